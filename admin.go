@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// adminSocketFlag is the -admin-socket flag value, the unix socket of the local admin API, eg: for the
+// node tooling and the Scaleway CLI instead of parsing the journal. Disabled if empty.
+var adminSocketFlag string
+
+// defaultAdminSocket is the admin socket path suggested in the flag usage
+const defaultAdminSocket = "/run/scw-k8s-agent/admin.sock"
+
+// AdminStatus is the response of the admin status endpoint
+//
+//	{
+//	   "node": "scw-pool-0123",
+//	   "agent_version": "1.4.0",
+//	   "components": {"containerd": "1.7.22", "kubelet": "1.31.2"},
+//	   "install": {"phase": "installed", ...},
+//	   "controller": {"running": true, "reconciling": false, "last_reconcile": "2024-10-07T10:00:00Z"}
+//	}
+type AdminStatus struct {
+	Node         string            `json:"node,omitempty"`
+	AgentVersion string            `json:"agent_version"`
+	Components   map[string]string `json:"components"`
+	Install      *NodeStatus       `json:"install,omitempty"` // Install of this process, none in the unprivileged controller
+	Controller   ControllerStatus  `json:"controller"`
+}
+
+type ControllerStatus struct {
+	Running       bool       `json:"running"`
+	Reconciling   bool       `json:"reconciling"`
+	LastReconcile *time.Time `json:"last_reconcile,omitempty"`
+	LastSyncError string     `json:"last_sync_error,omitempty"`
+}
+
+// adminController is the controller the admin operations are run by, nil until it is running
+var adminController atomic.Pointer[Controller]
+
+// adminLogs is the log stream of the operations, nil if the admin socket is disabled
+var adminLogs *logStream
+
+// maxLogStreamLines is the number of lines of the current operation kept for the new log readers
+const maxLogStreamLines = 2000
+
+// logStream keeps the log lines of the current operation, or of the last one, and sends the new lines
+// to the readers until the operation ends. The lines logged between the operations are not kept.
+type logStream struct {
+	mu      sync.Mutex
+	running bool
+	lines   [][]byte
+	readers map[chan []byte]struct{}
+}
+
+func newLogStream() *logStream {
+	return &logStream{readers: make(map[chan []byte]struct{})}
+}
+
+// Write receives a log line, the slow readers miss the lines instead of blocking the logging
+func (s *logStream) Write(p []byte) (int, error) {
+	line := slices.Clone(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return len(p), nil
+	}
+	if len(s.lines) >= maxLogStreamLines {
+		s.lines = s.lines[1:]
+	}
+	s.lines = append(s.lines, line)
+	for reader := range s.readers {
+		select {
+		case reader <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// startOperation drops the lines of the previous operation and keeps the lines of the new one
+func (s *logStream) startOperation() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = true
+	s.lines = nil
+}
+
+// endOperation stops keeping the lines, the streams of the readers end
+func (s *logStream) endOperation() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	for reader := range s.readers {
+		close(reader)
+		delete(s.readers, reader)
+	}
+}
+
+// follow returns the lines of the current operation and the channel of its next lines, closed once the
+// operation ends or once stopped. Without operation running, it returns the lines of the last one.
+func (s *logStream) follow() ([][]byte, <-chan []byte, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reader := make(chan []byte, 256)
+	if !s.running {
+		close(reader)
+		return slices.Clone(s.lines), reader, func() {}
+	}
+	s.readers[reader] = struct{}{}
+	stop := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.readers, reader)
+	}
+	return slices.Clone(s.lines), reader, stop
+}
+
+// captureAdminLogs streams the lines of the default logger, written through the log package
+func captureAdminLogs() {
+	adminLogs = newLogStream()
+	log.SetOutput(io.MultiWriter(os.Stderr, adminLogs))
+}
+
+// serveAdmin serves the admin API on the unix socket until the context is done. The socket is only
+// accessible by the agent user, eg: root.
+func serveAdmin(ctx context.Context, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create admin socket directory: %w", err)
+	}
+	// Remove the socket left by a previous agent process
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove admin socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin socket: %w", err)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("failed to chmod admin socket: %w", err)
+	}
+
+	captureAdminLogs()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", handleAdminStatus)
+	mux.HandleFunc("POST /v1/verify", handleAdminVerify)
+	mux.HandleFunc("POST /v1/upgrade", handleAdminUpgrade)
+	mux.HandleFunc("GET /v1/sbom", handleAdminSBOM)
+	mux.HandleFunc("GET /v1/logs", handleAdminLogs)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+		_ = os.Remove(path)
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Warn("Admin server stopped", slog.Any("error", err))
+		}
+	}()
+	slog.Info("Serving admin API", slog.String("socket", path))
+
+	return nil
+}
+
+func handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	versions, err := ListComponentsVersions()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, fmt.Errorf("failed to list components versions: %w", err))
+		return
+	}
+	adminStatus := AdminStatus{AgentVersion: Version, Components: versions}
+
+	statusMu.Lock()
+	if !status.StartedAt.IsZero() {
+		install := status
+		install.Components = slices.Clone(status.Components)
+		adminStatus.Install = &install
+	}
+	statusMu.Unlock()
+
+	if c := adminController.Load(); c != nil {
+		adminStatus.Node = c.nodeName
+		adminStatus.Controller.Running = true
+		adminStatus.Controller.Reconciling = c.reconciling.Load()
+		if lastReconcile := c.lastReconcile.Load(); lastReconcile > 0 {
+			lastReconcileTime := time.Unix(0, lastReconcile).UTC()
+			adminStatus.Controller.LastReconcile = &lastReconcileTime
+		}
+		if lastSyncError := c.lastSyncError.Load(); lastSyncError != nil {
+			adminStatus.Controller.LastSyncError = *lastSyncError
+		}
+	}
+
+	writeAdminJSON(w, http.StatusOK, adminStatus)
+}
+
+// handleAdminVerify checks the node health once, as the verify remote operation
+func handleAdminVerify(w http.ResponseWriter, r *http.Request) {
+	c := adminController.Load()
+	if c == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, fmt.Errorf("controller not running"))
+		return
+	}
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		writeAdminError(w, http.StatusServiceUnavailable, fmt.Errorf("failed to get node %s: %w", c.nodeName, err))
+		return
+	}
+
+	// The verify is run between the reconciles, the admin socket streams its logs
+	c.operationMu.Lock()
+	defer c.operationMu.Unlock()
+	adminLogs.startOperation()
+	defer adminLogs.endOperation()
+
+	operation := AgentOperation{Name: "verify"}
+	message, err := c.runRemoteOperation(r.Context(), node, operation, AuditEntry{Source: auditSource(r.Context()), Actor: "admin-socket"})
+	result := OperationResult{Operation: operation.String(), Status: "succeeded", Message: message, Time: time.Now().UTC()}
+	code := http.StatusOK
+	if err != nil {
+		result.Status, result.Message, code = "failed", err.Error(), http.StatusInternalServerError
+	}
+	writeAdminJSON(w, code, result)
+}
+
+// handleAdminUpgrade requests an upgrade with the agent annotation, so it runs with the maintenance
+// window, approval and concurrency of the other upgrades
+func handleAdminUpgrade(w http.ResponseWriter, r *http.Request) {
+	c := adminController.Load()
+	if c == nil {
+		writeAdminError(w, http.StatusServiceUnavailable, fmt.Errorf("controller not running"))
+		return
+	}
+	node, err := c.client.CoreV1().Nodes().Get(r.Context(), c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		writeAdminError(w, http.StatusServiceUnavailable, fmt.Errorf("failed to get node %s: %w", c.nodeName, err))
+		return
+	}
+	if value, exists := node.Annotations[agentAnnotation]; exists {
+		writeAdminError(w, http.StatusConflict, fmt.Errorf("operation %s already requested", value))
+		return
+	}
+
+	nodeCopy := node.DeepCopy()
+	if nodeCopy.Annotations == nil {
+		nodeCopy.Annotations = make(map[string]string)
+	}
+	nodeCopy.Annotations[agentAnnotation] = "upgrade"
+	_, err = c.client.CoreV1().Nodes().Update(r.Context(), nodeCopy, metav1.UpdateOptions{})
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, fmt.Errorf("failed to request upgrade on node %s: %w", c.nodeName, err))
+		return
+	}
+	c.logger.Info("Upgrade requested through the admin API", slog.String("source", auditSource(r.Context())))
+
+	writeAdminJSON(w, http.StatusAccepted, OperationResult{Operation: "upgrade", Status: "requested", Message: "Upgrade requested, see the node events and conditions", Time: time.Now().UTC()})
+}
+
+// handleAdminLogs streams the log lines of the current operation, eg: a reconcile or a verify, until it
+// ends or the client disconnects, or the lines of the last operation. With -controller-user, the lines
+// of the root agent process are not streamed, they are only in its journal.
+func handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	lines, next, stop := adminLogs.follow()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	for _, line := range lines {
+		_, _ = w.Write(line)
+	}
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case line, ok := <-next:
+			if !ok {
+				return
+			}
+			_, err := w.Write(line)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleAdminSBOM returns the SBOM of the components installed, as written after the last install
+func handleAdminSBOM(w http.ResponseWriter, r *http.Request) {
+	jsonSBOM, err := os.ReadFile(hostPath(sbomFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("no SBOM written yet"))
+		return
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, fmt.Errorf("failed to read SBOM: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.cyclonedx+json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(jsonSBOM)
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, map[string]string{"error": err.Error()})
+}
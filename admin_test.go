@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestAdminSocket(t *testing.T) {
+	defer func(original string) { rootDir = original }(rootDir)
+	rootDir = t.TempDir()
+	defer func() {
+		log.SetOutput(os.Stderr)
+		adminLogs = nil
+		adminController.Store(nil)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	socket := filepath.Join(t.TempDir(), "run", "admin.sock")
+	err := serveAdmin(ctx, socket)
+	if err != nil {
+		t.Fatalf("failed to serve admin API: %v", err)
+	}
+	info, err := os.Stat(socket)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected admin socket %v, %v", info, err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	// The status is served before the controller runs, the operations are not
+	resp, err := client.Get("http://admin/v1/status")
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	var adminStatus AdminStatus
+	err = json.NewDecoder(resp.Body).Decode(&adminStatus)
+	_ = resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || adminStatus.AgentVersion != Version || adminStatus.Controller.Running {
+		t.Errorf("unexpected status %d %+v, %v", resp.StatusCode, adminStatus, err)
+	}
+	resp, err = client.Post("http://admin/v1/upgrade", "", nil)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the upgrade to be unavailable, got %v, %v", resp, err)
+	}
+	_ = resp.Body.Close()
+
+	// The upgrade is requested with the agent annotation, once
+	nodeClient := fake.NewClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}})
+	adminController.Store(&Controller{nodeName: "node", client: nodeClient, logger: slog.Default()})
+	for _, expected := range []int{http.StatusAccepted, http.StatusConflict} {
+		resp, err = client.Post("http://admin/v1/upgrade", "", nil)
+		if err != nil || resp.StatusCode != expected {
+			t.Errorf("expected status %d, got %v, %v", expected, resp, err)
+		}
+		_ = resp.Body.Close()
+	}
+	node, err := nodeClient.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+	if err != nil || node.Annotations[agentAnnotation] != "upgrade" {
+		t.Errorf("expected the upgrade annotation, got %v, %v", node.Annotations, err)
+	}
+
+	// The verify waits for the reconcile in progress
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err = indexer.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Controller{nodeName: "node", client: nodeClient, nodesLister: corelisters.NewNodeLister(indexer), privileged: operationPrivileged{}, recorder: newEventRecorder(ctx, nodeClient, "node"), logger: slog.Default()}
+	adminController.Store(c)
+	c.operationMu.Lock()
+	verified := make(chan int)
+	go func() {
+		resp, err := client.Post("http://admin/v1/verify", "", nil)
+		if err != nil {
+			verified <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		verified <- resp.StatusCode
+	}()
+	select {
+	case code := <-verified:
+		t.Fatalf("expected the verify to wait for the reconcile, got %d", code)
+	case <-time.After(200 * time.Millisecond):
+	}
+	c.operationMu.Unlock()
+	if code := <-verified; code != http.StatusInternalServerError {
+		t.Errorf("expected the verify denied by the node metadata, got %d", code)
+	}
+
+	// The logs of the current operation are streamed, then the next ones until it ends
+	adminLogs.startOperation()
+	slog.Info("Admin test first line")
+	logsCtx, logsCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer logsCancel()
+	readLogs := func() []string {
+		t.Helper()
+		req, err := http.NewRequestWithContext(logsCtx, http.MethodGet, "http://admin/v1/logs", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to get logs: %v", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read logs: %v", err)
+		}
+		return strings.Split(strings.TrimSpace(string(body)), "\n")
+	}
+	done := make(chan []string)
+	go func() { done <- readLogs() }()
+	time.Sleep(100 * time.Millisecond)
+	slog.Info("Admin test next line")
+	adminLogs.endOperation()
+	lines := <-done
+	if len(lines) != 2 || !strings.Contains(lines[0], "Admin test first line") || !strings.Contains(lines[1], "Admin test next line") {
+		t.Errorf("unexpected log lines %q", lines)
+	}
+
+	// The lines logged between the operations are not kept, the last operation is streamed
+	slog.Info("Admin test line between the operations")
+	lines = readLogs()
+	if len(lines) != 2 || !strings.Contains(lines[1], "Admin test next line") {
+		t.Errorf("expected the lines of the last operation, got %q", lines)
+	}
+}
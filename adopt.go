@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ComponentAdopt detects the version of a component installed by a previous tooling, so a legacy node
+// switched to the agent does not reinstall it
+//
+//	adopt:
+//	  command: ["/usr/local/bin/kubelet", "--version"]
+//	  version_regexp: 'Kubernetes v(\S+)'
+//	  units: ["kubelet.service"]
+type ComponentAdopt struct {
+	Command       []string `yaml:"command"`         // Command printing the installed version
+	VersionRegexp string   `yaml:"version_regexp"`  // The first group of the regexp is the version
+	Units         []string `yaml:"units,omitempty"` // Units which must be loaded
+	Files         []string `yaml:"files,omitempty"` // Files which must exist
+}
+
+// probe returns the version of the component installed by a previous tooling, empty if not installed
+func (a ComponentAdopt) probe() (string, error) {
+	if len(a.Command) == 0 || !strings.HasPrefix(a.Command[0], "/") {
+		return "", fmt.Errorf("invalid adopt command %q, expected an absolute path", a.Command)
+	}
+	versionRegexp, err := regexp.Compile(a.VersionRegexp)
+	if err != nil || versionRegexp.NumSubexp() < 1 {
+		return "", fmt.Errorf("invalid adopt version regexp %q, expected a group matching the version", a.VersionRegexp)
+	}
+
+	// The units and files must be present
+	for _, path := range a.Files {
+		exists, err := fileExists(path)
+		if err != nil || !exists {
+			return "", err
+		}
+	}
+	for _, unit := range a.Units {
+		output, err := command("/usr/bin/systemctl", "show", "--property=LoadState", unit).Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to get unit %s state: %w", unit, err)
+		}
+		if strings.TrimSpace(string(output)) != "LoadState=loaded" {
+			return "", nil
+		}
+	}
+
+	// The binary is probed last, it may not exist
+	exists, err := fileExists(a.Command[0])
+	if err != nil || !exists {
+		return "", err
+	}
+	output, err := command(a.Command[0], a.Command[1:]...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run %s: %w: %s", strings.Join(a.Command, " "), err, output)
+	}
+	match := versionRegexp.FindSubmatch(output)
+	if match == nil {
+		return "", nil
+	}
+
+	return string(match[1]), nil
+}
+
+// probeAdopt returns the version of the component installed by a previous tooling
+var probeAdopt = func(adopt ComponentAdopt) (string, error) {
+	return adopt.probe()
+}
+
+// adoptComponents records the components installed by a previous tooling as installed, on the first
+// install with the AdoptInstallations feature gate. Only the components with an adopt section in the
+// metadata of the release version, and probed with this version, are adopted: the other ones are
+// installed. The files of the adopted components are kept, and their node specific resources
+// (templates, kubeconfigs, directories, services and scripts) are processed.
+func adoptComponents(ctx context.Context, repoFS fs.FS, nodemetadata NodeMetadata, components []Component, upgrade bool) error {
+	if upgrade || serviceManager == chrootServiceManager || !nodemetadata.featureEnabled(FeatureAdoptInstallations) {
+		return nil
+	}
+	versions, err := ListComponentsVersions()
+	if err != nil {
+		return fmt.Errorf("failed to list components versions: %w", err)
+	}
+	if len(versions) > 0 {
+		return nil
+	}
+
+	for _, component := range components {
+		if component.Source != nil {
+			continue
+		}
+		expectedVersion := expandVersion(component.Version, nodemetadata.PoolVersion)
+		componentSections, componentFS, funcs, err := openComponentInstall(repoFS, nil, component.Name, expectedVersion, nodemetadata)
+		if err != nil {
+			return err
+		}
+		if componentSections.Adopt == nil {
+			continue
+		}
+
+		logger := componentLogger(component.Name, expectedVersion, "adopt")
+		version, err := probeAdopt(*componentSections.Adopt)
+		if err != nil {
+			logger.Warn("Failed to probe component, installing it", slog.Any("error", err))
+			continue
+		}
+		if version == "" {
+			logger.Info("Component not installed, installing it")
+			continue
+		}
+		if version != trimVersion(expectedVersion) && version != expectedVersion {
+			logger.Info("Component installed with another version, installing it", slog.String("installed", version))
+			continue
+		}
+
+		// Back up the existing files of the install, the reset restores them. The files are kept and
+		// not managed, the node specific resources are processed and managed.
+		err = backupAdoptedFiles(logger, component.Name, expectedVersion, componentSections, nodemetadata)
+		if err != nil {
+			return err
+		}
+		var resources []ComponentResources
+		for _, resource := range componentSections.Install {
+			resource.Files = slices.DeleteFunc(slices.Clone(resource.Files), func(file ComponentFile) bool {
+				return file.State == "file" || file.State == "file_if_absent"
+			})
+			resources = append(resources, resource)
+		}
+
+		// The version probed is recorded, a component probed without the release suffix is then upgraded
+		err = processComponentMetadata(ctx, logger, componentFS, component.Name, version, resources, funcs, nodemetadata)
+		if err != nil {
+			return fmt.Errorf("failed to adopt component %s: %w", component.Name, err)
+		}
+		err = recordComponentRepo(component.Name, nodemetadata.RepoURI)
+		if err != nil {
+			return err
+		}
+		setComponentStatus(component.Name, version, "installed")
+		logger.Info("Component adopted", slog.String("installed", version))
+	}
+
+	return nil
+}
+
+// backupAdoptedFiles backs up the existing files of the component install, they are then taken over
+func backupAdoptedFiles(logger *slog.Logger, name, version string, sections ComponentSections, nodemetadata NodeMetadata) error {
+	for _, resources := range sections.Install {
+		for _, file := range resources.Files {
+			if file.State != "file" && file.State != "template" && file.State != "kubeconfig" {
+				continue
+			}
+			src, err := templateComponentPath(file.sourceName(), version)
+			if err != nil {
+				return fmt.Errorf("failed to template source path: %w", err)
+			}
+			dst, err := templateComponentPath(file.Dst, version)
+			if err != nil {
+				return fmt.Errorf("failed to template destination path: %w", err)
+			}
+			path := destinationPath(src, nodemetadata.componentPath(name, dst))
+
+			_, err = os.Lstat(hostPath(path))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to stat %s: %w", path, err)
+			}
+			err = backupTakenOverFile(logger, path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// writeVersionScript writes a script printing the output, under the root directory and at its path
+func writeVersionScript(t *testing.T, output string) string {
+	t.Helper()
+	script := filepath.Join(t.TempDir(), "version.sh")
+	for _, path := range []string{script, hostPath(script)} {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte("#!/bin/sh\necho '"+output+"'\n"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return script
+}
+
+func TestComponentAdoptProbe(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = systemdServiceManager
+
+	script := writeVersionScript(t, "Kubernetes v1.31.2")
+	tests := []struct {
+		name     string
+		adopt    ComponentAdopt
+		expected string
+		err      string
+	}{
+		{name: "version", adopt: ComponentAdopt{Command: []string{script}, VersionRegexp: `Kubernetes v(\S+)`}, expected: "1.31.2"},
+		{name: "no match", adopt: ComponentAdopt{Command: []string{script}, VersionRegexp: `containerd (\S+)`}},
+		{name: "missing binary", adopt: ComponentAdopt{Command: []string{"/usr/local/bin/missing", "--version"}, VersionRegexp: `v(\S+)`}},
+		{name: "missing file", adopt: ComponentAdopt{Command: []string{script}, VersionRegexp: `v(\S+)`, Files: []string{"/etc/kubernetes/kubelet.conf"}}},
+		{name: "relative command", adopt: ComponentAdopt{Command: []string{"kubelet"}, VersionRegexp: `v(\S+)`}, err: "expected an absolute path"},
+		{name: "no group", adopt: ComponentAdopt{Command: []string{script}, VersionRegexp: `v\S+`}, err: "expected a group"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, err := test.adopt.probe()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if version != test.expected {
+				t.Errorf("version = %q, expected %q", version, test.expected)
+			}
+		})
+	}
+}
+
+func TestAdoptComponents(t *testing.T) {
+	defer func(previousRoot, previousManager string, previousProbe func(ComponentAdopt) (string, error)) {
+		rootDir, serviceManager, probeAdopt = previousRoot, previousManager, previousProbe
+	}(rootDir, serviceManager, probeAdopt)
+	rootDir = t.TempDir()
+
+	// The versions are probed for real, the other commands are recorded
+	probeAdopt = func(adopt ComponentAdopt) (string, error) {
+		serviceManager = systemdServiceManager
+		defer func() { serviceManager = fakeServiceManager }()
+		return adopt.probe()
+	}
+	serviceManager = fakeServiceManager
+	err := os.MkdirAll(filepath.Join(rootDir, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The kubelet is installed with the release version, the CNI plugins with another version
+	kubelet := writeVersionScript(t, "Kubernetes v1.31.2")
+	cni := writeVersionScript(t, "CNI plugins v1.4.0")
+	for path, content := range map[string]string{"/usr/local/bin/kubelet": "kubelet", "/etc/kubernetes/kubelet.conf": "legacy"} {
+		err = os.MkdirAll(filepath.Dir(hostPath(path)), 0755)
+		if err == nil {
+			err = os.WriteFile(hostPath(path), []byte(content), 0755)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	repoFS := fstest.MapFS{
+		"kubelet/metadata.yaml": {Data: []byte(`versions:
+  1.31.2:
+    install:
+      - files:
+          - {state: file, src: kubelet, dst: /usr/local/bin/}
+          - {state: file, src: kubelet.service, dst: /etc/systemd/system/}
+          - {state: template, src: kubelet.conf, dst: /etc/kubernetes/}
+    adopt:
+      command: ["` + kubelet + `", "--version"]
+      version_regexp: 'Kubernetes v(\S+)'
+`)},
+		"kubelet/kubelet.conf": {Data: []byte("pool {{ .PoolVersion }}")},
+		"cni/metadata.yaml": {Data: []byte(`versions:
+  1.5.1:
+    adopt:
+      command: ["` + cni + `"]
+      version_regexp: 'v(\S+)'
+`)},
+		"containerd/metadata.yaml": {Data: []byte("versions:\n  1.7.22: {}\n")},
+	}
+	components := []Component{{Name: "containerd", Version: "1.7.22"}, {Name: "cni", Version: "1.5.1"}, {Name: "kubelet", Version: "~"}}
+	nodemetadata := NodeMetadata{PoolVersion: "1.31.2", RepoURI: "https://repo.example.com/k8s"}
+
+	// Not adopted without the feature gate
+	err = adoptComponents(context.Background(), repoFS, nodemetadata, components, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := ListComponentsVersions()
+	if err != nil || len(versions) != 0 {
+		t.Fatalf("unexpected versions %v, %v", versions, err)
+	}
+
+	nodemetadata.FeatureGates = map[string]bool{FeatureAdoptInstallations: true}
+	err = adoptComponents(context.Background(), repoFS, nodemetadata, components, false)
+	if err != nil {
+		t.Fatalf("failed to adopt components: %v", err)
+	}
+	versions, err = ListComponentsVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The version probed is recorded, without the release suffix
+	if len(versions) != 1 || versions["kubelet"] != "1.31.2" {
+		t.Errorf("unexpected versions %v", versions)
+	}
+
+	// The existing files of the adopted component are kept and backed up, the templates are rendered
+	for path, expected := range map[string]string{"/usr/local/bin/kubelet": "kubelet", "/etc/kubernetes/kubelet.conf": "pool 1.31.2"} {
+		content, err := os.ReadFile(hostPath(path))
+		if err != nil || string(content) != expected {
+			t.Errorf("%s = %q, %v, expected %q", path, content, err, expected)
+		}
+	}
+	for path, expected := range map[string]string{"/usr/local/bin/kubelet": "kubelet", "/etc/kubernetes/kubelet.conf": "legacy"} {
+		content, err := os.ReadFile(hostPath(filepath.Join(takeoverBackupDir, path)))
+		if err != nil || string(content) != expected {
+			t.Errorf("backup of %s = %q, %v, expected %q", path, content, err, expected)
+		}
+	}
+
+	// Only the rendered files are managed, the reset does not remove the files kept
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(managedFiles) != 1 || managedFiles["/etc/kubernetes/kubelet.conf"] != "kubelet" {
+		t.Errorf("unexpected managed files %v", managedFiles)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// apiReadyTimeout is the maximum time to wait for the Kubernetes API, eg: while the control plane of
+// a new cluster is still provisioning
+var apiReadyTimeout = 10 * time.Minute
+
+// Backoff between the Kubernetes API checks, and timeout of each check
+var (
+	apiCheckInitialDelay = time.Second
+	apiCheckMaxDelay     = 30 * time.Second
+	apiCheckTimeout      = 10 * time.Second
+)
+
+// errAPIUnavailable is returned when the Kubernetes API does not answer within apiReadyTimeout
+var errAPIUnavailable = errors.New("kubernetes API not reachable")
+
+// waitForAPIServer waits for the Kubernetes API to answer the node Get, with an exponential backoff.
+// The API answers once the node is found or not registered yet, the rejected credentials are not
+// retried.
+func waitForAPIServer(ctx context.Context, client kubernetes.Interface, clusterURL, nodeName string) error {
+	start := time.Now()
+	deadline := start.Add(apiReadyTimeout)
+	delay := apiCheckInitialDelay
+	for attempt := 1; ; attempt++ {
+		checkCtx, cancel := context.WithTimeout(ctx, apiCheckTimeout)
+		_, err := client.CoreV1().Nodes().Get(checkCtx, nodeName, metav1.GetOptions{})
+		cancel()
+		if err == nil || apierrors.IsNotFound(err) {
+			if attempt > 1 {
+				slog.Info("Kubernetes API reachable", slog.String("url", clusterURL), slog.Duration("waited", time.Since(start).Round(time.Second)))
+			}
+			return nil
+		}
+		if apierrors.IsUnauthorized(err) || apierrors.IsForbidden(err) {
+			return fmt.Errorf("%w: %w", errControllerAuth, err)
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("%w: %s did not answer after %s, the control plane may still be provisioning: %w", errAPIUnavailable, clusterURL, apiReadyTimeout, err)
+		}
+		slog.Info("Waiting for Kubernetes API", slog.String("url", clusterURL), slog.Int("attempt", attempt), slog.Duration("elapsed", time.Since(start).Round(time.Second)), slog.Duration("retry_in", delay), slog.Any("reason", err))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("context cancelled: %w", context.Cause(ctx))
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, apiCheckMaxDelay)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWaitForAPIServer(t *testing.T) {
+	defer func(timeout, initial, max time.Duration) {
+		apiReadyTimeout, apiCheckInitialDelay, apiCheckMaxDelay = timeout, initial, max
+	}(apiReadyTimeout, apiCheckInitialDelay, apiCheckMaxDelay)
+	apiReadyTimeout, apiCheckInitialDelay, apiCheckMaxDelay = 200*time.Millisecond, 10*time.Millisecond, 20*time.Millisecond
+
+	unreachable := errors.New("dial tcp 10.0.0.1:6443: connect: connection refused")
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		expected error
+	}{
+		{name: "reachable"},
+		{name: "node not registered", err: apierrors.NewNotFound(schema.GroupResource{Resource: "nodes"}, "node")},
+		{name: "reachable after retries", failures: 3, err: unreachable},
+		{name: "unreachable", failures: 1000, err: unreachable, expected: errAPIUnavailable},
+		{name: "unauthorized", failures: 1000, err: apierrors.NewUnauthorized("invalid token"), expected: errControllerAuth},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			calls := 0
+			client.PrependReactor("get", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				calls++
+				if test.failures == 0 || calls <= test.failures {
+					return test.err != nil, nil, test.err
+				}
+				return false, nil, nil
+			})
+
+			err := waitForAPIServer(context.Background(), client, "https://k8s.example.com:6443", "node")
+			if !errors.Is(err, test.expected) || (test.expected == nil && err != nil) {
+				t.Fatalf("expected error %v, got %v", test.expected, err)
+			}
+			if test.err != nil && test.expected == nil && test.failures > 0 && calls != test.failures+1 {
+				t.Errorf("expected %d calls, got %d", test.failures+1, calls)
+			}
+			if errors.Is(test.expected, errControllerAuth) && calls != 1 {
+				t.Errorf("expected the rejected credentials not retried, got %d calls", calls)
+			}
+		})
+	}
+}
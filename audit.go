@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The remote operations (reinstall, restart, verify and decommission) are disabled unless allowed by the node metadata
+// endpoint, they are not allowed by the metadata ConfigMap since it can be changed from the cluster
+//
+//	"remote_operations": ["restart", "verify"]
+var remoteOperations = []string{"reinstall", "restart", "verify", "decommission"}
+
+// privilegedRemoteOperations are the remote operations run by the root agent process, it records them in
+// the audit log itself so the controller cannot forge or skip their entries
+var privilegedRemoteOperations = []string{"reinstall", "restart", "decommission"}
+
+// auditLog records the remote operations requested to the agent, one JSON entry per line
+//
+//	{"time":"2024-10-07T10:00:00Z","source":"annotation","operation":"restart=kubelet","actor":"kubectl-annotate","requested_at":"2024-10-07T09:59:58Z","status":"started"}
+var auditLog = filepath.Join(stateDir, "audit.log")
+
+// The audit log is rotated once it would exceed auditLogMaxSize, the rotated logs are kept as
+// audit.log.1 (the newest) to audit.log.<auditLogBackups>, so the audit takes at most
+// (auditLogBackups + 1) * auditLogMaxSize bytes, eg: when a denied operation is requested in a loop
+var (
+	auditLogMaxSize int64 = 10 << 20
+	auditLogBackups       = 3
+)
+
+// auditMutex serializes the audit log appends and rotations of the process
+var auditMutex sync.Mutex
+
+// AuditEntry is a remote operation recorded in the audit log
+type AuditEntry struct {
+	Time        time.Time  `json:"time"`
+	Source      string     `json:"source"` // annotation, NodeOperation namespace/name, deletion, admin, remote-api or component name and version
+	Operation   string     `json:"operation"`
+	Actor       string     `json:"actor"`                  // Field manager of the operation request, eg: kubectl-annotate
+	RequestedAt *time.Time `json:"requested_at,omitempty"` // Time the actor requested the operation
+	Status      string     `json:"status"`                 // denied, started, succeeded or failed
+	Message     string     `json:"message,omitempty"`
+	Digest      string     `json:"digest,omitempty"`   // Digest of the component script run
+	Reporter    string     `json:"reporter,omitempty"` // controller for the entries reported by the unprivileged controller process
+}
+
+// remoteOperationAllowed returns whether the remote operation is allowed by the node metadata, the
+// operations which are not remote (upgrade, restore, plan) are always allowed
+func (m NodeMetadata) remoteOperationAllowed(operation string) bool {
+	return !slices.Contains(remoteOperations, operation) || slices.Contains(m.RemoteOperations, operation)
+}
+
+// appendAudit appends the entry to the audit log
+func appendAudit(entry AuditEntry) error {
+	jsonEntry, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	// Rotate the log before it exceeds its maximum size
+	info, err := os.Stat(hostPath(auditLog))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	if err == nil && info.Size() > 0 && info.Size()+int64(len(jsonEntry))+1 > auditLogMaxSize {
+		err = rotateAuditLog()
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(hostPath(auditLog), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	_, err = file.Write(append(jsonEntry, '\n'))
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+
+	return file.Close()
+}
+
+// auditRemoteOperation runs the privileged remote operation if allowed by the node metadata, it is
+// recorded in the audit log before and after running it, and not run if it cannot be recorded
+func auditRemoteOperation(ctx context.Context, operation AgentOperation, request RemoteOperationRequest, run func(NodeMetadata) (string, error)) error {
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: failed to get node metadata: %w", errOperationNotStarted, err)
+	}
+	audit := AuditEntry{Source: request.Source, Operation: operation.String(), Actor: request.Actor, RequestedAt: request.RequestedAt}
+
+	if !nodeMetadata.remoteOperationAllowed(operation.Name) {
+		err = fmt.Errorf("operation %s is not allowed by the node metadata remote operations policy", operation.Name)
+		recordAudit(audit, "denied", err.Error())
+		return err
+	}
+	if request.Source == "deletion" && !nodeMetadata.DecommissionOnDelete {
+		err = fmt.Errorf("operation %s on the node deletion is not allowed by the node metadata", operation.Name)
+		recordAudit(audit, "denied", err.Error())
+		return err
+	}
+
+	audit.Time = time.Now().UTC()
+	audit.Status = "started"
+	err = appendAudit(audit)
+	if err != nil {
+		return fmt.Errorf("%w: failed to record operation in the audit log: %w", errOperationNotStarted, err)
+	}
+
+	message, err := run(nodeMetadata)
+	if err != nil {
+		recordAudit(audit, "failed", err.Error())
+		return err
+	}
+	recordAudit(audit, "succeeded", message)
+
+	return nil
+}
+
+// recordAudit records the result of the operation in the audit log, the failures are only logged since
+// the operation is already recorded as started
+func recordAudit(audit AuditEntry, status, message string) {
+	audit.Time = time.Now().UTC()
+	audit.Status = status
+	audit.Message = message
+	err := appendAudit(audit)
+	if err != nil {
+		slog.Warn("Failed to record operation in the audit log", slog.String("operation", audit.Operation), slog.Any("error", err))
+	}
+}
+
+// recordReportedAudit records the entry reported by the controller, marked with its reporter. The
+// controller cannot record the start or the result of the privileged remote operations, nor a script
+// digest, nor the remote API requests other than the verify, and the time of the entry is the time it
+// is recorded.
+func recordReportedAudit(entry AuditEntry) error {
+	if !slices.Contains([]string{"denied", "deferred", "started", "succeeded", "failed"}, entry.Status) {
+		return fmt.Errorf("invalid audit status %q", entry.Status)
+	}
+	if entry.Digest != "" {
+		return fmt.Errorf("script digests are only recorded by the root agent process")
+	}
+	operation, err := parseAgentOperation(entry.Operation)
+	if entry.Source == remoteAPISource && (err != nil || operation.Name != "verify") {
+		return fmt.Errorf("remote API requests are recorded by the root agent process")
+	}
+	if err == nil && slices.Contains(privilegedRemoteOperations, operation.Name) && entry.Status != "denied" && entry.Status != "deferred" {
+		return fmt.Errorf("operation %s is recorded by the root agent process", operation.Name)
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.Reporter = "controller"
+	return appendAudit(entry)
+}
+
+// rotateAuditLog shifts the rotated audit logs, the oldest one is removed
+func rotateAuditLog() error {
+	for i := auditLogBackups; i > 0; i-- {
+		previous := hostPath(auditLog)
+		if i > 1 {
+			previous = hostPath(fmt.Sprintf("%s.%d", auditLog, i-1))
+		}
+		err := os.Rename(previous, hostPath(fmt.Sprintf("%s.%d", auditLog, i)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	if auditLogBackups == 0 {
+		err := os.Remove(hostPath(auditLog))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// isAuditLog returns whether the state file is the audit log or one of its rotated logs
+func isAuditLog(name string) bool {
+	base := filepath.Base(auditLog)
+	return name == base || strings.HasPrefix(name, base+".")
+}
+
+// fieldManager returns the last manager which set the field (eg: "metadata", "annotations", "k8s.scaleway.com/agent")
+// and when, from the object managed fields. The manager is empty if unknown.
+func fieldManager(managedFields []metav1.ManagedFieldsEntry, path ...string) (string, *time.Time) {
+	var manager string
+	var managedAt *time.Time
+	for _, entry := range managedFields {
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]any
+		err := json.Unmarshal(entry.FieldsV1.Raw, &fields)
+		if err != nil {
+			continue
+		}
+
+		// Walk the fields set by the manager
+		found := true
+		for _, field := range path {
+			fields, found = fields["f:"+field].(map[string]any)
+			if !found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		if manager == "" || (entry.Time != nil && (managedAt == nil || entry.Time.After(*managedAt))) {
+			manager = entry.Manager
+			managedAt = nil
+			if entry.Time != nil {
+				managedAt = &entry.Time.Time
+			}
+		}
+	}
+
+	return manager, managedAt
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRemoteOperationAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   []string
+		operation string
+		want      bool
+	}{
+		{name: "disabled by default", operation: "restart", want: false},
+		{name: "allowed", allowed: []string{"restart", "verify"}, operation: "restart", want: true},
+		{name: "not allowed", allowed: []string{"verify"}, operation: "reinstall", want: false},
+		{name: "upgrade always allowed", operation: "upgrade", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := NodeMetadata{RemoteOperations: tt.allowed}
+			if got := metadata.remoteOperationAllowed(tt.operation); got != tt.want {
+				t.Errorf("remoteOperationAllowed(%q) = %v, want %v", tt.operation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldManager(t *testing.T) {
+	earlier := metav1.NewTime(time.Date(2024, 10, 7, 9, 0, 0, 0, time.UTC))
+	later := metav1.NewTime(time.Date(2024, 10, 7, 10, 0, 0, 0, time.UTC))
+	managedFields := []metav1.ManagedFieldsEntry{
+		{Manager: "kubelet", Time: &later, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:status":{"f:conditions":{}}}`)}},
+		{Manager: "kubectl-annotate", Time: &earlier, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:k8s.scaleway.com/agent":{}}}}`)}},
+		{Manager: "support-tool", Time: &later, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:k8s.scaleway.com/agent":{},"f:other":{}}}}`)}},
+		{Manager: "agent", Time: &later, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:k8s.scaleway.com/agent-result":{}}}}`)}},
+	}
+
+	manager, managedAt := fieldManager(managedFields, "metadata", "annotations", agentAnnotation)
+	if manager != "support-tool" || managedAt == nil || !managedAt.Equal(later.Time) {
+		t.Errorf("fieldManager() = %q, %v, want support-tool, %v", manager, managedAt, later)
+	}
+
+	manager, managedAt = fieldManager(managedFields, "spec")
+	if manager != "" || managedAt != nil {
+		t.Errorf("fieldManager() = %q, %v, want no manager", manager, managedAt)
+	}
+}
+
+func TestAppendAudit(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	for _, status := range []string{"started", "succeeded"} {
+		err := appendAudit(AuditEntry{Time: time.Now().UTC(), Source: "annotation", Operation: "restart=kubelet", Actor: "kubectl-annotate", Status: status})
+		if err != nil {
+			t.Fatalf("failed to append audit entry: %v", err)
+		}
+	}
+
+	file, err := os.Open(filepath.Join(rootDir, auditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+	var statuses []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("invalid audit entry %q: %v", scanner.Text(), err)
+		}
+		statuses = append(statuses, entry.Status)
+	}
+	if len(statuses) != 2 || statuses[0] != "started" || statuses[1] != "succeeded" {
+		t.Errorf("audit statuses = %v", statuses)
+	}
+}
+
+func TestAppendAuditRotation(t *testing.T) {
+	defer func(previousRoot string, previousMaxSize int64, previousBackups int) {
+		rootDir, auditLogMaxSize, auditLogBackups = previousRoot, previousMaxSize, previousBackups
+	}(rootDir, auditLogMaxSize, auditLogBackups)
+	rootDir = t.TempDir()
+	auditLogMaxSize, auditLogBackups = 400, 2
+
+	// Each entry takes about 150 bytes, so each log holds two entries
+	for range 10 {
+		err := appendAudit(AuditEntry{Time: time.Now().UTC(), Source: "annotation", Operation: "restart=kubelet", Actor: "kubectl-annotate", Status: "denied"})
+		if err != nil {
+			t.Fatalf("failed to append audit entry: %v", err)
+		}
+	}
+
+	// The oldest logs are removed, the kept logs do not exceed the maximum size
+	for _, name := range []string{auditLog, auditLog + ".1", auditLog + ".2"} {
+		info, err := os.Stat(filepath.Join(rootDir, name))
+		if err != nil {
+			t.Fatalf("expected %s kept: %v", name, err)
+		}
+		if info.Size() > auditLogMaxSize {
+			t.Errorf("%s size = %d, expected at most %d", name, info.Size(), auditLogMaxSize)
+		}
+	}
+	_, err := os.Stat(filepath.Join(rootDir, auditLog+".3"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected %s.3 removed, got %v", auditLog, err)
+	}
+}
+
+func TestAuditRemoteOperation(t *testing.T) {
+	defer func(previousRoot, previousManager string, previousMetadata func(context.Context) (NodeMetadata, error)) {
+		rootDir, serviceManager, privilegedNodeMetadata = previousRoot, previousManager, previousMetadata
+	}(rootDir, serviceManager, privilegedNodeMetadata)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+	serveFakeCRI(t)
+	privilegedNodeMetadata = func(ctx context.Context) (NodeMetadata, error) {
+		return NodeMetadata{RemoteOperations: []string{"restart"}}, nil
+	}
+
+	// The restart is recorded by the root agent process with the actor of the request
+	request := RemoteOperationRequest{Arg: "kubelet", Source: "annotation", Actor: "kubectl-annotate"}
+	err := localPrivileged{}.RestartService(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(hostPath(auditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var entry AuditEntry
+		err = json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("invalid audit entry %q: %v", line, err)
+		}
+		if entry.Operation != "restart=kubelet" || entry.Actor != "kubectl-annotate" || entry.Reporter != "" {
+			t.Errorf("unexpected audit entry %+v", entry)
+		}
+		statuses = append(statuses, entry.Status)
+	}
+	if !slices.Equal(statuses, []string{"started", "succeeded"}) {
+		t.Errorf("audit statuses = %v", statuses)
+	}
+
+	// The operation is not run if it cannot be recorded
+	err = os.Remove(hostPath(auditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(hostPath(auditLog), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = localPrivileged{}.RestartService(context.Background(), request)
+	if !errors.Is(err, errOperationNotStarted) {
+		t.Errorf("expected the restart not started, got %v", err)
+	}
+	commands, err := os.ReadFile(hostPath(commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(commands), "systemctl restart kubelet") != 1 {
+		t.Errorf("expected the restart not run again, got commands %q", commands)
+	}
+}
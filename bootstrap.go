@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// errBootstrapTimeout is returned when the initial install of the node exceeds the bootstrap timeout,
+// the agent exits with exitBootstrap so the control plane can replace the node
+var errBootstrapTimeout = errors.New("bootstrap timeout exceeded")
+
+// bootstrapNode runs the initial install of the node within the timeout, no timeout if 0. The admin
+// socket streams its logs as an operation.
+func bootstrapNode(ctx context.Context, nodemetadata NodeMetadata, timeout time.Duration) error {
+	adminLogs.startOperation()
+	defer adminLogs.endOperation()
+	return installWithTimeout(ctx, timeout, func(ctx context.Context) error {
+		return processComponents(ctx, nodemetadata, false)
+	})
+}
+
+// bootstrapEventTimeout is the timeout of the release event of the initial install, the node may not be
+// registered yet and the API server not reachable
+const bootstrapEventTimeout = 10 * time.Second
+
+// reportBootstrapRelease reports the missing release or the closest release installed instead of the
+// node pool version by the initial install with a node event, as the controller for the upgrades. The
+// event is only logged if it cannot be created.
+func reportBootstrapRelease(ctx context.Context, nodemetadata NodeMetadata, installErr error) {
+	reason, message := bootstrapReleaseEvent(nodemetadata, installErr, statusFallbackRelease())
+	if reason == "" {
+		return
+	}
+
+	client, err := newKubernetesClient(nodemetadata)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(ctx, bootstrapEventTimeout)
+		defer cancel()
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodemetadata.Name}}
+		err = createNodeEvents(ctx, client, node, eventReportingController+"-"+nodemetadata.Name, reason, message)
+	}
+	if err != nil {
+		slog.Warn("Failed to report release event", slog.String("reason", reason), slog.Any("error", err))
+	}
+}
+
+// bootstrapReleaseEvent returns the reason and the message of the release event of the initial install,
+// none if the release of the node pool version was installed
+func bootstrapReleaseEvent(nodemetadata NodeMetadata, installErr error, fallback string) (string, string) {
+	switch {
+	case errors.Is(installErr, errReleaseNotFound):
+		return "ReleaseNotFound", fmt.Sprintf("No release for the node pool version in repository %s: %s", nodemetadata.RepoURI, installErr)
+	case installErr == nil && fallback != "":
+		return "ReleaseFallback", releaseFallbackMessage(nodemetadata.PoolVersion, nodemetadata.RepoURI, fallback)
+	}
+	return "", ""
+}
+
+// installWithTimeout runs the install within the timeout. Once exceeded, the partial install is
+// recorded in the status as failed without waiting for the install step in progress, eg: a blocked
+// script.
+func installWithTimeout(ctx context.Context, timeout time.Duration, install func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return install(ctx)
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%w: node not installed after %s", errBootstrapTimeout, timeout))
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer handlePanic(nil)
+		done <- install(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// The install cancelled by a signal stops at the next step
+	err := context.Cause(ctx)
+	if !errors.Is(err, errBootstrapTimeout) {
+		return <-done
+	}
+
+	slog.Error("Bootstrap timeout exceeded", slog.Duration("timeout", timeout), slog.Any("installed", statusComponents("installed")), slog.Any("installing", statusComponents("installing")))
+	finishStatus(err)
+	return err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInstallWithTimeout(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	installErr := errors.New("failed to install component kubelet")
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		install func(ctx context.Context) error
+		phase   string
+		wantErr error
+	}{
+		{
+			name:    "no timeout",
+			timeout: 0,
+			install: func(ctx context.Context) error { return nil },
+			phase:   "installed",
+		},
+		{
+			name:    "installed in time",
+			timeout: time.Minute,
+			install: func(ctx context.Context) error { return nil },
+			phase:   "installed",
+		},
+		{
+			name:    "install failure",
+			timeout: time.Minute,
+			install: func(ctx context.Context) error { return installErr },
+			phase:   "failed",
+			wantErr: installErr,
+		},
+		{
+			name:    "install stopped at the timeout",
+			timeout: 10 * time.Millisecond,
+			install: func(ctx context.Context) error {
+				<-ctx.Done()
+				return context.Cause(ctx)
+			},
+			phase:   "failed",
+			wantErr: errBootstrapTimeout,
+		},
+		{
+			name:    "install blocked",
+			timeout: 10 * time.Millisecond,
+			install: func(ctx context.Context) error {
+				setComponentStatus("kubelet", "1.31.2", "installing")
+				time.Sleep(time.Hour)
+				return nil
+			},
+			phase:   "failed",
+			wantErr: errBootstrapTimeout,
+		},
+	}
+	for _, test := range tests {
+		startStatus(NodeMetadata{PoolVersion: "1.31.2"}, false)
+		setComponentStatus("containerd", "1.7.22", "installed")
+
+		err := installWithTimeout(context.Background(), test.timeout, func(ctx context.Context) error {
+			err := test.install(ctx)
+			finishStatus(err)
+			return err
+		})
+		if !errors.Is(err, test.wantErr) || (test.wantErr == nil && err != nil) {
+			t.Errorf("%s: error = %v, expected %v", test.name, err, test.wantErr)
+		}
+
+		// The partial install is recorded
+		statusMu.Lock()
+		phase, components := status.Phase, status.Components
+		statusMu.Unlock()
+		if phase != test.phase {
+			t.Errorf("%s: phase = %s, expected %s", test.name, phase, test.phase)
+		}
+		if components[0].Status != "installed" {
+			t.Errorf("%s: containerd status = %s, expected installed", test.name, components[0].Status)
+		}
+		if test.name == "install blocked" && (components[1].Status != "failed" || components[1].Error == "") {
+			t.Errorf("%s: expected the kubelet failed with the timeout, got %+v", test.name, components[1])
+		}
+	}
+}
+
+func TestBootstrapReleaseEvent(t *testing.T) {
+	nodemetadata := NodeMetadata{PoolVersion: "1.31.5", RepoURI: "https://repo"}
+	tests := []struct {
+		name       string
+		installErr error
+		fallback   string
+		reason     string
+	}{
+		{name: "installed"},
+		{name: "release not found", installErr: fmt.Errorf("%w: 1.31.5 is newer than the latest release 1.31.4", errReleaseNotFound), reason: "ReleaseNotFound"},
+		{name: "release fallback", fallback: "1.31.4", reason: "ReleaseFallback"},
+		{name: "install failure", installErr: errors.New("failed to install component kubelet"), fallback: "1.31.4"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason, message := bootstrapReleaseEvent(nodemetadata, test.installErr, test.fallback)
+			if reason != test.reason || (reason == "") != (message == "") {
+				t.Errorf("expected %q event, got %q: %q", test.reason, reason, message)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudInitRunDir is created by cloud-init when it runs on this boot, and its result file once done
+const (
+	cloudInitRunDir     = "/run/cloud-init"
+	cloudInitResultFile = "/run/cloud-init/result.json"
+)
+
+// Backoff between the boot conditions checks
+const (
+	bootWaitInitialDelay = time.Second
+	bootWaitMaxDelay     = 15 * time.Second
+)
+
+// defaultBootWaitTimeout is the maximum time to wait for the boot conditions before installing anyway
+const defaultBootWaitTimeout = 10 * time.Minute
+
+// bootCondition is a condition the initial install waits for, eg: cloud-init still configuring the
+// network or the disks the components need
+type bootCondition struct {
+	Kind string // cloud-init, file or unit
+	Arg  string // Path of the file or name of the unit
+}
+
+func (c bootCondition) String() string {
+	if c.Arg == "" {
+		return c.Kind
+	}
+	return c.Kind + ":" + c.Arg
+}
+
+// parseBootConditions parses the -wait-for flag value, eg: cloud-init,file:/run/disks-ready,unit:setup-network.service
+func parseBootConditions(value string) ([]bootCondition, error) {
+	var conditions []bootCondition
+	if value == "" {
+		return conditions, nil
+	}
+
+	for item := range strings.SplitSeq(value, ",") {
+		kind, arg, _ := strings.Cut(strings.TrimSpace(item), ":")
+		switch kind {
+		case "cloud-init":
+			if arg != "" {
+				return nil, fmt.Errorf("invalid boot condition %q, cloud-init does not take an argument", item)
+			}
+		case "file":
+			if !strings.HasPrefix(arg, "/") {
+				return nil, fmt.Errorf("invalid boot condition %q, expected an absolute path, eg: file:/run/disks-ready", item)
+			}
+		case "unit":
+			if arg == "" {
+				return nil, fmt.Errorf("invalid boot condition %q, expected a unit, eg: unit:setup-network.service", item)
+			}
+		default:
+			return nil, fmt.Errorf("invalid boot condition %q, expected cloud-init, file:<path> or unit:<name>", item)
+		}
+		conditions = append(conditions, bootCondition{Kind: kind, Arg: arg})
+	}
+
+	return conditions, nil
+}
+
+// met returns whether the boot condition is met
+func (c bootCondition) met() (bool, error) {
+	switch c.Kind {
+	case "cloud-init":
+		// cloud-init does not run on this boot
+		_, err := os.Stat(hostPath(cloudInitRunDir))
+		if errors.Is(err, fs.ErrNotExist) {
+			return true, nil
+		}
+		return fileExists(cloudInitResultFile)
+	case "file":
+		return fileExists(c.Arg)
+	case "unit":
+		output, err := command("/usr/bin/systemctl", "show", "--property=ActiveState,ExecMainExitTimestampMonotonic", c.Arg).Output()
+		if err != nil {
+			return false, fmt.Errorf("failed to get unit %s state: %w", c.Arg, err)
+		}
+		return unitFinished(string(output)), nil
+	}
+	return false, fmt.Errorf("unknown boot condition %s", c)
+}
+
+// unitFinished returns whether the unit of the systemctl show properties is started or has run, a
+// oneshot unit is inactive once it ran
+func unitFinished(properties string) bool {
+	var state string
+	var exitTimestamp int64
+	for line := range strings.SplitSeq(properties, "\n") {
+		name, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch name {
+		case "ActiveState":
+			state = value
+		case "ExecMainExitTimestampMonotonic":
+			exitTimestamp, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return state == "active" || state == "failed" || (state == "inactive" && exitTimestamp > 0)
+}
+
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(hostPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// waitForBoot waits for the boot conditions before the initial install, with an exponential backoff.
+// Once the timeout is exceeded, the node is installed anyway and the bootstrap timeout applies.
+func waitForBoot(ctx context.Context, conditions []bootCondition, timeout time.Duration) error {
+	if len(conditions) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	delay := bootWaitInitialDelay
+	for {
+		var pending []string
+		for _, condition := range conditions {
+			met, err := condition.met()
+			if err != nil {
+				slog.Warn("Failed to check boot condition", slog.String("condition", condition.String()), slog.Any("error", err))
+			}
+			if !met {
+				pending = append(pending, condition.String())
+			}
+		}
+		if len(pending) == 0 {
+			slog.Info("Boot conditions met", slog.Duration("waited", time.Since(start).Round(time.Second)))
+			return nil
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			slog.Warn("Boot conditions not met, installing anyway", slog.Any("pending", pending), slog.Duration("timeout", timeout))
+			return nil
+		}
+		slog.Info("Waiting for boot conditions", slog.Any("pending", pending), slog.Duration("retry_in", delay))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("context cancelled: %w", context.Cause(ctx))
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, bootWaitMaxDelay)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBootConditions(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []bootCondition
+		err      string
+	}{
+		{value: ""},
+		{value: "cloud-init", expected: []bootCondition{{Kind: "cloud-init"}}},
+		{value: "cloud-init, file:/run/disks-ready,unit:setup-network.service", expected: []bootCondition{{Kind: "cloud-init"}, {Kind: "file", Arg: "/run/disks-ready"}, {Kind: "unit", Arg: "setup-network.service"}}},
+		{value: "cloud-init:final", err: "does not take an argument"},
+		{value: "file:disks-ready", err: "expected an absolute path"},
+		{value: "unit:", err: "expected a unit"},
+		{value: "network", err: "expected cloud-init, file:<path> or unit:<name>"},
+	}
+	for _, test := range tests {
+		conditions, err := parseBootConditions(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error %q, got %v", test.value, test.err, err)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(conditions, test.expected) {
+			t.Errorf("%q: got %v, %v, expected %v", test.value, conditions, err, test.expected)
+		}
+	}
+}
+
+func TestUnitFinished(t *testing.T) {
+	tests := []struct {
+		properties string
+		finished   bool
+	}{
+		{properties: "ActiveState=active\nExecMainExitTimestampMonotonic=0\n", finished: true},
+		{properties: "ActiveState=failed\nExecMainExitTimestampMonotonic=1234\n", finished: true},
+		{properties: "ActiveState=inactive\nExecMainExitTimestampMonotonic=1234\n", finished: true},
+		{properties: "ActiveState=inactive\nExecMainExitTimestampMonotonic=0\n"},
+		{properties: "ActiveState=activating\nExecMainExitTimestampMonotonic=0\n"},
+		{properties: ""},
+	}
+	for _, test := range tests {
+		if finished := unitFinished(test.properties); finished != test.finished {
+			t.Errorf("unitFinished(%q) = %v, expected %v", test.properties, finished, test.finished)
+		}
+	}
+}
+
+func TestBootConditionMet(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	cloudInit := bootCondition{Kind: "cloud-init"}
+	file := bootCondition{Kind: "file", Arg: "/run/disks-ready"}
+
+	// cloud-init does not run on this boot
+	met, err := cloudInit.met()
+	if err != nil || !met {
+		t.Errorf("expected cloud-init met without its run directory, got %v, %v", met, err)
+	}
+
+	// cloud-init is running
+	err = os.MkdirAll(filepath.Join(rootDir, cloudInitRunDir), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	met, err = cloudInit.met()
+	if err != nil || met {
+		t.Errorf("expected cloud-init not met while running, got %v, %v", met, err)
+	}
+
+	// The install waits until the timeout, then installs anyway
+	start := time.Now()
+	err = waitForBoot(context.Background(), []bootCondition{cloudInit, file}, 0)
+	if err != nil || time.Since(start) > time.Second {
+		t.Errorf("expected the wait to give up, got %v after %s", err, time.Since(start))
+	}
+
+	// cloud-init and the file are done
+	for _, path := range []string{cloudInitResultFile, file.Arg} {
+		err = os.WriteFile(filepath.Join(rootDir, path), []byte("{}"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, condition := range []bootCondition{cloudInit, file} {
+		met, err = condition.met()
+		if err != nil || !met {
+			t.Errorf("expected %s met, got %v, %v", condition, met, err)
+		}
+	}
+	err = waitForBoot(context.Background(), []bootCondition{cloudInit, file}, time.Minute)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// kubeletCAFile is the cluster CA bundle the kubelet verifies the API server with
+const kubeletCAFile = "/etc/kubernetes/pki/ca.crt"
+
+// caRotationServices are restarted in order once the cluster CA bundle is updated
+var caRotationServices = []string{"kubelet"}
+
+// caRestartPendingFile marks the cluster CA bundle written while its services are not restarted yet, they
+// are restarted on the next check even if the bundle is unchanged
+var caRestartPendingFile = filepath.Join(stateDir, "ca-restart-pending")
+
+// caCheckInterval is the minimum time between two checks of the cluster CA in the node metadata
+const caCheckInterval = 5 * time.Minute
+
+// decodeClusterCA decodes the base64 PEM bundle of the node metadata, all its blocks must be certificates
+func decodeClusterCA(clusterCA string) ([]byte, error) {
+	bundle, err := base64.StdEncoding.DecodeString(clusterCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode cluster CA: %w", err)
+	}
+
+	certificates := 0
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("invalid cluster CA: unexpected PEM block %s", block.Type)
+		}
+		_, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster CA certificate: %w", err)
+		}
+		certificates++
+	}
+	if certificates == 0 {
+		return nil, fmt.Errorf("invalid cluster CA: no certificate")
+	}
+
+	return bundle, nil
+}
+
+// rotateClusterCA writes the cluster CA bundle of the kubelet and restarts the services using it, it
+// returns false if the bundle is unchanged and its services were restarted
+func rotateClusterCA(clusterCA string) (bool, error) {
+	bundle, err := decodeClusterCA(clusterCA)
+	if err != nil {
+		return false, err
+	}
+
+	current, err := os.ReadFile(hostPath(kubeletCAFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("failed to read kubelet CA file: %w", err)
+	}
+	_, err = os.Stat(hostPath(caRestartPendingFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("failed to check cluster CA restart: %w", err)
+	}
+	restartPending := err == nil
+	if bytes.Equal(current, bundle) && !restartPending {
+		return false, nil
+	}
+
+	if !bytes.Equal(current, bundle) {
+		// The restart is retried if it fails once the bundle is written
+		err = os.MkdirAll(hostPath(stateDir), 0700)
+		if err != nil {
+			return false, fmt.Errorf("failed to create state directory: %w", err)
+		}
+		err = os.WriteFile(hostPath(caRestartPendingFile), nil, 0600)
+		if err != nil {
+			return false, fmt.Errorf("failed to mark cluster CA restart: %w", err)
+		}
+
+		// Replace the bundle atomically, the kubelet must never read a partial bundle
+		err = os.MkdirAll(hostPath(filepath.Dir(kubeletCAFile)), defaultDirectoryMode)
+		if err != nil {
+			return false, fmt.Errorf("failed to create kubelet CA directory: %w", err)
+		}
+		err = writeFileSync(kubeletCAFile, bundle, 0644)
+		if err != nil {
+			return false, fmt.Errorf("failed to write kubelet CA file: %w", err)
+		}
+		slog.Info("Cluster CA bundle updated", slog.String("file", kubeletCAFile))
+	}
+
+	// Restart the services so they load the new bundle
+	for _, service := range caRotationServices {
+		cmd := command("/usr/bin/systemctl", "try-restart", service)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return true, fmt.Errorf("failed to restart service %s: %w: %s", service, err, output)
+		}
+		slog.Info("Service restarted", slog.String("service", service))
+	}
+
+	err = os.Remove(hostPath(caRestartPendingFile))
+	if err != nil {
+		return true, fmt.Errorf("failed to clear cluster CA restart: %w", err)
+	}
+
+	return true, nil
+}
+
+// syncClusterCA applies the cluster CA rotations of the node metadata. The controller is restarted
+// once the CA is rotated, so its Kubernetes client trusts the new CA. The CA is also rotated before
+// the node is registered, without events.
+func (c *Controller) syncClusterCA(ctx context.Context) error {
+	if time.Since(c.lastCACheck) < caCheckInterval {
+		return nil
+	}
+	c.lastCACheck = time.Now()
+
+	// Get the node from the lister, the events are recorded once it is registered
+	node, err := c.nodesLister.Get(c.nodeName)
+	if apierrors.IsNotFound(err) {
+		node, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+	event := func(eventtype, message string) {
+		if node != nil {
+			c.recorder.Event(node, eventtype, "ClusterCARotation", message)
+		}
+	}
+
+	// Update the kubelet bundle and the kubeconfigs with the cluster CA of the node metadata loaded by the
+	// root agent process, also when the CA was rotated while the agent was stopped
+	rotation, err := c.privileged.RotateClusterCA(ctx)
+	if err != nil {
+		c.lastCACheck = time.Time{}
+		event(corev1.EventTypeWarning, fmt.Sprintf("Failed to rotate cluster CA: %s", err))
+		return fmt.Errorf("failed to rotate cluster CA: %w", err)
+	}
+	if rotation.ClusterCA == "" {
+		return nil
+	}
+	if rotation.Rotated {
+		c.logger.Info("Kubelet cluster CA rotated")
+		event(corev1.EventTypeNormal, "Kubelet cluster CA rotated")
+	}
+
+	// The informers and the event recorder use the client trusting the previous CA
+	if rotation.ClusterCA != c.clusterCA {
+		event(corev1.EventTypeNormal, "Cluster CA rotated, restarting the agent")
+		c.requestRestart("cluster CA rotated")
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA returns a base64 PEM self-signed CA certificate
+func testCA(t *testing.T, name string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestDecodeClusterCA(t *testing.T) {
+	ca := testCA(t, "kubernetes")
+	decoded, _ := base64.StdEncoding.DecodeString(ca)
+	other, _ := base64.StdEncoding.DecodeString(testCA(t, "kubernetes-next"))
+
+	tests := []struct {
+		name      string
+		clusterCA string
+		wantErr   bool
+	}{
+		{name: "certificate", clusterCA: ca},
+		{name: "bundle", clusterCA: base64.StdEncoding.EncodeToString(append(decoded, other...))},
+		{name: "not base64", clusterCA: "not base64!", wantErr: true},
+		{name: "empty", clusterCA: "", wantErr: true},
+		{name: "private key", clusterCA: base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("key")})), wantErr: true},
+		{name: "invalid certificate", clusterCA: base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")})), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeClusterCA(tt.clusterCA)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeClusterCA() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRotateClusterCA(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	// The kubelet is restarted once per bundle change
+	for _, ca := range []string{testCA(t, "kubernetes"), testCA(t, "kubernetes-next")} {
+		for i, want := range []bool{true, false} {
+			rotated, err := rotateClusterCA(ca)
+			if err != nil {
+				t.Fatalf("failed to rotate cluster CA: %v", err)
+			}
+			if rotated != want {
+				t.Errorf("rotateClusterCA() call %d = %v, want %v", i, rotated, want)
+			}
+		}
+		bundle, err := os.ReadFile(filepath.Join(rootDir, kubeletCAFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if base64.StdEncoding.EncodeToString(bundle) != ca {
+			t.Error("kubelet CA file not updated")
+		}
+	}
+
+	// The restart failed once the bundle was written is retried, the bundle is unchanged
+	err := os.WriteFile(filepath.Join(rootDir, caRestartPendingFile), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := os.ReadFile(filepath.Join(rootDir, kubeletCAFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := rotateClusterCA(base64.StdEncoding.EncodeToString(bundle))
+	if err != nil || !rotated {
+		t.Errorf("rotateClusterCA() = %v, %v, want the restart retried", rotated, err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, caRestartPendingFile))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the pending restart cleared, got %v", err)
+	}
+
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(commands), "try-restart kubelet") != 3 {
+		t.Errorf("expected three kubelet restarts, got commands %q", commands)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// cniConfDir is the directory the kubelet loads the CNI configuration from, the first file in
+// lexical order is used, so leftovers of a previous CNI may be used instead of the expected one
+const cniConfDir = "/etc/cni/net.d"
+
+// cniQuarantineDir holds the conflicting CNI configuration files moved out of the CNI directory,
+// they are kept so a wrong quarantine can be restored by hand
+var cniQuarantineDir = filepath.Join(stateDir, "cni-quarantine")
+
+// cniConfPatterns are the file name patterns of the configuration written by each CNI
+var cniConfPatterns = map[string][]string{
+	"cilium":  {"*cilium*"},
+	"calico":  {"*calico*"},
+	"flannel": {"*flannel*"},
+	"weave":   {"*weave*"},
+	"kilo":    {"*kilo*"},
+}
+
+// cniOwner returns the CNI writing the configuration file, an empty string if it is unknown. The CNIs
+// are matched in name order, so a file matching several CNIs always has the same owner.
+func cniOwner(name string) string {
+	for _, cni := range slices.Sorted(maps.Keys(cniConfPatterns)) {
+		for _, pattern := range cniConfPatterns[cni] {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return cni
+			}
+		}
+	}
+	return ""
+}
+
+// cniConflicts returns the configuration files of the CNI directory written by another CNI than the
+// expected one, the unknown files (eg: chained plugins such as multus) are left untouched
+func cniConflicts(expected string) ([]string, error) {
+	if _, ok := cniConfPatterns[expected]; !ok {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(hostPath(cniConfDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list CNI configuration: %w", err)
+	}
+
+	var conflicts []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		owner := cniOwner(entry.Name())
+		if owner != "" && owner != expected {
+			conflicts = append(conflicts, entry.Name())
+		}
+	}
+	sort.Strings(conflicts)
+
+	return conflicts, nil
+}
+
+// cniQuarantinePath returns the path the configuration file is quarantined to, suffixed with the time so
+// a file quarantined again, eg: written again by a leftover CNI, does not replace the previous one
+func cniQuarantinePath(name string) (string, error) {
+	base := filepath.Join(cniQuarantineDir, fmt.Sprintf("%s.%s", name, time.Now().UTC().Format("20060102T150405Z")))
+	for i := 0; ; i++ {
+		path := base
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", base, i)
+		}
+		_, err := os.Lstat(hostPath(path))
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to check CNI quarantine %s: %w", path, err)
+		}
+	}
+}
+
+// reconcileCNI moves the configuration files of another CNI than the expected one to the quarantine
+// directory, it returns the quarantined files. Nothing is done if the expected CNI is unknown.
+func reconcileCNI(expected string) ([]string, error) {
+	if expected == "" {
+		return nil, nil
+	}
+	if _, ok := cniConfPatterns[expected]; !ok {
+		slog.Warn("Unknown CNI, configuration not reconciled", slog.String("cni", expected))
+		return nil, nil
+	}
+
+	conflicts, err := cniConflicts(expected)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+
+	err = os.MkdirAll(hostPath(cniQuarantineDir), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CNI quarantine directory: %w", err)
+	}
+
+	var quarantined []string
+	for _, name := range conflicts {
+		quarantinePath, err := cniQuarantinePath(name)
+		if err != nil {
+			return quarantined, err
+		}
+		err = os.Rename(hostPath(filepath.Join(cniConfDir, name)), hostPath(quarantinePath))
+		if err != nil {
+			return quarantined, fmt.Errorf("failed to quarantine CNI configuration %s: %w", name, err)
+		}
+		quarantined = append(quarantined, name)
+		slog.Warn("Conflicting CNI configuration quarantined", slog.String("file", name), slog.String("quarantine", quarantinePath), slog.String("cni", cniOwner(name)), slog.String("expected_cni", expected))
+	}
+
+	// Warn when the expected configuration is missing, the CNI pods write it once running
+	entries, err := os.ReadDir(hostPath(cniConfDir))
+	if err != nil {
+		return quarantined, fmt.Errorf("failed to list CNI configuration: %w", err)
+	}
+	if !slices.ContainsFunc(entries, func(entry fs.DirEntry) bool { return cniOwner(entry.Name()) == expected }) {
+		slog.Warn("Expected CNI configuration not found, waiting for the CNI to write it", slog.String("cni", expected))
+	}
+
+	return quarantined, nil
+}
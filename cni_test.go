@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReconcileCNI(t *testing.T) {
+	tests := []struct {
+		name        string
+		cni         string
+		files       []string
+		quarantined []string
+		remaining   []string
+	}{
+		{
+			name:        "calico leftovers after cilium migration",
+			cni:         "cilium",
+			files:       []string{"05-cilium.conflist", "10-calico.conflist", "calico-kubeconfig"},
+			quarantined: []string{"10-calico.conflist", "calico-kubeconfig"},
+			remaining:   []string{"05-cilium.conflist"},
+		},
+		{
+			name:      "chained plugin kept",
+			cni:       "cilium",
+			files:     []string{"00-multus.conf", "05-cilium.conflist"},
+			remaining: []string{"00-multus.conf", "05-cilium.conflist"},
+		},
+		{
+			name:      "unknown CNI",
+			cni:       "antrea",
+			files:     []string{"10-antrea.conflist", "10-calico.conflist"},
+			remaining: []string{"10-antrea.conflist", "10-calico.conflist"},
+		},
+		{
+			name:        "expected configuration not written yet",
+			cni:         "calico",
+			files:       []string{"05-cilium.conflist"},
+			quarantined: []string{"05-cilium.conflist"},
+		},
+	}
+
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rootDir = t.TempDir()
+			err := os.MkdirAll(hostPath(cniConfDir), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range test.files {
+				err = os.WriteFile(hostPath(filepath.Join(cniConfDir, file)), []byte("{}"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			quarantined, err := reconcileCNI(test.cni)
+			if err != nil {
+				t.Fatalf("failed to reconcile CNI configuration: %v", err)
+			}
+			if !reflect.DeepEqual(quarantined, test.quarantined) {
+				t.Errorf("quarantined = %v, expected %v", quarantined, test.quarantined)
+			}
+
+			entries, err := os.ReadDir(hostPath(cniConfDir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var remaining []string
+			for _, entry := range entries {
+				remaining = append(remaining, entry.Name())
+			}
+			if !reflect.DeepEqual(remaining, test.remaining) {
+				t.Errorf("remaining = %v, expected %v", remaining, test.remaining)
+			}
+			for _, file := range test.quarantined {
+				matches, err := filepath.Glob(hostPath(filepath.Join(cniQuarantineDir, file+".*")))
+				if err != nil || len(matches) != 1 {
+					t.Errorf("%s not quarantined: %v, %v", file, matches, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileCNIQuarantinedAgain(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+	err := os.MkdirAll(hostPath(cniConfDir), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file written again by a leftover CNI is quarantined without replacing the previous one
+	for i := range 2 {
+		err = os.WriteFile(hostPath(filepath.Join(cniConfDir, "10-calico.conflist")), []byte(fmt.Sprint(i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = reconcileCNI("cilium")
+		if err != nil {
+			t.Fatalf("failed to reconcile CNI configuration: %v", err)
+		}
+	}
+	matches, err := filepath.Glob(hostPath(filepath.Join(cniQuarantineDir, "10-calico.conflist.*")))
+	if err != nil || len(matches) != 2 {
+		t.Errorf("expected both files quarantined, got %v, %v", matches, err)
+	}
+}
+
+func TestCNIOwner(t *testing.T) {
+	// A file matching several CNIs always has the same owner, eg: canal is calico with flannel
+	for range 10 {
+		if owner := cniOwner("10-calico-flannel.conflist"); owner != "calico" {
+			t.Fatalf("owner = %q, expected calico", owner)
+		}
+	}
+	if owner := cniOwner("00-multus.conf"); owner != "" {
+		t.Errorf("owner = %q, expected unknown", owner)
+	}
+}
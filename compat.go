@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// kubeletComponent is the component checked against the version of the API server
+const kubeletComponent = "kubelet"
+
+// maxKubeletSkew is the number of minor versions the kubelet may be older than the API server
+const maxKubeletSkew = 3
+
+// checkComponentRequirements checks the release components satisfy the requirements of each other,
+// eg: the containerd and runc versions required by the kubelet version
+//
+//	versions:
+//	  1.32.0:
+//	    requires:
+//	      containerd: ">= 1.7.0"
+//	      runc: ">= 1.1.0"
+func checkComponentRequirements(repoFS fs.FS, components []Component, poolVersion string) error {
+	versions := make(map[string]string, len(components))
+	sources := make(map[string]bool)
+	for _, component := range components {
+		versions[component.Name] = trimVersion(expandVersion(component.Version, poolVersion))
+		sources[component.Name] = component.Source != nil
+	}
+
+	for _, component := range components {
+		// The components installed from a single file have no metadata
+		if component.Source != nil {
+			continue
+		}
+		componentSections, err := componentMetadata(repoFS, component.Name, versions[component.Name])
+		if err != nil {
+			return fmt.Errorf("failed to read component metadata: %w", err)
+		}
+
+		for _, required := range slices.Sorted(maps.Keys(componentSections.Requires)) {
+			err = checkRequirement(versions, sources, required, componentSections.Requires[required])
+			if err != nil {
+				return fmt.Errorf("incompatible components: %s %s requires %s %s: %w", component.Name, versions[component.Name], required, componentSections.Requires[required], err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkRequirement checks the version of the required component satisfies the constraint. The version of
+// a component installed from a source is free-form, eg: 1.7.23-hotfix1 or hotfix, it is only checked if
+// it is a semantic version.
+func checkRequirement(versions map[string]string, sources map[string]bool, required, constraint string) error {
+	parsedConstraint, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return fmt.Errorf("invalid version constraint: %w", err)
+	}
+	version, ok := versions[required]
+	if !ok {
+		return fmt.Errorf("%s is not in the release", required)
+	}
+	parsedVersion, err := semver.NewVersion(version)
+	if err != nil && sources[required] {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s version %s: %w", required, version, err)
+	}
+	if !parsedConstraint.Check(parsedVersion) {
+		return fmt.Errorf("got %s", version)
+	}
+	return nil
+}
+
+// checkKubeletSkew checks the kubelet version of the plan is within the supported skew of the API
+// server version: not newer, and at most 3 minor versions older. A free-form kubelet version, eg: a
+// hotfix installed from a source, is not checked, as for the requirements.
+func checkKubeletSkew(plan UpgradePlan, serverVersion string) error {
+	index := slices.IndexFunc(plan.Components, func(component PlannedComponent) bool { return component.Name == kubeletComponent })
+	if index < 0 {
+		return nil
+	}
+	kubeletVersion := trimVersion(plan.Components[index].To)
+
+	kubelet, err := semver.NewVersion(kubeletVersion)
+	if err != nil {
+		return nil
+	}
+	server, err := semver.NewVersion(serverVersion)
+	if err != nil {
+		return fmt.Errorf("invalid API server version %s: %w", serverVersion, err)
+	}
+
+	switch {
+	case kubelet.Major() != server.Major():
+		return fmt.Errorf("kubelet %s and the API server %s have different major versions", kubeletVersion, serverVersion)
+	case kubelet.Minor() > server.Minor():
+		return fmt.Errorf("kubelet %s is newer than the API server %s", kubeletVersion, serverVersion)
+	case server.Minor()-kubelet.Minor() > maxKubeletSkew:
+		return fmt.Errorf("kubelet %s is more than %d minor versions older than the API server %s", kubeletVersion, maxKubeletSkew, serverVersion)
+	}
+	return nil
+}
+
+// checkPlanCompatibility checks the kubelet version of the plan against the version of the API server
+func (c *Controller) checkPlanCompatibility(plan UpgradePlan) error {
+	if !slices.ContainsFunc(plan.Components, func(component PlannedComponent) bool { return component.Name == kubeletComponent }) {
+		return nil
+	}
+
+	serverVersion, err := c.client.Discovery().ServerVersion()
+	if err != nil {
+		return fmt.Errorf("failed to get API server version: %w", err)
+	}
+	return checkKubeletSkew(plan, serverVersion.GitVersion)
+}
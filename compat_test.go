@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckComponentRequirements(t *testing.T) {
+	repoFS := fstest.MapFS{
+		"kubelet/metadata.yaml": {Data: []byte(`ranges:
+  ">= 1.32.0":
+    requires:
+      containerd: ">= 2.0.0"
+      runc: ">= 1.1.0"
+versions:
+  1.31.2: {}
+  1.32.0: {}
+`)},
+		"containerd/metadata.yaml": {Data: []byte("versions:\n  1.7.23: {}\n  2.0.1: {}\n")},
+		"runc/metadata.yaml":       {Data: []byte("versions:\n  1.1.14: {}\n")},
+	}
+
+	tests := []struct {
+		name       string
+		components []Component
+		err        string
+	}{
+		{
+			name:       "no requirements",
+			components: []Component{{Name: "kubelet", Version: "1.31.2"}, {Name: "containerd", Version: "1.7.23"}},
+		},
+		{
+			name:       "satisfied",
+			components: []Component{{Name: "kubelet"}, {Name: "containerd", Version: "2.0.1"}, {Name: "runc", Version: "1.1.14"}},
+		},
+		{
+			name:       "unsatisfied",
+			components: []Component{{Name: "kubelet"}, {Name: "containerd", Version: "1.7.23"}, {Name: "runc", Version: "1.1.14"}},
+			err:        "incompatible components: kubelet 1.32.0 requires containerd >= 2.0.0: got 1.7.23",
+		},
+		{
+			name:       "missing",
+			components: []Component{{Name: "kubelet", Version: "~1"}, {Name: "containerd", Version: "2.0.1"}},
+			err:        "kubelet 1.32.0 requires runc >= 1.1.0: runc is not in the release",
+		},
+		{
+			name:       "single file source",
+			components: []Component{{Name: "kubelet", Version: "1.31.2"}, {Name: "containerd", Version: "1.7.24", Source: &ComponentSource{}}},
+		},
+		{
+			name:       "required component from a source",
+			components: []Component{{Name: "kubelet"}, {Name: "containerd", Version: "hotfix", Source: &ComponentSource{}}, {Name: "runc", Version: "1.1.14"}},
+		},
+		{
+			name:       "required component from a source unsatisfied",
+			components: []Component{{Name: "kubelet"}, {Name: "containerd", Version: "1.7.23-hotfix1", Source: &ComponentSource{}}, {Name: "runc", Version: "1.1.14"}},
+			err:        "kubelet 1.32.0 requires containerd >= 2.0.0: got 1.7.23-hotfix1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkComponentRequirements(repoFS, test.components, "1.32.0")
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestCheckKubeletSkew(t *testing.T) {
+	tests := []struct {
+		name          string
+		kubelet       string
+		serverVersion string
+		err           string
+	}{
+		{name: "same version", kubelet: "1.31.2", serverVersion: "v1.31.2"},
+		{name: "older patch", kubelet: "1.31.1~2", serverVersion: "v1.31.4-scw.1"},
+		{name: "oldest supported", kubelet: "1.28.15", serverVersion: "v1.31.2"},
+		{name: "newer", kubelet: "1.32.0", serverVersion: "v1.31.2", err: "kubelet 1.32.0 is newer than the API server v1.31.2"},
+		{name: "too old", kubelet: "1.27.16", serverVersion: "v1.31.2", err: "more than 3 minor versions older"},
+		{name: "major", kubelet: "2.0.0", serverVersion: "v1.31.2", err: "different major versions"},
+		{name: "free-form kubelet version", kubelet: "hotfix", serverVersion: "v1.31.2"},
+		{name: "invalid server version", kubelet: "1.31.2", serverVersion: "unknown", err: "invalid API server version"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := UpgradePlan{Components: []PlannedComponent{{Name: "containerd", To: "1.7.23"}, {Name: "kubelet", From: "1.30.6", To: test.kubelet}}}
+			err := checkKubeletSkew(plan, test.serverVersion)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// The plans without kubelet change are not checked
+	err := checkKubeletSkew(UpgradePlan{Components: []PlannedComponent{{Name: "containerd", To: "1.7.23"}}}, "unknown")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckPlanCompatibility(t *testing.T) {
+	client := fake.NewClientset()
+	client.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: "v1.31.2"}
+	c := &Controller{nodeName: "node", client: client}
+
+	err := c.checkPlanCompatibility(UpgradePlan{Components: []PlannedComponent{{Name: "kubelet", From: "1.30.6", To: "1.31.2"}}})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = c.checkPlanCompatibility(UpgradePlan{Components: []PlannedComponent{{Name: "kubelet", From: "1.31.2", To: "1.32.0"}}})
+	if err == nil || !strings.Contains(err.Error(), "newer than the API server") {
+		t.Errorf("expected a skew error, got %v", err)
+	}
+}
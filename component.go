@@ -2,31 +2,73 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/scaleway/k8s-agent/repo"
-	"gopkg.in/yaml.v3"
 )
 
-// Structs to unmarshal metadata.yaml
+// Structs to unmarshal metadata.yaml, the sections of a version are merged over the defaults and
+// the matching version ranges, each section set in an upper layer replacing the lower one
+//
+//	defaults:
+//	  install: [...]
+//	ranges:
+//	  ">= 1.30, < 1.32":
+//	    uninstall: [...]
+//	versions:
+//	  1.29.4:
+//	    install: [...]
+//	  1.30.2: {}
+//	  1.31.0: {}
+//	fallback: [nearest_lower_patch]
 type ComponentVersions struct {
-	Versions map[string]ComponentSections
+	Defaults ComponentSections            `yaml:"defaults,omitempty"`
+	Ranges   map[string]ComponentSections `yaml:"ranges,omitempty"`
+	Versions map[string]ComponentSections `yaml:"versions"`
+
+	// Rules resolving the sections of a version without key, tried in order, the version is not found
+	// if none applies
+	Fallback []string `yaml:"fallback,omitempty"`
 }
 
 type ComponentSections struct {
 	Install   []ComponentResources `yaml:"install,omitempty"`
 	Uninstall []ComponentResources `yaml:"uninstall,omitempty"`
+
+	// Allowlist of the sprig, structured configuration and component directory (include, loadConfig)
+	// functions available in templates, all the safe ones if empty
+	TemplateFunctions []string `yaml:"template_functions,omitempty"`
+
+	// Detection of the version installed by a previous tooling
+	Adopt *ComponentAdopt `yaml:"adopt,omitempty"`
+
+	// Version constraints of the other release components, eg: {"containerd": ">= 1.7.0"}
+	Requires map[string]string `yaml:"requires,omitempty"`
+
+	// Version key the sections fell back to and its rule, the version has no key in metadata.yaml
+	fallback     string
+	fallbackRule string
 }
 
 type ComponentResources struct {
+	Mounts   []ComponentMount   `yaml:"mounts,omitempty"`
+	Network  *ComponentNetwork  `yaml:"network,omitempty"`
+	Firewall *ComponentFirewall `yaml:"firewall,omitempty"`
+	Kernel   *ComponentKernel   `yaml:"kernel,omitempty"`
 	Files    []ComponentFile    `yaml:"files,omitempty"`
 	Services []ComponentService `yaml:"services,omitempty"`
 	Scripts  []ComponentScript  `yaml:"scripts,omitempty"`
@@ -35,10 +77,17 @@ type ComponentResources struct {
 type ComponentFile struct {
 	State string `yaml:"state"`
 	Src   string `yaml:"src,omitempty"`
-	Dst   string `yaml:"dst,omitempty"`
-	Mode  string `yaml:"mode,omitempty"`
-	Owner string `yaml:"owner,omitempty"`
-	Group string `yaml:"group,omitempty"`
+	// Artifact of the component index.yaml instead of the src, resolved for the node architecture
+	Artifact string `yaml:"artifact,omitempty"`
+	Dst      string `yaml:"dst,omitempty"`
+	Mode     string `yaml:"mode,omitempty"`
+	Owner    string `yaml:"owner,omitempty"`
+	Group    string `yaml:"group,omitempty"`
+	Header   bool   `yaml:"header,omitempty"` // Prepend a "managed by" header
+	Force    bool   `yaml:"force,omitempty"`  // Take over an existing file not managed by the agent
+
+	// Apply the mode and ownership to the parent directories created
+	ApplyToParents bool `yaml:"apply_to_parents,omitempty"`
 }
 
 type ComponentService struct {
@@ -49,32 +98,210 @@ type ComponentService struct {
 
 type ComponentScript struct {
 	Cmd string `yaml:"cmd"`
+
+	// The scripts run with a minimal environment, with the declared variables and the agent variables
+	// inherited, eg: HTTPS_PROXY
+	Env        map[string]string `yaml:"env,omitempty"`
+	InheritEnv []string          `yaml:"inherit_env,omitempty"`
+
+	// SHA256 digest of the command with its environment, and of the script files it runs by path,
+	// checked before running it
+	SHA256 string            `yaml:"sha256,omitempty"`
+	Files  map[string]string `yaml:"files,omitempty"`
+}
+
+// processComponents installs the node components, upgrade is set when the install was triggered on the node,
+// otherwise the repository snapshot pinned at the last successful install is used
+func processComponents(ctx context.Context, nodemetadata NodeMetadata, upgrade bool) error {
+	// Report the install progress to the control plane
+	defer stalls.start("install")()
+	startStatus(nodemetadata, upgrade)
+	err := installNode(ctx, nodemetadata, upgrade)
+	if err == nil && !upgrade && nodemetadata.SmokeTest != nil && serviceManager != chrootServiceManager {
+		// The install is only reported successful once the node works
+		err = runSmokeTest(ctx, *nodemetadata.SmokeTest, nodemetadata.ClusterURL, nodemetadata.ResolvconfPath)
+	}
+	if err == nil {
+		// Record the inventory of the components installed, the install is not failed without it
+		digest, sbomErr := writeSBOM(nodemetadata)
+		if sbomErr != nil {
+			slog.Warn("Failed to write SBOM", slog.Any("error", sbomErr))
+		} else {
+			setStatusSBOMDigest(digest)
+		}
+	}
+	finishStatus(err)
+
+	return err
 }
 
-func processComponents(ctx context.Context, nodemetadata NodeMetadata) error {
+func installNode(ctx context.Context, nodemetadata NodeMetadata, upgrade bool) error {
+	// Reject the invalid labels and taints before the kubelet is configured with them
+	err := nodemetadata.ValidateRegistration()
+	if err != nil {
+		return fmt.Errorf("invalid node registration: %w", err)
+	}
+
+	// Limit the resources used by the install, and restore the agent ones once done
+	restoreLimits, err := applyResourceLimits(nodemetadata.ResourceLimits)
+	if err != nil {
+		return fmt.Errorf("failed to apply resource limits: %w", err)
+	}
+	defer restoreLimits()
+
 	// Open repository FS (local zip or remote http(s))
 	slog.Info("Opening repositories", slog.String("uri", nodemetadata.RepoURI))
-	repoFS, err := repo.NewRepoFS(nodemetadata.RepoURI)
+	repoFS, err := repo.NewRepoFS(nodemetadata.RepoURI, hostPath(repoCacheDir))
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", errRepository, err)
+	}
+
+	// Report the downloads, also when the install fails since slow downloads may be the cause
+	defer reportFetchStats(repoFS)
+
+	// Use the pinned repository snapshot if the node version is unchanged
+	pinned, err := pinRepository(repoFS, nodemetadata, upgrade)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errRepository, err)
 	}
+	repoFS = pinned
+	setStatusRepoDigest(releasesDigest(pinned.releases))
 
 	// Get the release components for the node version
-	releaseComponents, err := releaseComponents(repoFS, nodemetadata)
+	releaseComponents, fallback, err := releaseComponents(repoFS, nodemetadata)
+	if err != nil {
+		return fmt.Errorf("%w: failed to get release components: %w", errRepository, err)
+	}
+	if fallback != "" {
+		setStatusFallbackRelease(fallback)
+	}
+
+	// Resolve the wildcard versions, the installed versions are kept unless upgrading
+	releaseComponents, err = resolveComponentVersions(repoFS, releaseComponents, !upgrade)
+	if err != nil {
+		return fmt.Errorf("%w: failed to resolve release components versions: %w", errRepository, err)
+	}
+
+	// Refuse the releases which components do not work together before changing anything
+	err = checkComponentRequirements(repoFS, releaseComponents, nodemetadata.PoolVersion)
+	if err != nil {
+		return err
+	}
+
+	// Set up the Kosmos tunnel before the components, they may need to reach the cluster
+	if nodemetadata.Tunnel != nil {
+		err = setupTunnel(*nodemetadata.Tunnel)
+		if err != nil {
+			return fmt.Errorf("failed to set up tunnel: %w", err)
+		}
+	}
+
+	// Provision the local disks before the components, they may be installed on them
+	if nodemetadata.LocalDisks != nil {
+		err = provisionLocalDisks(*nodemetadata.LocalDisks)
+		if err != nil {
+			return fmt.Errorf("failed to provision local disks: %w", err)
+		}
+	}
+
+	// Process the node network prerequisites before the components
+	err = processNetwork(slog.Default(), "node", nodemetadata.Network)
+	if err != nil {
+		return fmt.Errorf("failed to process node network: %w", err)
+	}
+
+	// Process the node firewall openings before the components
+	err = processFirewall(slog.Default(), "node", nodemetadata.Firewall)
 	if err != nil {
-		return fmt.Errorf("failed to get release components: %w", err)
+		return fmt.Errorf("failed to process node firewall: %w", err)
 	}
 
-	// Uninstall components (components are uninstalled in reverse order)
-	err = uninstallComponents(ctx, repoFS, releaseComponents, nodemetadata)
+	// Process the node kernel parameters, they take effect on the next boot
+	err = processKernel(slog.Default(), "node", nodemetadata.Kernel)
 	if err != nil {
-		return fmt.Errorf("failed to uninstall components: %w", err)
+		return fmt.Errorf("failed to process node kernel parameters: %w", err)
 	}
 
-	// Install components
-	err = installComponents(ctx, repoFS, releaseComponents, nodemetadata)
+	// Process the node mounts before the components, they may be installed on the mounts
+	err = processMounts(slog.Default(), nodemetadata.Mounts)
 	if err != nil {
-		return fmt.Errorf("failed to install components: %w", err)
+		return fmt.Errorf("failed to process node mounts: %w", err)
+	}
+
+	// Render the containerd storage settings, the root may be on the mounts. They are applied with
+	// containerd when it is deferred until the maintenance window.
+	if !nodemetadata.deferContainerd {
+		containerdVersion, err := containerdVersion(releaseComponents, nodemetadata.PoolVersion)
+		if err != nil {
+			return err
+		}
+		err = processContainerd(nodemetadata.Containerd, containerdVersion)
+		if err != nil {
+			return fmt.Errorf("failed to process containerd settings: %w", err)
+		}
+	}
+
+	// Quarantine the configuration of a previous CNI before the kubelet is restarted
+	_, err = reconcileCNI(nodemetadata.CNI)
+	if err != nil {
+		return fmt.Errorf("failed to reconcile CNI configuration: %w", err)
+	}
+
+	// Adopt the components installed by a previous tooling on first install, they are not reinstalled
+	err = adoptComponents(ctx, repoFS, nodemetadata, releaseComponents, upgrade)
+	if err != nil {
+		return err
+	}
+
+	// Load the image manifest once, the files baked into the image are not copied again
+	if serviceManager != chrootServiceManager {
+		nodemetadata.image, err = loadImageManifest()
+		if err != nil {
+			slog.Warn("Invalid image manifest, installing the components", slog.String("file", imageManifestFile), slog.Any("error", err))
+		}
+	}
+
+	// On first boot, check the image against the whole release at once, the install phase is then
+	// skipped: the components baked into the image are only recorded as installed
+	verifiedImage, err := imageFastPath(nodemetadata, releaseComponents, upgrade)
+	if err != nil {
+		return err
+	}
+	if verifiedImage != nil {
+		err = recordImageComponents(verifiedImage, nodemetadata)
+		if err != nil {
+			return fmt.Errorf("failed to record image components: %w", err)
+		}
+	} else {
+		// Uninstall components (components are uninstalled in reverse order)
+		err = uninstallComponents(ctx, repoFS, releaseComponents, nodemetadata)
+		if err != nil {
+			return fmt.Errorf("failed to uninstall components: %w", err)
+		}
+
+		// Install components
+		err = installComponents(ctx, repoFS, releaseComponents, nodemetadata)
+		if err != nil {
+			return fmt.Errorf("failed to install components: %w", err)
+		}
+	}
+
+	// Configure the GPUs once the driver is installed
+	err = configureGPU(nodemetadata.GPU)
+	if err != nil {
+		return fmt.Errorf("failed to configure GPUs: %w", err)
+	}
+
+	// Render the node kubeconfig owned by root, eg: for debugging on the node
+	err = syncNodeKubeconfig(nodemetadata)
+	if err != nil {
+		return err
+	}
+
+	// Pin the repository snapshot used by this install
+	err = saveRepoPin(nodemetadata, pinned)
+	if err != nil {
+		return err
 	}
 
 	// Cleanup the repository FS (eg: remove the zip file for local zipFS)
@@ -97,7 +324,7 @@ func uninstallComponents(ctx context.Context, repoFS fs.FS, components []Compone
 		// Check context cancellation
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("context cancelled")
+			return fmt.Errorf("context cancelled: %w", context.Cause(ctx))
 		default:
 		}
 
@@ -111,128 +338,585 @@ func uninstallComponents(ctx context.Context, repoFS fs.FS, components []Compone
 			continue
 		}
 
-		// Read component specific "metadata.yaml" file inside the component directory in root of the repository
-		componentSections, err := componentMetadata(repoFS, component.Name, installedVersion)
+		// Remove the file of a previous source install, the file replaced in place is kept
+		logger := componentLogger(component.Name, installedVersion, "uninstall")
+		replacedVersion, err := uninstallComponentSource(logger, component.Name, component.Source)
+		if err != nil {
+			return fmt.Errorf("failed to uninstall component %s source: %w", component.Name, err)
+		}
+
+		// A source replaces the file of the installed version in place, the installed version is not
+		// uninstalled so its other files and services are kept
+		if component.Source != nil {
+			continue
+		}
+
+		// Back to the repository, the version the source replaced is uninstalled
+		if replacedVersion != "" {
+			installedVersion = replacedVersion
+			logger = componentLogger(component.Name, installedVersion, "uninstall")
+		}
+
+		// Read and verify the installed version metadata, from the repository the component was
+		// installed from, the component only reads the files of its own directory
+		componentSections, componentFS, err := installedComponentMetadata(repoFS, nodemetadata, component.Name, installedVersion)
 		if err != nil {
-			return fmt.Errorf("failed to read component metadata: %w", err)
+			return err
+		}
+
+		// Build the template functions allowed for the component
+		funcs, err := templateFuncMap(componentSections.TemplateFunctions)
+		if err != nil {
+			return fmt.Errorf("invalid template functions for component %s: %w", component.Name, err)
 		}
 
 		// Uninstall the component
-		slog.Info("Uninstall component", slog.String("component", component.Name), slog.String("version", installedVersion))
-		err = processComponentMetadata(repoFS, component.Name, "uninstalled", componentSections.Uninstall, nodemetadata)
+		logger.Info("Uninstall component")
+		err = processComponentMetadata(ctx, logger, componentFS, component.Name, "uninstalled", componentSections.Uninstall, funcs, nodemetadata)
 		if err != nil {
 			return fmt.Errorf("failed to uninstall component %s: %w", component.Name, err)
 		}
+
+		// The kernel parameters of the component are removed with it, even if its uninstall does not
+		// declare them absent
+		err = processKernel(logger, component.Name, &ComponentKernel{State: "absent"})
+		if err != nil {
+			return fmt.Errorf("failed to remove component %s kernel parameters: %w", component.Name, err)
+		}
 	}
 
 	return nil
 }
 
 func installComponents(ctx context.Context, repoFS fs.FS, components []Component, nodemetadata NodeMetadata) error {
+	// Install the components concurrently, once the components they require are installed
+	if nodemetadata.featureEnabled(FeatureParallelInstall) && !nodemetadata.SystemExtensions {
+		return installComponentsConcurrently(ctx, repoFS, components, nodemetadata)
+	}
+
 	// Install component one by one
-	for _, component := range components {
+	for i, component := range components {
 		// Check context cancellation
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("context cancelled")
+			return fmt.Errorf("context cancelled: %w", context.Cause(ctx))
 		default:
 		}
 
-		// Get current installed version of the component
+		err := installComponent(ctx, repoFS, nil, component, fmt.Sprintf("%d/%d", i+1, len(components)), nodemetadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// componentInstallWorkers is the maximum number of components installed concurrently
+const componentInstallWorkers = 4
+
+// installComponentsConcurrently installs the components concurrently, a component waits for the
+// components it requires, or for all the previous components of the release when its metadata is only
+// read once attested. The system extensions are merged once for the whole node, so their components
+// are always installed one by one.
+func installComponentsConcurrently(ctx context.Context, repoFS fs.FS, components []Component, nodemetadata NodeMetadata) error {
+	// Read the metadata of the components concurrently, before installing any component
+	prefetched, err := prefetchComponentMetadata(repoFS, components, nodemetadata)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var (
+		wg      sync.WaitGroup
+		workers = make(chan struct{}, componentInstallWorkers)
+		done    = make([]chan struct{}, len(components))
+		errs    = make([]error, len(components))
+	)
+	for i := range components {
+		done[i] = make(chan struct{})
+	}
+	for i, component := range components {
+		wg.Go(func() {
+			defer close(done[i])
+
+			// Wait for the previous components the component depends on
+			for j := range i {
+				if !componentDependsOn(component, components[j], prefetched) {
+					continue
+				}
+				select {
+				case <-done[j]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-workers }()
+			if ctx.Err() != nil {
+				return
+			}
+
+			errs[i] = installComponent(ctx, repoFS, prefetched, component, fmt.Sprintf("%d/%d", i+1, len(components)), nodemetadata)
+			if errs[i] != nil {
+				cancel(errs[i])
+			}
+		})
+	}
+	wg.Wait()
+
+	// Report the errors in the components order
+	err = errors.Join(errs...)
+	if err == nil && ctx.Err() != nil {
+		err = fmt.Errorf("context cancelled: %w", context.Cause(ctx))
+	}
+	return err
+}
+
+// componentDependsOn returns whether the component is installed after the previous component of the
+// release: the component requires it, or its metadata was not prefetched
+func componentDependsOn(component, previous Component, prefetched map[string]ComponentSections) bool {
+	sections, ok := prefetched[component.Name]
+	if !ok {
+		return true
+	}
+	_, required := sections.Requires[previous.Name]
+	return required
+}
+
+// installComponent installs the component version of the release if it is not installed yet, the
+// metadata prefetched is used if any
+func installComponent(ctx context.Context, repoFS fs.FS, prefetched map[string]ComponentSections, component Component, progress string, nodemetadata NodeMetadata) error {
+	// Get current installed version of the component
+	installedVersion, err := GetComponentVersion(component.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get component version: %w", err)
+	}
+	expectedVersion := expandVersion(component.Version, nodemetadata.PoolVersion)
+	logger := componentLogger(component.Name, expectedVersion, "install")
+
+	// If the component is already installed and the version is the same, skip it
+	if installedVersion == expectedVersion {
+		logger.Info("Component already installed")
+		setComponentStatus(component.Name, expectedVersion, "installed")
+		return nil
+	}
+	setComponentStatus(component.Name, expectedVersion, "installing")
+
+	// Install the component from its source file, bypassing the repository
+	if component.Source != nil {
+		// The source file has no provenance attestation
+		if nodemetadata.Provenance.enforced(component.Name) {
+			return fmt.Errorf("component %s source cannot be installed: its provenance is not attested", component.Name)
+		}
+		logger.Info("Install component from source")
+		err = installComponentSource(ctx, logger, component.Name, expectedVersion, *component.Source)
+		if err != nil {
+			return fmt.Errorf("failed to install component %s from source: %w", component.Name, err)
+		}
+		setComponentStatus(component.Name, expectedVersion, "installed")
+		return nil
+	}
+
+	// Read and verify the component before any change
+	componentSections, componentFS, funcs, err := openComponentInstall(repoFS, prefetched, component.Name, expectedVersion, nodemetadata)
+	if err != nil {
+		return err
+	}
+	if componentSections.fallback != "" {
+		logger.Warn("Component version not found, using fallback", slog.String("fallback", componentSections.fallback), slog.String("rule", componentSections.fallbackRule))
+	}
+
+	// Install the component
+	logger.Info("Install component", slog.String("progress", progress))
+	err = processComponentMetadata(ctx, logger, componentFS, component.Name, expectedVersion, componentSections.Install, funcs, nodemetadata)
+	if err != nil {
+		return fmt.Errorf("failed to install component %s: %w", component.Name, err)
+	}
+
+	// Record the repository the component was installed from
+	err = recordComponentRepo(component.Name, nodemetadata.RepoURI)
+	if err != nil {
+		return err
+	}
+	setComponentStatus(component.Name, expectedVersion, "installed")
+
+	return nil
+}
+
+// openComponentInstall returns the install sections, the filesystem and the template functions of the
+// component version, once its provenance, template args and sources are verified. The metadata
+// prefetched is used if any.
+func openComponentInstall(repoFS fs.FS, prefetched map[string]ComponentSections, name, version string, nodemetadata NodeMetadata) (ComponentSections, fs.FS, template.FuncMap, error) {
+	// The component only reads the files of its own directory
+	componentFS, err := openComponentFS(repoFS, name)
+	if err != nil {
+		return ComponentSections{}, nil, nil, err
+	}
+
+	// Reject the component not built by the expected pipeline, it is then only read from its
+	// attested files
+	componentFS, err = verifyComponentProvenance(componentFS, name, version, nodemetadata.Provenance)
+	if err != nil {
+		return ComponentSections{}, nil, nil, fmt.Errorf("failed to verify component %s provenance: %w", name, err)
+	}
+
+	// Read component specific "metadata.yaml" file inside the component directory in root of the repository
+	componentSections, ok := prefetched[name]
+	if !ok {
+		componentSections, err = componentFSMetadata(componentFS, name, version)
+		if err != nil {
+			return ComponentSections{}, nil, nil, fmt.Errorf("failed to read component metadata: %w", err)
+		}
+	}
+
+	// Validate the template args before rendering any template
+	err = validateComponentTemplateArgs(componentFS, nodemetadata.TemplateArgs)
+	if err != nil {
+		return ComponentSections{}, nil, nil, fmt.Errorf("invalid template args for component %s: %w", name, err)
+	}
+
+	// Build the template functions allowed for the component
+	funcs, err := templateFuncMap(componentSections.TemplateFunctions)
+	if err != nil {
+		return ComponentSections{}, nil, nil, fmt.Errorf("invalid template functions for component %s: %w", name, err)
+	}
+
+	// Reject the files not attested before any change
+	err = checkAttestedSources(componentFS, version, componentSections.Install)
+	if err != nil {
+		return ComponentSections{}, nil, nil, fmt.Errorf("failed to verify component %s provenance: %w", name, err)
+	}
+
+	return componentSections, componentFS, funcs, nil
+}
+
+// prefetchComponentMetadata reads the metadata of the components to install concurrently, the components
+// already installed, installed from a source or verified against their provenance are skipped
+func prefetchComponentMetadata(repoFS fs.FS, components []Component, nodemetadata NodeMetadata) (map[string]ComponentSections, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		errs     []error
+		sections = make(map[string]ComponentSections)
+	)
+	for _, component := range components {
 		installedVersion, err := GetComponentVersion(component.Name)
 		if err != nil {
-			return fmt.Errorf("failed to get component version: %w", err)
+			return nil, fmt.Errorf("failed to get component version: %w", err)
 		}
 		expectedVersion := expandVersion(component.Version, nodemetadata.PoolVersion)
-
-		// If the component is already installed and the version is the same, skip it
-		if installedVersion == expectedVersion {
-			slog.Info("Component already installed", slog.String("component", component.Name), slog.String("version", expectedVersion))
+		// The metadata of the components verified against their provenance is read once attested
+		if installedVersion == expectedVersion || component.Source != nil || nodemetadata.Provenance.enforced(component.Name) {
 			continue
 		}
 
-		// Read component specific "metadata.yaml" file inside the component directory in root of the repository
-		componentSections, err := componentMetadata(repoFS, component.Name, expectedVersion)
-		if err != nil {
-			return fmt.Errorf("failed to read component metadata: %w", err)
+		wg.Go(func() {
+			componentSections, err := componentMetadata(repoFS, component.Name, expectedVersion)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to read component %s metadata: %w", component.Name, err))
+				return
+			}
+			sections[component.Name] = componentSections
+		})
+	}
+	wg.Wait()
+
+	return sections, errors.Join(errs...)
+}
+
+// deferredChown is a chown deferred after the scripts execution, since the owner or group
+// may be created by the component scripts
+type deferredChown struct {
+	Path  string
+	Owner string
+	Group string
+}
+
+// componentFileWorkers is the maximum number of files of a component written concurrently
+const componentFileWorkers = 8
+
+// concurrentFileStates are the file states written concurrently, the other states are applied alone
+// in order since the next files may depend on them, eg: a directory
+var concurrentFileStates = []string{"file", "file_if_absent", "template"}
+
+func processComponentFiles(logger *slog.Logger, componentFS fs.FS, name, version string, files []ComponentFile, funcs template.FuncMap, nodeMetadata NodeMetadata) ([]deferredChown, error) {
+	// The existing files not managed by the agent are taken over on install and upgrade, except for the
+	// components installed before the managed files were recorded
+	installedVersion, err := GetComponentVersion(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get component version: %w", err)
+	}
+	managedFilesMu.Lock()
+	managedFiles, err := loadManagedFiles()
+	managedFilesMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	installed := installedVersion != "" && installedVersion != "uninstalled"
+	legacyInstall := installed && !slices.Contains(slices.Collect(maps.Values(managedFiles)), name)
+
+	// Write the independent files concurrently, in batches of consecutive files
+	var deferredChowns []deferredChown
+	for _, batch := range componentFileBatches(files) {
+		var (
+			wg      sync.WaitGroup
+			workers = make(chan struct{}, componentFileWorkers)
+			chowns  = make([][]deferredChown, len(batch))
+			errs    = make([]error, len(batch))
+		)
+		for i, file := range batch {
+			workers <- struct{}{}
+			wg.Go(func() {
+				defer func() { <-workers }()
+				chowns[i], errs[i] = processComponentFile(logger, componentFS, name, version, file, funcs, nodeMetadata, legacyInstall)
+			})
 		}
+		wg.Wait()
 
-		// Install the component
-		slog.Info("Install component", slog.String("component", component.Name), slog.String("version", expectedVersion))
-		err = processComponentMetadata(repoFS, component.Name, expectedVersion, componentSections.Install, nodemetadata)
+		// Report the errors in the files order
+		err = errors.Join(errs...)
 		if err != nil {
-			return fmt.Errorf("failed to install component %s: %w", component.Name, err)
+			return nil, err
 		}
+		deferredChowns = slices.Concat(deferredChowns, slices.Concat(chowns...))
 	}
 
-	return nil
+	// The units are verified once all the files are written, eg: with the binaries they run
+	err = verifyComponentUnits(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return deferredChowns, nil
 }
 
-func processComponentFiles(repoFS fs.FS, name, version string, files []ComponentFile, nodeMetadata NodeMetadata) error {
+// componentFileBatches splits the files in batches which can be written concurrently: consecutive
+// files of the concurrent states with distinct destinations
+func componentFileBatches(files []ComponentFile) [][]ComponentFile {
+	var (
+		batches      [][]ComponentFile
+		batch        []ComponentFile
+		destinations = make(map[string]bool)
+	)
 	for _, file := range files {
-		// Template the source and destination paths
-		src, err := templateComponentPath(file.Src, version)
-		if err != nil {
-			return fmt.Errorf("failed to template source path: %w", err)
+		dst := destinationPath(file.sourceName(), file.Dst)
+		if len(batch) > 0 && (!slices.Contains(concurrentFileStates, file.State) || !slices.Contains(concurrentFileStates, batch[0].State) || destinations[dst]) {
+			batches = append(batches, batch)
+			batch = nil
+			clear(destinations)
+		}
+		batch = append(batch, file)
+		destinations[dst] = true
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+
+	return batches
+}
+
+// processComponentFile applies the state of the component file
+func processComponentFile(logger *slog.Logger, componentFS fs.FS, name, version string, file ComponentFile, funcs template.FuncMap, nodeMetadata NodeMetadata, legacyInstall bool) ([]deferredChown, error) {
+	var deferredChowns []deferredChown
+
+	// Defer the chown if the owner or group does not exist yet
+	deferChown := func(path string, err error) error {
+		if !errors.Is(err, errUnknownOwner) {
+			return err
 		}
-		dst, err := templateComponentPath(file.Dst, version)
+		logger.Info("Owner not found, chown deferred after scripts", slog.String("path", path), slog.Any("reason", err))
+		deferredChowns = append(deferredChowns, deferredChown{Path: path, Owner: file.Owner, Group: file.Group})
+		return nil
+	}
+
+	// Template the source and destination paths, the artifacts are resolved with the component index
+	src, err := componentFileSource(componentFS, file, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve source path: %w", err)
+	}
+	dst, err := templateComponentPath(file.Dst, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to template destination path: %w", err)
+	}
+	dst = nodeMetadata.componentPath(name, dst)
+	if file.Artifact != "" {
+		dst = destinationPath(file.Artifact, dst)
+	}
+
+	// The directories of the system extensions are created with the files
+	if strings.HasPrefix(dst, sysextDir+"/") && file.State != "absent" {
+		err = os.MkdirAll(hostPath(filepath.Dir(destinationPath(src, dst))), defaultDirectoryMode)
 		if err != nil {
-			return fmt.Errorf("failed to template destination path: %w", err)
+			return nil, fmt.Errorf("failed to create system extension directory: %w", err)
 		}
+	}
 
-		switch file.State {
-		case "file":
-			// When type is file, only copy the file from the repository to the filesystem
-			filePath, err := writeFile(repoFS, name, src, dst, file.Mode, file.Owner, file.Group)
-			if err != nil {
-				return fmt.Errorf("failed to write file %s: %w", file.Dst, err)
-			}
-			slog.Info("File copied", slog.String("file", filePath))
-		case "template":
-			// When type is template, render the file with the node metadata and copy it to the filesystem
-			filePath, err := templateFile(repoFS, name, src, dst, file.Mode, file.Owner, file.Group, nodeMetadata)
-			if err != nil {
-				return fmt.Errorf("failed to write file %s: %w", file.Dst, err)
-			}
-			slog.Info("Template rendered", slog.String("template", filePath))
-		case "directory":
-			// When type is dir, create the directory with the specified permissions
-			// if the directory already exists, the ownership and permissions are ensured
-			err := mkdir(file.Dst, file.Mode, file.Owner, file.Group)
-			if err != nil {
-				return fmt.Errorf("failed to make directory %s: %w", dst, err)
-			}
-			slog.Info("Directory created", slog.String("directory", dst))
-		case "absent":
-			// When type is absent, remove the file or directory
-			err := os.RemoveAll(dst)
+	switch file.State {
+	case "file":
+		// When type is file, only copy the file from the repository to the filesystem
+		err := checkTakeover(logger, destinationPath(src, dst), name, legacyInstall, file.Force)
+		if err != nil {
+			return nil, err
+		}
+		// The files pre-installed into the image are not downloaded again
+		if serviceManager != chrootServiceManager && bakedFile(nodeMetadata.image, name, version, destinationPath(src, dst)) {
+			err = recordManagedFile(destinationPath(src, dst), name)
 			if err != nil {
-				return fmt.Errorf("failed to remove %s: %w", dst, err)
+				return nil, fmt.Errorf("failed to record managed file %s: %w", destinationPath(src, dst), err)
 			}
-			slog.Info("File/Directory removed", slog.String("path", dst))
+			logger.Info("File pre-installed in the image", slog.String("file", destinationPath(src, dst)))
+			return deferredChowns, nil
+		}
+		filePath, err := writeFile(componentFS, src, dst, file.Mode, file.Owner, file.Group, file.Header)
+		err = deferChown(filePath, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write file %s: %w", file.Dst, err)
+		}
+		err = recordManagedFile(filePath, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record managed file %s: %w", filePath, err)
+		}
+		logger.Info("File copied", slog.String("file", filePath))
+	case "file_if_absent":
+		// When type is file_if_absent, only copy the file if the destination does not exist yet,
+		// the file is then owned by the user and never overwritten
+		filePath := destinationPath(src, dst)
+		_, err := os.Lstat(hostPath(filePath))
+		if err == nil {
+			logger.Info("File already present, not overwritten", slog.String("file", filePath))
+			return deferredChowns, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to stat file %s: %w", filePath, err)
 		}
+
+		filePath, err = writeFile(componentFS, src, dst, file.Mode, file.Owner, file.Group, file.Header)
+		err = deferChown(filePath, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write file %s: %w", file.Dst, err)
+		}
+		logger.Info("File copied", slog.String("file", filePath))
+	case "template":
+		// When type is template, render the file with the node metadata and copy it to the filesystem
+		err := checkTakeover(logger, destinationPath(src, dst), name, legacyInstall, file.Force)
+		if err != nil {
+			return nil, err
+		}
+		filePath, err := templateFile(componentFS, src, dst, file.Mode, file.Owner, file.Group, file.Header, funcs, nodeMetadata)
+		err = deferChown(filePath, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write file %s: %w", file.Dst, err)
+		}
+		err = recordManagedFile(filePath, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record managed file %s: %w", filePath, err)
+		}
+		logger.Info("Template rendered", slog.String("template", filePath))
+	case "kubeconfig":
+		// When type is kubeconfig, render the node kubeconfig, it is rendered again on rotation
+		err := checkTakeover(logger, dst, name, legacyInstall, file.Force)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writeKubeconfig(Kubeconfig{Path: dst, Owner: file.Owner, Group: file.Group}, nodeMetadata)
+		err = deferChown(dst, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write kubeconfig %s: %w", file.Dst, err)
+		}
+		err = recordManagedFile(dst, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record managed file %s: %w", dst, err)
+		}
+		logger.Info("Kubeconfig rendered", slog.String("kubeconfig", dst))
+	case "directory":
+		// When type is dir, create the directory and its parents with the specified permissions
+		// if the directory already exists, the ownership and permissions are ensured
+		err := mkdir(dst, file.Mode, file.Owner, file.Group, file.ApplyToParents)
+		err = deferChown(dst, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make directory %s: %w", dst, err)
+		}
+		logger.Info("Directory created", slog.String("directory", dst))
+	case "absent":
+		// When type is absent, remove the file or directory
+		err := os.RemoveAll(hostPath(dst))
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove %s: %w", dst, err)
+		}
+		err = forgetManagedFile(dst)
+		if err != nil {
+			return nil, fmt.Errorf("failed to forget managed file %s: %w", dst, err)
+		}
+		err = forgetKubeconfig(dst)
+		if err != nil {
+			return nil, fmt.Errorf("failed to forget kubeconfig %s: %w", dst, err)
+		}
+		logger.Info("File/Directory removed", slog.String("path", dst))
 	}
 
-	return nil
+	return deferredChowns, nil
 }
 
-func processComponentScripts(scripts []ComponentScript) error {
+func processComponentScripts(logger *slog.Logger, name, version string, scripts []ComponentScript, nodeMetadata NodeMetadata) error {
 	// Execute the scripts in bash
 	for _, script := range scripts {
-		// Execute the script with with the arguments via bash
-		cmd := exec.Command("/bin/bash", "-c", script.Cmd)
-		err := cmd.Run()
+		// Refuse the scripts which differ from their digest, the pinned scripts are audited. The digest
+		// is trusted if the metadata is attested, or if pinned by the node metadata endpoint.
+		attested := nodeMetadata.Provenance.enforced(name) || slices.Contains(nodeMetadata.ScriptDigests, strings.ToLower(script.SHA256))
+		run, cleanup, err := checkScriptDigests(script, nodeMetadata.featureEnabled(FeatureScriptDigests), attested)
 		if err != nil {
-			return fmt.Errorf("failed to execute script %s: %w", script.Cmd, err)
+			recordScriptAudit(logger, name, version, script, "denied", err.Error())
+			return fmt.Errorf("script %s refused: %w", script.Cmd, err)
+		}
+		if script.SHA256 != "" {
+			err = appendAudit(scriptAuditEntry(name, version, script, "started", script.Cmd))
+			if err != nil {
+				return fmt.Errorf("failed to record script %s in the audit log: %w", script.Cmd, err)
+			}
+		}
+
+		// Execute the script with with the arguments via bash
+		start := time.Now()
+		cmd := scriptCommand(run, nodeMetadata.ResourceLimits)
+		cmd.Env = scriptEnv(script)
+
+		// Stream the script output to the debug logs, the background processes started by the script
+		// may keep the output open after it exits
+		output := newScriptOutput(logger, script.Cmd)
+		stdout, stderr := output.stream("stdout"), output.stream("stderr")
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		cmd.WaitDelay = scriptOutputWaitDelay
+		err = runScriptWithProgress(logger, cmd, script.Cmd)
+		cleanup()
+		stdout.flush()
+		stderr.flush()
+		if err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+			if script.SHA256 != "" {
+				recordScriptAudit(logger, name, version, script, "failed", err.Error())
+			}
+			return fmt.Errorf("failed to execute script %s: %w, last output:\n%s", script.Cmd, err, output.Tail())
 		}
+		if script.SHA256 != "" {
+			recordScriptAudit(logger, name, version, script, "succeeded", script.Cmd)
+		}
+		logger.Info("Script executed", slog.String("script", script.Cmd), slog.Duration("duration", time.Since(start).Round(time.Millisecond)))
 	}
 
 	return nil
 }
 
-func processComponentServices(services []ComponentService) error {
+func processComponentServices(ctx context.Context, logger *slog.Logger, services []ComponentService) error {
 	// Daemon-reload to pick up the updated service files
-	cmd := exec.Command("/usr/bin/systemctl", "daemon-reload")
+	cmd := command("/usr/bin/systemctl", "daemon-reload")
 	err := cmd.Run()
 	if err != nil {
 		return fmt.Errorf("failed to daemon-reload: %w", err)
@@ -241,14 +925,14 @@ func processComponentServices(services []ComponentService) error {
 	for _, service := range services {
 		// Enable the service
 		if service.Enabled {
-			cmd = exec.Command("/usr/bin/systemctl", "enable", service.Name)
+			cmd = command("/usr/bin/systemctl", "enable", service.Name)
 			err = cmd.Run()
 			if err != nil {
 				return fmt.Errorf("failed to enable service %s: %w", service.Name, err)
 			}
-			slog.Info("Service enabled", slog.String("service", service.Name))
+			logger.Info("Service enabled", slog.String("service", service.Name))
 		} else {
-			cmd = exec.Command("/usr/bin/systemctl", "disable", service.Name)
+			cmd = command("/usr/bin/systemctl", "disable", service.Name)
 			err = cmd.Run()
 			if err != nil {
 				if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
@@ -259,19 +943,27 @@ func processComponentServices(services []ComponentService) error {
 
 				return fmt.Errorf("failed to disable service %s: %w", service.Name, err)
 			}
-			slog.Info("Service disabled", slog.String("service", service.Name))
+			logger.Info("Service disabled", slog.String("service", service.Name))
 		}
 
 		switch service.State {
 		case "started":
-			cmd = exec.Command("/usr/bin/systemctl", "start", service.Name)
+			// Do not let the kubelet crash-loop while the container runtime is not ready
+			if slices.Contains(criGatedServices, service.Name) {
+				err = waitForCRI(ctx, logger)
+				if err != nil {
+					return err
+				}
+			}
+
+			cmd = command("/usr/bin/systemctl", "start", service.Name)
 			err = cmd.Run()
 			if err != nil {
 				return fmt.Errorf("failed to start service %s: %w", service.Name, err)
 			}
-			slog.Info("Service started", slog.String("service", service.Name))
+			logger.Info("Service started", slog.String("service", service.Name))
 		case "stopped":
-			cmd = exec.Command("/usr/bin/systemctl", "stop", service.Name)
+			cmd = command("/usr/bin/systemctl", "stop", service.Name)
 			err = cmd.Run()
 			if err != nil {
 				if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 5 {
@@ -282,7 +974,7 @@ func processComponentServices(services []ComponentService) error {
 
 				return fmt.Errorf("failed to stop service %s: %w", service.Name, err)
 			}
-			slog.Info("Service stopped", slog.String("service", service.Name))
+			logger.Info("Service stopped", slog.String("service", service.Name))
 		default:
 			return fmt.Errorf("unknown service state: %s", service.State)
 		}
@@ -291,30 +983,130 @@ func processComponentServices(services []ComponentService) error {
 	return nil
 }
 
-// processComponentMetadata processes the files and services operations defined in the component metadata
-func processComponentMetadata(repoFS fs.FS, name, version string, resources []ComponentResources, nodeMetadata NodeMetadata) error {
+// componentLogger returns the logger of the component operations, so the logs can be filtered by
+// component, eg: journalctl -u scw-k8s-agent --grep component=kubelet
+func componentLogger(name, version, phase string) *slog.Logger {
+	return slog.With(slog.String("component", name), slog.String("version", version), slog.String("phase", phase))
+}
+
+// processComponentMetadata processes the files and services operations defined in the component metadata,
+// the component files are read from the component directory filesystem
+// nodeResourcesMu serializes the node-wide changes of the components installed concurrently, they
+// update the node state shared by all the components, eg: the firewall rules
+var nodeResourcesMu sync.Mutex
+
+// processNodeResources processes the mounts, network, firewall and kernel parameters operations
+func processNodeResources(logger *slog.Logger, name string, resource ComponentResources) error {
+	nodeResourcesMu.Lock()
+	defer nodeResourcesMu.Unlock()
+
+	// Process mounts operations
+	err := processMounts(logger, resource.Mounts)
+	if err != nil {
+		return fmt.Errorf("failed to process mounts: %w", err)
+	}
+
+	// Process network operations
+	err = processNetwork(logger, name, resource.Network)
+	if err != nil {
+		return fmt.Errorf("failed to process network: %w", err)
+	}
+
+	// Process firewall operations
+	err = processFirewall(logger, name, resource.Firewall)
+	if err != nil {
+		return fmt.Errorf("failed to process firewall: %w", err)
+	}
+
+	// Process kernel parameters operations
+	err = processKernel(logger, name, resource.Kernel)
+	if err != nil {
+		return fmt.Errorf("failed to process kernel parameters: %w", err)
+	}
+
+	return nil
+}
+
+func processComponentMetadata(ctx context.Context, logger *slog.Logger, componentFS fs.FS, name, version string, resources []ComponentResources, funcs template.FuncMap, nodeMetadata NodeMetadata) error {
+	// Fail before any change if a file cannot be written
+	err := checkWritableDestinations(name, version, resources, nodeMetadata)
+	if err != nil {
+		return fmt.Errorf("component %s cannot be written: %w", name, err)
+	}
+
+	// The system extension staged to write its files is merged again, even if the process fails
+	staged := false
+	defer func() {
+		if staged {
+			_ = refreshStagedSysext(name)
+		}
+	}()
+
 	for _, resource := range resources {
+		// Process the node-wide operations, first since files may be written on the mounts
+		err := processNodeResources(logger, name, resource)
+		if err != nil {
+			return err
+		}
+
+		// Stage the system extension while its files are written
+		if nodeMetadata.SystemExtensions && len(resource.Files) > 0 {
+			err = stageSysext(name)
+			if err != nil {
+				return err
+			}
+			staged = true
+		}
+
 		// Process files operations
-		err := processComponentFiles(repoFS, name, version, resource.Files, nodeMetadata)
+		deferredChowns, err := processComponentFiles(logger, componentFS, name, version, resource.Files, funcs, nodeMetadata)
 		if err != nil {
 			return fmt.Errorf("failed to process files: %w", err)
 		}
 
+		// Merge the system extensions again before the services are started
+		if staged && version == "uninstalled" {
+			err = refreshStagedSysext(name)
+		} else if staged {
+			err = installSysext(logger, name, version)
+		}
+		if err != nil {
+			return err
+		}
+		staged = false
+
 		// Process services operations
-		err = processComponentServices(resource.Services)
+		err = processComponentServices(ctx, logger, resource.Services)
 		if err != nil {
 			return fmt.Errorf("failed to process services: %w", err)
 		}
 
 		// Process scripts operations
-		err = processComponentScripts(resource.Scripts)
+		err = processComponentScripts(logger, name, version, resource.Scripts, nodeMetadata)
 		if err != nil {
 			return fmt.Errorf("failed to process scripts: %w", err)
 		}
+
+		// Process the chowns deferred until the scripts created the owners and groups
+		for _, deferred := range deferredChowns {
+			err = chown(deferred.Path, deferred.Owner, deferred.Group)
+			if err != nil {
+				return fmt.Errorf("failed to chown %s: %w", deferred.Path, err)
+			}
+			logger.Info("Deferred chown applied", slog.String("path", deferred.Path))
+		}
+	}
+
+	// Remove the system extension of the uninstalled component
+	if nodeMetadata.SystemExtensions && version == "uninstalled" {
+		err = removeSysext(logger, name)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Store the component version in the versions file
-	err := SetComponentVersion(name, version)
+	err = SetComponentVersion(name, version)
 	if err != nil {
 		return fmt.Errorf("failed to store component version: %w", err)
 	}
@@ -322,31 +1114,175 @@ func processComponentMetadata(repoFS fs.FS, name, version string, resources []Co
 	return nil
 }
 
-// releaseComponents returns the list of components for the given version
-func componentMetadata(repoFS fs.FS, name, version string) (ComponentSections, error) {
+// openComponentFS returns the filesystem of the component directory, so the component cannot read
+// the files of the other components
+func openComponentFS(repoFS fs.FS, name string) (fs.FS, error) {
+	if !fs.ValidPath(name) || name == "." || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid component name %q", name)
+	}
+
+	componentFS, err := fs.Sub(repoFS, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open component %s directory: %w", name, err)
+	}
+
+	// The components of the repository layout v2 have an index of their artifacts
+	return openIndexedFS(componentFS, name)
+}
+
+// parseComponentMetadata reads and strictly unmarshals the component "metadata.yaml" file
+func parseComponentMetadata(repoFS fs.FS, name string) (ComponentVersions, error) {
+	componentFS, err := openComponentFS(repoFS, name)
+	if err != nil {
+		return ComponentVersions{}, err
+	}
+
+	return parseComponentFSMetadata(componentFS, name)
+}
+
+// parseComponentFSMetadata reads and strictly unmarshals the "metadata.yaml" file of the component
+// filesystem
+func parseComponentFSMetadata(componentFS fs.FS, name string) (ComponentVersions, error) {
 	// Read component specific "metadata.yaml" file inside the component directory in root of the repository
-	componentMetadataFile, err := fs.ReadFile(repoFS, name+"/metadata.yaml")
+	componentMetadataFile, err := fs.ReadFile(componentFS, "metadata.yaml")
 	if err != nil {
-		return ComponentSections{}, fmt.Errorf("failed to read component file: %w", err)
+		return ComponentVersions{}, fmt.Errorf("failed to read component file: %w", err)
 	}
 
-	// Unmarshal the metadata file
+	// Unmarshal the metadata file, unknown fields are errors
 	var componentMetadata ComponentVersions
-	err = yaml.Unmarshal(componentMetadataFile, &componentMetadata)
+	err = unmarshalStrict(componentMetadataFile, &componentMetadata)
 	if err != nil {
-		return ComponentSections{}, fmt.Errorf("failed to unmarshal component file: %w", err)
+		return ComponentVersions{}, fmt.Errorf("failed to unmarshal component file %s/metadata.yaml: %w", name, err)
+	}
+	for _, rule := range componentMetadata.Fallback {
+		if !slices.Contains(fallbackRules, rule) {
+			return ComponentVersions{}, fmt.Errorf("invalid fallback %q in component file %s/metadata.yaml", rule, name)
+		}
+	}
+
+	// With an index, the versions available are the ones of the index, the metadata only sets their
+	// sections. The versions without sections use the ones of their fallback version, eg: default, before
+	// the versions missing from the index are dropped.
+	if indexed, ok := componentIndex(componentFS); ok {
+		versions := make(map[string]ComponentSections, len(indexed.index.Versions)+1)
+		for version := range indexed.index.Versions {
+			sections, ok := componentMetadata.Versions[version]
+			if !ok {
+				if fallbackVersion, _, found := componentMetadata.fallbackVersion(version); found {
+					sections = componentMetadata.Versions[fallbackVersion]
+				}
+			}
+			versions[version] = sections
+		}
+		if sections, ok := componentMetadata.Versions[defaultVersionKey]; ok {
+			versions[defaultVersionKey] = sections
+		}
+		componentMetadata.Versions = versions
+	}
+
+	return componentMetadata, nil
+}
+
+// releaseComponents returns the list of components for the given version
+func componentMetadata(repoFS fs.FS, name, version string) (ComponentSections, error) {
+	componentFS, err := openComponentFS(repoFS, name)
+	if err != nil {
+		return ComponentSections{}, err
+	}
+
+	return componentFSMetadata(componentFS, name, version)
+}
+
+// componentFSMetadata returns the sections of the version from the metadata of the component filesystem
+func componentFSMetadata(componentFS fs.FS, name, version string) (ComponentSections, error) {
+	componentMetadata, err := parseComponentFSMetadata(componentFS, name)
+	if err != nil {
+		return ComponentSections{}, err
 	}
 
-	// Remove subversion suffix from the version
+	// Remove subversion suffix from the version, the default version key is not a version
 	version = trimVersion(version)
+	if version == defaultVersionKey {
+		return ComponentSections{}, fmt.Errorf("component version %s is reserved for the default fallback", version)
+	}
 
-	// Get the metadata for the given version
+	// Get the metadata for the given version, or the fallback version of the component if any
+	var fallbackVersion, rule string
 	componentMetadataVersion, ok := componentMetadata.Versions[version]
 	if !ok {
-		return ComponentSections{}, fmt.Errorf("component version %s not found", version)
+		// The versions missing from the index have no artifacts, the fallback only applies to their sections
+		if _, indexed := componentIndex(componentFS); indexed {
+			return ComponentSections{}, fmt.Errorf("component version %s not found in index", version)
+		}
+		var found bool
+		fallbackVersion, rule, found = componentMetadata.fallbackVersion(version)
+		if !found {
+			return ComponentSections{}, fmt.Errorf("component version %s not found", version)
+		}
+		componentMetadataVersion = componentMetadata.Versions[fallbackVersion]
+	}
+
+	sections, err := componentMetadata.merge(version, componentMetadataVersion)
+	if err != nil {
+		return ComponentSections{}, err
+	}
+	sections.fallback, sections.fallbackRule = fallbackVersion, rule
+	return sections, nil
+}
+
+// merge merges the version sections over the defaults and the matching ranges (in their sorted order)
+func (c ComponentVersions) merge(version string, sections ComponentSections) (ComponentSections, error) {
+	merged := c.Defaults
+
+	if len(c.Ranges) > 0 {
+		parsedVersion, err := semver.NewVersion(version)
+		if err != nil {
+			return ComponentSections{}, fmt.Errorf("version %s cannot be matched against ranges: %w", version, err)
+		}
+		for _, versionRange := range slices.Sorted(maps.Keys(c.Ranges)) {
+			constraint, err := semver.NewConstraint(versionRange)
+			if err != nil {
+				return ComponentSections{}, fmt.Errorf("invalid version range %q: %w", versionRange, err)
+			}
+			if constraint.Check(parsedVersion) {
+				merged = merged.override(c.Ranges[versionRange])
+			}
+		}
+	}
+
+	return merged.override(sections), nil
+}
+
+// override returns the sections with the sections set in the override replaced
+func (s ComponentSections) override(override ComponentSections) ComponentSections {
+	if override.Install != nil {
+		s.Install = override.Install
+	}
+	if override.Uninstall != nil {
+		s.Uninstall = override.Uninstall
+	}
+	if override.TemplateFunctions != nil {
+		s.TemplateFunctions = override.TemplateFunctions
+	}
+	if override.Adopt != nil {
+		s.Adopt = override.Adopt
+	}
+	if override.Requires != nil {
+		s.Requires = override.Requires
+	}
+	return s
+}
+
+// componentVersions returns the versions defined in the component metadata
+func componentVersions(repoFS fs.FS, name string) ([]string, error) {
+	componentMetadata, err := parseComponentMetadata(repoFS, name)
+	if err != nil {
+		return nil, err
 	}
 
-	return componentMetadataVersion, nil
+	delete(componentMetadata.Versions, defaultVersionKey)
+	return slices.Collect(maps.Keys(componentMetadata.Versions)), nil
 }
 
 // templateComponentPath renders a component path based on the version and architecture
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestComponentVersionsMerge(t *testing.T) {
+	base := []ComponentResources{{Scripts: []ComponentScript{{Cmd: "base"}}}}
+	legacy := []ComponentResources{{Scripts: []ComponentScript{{Cmd: "legacy"}}}}
+	specific := []ComponentResources{{Scripts: []ComponentScript{{Cmd: "specific"}}}}
+
+	versions := ComponentVersions{
+		Defaults: ComponentSections{Install: base, Uninstall: base},
+		Ranges: map[string]ComponentSections{
+			"< 1.30":          {Install: legacy},
+			">= 1.29, < 1.31": {TemplateFunctions: []string{"upper"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		version  string
+		sections ComponentSections
+		expected ComponentSections
+	}{
+		{
+			name:     "defaults only",
+			version:  "1.31.0",
+			expected: ComponentSections{Install: base, Uninstall: base},
+		},
+		{
+			name:     "ranges",
+			version:  "1.29.4",
+			expected: ComponentSections{Install: legacy, Uninstall: base, TemplateFunctions: []string{"upper"}},
+		},
+		{
+			name:     "version override",
+			version:  "1.30.2",
+			sections: ComponentSections{Install: specific},
+			expected: ComponentSections{Install: specific, Uninstall: base, TemplateFunctions: []string{"upper"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := versions.merge(tt.version, tt.sections)
+			if err != nil {
+				t.Fatalf("merge() error = %v", err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("merge() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestOpenComponentFS(t *testing.T) {
+	repoFS := fstest.MapFS{
+		"containerd/metadata.yaml":     {Data: []byte("versions: {}\n")},
+		"containerd/config.toml":       {Data: []byte("version = 2\n")},
+		"kubelet/secret/bootstrap.key": {Data: []byte("secret")},
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		wantErr bool
+	}{
+		{"containerd", "config.toml", false},
+		{"containerd", "../kubelet/secret/bootstrap.key", true},
+		{"containerd", "/kubelet/secret/bootstrap.key", true},
+		{"kubelet/secret", "bootstrap.key", true},
+		{"..", "kubelet/secret/bootstrap.key", true},
+		{".", "kubelet/secret/bootstrap.key", true},
+	}
+
+	for _, test := range tests {
+		componentFS, err := openComponentFS(repoFS, test.name)
+		if err == nil {
+			_, err = fs.ReadFile(componentFS, test.src)
+		}
+		if (err != nil) != test.wantErr {
+			t.Errorf("reading %s from component %s: error = %v, wantErr %v", test.src, test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestComponentLogger(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	defer slog.SetDefault(slog.Default())
+	var output bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&output, nil)))
+
+	for _, dir := range []string{"/var/run", "/etc"} {
+		err := os.MkdirAll(hostPath(dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logger := componentLogger("containerd", "1.7.22", "install")
+	resources := []ComponentResources{{
+		Firewall: &ComponentFirewall{Rules: []FirewallRule{{Protocol: "tcp", Ports: "10250"}}},
+		Kernel:   &ComponentKernel{Cmdline: []string{"systemd.unified_cgroup_hierarchy=1"}},
+		Services: []ComponentService{{Name: "containerd", Enabled: true, State: "started"}},
+	}}
+	err := processComponentMetadata(context.Background(), logger, fstest.MapFS{}, "containerd", "1.7.22", resources, nil, NodeMetadata{})
+	if err != nil {
+		t.Fatalf("failed to process component: %v", err)
+	}
+
+	// Every log of the component operations, including the node-wide ones, is attributed to the component
+	var messages []string
+	for line := range strings.Lines(output.String()) {
+		var record map[string]any
+		err = json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("invalid log record %q: %v", line, err)
+		}
+		if record["component"] != "containerd" || record["version"] != "1.7.22" || record["phase"] != "install" {
+			t.Errorf("log record not attributed to the component: %q", line)
+		}
+		messages = append(messages, record["msg"].(string))
+	}
+	for _, expected := range []string{"Firewall rules applied", "Kernel parameters changed, reboot required", "Service enabled", "Service started"} {
+		if !slices.Contains(messages, expected) {
+			t.Errorf("expected the record %q, got %q", expected, messages)
+		}
+	}
+}
+
+func TestComponentFileBatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []ComponentFile
+		expected [][]string
+	}{
+		{
+			name: "independent files",
+			files: []ComponentFile{
+				{State: "file", Src: "bin/bridge", Dst: "/opt/cni/bin/"},
+				{State: "file", Src: "bin/host-local", Dst: "/opt/cni/bin/"},
+				{State: "template", Src: "10-bridge.conflist", Dst: "/etc/cni/net.d/"},
+			},
+			expected: [][]string{{"/opt/cni/bin/bridge", "/opt/cni/bin/host-local", "/etc/cni/net.d/10-bridge.conflist"}},
+		},
+		{
+			name: "directory before its files",
+			files: []ComponentFile{
+				{State: "directory", Dst: "/opt/cni/bin"},
+				{State: "file", Src: "bin/bridge", Dst: "/opt/cni/bin/"},
+				{State: "file", Src: "bin/host-local", Dst: "/opt/cni/bin/"},
+				{State: "absent", Dst: "/opt/cni/bin/flannel"},
+				{State: "kubeconfig", Dst: "/etc/cni/net.d/cni.kubeconfig"},
+			},
+			expected: [][]string{{"/opt/cni/bin"}, {"/opt/cni/bin/bridge", "/opt/cni/bin/host-local"}, {"/opt/cni/bin/flannel"}, {"/etc/cni/net.d/cni.kubeconfig"}},
+		},
+		{
+			name: "same destination",
+			files: []ComponentFile{
+				{State: "file", Src: "config.toml", Dst: "/etc/containerd/config.toml"},
+				{State: "template", Src: "config.toml.tmpl", Dst: "/etc/containerd/config.toml"},
+			},
+			expected: [][]string{{"/etc/containerd/config.toml"}, {"/etc/containerd/config.toml"}},
+		},
+	}
+	for _, test := range tests {
+		var batches [][]string
+		for _, batch := range componentFileBatches(test.files) {
+			var destinations []string
+			for _, file := range batch {
+				destinations = append(destinations, destinationPath(file.Src, file.Dst))
+			}
+			batches = append(batches, destinations)
+		}
+		if !reflect.DeepEqual(batches, test.expected) {
+			t.Errorf("%s: batches = %v, expected %v", test.name, batches, test.expected)
+		}
+	}
+}
+
+func TestProcessComponentFilesConcurrently(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	componentFS := fstest.MapFS{}
+	files := []ComponentFile{{State: "directory", Dst: "/opt/cni/bin"}}
+	for i := range 40 {
+		plugin := fmt.Sprintf("plugin-%d", i)
+		componentFS["bin/"+plugin] = &fstest.MapFile{Data: []byte(plugin)}
+		files = append(files, ComponentFile{State: "file", Src: "bin/" + plugin, Dst: "/opt/cni/bin/", Mode: "0755"})
+	}
+
+	_, err := processComponentFiles(slog.Default(), componentFS, "cni", "1.5.1", files, nil, NodeMetadata{})
+	if err != nil {
+		t.Fatalf("failed to process files: %v", err)
+	}
+
+	// All the files are written and recorded
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 40 {
+		path := fmt.Sprintf("/opt/cni/bin/plugin-%d", i)
+		content, err := os.ReadFile(hostPath(path))
+		if err != nil || string(content) != fmt.Sprintf("plugin-%d", i) {
+			t.Errorf("file %s not written: %q, %v", path, content, err)
+		}
+		if managedFiles[path] != "cni" {
+			t.Errorf("file %s not recorded as managed", path)
+		}
+	}
+
+	// The errors are reported in the files order
+	files = append(files, ComponentFile{State: "file", Src: "bin/missing-1", Dst: "/opt/cni/bin/"}, ComponentFile{State: "file", Src: "bin/missing-2", Dst: "/opt/cni/bin/"})
+	_, err = processComponentFiles(slog.Default(), componentFS, "cni", "1.5.1", files, nil, NodeMetadata{})
+	if err == nil || !strings.Contains(err.Error(), "missing-2") || strings.Index(err.Error(), "missing-1") > strings.Index(err.Error(), "missing-2") {
+		t.Errorf("expected the missing files errors in order, got %v", err)
+	}
+}
+
+func TestProcessComponentFilesTakeoverOnUpgrade(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	componentFS := fstest.MapFS{"crictl.yaml": {Data: []byte("installed")}}
+	err := os.MkdirAll(hostPath("/etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(hostPath("/etc/crictl.yaml"), []byte("user"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []ComponentFile{{State: "file", Src: "crictl.yaml", Dst: "/etc/crictl.yaml"}}
+
+	// A legacy install, without managed files recorded, keeps owning its existing files
+	err = SetComponentVersion("crictl", "1.30.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = processComponentFiles(slog.Default(), componentFS, "crictl", "1.31.0", files, nil, NodeMetadata{})
+	if err != nil {
+		t.Fatalf("expected the legacy install files overwritten, got %v", err)
+	}
+
+	// An upgrade of a tracked install refuses to overwrite an unmanaged file
+	err = os.MkdirAll(hostPath("/usr/local"), 0755)
+	if err == nil {
+		err = os.WriteFile(hostPath("/usr/local/crictl.yaml"), []byte("user"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, ComponentFile{State: "file", Src: "crictl.yaml", Dst: "/usr/local/crictl.yaml"})
+	_, err = processComponentFiles(slog.Default(), componentFS, "crictl", "1.32.0", files, nil, NodeMetadata{})
+	if err == nil || !strings.Contains(err.Error(), "not managed by the agent") {
+		t.Errorf("expected the unmanaged file refused on upgrade, got %v", err)
+	}
+}
+
+func TestInstallComponentsConcurrently(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	for _, dir := range []string{"/var/run", "/etc/containerd", "/etc/kubernetes", "/opt/cni/bin"} {
+		err := os.MkdirAll(hostPath(dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	repoFS := fstest.MapFS{
+		"containerd/metadata.yaml": {Data: []byte(`versions:
+  1.7.23:
+    install:
+      - files:
+          - {state: file, src: config.toml, dst: /etc/containerd/}
+  1.7.24:
+    install:
+      - files:
+          - {state: file, src: missing.toml, dst: /etc/containerd/}
+`)},
+		"containerd/config.toml": {Data: []byte("version = 2")},
+		"kubelet/metadata.yaml": {Data: []byte(`versions:
+  1.31.2:
+    requires: {containerd: ">=1.7"}
+    install:
+      - files:
+          - {state: file, src: kubelet.conf, dst: /etc/kubernetes/}
+  1.31.3:
+    requires: {containerd: ">=1.7"}
+    install:
+      - files:
+          - {state: file, src: kubelet.conf, dst: /etc/kubernetes/}
+`)},
+		"kubelet/kubelet.conf": {Data: []byte("kubelet")},
+		"cni/metadata.yaml": {Data: []byte(`versions:
+  1.5.1:
+    install:
+      - files:
+          - {state: file, src: bridge, dst: /opt/cni/bin/}
+`)},
+		"cni/bridge": {Data: []byte("bridge")},
+	}
+	nodemetadata := NodeMetadata{RepoURI: "https://repo", FeatureGates: map[string]bool{FeatureParallelInstall: true}}
+
+	components := []Component{{Name: "containerd", Version: "1.7.23"}, {Name: "cni", Version: "1.5.1"}, {Name: "kubelet", Version: "1.31.2"}}
+	err := installComponents(context.Background(), repoFS, components, nodemetadata)
+	if err != nil {
+		t.Fatalf("failed to install components: %v", err)
+	}
+	versions, err := ListComponentsVersions()
+	expected := map[string]string{"containerd": "1.7.23", "cni": "1.5.1", "kubelet": "1.31.2"}
+	if err != nil || !reflect.DeepEqual(versions, expected) {
+		t.Errorf("versions = %v, %v, expected %v", versions, err, expected)
+	}
+
+	// The component requiring a failed component is not installed
+	components = []Component{{Name: "containerd", Version: "1.7.24"}, {Name: "cni", Version: "1.5.1"}, {Name: "kubelet", Version: "1.31.3"}}
+	err = installComponents(context.Background(), repoFS, components, nodemetadata)
+	if err == nil || !strings.Contains(err.Error(), "failed to install component containerd") {
+		t.Fatalf("expected the containerd install error, got %v", err)
+	}
+	version, err := GetComponentVersion("kubelet")
+	if err != nil || version != "1.31.2" {
+		t.Errorf("kubelet version = %s, %v, expected the required component installed first", version, err)
+	}
+}
+
+func TestComponentDependsOn(t *testing.T) {
+	prefetched := map[string]ComponentSections{
+		"kubelet": {Requires: map[string]string{"containerd": ">=1.7"}},
+		"cni":     {},
+	}
+	tests := []struct {
+		component, previous string
+		expected            bool
+	}{
+		{"kubelet", "containerd", true},
+		{"kubelet", "cni", false},
+		{"cni", "containerd", false},
+		// The metadata of the components verified against their provenance is only read once attested
+		{"gpu-operator", "kubelet", true},
+	}
+
+	for _, test := range tests {
+		dependsOn := componentDependsOn(Component{Name: test.component}, Component{Name: test.previous}, prefetched)
+		if dependsOn != test.expected {
+			t.Errorf("%s depends on %s = %v, expected %v", test.component, test.previous, dependsOn, test.expected)
+		}
+	}
+}
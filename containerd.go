@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Containerd configures the containerd storage, rendered by the agent in a containerd configuration
+// drop-in imported by the release configuration (imports = ["/etc/containerd/conf.d/*.toml"])
+//
+//	"containerd": {
+//	   "snapshotter": "overlayfs",
+//	   "root": "/mnt/local/containerd",
+//	   "gc": {
+//	      "pause_threshold": 0.05,
+//	      "deletion_threshold": 100,
+//	      "schedule_delay": "10ms"
+//	   }
+//	}
+type Containerd struct {
+	// Snapshotter of the images, overlayfs if empty
+	Snapshotter string `json:"snapshotter,omitempty"`
+
+	// Root directory of the containerd data, eg: on the local disks, /var/lib/containerd if empty
+	Root string `json:"root,omitempty"`
+
+	// Garbage collector thresholds, the containerd defaults if not set
+	GC *ContainerdGC `json:"gc,omitempty"`
+}
+
+// ContainerdGC are the settings of the containerd garbage collector scheduler
+type ContainerdGC struct {
+	PauseThreshold    float64 `json:"pause_threshold,omitempty"`    // Maximum ratio of time paused by the collection
+	DeletionThreshold int     `json:"deletion_threshold,omitempty"` // Deletions triggering a collection
+	MutationThreshold int     `json:"mutation_threshold,omitempty"` // Mutations triggering a collection
+	ScheduleDelay     string  `json:"schedule_delay,omitempty"`     // Delay before a triggered collection, eg: 10ms
+}
+
+// containerdSnapshotters are the supported snapshotters
+var containerdSnapshotters = []string{"overlayfs", "native", "erofs", "stargz"}
+
+// containerdStargzAddress is the socket of the stargz snapshotter, run as a proxy plugin
+const containerdStargzAddress = "/run/containerd-stargz-grpc/containerd-stargz-grpc.sock"
+
+// containerdStorageFile is the configuration drop-in rendered from the metadata
+const containerdStorageFile = "/etc/containerd/conf.d/90-scw-k8s-storage.toml"
+
+var containerdRootRegexp = regexp.MustCompile(`^/[A-Za-z0-9_./-]+$`)
+
+// Validate checks the containerd storage settings
+func (c Containerd) Validate() error {
+	if c.Snapshotter != "" && !slices.Contains(containerdSnapshotters, c.Snapshotter) {
+		return fmt.Errorf("unsupported snapshotter %q, expected one of %s", c.Snapshotter, strings.Join(containerdSnapshotters, ", "))
+	}
+
+	if c.Root != "" && (!containerdRootRegexp.MatchString(c.Root) || filepath.Clean(c.Root) != c.Root) {
+		return fmt.Errorf("invalid root %q, expected a clean absolute path", c.Root)
+	}
+
+	if c.GC != nil {
+		if c.GC.PauseThreshold < 0 || c.GC.PauseThreshold >= 1 {
+			return fmt.Errorf("invalid GC pause threshold %v, expected a ratio between 0 and 1", c.GC.PauseThreshold)
+		}
+		if c.GC.DeletionThreshold < 0 || c.GC.MutationThreshold < 0 {
+			return errors.New("invalid GC thresholds, expected positive numbers")
+		}
+		if c.GC.ScheduleDelay != "" {
+			_, err := time.ParseDuration(c.GC.ScheduleDelay)
+			if err != nil {
+				return fmt.Errorf("invalid GC schedule delay %q: %w", c.GC.ScheduleDelay, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// containerdConfigVersion returns the configuration version of the containerd version: 3 since
+// containerd 2.0, 2 before. The latest is used if the version is unknown.
+func containerdConfigVersion(version string) int {
+	parsed, err := semver.NewVersion(trimVersion(version))
+	if err == nil && parsed.Major() < 2 {
+		return 2
+	}
+	return 3
+}
+
+// render returns the containerd configuration drop-in of the storage settings, in the configuration
+// version of the containerd version
+func (c Containerd) render(version string) []byte {
+	configVersion := containerdConfigVersion(version)
+
+	var config strings.Builder
+	fmt.Fprintf(&config, "# %s\nversion = %d\n", managedHeaderText, configVersion)
+
+	if c.Root != "" {
+		fmt.Fprintf(&config, "root = %q\n", c.Root)
+	}
+
+	// The CRI plugin is split in containerd 2.0, the snapshotter moved to the images plugin
+	if c.Snapshotter != "" && configVersion == 2 {
+		fmt.Fprintf(&config, "\n[plugins.'io.containerd.grpc.v1.cri'.containerd]\n  snapshotter = %q\n", c.Snapshotter)
+	} else if c.Snapshotter != "" {
+		fmt.Fprintf(&config, "\n[plugins.'io.containerd.cri.v1.images']\n  snapshotter = %q\n", c.Snapshotter)
+	}
+
+	if c.GC != nil {
+		config.WriteString("\n[plugins.'io.containerd.gc.v1.scheduler']\n")
+		if c.GC.PauseThreshold != 0 {
+			fmt.Fprintf(&config, "  pause_threshold = %v\n", c.GC.PauseThreshold)
+		}
+		if c.GC.DeletionThreshold != 0 {
+			fmt.Fprintf(&config, "  deletion_threshold = %d\n", c.GC.DeletionThreshold)
+		}
+		if c.GC.MutationThreshold != 0 {
+			fmt.Fprintf(&config, "  mutation_threshold = %d\n", c.GC.MutationThreshold)
+		}
+		if c.GC.ScheduleDelay != "" {
+			fmt.Fprintf(&config, "  schedule_delay = %q\n", c.GC.ScheduleDelay)
+		}
+	}
+
+	if c.Snapshotter == "stargz" {
+		fmt.Fprintf(&config, "\n[proxy_plugins.stargz]\n  type = \"snapshot\"\n  address = %q\n", containerdStargzAddress)
+	}
+
+	return []byte(config.String())
+}
+
+// containerdVersion returns the containerd version of the release components, the installed version
+// if the release has no containerd
+func containerdVersion(components []Component, poolVersion string) (string, error) {
+	for _, component := range components {
+		if component.Name == "containerd" {
+			return expandVersion(component.Version, poolVersion), nil
+		}
+	}
+	return GetComponentVersion("containerd")
+}
+
+// containerdSettings returns the containerd storage drop-in rendered for the containerd version, and
+// the current one. The drop-in content is nil when it is removed or missing.
+func containerdSettings(containerd *Containerd, version string) ([]byte, []byte, error) {
+	var content []byte
+	if containerd != nil {
+		err := containerd.Validate()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid containerd settings: %w", err)
+		}
+		content = containerd.render(version)
+	}
+
+	current, err := os.ReadFile(hostPath(containerdStorageFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", containerdStorageFile, err)
+	}
+	return content, current, nil
+}
+
+// containerdRestartRequired returns true if the containerd storage settings changed while containerd
+// stays at the installed version, the running containerd is then restarted to apply them. A containerd
+// installed with another version is restarted by its install anyway.
+func containerdRestartRequired(containerd *Containerd, version string) (bool, error) {
+	content, current, err := containerdSettings(containerd, version)
+	if err != nil || bytes.Equal(current, content) {
+		return false, err
+	}
+	installedVersion, err := GetComponentVersion("containerd")
+	if err != nil {
+		return false, fmt.Errorf("failed to get containerd version: %w", err)
+	}
+	return installedVersion != "" && installedVersion == version, nil
+}
+
+// processContainerd renders the containerd storage settings for the containerd version of the release,
+// containerd is restarted if it is installed and the settings changed. The controller drains the node
+// first, see UpgradePlan.ContainerdRestart. The drop-in is removed when the settings are removed from
+// the metadata.
+func processContainerd(containerd *Containerd, version string) error {
+	content, current, err := containerdSettings(containerd, version)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(current, content) {
+		return nil
+	}
+
+	if content == nil {
+		err = os.Remove(hostPath(containerdStorageFile))
+	} else {
+		err = os.MkdirAll(hostPath(filepath.Dir(containerdStorageFile)), defaultDirectoryMode)
+		if err == nil {
+			err = os.WriteFile(hostPath(containerdStorageFile), content, 0644)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", containerdStorageFile, err)
+	}
+
+	// The images are pulled again when the root or the snapshotter changes
+	if current != nil {
+		slog.Warn("Containerd storage settings changed", slog.Any("containerd", containerd))
+	}
+
+	// Only restart an installed containerd, it is started with the settings when installed. The running
+	// containerd may not support the configuration version of the containerd about to be installed.
+	installedVersion, err := GetComponentVersion("containerd")
+	if err != nil {
+		return fmt.Errorf("failed to get containerd version: %w", err)
+	}
+	if installedVersion == "" || installedVersion != version {
+		slog.Info("Containerd storage settings written, applied once containerd is installed", slog.String("file", containerdStorageFile))
+		return nil
+	}
+	cmd := command("/usr/bin/systemctl", "restart", "containerd")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to restart containerd: %w: %s", err, output)
+	}
+	slog.Info("Containerd storage settings applied", slog.String("file", containerdStorageFile))
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestContainerdValidate(t *testing.T) {
+	tests := []struct {
+		containerd Containerd
+		valid      bool
+	}{
+		{Containerd{Snapshotter: "erofs", Root: "/mnt/local/containerd", GC: &ContainerdGC{PauseThreshold: 0.05, ScheduleDelay: "10ms"}}, true},
+		{Containerd{Snapshotter: "aufs"}, false},
+		{Containerd{Root: "var/lib/containerd"}, false},
+		{Containerd{Root: "/mnt/local/../containerd"}, false},
+		{Containerd{Root: "/mnt/\"local"}, false},
+		{Containerd{GC: &ContainerdGC{PauseThreshold: 1.5}}, false},
+		{Containerd{GC: &ContainerdGC{ScheduleDelay: "10"}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.containerd.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: error = %v, valid %v", test.containerd, err, test.valid)
+		}
+	}
+}
+
+func TestContainerdRender(t *testing.T) {
+	config := string(Containerd{Snapshotter: "stargz", Root: "/mnt/local/containerd", GC: &ContainerdGC{DeletionThreshold: 100}}.render("2.0.2"))
+
+	for _, expected := range []string{
+		"version = 3\n",
+		"root = \"/mnt/local/containerd\"\n",
+		"[plugins.'io.containerd.cri.v1.images']\n  snapshotter = \"stargz\"\n",
+		"[plugins.'io.containerd.gc.v1.scheduler']\n  deletion_threshold = 100\n",
+		"[proxy_plugins.stargz]\n",
+	} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("expected %q in the rendered configuration:\n%s", expected, config)
+		}
+	}
+}
+
+func TestContainerdRenderVersion(t *testing.T) {
+	tests := []struct {
+		version  string
+		expected []string
+	}{
+		{version: "1.7.22~1", expected: []string{"version = 2\n", "[plugins.'io.containerd.grpc.v1.cri'.containerd]\n  snapshotter = \"erofs\"\n"}},
+		{version: "2.1.0", expected: []string{"version = 3\n", "[plugins.'io.containerd.cri.v1.images']\n  snapshotter = \"erofs\"\n"}},
+		{version: "", expected: []string{"version = 3\n"}},
+	}
+
+	for _, test := range tests {
+		config := string(Containerd{Snapshotter: "erofs"}.render(test.version))
+		for _, expected := range test.expected {
+			if !strings.Contains(config, expected) {
+				t.Errorf("%s: expected %q in the rendered configuration:\n%s", test.version, expected, config)
+			}
+		}
+	}
+}
+
+func TestProcessContainerdRestart(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	for _, dir := range []string{"/var/run", "/etc"} {
+		err := os.MkdirAll(hostPath(dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := SetComponentVersion("containerd", "2.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerd := &Containerd{Snapshotter: "erofs"}
+
+	// The settings of another containerd version are applied by its install
+	restart, err := containerdRestartRequired(containerd, "2.1.0")
+	if err != nil || restart {
+		t.Errorf("expected no restart for a containerd upgrade, got %v, %v", restart, err)
+	}
+
+	// The installed containerd is restarted once the settings changed, the plan drains the node first
+	restart, err = containerdRestartRequired(containerd, "2.0.2")
+	if err != nil || !restart {
+		t.Fatalf("expected a restart for the changed settings, got %v, %v", restart, err)
+	}
+	err = processContainerd(containerd, "2.0.2")
+	if err != nil {
+		t.Fatalf("failed to process containerd settings: %v", err)
+	}
+	commands, err := os.ReadFile(hostPath(commandsLog))
+	if err != nil || !strings.Contains(string(commands), "systemctl restart containerd") {
+		t.Errorf("expected containerd restarted, got %q, %v", commands, err)
+	}
+
+	restart, err = containerdRestartRequired(containerd, "2.0.2")
+	if err != nil || restart {
+		t.Errorf("expected no restart once the settings are applied, got %v, %v", restart, err)
+	}
+}
@@ -3,87 +3,220 @@ package main
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"reflect"
+	"maps"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/client-go/util/workqueue"
-	"k8s.io/kubectl/pkg/scheme"
+)
+
+// Annotations used to drive the agent
+var (
+	// agentAnnotation triggers an agent operation on the node, eg: "upgrade" or "restart=kubelet"
+	agentAnnotation = defaultAnnotationPrefix + "agent"
+	// upgradePlanAnnotation is set by the agent with the hash of the pending upgrade plan
+	upgradePlanAnnotation = defaultAnnotationPrefix + "upgrade-plan"
+	// upgradeApprovedAnnotation is set by the control plane with the hash of the approved upgrade plan
+	upgradeApprovedAnnotation = defaultAnnotationPrefix + "upgrade-approved"
+	// planPreviewAnnotation is set by the agent with the upgrade plan computed on a "plan" operation
+	planPreviewAnnotation = defaultAnnotationPrefix + "plan"
+	// agentPanicAnnotation is set by the agent with the time and message of its last panic
+	agentPanicAnnotation = defaultAnnotationPrefix + "agent-panic"
+	// repoFetchAnnotation is set by the agent with the repository download statistics of the last install
+	repoFetchAnnotation = defaultAnnotationPrefix + "repo-fetch"
+	// managedAnnotationsAnnotation is set by the agent with the annotations it manages, comma separated,
+	// so the annotations set by other tools are never removed
+	managedAnnotationsAnnotation = defaultAnnotationPrefix + "agent-managed-annotations"
+	// componentAnnotationPrefix is the prefix of the annotations set by the agent with the installed
+	// components versions, eg: k8s.scaleway.com/component-kubelet=1.31.2
+	componentAnnotationPrefix = defaultAnnotationPrefix + "component-"
+)
+
+// Conditions set by the agent on the node, prefixed with the annotation prefix once configured
+var (
+	// upgradeDeferredCondition is true while an upgrade waits, eg: for its approval or an upgrade slot
+	upgradeDeferredCondition corev1.NodeConditionType = "AgentUpgradeDeferred"
+	// tunnelUnavailableCondition is true while the tunnel to the control plane is down
+	tunnelUnavailableCondition corev1.NodeConditionType = "AgentTunnelUnavailable"
+	// kernelRebootCondition is true while kernel parameters wait for a reboot
+	kernelRebootCondition corev1.NodeConditionType = "KernelRebootRequired"
 )
 
 // Controller is a controller that watches and reconciles the node
 type Controller struct {
 	nodeName string
 
+	// Node metadata of the last install or upgrade, read by the reconciles and the process duties
+	// (heartbeat, remote API) while the reconciles update it
+	nodeMetadataMu sync.RWMutex
+	nodeMetadata   NodeMetadata
+
+	// privileged runs the operations requiring root, in this process or in the root agent process
+	privileged privileged
+
 	logger *slog.Logger
 
 	client          kubernetes.Interface
 	informerFactory informers.SharedInformerFactory
-	recorder        record.EventRecorder
+	recorder        *eventRecorder
 	nodesLister     corelisters.NodeLister
 	nodesSynced     cache.InformerSynced
 	queue           workqueue.TypedRateLimitingInterface[cache.ObjectName]
+
+	// NodeOperations of the node, nil if the NodeOperations feature gate is disabled
+	dynamicClient             dynamic.Interface
+	operationsInformerFactory dynamicinformer.DynamicSharedInformerFactory
+	operationsLister          cache.GenericLister
+	operationsSynced          cache.InformerSynced
+
+	// Reconcile loop liveness, reported to the systemd watchdog
+	reconciling   atomic.Bool
+	lastReconcile atomic.Int64
+	lastSyncError atomic.Pointer[string] // nil if the last reconcile succeeded
+
+	// Last image filesystem check, the checks are spaced by imageGCInterval
+	lastImageGC time.Time
+
+	// Last versions annotations update, they are spaced by annotationsUpdateInterval
+	lastAnnotationsUpdate time.Time
+
+	// Requeue delay while the node is not registered by the kubelet, zero once registered
+	nodeWaitDelay time.Duration
+
+	// Last node seen, nil until registered or once its deletion is handled
+	lastNode *corev1.Node
+
+	// Last ReleaseNotFound or ReleaseFallback event of the upgrade in progress, reported once
+	releaseReported string
+
+	// The node is decommissioned, the controller is stopping
+	decommissioned bool
+
+	// Cluster CA trusted by the client, and last check of its rotation, they are spaced by caCheckInterval
+	clusterCA   string
+	lastCACheck time.Time
+
+	// Stops the controller, Run returns the restart reason if a restart is requested
+	cancel        context.CancelFunc
+	restartReason atomic.Pointer[string]
+
+	// Nodes of a shared agent: their reconciles act on the same host so they are serialized, except
+	// while a node drains, and the process duties (systemd notifications, watchdog, stalls, heartbeat,
+	// admin operations) are left to the first node
+	sharedSync *sync.Mutex
+	secondary  bool
+
+	// Serializes the reconciles and the operations of the admin socket and remote API, eg: verify
+	operationMu sync.Mutex
+
+	// Managed node of a shared agent other than the host, eg: a virtual machine of a hypervisor
+	managedNode bool
 }
 
-func NewController(ctx context.Context, nodemetadata NodeMetadata) (*Controller, error) {
-	// Build the Kubernetes client configuration
-	config, err := clientcmd.BuildConfigFromFlags(nodemetadata.ClusterURL, "")
-	if err != nil {
-		return nil, fmt.Errorf("failed to build Kubernetes client configuration: %w", err)
-	}
+// metadata returns the node metadata of the last install or upgrade
+func (c *Controller) metadata() NodeMetadata {
+	c.nodeMetadataMu.RLock()
+	defer c.nodeMetadataMu.RUnlock()
+	return c.nodeMetadata
+}
 
-	// Set the IAM bearer token for authentication
-	config.BearerToken = nodemetadata.Token
+// setMetadata replaces the node metadata once an upgrade succeeded
+func (c *Controller) setMetadata(nodeMetadata NodeMetadata) {
+	c.nodeMetadataMu.Lock()
+	defer c.nodeMetadataMu.Unlock()
+	c.nodeMetadata = nodeMetadata
+}
 
-	// Set the CA certificate from the node metadata
-	decodedCA, err := base64.StdEncoding.DecodeString(nodemetadata.ClusterCA)
+// annotationsUpdateInterval is the minimum time between two versions annotations updates, so the
+// API server is not updated on every reconcile when other actors keep changing the node
+const annotationsUpdateInterval = 30 * time.Second
+
+// Backoff of the reconciles while the node is not registered, capped below watchdogStaleAfter since
+// no other event requeues the node until it is added
+const (
+	nodeWaitInitialDelay = time.Second
+	nodeWaitMaxDelay     = 30 * time.Second
+)
+
+// errNodeNotRegistered is returned by the reconcile while the node is not in the informer cache, eg:
+// at startup before the kubelet registers it
+var errNodeNotRegistered = errors.New("node not registered")
+
+// watchdogStaleAfter is the time after which the reconcile loop is considered stuck if it did not
+// reconcile, the node is resynced every minute
+const watchdogStaleAfter = 5 * time.Minute
+
+func NewController(ctx context.Context, nodemetadata NodeMetadata, privileged privileged) (*Controller, error) {
+	// Check the node name before editing the node
+	err := validateNodeName(nodemetadata.Name, len(nodemetadata.ManagedNodes) == 0)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode Kubernetes CA certificate: %w", err)
+		return nil, err
 	}
-	config.CAData = decodedCA
 
 	// Create the Kubernetes client
-	client, err := kubernetes.NewForConfig(config)
+	client, err := newKubernetesClient(nodemetadata)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+		return nil, err
+	}
+
+	// Wait for the Kubernetes API before constructing the informers, the control plane may still be provisioning
+	err = waitForAPIServer(ctx, client, nodemetadata.ClusterURL, nodemetadata.Name)
+	if err != nil {
+		return nil, err
 	}
 
+	// The resync periods and rate limits are tuned by the node metadata
+	settings := nodemetadata.ControllerTuning.settingsOrDefaults()
+
 	// Create the node informer with a field selector to watch only the current node
 	fieldSelector := fmt.Sprintf("metadata.name=%s", nodemetadata.Name)
 	tweakListOptions := func(options *metav1.ListOptions) {
 		options.FieldSelector = fieldSelector
 	}
-	informerFactory := informers.NewSharedInformerFactoryWithOptions(client, time.Hour*24, informers.WithTweakListOptions(tweakListOptions))
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(client, settings.InformerResync, informers.WithTweakListOptions(tweakListOptions))
 	nodeInformer := informerFactory.Core().V1().Nodes()
 
 	// Define the rate limiter for the workqueue
 	ratelimiter := workqueue.NewTypedMaxOfRateLimiter(
-		workqueue.NewTypedItemExponentialFailureRateLimiter[cache.ObjectName](5*time.Millisecond, 1000*time.Second),
-		&workqueue.TypedBucketRateLimiter[cache.ObjectName]{Limiter: rate.NewLimiter(rate.Limit(50), 300)},
+		workqueue.NewTypedItemExponentialFailureRateLimiter[cache.ObjectName](settings.QueueBaseDelay, settings.QueueMaxDelay),
+		&workqueue.TypedBucketRateLimiter[cache.ObjectName]{Limiter: rate.NewLimiter(rate.Limit(settings.QueueQPS), settings.QueueBurst)},
 	)
 
-	// Create the recorder for events
-	eventBroadcaster := record.NewBroadcaster(record.WithContext(ctx))
-	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
-	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "agent"})
+	// Create the recorder for events, also aggregated in events.k8s.io/v1 event series
+	recorder := newEventRecorder(ctx, client, nodemetadata.Name)
 
 	// Create the controller
 	controller := &Controller{
 		nodeName:        nodemetadata.Name,
+		nodeMetadata:    nodemetadata,
+		clusterCA:       nodemetadata.ClusterCA,
+		privileged:      privileged,
 		client:          client,
 		informerFactory: informerFactory,
 		recorder:        recorder,
@@ -107,25 +240,138 @@ func NewController(ctx context.Context, nodemetadata NodeMetadata) (*Controller,
 			deletedNode := obj.(*corev1.Node)
 			controller.queue.Add(cache.ObjectName{Namespace: deletedNode.Namespace, Name: deletedNode.Name})
 		},
-	}, time.Minute)
+	}, settings.HandlerResync)
 	if err != nil {
 		return nil, fmt.Errorf("failed to set up event handler for node informer: %w", err)
 	}
 
+	// Watch the NodeOperations of the node
+	if nodemetadata.featureEnabled(FeatureNodeOperations) {
+		err = controller.setupNodeOperations(nodemetadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return controller, nil
 }
 
+// newKubernetesClient creates a Kubernetes client authenticated with the node token
+func newKubernetesClient(nodemetadata NodeMetadata) (kubernetes.Interface, error) {
+	config, err := kubernetesConfig(nodemetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the Kubernetes client
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	return client, nil
+}
+
+// kubernetesConfig returns the Kubernetes client configuration authenticated with the node token
+func kubernetesConfig(nodemetadata NodeMetadata) (*rest.Config, error) {
+	// Build the Kubernetes client configuration
+	config, err := clientcmd.BuildConfigFromFlags(nodemetadata.ClusterURL, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Kubernetes client configuration: %w", err)
+	}
+
+	// Set the IAM bearer token for authentication
+	config.BearerToken = nodemetadata.Token
+
+	// Set the CA certificate from the node metadata
+	decodedCA, err := base64.StdEncoding.DecodeString(nodemetadata.ClusterCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Kubernetes CA certificate: %w", err)
+	}
+	config.CAData = decodedCA
+
+	// Set the client rate limits, tuned by the node metadata
+	settings := nodemetadata.ControllerTuning.settingsOrDefaults()
+	config.QPS, config.Burst = settings.QPS, settings.Burst
+
+	// Use protobuf to cut the API bandwidth of the agents of all the nodes, the responses are also
+	// gzip-compressed unless DisableCompression is set. The dynamic client of the custom resources
+	// still uses JSON.
+	config.ContentType = runtime.ContentTypeProtobuf
+	config.AcceptContentTypes = runtime.ContentTypeProtobuf + "," + runtime.ContentTypeJSON
+
+	// Refuse the writes to other nodes than the own node
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &ownNodeTransport{next: rt, nodeName: nodemetadata.Name}
+	})
+
+	return config, nil
+}
+
 func (c *Controller) Run(ctx context.Context) error {
+	ctx, c.cancel = context.WithCancel(ctx)
+	defer c.cancel()
+
+	// Check the credentials first, the informers would retry forever with rejected credentials
+	_, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if apierrors.IsUnauthorized(err) || apierrors.IsForbidden(err) {
+		return fmt.Errorf("%w: %w", errControllerAuth, err)
+	}
+
 	// Start the informer factories to begin populating the informer caches
 	c.logger.Info("Starting controller")
 	go c.informerFactory.Start(ctx.Done())
+	cacheSyncs := []cache.InformerSynced{c.nodesSynced}
+	if c.operationsInformerFactory != nil {
+		go c.operationsInformerFactory.Start(ctx.Done())
+		cacheSyncs = append(cacheSyncs, c.operationsSynced)
+	}
 
 	// Wait for the cache to be synced before starting worker
 	c.logger.Info("Waiting for informer cache to sync")
-	if ok := cache.WaitForCacheSync(ctx.Done(), c.nodesSynced); !ok {
+	if ok := cache.WaitForCacheSync(ctx.Done(), cacheSyncs...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	c.lastReconcile.Store(time.Now().UnixNano())
+	if !c.secondary {
+		// The node is installed and the controller is ready
+		err = sdNotify("READY=1\nSTATUS=Controller running")
+		if err != nil {
+			c.logger.Warn("Failed to notify systemd", slog.Any("error", err))
+		}
+
+		// Ping the systemd watchdog while the reconcile loop is alive
+		if interval := watchdogInterval(); interval > 0 {
+			go c.runWatchdog(ctx, interval)
+		}
+
+		// Report the stalled reconciles on the node
+		stalls.setReport(c.reportStall)
+		defer stalls.setReport(nil)
+
+		// Run the operations requested on the admin socket and the remote API
+		adminController.Store(c)
+		defer adminController.CompareAndSwap(c, nil)
+		if remoteAPIAddressFlag != "" {
+			go func() {
+				defer handlePanic(c.reportPanic)
+
+				err := c.serveRemoteAPI(ctx, remoteAPIAddressFlag, remoteAPICertFlag, remoteAPIKeyFlag)
+				if err != nil && ctx.Err() == nil {
+					c.logger.Warn("Failed to serve remote API", slog.Any("error", err))
+				}
+			}()
+		}
+
+		// Report the agent liveness to the control plane, while the node metadata sets a heartbeat endpoint
+		go func() {
+			defer handlePanic(c.reportPanic)
+
+			c.runHeartbeat(ctx)
+		}()
+	}
+
 	// Start the worker
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -134,6 +380,7 @@ func (c *Controller) Run(ctx context.Context) error {
 			wg.Done()
 			c.logger.Info("Defer worker stopped")
 		}()
+		defer handlePanic(c.reportPanic)
 
 		wait.UntilWithContext(ctx, c.runWorker, time.Second)
 	}()
@@ -142,15 +389,104 @@ func (c *Controller) Run(ctx context.Context) error {
 	// Block until the context is done and gracefully shut down the worker
 	<-ctx.Done()
 	c.logger.Info("Shutting down worker")
+	if !c.secondary {
+		_ = sdNotify("STOPPING=1")
+	}
 	c.queue.ShutDown()
 
 	// Wait for the worker to finish
 	wg.Wait()
 	c.logger.Info("Worker stopped")
 
+	// The agent is restarted by systemd
+	if reason := c.restartReason.Load(); reason != nil {
+		return fmt.Errorf("controller restart required: %s", *reason)
+	}
+
 	return nil
 }
 
+// requestRestart stops the controller, Run returns an error so the agent is restarted by systemd
+func (c *Controller) requestRestart(reason string) {
+	c.logger.Info("Restarting controller", slog.String("reason", reason))
+	c.restartReason.Store(&reason)
+	c.cancel()
+}
+
+// reportPanic reports the panic on the node with an event and an annotation, synchronously
+// since the agent exits right after
+func (c *Controller) reportPanic(message string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		c.logger.Error("Failed to get node to report panic", slog.Any("error", err))
+		return
+	}
+
+	now := metav1.Now()
+	err = c.createNodeEvent(ctx, node, "AgentPanic", message)
+	if err != nil {
+		c.logger.Error("Failed to create panic event", slog.Any("error", err))
+	}
+
+	nodeCopy := node.DeepCopy()
+	if nodeCopy.Annotations == nil {
+		nodeCopy.Annotations = make(map[string]string)
+	}
+	nodeCopy.Annotations[agentPanicAnnotation] = fmt.Sprintf("%s: %s", now.Format(time.RFC3339), message)
+	_, err = c.client.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+	if err != nil {
+		c.logger.Error("Failed to annotate node with panic", slog.Any("error", err))
+	}
+}
+
+// reportStall reports the stalled reconcile or install on the node with an event, synchronously
+// since the agent may exit right after
+func (c *Controller) reportStall(message string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		c.logger.Error("Failed to get node to report stall", slog.Any("error", err))
+		return
+	}
+	err = c.createNodeEvent(ctx, node, "AgentStalled", message)
+	if err != nil {
+		c.logger.Error("Failed to create stall event", slog.Any("error", err))
+	}
+}
+
+// createNodeEvent creates a warning event on the node, without the asynchronous event recorder
+func (c *Controller) createNodeEvent(ctx context.Context, node *corev1.Node, reason, message string) error {
+	return createNodeEvents(ctx, c.client, node, eventReportingController+"-"+c.nodeName, reason, message)
+}
+
+// runWatchdog pings the systemd watchdog as long as the reconcile loop reconciles or is reconciling
+func (c *Controller) runWatchdog(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lastReconcile := time.Unix(0, c.lastReconcile.Load())
+			if !c.reconciling.Load() && time.Since(lastReconcile) > watchdogStaleAfter {
+				c.logger.Warn("Reconcile loop is stuck, not pinging the watchdog", slog.Time("last_reconcile", lastReconcile))
+				continue
+			}
+			err := sdNotify("WATCHDOG=1")
+			if err != nil {
+				c.logger.Warn("Failed to ping systemd watchdog", slog.Any("error", err))
+			}
+		}
+	}
+}
+
 // runWorker starts a single worker.
 func (c *Controller) runWorker(ctx context.Context) {
 	for c.processNextWorkItem(ctx) {
@@ -168,12 +504,54 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 
 	defer c.queue.Done(objRef)
 
+	// The admin operations wait for the reconcile, the admin socket streams its logs
+	c.operationMu.Lock()
+	defer c.operationMu.Unlock()
+	if !c.secondary {
+		adminLogs.startOperation()
+		defer adminLogs.endOperation()
+	}
+
+	// Track the reconcile loop liveness
+	c.reconciling.Store(true)
+	defer stalls.start("reconcile")()
+	defer func() {
+		c.reconciling.Store(false)
+		c.lastReconcile.Store(time.Now().UnixNano())
+	}()
+
+	if c.sharedSync != nil {
+		c.sharedSync.Lock()
+	}
 	err := c.syncHandler(ctx)
+	if c.sharedSync != nil {
+		c.sharedSync.Unlock()
+	}
+	if errors.Is(err, errNodeNotRegistered) {
+		// Requeue without reporting an error, the informer also enqueues the node once added
+		if c.nodeWaitDelay == 0 {
+			c.logger.Info("Waiting for node registration", slog.String("node", c.nodeName))
+			c.nodeWaitDelay = nodeWaitInitialDelay
+		} else {
+			c.nodeWaitDelay = min(c.nodeWaitDelay*2, nodeWaitMaxDelay)
+		}
+		c.queue.Forget(objRef)
+		c.queue.AddAfter(objRef, c.nodeWaitDelay)
+		return true
+	}
+	if c.nodeWaitDelay > 0 {
+		c.logger.Info("Node registered", slog.String("node", c.nodeName))
+		c.nodeWaitDelay = 0
+	}
+
 	if err == nil {
+		c.lastSyncError.Store(nil)
 		c.queue.Forget(objRef)
 		return true
 	}
 
+	message := err.Error()
+	c.lastSyncError.Store(&message)
 	c.logger.Error("Sync error, requeuing", slog.Any("error", err))
 	c.queue.AddRateLimited(objRef)
 	return true
@@ -181,13 +559,120 @@ func (c *Controller) processNextWorkItem(ctx context.Context) bool {
 
 // syncNode runs the node reconciliation logic.
 func (c *Controller) syncHandler(ctx context.Context) error {
+	// Nothing is reconciled once the node is decommissioned
+	if c.decommissioned {
+		return nil
+	}
+
+	// Sync the component holds before any operation using them
+	err := c.syncHolds(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to sync holds: %w", err)
+	}
+
+	// Apply the cluster CA rotation, the controller is restarted with the new CA. It is applied before
+	// the node is registered, the kubelet may need the new CA to register it.
+	err = c.syncClusterCA(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to sync cluster CA: %w", err)
+	}
+
+	// Wait for the kubelet to register the node, the versions annotations are set once it is added.
+	// Once seen, the node is decommissioned when deleted if allowed.
+	node, err := c.nodesLister.Get(c.nodeName)
+	if apierrors.IsNotFound(err) {
+		if c.lastNode == nil {
+			return errNodeNotRegistered
+		}
+		err = c.syncNodeDeletion(ctx)
+		if c.stopIfDecommissioned() {
+			return nil
+		}
+		return err
+	}
+
+	// Refuse to edit the node of another instance, the managed nodes of a shared agent must be on a
+	// network of the host
+	if err == nil {
+		err = checkNodeOwnership(node, c.managedNode)
+		if err != nil {
+			return err
+		}
+		c.lastNode = node
+
+		// Move the annotations set with the default prefix, the node is reconciled again once updated
+		migrated, err := c.migrateAnnotations(ctx, node)
+		if err != nil || migrated {
+			return err
+		}
+	}
 
 	// Upgrade the node if the annotation is set
-	err := c.upgradeNode(ctx)
+	err = c.upgradeNode(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to upgrade node %s: %w", c.nodeName, err)
 	}
 
+	// Restore the last configuration snapshot if the annotation is set
+	err = c.restoreNode(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to restore node %s: %w", c.nodeName, err)
+	}
+
+	// Compute and publish the upgrade plan if the annotation is set
+	err = c.planNode(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to plan node %s: %w", c.nodeName, err)
+	}
+
+	// Run the remediation operation if the annotation is set
+	err = c.operateNode(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to operate node %s: %w", c.nodeName, err)
+	}
+	if c.stopIfDecommissioned() {
+		return nil
+	}
+
+	// Run the pending NodeOperations of the node
+	err = c.syncNodeOperations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to sync node operations: %w", err)
+	}
+	if c.stopIfDecommissioned() {
+		return nil
+	}
+
+	// Monitor the Kosmos tunnel
+	if err := c.syncTunnel(ctx); err != nil {
+		return fmt.Errorf("failed to sync tunnel: %w", err)
+	}
+
+	// Detect and correct the network configuration drift
+	if err := c.syncNetworkDrift(ctx); err != nil {
+		return fmt.Errorf("failed to sync network drift: %w", err)
+	}
+
+	// Detect and correct the firewall rules drift
+	if err := c.syncFirewallDrift(ctx); err != nil {
+		return fmt.Errorf("failed to sync firewall drift: %w", err)
+	}
+
+	// Quarantine the configuration of another CNI
+	if err := c.syncCNIConflicts(ctx); err != nil {
+		return fmt.Errorf("failed to sync CNI configuration: %w", err)
+	}
+
+	// Remediate the image filesystem disk pressure
+	if err := c.syncImageFilesystem(ctx); err != nil {
+		return fmt.Errorf("failed to sync image filesystem: %w", err)
+	}
+
+	// Report the kernel parameters waiting for a reboot
+	if err := c.syncKernelParameters(ctx); err != nil {
+		return fmt.Errorf("failed to sync kernel parameters: %w", err)
+	}
+
 	// Sync versions annotations
 	if err := c.syncVersionsAnnotations(ctx); err != nil {
 		return fmt.Errorf("failed to sync versions annotations: %w", err)
@@ -203,35 +688,16 @@ func (c *Controller) upgradeNode(ctx context.Context) error {
 		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
 	}
 
-	// Exit if the annotation is not set
-	if value, exists := node.Annotations["k8s.scaleway.com/agent"]; !exists || value != "upgrade" {
+	// Exit if the annotation is not set, the upgrade of a managed node is refused by operateNode
+	if value, exists := node.Annotations[agentAnnotation]; !exists || value != "upgrade" || c.managedNode {
 		return nil
 	}
 
-	// The annotation is set, so we need to upgrade the node
-	c.logger.Info("Upgrading node")
-	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeUpgrade", "Node upgrading")
-
-	// Get node token to fetch the node metadata
-	nodeUserData, err := getNodeUserData()
-	if err != nil {
-		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to get credentials: %s", err)
-		return fmt.Errorf("failed to get credentials: %w", err)
-	}
-
-	// Get the node metadata, from the PN node metadata endpoint or the external kapsule endpoint
-	nodeMetadata, err := getNodeMetadata(nodeUserData.MetadataURL, nodeUserData.NodeSecretKey)
-	if err != nil {
-		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to get node metadata: %s", err)
-		return fmt.Errorf("failed to get node metadata: %w", err)
-	}
-
-	// Install the components: binaries, configuration files, and services
-	err = processComponents(ctx, nodeMetadata)
-	if err != nil {
-		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to install components: %s", err)
-		return fmt.Errorf("failed to install components: %w", err)
+	done, err := c.upgrade(ctx, node, node.Annotations[repoURIAnnotation])
+	if err != nil || !done {
+		return err
 	}
+	c.releaseReported = ""
 
 	// Remove the annotation
 	node, err = c.nodesLister.Get(c.nodeName)
@@ -239,75 +705,1007 @@ func (c *Controller) upgradeNode(ctx context.Context) error {
 		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
 	}
 	nodeCopy := node.DeepCopy()
-	delete(nodeCopy.Annotations, "k8s.scaleway.com/agent")
+	delete(nodeCopy.Annotations, agentAnnotation)
+	delete(nodeCopy.Annotations, upgradePlanAnnotation)
+	delete(nodeCopy.Annotations, upgradeApprovedAnnotation)
 	_, err = c.client.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
 	if err != nil {
 		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to remove annotation: %s", err)
 		return fmt.Errorf("failed to remove annotation from node %s: %w", c.nodeName, err)
 	}
 
-	c.logger.Info("Node upgraded")
-	c.recorder.Event(node, corev1.EventTypeNormal, "NodeUpgrade", "Node upgraded")
-
 	return nil
 }
 
-func (c *Controller) syncVersionsAnnotations(ctx context.Context) error {
-	// Read installed components versions
-	versions, err := ListComponentsVersions()
+// checkUpgradeCompatibility computes the upgrade plan and checks it against the cluster, it is only run
+// once the upgrade is not deferred since it reads the repository and the API server version. It returns
+// the checked plan.
+func (c *Controller) checkUpgradeCompatibility(ctx context.Context, node *corev1.Node, repoURI string) (UpgradePlan, error) {
+	plan, err := c.privileged.PlanComponents(ctx, InstallRequest{RepoURI: repoURI})
+	if errors.Is(err, errReleaseNotFound) {
+		c.reportRelease(node, "ReleaseNotFound", fmt.Sprintf("No release for the node pool version in repository %s: %s", repoURI, err))
+		return UpgradePlan{}, fmt.Errorf("failed to compute upgrade plan: %w", err)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to list components versions: %w", err)
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to compute upgrade plan: %s", err)
+		return UpgradePlan{}, fmt.Errorf("failed to compute upgrade plan: %w", err)
 	}
-
-	// Get the node from the lister
-	node, err := c.nodesLister.Get(c.nodeName)
+	if plan.FallbackRelease != "" {
+		c.reportRelease(node, "ReleaseFallback", releaseFallbackMessage(plan.PoolVersion, repoURI, plan.FallbackRelease))
+	}
+	err = c.checkPlanCompatibility(plan)
 	if err != nil {
-		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Incompatible upgrade plan: %s", err)
+		return UpgradePlan{}, fmt.Errorf("incompatible upgrade plan: %w", err)
 	}
-	nodeCopy := node.DeepCopy()
+	return plan, nil
+}
 
-	// Initialize the annotations map if nil
-	if nodeCopy.Annotations == nil {
-		nodeCopy.Annotations = make(map[string]string)
+// reportRelease reports the missing release or the closest release installed instead of the node pool
+// version, see -release-fallback, once per upgrade: the deferred upgrades compute the plan on each
+// reconcile
+func (c *Controller) reportRelease(node *corev1.Node, reason, message string) {
+	if c.releaseReported == reason+": "+message {
+		return
 	}
+	c.releaseReported = reason + ": " + message
+	c.recorder.Event(node, corev1.EventTypeWarning, reason, message)
+}
 
-	// Set agent version
-	versions["agent"] = Version
+// releaseFallbackMessage returns the message of the ReleaseFallback event
+func releaseFallbackMessage(poolVersion, repoURI, fallback string) string {
+	return fmt.Sprintf("No release for the node pool version %s in repository %s, using the closest release %s", poolVersion, repoURI, fallback)
+}
 
-	// Update the node annotations with the versions
-	for component, version := range versions {
-		nodeCopy.Annotations[fmt.Sprintf("k8s.scaleway.com/component-%s", component)] = version
+// upgrade upgrades the node, switching to the repository if set. It returns false if the upgrade is
+// deferred until the maintenance window opens or the upgrade plan is approved.
+func (c *Controller) upgrade(ctx context.Context, node *corev1.Node, repoURI string) (bool, error) {
+	// Get the node metadata, merged from all the metadata sources
+	nodeMetadata, err := c.privileged.LoadNodeMetadata(ctx)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to get node metadata: %s", err)
+		return false, fmt.Errorf("failed to get node metadata: %w", err)
 	}
 
-	// Remove version annotations for components not installed anymore
-	for annotation := range nodeCopy.Annotations {
-		// Check if the annotation is for a component version
-		if !strings.HasPrefix(annotation, "k8s.scaleway.com/component-") {
-			continue
+	// Switch to the repository requested by the control plane, the components are resolved against it
+	currentRepoURI := nodeMetadata.RepoURI
+	if repoURI != "" && repoURI != currentRepoURI {
+		err = nodeMetadata.checkRepoURI(repoURI)
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "RepositoryRejected", "Repository switch rejected: %s", err)
+			return false, err
+		}
+		c.logger.Info("Switching repository", slog.String("from", currentRepoURI), slog.String("to", repoURI))
+		nodeMetadata.RepoURI = repoURI
+	}
+
+	// Defer the upgrade until the maintenance window opens
+	if nodeMetadata.MaintenanceWindow != nil {
+		delay, err := nodeMetadata.MaintenanceWindow.NextOpening(time.Now())
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Invalid maintenance window: %s", err)
+			return false, fmt.Errorf("invalid maintenance window: %w", err)
 		}
 
-		found := false
-		for component := range versions {
-			if annotation == fmt.Sprintf("k8s.scaleway.com/component-%s", component) {
-				found = true
-				break
+		// Apply the non-disruptive changes now, only the disruptive ones wait for the window. The upgrade
+		// is done if it has no disruptive change.
+		if delay > 0 && nodeMetadata.SplitDisruptiveUpgrades {
+			upgraded, waiting, err := c.upgradeNonDisruptive(ctx, node, nodeMetadata, currentRepoURI)
+			if err != nil || upgraded || waiting {
+				return upgraded, err
 			}
 		}
-		if !found {
-			delete(nodeCopy.Annotations, annotation)
+
+		if delay > 0 {
+			reason, message := "MaintenanceWindowClosed", fmt.Sprintf("Upgrade deferred until the maintenance window opens in %s", delay.Round(time.Second))
+			if nodeMetadata.SplitDisruptiveUpgrades {
+				reason, message = "DisruptiveComponentsDeferred", fmt.Sprintf("Disruptive components upgrade deferred until the maintenance window opens in %s", delay.Round(time.Second))
+			}
+			changed, err := c.setNodeCondition(ctx, upgradeDeferredCondition, corev1.ConditionTrue, reason, message)
+			if err != nil {
+				return false, fmt.Errorf("failed to set upgrade deferred condition: %w", err)
+			}
+			if changed {
+				c.logger.Info("Upgrade deferred until the maintenance window opens", slog.String("reason", reason), slog.Duration("delay", delay))
+				c.recorder.Event(node, corev1.EventTypeNormal, "NodeUpgradeDeferred", message)
+			}
+
+			// Requeue the node when the window opens
+			c.queue.AddAfter(cache.ObjectName{Namespace: node.Namespace, Name: node.Name}, delay)
+			return false, nil
 		}
 	}
 
-	// If the annotations are the same, do not update
-	if reflect.DeepEqual(node.Annotations, nodeCopy.Annotations) {
-		return nil
+	// Wait for the control plane to approve the upgrade plan
+	if nodeMetadata.RequireUpgradeApproval {
+		approved, err := c.checkUpgradeApproval(ctx, nodeMetadata)
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to check upgrade approval: %s", err)
+			return false, fmt.Errorf("failed to check upgrade approval: %w", err)
+		}
+		if !approved {
+			return false, nil
+		}
 	}
 
-	// Update the node with the new annotations
-	_, err = c.client.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+	// Refuse the upgrade to components incompatible with the cluster before anything is changed
+	plan, err := c.checkUpgradeCompatibility(ctx, node, nodeMetadata.RepoURI)
 	if err != nil {
-		return fmt.Errorf("failed to update node annotations %s: %w", c.nodeName, err)
+		return false, err
 	}
 
-	return nil
+	// Wait for a free upgrade slot of the pool, held until the upgrade is done
+	releaseSlot, acquired, err := c.holdUpgradeSlotOrDefer(ctx, node, nodeMetadata)
+	if err != nil || !acquired {
+		return false, err
+	}
+	var upgraded bool
+	defer func() { releaseSlot(upgraded) }()
+
+	// The upgrade is not deferred anymore
+	_, err = c.setNodeCondition(ctx, upgradeDeferredCondition, corev1.ConditionFalse, "UpgradeStarted", "Upgrade started")
+	if err != nil {
+		return false, fmt.Errorf("failed to set upgrade deferred condition: %w", err)
+	}
+
+	// The annotation is set and the upgrade is not deferred, so we need to upgrade the node
+	c.logger.Info("Upgrading node")
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeUpgrade", "Node upgrading")
+	if holds := nodeHolds(node.Annotations); len(holds) > 0 {
+		c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeUpgrade", "Held components are not upgraded: %s", formatHolds(holds))
+	}
+
+	// Drain the node before changing the components, it stays cordoned until the upgrade succeeds. The
+	// node is always drained before containerd is restarted with new storage settings, the containers
+	// are not kept across a root or snapshotter change.
+	var cordoned bool
+	if nodeMetadata.featureEnabled(FeatureDrainBeforeUpgrade) || plan.ContainerdRestart {
+		cordoned, err = c.drainNode(ctx)
+		if errors.Is(err, errDrainTimeout) {
+			// Retry the drain later instead of evicting the pods again right away
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to drain node, retrying in %s: %s", drainRetryInterval, err)
+			c.queue.AddAfter(cache.ObjectName{Namespace: node.Namespace, Name: node.Name}, drainRetryInterval)
+			return false, nil
+		}
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to drain node: %s", err)
+			return false, fmt.Errorf("failed to drain node: %w", err)
+		}
+		c.recorder.Event(node, corev1.EventTypeNormal, "NodeUpgrade", "Node drained")
+	}
+
+	// Snapshot the critical configuration so the upgrade can be undone
+	snapshotPath, err := c.privileged.CreateSnapshot(ctx)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to snapshot configuration: %s", err)
+		return false, fmt.Errorf("failed to snapshot configuration: %w", err)
+	}
+	c.logger.Info("Configuration snapshot created", slog.String("snapshot", snapshotPath))
+
+	// Install the components: binaries, configuration files, and services
+	err = c.privileged.ProcessComponents(ctx, InstallRequest{RepoURI: nodeMetadata.RepoURI})
+	if isCRIUnavailable(err) {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "ContainerRuntimeUnavailable", "Kubelet not started, the container runtime is not ready: %s", err)
+	}
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to install components: %s", err)
+		return false, fmt.Errorf("failed to install components: %w", err)
+	}
+
+	// Verify the node is healthy before considering the upgrade done
+	err = c.verifyNodeHealth(ctx, nodeMetadata.CriticalDaemonSets)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Node unhealthy after upgrade: %s", err)
+		return false, fmt.Errorf("failed to verify node health: %w", err)
+	}
+
+	err = c.finishUpgrade(ctx, node, nodeMetadata, currentRepoURI)
+	if err != nil {
+		return false, err
+	}
+
+	// The node drained by the agent is schedulable again once upgraded
+	if cordoned {
+		err = c.cordonNode(ctx, false)
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to uncordon node: %s", err)
+		}
+	}
+
+	c.logger.Info("Node upgraded")
+	c.recorder.Event(node, corev1.EventTypeNormal, "NodeUpgrade", "Node upgraded")
+
+	upgraded = true
+	return true, nil
+}
+
+// finishUpgrade keeps the switched repository and the metadata of the upgrade for the next installs and
+// reconciles once the node is upgraded
+func (c *Controller) finishUpgrade(ctx context.Context, node *corev1.Node, nodeMetadata NodeMetadata, currentRepoURI string) error {
+	if nodeMetadata.RepoURI != currentRepoURI {
+		err := c.privileged.SwitchRepository(ctx, nodeMetadata.RepoURI)
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to save repository switch: %s", err)
+			return fmt.Errorf("failed to save repository switch: %w", err)
+		}
+		c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeUpgrade", "Repository switched to %s", nodeMetadata.RepoURI)
+	}
+	c.setMetadata(nodeMetadata)
+	return nil
+}
+
+// holdUpgradeSlotOrDefer acquires a free upgrade slot of the pool with upgrade_concurrency, it returns
+// the function releasing it once the upgrade is done, or false if the upgrade is deferred until a slot
+// is free
+func (c *Controller) holdUpgradeSlotOrDefer(ctx context.Context, node *corev1.Node, nodeMetadata NodeMetadata) (func(upgraded bool), bool, error) {
+	if nodeMetadata.UpgradeConcurrency == nil {
+		return func(bool) {}, true, nil
+	}
+	concurrency := *nodeMetadata.UpgradeConcurrency
+	err := concurrency.validate()
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Invalid upgrade concurrency: %s", err)
+		return nil, false, err
+	}
+	slot, err := c.acquireUpgradeSlot(ctx, concurrency)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to acquire upgrade slot: %s", err)
+		return nil, false, fmt.Errorf("failed to acquire upgrade slot: %w", err)
+	}
+	if slot == "" {
+		changed, err := c.setNodeCondition(ctx, upgradeDeferredCondition, corev1.ConditionTrue, "UpgradeConcurrencyLimit",
+			fmt.Sprintf("Upgrade deferred until less than %d nodes of %s are upgrading", concurrency.MaxUpgrading, concurrency.Group))
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to set upgrade deferred condition: %w", err)
+		}
+		if changed {
+			c.logger.Info("Upgrade deferred until an upgrade slot is free", slog.String("group", concurrency.Group), slog.Int("max_upgrading", concurrency.MaxUpgrading))
+			c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeUpgradeDeferred", "Upgrade deferred until less than %d nodes of %s are upgrading", concurrency.MaxUpgrading, concurrency.Group)
+		}
+
+		// Requeue the node to try again
+		c.queue.AddAfter(cache.ObjectName{Namespace: node.Namespace, Name: node.Name}, upgradeSlotRetryInterval)
+		return nil, false, nil
+	}
+	c.logger.Info("Upgrade slot acquired", slog.String("slot", slot))
+
+	// The slot is kept by the node if the upgrade fails, so a bad release does not spread across the pool
+	return c.holdUpgradeSlot(ctx, concurrency, slot), true, nil
+}
+
+// upgradeNonDisruptive applies the component changes which do not restart the node services while the
+// maintenance window is closed, the disruptive ones are kept at their installed version for the window.
+// The phase is approved apart, holds an upgrade slot and is verified as an upgrade, but the node is not
+// drained. It returns true once the upgrade is done, when it has no disruptive change, and waiting if
+// the phase waits for its approval or an upgrade slot.
+func (c *Controller) upgradeNonDisruptive(ctx context.Context, node *corev1.Node, nodeMetadata NodeMetadata, currentRepoURI string) (upgraded bool, waiting bool, err error) {
+	plan, err := c.checkUpgradeCompatibility(ctx, node, nodeMetadata.RepoURI)
+	if err != nil {
+		return false, false, err
+	}
+	phase := plan.immediatePhase()
+	_, deferred := plan.split()
+	disruptive := len(deferred) > 0 || plan.ContainerdRestart
+	if len(phase.Components) == 0 {
+		return false, false, nil
+	}
+
+	// The phase is approved with the hash of its own plan, the disruptive changes are approved in the window
+	if nodeMetadata.RequireUpgradeApproval {
+		planHash, err := phase.Hash()
+		if err != nil {
+			return false, false, fmt.Errorf("failed to hash non-disruptive upgrade plan: %w", err)
+		}
+		approved, err := c.checkApproval(ctx, "Non-disruptive upgrade plan", planHash)
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgradeNonDisruptive", "Failed to check upgrade approval: %s", err)
+			return false, false, fmt.Errorf("failed to check upgrade approval: %w", err)
+		}
+		if !approved {
+			return false, true, nil
+		}
+	}
+
+	// Wait for a free upgrade slot of the pool, held until the phase is done
+	releaseSlot, acquired, err := c.holdUpgradeSlotOrDefer(ctx, node, nodeMetadata)
+	if err != nil || !acquired {
+		return false, !acquired && err == nil, err
+	}
+	var phaseDone bool
+	defer func() { releaseSlot(phaseDone) }()
+
+	_, err = c.setNodeCondition(ctx, upgradeDeferredCondition, corev1.ConditionFalse, "NonDisruptiveUpgradeStarted", "Non-disruptive components upgrade started")
+	if err != nil {
+		return false, false, fmt.Errorf("failed to set upgrade deferred condition: %w", err)
+	}
+	c.logger.Info("Upgrading non-disruptive components", slog.String("components", formatPlannedComponents(phase.Components)), slog.String("deferred", formatPlannedComponents(deferred)))
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeUpgradeNonDisruptive", "Upgrading non-disruptive components: %s", formatPlannedComponents(phase.Components))
+
+	// Snapshot the critical configuration so the upgrade can be undone
+	snapshotPath, err := c.privileged.CreateSnapshot(ctx)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgradeNonDisruptive", "Failed to snapshot configuration: %s", err)
+		return false, false, fmt.Errorf("failed to snapshot configuration: %w", err)
+	}
+	c.logger.Info("Configuration snapshot created", slog.String("snapshot", snapshotPath))
+
+	// Install the components, the disruptive ones are kept at their installed version
+	deferredNames := make([]string, 0, len(deferred)+1)
+	for _, component := range deferred {
+		deferredNames = append(deferredNames, component.Name)
+	}
+	if plan.ContainerdRestart && !slices.Contains(deferredNames, "containerd") {
+		deferredNames = append(deferredNames, "containerd")
+	}
+	err = c.privileged.ProcessComponents(ctx, InstallRequest{RepoURI: nodeMetadata.RepoURI, Deferred: deferredNames})
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgradeNonDisruptive", "Failed to install non-disruptive components: %s", err)
+		return false, false, fmt.Errorf("failed to install non-disruptive components: %w", err)
+	}
+
+	// Verify the node is healthy before considering the phase done
+	err = c.verifyNodeHealth(ctx, nodeMetadata.CriticalDaemonSets)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgradeNonDisruptive", "Node unhealthy after non-disruptive upgrade: %s", err)
+		return false, false, fmt.Errorf("failed to verify node health: %w", err)
+	}
+	phaseDone = true
+
+	// Without disruptive change, the upgrade is done
+	if !disruptive {
+		err = c.finishUpgrade(ctx, node, nodeMetadata, currentRepoURI)
+		if err != nil {
+			return false, false, err
+		}
+		_, err = c.setNodeCondition(ctx, upgradeDeferredCondition, corev1.ConditionFalse, "Upgraded", "Node upgraded without disruptive components")
+		if err != nil {
+			return false, false, fmt.Errorf("failed to set upgrade deferred condition: %w", err)
+		}
+		c.logger.Info("Node upgraded without disruptive components")
+		c.recorder.Event(node, corev1.EventTypeNormal, "NodeUpgradeNonDisruptive", "Node upgraded, no disruptive component")
+		return true, false, nil
+	}
+
+	c.logger.Info("Non-disruptive components upgraded")
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeUpgradeNonDisruptive", "Non-disruptive components upgraded, disruptive components deferred until the maintenance window: %s", formatPlannedComponents(deferred))
+
+	return false, false, nil
+}
+
+func (c *Controller) restoreNode(ctx context.Context) error {
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	// Exit if the annotation is not set, the restore of a managed node is refused by operateNode
+	if value, exists := node.Annotations[agentAnnotation]; !exists || value != "restore" || c.managedNode {
+		return nil
+	}
+
+	// The annotation is set, so we need to restore the last snapshot
+	_, err = c.restore(ctx, node)
+	if err != nil {
+		return err
+	}
+
+	// Remove the annotation
+	node, err = c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+	nodeCopy := node.DeepCopy()
+	delete(nodeCopy.Annotations, agentAnnotation)
+	_, err = c.client.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeRestore", "Failed to remove annotation: %s", err)
+		return fmt.Errorf("failed to remove annotation from node %s: %w", c.nodeName, err)
+	}
+
+	return nil
+}
+
+// restore restores the latest configuration snapshot, it returns the snapshot restored
+func (c *Controller) restore(ctx context.Context, node *corev1.Node) (string, error) {
+	c.logger.Info("Restoring node configuration")
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeRestore", "Node restoring")
+
+	snapshotPath, err := c.privileged.RestoreLatestSnapshot(ctx)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeRestore", "Failed to restore snapshot: %s", err)
+		return "", fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+
+	c.logger.Info("Node configuration restored", slog.String("snapshot", snapshotPath))
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeRestore", "Node restored from snapshot %s", filepath.Base(snapshotPath))
+
+	return snapshotPath, nil
+}
+
+// planNode computes the upgrade plan and publishes it without applying anything
+func (c *Controller) planNode(ctx context.Context) error {
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	// Exit if the annotation is not set
+	if value, exists := node.Annotations[agentAnnotation]; !exists || value != "plan" {
+		return nil
+	}
+
+	plan, err := c.plan(ctx, node, node.Annotations[repoURIAnnotation])
+	if err != nil {
+		return err
+	}
+	jsonPlan, err := json.Marshal(plan)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upgrade plan: %w", err)
+	}
+
+	// Publish the plan and remove the annotation
+	node, err = c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+	nodeCopy := node.DeepCopy()
+	delete(nodeCopy.Annotations, agentAnnotation)
+	nodeCopy.Annotations[planPreviewAnnotation] = string(jsonPlan)
+	_, err = c.client.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodePlan", "Failed to publish upgrade plan: %s", err)
+		return fmt.Errorf("failed to publish upgrade plan on node %s: %w", c.nodeName, err)
+	}
+
+	return nil
+}
+
+// plan computes the upgrade plan against the repository if set, without applying anything
+func (c *Controller) plan(ctx context.Context, node *corev1.Node, repoURI string) (UpgradePlan, error) {
+	// Get the node metadata, merged from all the metadata sources
+	nodeMetadata, err := c.privileged.LoadNodeMetadata(ctx)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodePlan", "Failed to get node metadata: %s", err)
+		return UpgradePlan{}, fmt.Errorf("failed to get node metadata: %w", err)
+	}
+
+	// Plan against the repository the next upgrade switches to
+	if repoURI != "" {
+		err = nodeMetadata.checkRepoURI(repoURI)
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "RepositoryRejected", "Repository switch rejected: %s", err)
+			return UpgradePlan{}, err
+		}
+		nodeMetadata.RepoURI = repoURI
+	}
+
+	// Compute the upgrade plan
+	plan, err := c.privileged.PlanComponents(ctx, InstallRequest{RepoURI: nodeMetadata.RepoURI})
+	if errors.Is(err, errReleaseNotFound) {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "ReleaseNotFound", "No release for the node pool version in repository %s: %s", nodeMetadata.RepoURI, err)
+		return UpgradePlan{}, fmt.Errorf("failed to compute upgrade plan: %w", err)
+	}
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodePlan", "Failed to compute upgrade plan: %s", err)
+		return UpgradePlan{}, fmt.Errorf("failed to compute upgrade plan: %w", err)
+	}
+	if plan.FallbackRelease != "" {
+		c.recorder.Event(node, corev1.EventTypeWarning, "ReleaseFallback", releaseFallbackMessage(plan.PoolVersion, nodeMetadata.RepoURI, plan.FallbackRelease))
+	}
+	err = c.checkPlanCompatibility(plan)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodePlan", "Incompatible upgrade plan: %s", err)
+		return UpgradePlan{}, fmt.Errorf("incompatible upgrade plan: %w", err)
+	}
+
+	changes := make([]string, 0, len(plan.Components))
+	for _, component := range plan.Components {
+		changes = append(changes, fmt.Sprintf("%s %s->%s", component.Name, component.From, component.To))
+	}
+	c.logger.Info("Upgrade plan published", slog.String("pool_version", plan.PoolVersion), slog.String("disruption", plan.Disruption), slog.Any("components", changes))
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodePlan", "Upgrade plan to %s (disruption: %s): %s", plan.PoolVersion, plan.Disruption, strings.Join(changes, ", "))
+
+	return plan, nil
+}
+
+// checkUpgradeApproval publishes the upgrade plan hash on the node and returns true
+// once the control plane approved this exact plan
+func (c *Controller) checkUpgradeApproval(ctx context.Context, nodeMetadata NodeMetadata) (bool, error) {
+	// Compute the upgrade plan and its hash
+	plan, err := c.privileged.PlanComponents(ctx, InstallRequest{RepoURI: nodeMetadata.RepoURI})
+	if err != nil {
+		return false, fmt.Errorf("failed to compute upgrade plan: %w", err)
+	}
+	planHash, err := plan.Hash()
+	if err != nil {
+		return false, fmt.Errorf("failed to hash upgrade plan: %w", err)
+	}
+
+	return c.checkApproval(ctx, "Upgrade plan", planHash)
+}
+
+// checkApproval publishes the hash of the change on the node and returns true once the control plane
+// approved this exact hash, the subject names the change in the events, eg: "Upgrade plan"
+func (c *Controller) checkApproval(ctx context.Context, subject, planHash string) (bool, error) {
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return false, fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	// The control plane approved the plan
+	if node.Annotations[upgradeApprovedAnnotation] == planHash {
+		c.logger.Info("Change approved", slog.String("change", subject), slog.String("hash", planHash))
+		return true, nil
+	}
+
+	// Publish the plan hash if it is not already published
+	if node.Annotations[upgradePlanAnnotation] != planHash {
+		nodeCopy := node.DeepCopy()
+		if nodeCopy.Annotations == nil {
+			nodeCopy.Annotations = make(map[string]string)
+		}
+		nodeCopy.Annotations[upgradePlanAnnotation] = planHash
+		_, err = c.client.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to publish upgrade plan on node %s: %w", c.nodeName, err)
+		}
+
+		c.logger.Info("Change published, waiting for approval", slog.String("change", subject), slog.String("hash", planHash))
+		c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeUpgradeDeferred", "%s %s published, waiting for approval", subject, planHash)
+	}
+
+	_, err = c.setNodeCondition(ctx, upgradeDeferredCondition, corev1.ConditionTrue, "WaitingForApproval", fmt.Sprintf("%s %s is waiting for approval", subject, planHash))
+	if err != nil {
+		return false, fmt.Errorf("failed to set upgrade deferred condition: %w", err)
+	}
+
+	return false, nil
+}
+
+// syncTunnel sets up the tunnel again if its interface disappeared and reports its health as a node condition
+func (c *Controller) syncTunnel(ctx context.Context) error {
+	nodeMetadata := c.metadata()
+	if nodeMetadata.Tunnel == nil {
+		return nil
+	}
+	tunnel := *nodeMetadata.Tunnel
+
+	if _, err := net.InterfaceByName(tunnel.interfaceName()); err != nil {
+		c.logger.Warn("Tunnel interface not found, setting it up again", slog.String("interface", tunnel.interfaceName()))
+		err = c.privileged.SetupTunnel(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to set up tunnel: %w", err)
+		}
+	}
+
+	// Publish the public key, the control plane adds the node as a peer of the cluster side
+	err := c.publishTunnelPublicKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Report the tunnel health, the condition is only created once the tunnel is unavailable
+	status, reason, message := corev1.ConditionFalse, "TunnelHealthy", "All the tunnel peers handshaked recently"
+	if err := c.privileged.CheckTunnel(ctx); err != nil {
+		status, reason, message = corev1.ConditionTrue, "TunnelUnhealthy", err.Error()
+	}
+	changed, err := c.setNodeCondition(ctx, tunnelUnavailableCondition, status, reason, message)
+	if err != nil {
+		return fmt.Errorf("failed to set tunnel condition: %w", err)
+	}
+	if changed {
+		node, err := c.nodesLister.Get(c.nodeName)
+		if err != nil {
+			return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+		}
+		eventType := corev1.EventTypeNormal
+		if status == corev1.ConditionTrue {
+			eventType = corev1.EventTypeWarning
+		}
+		c.logger.Info("Tunnel status changed", slog.String("reason", reason), slog.String("message", message))
+		c.recorder.Event(node, eventType, reason, message)
+	}
+
+	return nil
+}
+
+// publishTunnelPublicKey sets the tunnel public key annotation on the node if it changed
+func (c *Controller) publishTunnelPublicKey(ctx context.Context) error {
+	publicKey, err := c.privileged.TunnelPublicKey(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel public key: %w", err)
+	}
+
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+	if node.Annotations[tunnelPublicKeyAnnotation] == publicKey {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": map[string]string{tunnelPublicKeyAnnotation: publicKey}}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal tunnel public key patch: %w", err)
+	}
+	_, err = c.client.CoreV1().Nodes().Patch(ctx, c.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to publish tunnel public key on node %s: %w", c.nodeName, err)
+	}
+	c.logger.Info("Tunnel public key published", slog.String("public_key", publicKey))
+
+	return nil
+}
+
+// syncHolds persists the component holds set in the node annotations, none is set before the node is
+// registered
+func (c *Controller) syncHolds(ctx context.Context) error {
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	holds := nodeHolds(node.Annotations)
+	changed, err := c.privileged.SyncHolds(ctx, holds)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	c.logger.Info("Component holds changed", slog.String("holds", formatHolds(holds)))
+	if len(holds) > 0 {
+		c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeHold", "Components held: %s", formatHolds(holds))
+	} else {
+		c.recorder.Event(node, corev1.EventTypeNormal, "NodeHold", "No component held")
+	}
+
+	return nil
+}
+
+// syncNetworkDrift detects the node network configuration drift and applies the configuration again
+func (c *Controller) syncNetworkDrift(ctx context.Context) error {
+	nodeMetadata := c.metadata()
+	if nodeMetadata.Network == nil {
+		return nil
+	}
+
+	drifts, err := networkDrift(*nodeMetadata.Network)
+	if err != nil {
+		return fmt.Errorf("failed to detect network drift: %w", err)
+	}
+	if len(drifts) == 0 {
+		return nil
+	}
+
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	c.logger.Warn("Network configuration drift detected", slog.Any("drifts", drifts))
+	c.recorder.Eventf(node, corev1.EventTypeWarning, "NetworkDrift", "Network configuration drift detected: %s", strings.Join(drifts, ", "))
+	if !nodeMetadata.featureEnabled(FeatureDriftHeal) {
+		return nil
+	}
+
+	err = c.privileged.ProcessNetwork(ctx)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NetworkDrift", "Failed to correct network configuration drift: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// syncFirewallDrift detects the missing agent firewall rules and applies the rules again
+func (c *Controller) syncFirewallDrift(ctx context.Context) error {
+	drifts, err := c.privileged.FirewallDrift(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to detect firewall drift: %w", err)
+	}
+	if len(drifts) == 0 {
+		return nil
+	}
+
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	c.logger.Warn("Firewall rules drift detected", slog.Any("drifts", drifts))
+	c.recorder.Eventf(node, corev1.EventTypeWarning, "FirewallDrift", "Firewall rules drift detected: %s", strings.Join(drifts, ", "))
+	if !c.metadata().featureEnabled(FeatureDriftHeal) {
+		return nil
+	}
+
+	err = c.privileged.ApplyFirewallRules(ctx)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "FirewallDrift", "Failed to correct firewall rules drift: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// syncCNIConflicts quarantines the configuration of another CNI than the cluster one, eg: calico
+// leftovers after a migration to cilium
+func (c *Controller) syncCNIConflicts(ctx context.Context) error {
+	cni := c.metadata().CNI
+	if cni == "" {
+		return nil
+	}
+
+	quarantined, err := c.privileged.ReconcileCNI(ctx)
+	if err != nil {
+		return err
+	}
+	if len(quarantined) == 0 {
+		return nil
+	}
+
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	c.logger.Warn("Conflicting CNI configuration quarantined", slog.Any("files", quarantined))
+	c.recorder.Eventf(node, corev1.EventTypeWarning, "CNIConflict", "Configuration of another CNI than %s quarantined: %s", cni, strings.Join(quarantined, ", "))
+
+	return nil
+}
+
+// syncImageFilesystem prunes the unused images when the image filesystem usage is above the threshold
+func (c *Controller) syncImageFilesystem(ctx context.Context) error {
+	if c.metadata().ImageGC == nil || time.Since(c.lastImageGC) < imageGCInterval {
+		return nil
+	}
+
+	// The check is spaced even if it failed or nothing was pruned, it is not run on every reconcile
+	c.lastImageGC = time.Now()
+	report, err := c.privileged.RemediateImageFilesystem(ctx)
+	if err != nil {
+		return err
+	}
+	if len(report.Actions) == 0 {
+		return nil
+	}
+
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	message := fmt.Sprintf("Image filesystem usage %d%% above %d%%: %s, usage now %d%%", report.UsageBefore, report.Threshold, strings.Join(report.Actions, ", "), report.UsageAfter)
+	if report.UsageAfter >= report.Threshold {
+		c.logger.Warn("Image filesystem usage still above threshold", slog.Int("usage", report.UsageAfter), slog.Int("threshold", report.Threshold))
+		c.recorder.Event(node, corev1.EventTypeWarning, "ImageGCInsufficient", message)
+	} else {
+		c.recorder.Event(node, corev1.EventTypeNormal, "ImageGC", message)
+	}
+
+	return nil
+}
+
+// syncKernelParameters sets the reboot required condition until the kernel parameters took effect, and
+// reports the parameters still not applied once the node rebooted, eg: rejected by the boot loader
+func (c *Controller) syncKernelParameters(ctx context.Context) error {
+	pending, notApplied, err := pendingKernelParams()
+	if err != nil {
+		return fmt.Errorf("failed to check kernel parameters: %w", err)
+	}
+
+	status, reason, message := corev1.ConditionFalse, "KernelParametersApplied", "Kernel parameters applied"
+	switch {
+	case len(notApplied) > 0:
+		status, reason, message = corev1.ConditionTrue, "KernelParametersNotApplied", fmt.Sprintf("Kernel parameters not applied after the reboot: %s", strings.Join(notApplied, " "))
+	case len(pending) > 0:
+		status, reason, message = corev1.ConditionTrue, "KernelParametersPending", fmt.Sprintf("Reboot required to apply kernel parameters: %s", strings.Join(pending, " "))
+	}
+
+	changed, err := c.setNodeCondition(ctx, kernelRebootCondition, status, reason, message)
+	if err != nil {
+		return fmt.Errorf("failed to set kernel reboot required condition: %w", err)
+	}
+	if changed && len(pending) > 0 {
+		node, err := c.nodesLister.Get(c.nodeName)
+		if err != nil {
+			return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+		}
+		c.logger.Warn(message, slog.Any("parameters", pending))
+		eventReason := "KernelRebootRequired"
+		if len(notApplied) > 0 {
+			eventReason = reason
+		}
+		c.recorder.Event(node, corev1.EventTypeWarning, eventReason, message)
+	}
+
+	return nil
+}
+
+// syncVersionsAnnotations annotates the node with the installed components versions. The changes are
+// batched in a single conditional patch, at most once per annotationsUpdateInterval.
+func (c *Controller) syncVersionsAnnotations(ctx context.Context) error {
+	// Read installed components versions
+	versions, err := ListComponentsVersions()
+	if err != nil {
+		return fmt.Errorf("failed to list components versions: %w", err)
+	}
+
+	// Set agent version
+	versions["agent"] = Version
+
+	// Annotate the node with the versions
+	desired := make(map[string]string)
+	for component, version := range versions {
+		desired[componentAnnotationPrefix+component] = version
+	}
+
+	// Set the repository download statistics of the last install
+	stats, err := c.privileged.FetchStats(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get repository fetch statistics: %w", err)
+	}
+	if stats.Files > 0 {
+		desired[repoFetchAnnotation] = stats.String()
+	}
+
+	// Set the digest of the node SBOM
+	sbomDigest, err := c.privileged.SBOMDigest(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get SBOM digest: %w", err)
+	}
+	if sbomDigest != "" {
+		desired[sbomAnnotation] = sbomDigest
+	}
+
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	// If the annotations are the same, do not update
+	if len(annotationsPatch(node.Annotations, desired)) == 0 {
+		return nil
+	}
+
+	// Throttle the updates, the changes are applied together once the interval elapsed
+	if delay := annotationsUpdateInterval - time.Since(c.lastAnnotationsUpdate); delay > 0 {
+		c.queue.AddAfter(cache.ObjectName{Namespace: node.Namespace, Name: node.Name}, delay)
+		return nil
+	}
+	c.lastAnnotationsUpdate = time.Now()
+
+	// Patch the changed annotations only, conditionally to the node version so the changes of the
+	// other actors are not overwritten, and retry with the current node on conflicts
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		patch := annotationsPatch(node.Annotations, desired)
+		if len(patch) == 0 {
+			return nil
+		}
+		jsonPatch, err := json.Marshal(map[string]any{
+			"metadata": map[string]any{"annotations": patch, "resourceVersion": node.ResourceVersion},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal annotations patch: %w", err)
+		}
+
+		_, err = c.client.CoreV1().Nodes().Patch(ctx, c.nodeName, types.MergePatchType, jsonPatch, metav1.PatchOptions{})
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+
+		var getErr error
+		node, getErr = c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+		if getErr != nil {
+			return fmt.Errorf("failed to get node %s: %w", c.nodeName, getErr)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update node annotations %s: %w", c.nodeName, err)
+	}
+
+	return nil
+}
+
+// annotationsPatch returns the merge patch of the annotations setting the desired annotations,
+// the removed annotations are set to nil
+func annotationsPatch(annotations map[string]string, desired map[string]string) map[string]*string {
+	reconciled := maps.Clone(annotations)
+	if reconciled == nil {
+		reconciled = make(map[string]string)
+	}
+	reconcileManagedAnnotations(reconciled, desired)
+
+	patch := make(map[string]*string)
+	for annotation, value := range reconciled {
+		if current, ok := annotations[annotation]; !ok || current != value {
+			patch[annotation] = &value
+		}
+	}
+	for annotation := range annotations {
+		if _, ok := reconciled[annotation]; !ok {
+			patch[annotation] = nil
+		}
+	}
+
+	return patch
+}
+
+// reconcileManagedAnnotations sets the desired annotations, and removes the ones the agent set previously
+// which are not desired anymore. The managed annotations are recorded in the node annotations, the
+// annotations set before the record existed are left untouched.
+func reconcileManagedAnnotations(annotations map[string]string, desired map[string]string) {
+	for _, annotation := range strings.Split(annotations[managedAnnotationsAnnotation], ",") {
+		if _, ok := desired[annotation]; !ok {
+			delete(annotations, annotation)
+		}
+	}
+
+	maps.Copy(annotations, desired)
+	annotations[managedAnnotationsAnnotation] = strings.Join(slices.Sorted(maps.Keys(desired)), ",")
+}
+
+// setNodeCondition sets a condition on the node status, it returns true if the condition changed
+func (c *Controller) setNodeCondition(ctx context.Context, conditionType corev1.NodeConditionType, status corev1.ConditionStatus, reason, message string) (bool, error) {
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return false, fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+	nodeCopy := node.DeepCopy()
+
+	// Look for an existing condition of the same type
+	now := metav1.Now()
+	condition := corev1.NodeCondition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+	}
+	index := slices.IndexFunc(nodeCopy.Status.Conditions, func(c corev1.NodeCondition) bool {
+		return c.Type == conditionType
+	})
+
+	switch {
+	case index < 0:
+		// Do not create the condition if it is false, the absence of the condition means the same
+		if status == corev1.ConditionFalse {
+			return false, nil
+		}
+		nodeCopy.Status.Conditions = append(nodeCopy.Status.Conditions, condition)
+	case nodeCopy.Status.Conditions[index].Status == status && nodeCopy.Status.Conditions[index].Reason == reason:
+		// The condition did not change, do not update to avoid flooding the API server
+		return false, nil
+	default:
+		if nodeCopy.Status.Conditions[index].Status == status {
+			condition.LastTransitionTime = nodeCopy.Status.Conditions[index].LastTransitionTime
+		}
+		nodeCopy.Status.Conditions[index] = condition
+	}
+
+	// Update the node status with the new condition
+	_, err = c.client.CoreV1().Nodes().UpdateStatus(ctx, nodeCopy, metav1.UpdateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to update node %s status: %w", c.nodeName, err)
+	}
+
+	return true, nil
 }
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestReconcileManagedAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		desired     map[string]string
+		expected    map[string]string
+	}{
+		{
+			name:        "first sync keeps the other tools annotations",
+			annotations: map[string]string{"k8s.scaleway.com/component-gpu-operator": "v24.6"},
+			desired:     map[string]string{"k8s.scaleway.com/component-kubelet": "1.31.2"},
+			expected: map[string]string{
+				"k8s.scaleway.com/component-gpu-operator": "v24.6",
+				"k8s.scaleway.com/component-kubelet":      "1.31.2",
+				managedAnnotationsAnnotation:              "k8s.scaleway.com/component-kubelet",
+			},
+		},
+		{
+			name: "uninstalled component removed",
+			annotations: map[string]string{
+				"k8s.scaleway.com/component-gpu-operator": "v24.6",
+				"k8s.scaleway.com/component-kubelet":      "1.31.2",
+				"k8s.scaleway.com/component-cni-plugins":  "1.5.1",
+				managedAnnotationsAnnotation:              "k8s.scaleway.com/component-cni-plugins,k8s.scaleway.com/component-kubelet",
+			},
+			desired: map[string]string{"k8s.scaleway.com/component-kubelet": "1.31.3"},
+			expected: map[string]string{
+				"k8s.scaleway.com/component-gpu-operator": "v24.6",
+				"k8s.scaleway.com/component-kubelet":      "1.31.3",
+				managedAnnotationsAnnotation:              "k8s.scaleway.com/component-kubelet",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reconcileManagedAnnotations(test.annotations, test.desired)
+			if !reflect.DeepEqual(test.annotations, test.expected) {
+				t.Errorf("annotations = %v, expected %v", test.annotations, test.expected)
+			}
+		})
+	}
+}
+
+func TestAnnotationsPatch(t *testing.T) {
+	annotations := map[string]string{
+		"other":                                  "kept",
+		"k8s.scaleway.com/component-kubelet":     "1.31.2",
+		"k8s.scaleway.com/component-cni-plugins": "1.5.1",
+		managedAnnotationsAnnotation:             "k8s.scaleway.com/component-cni-plugins,k8s.scaleway.com/component-kubelet",
+	}
+
+	// Unchanged annotations are not patched
+	patch := annotationsPatch(annotations, map[string]string{
+		"k8s.scaleway.com/component-kubelet":     "1.31.2",
+		"k8s.scaleway.com/component-cni-plugins": "1.5.1",
+	})
+	if len(patch) != 0 {
+		t.Errorf("expected an empty patch, got %v", patch)
+	}
+
+	patch = annotationsPatch(annotations, map[string]string{"k8s.scaleway.com/component-kubelet": "1.31.3"})
+	if len(patch) != 3 {
+		t.Fatalf("expected 3 patched annotations, got %v", patch)
+	}
+	if value := patch["k8s.scaleway.com/component-kubelet"]; value == nil || *value != "1.31.3" {
+		t.Errorf("kubelet annotation not updated")
+	}
+	if value, ok := patch["k8s.scaleway.com/component-cni-plugins"]; !ok || value != nil {
+		t.Errorf("cni-plugins annotation not removed")
+	}
+	if annotations["k8s.scaleway.com/component-kubelet"] != "1.31.2" {
+		t.Errorf("annotations modified by the patch computation")
+	}
+}
+
+func TestKubernetesConfig(t *testing.T) {
+	nodemetadata := NodeMetadata{
+		ClusterURL:       "https://k8s.example.com:6443",
+		ClusterCA:        base64.StdEncoding.EncodeToString([]byte("ca")),
+		Token:            "token",
+		ControllerTuning: &ControllerTuning{QPS: 2, Burst: 4},
+	}
+
+	config, err := kubernetesConfig(nodemetadata)
+	if err != nil {
+		t.Fatalf("failed to build Kubernetes client configuration: %v", err)
+	}
+	if config.ContentType != "application/vnd.kubernetes.protobuf" || config.AcceptContentTypes != "application/vnd.kubernetes.protobuf,application/json" {
+		t.Errorf("expected protobuf content types, got %q and %q", config.ContentType, config.AcceptContentTypes)
+	}
+	if config.DisableCompression || config.QPS != 2 || config.Burst != 4 || config.BearerToken != "token" {
+		t.Errorf("unexpected Kubernetes client configuration %+v", config)
+	}
+}
+
+// caRotationPrivileged counts the cluster CA rotations, the CA is unchanged
+type caRotationPrivileged struct {
+	localPrivileged
+	rotations *int
+}
+
+func (p caRotationPrivileged) RotateClusterCA(ctx context.Context) (ClusterCARotation, error) {
+	*p.rotations++
+	return ClusterCARotation{}, nil
+}
+
+func TestProcessNodeNotRegistered(t *testing.T) {
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[cache.ObjectName]())
+	defer queue.ShutDown()
+	var rotations int
+	c := &Controller{
+		nodeName:    "node",
+		nodesLister: corelisters.NewNodeLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		queue:       queue,
+		logger:      slog.Default(),
+		privileged:  caRotationPrivileged{rotations: &rotations},
+	}
+
+	// The node is requeued with a capped backoff, without reporting an error
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for _, delay := range expected {
+		queue.Add(cache.ObjectName{Name: "node"})
+		if !c.processNextWorkItem(context.Background()) {
+			t.Fatal("unexpected queue shutdown")
+		}
+		if c.nodeWaitDelay != delay {
+			t.Errorf("requeue delay = %s, expected %s", c.nodeWaitDelay, delay)
+		}
+		if c.lastSyncError.Load() != nil {
+			t.Errorf("unexpected sync error %q", *c.lastSyncError.Load())
+		}
+		if queue.NumRequeues(cache.ObjectName{Name: "node"}) != 0 {
+			t.Error("expected the rate limiter backoff to be reset")
+		}
+	}
+	// The cluster CA is rotated before the node is registered, the kubelet may need it to register
+	if rotations != 1 {
+		t.Errorf("expected the cluster CA rotation checked once, got %d", rotations)
+	}
+}
+
+// imageGCPrivileged counts the image filesystem checks, the usage is under the threshold
+type imageGCPrivileged struct {
+	localPrivileged
+	checks *int
+}
+
+func (p imageGCPrivileged) RemediateImageFilesystem(ctx context.Context) (ImageGCReport, error) {
+	*p.checks++
+	return ImageGCReport{Threshold: 85, UsageBefore: 40, UsageAfter: 40}, nil
+}
+
+func TestSyncImageFilesystemInterval(t *testing.T) {
+	var checks int
+	c := &Controller{
+		nodeName:     "node",
+		nodeMetadata: NodeMetadata{ImageGC: &ImageGC{}},
+		privileged:   imageGCPrivileged{checks: &checks},
+		logger:       slog.Default(),
+	}
+
+	// The image filesystem is not checked again before the interval, even if nothing was pruned
+	for range 2 {
+		err := c.syncImageFilesystem(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if checks != 1 {
+		t.Errorf("expected a single image filesystem check, got %d", checks)
+	}
+}
+
+func TestUpgradeDeferredNotPlanned(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+	client := fake.NewClientset(node)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err := indexer.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[cache.ObjectName]())
+	defer queue.ShutDown()
+
+	var planned []string
+	closed := &MaintenanceWindow{Start: time.Now().UTC().Add(2 * time.Hour).Format("15:04"), Duration: "1m"}
+	c := &Controller{
+		nodeName:    "node",
+		client:      client,
+		nodesLister: corelisters.NewNodeLister(indexer),
+		queue:       queue,
+		privileged:  operationPrivileged{metadata: NodeMetadata{RepoURI: "https://repo", MaintenanceWindow: closed}, planned: &planned},
+		recorder:    newEventRecorder(ctx, client, "node"),
+		logger:      slog.Default(),
+	}
+
+	// The plan and its compatibility are only checked once the window opens
+	upgraded, err := c.upgrade(ctx, node, "")
+	if err != nil || upgraded {
+		t.Fatalf("expected the upgrade deferred, got %t, %v", upgraded, err)
+	}
+	if len(planned) != 0 {
+		t.Errorf("expected no upgrade plan while deferred, got %q", planned)
+	}
+}
+
+// planPrivileged returns the upgrade plan or the plan error of the test
+type planPrivileged struct {
+	localPrivileged
+	plan UpgradePlan
+	err  error
+}
+
+func (p planPrivileged) PlanComponents(ctx context.Context, request InstallRequest) (UpgradePlan, error) {
+	return p.plan, p.err
+}
+
+func TestCheckUpgradeCompatibilityEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		plan      UpgradePlan
+		err       error
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:      "release not found",
+			err:       privilegedError{message: "release not found: 1.31.5 is newer than the latest release 1.31.4", err: errReleaseNotFound},
+			expected:  "ReleaseNotFound",
+			expectErr: true,
+		},
+		{
+			name:      "plan failure",
+			err:       errors.New("failed to read releases file"),
+			expected:  "NodeUpgrade",
+			expectErr: true,
+		},
+		{
+			name:     "release fallback",
+			plan:     UpgradePlan{PoolVersion: "1.31.5", FallbackRelease: "1.31.4"},
+			expected: "ReleaseFallback",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			client := fake.NewClientset()
+			c := &Controller{
+				nodeName:   "node",
+				client:     client,
+				privileged: planPrivileged{plan: test.plan, err: test.err},
+				recorder:   newEventRecorder(ctx, client, "node"),
+				logger:     slog.Default(),
+			}
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", UID: "uid"}}
+
+			_, err := c.checkUpgradeCompatibility(ctx, node, "https://repo")
+			if (err != nil) != test.expectErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			// A single event is emitted per plan, the recorder sends the events asynchronously
+			var events *eventsv1.EventList
+			err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+				var err error
+				events, err = client.EventsV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+				return err == nil && len(events.Items) > 0, err
+			})
+			if err != nil {
+				t.Fatalf("expected an event: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			events, err = client.EventsV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+			var reasons []string
+			for _, event := range events.Items {
+				reasons = append(reasons, event.Reason)
+			}
+			if err != nil || len(reasons) != 1 || reasons[0] != test.expected {
+				t.Errorf("expected a single %s event, got %v, %v", test.expected, reasons, err)
+			}
+		})
+	}
+}
+
+func TestReportReleaseOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewClientset()
+	c := &Controller{
+		nodeName:   "node",
+		client:     client,
+		privileged: planPrivileged{plan: UpgradePlan{PoolVersion: "1.31.5", FallbackRelease: "1.31.4"}},
+		recorder:   newEventRecorder(ctx, client, "node"),
+		logger:     slog.Default(),
+	}
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", UID: "uid"}}
+
+	// The deferred upgrade computes the plan on each reconcile, the fallback is reported once
+	for range 3 {
+		_, err := c.checkUpgradeCompatibility(ctx, node, "https://repo")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	var events *eventsv1.EventList
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		var err error
+		events, err = client.EventsV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+		return err == nil && len(events.Items) > 0, err
+	})
+	if err != nil {
+		t.Fatalf("expected an event: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	events, err = client.EventsV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+	if err != nil || len(events.Items) != 1 || events.Items[0].Reason != "ReleaseFallback" || events.Items[0].Series != nil {
+		t.Fatalf("expected a single ReleaseFallback event without series, got %+v, %v", events.Items, err)
+	}
+
+	// A new fallback is reported again
+	c.privileged = planPrivileged{plan: UpgradePlan{PoolVersion: "1.31.6", FallbackRelease: "1.31.4"}}
+	_, err = c.checkUpgradeCompatibility(ctx, node, "https://repo")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		events, err := client.EventsV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+		return err == nil && len(events.Items) == 2, err
+	})
+	if err != nil {
+		t.Errorf("expected the new fallback to be reported: %v", err)
+	}
+}
+
+// phasedPrivileged installs the components of its plan, the deferred ones are planned again once the
+// non-disruptive phase is installed
+type phasedPrivileged struct {
+	localPrivileged
+	metadata *NodeMetadata
+	plan     *UpgradePlan
+	installs *[]InstallRequest
+}
+
+func (p phasedPrivileged) LoadNodeMetadata(ctx context.Context) (NodeMetadata, error) {
+	return *p.metadata, nil
+}
+
+func (p phasedPrivileged) PlanComponents(ctx context.Context, request InstallRequest) (UpgradePlan, error) {
+	return *p.plan, nil
+}
+
+func (p phasedPrivileged) CreateSnapshot(ctx context.Context) (string, error) {
+	return "/var/lib/scw-k8s-agent/snapshots/snapshot.tar.gz", nil
+}
+
+func (p phasedPrivileged) ProcessComponents(ctx context.Context, request InstallRequest) error {
+	*p.installs = append(*p.installs, request)
+	var remaining []PlannedComponent
+	for _, component := range p.plan.Components {
+		if slices.Contains(request.Deferred, component.Name) {
+			remaining = append(remaining, component)
+		}
+	}
+	p.plan.Components = remaining
+	return nil
+}
+
+func TestUpgradeSplitPhases(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node", UID: "uid"},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+	}
+	client := fake.NewClientset(node)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err := indexer.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the lister in sync with the updates, as the informer would
+	client.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return false, nil, indexer.Update(action.(k8stesting.UpdateAction).GetObject())
+	})
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[cache.ObjectName]())
+	defer queue.ShutDown()
+
+	closed := &MaintenanceWindow{Start: time.Now().UTC().Add(2 * time.Hour).Format("15:04"), Duration: "1m"}
+	metadata := &NodeMetadata{RepoURI: "https://repo", MaintenanceWindow: closed, SplitDisruptiveUpgrades: true, RequireUpgradeApproval: true}
+	plan := &UpgradePlan{PoolVersion: "1.31.3", Disruption: disruptionNode, Components: []PlannedComponent{
+		{Name: "containerd", From: "1.7.22", To: "1.7.24", Disruption: disruptionNode},
+		{Name: "crictl", From: "1.30.0", To: "1.31.1", Disruption: disruptionNone},
+	}}
+	var installs []InstallRequest
+	c := &Controller{
+		nodeName:    "node",
+		client:      client,
+		nodesLister: corelisters.NewNodeLister(indexer),
+		queue:       queue,
+		privileged:  phasedPrivileged{metadata: metadata, plan: plan, installs: &installs},
+		recorder:    newEventRecorder(ctx, client, "node"),
+		logger:      slog.Default(),
+	}
+	reasons := func() []string {
+		t.Helper()
+		time.Sleep(100 * time.Millisecond)
+		events, err := client.EventsV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reasons []string
+		for _, event := range events.Items {
+			reasons = append(reasons, event.Reason+": "+event.Note)
+		}
+		slices.Sort(reasons)
+		return reasons
+	}
+	condition := func() corev1.NodeCondition {
+		t.Helper()
+		current, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, condition := range current.Status.Conditions {
+			if condition.Type == "AgentUpgradeDeferred" {
+				return condition
+			}
+		}
+		return corev1.NodeCondition{}
+	}
+	approve := func() {
+		t.Helper()
+		current, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		current.Annotations[upgradeApprovedAnnotation] = current.Annotations[upgradePlanAnnotation]
+		_, err = client.CoreV1().Nodes().Update(ctx, current, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The non-disruptive phase waits for the approval of its own plan
+	immediateHash, err := plan.immediatePhase().Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgraded, err := c.upgrade(ctx, node, "")
+	if err != nil || upgraded || len(installs) != 0 {
+		t.Fatalf("expected the non-disruptive phase waiting for approval, got %t, %v, %+v", upgraded, err, installs)
+	}
+	current, _ := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+	if current.Annotations[upgradePlanAnnotation] != immediateHash {
+		t.Errorf("expected the non-disruptive plan hash %s published, got %s", immediateHash, current.Annotations[upgradePlanAnnotation])
+	}
+	if condition := condition(); condition.Reason != "WaitingForApproval" {
+		t.Errorf("expected the approval condition, got %+v", condition)
+	}
+
+	// Once approved, only the non-disruptive components are installed, without drain
+	approve()
+	upgraded, err = c.upgrade(ctx, node, "")
+	if err != nil || upgraded {
+		t.Fatalf("expected the disruptive phase deferred, got %t, %v", upgraded, err)
+	}
+	if len(installs) != 1 || !slices.Equal(installs[0].Deferred, []string{"containerd"}) {
+		t.Errorf("expected the non-disruptive install deferring containerd, got %+v", installs)
+	}
+	if condition := condition(); condition.Status != corev1.ConditionTrue || condition.Reason != "DisruptiveComponentsDeferred" {
+		t.Errorf("expected the disruptive components deferred condition, got %+v", condition)
+	}
+	expected := []string{
+		"NodeUpgradeDeferred: Disruptive components upgrade deferred",
+		"NodeUpgradeDeferred: Non-disruptive upgrade plan " + immediateHash + " published, waiting for approval",
+		"NodeUpgradeNonDisruptive: Non-disruptive components upgraded, disruptive components deferred until the maintenance window: containerd 1.7.22->1.7.24",
+		"NodeUpgradeNonDisruptive: Upgrading non-disruptive components: crictl 1.30.0->1.31.1",
+	}
+	if got := reasons(); len(got) != len(expected) || !slices.ContainsFunc(got, func(reason string) bool { return strings.HasPrefix(reason, expected[0]) }) || !slices.Equal(got[1:], expected[1:]) {
+		t.Errorf("unexpected events of the non-disruptive phase %q", got)
+	}
+	current, _ = client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+	if current.Spec.Unschedulable {
+		t.Error("expected the node not drained outside the maintenance window")
+	}
+
+	// The disruptive phase is approved apart once the window opens
+	metadata.MaintenanceWindow = &MaintenanceWindow{Start: time.Now().UTC().Add(-time.Minute).Format("15:04"), Duration: "1h"}
+	upgraded, err = c.upgrade(ctx, node, "")
+	if err != nil || upgraded || len(installs) != 1 {
+		t.Fatalf("expected the disruptive phase waiting for approval, got %t, %v, %+v", upgraded, err, installs)
+	}
+	approve()
+	upgraded, err = c.upgrade(ctx, node, "")
+	if err != nil || !upgraded || len(installs) != 2 || len(installs[1].Deferred) != 0 {
+		t.Fatalf("expected the disruptive phase installed, got %t, %v, %+v", upgraded, err, installs)
+	}
+	if condition := condition(); condition.Status != corev1.ConditionFalse || condition.Reason != "UpgradeStarted" {
+		t.Errorf("expected the upgrade started condition, got %+v", condition)
+	}
+	got := reasons()
+	for _, reason := range []string{"NodeUpgrade: Node upgrading", "NodeUpgrade: Node upgraded"} {
+		if !slices.Contains(got, reason) {
+			t.Errorf("expected the %q event of the disruptive phase, got %q", reason, got)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcstatus "google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// criSocket is the CRI socket of containerd the kubelet connects to
+const criSocket = "/run/containerd/containerd.sock"
+
+// criEndpoint is the CRI endpoint of containerd the kubelet connects to
+const criEndpoint = "unix://" + criSocket
+
+// criCallTimeout is the timeout of each CRI Version call
+const criCallTimeout = 2 * time.Second
+
+// criReadyTimeout is the maximum time to wait for the CRI endpoint to answer before starting the kubelet
+var criReadyTimeout = 2 * time.Minute
+
+// Backoff between the CRI checks
+const (
+	criCheckInitialDelay = time.Second
+	criCheckMaxDelay     = 15 * time.Second
+)
+
+// criGatedServices are the services only started once the CRI endpoint answers
+var criGatedServices = []string{"kubelet"}
+
+// errCRIUnavailable is returned when the container runtime does not answer, the kubelet is not started
+var errCRIUnavailable = errors.New("container runtime not ready")
+
+// criRemoveTimeout is the maximum time to stop and remove the pods through the CRI
+const criRemoveTimeout = 2 * time.Minute
+
+// newCRIClient returns a CRI client of the containerd socket, it connects lazily and each call tries
+// to connect again
+func newCRIClient() (runtimeapi.RuntimeServiceClient, *grpc.ClientConn, error) {
+	conn, err := grpc.NewClient("unix://"+hostPath(criSocket), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CRI client: %w", err)
+	}
+	return runtimeapi.NewRuntimeServiceClient(conn), conn, nil
+}
+
+// waitForCRI waits for the CRI endpoint to answer the Version call, with an exponential backoff. Only
+// systemd starts containerd, so the other service managers do not wait.
+func waitForCRI(ctx context.Context, logger *slog.Logger) error {
+	if serviceManager != systemdServiceManager {
+		return nil
+	}
+
+	client, conn, err := newCRIClient()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	deadline := time.Now().Add(criReadyTimeout)
+	delay := criCheckInitialDelay
+	for {
+		callCtx, cancel := context.WithTimeout(ctx, criCallTimeout)
+		version, err := client.Version(callCtx, &runtimeapi.VersionRequest{})
+		cancel()
+		if err == nil {
+			logger.Debug("Container runtime ready", slog.String("runtime", version.RuntimeName), slog.String("version", version.RuntimeVersion))
+			return nil
+		}
+		reason := grpcstatus.Convert(err).Message()
+
+		if time.Now().Add(delay).After(deadline) {
+			logger.Error("Container runtime not ready, kubelet not started", slog.String("endpoint", criEndpoint), slog.String("reason", reason))
+			return fmt.Errorf("%w: %s did not answer after %s, check the containerd service: %s", errCRIUnavailable, criEndpoint, criReadyTimeout, reason)
+		}
+		logger.Info("Waiting for container runtime", slog.String("endpoint", criEndpoint), slog.Duration("retry_in", delay), slog.String("reason", reason))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", errCRIUnavailable, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, criCheckMaxDelay)
+	}
+}
+
+// isCRIUnavailable returns whether the error is due to the container runtime, also when returned by
+// the privileged helper where the error chain is lost
+func isCRIUnavailable(err error) bool {
+	return err != nil && (errors.Is(err, errCRIUnavailable) || strings.Contains(err.Error(), errCRIUnavailable.Error()))
+}
+
+// removeCRIPods stops and removes all the pods through the CRI, containerd stops their containers and
+// shims. Nothing is removed if containerd is not running, its pods were removed before it was stopped.
+func removeCRIPods(ctx context.Context) error {
+	client, conn, err := newCRIClient()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	ctx, cancel := context.WithTimeout(ctx, criRemoveTimeout)
+	defer cancel()
+
+	pods, err := client.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{})
+	if grpcstatus.Code(err) == codes.Unavailable {
+		slog.Info("Container runtime not running, no pod to remove", slog.String("endpoint", criEndpoint))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	for _, pod := range pods.Items {
+		_, err = client.StopPodSandbox(ctx, &runtimeapi.StopPodSandboxRequest{PodSandboxId: pod.Id})
+		if err != nil {
+			return fmt.Errorf("failed to stop pod %s/%s: %w", pod.Metadata.GetNamespace(), pod.Metadata.GetName(), err)
+		}
+		_, err = client.RemovePodSandbox(ctx, &runtimeapi.RemovePodSandboxRequest{PodSandboxId: pod.Id})
+		if err != nil {
+			return fmt.Errorf("failed to remove pod %s/%s: %w", pod.Metadata.GetNamespace(), pod.Metadata.GetName(), err)
+		}
+	}
+	slog.Info("Pods removed", slog.Int("count", len(pods.Items)))
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// fakeCRI answers the CRI Version and pod calls and records them in the commands log
+type fakeCRI struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+	pods []string
+}
+
+func (fakeCRI) Version(ctx context.Context, request *runtimeapi.VersionRequest) (*runtimeapi.VersionResponse, error) {
+	err := recordCommand("cri", []string{"Version"})
+	if err != nil {
+		return nil, err
+	}
+	return &runtimeapi.VersionResponse{RuntimeName: "containerd", RuntimeVersion: "v2.0.2"}, nil
+}
+
+func (f fakeCRI) ListPodSandbox(ctx context.Context, request *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	response := &runtimeapi.ListPodSandboxResponse{}
+	for _, id := range f.pods {
+		response.Items = append(response.Items, &runtimeapi.PodSandbox{Id: id, Metadata: &runtimeapi.PodSandboxMetadata{Name: id, Namespace: "kube-system"}})
+	}
+	return response, nil
+}
+
+func (fakeCRI) StopPodSandbox(ctx context.Context, request *runtimeapi.StopPodSandboxRequest) (*runtimeapi.StopPodSandboxResponse, error) {
+	return &runtimeapi.StopPodSandboxResponse{}, recordCommand("cri", []string{"StopPodSandbox", request.PodSandboxId})
+}
+
+func (fakeCRI) RemovePodSandbox(ctx context.Context, request *runtimeapi.RemovePodSandboxRequest) (*runtimeapi.RemovePodSandboxResponse, error) {
+	return &runtimeapi.RemovePodSandboxResponse{}, recordCommand("cri", []string{"RemovePodSandbox", request.PodSandboxId})
+}
+
+// RunPodSandbox fails on the first attempt, like before the CNI configuration is written
+func (fakeCRI) RunPodSandbox(ctx context.Context, request *runtimeapi.RunPodSandboxRequest) (*runtimeapi.RunPodSandboxResponse, error) {
+	err := recordCommand("cri", []string{"RunPodSandbox", request.Config.Metadata.Name})
+	if err != nil {
+		return nil, err
+	}
+	if request.Config.Metadata.Attempt == 0 {
+		return nil, grpcstatus.Error(codes.Unknown, "cni config uninitialized")
+	}
+	return &runtimeapi.RunPodSandboxResponse{PodSandboxId: "sandbox"}, nil
+}
+
+func (fakeCRI) PodSandboxStatus(ctx context.Context, request *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	info := `{"runtimeSpec": {"linux": {"namespaces": [{"type": "network", "path": "/var/run/netns/cni-` + request.PodSandboxId + `"}]}}}`
+	return &runtimeapi.PodSandboxStatusResponse{Info: map[string]string{"info": info}}, nil
+}
+
+// serveFakeCRI serves the fake CRI on the containerd socket of the root directory until the test ends
+func serveFakeCRI(t *testing.T, pods ...string) {
+	err := os.MkdirAll(filepath.Dir(hostPath(criSocket)), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", hostPath(criSocket))
+	if err != nil {
+		t.Fatalf("failed to listen on CRI socket: %v", err)
+	}
+	server := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(server, fakeCRI{pods: pods})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+}
+
+func TestWaitForCRIGatesKubelet(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	// Only systemd starts containerd, the kubelet is started without waiting for the CRI otherwise
+	err := processComponentServices(context.Background(), slog.Default(), []ComponentService{
+		{Name: "containerd", Enabled: true, State: "started"},
+		{Name: "kubelet", Enabled: true, State: "started"},
+	})
+	if err != nil {
+		t.Fatalf("failed to process services: %v", err)
+	}
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(commands), "cri Version") || !strings.Contains(string(commands), "systemctl start kubelet") {
+		t.Errorf("expected the kubelet started without CRI check, got commands %q", commands)
+	}
+
+	// With systemd, the CRI answers the Version call before the kubelet is started
+	serveFakeCRI(t)
+	serviceManager = systemdServiceManager
+	err = waitForCRI(context.Background(), slog.Default())
+	if err != nil {
+		t.Fatalf("failed to wait for CRI: %v", err)
+	}
+	commands, err = os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(commands), "cri Version") != 1 {
+		t.Errorf("expected a single CRI check, got commands %q", commands)
+	}
+}
+
+func TestWaitForCRIUnavailable(t *testing.T) {
+	defer func(previousRoot, previousManager string, previousTimeout time.Duration) {
+		rootDir, serviceManager, criReadyTimeout = previousRoot, previousManager, previousTimeout
+	}(rootDir, serviceManager, criReadyTimeout)
+	rootDir = t.TempDir()
+	serviceManager = systemdServiceManager
+	criReadyTimeout = 10 * time.Millisecond
+
+	err := waitForCRI(context.Background(), slog.Default())
+	if err == nil {
+		t.Fatal("expected an error without container runtime")
+	}
+	if !isCRIUnavailable(err) || !isCRIUnavailable(fmt.Errorf("rpc: %s", err.Error())) {
+		t.Errorf("isCRIUnavailable(%v) = false", err)
+	}
+	if isCRIUnavailable(fmt.Errorf("failed to install components")) {
+		t.Error("isCRIUnavailable() = true for another error")
+	}
+
+	// The wait stops once cancelled
+	criReadyTimeout = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = waitForCRI(ctx, slog.Default())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the wait cancelled, got %v", err)
+	}
+}
+
+func TestRemoveCRIPods(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	// Nothing is removed once containerd is stopped
+	err := removeCRIPods(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error without container runtime: %v", err)
+	}
+
+	// The pods are stopped and removed
+	serveFakeCRI(t, "pod-1", "pod-2")
+	err = removeCRIPods(context.Background())
+	if err != nil {
+		t.Fatalf("failed to remove pods: %v", err)
+	}
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "cri StopPodSandbox pod-1\ncri RemovePodSandbox pod-1\ncri StopPodSandbox pod-2\ncri RemovePodSandbox pod-2\n"
+	if string(commands) != expected {
+		t.Errorf("commands = %q, expected %q", commands, expected)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// debugSocketFlag is the -debug-socket flag value, the unix socket of the Go profiles endpoint of the
+// long-running agent process, eg: to diagnose a memory growth in place. Disabled if empty.
+var debugSocketFlag string
+
+// defaultDebugSocket is the debug socket path suggested in the flag usage
+const defaultDebugSocket = "/run/scw-k8s-agent/debug.sock"
+
+// serveDebug serves the Go profiles on /debug/pprof on the unix socket until the context is done. The
+// profiles expose the agent internals, the socket is only accessible by the agent user, eg: root.
+func serveDebug(ctx context.Context, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create debug socket directory: %w", err)
+	}
+	// Remove the socket left by a previous agent process
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove debug socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on debug socket: %w", err)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("failed to chmod debug socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+		_ = os.Remove(path)
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Warn("Debug server stopped", slog.Any("error", err))
+		}
+	}()
+	slog.Info("Serving profiles", slog.String("socket", path))
+
+	return nil
+}
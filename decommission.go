@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/scaleway/k8s-agent/repo"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// decommissionedFile marks the node decommissioned, the agent does not install it again until removed
+var decommissionedFile = filepath.Join(stateDir, "decommissioned")
+
+// decommissionServices are stopped before the components are uninstalled, the kubelet first so it
+// does not restart the containers
+var decommissionServices = []string{"kubelet", "containerd"}
+
+// decommissionSecrets are the credentials of the node removed once the components are uninstalled, in
+// addition to the kubeconfigs rendered by the agent
+var decommissionSecrets = []string{kosmosUserDataCacheFile, kubeletCAFile}
+
+// errDecommissionFailed is returned when the decommission failed once started, it is retried
+var errDecommissionFailed = errors.New("failed to decommission node")
+
+// decommissionNode stops the services, uninstalls all the components and wipes the credentials and
+// the state of the node, eg: before a Kosmos node is detached and returned to other duties. The audit
+// log is kept.
+func decommissionNode(ctx context.Context, nodemetadata NodeMetadata) error {
+	// Resolve the components to uninstall before any change, the node keeps running if the repository
+	// is unreachable
+	repoFS, components, err := installedComponents(nodemetadata)
+	if err != nil {
+		return err
+	}
+
+	// Stop the services cleanly before uninstalling them. The pods are removed through the CRI once
+	// the kubelet is stopped, so containerd stops their containers and shims before it is stopped.
+	for _, service := range decommissionServices {
+		if service == "containerd" {
+			err = removeCRIPods(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		output, err := command("/usr/bin/systemctl", "stop", service).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to stop service %s: %w: %s", service, err, output)
+		}
+		slog.Info("Service stopped", slog.String("service", service))
+	}
+
+	// Uninstall the installed components, in the reverse order of the release
+	err = uninstallComponents(ctx, repoFS, components, nodemetadata)
+	if err != nil {
+		return fmt.Errorf("failed to uninstall components: %w", err)
+	}
+	err = repoFS.Cleanup()
+	if err != nil {
+		return fmt.Errorf("failed to cleanup repository: %w", err)
+	}
+
+	// Remove the credentials and the state of the node
+	err = wipeNodeState()
+	if err != nil {
+		return err
+	}
+
+	// Mark the node decommissioned so the agent does not install it again
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	err = writeFileSync(decommissionedFile, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to mark node decommissioned: %w", err)
+	}
+	slog.Info("Node decommissioned")
+
+	return nil
+}
+
+// wipeNodeState removes the kubeconfigs rendered by the agent, the credentials and the state files of
+// the node, except the audit log, and the managed files and taken over files backups used by the reset
+func wipeNodeState() error {
+	// The kubeconfigs are listed in the state directory
+	kubeconfigs, err := loadKubeconfigs()
+	if err != nil {
+		return err
+	}
+	paths := append(slices.Sorted(maps.Keys(kubeconfigs)), decommissionSecrets...)
+	paths = append(paths, versionsFile, versionsFile+".lock", imageManifestFile)
+	for _, path := range paths {
+		err = os.Remove(hostPath(path))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	// Wipe the state directory, except the audit logs and what the reset needs to restore the machine
+	entries, err := os.ReadDir(hostPath(stateDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read state directory: %w", err)
+	}
+	for _, entry := range entries {
+		if isAuditLog(entry.Name()) || entry.Name() == filepath.Base(managedFilesFile) || entry.Name() == filepath.Base(takeoverBackupDir) {
+			continue
+		}
+		err = os.RemoveAll(hostPath(filepath.Join(stateDir, entry.Name())))
+		if err != nil {
+			return fmt.Errorf("failed to remove state %s: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// uninstallNode runs the uninstall sections of all the installed components
+func uninstallNode(ctx context.Context, nodemetadata NodeMetadata) error {
+	repoFS, components, err := installedComponents(nodemetadata)
+	if err != nil {
+		return err
+	}
+
+	err = uninstallComponents(ctx, repoFS, components, nodemetadata)
+	if err != nil {
+		return fmt.Errorf("failed to uninstall components: %w", err)
+	}
+
+	err = repoFS.Cleanup()
+	if err != nil {
+		return fmt.Errorf("failed to cleanup repository: %w", err)
+	}
+
+	return nil
+}
+
+// installedComponents returns the pinned repository and the installed components to uninstall, in
+// the release order, with the uninstalled version expected
+func installedComponents(nodemetadata NodeMetadata) (repo.RepoFS, []Component, error) {
+	repoFS, err := repo.NewRepoFS(nodemetadata.RepoURI, hostPath(repoCacheDir))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errRepository, err)
+	}
+	repoFS, err = pinRepository(repoFS, nodemetadata, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errRepository, err)
+	}
+	releaseComponents, _, err := releaseComponents(repoFS, nodemetadata)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to get release components: %w", errRepository, err)
+	}
+
+	// The components not in the release are uninstalled first
+	versions, err := ListComponentsVersions()
+	if err != nil {
+		return nil, nil, err
+	}
+	var components []Component
+	for _, component := range releaseComponents {
+		if _, ok := versions[component.Name]; ok {
+			components = append(components, component)
+			delete(versions, component.Name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(versions)) {
+		components = append(components, Component{Name: name})
+	}
+
+	// The components are uninstalled since their expected version is the uninstalled one
+	for i := range components {
+		components[i].Version = "uninstalled"
+	}
+
+	return repoFS, components, nil
+}
+
+// decommission drains and decommissions the node, the controller is stopped once done. The node deleted
+// is not drained, its pods are deleted with it.
+func (c *Controller) decommission(ctx context.Context, node *corev1.Node, request RemoteOperationRequest) (string, error) {
+	if request.Source != "deletion" {
+		_, err := c.drainNode(ctx)
+		if errors.Is(err, errDrainTimeout) {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to drain node, retrying in %s: %s", drainRetryInterval, err)
+			c.queue.AddAfter(cache.ObjectName{Namespace: node.Namespace, Name: node.Name}, drainRetryInterval)
+			return "", fmt.Errorf("%w until the node is drained: %w", errOperationDeferred, err)
+		}
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to drain node: %s", err)
+			return "", fmt.Errorf("failed to drain node: %w", err)
+		}
+	}
+
+	c.logger.Info("Decommissioning node")
+	c.recorder.Event(node, corev1.EventTypeNormal, "NodeOperation", "Decommissioning node")
+
+	err := c.privileged.DecommissionNode(ctx, request)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to decommission node: %s", err)
+		return "", fmt.Errorf("%w: %w", errDecommissionFailed, err)
+	}
+	c.decommissioned = true
+
+	c.recorder.Event(node, corev1.EventTypeNormal, "NodeOperation", "Node decommissioned")
+	return "Node decommissioned", nil
+}
+
+// syncNodeDeletion decommissions the node once its Node object is deleted, eg: on a pool scale-down
+// or when a Kosmos node is detached, if the node metadata opts in. Otherwise the controller waits for
+// the node to be registered again.
+func (c *Controller) syncNodeDeletion(ctx context.Context) error {
+	// Confirm the deletion, the informer cache may be stale
+	_, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err == nil {
+		return errNodeNotRegistered
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	// The last node seen is the object of the events, it is kept until the deletion is handled
+	node := c.lastNode
+	c.logger.Info("Node deleted", slog.String("node", c.nodeName))
+
+	// The host of a shared agent still runs the other nodes, it is not decommissioned
+	if c.sharedSync != nil {
+		c.lastNode = nil
+		return nil
+	}
+
+	// The node is only decommissioned on its deletion if the node metadata opts in
+	nodeMetadata, err := c.privileged.LoadNodeMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: failed to get node metadata: %w", errOperationNotStarted, err)
+	}
+	if !nodeMetadata.DecommissionOnDelete {
+		c.logger.Info("Node not decommissioned on deletion, waiting for it to be registered again")
+		c.lastNode = nil
+		return nil
+	}
+	// The decommission not started or failed is retried, a denied one is not
+	_, err = c.runRemoteOperation(ctx, node, AgentOperation{Name: "decommission"}, AuditEntry{Source: "deletion"})
+	if errors.Is(err, errOperationNotStarted) || errors.Is(err, errDecommissionFailed) {
+		return err
+	}
+	c.lastNode = nil
+
+	return err
+}
+
+// stopIfDecommissioned stops the controller once the node is decommissioned, the agent exits and is
+// not restarted by systemd
+func (c *Controller) stopIfDecommissioned() bool {
+	if !c.decommissioned {
+		return false
+	}
+	c.logger.Info("Node decommissioned, stopping controller")
+	c.cancel()
+	return true
+}
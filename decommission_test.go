@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWipeNodeState(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	// Files of a node installed with a rendered kubeconfig
+	files := []string{
+		kosmosUserDataCacheFile,
+		kubeletCAFile,
+		versionsFile,
+		"/root/.kube/config",
+		auditLog,
+		managedFilesFile,
+		filepath.Join(takeoverBackupDir, "etc/crictl.yaml"),
+		statusFile,
+		filepath.Join(snapshotsDir, "snapshot-1.tar.gz"),
+	}
+	for _, path := range files {
+		err := os.MkdirAll(filepath.Dir(hostPath(path)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(hostPath(path), []byte("data"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := saveKubeconfigs(map[string]Kubeconfig{"/root/.kube/config": {Path: "/root/.kube/config"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wipeNodeState()
+	if err != nil {
+		t.Fatalf("failed to wipe node state: %v", err)
+	}
+
+	// The audit log is kept, and the managed files and backups for the reset
+	kept := []string{auditLog, managedFilesFile, filepath.Join(takeoverBackupDir, "etc/crictl.yaml")}
+	for _, path := range files {
+		_, err := os.Stat(hostPath(path))
+		if slices.Contains(kept, path) && err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+		if !slices.Contains(kept, path) && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+	entries, err := os.ReadDir(hostPath(stateDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !slices.Equal(names, []string{"audit.log", "managed-files.json", "takeover-backup"}) {
+		t.Errorf("unexpected state files %v", names)
+	}
+
+	// The node is wiped again after a failed decommission
+	err = wipeNodeState()
+	if err != nil {
+		t.Errorf("failed to wipe node state again: %v", err)
+	}
+}
+
+func entryNames(entries []os.DirEntry) []string {
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// decommissionPrivileged allows the decommission and fails it
+type decommissionPrivileged struct {
+	localPrivileged
+}
+
+func (decommissionPrivileged) LoadNodeMetadata(ctx context.Context) (NodeMetadata, error) {
+	return NodeMetadata{RemoteOperations: []string{"decommission"}, DecommissionOnDelete: true}, nil
+}
+
+func (decommissionPrivileged) DecommissionNode(ctx context.Context, request RemoteOperationRequest) error {
+	return fmt.Errorf("repository unreachable")
+}
+
+func TestSyncNodeDeletionRetried(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	// The failed decommission is retried, the deleted node is kept
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewClientset()
+	c := &Controller{
+		nodeName:   "node",
+		client:     client,
+		privileged: decommissionPrivileged{},
+		recorder:   newEventRecorder(ctx, client, "node"),
+		logger:     slog.Default(),
+		lastNode:   &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}},
+	}
+	err := c.syncNodeDeletion(ctx)
+	if err == nil || !errors.Is(err, errDecommissionFailed) {
+		t.Fatalf("expected the decommission failure, got %v", err)
+	}
+	if c.lastNode == nil || c.decommissioned {
+		t.Errorf("expected the deleted node kept for a retry, got %v, %v", c.lastNode, c.decommissioned)
+	}
+}
+
+// decommissionOptOutPrivileged allows the decommission without opting in the decommission on deletion
+type decommissionOptOutPrivileged struct {
+	decommissionPrivileged
+}
+
+func (decommissionOptOutPrivileged) LoadNodeMetadata(ctx context.Context) (NodeMetadata, error) {
+	return NodeMetadata{RemoteOperations: []string{"decommission"}}, nil
+}
+
+func TestSyncNodeDeletionOptIn(t *testing.T) {
+	// The deleted node is not decommissioned unless the node metadata opts in
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewClientset()
+	c := &Controller{
+		nodeName:   "node",
+		client:     client,
+		privileged: decommissionOptOutPrivileged{},
+		recorder:   newEventRecorder(ctx, client, "node"),
+		logger:     slog.Default(),
+		lastNode:   &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}},
+	}
+	err := c.syncNodeDeletion(ctx)
+	if err != nil {
+		t.Fatalf("expected the deletion ignored, got %v", err)
+	}
+	if c.lastNode != nil || c.decommissioned {
+		t.Errorf("expected the controller waiting for the node registration, got %v, %v", c.lastNode, c.decommissioned)
+	}
+}
+
+func TestDecommissionDrained(t *testing.T) {
+	// The node is drained before the decommission operation stops the kubelet
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+	client := fake.NewClientset(node)
+	c := &Controller{
+		nodeName:   "node",
+		client:     client,
+		privileged: decommissionPrivileged{},
+		recorder:   newEventRecorder(ctx, client, "node"),
+		logger:     slog.Default(),
+	}
+	_, err := c.decommission(ctx, node, RemoteOperationRequest{Source: "annotation"})
+	if !errors.Is(err, errDecommissionFailed) {
+		t.Fatalf("expected the decommission failure, got %v", err)
+	}
+	drained, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !drained.Spec.Unschedulable {
+		t.Error("expected the node drained before the decommission")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// drainTimeout is the maximum time to wait for the pods to be evicted, the PodDisruptionBudgets
+// may delay the evictions
+const drainTimeout = 10 * time.Minute
+
+// drainRetryInterval is the delay before draining the node again once the drain timed out, the node
+// stays cordoned in the meantime
+var drainRetryInterval = 5 * time.Minute
+
+// drainCordonAnnotation is set by the agent on the node it cordoned, so it is uncordoned once an
+// upgrade succeeds even if the upgrade failed or was retried after the drain
+var drainCordonAnnotation = defaultAnnotationPrefix + "agent-cordoned"
+
+// errDrainTimeout is returned when the pods are not all evicted before the drain timeout
+var errDrainTimeout = errors.New("drain timed out")
+
+// cordonNode marks the node unschedulable or schedulable, and records whether the agent cordoned it
+func (c *Controller) cordonNode(ctx context.Context, unschedulable bool) error {
+	annotation := "null"
+	if unschedulable {
+		annotation = `"true"`
+	}
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%s}},"spec":{"unschedulable":%t}}`, drainCordonAnnotation, annotation, unschedulable)
+	_, err := c.client.CoreV1().Nodes().Patch(ctx, c.nodeName, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to patch node %s unschedulable: %w", c.nodeName, err)
+	}
+	return nil
+}
+
+// drainNode cordons the node and evicts its pods, except the DaemonSets and static pods. It returns
+// true if the node was cordoned by the agent, now or by a previous drain, so it must be uncordoned
+// once the upgrade succeeds.
+func (c *Controller) drainNode(ctx context.Context) (bool, error) {
+	node, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	// A node already cordoned by someone else is left cordoned after the upgrade
+	cordoned := !node.Spec.Unschedulable || node.Annotations[drainCordonAnnotation] == "true"
+	if !node.Spec.Unschedulable {
+		err = c.cordonNode(ctx, true)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// The drain does not act on the host, the other nodes of a shared agent are reconciled meanwhile
+	if c.sharedSync != nil {
+		c.sharedSync.Unlock()
+		defer c.sharedSync.Lock()
+	}
+
+	// Evict the pods until they are all gone, the evictions blocked by a PodDisruptionBudget are retried.
+	// The drain is bounded by its timeout, each poll is a progress of the drain.
+	defer stalls.start("drain")()
+	var remaining int
+	err = wait.PollUntilContextTimeout(ctx, 5*time.Second, drainTimeout, true, func(ctx context.Context) (bool, error) {
+		stalls.progress()
+		pods, err := c.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+			FieldSelector: fmt.Sprintf("spec.nodeName=%s", c.nodeName),
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to list pods on node %s: %w", c.nodeName, err)
+		}
+
+		remaining = 0
+		for _, pod := range pods.Items {
+			if !evictable(pod) {
+				continue
+			}
+			remaining++
+			if pod.DeletionTimestamp != nil {
+				continue
+			}
+
+			err = c.client.PolicyV1().Evictions(pod.Namespace).Evict(ctx, &policyv1.Eviction{
+				ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+			})
+			if err != nil && !apierrors.IsTooManyRequests(err) && !apierrors.IsNotFound(err) {
+				return false, fmt.Errorf("failed to evict pod %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+		}
+
+		if remaining > 0 {
+			c.logger.Info("Waiting for pods to be evicted", slog.Int("pods", remaining))
+		}
+		return remaining == 0, nil
+	})
+	if wait.Interrupted(err) && ctx.Err() == nil {
+		return cordoned, fmt.Errorf("failed to drain node %s, %d pods remaining: %w", c.nodeName, remaining, errDrainTimeout)
+	}
+	if err != nil {
+		return cordoned, fmt.Errorf("failed to drain node %s, %d pods remaining: %w", c.nodeName, remaining, err)
+	}
+
+	return cordoned, nil
+}
+
+// evictable returns whether the pod is evicted by the drain, the DaemonSets pods would be recreated
+// and the static pods cannot be evicted
+func evictable(pod corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	if _, mirror := pod.Annotations[corev1.MirrorPodAnnotationKey]; mirror {
+		return false
+	}
+	owner := metav1.GetControllerOf(&pod)
+	return owner == nil || owner.Kind != "DaemonSet"
+}
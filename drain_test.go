@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDrainNodeCordoned(t *testing.T) {
+	tests := []struct {
+		name          string
+		unschedulable bool
+		annotations   map[string]string
+		expected      bool
+	}{
+		{name: "schedulable", expected: true},
+		{name: "cordoned by someone else", unschedulable: true},
+		{name: "cordoned by a previous drain", unschedulable: true, annotations: map[string]string{drainCordonAnnotation: "true"}, expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Annotations: test.annotations}, Spec: corev1.NodeSpec{Unschedulable: test.unschedulable}}
+			client := fake.NewClientset(node)
+			c := &Controller{nodeName: "node", client: client, logger: slog.Default()}
+
+			cordoned, err := c.drainNode(ctx)
+			if err != nil {
+				t.Fatalf("failed to drain node: %v", err)
+			}
+			if cordoned != test.expected {
+				t.Errorf("cordoned = %t, expected %t", cordoned, test.expected)
+			}
+			drained, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !drained.Spec.Unschedulable {
+				t.Error("expected the node cordoned")
+			}
+
+			// The uncordon removes the record of the agent cordon
+			if cordoned {
+				err = c.cordonNode(ctx, false)
+				if err != nil {
+					t.Fatalf("failed to uncordon node: %v", err)
+				}
+				uncordoned, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, found := uncordoned.Annotations[drainCordonAnnotation]; found || uncordoned.Spec.Unschedulable {
+					t.Errorf("expected the node uncordoned, got %v, %v", uncordoned.Spec.Unschedulable, uncordoned.Annotations)
+				}
+			}
+		})
+	}
+}
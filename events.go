@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventReportingController is the reporting controller of the agent events
+const eventReportingController = "agent"
+
+// eventAction is the action of the agent events, the agent reconciles its node
+const eventAction = "Reconcile"
+
+// Series of the events.k8s.io/v1 events, as the client-go events recorder: the identical events are
+// aggregated until eventSeriesExpiry after the last one, and the count of the series is refreshed every
+// eventSeriesRefresh. The events are dropped once eventQueueLength events wait to be sent.
+const (
+	eventSeriesExpiry  = 6 * time.Minute
+	eventSeriesRefresh = 30 * time.Minute
+	eventQueueLength   = 1000
+)
+
+// eventRecorder records the node events as core/v1 events, with the client-go recorder, and also as
+// events.k8s.io/v1 events. The identical events.k8s.io/v1 events, same node, type, reason and note, are
+// aggregated in an event series, eg: the warning of each reconcile of a flapping upgrade, the events with
+// a different note are not.
+type eventRecorder struct {
+	legacy   record.EventRecorder
+	client   kubernetes.Interface
+	instance string
+	events   chan *eventsv1.Event
+	series   map[eventSeriesKey]*eventSeries
+}
+
+// eventSeriesKey identifies the identical events
+type eventSeriesKey struct {
+	regarding string
+	eventType string
+	reason    string
+	note      string
+}
+
+// eventSeries is the last event created of identical events, with its series once repeated
+type eventSeries struct {
+	event *eventsv1.Event
+	dirty bool // The series count is not sent yet
+}
+
+// newEventRecorder returns the event recorder of the node, the events are sent until the context is done
+func newEventRecorder(ctx context.Context, client kubernetes.Interface, nodeName string) *eventRecorder {
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+
+	recorder := &eventRecorder{
+		legacy:   broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventReportingController}),
+		client:   client,
+		instance: eventReportingController + "-" + nodeName,
+		events:   make(chan *eventsv1.Event, eventQueueLength),
+		series:   make(map[eventSeriesKey]*eventSeries),
+	}
+	go recorder.run(ctx)
+	return recorder
+}
+
+// Event records an event on the node, asynchronously
+func (r *eventRecorder) Event(node *corev1.Node, eventType, reason, message string) {
+	r.legacy.Event(node, eventType, reason, message)
+
+	select {
+	case r.events <- newNodeEvent(node, eventType, reason, truncateEventNote(message), r.instance):
+	default:
+		slog.Warn("Too many events queued, event dropped", slog.String("reason", reason))
+	}
+}
+
+// Eventf records an event on the node with a formatted message, asynchronously
+func (r *eventRecorder) Eventf(node *corev1.Node, eventType, reason, messageFmt string, args ...interface{}) {
+	r.Event(node, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// run sends the events.k8s.io/v1 events and refreshes their series until the context is done
+func (r *eventRecorder) run(ctx context.Context) {
+	ticker := time.NewTicker(eventSeriesRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-r.events:
+			r.record(ctx, event)
+		case <-ticker.C:
+			r.refresh(ctx)
+		}
+	}
+}
+
+// record creates the event, or counts it in the series of the identical event. The series is sent with
+// the first repeated event, the next ones are counted until it is refreshed.
+func (r *eventRecorder) record(ctx context.Context, event *eventsv1.Event) {
+	key := eventSeriesKey{regarding: event.Regarding.Name, eventType: event.Type, reason: event.Reason, note: event.Note}
+	series, exists := r.series[key]
+	if exists && event.EventTime.Sub(lastObservedTime(series.event)) < eventSeriesExpiry {
+		if series.event.Series == nil {
+			series.event.Series = &eventsv1.EventSeries{Count: 2, LastObservedTime: event.EventTime}
+			r.patchSeries(ctx, series)
+			return
+		}
+		series.event.Series.Count++
+		series.event.Series.LastObservedTime = event.EventTime
+		series.dirty = true
+		return
+	}
+
+	created, err := r.client.EventsV1().Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	if err != nil {
+		slog.Warn("Failed to create event", slog.String("reason", event.Reason), slog.Any("error", err))
+		return
+	}
+	r.series[key] = &eventSeries{event: created}
+}
+
+// refresh sends the count of the series, and forgets the events which are not repeated anymore
+func (r *eventRecorder) refresh(ctx context.Context) {
+	now := time.Now()
+	for key, series := range r.series {
+		if series.dirty {
+			r.patchSeries(ctx, series)
+		}
+		if now.Sub(lastObservedTime(series.event)) >= eventSeriesExpiry {
+			delete(r.series, key)
+		}
+	}
+}
+
+// patchSeries sends the series of the event
+func (r *eventRecorder) patchSeries(ctx context.Context, series *eventSeries) {
+	patch, err := json.Marshal(map[string]any{"series": series.event.Series})
+	if err != nil {
+		slog.Warn("Failed to marshal event series", slog.Any("error", err))
+		return
+	}
+	_, err = r.client.EventsV1().Events(series.event.Namespace).Patch(ctx, series.event.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		slog.Warn("Failed to update event series", slog.String("reason", series.event.Reason), slog.Any("error", err))
+		return
+	}
+	series.dirty = false
+}
+
+// lastObservedTime returns the time of the last event of the series
+func lastObservedTime(event *eventsv1.Event) time.Time {
+	if event.Series != nil {
+		return event.Series.LastObservedTime.Time
+	}
+	return event.EventTime.Time
+}
+
+// createNodeEvents creates a warning event on the node as a core/v1 and an events.k8s.io/v1 event,
+// synchronously, eg: before the agent exits
+func createNodeEvents(ctx context.Context, client kubernetes.Interface, node *corev1.Node, instance, reason, message string) error {
+	now := metav1.Now()
+	_, err := client.CoreV1().Events(metav1.NamespaceDefault).Create(ctx, &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{GenerateName: node.Name + "."},
+		InvolvedObject: corev1.ObjectReference{Kind: "Node", Name: node.Name, UID: node.UID},
+		Type:           corev1.EventTypeWarning,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: eventReportingController},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	event := newNodeEvent(node, corev1.EventTypeWarning, reason, truncateEventNote(message), instance)
+	_, err = client.EventsV1().Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// newNodeEvent returns an event regarding the node, in the default namespace as the node is not
+// namespaced
+func newNodeEvent(node *corev1.Node, eventType, reason, note, instance string) *eventsv1.Event {
+	now := time.Now()
+	return &eventsv1.Event{
+		ObjectMeta:          metav1.ObjectMeta{Name: fmt.Sprintf("%s.%x", node.Name, now.UnixNano()), Namespace: metav1.NamespaceDefault},
+		EventTime:           metav1.NewMicroTime(now),
+		ReportingController: eventReportingController,
+		ReportingInstance:   instance,
+		Action:              eventAction,
+		Reason:              reason,
+		Regarding:           corev1.ObjectReference{APIVersion: "v1", Kind: "Node", Name: node.Name, UID: node.UID},
+		Note:                note,
+		Type:                eventType,
+	}
+}
+
+// maxEventNoteLength is the maximum length of an event note accepted by the API server
+const maxEventNoteLength = 1024
+
+func truncateEventNote(note string) string {
+	if len(note) <= maxEventNoteLength {
+		return note
+	}
+	return strings.ToValidUTF8(note[:maxEventNoteLength-3], "") + "..."
+}
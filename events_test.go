@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEventRecorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewClientset()
+	recorder := newEventRecorder(ctx, client, "node")
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", UID: "uid"}}
+
+	// The identical warnings are aggregated, the other events are not
+	for range 3 {
+		recorder.Eventf(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to upgrade: %s", "timeout")
+	}
+	recorder.Event(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to upgrade: drain")
+	recorder.Event(node, corev1.EventTypeNormal, "NodeUpgrade", "Failed to upgrade: timeout")
+
+	// The series is sent with the second event, the next ones are counted until it is refreshed
+	var events *eventsv1.EventList
+	err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		var err error
+		events, err = client.EventsV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		series := slices.ContainsFunc(events.Items, func(event eventsv1.Event) bool { return event.Series != nil })
+		return len(events.Items) == 3 && series, nil
+	})
+	if err != nil {
+		t.Fatalf("expected 3 events with a series, got %v: %v", events, err)
+	}
+	for _, event := range events.Items {
+		if event.Regarding.Kind != "Node" || event.Regarding.Name != "node" || event.ReportingController != eventReportingController || event.ReportingInstance != "agent-node" || event.Action != eventAction {
+			t.Errorf("unexpected event %+v", event)
+		}
+		repeated := event.Type == corev1.EventTypeWarning && event.Note == "Failed to upgrade: timeout"
+		if repeated && (event.Series == nil || event.Series.Count < 2) {
+			t.Errorf("expected a series of the repeated events, got %+v", event.Series)
+		}
+		if !repeated && event.Series != nil {
+			t.Errorf("unexpected series %+v for %s", event.Series, event.Note)
+		}
+	}
+
+	// The events are also recorded as core/v1 events
+	err = wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		coreEvents, err := client.CoreV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		return slices.ContainsFunc(coreEvents.Items, func(event corev1.Event) bool {
+			return event.InvolvedObject.Name == "node" && event.Reason == "NodeUpgrade" && event.Message == "Failed to upgrade: drain" && event.Source.Component == eventReportingController
+		}), nil
+	})
+	if err != nil {
+		t.Errorf("expected the core/v1 events: %v", err)
+	}
+}
+
+func TestEventSeriesRefresh(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset()
+	recorder := &eventRecorder{client: client, instance: "agent-node", series: make(map[eventSeriesKey]*eventSeries)}
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+	at := func(event *eventsv1.Event, eventTime time.Time) *eventsv1.Event {
+		event.EventTime = metav1.NewMicroTime(eventTime)
+		event.Name = fmt.Sprintf("node.%x", eventTime.UnixNano())
+		return event
+	}
+	series := func() *eventsv1.EventSeries {
+		t.Helper()
+		events, err := client.EventsV1().Events(metav1.NamespaceDefault).List(ctx, metav1.ListOptions{})
+		if err != nil || len(events.Items) != 1 {
+			t.Fatalf("expected one event, got %v: %v", events, err)
+		}
+		return events.Items[0].Series
+	}
+
+	start := time.Now().Add(-time.Hour)
+	for i := range 3 {
+		recorder.record(ctx, at(newNodeEvent(node, corev1.EventTypeWarning, "NodeUpgrade", "Failed to upgrade", "agent-node"), start.Add(time.Duration(i)*time.Minute)))
+	}
+	if s := series(); s == nil || s.Count != 2 {
+		t.Errorf("expected the series sent with the second event, got %+v", s)
+	}
+
+	// The refresh sends the series count and forgets the expired series
+	recorder.refresh(ctx)
+	if s := series(); s == nil || s.Count != 3 {
+		t.Errorf("expected the series count refreshed, got %+v", s)
+	}
+	if len(recorder.series) != 0 {
+		t.Errorf("expected the expired series forgotten, got %d", len(recorder.series))
+	}
+}
+
+func TestTruncateEventNote(t *testing.T) {
+	note := truncateEventNote(strings.Repeat("é", maxEventNoteLength))
+	if len(note) > maxEventNoteLength || !strings.HasSuffix(note, "...") || !strings.HasPrefix(note, "éé") {
+		t.Errorf("unexpected truncated note of %d bytes", len(note))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Exit codes of the agent, also reported to systemd with EXIT_STATUS, so the OnFailure handlers and
+// the control plane can react to each failure class
+const (
+	exitFailure        = 1  // Invalid flags or unexpected failure
+	exitCredentials    = 3  // The node credentials cannot be read
+	exitMetadata       = 4  // The node metadata is unreachable or invalid
+	exitInstall        = 5  // The installation of the components failed
+	exitController     = 6  // The controller failed or must be restarted, eg: after a cluster CA rotation
+	exitPanic          = 7  // The agent panicked, the stack is saved in the panics directory
+	exitBootstrap      = 8  // The bootstrap timeout is exceeded, the node should be replaced
+	exitRepository     = 9  // The repository is unreachable or invalid, the installation did not start
+	exitControllerAuth = 10 // The API server rejects the controller credentials
+	exitStalled        = 11 // A reconcile or an install made no progress within the stall timeout
+)
+
+var (
+	// errRepository is returned when the repository cannot be opened or its releases are invalid
+	errRepository = errors.New("repository unavailable or invalid")
+	// errControllerAuth is returned when the API server rejects the controller credentials
+	errControllerAuth = errors.New("controller credentials rejected")
+)
+
+// controllerExitError is the exit status of the unprivileged controller child process, the agent exits
+// with it. The exit statuses of the other commands, eg: the scripts, are not exit codes of the agent.
+type controllerExitError struct {
+	code int
+	err  error
+}
+
+func (e controllerExitError) Error() string { return fmt.Sprintf("controller exited: %s", e.err) }
+
+func (e controllerExitError) Unwrap() error { return e.err }
+
+// exitCode returns the exit code of the error failure class, the fallback for the other errors. The
+// exit code of the unprivileged controller is kept.
+func exitCode(err error, fallback int) int {
+	var exitErr controllerExitError
+	switch {
+	case errors.Is(err, errBootstrapTimeout):
+		return exitBootstrap
+	case errors.Is(err, errRepository):
+		return exitRepository
+	case errors.Is(err, errControllerAuth):
+		return exitControllerAuth
+	case errors.As(err, &exitErr) && exitErr.code > 0:
+		return exitErr.code
+	default:
+		return fallback
+	}
+}
+
+// exit reports the exit status to systemd and exits
+func exit(code int) {
+	_ = sdNotify(fmt.Sprintf("EXIT_STATUS=%d", code))
+	os.Exit(code)
+}
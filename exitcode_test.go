@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	childErr := exec.Command("/bin/sh", "-c", "exit 10").Run()
+
+	tests := []struct {
+		name     string
+		err      error
+		fallback int
+		expected int
+	}{
+		{
+			name:     "install failure",
+			err:      errors.New("failed to install component kubelet"),
+			fallback: exitInstall,
+			expected: exitInstall,
+		},
+		{
+			name:     "repository",
+			err:      fmt.Errorf("failed to install: %w", fmt.Errorf("%w: failed to read releases file", errRepository)),
+			fallback: exitInstall,
+			expected: exitRepository,
+		},
+		{
+			name:     "bootstrap timeout",
+			err:      fmt.Errorf("%w: node not installed after 30m0s", errBootstrapTimeout),
+			fallback: exitInstall,
+			expected: exitBootstrap,
+		},
+		{
+			name:     "controller credentials",
+			err:      fmt.Errorf("%w: Unauthorized", errControllerAuth),
+			fallback: exitController,
+			expected: exitControllerAuth,
+		},
+		{
+			name:     "unprivileged controller exit code",
+			err:      controllerExitError{code: 10, err: childErr},
+			fallback: exitController,
+			expected: exitControllerAuth,
+		},
+		{
+			name:     "script exit code",
+			err:      fmt.Errorf("failed to install component kubelet: %w", exec.Command("/bin/sh", "-c", "exit 8").Run()),
+			fallback: exitInstall,
+			expected: exitInstall,
+		},
+	}
+	for _, test := range tests {
+		code := exitCode(test.err, test.fallback)
+		if code != test.expected {
+			t.Errorf("%s: exit code = %d, expected %d", test.name, code, test.expected)
+		}
+	}
+}
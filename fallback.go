@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/Masterminds/semver/v3"
+)
+
+// Fallback rules of the component versions without key in metadata.yaml, eg: a patch version
+// released before its key was added
+const (
+	// fallbackNearestLowerPatch uses the highest lower version of the same minor version
+	fallbackNearestLowerPatch = "nearest_lower_patch"
+	// fallbackNearestLowerMinor uses the highest lower version of the same major version
+	fallbackNearestLowerMinor = "nearest_lower_minor"
+	// fallbackDefault uses the "default" version key
+	fallbackDefault = "default"
+)
+
+var fallbackRules = []string{fallbackNearestLowerPatch, fallbackNearestLowerMinor, fallbackDefault}
+
+// defaultVersionKey is the version key used by the default fallback, it is not an available version
+const defaultVersionKey = "default"
+
+// fallbackVersion returns the version key of the first fallback rule which applies to the version, and
+// the rule
+func (c ComponentVersions) fallbackVersion(version string) (string, string, bool) {
+	for _, rule := range c.Fallback {
+		switch rule {
+		case fallbackNearestLowerPatch, fallbackNearestLowerMinor:
+			nearest, found := c.nearestLowerVersion(version, rule == fallbackNearestLowerPatch)
+			if found {
+				return nearest, rule, true
+			}
+		case fallbackDefault:
+			if _, ok := c.Versions[defaultVersionKey]; ok {
+				return defaultVersionKey, rule, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// nearestLowerVersion returns the highest version key lower than the version, of the same major
+// version, and of the same minor version if sameMinor is set
+func (c ComponentVersions) nearestLowerVersion(version string, sameMinor bool) (string, bool) {
+	parsedVersion, err := semver.NewVersion(version)
+	if err != nil {
+		return "", false
+	}
+
+	var nearest *semver.Version
+	nearestKey := ""
+	for key := range c.Versions {
+		parsedKey, err := semver.NewVersion(key)
+		if err != nil || parsedKey.Prerelease() != "" || !parsedKey.LessThan(parsedVersion) {
+			continue
+		}
+		if parsedKey.Major() != parsedVersion.Major() || (sameMinor && parsedKey.Minor() != parsedVersion.Minor()) {
+			continue
+		}
+		if nearest == nil || parsedKey.GreaterThan(nearest) {
+			nearest, nearestKey = parsedKey, key
+		}
+	}
+	return nearestKey, nearest != nil
+}
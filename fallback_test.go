@@ -0,0 +1,89 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFallbackVersion(t *testing.T) {
+	versions := map[string]ComponentSections{"1.29.9": {}, "1.30.2": {}, "1.30.4": {}, "1.31.0-rc.1": {}, "2.0.0": {}, defaultVersionKey: {}}
+
+	tests := []struct {
+		name     string
+		fallback []string
+		version  string
+		expected string
+		rule     string
+	}{
+		{name: "no fallback", version: "1.30.5"},
+		{name: "nearest lower patch", fallback: []string{"nearest_lower_patch"}, version: "1.30.5", expected: "1.30.4", rule: "nearest_lower_patch"},
+		{name: "no lower patch", fallback: []string{"nearest_lower_patch"}, version: "1.30.1"},
+		{name: "nearest lower minor", fallback: []string{"nearest_lower_minor"}, version: "1.31.1", expected: "1.30.4", rule: "nearest_lower_minor"},
+		{name: "prereleases skipped", fallback: []string{"nearest_lower_minor"}, version: "1.31.2", expected: "1.30.4", rule: "nearest_lower_minor"},
+		{name: "other major", fallback: []string{"nearest_lower_minor"}, version: "2.0.0-rc.1"},
+		{name: "default", fallback: []string{"default"}, version: "1.32.0", expected: defaultVersionKey, rule: "default"},
+		{name: "in order", fallback: []string{"nearest_lower_patch", "default"}, version: "1.31.2", expected: defaultVersionKey, rule: "default"},
+		{name: "not a version", fallback: []string{"nearest_lower_minor"}, version: "latest"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			componentVersions := ComponentVersions{Versions: versions, Fallback: test.fallback}
+			version, rule, found := componentVersions.fallbackVersion(test.version)
+			if version != test.expected || rule != test.rule || found != (test.expected != "") {
+				t.Errorf("expected %q %q, got %q %q %v", test.expected, test.rule, version, rule, found)
+			}
+		})
+	}
+}
+
+func TestComponentMetadataFallback(t *testing.T) {
+	repoFS := fstest.MapFS{
+		"kubelet/metadata.yaml": {Data: []byte(`versions:
+  1.30.4:
+    template_functions: [indent]
+  default:
+    template_functions: [quote]
+fallback: [nearest_lower_patch, default]
+`)},
+		"containerd/metadata.yaml": {Data: []byte("versions:\n  1.7.22: {}\n")},
+		"runc/metadata.yaml":       {Data: []byte("versions: {}\nfallback: [nearest]\n")},
+	}
+
+	// The fallback is returned with the sections, so it is logged once by the install
+	sections, err := componentMetadata(repoFS, "kubelet", "1.30.6~1")
+	if err != nil || !slices.Equal(sections.TemplateFunctions, []string{"indent"}) || sections.fallback != "1.30.4" || sections.fallbackRule != "nearest_lower_patch" {
+		t.Errorf("expected the 1.30.4 sections, got %+v, %v", sections, err)
+	}
+	sections, err = componentMetadata(repoFS, "kubelet", "1.31.0")
+	if err != nil || !slices.Equal(sections.TemplateFunctions, []string{"quote"}) || sections.fallback != defaultVersionKey {
+		t.Errorf("expected the default sections, got %+v, %v", sections, err)
+	}
+	sections, err = componentMetadata(repoFS, "kubelet", "1.30.4")
+	if err != nil || sections.fallback != "" {
+		t.Errorf("expected the sections of the version without fallback, got %+v, %v", sections, err)
+	}
+
+	// The default key cannot be requested as a version
+	_, err = componentMetadata(repoFS, "kubelet", "default")
+	if err == nil || !strings.Contains(err.Error(), "reserved for the default fallback") {
+		t.Errorf("expected the default version refused, got %v", err)
+	}
+
+	// The default key is not an available version
+	versions, err := componentVersions(repoFS, "kubelet")
+	if err != nil || !slices.Equal(versions, []string{"1.30.4"}) {
+		t.Errorf("unexpected versions %v, %v", versions, err)
+	}
+
+	// The components without fallback still require the version key
+	_, err = componentMetadata(repoFS, "containerd", "1.7.23")
+	if err == nil || !strings.Contains(err.Error(), "component version 1.7.23 not found") {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	_, err = componentMetadata(repoFS, "runc", "1.1.14")
+	if err == nil || !strings.Contains(err.Error(), `invalid fallback "nearest"`) {
+		t.Errorf("expected an invalid fallback error, got %v", err)
+	}
+}
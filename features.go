@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Feature gates guard the new agent behaviors, so they can be enabled gradually: the agent ships with
+// the gate defaults, the agent flag overrides them per node image, and the node metadata per pool
+//
+//	"feature_gates": {
+//	   "DrainBeforeUpgrade": true
+//	}
+const (
+	// FeatureDrainBeforeUpgrade cordons and drains the node before an upgrade, it is uncordoned once healthy
+	FeatureDrainBeforeUpgrade = "DrainBeforeUpgrade"
+
+	// FeatureDriftHeal corrects the network and firewall drifts, they are only reported when disabled
+	FeatureDriftHeal = "DriftHeal"
+
+	// FeatureParallelInstall installs the components concurrently, a component waits for the components
+	// it requires. Their metadata is read before any change, so an invalid component fails the install first.
+	FeatureParallelInstall = "ParallelInstall"
+
+	// FeatureNodeOperations watches the NodeOperation objects of the node to run the upgrades, restores
+	// and plans, in addition to the agent annotation
+	FeatureNodeOperations = "NodeOperations"
+
+	// FeatureImageFastPath checks the image once on first boot, when it was built with exactly the
+	// components of the release and their files are unchanged, the baked files are then not checked again
+	FeatureImageFastPath = "ImageFastPath"
+
+	// FeatureScriptDigests refuses the component scripts without a digest attested by the provenance or
+	// pinned by the node metadata, the scripts with a digest are always checked
+	FeatureScriptDigests = "ScriptDigests"
+
+	// FeatureAdoptInstallations records the components installed by a previous tooling with the release
+	// version as installed on the first install, instead of reinstalling them
+	FeatureAdoptInstallations = "AdoptInstallations"
+)
+
+// featureGate is the maturity and default state of a feature gate
+type featureGate struct {
+	Default bool
+	Stage   string // alpha (disabled by default), beta (enabled by default) or GA
+}
+
+var featureGates = map[string]featureGate{
+	FeatureDrainBeforeUpgrade: {Default: false, Stage: "alpha"},
+	FeatureDriftHeal:          {Default: true, Stage: "beta"},
+	FeatureParallelInstall:    {Default: false, Stage: "alpha"},
+	FeatureNodeOperations:     {Default: false, Stage: "alpha"},
+	FeatureImageFastPath:      {Default: false, Stage: "alpha"},
+	FeatureScriptDigests:      {Default: false, Stage: "alpha"},
+	FeatureAdoptInstallations: {Default: false, Stage: "alpha"},
+}
+
+// featureGatesFlag is the -feature-gates flag value, eg: DrainBeforeUpgrade=true,DriftHeal=false
+var featureGatesFlag string
+
+// flagFeatureGates are the feature gates of the flag, parsed once at startup
+var flagFeatureGates map[string]bool
+
+// parseFeatureGates parses the feature gates of the flag, the unknown gates are rejected
+func parseFeatureGates(value string) (map[string]bool, error) {
+	var err error
+	gates := make(map[string]bool)
+	if value == "" {
+		return gates, nil
+	}
+
+	for _, gate := range strings.Split(value, ",") {
+		name, enabled, ok := strings.Cut(strings.TrimSpace(gate), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid feature gate %q, expected Name=true|false", gate)
+		}
+		if _, known := featureGates[name]; !known {
+			return nil, fmt.Errorf("unknown feature gate %q, expected one of %s", name, strings.Join(slices.Sorted(maps.Keys(featureGates)), ", "))
+		}
+		gates[name], err = strconv.ParseBool(enabled)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feature gate %q value %q", name, enabled)
+		}
+	}
+
+	return gates, nil
+}
+
+// featureEnabled returns whether the feature gate is enabled, by the node metadata, the flag or its default.
+// The unknown gates of the metadata are ignored, they may be sent by a newer control plane.
+func (m NodeMetadata) featureEnabled(name string) bool {
+	if enabled, ok := m.FeatureGates[name]; ok {
+		return enabled
+	}
+
+	if enabled, ok := flagFeatureGates[name]; ok {
+		return enabled
+	}
+
+	return featureGates[name].Default
+}
+
+// logFeatureGates logs the enabled feature gates and the unknown gates of the metadata
+func logFeatureGates(m NodeMetadata) {
+	var enabled []string
+	for _, name := range slices.Sorted(maps.Keys(featureGates)) {
+		if m.featureEnabled(name) {
+			enabled = append(enabled, name)
+		}
+	}
+	for name := range m.FeatureGates {
+		if _, known := featureGates[name]; !known {
+			slog.Warn("Unknown feature gate ignored", slog.String("gate", name))
+		}
+	}
+	slog.Info("Feature gates", slog.String("enabled", strings.Join(enabled, ",")))
+}
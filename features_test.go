@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestParseFeatureGates(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"", true},
+		{"DrainBeforeUpgrade=true,DriftHeal=false", true},
+		{"DrainBeforeUpgrade", false},
+		{"DrainBeforeUpgrade=yes", false},
+		{"Unknown=true", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseFeatureGates(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: error = %v, valid %v", test.value, err, test.valid)
+		}
+	}
+}
+
+func TestFeatureEnabled(t *testing.T) {
+	defer func(previous map[string]bool) {
+		flagFeatureGates = previous
+	}(flagFeatureGates)
+	flagFeatureGates = map[string]bool{FeatureDrainBeforeUpgrade: true, FeatureDriftHeal: false}
+
+	tests := []struct {
+		name     string
+		gates    map[string]bool
+		gate     string
+		expected bool
+	}{
+		{"default", nil, FeatureParallelInstall, false},
+		{"flag", nil, FeatureDrainBeforeUpgrade, true},
+		{"metadata over flag", map[string]bool{FeatureDriftHeal: true}, FeatureDriftHeal, true},
+		{"metadata over default", map[string]bool{FeatureParallelInstall: true}, FeatureParallelInstall, true},
+	}
+
+	for _, test := range tests {
+		enabled := NodeMetadata{FeatureGates: test.gates}.featureEnabled(test.gate)
+		if enabled != test.expected {
+			t.Errorf("%s: %s enabled = %v, expected %v", test.name, test.gate, enabled, test.expected)
+		}
+	}
+}
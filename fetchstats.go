@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+// fetchStatsFile stores the repository download statistics of the last install, reported by the controller
+var fetchStatsFile = filepath.Join(stateDir, "repo-fetch.json")
+
+// reportFetchStats logs and saves the repository download statistics, failing to save them is not an
+// error since they are only used for diagnostics
+func reportFetchStats(repoFS repo.RepoFS) {
+	stats := repoFS.FetchStats()
+	if stats.Files == 0 {
+		return
+	}
+	slog.Info("Repository files fetched", slog.String("mirror", stats.Mirror), slog.Int("files", stats.Files), slog.Int64("bytes", stats.Bytes), slog.Duration("duration", stats.Duration), slog.Int("retries", stats.Retries), slog.Int("cached", stats.Cached))
+
+	err := saveFetchStats(stats)
+	if err != nil {
+		slog.Warn("Failed to save repository fetch statistics", slog.Any("error", err))
+	}
+}
+
+func saveFetchStats(stats repo.FetchStats) error {
+	jsonStats, err := json.Marshal(stats)
+	if err != nil {
+		return fmt.Errorf("failed to marshal repository fetch statistics: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = os.WriteFile(hostPath(fetchStatsFile), jsonStats, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write repository fetch statistics: %w", err)
+	}
+
+	return nil
+}
+
+// loadFetchStats returns the repository download statistics of the last install, empty if none
+func loadFetchStats() (repo.FetchStats, error) {
+	jsonStats, err := os.ReadFile(hostPath(fetchStatsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return repo.FetchStats{}, nil
+	}
+	if err != nil {
+		return repo.FetchStats{}, fmt.Errorf("failed to read repository fetch statistics: %w", err)
+	}
+
+	var stats repo.FetchStats
+	err = json.Unmarshal(jsonStats, &stats)
+	if err != nil {
+		return repo.FetchStats{}, fmt.Errorf("failed to unmarshal repository fetch statistics: %w", err)
+	}
+
+	return stats, nil
+}
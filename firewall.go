@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ComponentFirewall declares the firewall openings required by a component (or by the node)
+//
+//	firewall:
+//	  state: present
+//	  rules:
+//	    - protocol: tcp
+//	      ports: "10250"
+//	    - protocol: tcp
+//	      ports: "30000-32767"
+//	    - protocol: tcp
+//	      ports: "179"
+//	      sources: [10.0.0.0/8]
+type ComponentFirewall struct {
+	State string         `yaml:"state" json:"state"` // present or absent
+	Rules []FirewallRule `yaml:"rules,omitempty" json:"rules,omitempty"`
+}
+
+type FirewallRule struct {
+	Protocol string   `yaml:"protocol" json:"protocol"` // tcp or udp
+	Ports    string   `yaml:"ports" json:"ports"`       // port or range, eg: "30000-32767"
+	Sources  []string `yaml:"sources,omitempty" json:"sources,omitempty"`
+}
+
+// The agent rules are integrated into the tables of the node firewall: an accept in a table of its own
+// would not override the drops of the other tables, since a packet must be accepted by all the base
+// chains of its hook. Each table with an input filter base chain gets an agent chain holding the rules
+// of all the owners (component or "node"), jumped to first from its input base chains. The rules are
+// stored in a state file, so all the agent chains can be rendered and applied atomically. Without any
+// input base chain, the input traffic is accepted and there is nothing to open.
+const firewallChainName = "scw_k8s_agent"
+
+var firewallStateFile = filepath.Join(stateDir, "firewall.json")
+
+var firewallPortsRegexp = regexp.MustCompile(`^[0-9]{1,5}(-[0-9]{1,5})?$`)
+
+// processFirewall applies or removes the firewall rules owned by a component (or "node")
+func processFirewall(logger *slog.Logger, owner string, firewall *ComponentFirewall) error {
+	if firewall == nil {
+		return nil
+	}
+
+	rules, err := loadFirewallRules()
+	if err != nil {
+		return err
+	}
+
+	switch firewall.State {
+	case "", "present":
+		for _, rule := range firewall.Rules {
+			err = rule.validate()
+			if err != nil {
+				return err
+			}
+		}
+		rules[owner] = firewall.Rules
+	case "absent":
+		delete(rules, owner)
+	default:
+		return fmt.Errorf("unknown firewall state: %s", firewall.State)
+	}
+
+	err = applyFirewallRules(rules)
+	if err != nil {
+		return err
+	}
+
+	err = saveFirewallRules(rules)
+	if err != nil {
+		return err
+	}
+	logger.Info("Firewall rules applied", slog.String("owner", owner), slog.Int("rules", len(firewall.Rules)))
+
+	return nil
+}
+
+func loadFirewallRules() (map[string][]FirewallRule, error) {
+	rules := make(map[string][]FirewallRule)
+
+	jsonRules, err := os.ReadFile(hostPath(firewallStateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read firewall rules: %w", err)
+	}
+
+	err = json.Unmarshal(jsonRules, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal firewall rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+func saveFirewallRules(rules map[string][]FirewallRule) error {
+	jsonRules, err := json.Marshal(rules)
+	if err != nil {
+		return fmt.Errorf("failed to marshal firewall rules: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = os.WriteFile(hostPath(firewallStateFile), jsonRules, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write firewall rules: %w", err)
+	}
+
+	return nil
+}
+
+// validate checks the rule before it is rendered in the nftables script
+func (r FirewallRule) validate() error {
+	if r.Protocol != "tcp" && r.Protocol != "udp" {
+		return fmt.Errorf("unknown firewall protocol: %s", r.Protocol)
+	}
+	if !firewallPortsRegexp.MatchString(r.Ports) {
+		return fmt.Errorf("invalid firewall ports %q, expected a port or a range", r.Ports)
+	}
+	for _, source := range r.Sources {
+		_, err := netip.ParsePrefix(source)
+		if err != nil {
+			_, err = netip.ParseAddr(source)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid firewall source %q: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// applyFirewallRules replaces atomically the agent chains with the given rules, the agent chains are
+// removed if there are no rules
+func applyFirewallRules(rules map[string][]FirewallRule) error {
+	ruleset, err := listFirewallRuleset()
+	if err != nil {
+		return err
+	}
+
+	cmd := command("/usr/sbin/nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(firewallScript(rules, ruleset))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to apply firewall rules: %w: %s", err, output)
+	}
+
+	return nil
+}
+
+// nftRuleset is the ruleset of the node, as listed by nft --json
+type nftRuleset struct {
+	Nftables []nftObject `json:"nftables"`
+}
+
+type nftObject struct {
+	Chain *nftChain `json:"chain,omitempty"`
+	Rule  *nftRule  `json:"rule,omitempty"`
+}
+
+type nftChain struct {
+	Family string `json:"family"`
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	Hook   string `json:"hook,omitempty"`
+}
+
+type nftRule struct {
+	Family  string                       `json:"family"`
+	Table   string                       `json:"table"`
+	Chain   string                       `json:"chain"`
+	Handle  int                          `json:"handle"`
+	Comment string                       `json:"comment,omitempty"`
+	Expr    []map[string]json.RawMessage `json:"expr"`
+}
+
+// nftTable identifies a table of the node firewall
+type nftTable struct {
+	Family string
+	Name   string
+}
+
+func (t nftTable) String() string {
+	return t.Family + " " + t.Name
+}
+
+// listFirewallRuleset returns the ruleset of the node, empty if nft lists nothing
+func listFirewallRuleset() (nftRuleset, error) {
+	cmd := command("/usr/sbin/nft", "--json", "list", "ruleset")
+	output, err := cmd.Output()
+	if err != nil {
+		return nftRuleset{}, fmt.Errorf("failed to list firewall ruleset: %w", err)
+	}
+	return parseFirewallRuleset(output)
+}
+
+func parseFirewallRuleset(output []byte) (nftRuleset, error) {
+	var ruleset nftRuleset
+	if len(strings.TrimSpace(string(output))) == 0 {
+		return ruleset, nil
+	}
+	err := json.Unmarshal(output, &ruleset)
+	if err != nil {
+		return nftRuleset{}, fmt.Errorf("failed to unmarshal firewall ruleset: %w", err)
+	}
+	return ruleset, nil
+}
+
+// inputChains returns the input filter base chains of the other tables, by table
+func (r nftRuleset) inputChains() map[nftTable][]string {
+	chains := make(map[nftTable][]string)
+	for _, object := range r.Nftables {
+		chain := object.Chain
+		if chain == nil || chain.Hook != "input" || chain.Type != "filter" {
+			continue
+		}
+		if chain.Family != "ip" && chain.Family != "ip6" && chain.Family != "inet" {
+			continue
+		}
+		table := nftTable{Family: chain.Family, Name: chain.Table}
+		chains[table] = append(chains[table], chain.Name)
+	}
+	return chains
+}
+
+// chainRules returns the rules of the chain, in order
+func (r nftRuleset) chainRules(table nftTable, chain string) []nftRule {
+	var rules []nftRule
+	for _, object := range r.Nftables {
+		if rule := object.Rule; rule != nil && rule.Family == table.Family && rule.Table == table.Name && rule.Chain == chain {
+			rules = append(rules, *rule)
+		}
+	}
+	return rules
+}
+
+// hasChain returns true if the table has the chain
+func (r nftRuleset) hasChain(table nftTable, name string) bool {
+	return slices.ContainsFunc(r.Nftables, func(object nftObject) bool {
+		return object.Chain != nil && object.Chain.Family == table.Family && object.Chain.Table == table.Name && object.Chain.Name == name
+	})
+}
+
+// String returns the rule in the nft syntax of firewallExpressions, only for the statements used by the
+// agent rules: the other rules are returned with an "unknown" statement so they never match
+func (r nftRule) String() string {
+	var statements []string
+	for _, expr := range r.Expr {
+		switch {
+		case expr["match"] != nil:
+			var match struct {
+				Op    string `json:"op"`
+				Left  map[string]json.RawMessage
+				Right json.RawMessage
+			}
+			if json.Unmarshal(expr["match"], &match) != nil || match.Op != "==" || match.Left["payload"] == nil {
+				// The implicit protocol dependencies are listed by some nft versions
+				if match.Left["meta"] != nil {
+					continue
+				}
+				statements = append(statements, "unknown")
+				continue
+			}
+			var payload struct {
+				Protocol string `json:"protocol"`
+				Field    string `json:"field"`
+			}
+			_ = json.Unmarshal(match.Left["payload"], &payload)
+			statements = append(statements, payload.Protocol+" "+payload.Field+" "+nftValue(match.Right))
+		case expr["jump"] != nil:
+			var jump struct {
+				Target string `json:"target"`
+			}
+			_ = json.Unmarshal(expr["jump"], &jump)
+			statements = append(statements, "jump "+jump.Target)
+		case expr["accept"] != nil:
+			statements = append(statements, "accept")
+		default:
+			statements = append(statements, "unknown")
+		}
+	}
+	return strings.Join(statements, " ")
+}
+
+// nftValue returns the value of a match: a number, a range or a prefix
+func nftValue(value json.RawMessage) string {
+	var number int
+	if json.Unmarshal(value, &number) == nil {
+		return strconv.Itoa(number)
+	}
+	var object struct {
+		Range  []int `json:"range"`
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+	}
+	if json.Unmarshal(value, &object) == nil {
+		switch {
+		case len(object.Range) == 2:
+			return fmt.Sprintf("%d-%d", object.Range[0], object.Range[1])
+		case object.Prefix != nil:
+			return fmt.Sprintf("%s/%d", object.Prefix.Addr, object.Prefix.Len)
+		}
+	}
+	var text string
+	if json.Unmarshal(value, &text) == nil {
+		return text
+	}
+	return "unknown"
+}
+
+// firewallTableRules returns the agent rules of the table family, by owner
+func firewallTableRules(rules map[string][]FirewallRule, family string) ([]string, map[string]string) {
+	var expressions []string
+	owners := make(map[string]string)
+	for _, owner := range slices.Sorted(maps.Keys(rules)) {
+		for _, rule := range rules[owner] {
+			for _, expression := range firewallExpressions(rule) {
+				if (family == "ip" && strings.HasPrefix(expression, "ip6 ")) || (family == "ip6" && strings.HasPrefix(expression, "ip ")) {
+					continue
+				}
+				expressions = append(expressions, expression)
+				owners[expression] = owner
+			}
+		}
+	}
+	return expressions, owners
+}
+
+// firewallScript renders the nftables script replacing the agent chains of the tables with an input
+// base chain
+func firewallScript(rules map[string][]FirewallRule, ruleset nftRuleset) string {
+	var script strings.Builder
+	inputChains := ruleset.inputChains()
+	for _, table := range slices.SortedFunc(maps.Keys(inputChains), func(a, b nftTable) int { return strings.Compare(a.String(), b.String()) }) {
+		// Remove the jumps which are not first, and all of them if there are no rules
+		for _, chain := range inputChains[table] {
+			for i, rule := range ruleset.chainRules(table, chain) {
+				if rule.String() == "jump "+firewallChainName && (i > 0 || len(rules) == 0) {
+					fmt.Fprintf(&script, "delete rule %s %s handle %d\n", table, chain, rule.Handle)
+				}
+			}
+		}
+		if len(rules) == 0 {
+			if ruleset.hasChain(table, firewallChainName) {
+				fmt.Fprintf(&script, "delete chain %s %s\n", table, firewallChainName)
+			}
+			continue
+		}
+
+		fmt.Fprintf(&script, "add chain %s %s\nflush chain %s %s\n", table, firewallChainName, table, firewallChainName)
+		expressions, owners := firewallTableRules(rules, table.Family)
+		for _, expression := range expressions {
+			fmt.Fprintf(&script, "add rule %s %s %s comment %q\n", table, firewallChainName, expression, owners[expression])
+		}
+		for _, chain := range inputChains[table] {
+			chainRules := ruleset.chainRules(table, chain)
+			if len(chainRules) == 0 || chainRules[0].String() != "jump "+firewallChainName {
+				fmt.Fprintf(&script, "insert rule %s %s jump %s\n", table, chain, firewallChainName)
+			}
+		}
+	}
+
+	return script.String()
+}
+
+// firewallExpressions returns the nftables rules of a firewall rule, one per source
+func firewallExpressions(rule FirewallRule) []string {
+	if len(rule.Sources) == 0 {
+		return []string{fmt.Sprintf("%s dport %s accept", rule.Protocol, rule.Ports)}
+	}
+
+	expressions := make([]string, 0, len(rule.Sources))
+	for _, source := range rule.Sources {
+		family := "ip"
+		if strings.Contains(source, ":") {
+			family = "ip6"
+		}
+		expressions = append(expressions, fmt.Sprintf("%s saddr %s %s dport %s accept", family, source, rule.Protocol, rule.Ports))
+	}
+	return expressions
+}
+
+// firewallDrift returns the differences between the agent rules and the agent chains of the ruleset
+func firewallDrift() ([]string, error) {
+	rules, err := loadFirewallRules()
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	ruleset, err := listFirewallRuleset()
+	if err != nil {
+		return nil, err
+	}
+
+	return rulesetDrift(rules, ruleset), nil
+}
+
+// rulesetDrift compares the agent rules with the rules of the agent chains, and checks the input base
+// chains jump to them first
+func rulesetDrift(rules map[string][]FirewallRule, ruleset nftRuleset) []string {
+	var drifts []string
+	for table, chains := range ruleset.inputChains() {
+		for _, chain := range chains {
+			chainRules := ruleset.chainRules(table, chain)
+			if len(chainRules) == 0 || chainRules[0].String() != "jump "+firewallChainName {
+				drifts = append(drifts, fmt.Sprintf("chain %s %s does not jump to the agent rules first", table, chain))
+			}
+		}
+
+		expected, owners := firewallTableRules(rules, table.Family)
+		var current []string
+		for _, rule := range ruleset.chainRules(table, firewallChainName) {
+			current = append(current, rule.String())
+		}
+		for _, expression := range expected {
+			if !slices.Contains(current, expression) {
+				drifts = append(drifts, fmt.Sprintf("rule %q of %s is missing in table %s", expression, owners[expression], table))
+			}
+		}
+		for _, expression := range current {
+			if !slices.Contains(expected, expression) {
+				drifts = append(drifts, fmt.Sprintf("rule %q is unexpected in table %s", expression, table))
+			}
+		}
+	}
+	sort.Strings(drifts)
+
+	return drifts
+}
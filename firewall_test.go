@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// firewallRulesetOutput is a node ruleset with an inet input chain dropping by default, where the jump
+// to the agent chain is not first and the agent chain has a stale rule
+const firewallRulesetOutput = `{"nftables": [
+{"metainfo": {"version": "1.0.9", "json_schema_version": 1}},
+{"table": {"family": "inet", "name": "filter", "handle": 1}},
+{"chain": {"family": "inet", "table": "filter", "name": "input", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "drop"}},
+{"chain": {"family": "inet", "table": "filter", "name": "scw_k8s_agent", "handle": 2}},
+{"chain": {"family": "ip", "table": "nat", "name": "prerouting", "handle": 1, "type": "nat", "hook": "prerouting", "prio": -100, "policy": "accept"}},
+{"rule": {"family": "inet", "table": "filter", "chain": "input", "handle": 3, "expr": [{"match": {"op": "==", "left": {"ct": {"key": "state"}}, "right": ["established", "related"]}}, {"accept": null}]}},
+{"rule": {"family": "inet", "table": "filter", "chain": "input", "handle": 4, "expr": [{"jump": {"target": "scw_k8s_agent"}}]}},
+{"rule": {"family": "inet", "table": "filter", "chain": "scw_k8s_agent", "handle": 5, "comment": "kubelet", "expr": [{"match": {"op": "==", "left": {"meta": {"key": "l4proto"}}, "right": "tcp"}}, {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 10250}}, {"accept": null}]}},
+{"rule": {"family": "inet", "table": "filter", "chain": "scw_k8s_agent", "handle": 6, "comment": "node", "expr": [{"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "saddr"}}, "right": {"prefix": {"addr": "10.0.0.0", "len": 8}}}}, {"match": {"op": "==", "left": {"payload": {"protocol": "udp", "field": "dport"}}, "right": {"range": [30000, 32767]}}}, {"accept": null}]}},
+{"rule": {"family": "inet", "table": "filter", "chain": "scw_k8s_agent", "handle": 7, "comment": "node", "expr": [{"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": 22}}, {"accept": null}]}}
+]}`
+
+var firewallTestRules = map[string][]FirewallRule{
+	"kubelet": {{Protocol: "tcp", Ports: "10250"}},
+	"node":    {{Protocol: "udp", Ports: "30000-32767", Sources: []string{"10.0.0.0/8", "fd00::/8"}}},
+}
+
+func TestFirewallRuleString(t *testing.T) {
+	ruleset, err := parseFirewallRuleset([]byte(firewallRulesetOutput))
+	if err != nil {
+		t.Fatalf("failed to parse ruleset: %v", err)
+	}
+
+	table := nftTable{Family: "inet", Name: "filter"}
+	var rules []string
+	for _, rule := range ruleset.chainRules(table, "input") {
+		rules = append(rules, rule.String())
+	}
+	for _, rule := range ruleset.chainRules(table, firewallChainName) {
+		rules = append(rules, rule.String())
+	}
+
+	// The implicit protocol matches are ignored, the other statements never match an agent rule
+	expected := []string{
+		"unknown accept",
+		"jump scw_k8s_agent",
+		"tcp dport 10250 accept",
+		"ip saddr 10.0.0.0/8 udp dport 30000-32767 accept",
+		"tcp dport 22 accept",
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("rules = %q, expected %q", rules, expected)
+	}
+}
+
+func TestFirewallDrift(t *testing.T) {
+	ruleset, err := parseFirewallRuleset([]byte(firewallRulesetOutput))
+	if err != nil {
+		t.Fatalf("failed to parse ruleset: %v", err)
+	}
+
+	// The nat chain is not an input filter chain and is ignored
+	drifts := rulesetDrift(firewallTestRules, ruleset)
+	expected := []string{
+		"chain inet filter input does not jump to the agent rules first",
+		`rule "ip6 saddr fd00::/8 udp dport 30000-32767 accept" of node is missing in table inet filter`,
+		`rule "tcp dport 22 accept" is unexpected in table inet filter`,
+	}
+	if !reflect.DeepEqual(drifts, expected) {
+		t.Errorf("drifts = %q, expected %q", drifts, expected)
+	}
+
+	// Without an input filter chain, the input traffic is accepted
+	drifts = rulesetDrift(firewallTestRules, nftRuleset{})
+	if len(drifts) != 0 {
+		t.Errorf("expected no drift without input chain, got %q", drifts)
+	}
+}
+
+func TestFirewallScript(t *testing.T) {
+	ruleset, err := parseFirewallRuleset([]byte(firewallRulesetOutput))
+	if err != nil {
+		t.Fatalf("failed to parse ruleset: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		rules    map[string][]FirewallRule
+		expected string
+	}{
+		{
+			name:  "rules",
+			rules: firewallTestRules,
+			expected: `delete rule inet filter input handle 4
+add chain inet filter scw_k8s_agent
+flush chain inet filter scw_k8s_agent
+add rule inet filter scw_k8s_agent tcp dport 10250 accept comment "kubelet"
+add rule inet filter scw_k8s_agent ip saddr 10.0.0.0/8 udp dport 30000-32767 accept comment "node"
+add rule inet filter scw_k8s_agent ip6 saddr fd00::/8 udp dport 30000-32767 accept comment "node"
+insert rule inet filter input jump scw_k8s_agent
+`,
+		},
+		{
+			name: "no rules",
+			expected: `delete rule inet filter input handle 4
+delete chain inet filter scw_k8s_agent
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script := firewallScript(test.rules, ruleset)
+			if script != test.expected {
+				t.Errorf("script = %s, expected %s", script, test.expected)
+			}
+		})
+	}
+}
+
+func TestFirewallRuleValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule FirewallRule
+		err  string
+	}{
+		{name: "port", rule: FirewallRule{Protocol: "tcp", Ports: "22"}},
+		{name: "range and sources", rule: FirewallRule{Protocol: "udp", Ports: "30000-32767", Sources: []string{"10.0.0.1", "fd00::/8"}}},
+		{name: "unknown protocol", rule: FirewallRule{Protocol: "icmp", Ports: "22"}, err: "unknown firewall protocol"},
+		{name: "injected ports", rule: FirewallRule{Protocol: "tcp", Ports: "22 accept; flush ruleset"}, err: "invalid firewall ports"},
+		{name: "invalid source", rule: FirewallRule{Protocol: "tcp", Ports: "22", Sources: []string{"0.0.0.0/0 accept"}}, err: "invalid firewall source"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.rule.validate()
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
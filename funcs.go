@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// forbiddenTemplateFunctions are the sprig functions never available in templates,
+// since templates come from a remote repository they must not read the agent environment or the network
+var forbiddenTemplateFunctions = []string{
+	"env",
+	"expandenv",
+	"getHostByName",
+}
+
+// templateFuncMap returns the sprig and structured configuration functions available in templates,
+// restricted to the allowlist if not empty
+func templateFuncMap(allowlist []string) (template.FuncMap, error) {
+	funcs := sprig.TxtFuncMap()
+	for _, name := range forbiddenTemplateFunctions {
+		delete(funcs, name)
+	}
+	maps.Copy(funcs, structuredTemplateFunctions)
+	maps.Copy(funcs, componentTemplateFunctions)
+
+	if len(allowlist) == 0 {
+		return funcs, nil
+	}
+
+	allowed := template.FuncMap{}
+	for _, name := range allowlist {
+		fn, ok := funcs[name]
+		if !ok {
+			return nil, fmt.Errorf("template function %q is unknown or forbidden", name)
+		}
+		allowed[name] = fn
+	}
+
+	return allowed, nil
+}
+
+// errNoComponentDirectory is returned by the functions reading the component directory when not bound to it
+var errNoComponentDirectory = errors.New("no component directory")
+
+// componentTemplateFunctions are the template functions reading the component directory, bound to it by
+// withComponentFuncs, so they are subject to the allowlist like the other functions
+var componentTemplateFunctions = map[string]any{
+	"loadConfig": func(string) (map[string]any, error) { return nil, errNoComponentDirectory },
+	"include":    func(string, any) (string, error) { return "", errNoComponentDirectory },
+}
+
+// maxIncludeDepth limits the nested partials, eg: a partial including itself
+const maxIncludeDepth = 10
+
+// withComponentFuncs returns the template functions with the ones reading the component directory, if
+// allowed: include renders a partial with the data, eg: {{ include "partials/registry.tmpl" . }}, and
+// loadConfig loads a YAML or JSON configuration, eg: {{ loadConfig "config.yaml" | toToml }}
+func withComponentFuncs(componentFS fs.FS, funcs template.FuncMap) template.FuncMap {
+	included := maps.Clone(funcs)
+	if _, ok := funcs["loadConfig"]; ok {
+		included["loadConfig"] = func(name string) (map[string]any, error) {
+			return loadConfig(componentFS, name)
+		}
+	}
+	if _, ok := funcs["include"]; !ok {
+		return included
+	}
+	depth := 0
+	included["include"] = func(name string, data any) (string, error) {
+		if !fs.ValidPath(name) {
+			return "", fmt.Errorf("invalid partial path %q, expected a path in the component directory", name)
+		}
+		if depth >= maxIncludeDepth {
+			return "", fmt.Errorf("failed to include partial %s: more than %d nested includes", name, maxIncludeDepth)
+		}
+		partial, err := fs.ReadFile(componentFS, name)
+		if err != nil {
+			return "", fmt.Errorf("failed to read partial: %w", err)
+		}
+		tmpl, err := template.New(name).Funcs(included).Parse(string(partial))
+		if err != nil {
+			return "", fmt.Errorf("failed to parse partial: %w", err)
+		}
+
+		depth++
+		defer func() { depth-- }()
+		var rendered strings.Builder
+		err = tmpl.Execute(&rendered, data)
+		if err != nil {
+			return "", fmt.Errorf("failed to render partial: %w", err)
+		}
+		return rendered.String(), nil
+	}
+	return included
+}
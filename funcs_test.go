@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+)
+
+func TestTemplateInclude(t *testing.T) {
+	componentFS := fstest.MapFS{
+		"config.toml.tmpl":          {Data: []byte(`version = 3{{ include "partials/registry.tmpl" . }}`)},
+		"partials/registry.tmpl":    {Data: []byte(`{{ range .Mirrors }}{{ include "partials/mirror.tmpl" . }}{{ end }}`)},
+		"partials/mirror.tmpl":      {Data: []byte("\n[mirror]\nendpoint = {{ . | quote }}")},
+		"partials/recursive.tmpl":   {Data: []byte(`{{ include "partials/recursive.tmpl" . }}`)},
+		"partials/undefined.tmpl":   {Data: []byte(`{{ undefinedFunction }}`)},
+		"partials/missing-key.tmpl": {Data: []byte(`{{ .Missing }}`)},
+	}
+	funcs, err := templateFuncMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+		err      string
+	}{
+		{
+			name:     "nested partials",
+			template: `{{ include "config.toml.tmpl" . }}`,
+			expected: "version = 3\n[mirror]\nendpoint = \"https://a\"\n[mirror]\nendpoint = \"https://b\"",
+		},
+		{name: "recursive", template: `{{ include "partials/recursive.tmpl" . }}`, err: "more than 10 nested includes"},
+		{name: "outside the component", template: `{{ include "../other/partial.tmpl" . }}`, err: "invalid partial path"},
+		{name: "missing", template: `{{ include "partials/missing.tmpl" . }}`, err: "failed to read partial"},
+		{name: "invalid", template: `{{ include "partials/undefined.tmpl" . }}`, err: "failed to parse partial"},
+		{name: "render failure", template: `{{ include "partials/missing-key.tmpl" . }}`, err: "failed to render partial"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl, err := template.New("tmpl").Funcs(withComponentFuncs(componentFS, funcs)).Parse(test.template)
+			if err != nil {
+				t.Fatalf("failed to parse template: %v", err)
+			}
+			var rendered strings.Builder
+			err = tmpl.Execute(&rendered, struct{ Mirrors []string }{Mirrors: []string{"https://a", "https://b"}})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rendered.String() != test.expected {
+				t.Errorf("rendered %q, expected %q", rendered.String(), test.expected)
+			}
+		})
+	}
+}
+
+func TestComponentFuncsAllowlist(t *testing.T) {
+	componentFS := fstest.MapFS{
+		"config.yaml":  {Data: []byte("version: 2\n")},
+		"partial.tmpl": {Data: []byte("partial")},
+	}
+
+	// The functions reading the component directory are only available if allowed
+	tests := []struct {
+		name      string
+		allowlist []string
+		template  string
+		expected  string
+		err       string
+	}{
+		{name: "include allowed", allowlist: []string{"include"}, template: `{{ include "partial.tmpl" . }}`, expected: "partial"},
+		{name: "include not allowed", allowlist: []string{"quote"}, template: `{{ include "partial.tmpl" . }}`, err: `function "include" not defined`},
+		{name: "loadConfig allowed", allowlist: []string{"loadConfig", "toToml"}, template: `{{ loadConfig "config.yaml" | toToml }}`, expected: "version = 2"},
+		{name: "loadConfig not allowed", allowlist: []string{"toToml"}, template: `{{ loadConfig "config.yaml" | toToml }}`, err: `function "loadConfig" not defined`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			funcs, err := templateFuncMap(test.allowlist)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tmpl, err := template.New("tmpl").Funcs(withComponentFuncs(componentFS, funcs)).Parse(test.template)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse template: %v", err)
+			}
+			var rendered strings.Builder
+			err = tmpl.Execute(&rendered, nil)
+			if err != nil || rendered.String() != test.expected {
+				t.Errorf("rendered %q, expected %q, got %v", rendered.String(), test.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GPU configures the NVIDIA GPUs of the pool nodes
+//
+//	"gpu": {
+//	   "driver_branch": "550",
+//	   "mig_profile": "3g.40gb,3g.40gb"
+//	}
+type GPU struct {
+	// NVIDIA driver branch, the latest driver of the branch is installed instead of the release one
+	DriverBranch string `json:"driver_branch,omitempty"`
+
+	// MIG GPU instance profiles created on every GPU (nvidia-smi mig -cgi), MIG is disabled if empty
+	MIGProfile string `json:"mig_profile,omitempty"`
+}
+
+// nvidiaDriverComponent is the component installing the NVIDIA driver
+const nvidiaDriverComponent = "nvidia-driver"
+
+// gpuModel is the compatibility of a GPU model, matched on the nvidia-smi name
+type gpuModel struct {
+	Name            string
+	MinDriverBranch int
+	MIG             bool
+}
+
+// gpuModels are the GPU models of the instances, the more specific names first
+var gpuModels = []gpuModel{
+	{Name: "H200", MinDriverBranch: 550, MIG: true},
+	{Name: "H100", MinDriverBranch: 525, MIG: true},
+	{Name: "A100", MinDriverBranch: 450, MIG: true},
+	{Name: "A30", MinDriverBranch: 450, MIG: true},
+	{Name: "L40S", MinDriverBranch: 525},
+	{Name: "L4", MinDriverBranch: 525},
+	{Name: "RTX 3070", MinDriverBranch: 455},
+	{Name: "P100", MinDriverBranch: 375},
+}
+
+var migProfileRegexp = regexp.MustCompile(`^[0-9]+g\.[0-9]+gb(\+me)?$`)
+
+// gpuMIGFile stores the MIG profile applied, so it is only applied once
+var gpuMIGFile = filepath.Join(stateDir, "gpu-mig.json")
+
+// Validate checks the driver branch and MIG profile syntax
+func (g GPU) Validate() error {
+	if g.DriverBranch != "" {
+		_, err := strconv.Atoi(g.DriverBranch)
+		if err != nil {
+			return fmt.Errorf("invalid driver branch %q, expected a major version, eg: 550", g.DriverBranch)
+		}
+	}
+
+	if g.MIGProfile != "" {
+		for _, profile := range strings.Split(g.MIGProfile, ",") {
+			if !migProfileRegexp.MatchString(profile) {
+				return fmt.Errorf("invalid MIG profile %q, expected GPU instance profiles, eg: 3g.40gb,3g.40gb", g.MIGProfile)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyGPUDriverBranch selects the latest driver of the metadata branch, unless the driver version is overridden
+func applyGPUDriverBranch(components []Component, nodemetadata NodeMetadata) ([]Component, error) {
+	if nodemetadata.GPU == nil || nodemetadata.GPU.DriverBranch == "" || nodemetadata.ComponentOverrides[nvidiaDriverComponent].Version != "" {
+		return components, nil
+	}
+
+	err := nodemetadata.GPU.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, component := range components {
+		if component.Name != nvidiaDriverComponent {
+			continue
+		}
+		slog.Info("NVIDIA driver branch selected", slog.String("branch", nodemetadata.GPU.DriverBranch), slog.String("release_version", component.Version))
+		components[i].Version = nodemetadata.GPU.DriverBranch + ".x"
+		components[i].Source = nil
+	}
+
+	return components, nil
+}
+
+// lookupGPUModel returns the compatibility of the GPU model, nil if the model is unknown
+func lookupGPUModel(name string) *gpuModel {
+	for _, model := range gpuModels {
+		if strings.Contains(name, model.Name) {
+			return &model
+		}
+	}
+	return nil
+}
+
+// nvidiaGPU is a GPU listed by nvidia-smi
+type nvidiaGPU struct {
+	Name          string
+	DriverVersion string
+	MIGMode       string // Enabled, Disabled or [N/A] if not supported
+}
+
+// listNvidiaGPUs lists the GPUs with nvidia-smi, the driver must be installed
+func listNvidiaGPUs() ([]nvidiaGPU, error) {
+	cmd := command("/usr/bin/nvidia-smi", "--query-gpu=name,driver_version,mig.mode.current", "--format=csv,noheader")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list GPUs: %w", err)
+	}
+
+	var gpus []nvidiaGPU
+	for line := range strings.Lines(string(output)) {
+		fields := strings.Split(strings.TrimSpace(line), ", ")
+		if len(fields) != 3 {
+			continue
+		}
+		gpus = append(gpus, nvidiaGPU{Name: fields[0], DriverVersion: fields[1], MIGMode: fields[2]})
+	}
+
+	return gpus, nil
+}
+
+// checkGPUCompatibility checks the GPUs support the installed driver and the MIG profile
+func checkGPUCompatibility(gpus []nvidiaGPU, gpu GPU) error {
+	if len(gpus) == 0 {
+		return errors.New("no NVIDIA GPU found")
+	}
+
+	var errs []error
+	for _, found := range gpus {
+		branch, _, _ := strings.Cut(found.DriverVersion, ".")
+		if gpu.DriverBranch != "" && branch != gpu.DriverBranch {
+			errs = append(errs, fmt.Errorf("GPU %s: driver %s installed instead of branch %s", found.Name, found.DriverVersion, gpu.DriverBranch))
+		}
+
+		model := lookupGPUModel(found.Name)
+		if model == nil {
+			slog.Warn("Unknown GPU model, compatibility not checked", slog.String("gpu", found.Name))
+			continue
+		}
+		if branchNumber, err := strconv.Atoi(branch); err == nil && branchNumber < model.MinDriverBranch {
+			errs = append(errs, fmt.Errorf("GPU %s requires a driver branch %d or newer, got %s", found.Name, model.MinDriverBranch, found.DriverVersion))
+		}
+		if gpu.MIGProfile != "" && !model.MIG {
+			errs = append(errs, fmt.Errorf("GPU %s does not support MIG", found.Name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// configureGPU checks the GPUs compatibility and applies the MIG profile once the driver is installed.
+// The MIG configuration is only applied when the profile changes or the GPU instances are lost, eg: after
+// a reboot, and disabled when the profile is removed.
+func configureGPU(gpu *GPU) error {
+	appliedProfile, err := loadMIGProfile()
+	if err != nil {
+		return err
+	}
+	if gpu == nil {
+		if appliedProfile == "" {
+			return nil
+		}
+		gpu = &GPU{}
+	}
+
+	err = gpu.Validate()
+	if err != nil {
+		return err
+	}
+
+	gpus, err := listNvidiaGPUs()
+	if err != nil {
+		return err
+	}
+	err = checkGPUCompatibility(gpus, *gpu)
+	if err != nil {
+		return err
+	}
+
+	if gpu.MIGProfile == appliedProfile {
+		if gpu.MIGProfile == "" || migConfigured(gpus, migInstancesExist()) {
+			return nil
+		}
+		slog.Info("MIG instances not found, applying the MIG profile again", slog.String("profile", gpu.MIGProfile))
+	}
+
+	// Destroy the existing instances, the command fails if there is none
+	_ = command("/usr/bin/nvidia-smi", "mig", "-dci").Run()
+	_ = command("/usr/bin/nvidia-smi", "mig", "-dgi").Run()
+
+	if gpu.MIGProfile == "" {
+		cmd := command("/usr/bin/nvidia-smi", "-mig", "0")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to disable MIG: %w: %s", err, output)
+		}
+		slog.Info("MIG disabled")
+		return saveMIGProfile("")
+	}
+
+	cmd := command("/usr/bin/nvidia-smi", "-mig", "1")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to enable MIG: %w: %s", err, output)
+	}
+
+	cmd = command("/usr/bin/nvidia-smi", "mig", "-cgi", gpu.MIGProfile, "-C")
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create MIG instances %s: %w: %s", gpu.MIGProfile, err, output)
+	}
+	slog.Info("MIG profile applied", slog.String("profile", gpu.MIGProfile))
+
+	return saveMIGProfile(gpu.MIGProfile)
+}
+
+// migInstancesExist returns true if GPU instances are created, nvidia-smi fails if there is none
+func migInstancesExist() bool {
+	return command("/usr/bin/nvidia-smi", "mig", "-lgi").Run() == nil
+}
+
+// migConfigured returns true if MIG is enabled on all the GPUs with their instances created. The MIG
+// mode survives a reboot, but not the instances.
+func migConfigured(gpus []nvidiaGPU, instancesExist bool) bool {
+	if !instancesExist {
+		return false
+	}
+	for _, gpu := range gpus {
+		if gpu.MIGMode != "Enabled" {
+			return false
+		}
+	}
+	return true
+}
+
+func loadMIGProfile() (string, error) {
+	var applied struct {
+		Profile string `json:"profile"`
+	}
+
+	jsonApplied, err := os.ReadFile(hostPath(gpuMIGFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read MIG profile: %w", err)
+	}
+
+	err = json.Unmarshal(jsonApplied, &applied)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal MIG profile: %w", err)
+	}
+
+	return applied.Profile, nil
+}
+
+func saveMIGProfile(profile string) error {
+	if profile == "" {
+		err := os.Remove(hostPath(gpuMIGFile))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove MIG profile: %w", err)
+		}
+		return nil
+	}
+
+	jsonApplied, err := json.Marshal(map[string]string{"profile": profile})
+	if err != nil {
+		return fmt.Errorf("failed to marshal MIG profile: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = os.WriteFile(hostPath(gpuMIGFile), jsonApplied, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write MIG profile: %w", err)
+	}
+
+	return nil
+}
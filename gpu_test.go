@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckGPUCompatibility(t *testing.T) {
+	tests := []struct {
+		name     string
+		gpus     []nvidiaGPU
+		gpu      GPU
+		expected string
+	}{
+		{
+			name: "compatible",
+			gpus: []nvidiaGPU{{Name: "NVIDIA H100 PCIe", DriverVersion: "550.127.05", MIGMode: "Disabled"}},
+			gpu:  GPU{DriverBranch: "550", MIGProfile: "3g.40gb,3g.40gb"},
+		},
+		{
+			name:     "no GPU",
+			gpu:      GPU{DriverBranch: "550"},
+			expected: "no NVIDIA GPU found",
+		},
+		{
+			name:     "other branch installed",
+			gpus:     []nvidiaGPU{{Name: "NVIDIA L4", DriverVersion: "535.183.01", MIGMode: "[N/A]"}},
+			gpu:      GPU{DriverBranch: "550"},
+			expected: "GPU NVIDIA L4: driver 535.183.01 installed instead of branch 550",
+		},
+		{
+			name:     "driver too old",
+			gpus:     []nvidiaGPU{{Name: "NVIDIA L40S", DriverVersion: "470.256.02", MIGMode: "[N/A]"}},
+			expected: "GPU NVIDIA L40S requires a driver branch 525 or newer, got 470.256.02",
+		},
+		{
+			name:     "MIG not supported",
+			gpus:     []nvidiaGPU{{Name: "NVIDIA L40S", DriverVersion: "550.127.05", MIGMode: "[N/A]"}},
+			gpu:      GPU{MIGProfile: "1g.10gb"},
+			expected: "GPU NVIDIA L40S does not support MIG",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkGPUCompatibility(test.gpus, test.gpu)
+			if test.expected == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("expected error %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestGPUValidate(t *testing.T) {
+	tests := []struct {
+		gpu   GPU
+		valid bool
+	}{
+		{GPU{DriverBranch: "550", MIGProfile: "1g.10gb,2g.20gb,3g.40gb+me"}, true},
+		{GPU{DriverBranch: "550.127"}, false},
+		{GPU{MIGProfile: "all-1g.10gb"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.gpu.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: error = %v, valid %v", test.gpu, err, test.valid)
+		}
+	}
+}
+
+func TestMIGConfigured(t *testing.T) {
+	enabled := nvidiaGPU{Name: "NVIDIA H100 PCIe", DriverVersion: "550.127.05", MIGMode: "Enabled"}
+	disabled := nvidiaGPU{Name: "NVIDIA H100 PCIe", DriverVersion: "550.127.05", MIGMode: "Disabled"}
+	tests := []struct {
+		name           string
+		gpus           []nvidiaGPU
+		instancesExist bool
+		expected       bool
+	}{
+		{name: "configured", gpus: []nvidiaGPU{enabled, enabled}, instancesExist: true, expected: true},
+		{name: "instances lost after reboot", gpus: []nvidiaGPU{enabled, enabled}},
+		{name: "MIG disabled on a GPU", gpus: []nvidiaGPU{enabled, disabled}, instancesExist: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if configured := migConfigured(test.gpus, test.instancesExist); configured != test.expected {
+				t.Errorf("migConfigured() = %v, expected %v", configured, test.expected)
+			}
+		})
+	}
+}
+
+func TestConfigureGPUWithoutProfile(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	// Nothing is done without GPU configuration, nvidia-smi is not even run
+	err := configureGPU(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(hostPath(commandsLog))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no command run, got %v", err)
+	}
+
+	// A removed profile disables MIG, the GPUs are listed first
+	err = saveMIGProfile("3g.40gb,3g.40gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = configureGPU(nil)
+	if err == nil || !strings.Contains(err.Error(), "no NVIDIA GPU found") {
+		t.Errorf("expected the GPUs listed, got %v", err)
+	}
+}
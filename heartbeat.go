@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// HeartbeatEndpoint is the control plane endpoint the controller posts its heartbeat to, so the dead
+// agents are detected on the nodes whose kubelet still reports Ready
+//
+//	"heartbeat": {
+//	   "url": "https://k8s.example.com/nodes/heartbeat",
+//	   "interval": "1m"
+//	}
+type HeartbeatEndpoint struct {
+	URL      string `json:"url"`
+	Interval string `json:"interval,omitempty"` // 1m if empty
+}
+
+const defaultHeartbeatInterval = time.Minute
+
+// heartbeat is the document posted to the heartbeat endpoint
+type heartbeat struct {
+	NodeID        string            `json:"node_id"`
+	NodeName      string            `json:"node_name"`
+	AgentVersion  string            `json:"agent_version"`
+	Components    map[string]string `json:"components"`
+	Healthy       bool              `json:"healthy"` // The reconcile loop is alive and the last reconcile succeeded
+	Reconciling   bool              `json:"reconciling"`
+	LastReconcile time.Time         `json:"last_reconcile"`
+	LastError     string            `json:"last_error,omitempty"`
+	SentAt        time.Time         `json:"sent_at"`
+}
+
+// interval returns the heartbeat interval, with its default
+func (h HeartbeatEndpoint) interval() (time.Duration, error) {
+	if h.Interval == "" {
+		return defaultHeartbeatInterval, nil
+	}
+	interval, err := time.ParseDuration(h.Interval)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid heartbeat interval %q", h.Interval)
+	}
+	return interval, nil
+}
+
+// runHeartbeat posts the heartbeat at every interval until the context is done. The endpoint is read
+// from the node metadata before every heartbeat, since the reconcile loop replaces it on upgrades, the
+// metadata is checked again at the default interval while no endpoint is set.
+func (c *Controller) runHeartbeat(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		timer.Reset(c.heartbeat())
+	}
+}
+
+// heartbeat sends the heartbeat to the endpoint of the node metadata if any, it returns the delay
+// before the next one
+func (c *Controller) heartbeat() time.Duration {
+	nodeMetadata := c.metadata()
+	if nodeMetadata.Heartbeat == nil {
+		return defaultHeartbeatInterval
+	}
+
+	interval, err := nodeMetadata.Heartbeat.interval()
+	if err != nil {
+		c.logger.Warn("Heartbeat disabled", slog.Any("error", err))
+		return defaultHeartbeatInterval
+	}
+
+	err = c.sendHeartbeat(nodeMetadata.Heartbeat.URL, nodeMetadata.ID, nodeMetadata.Token)
+	if err != nil {
+		c.logger.Warn("Failed to send heartbeat", slog.Any("error", err))
+	}
+
+	return interval
+}
+
+// buildHeartbeat returns the heartbeat of the controller
+func (c *Controller) buildHeartbeat(nodeID string) (heartbeat, error) {
+	versions, err := ListComponentsVersions()
+	if err != nil {
+		return heartbeat{}, fmt.Errorf("failed to list components versions: %w", err)
+	}
+
+	beat := heartbeat{
+		NodeID:        nodeID,
+		NodeName:      c.nodeName,
+		AgentVersion:  Version,
+		Components:    versions,
+		Reconciling:   c.reconciling.Load(),
+		LastReconcile: time.Unix(0, c.lastReconcile.Load()).UTC(),
+		SentAt:        time.Now().UTC(),
+	}
+	if lastError := c.lastSyncError.Load(); lastError != nil {
+		beat.LastError = *lastError
+	}
+	beat.Healthy = beat.LastError == "" && (beat.Reconciling || time.Since(beat.LastReconcile) <= watchdogStaleAfter)
+
+	return beat, nil
+}
+
+func (c *Controller) sendHeartbeat(url, nodeID, token string) error {
+	beat, err := c.buildHeartbeat(nodeID)
+	if err != nil {
+		return err
+	}
+
+	jsonBeat, err := json.Marshal(beat)
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %w", err)
+	}
+
+	return postJSON(url, token, jsonBeat)
+}
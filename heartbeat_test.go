@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBuildHeartbeat(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	failed := "failed to sync holds"
+	tests := []struct {
+		name          string
+		lastReconcile time.Time
+		lastError     *string
+		healthy       bool
+	}{
+		{"reconciled", time.Now(), nil, true},
+		{"stale", time.Now().Add(-2 * watchdogStaleAfter), nil, false},
+		{"failed", time.Now(), &failed, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Controller{nodeName: "node"}
+			c.lastReconcile.Store(test.lastReconcile.UnixNano())
+			c.lastSyncError.Store(test.lastError)
+
+			beat, err := c.buildHeartbeat("id")
+			if err != nil {
+				t.Fatalf("failed to build heartbeat: %v", err)
+			}
+			if beat.Healthy != test.healthy {
+				t.Errorf("healthy = %v, expected %v", beat.Healthy, test.healthy)
+			}
+		})
+	}
+}
+
+func TestHeartbeatMetadataRefresh(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	var posts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Token") == "token-2" {
+			posts.Add(1)
+		}
+	}))
+	defer server.Close()
+
+	// No heartbeat is sent until the node metadata sets an endpoint
+	c := &Controller{nodeName: "node", logger: slog.Default()}
+	if delay := c.heartbeat(); delay != defaultHeartbeatInterval || posts.Load() != 0 {
+		t.Fatalf("expected no heartbeat, got %d after %s", posts.Load(), delay)
+	}
+
+	// The endpoint and token of the metadata replaced by an upgrade are used
+	c.setMetadata(NodeMetadata{ID: "id", Token: "token-2", Heartbeat: &HeartbeatEndpoint{URL: server.URL, Interval: "30s"}})
+	if delay := c.heartbeat(); delay != 30*time.Second || posts.Load() != 1 {
+		t.Errorf("expected a heartbeat with the new token, got %d after %s", posts.Load(), delay)
+	}
+}
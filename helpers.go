@@ -1,116 +1,305 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"text/template"
-
-	"github.com/Masterminds/sprig/v3"
 )
 
-func writeFile(cacheFS fs.FS, name, src, dst, mode, owner, group string) (string, error) {
-	parsedMode, err := strconv.ParseUint(mode, 8, 32)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse mode: %w", err)
+// destinationPath returns the destination file path, if the destination is a directory
+// the base name of the source file is used
+func destinationPath(src, dst string) string {
+	if strings.HasSuffix(dst, "/") {
+		return dst + filepath.Base(src)
 	}
+	return dst
+}
 
-	srcFile, err := fs.ReadFile(cacheFS, fmt.Sprintf("%s/%s", name, src))
+// writeFile copies the source file of the component filesystem to the destination
+func writeFile(componentFS fs.FS, src, dst, mode, owner, group string, header bool) (string, error) {
+	content, err := fs.ReadFile(componentFS, src)
 	if err != nil {
 		return "", fmt.Errorf("failed to open src file: %w", err)
 	}
 
 	// If the destination is a directory, use the base name of the source file
 	// if not, use the name of the destination file
-	if strings.HasSuffix(dst, "/") {
-		dst = dst + filepath.Base(src)
+	dst = destinationPath(src, dst)
+
+	// Prepend the managed header if requested
+	if header {
+		content, err = addManagedHeader(dst, content)
+		if err != nil {
+			return "", fmt.Errorf("failed to add managed header: %w", err)
+		}
 	}
 
-	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(parsedMode))
+	// The path is also returned on chown error, so the chown can be deferred
+	err = installContent(dst, content, mode, owner, group)
 	if err != nil {
-		return "", fmt.Errorf("failed to open dst file: %w", err)
+		return dst, err
 	}
 
-	_, err = dstFile.Write(srcFile)
+	return dst, nil
+}
+
+// templateFile renders the source template of the component filesystem to the destination
+func templateFile(componentFS fs.FS, src, dst, mode, owner, group string, header bool, funcs template.FuncMap, metadata NodeMetadata) (string, error) {
+	srcFile, err := fs.ReadFile(componentFS, src)
 	if err != nil {
-		return "", fmt.Errorf("failed to write file: %w", err)
+		return "", fmt.Errorf("failed to open src file: %w", err)
 	}
 
-	err = dstFile.Close()
+	tmpl, err := template.New("tmpl").Funcs(withComponentFuncs(componentFS, funcs)).Parse(string(srcFile))
 	if err != nil {
-		return "", fmt.Errorf("failed to close dst file: %w", err)
+		return "", fmt.Errorf("failed to parse template: %w", err)
 	}
 
-	err = chown(dst, owner, group)
+	var rendered strings.Builder
+	err = tmpl.Execute(&rendered, metadata)
 	if err != nil {
-		return "", fmt.Errorf("failed to chown file: %w", err)
+		return "", fmt.Errorf("failed to render template: %w", err)
+	}
+	content := []byte(rendered.String())
+
+	// If the destination is a directory, use the base name of the source file
+	// if not, use the name of the destination file
+	dst = destinationPath(src, dst)
+
+	// Prepend the managed header if requested
+	if header {
+		content, err = addManagedHeader(dst, content)
+		if err != nil {
+			return "", fmt.Errorf("failed to add managed header: %w", err)
+		}
+	}
+
+	// Record what the render changes in the existing file, the install is not failed without it
+	diffErr := recordTemplateDiff(dst, content, metadata.secrets()...)
+	if diffErr != nil {
+		slog.Warn("Failed to record template diff", slog.String("template", dst), slog.Any("error", diffErr))
+	}
+
+	// The path is also returned on chown error, so the chown can be deferred
+	err = installContent(dst, content, mode, owner, group)
+	if err != nil {
+		return dst, err
 	}
 
 	return dst, nil
 }
 
-func templateFile(cacheFS fs.FS, name, src, dst, mode, owner, group string, metadata NodeMetadata) (string, error) {
-	parsedMode, err := strconv.ParseUint(mode, 8, 32)
+// installContent writes the content to the destination file with the given mode and ownership. The
+// content is written to a temporary file synced and renamed over the destination, so a power loss
+// never leaves the destination empty or partially written, eg: the kubelet binary or unit. A symlink
+// destination is written through, its target is replaced.
+func installContent(dst string, content []byte, mode, owner, group string) error {
+	parsedMode, err := parseMode(mode, defaultModeForContent(content), false)
+	if err != nil {
+		return fmt.Errorf("failed to parse mode: %w", err)
+	}
+	dst, err = resolveSymlink(dst)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse mode: %w", err)
+		return err
 	}
 
-	srcFile, err := fs.ReadFile(cacheFS, fmt.Sprintf("%s/%s", name, src))
+	tmpFile, err := os.CreateTemp(hostPath(filepath.Dir(dst)), "."+filepath.Base(dst)+".tmp-")
 	if err != nil {
-		return "", fmt.Errorf("failed to open src file: %w", err)
+		return fmt.Errorf("failed to open dst file: %w", err)
 	}
+	tmp := filepath.Join(filepath.Dir(dst), filepath.Base(tmpFile.Name()))
+	defer func() { _ = os.Remove(hostPath(tmp)) }()
 
-	tmpl, err := template.New("tmpl").Funcs(sprig.FuncMap()).Parse(string(srcFile))
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to parse template: %w", err)
+		_ = tmpFile.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close dst file: %w", err)
 	}
 
-	var rendered strings.Builder
-	err = tmpl.Execute(&rendered, metadata)
+	// The temporary file is created with mode 0600
+	err = os.Chmod(hostPath(tmp), parsedMode)
 	if err != nil {
-		return "", fmt.Errorf("failed to render template: %w", err)
+		return fmt.Errorf("failed to chmod file: %w", err)
 	}
 
-	// If the destination is a directory, use the base name of the source file
-	// if not, use the name of the destination file
-	if strings.HasSuffix(dst, "/") {
-		dst = dst + filepath.Base(src)
+	// The file is installed when the owner does not exist yet, the chown is deferred by the caller
+	chownErr := chown(tmp, owner, group)
+	if chownErr != nil && !errors.Is(chownErr, errUnknownOwner) {
+		return fmt.Errorf("failed to chown file: %w", chownErr)
+	}
+
+	// Changing the owner clears the setuid and setgid bits, so set them again
+	if chownErr == nil && parsedMode&(fs.ModeSetuid|fs.ModeSetgid) != 0 {
+		err = os.Chmod(hostPath(tmp), parsedMode)
+		if err != nil {
+			return fmt.Errorf("failed to chmod file: %w", err)
+		}
 	}
 
-	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(parsedMode))
+	err = os.Rename(hostPath(tmp), hostPath(dst))
 	if err != nil {
-		return "", fmt.Errorf("failed to open dst file: %w", err)
+		return fmt.Errorf("failed to replace dst file: %w", err)
 	}
+	err = syncDir(filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	if chownErr != nil {
+		return fmt.Errorf("failed to chown file: %w", chownErr)
+	}
+
+	return nil
+}
 
-	_, err = dstFile.Write([]byte(rendered.String()))
+// writeFileSync writes the state file atomically: the data is written to a temporary file synced and
+// renamed over the file, and the directory is synced. A symlink is written through.
+func writeFileSync(path string, data []byte, perm fs.FileMode) error {
+	path, err := resolveSymlink(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(hostPath(tmp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to write file: %w", err)
+		_ = file.Close()
+		_ = os.Remove(hostPath(tmp))
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		_ = os.Remove(hostPath(tmp))
+		return err
 	}
 
-	err = dstFile.Close()
+	err = os.Rename(hostPath(tmp), hostPath(path))
 	if err != nil {
-		return "", fmt.Errorf("failed to close dst file: %w", err)
+		_ = os.Remove(hostPath(tmp))
+		return err
 	}
 
-	err = chown(dst, owner, group)
+	return syncDir(filepath.Dir(path))
+}
+
+// resolveSymlink returns the file the path points to, the path itself if it is not a symlink. The
+// absolute targets are resolved in the host root.
+func resolveSymlink(path string) (string, error) {
+	for range 40 {
+		info, err := os.Lstat(hostPath(path))
+		if errors.Is(err, fs.ErrNotExist) {
+			return path, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return path, nil
+		}
+
+		target, err := os.Readlink(hostPath(path))
+		if err != nil {
+			return "", fmt.Errorf("failed to read symlink %s: %w", path, err)
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = filepath.Clean(target)
+	}
+
+	return "", fmt.Errorf("failed to resolve %s: too many levels of symbolic links", path)
+}
+
+// syncDir syncs the directory, so the files created or renamed in it survive a power loss
+func syncDir(path string) error {
+	dir, err := os.Open(hostPath(path))
 	if err != nil {
-		return "", fmt.Errorf("failed to chown file: %w", err)
+		return fmt.Errorf("failed to open directory %s: %w", path, err)
+	}
+	err = dir.Sync()
+	_ = dir.Close()
+	if err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", path, err)
 	}
 
-	return dst, nil
+	return nil
 }
 
-func mkdir(path string, mode string, owner string, group string) error {
-	parsedMode, err := strconv.ParseUint(mode, 8, 32)
+// mkdir creates the directory and its missing parents (mkdir -p), the mode and ownership are applied
+// to the directory and, if applyToParents is set, to the parents created
+func mkdir(path string, mode string, owner string, group string, applyToParents bool) error {
+	parsedMode, err := parseMode(mode, defaultDirectoryMode, true)
 	if err != nil {
 		return fmt.Errorf("failed to parse mode: %w", err)
 	}
 
-	err = os.Mkdir(path, os.FileMode(parsedMode))
+	// Find the missing parents, from the closest to the root
+	var missingParents []string
+	for parent := filepath.Dir(filepath.Clean(path)); parent != "/" && parent != "."; parent = filepath.Dir(parent) {
+		_, err := os.Stat(hostPath(parent))
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to stat parent dir: %w", err)
+		}
+		missingParents = append(missingParents, parent)
+	}
+
+	// Only the chown of the directory is deferred when the owner does not exist yet, the parents would
+	// be left with the wrong owner, so the lookup error is returned as is
+	if applyToParents && len(missingParents) > 0 {
+		_, err = lookupUserID(owner)
+		if err == nil {
+			_, err = lookupGroupID(group)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lookup parent dirs owner: %v", err)
+		}
+	}
+
+	// Create the missing parents, from the root to the closest
+	slices.Reverse(missingParents)
+	for _, parent := range missingParents {
+		if !applyToParents {
+			err = os.Mkdir(hostPath(parent), defaultDirectoryMode)
+			if err != nil && !os.IsExist(err) {
+				return fmt.Errorf("failed to create parent dir: %w", err)
+			}
+			continue
+		}
+
+		err = mkdirOwned(parent, parsedMode, owner, group)
+		if err != nil {
+			return err
+		}
+	}
+
+	return mkdirOwned(path, parsedMode, owner, group)
+}
+
+func mkdirOwned(path string, mode fs.FileMode, owner string, group string) error {
+	err := os.Mkdir(hostPath(path), mode.Perm())
 	if err != nil && !os.IsExist(err) {
 		// Ignore directory already exists error
 		return fmt.Errorf("failed to create dir: %w", err)
@@ -118,7 +307,7 @@ func mkdir(path string, mode string, owner string, group string) error {
 
 	// Since the mode is only set by mkdir at creation
 	// we also ensure the mode is set when the directory already exists
-	err = os.Chmod(path, os.FileMode(parsedMode))
+	err = os.Chmod(hostPath(path), mode)
 	if err != nil {
 		return fmt.Errorf("failed to chmod dir: %w", err)
 	}
@@ -131,6 +320,10 @@ func mkdir(path string, mode string, owner string, group string) error {
 	return nil
 }
 
+// errUnknownOwner is returned when the owner or group does not exist (yet)
+var errUnknownOwner = errors.New("unknown owner or group")
+
+// chown changes the owner and group of the path, an empty owner or group is left as is
 func chown(path string, owner string, group string) error {
 	ownerID, err := lookupUserID(owner)
 	if err != nil {
@@ -142,7 +335,7 @@ func chown(path string, owner string, group string) error {
 		return fmt.Errorf("failed to lookup group id: %w", err)
 	}
 
-	err = os.Chown(path, ownerID, groupID)
+	err = os.Chown(hostPath(path), ownerID, groupID)
 	if err != nil {
 		return fmt.Errorf("failed to chown: %w", err)
 	}
@@ -150,9 +343,28 @@ func chown(path string, owner string, group string) error {
 	return nil
 }
 
+// lookupUserID returns the uid of a user name or numeric id, -1 if empty
 func lookupUserID(username string) (int, error) {
+	if username == "" {
+		return -1, nil
+	}
+	if uid, err := strconv.Atoi(username); err == nil {
+		return uid, nil
+	}
+	if serviceManager == chrootServiceManager {
+		uid, found, err := lookupRootID("/etc/passwd", username)
+		if err == nil && !found {
+			return 0, fmt.Errorf("%w: user %s", errUnknownOwner, username)
+		}
+		return uid, err
+	}
+
 	u, err := user.Lookup(username)
 	if err != nil {
+		var unknownUserErr user.UnknownUserError
+		if errors.As(err, &unknownUserErr) {
+			return 0, fmt.Errorf("%w: user %s", errUnknownOwner, username)
+		}
 		return 0, fmt.Errorf("failed to lookup user: %w", err)
 	}
 	uid, err := strconv.Atoi(u.Uid)
@@ -162,9 +374,28 @@ func lookupUserID(username string) (int, error) {
 	return uid, nil
 }
 
+// lookupGroupID returns the gid of a group name or numeric id, -1 if empty
 func lookupGroupID(groupname string) (int, error) {
+	if groupname == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(groupname); err == nil {
+		return gid, nil
+	}
+	if serviceManager == chrootServiceManager {
+		gid, found, err := lookupRootID("/etc/group", groupname)
+		if err == nil && !found {
+			return 0, fmt.Errorf("%w: group %s", errUnknownOwner, groupname)
+		}
+		return gid, err
+	}
+
 	g, err := user.LookupGroup(groupname)
 	if err != nil {
+		var unknownGroupErr user.UnknownGroupError
+		if errors.As(err, &unknownGroupErr) {
+			return 0, fmt.Errorf("%w: group %s", errUnknownOwner, groupname)
+		}
 		return 0, fmt.Errorf("failed to lookup group: %w", err)
 	}
 	gid, err := strconv.Atoi(g.Gid)
@@ -173,3 +404,30 @@ func lookupGroupID(groupname string) (int, error) {
 	}
 	return gid, nil
 }
+
+// lookupRootID returns the id of the name in the passwd or group file of the alternate root, the users
+// and groups of the host are not the ones of the image
+func lookupRootID(file, name string) (int, bool, error) {
+	content, err := os.ReadFile(hostPath(file))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	// The id is the third field of both files, eg: "kubelet:x:998:998::/var/lib/kubelet:/sbin/nologin"
+	for line := range strings.Lines(string(content)) {
+		fields := strings.Split(strings.TrimSpace(line), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to parse id of %s in %s: %w", name, file, err)
+		}
+		return id, true, nil
+	}
+
+	return 0, false, nil
+}
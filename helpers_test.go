@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupUserID(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		expected int
+		err      error
+	}{
+		{
+			name:     "empty user",
+			username: "",
+			expected: -1,
+		},
+		{
+			name:     "numeric user",
+			username: "1234",
+			expected: 1234,
+		},
+		{
+			name:     "user name",
+			username: "root",
+			expected: 0,
+		},
+		{
+			name:     "unknown user",
+			username: "scw-k8s-agent-unknown",
+			err:      errUnknownOwner,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := lookupUserID(tt.username)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("lookupUserID(%q) error = %v, expected %v", tt.username, err, tt.err)
+			}
+			if err == nil && result != tt.expected {
+				t.Errorf("lookupUserID(%q) = %d, expected %d", tt.username, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestInstallContent(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	tests := []struct {
+		name    string
+		content string
+		mode    string
+		owner   string
+		err     error
+	}{
+		{
+			name:    "new file",
+			content: "#!/bin/sh\n",
+			mode:    "0755",
+		},
+		{
+			name:    "replaced file",
+			content: "#!/bin/sh\nexit 0\n",
+			mode:    "0750",
+		},
+		{
+			name:    "unknown owner",
+			content: "#!/bin/sh\nexit 1\n",
+			mode:    "0755",
+			owner:   "scw-unknown-user",
+			err:     errUnknownOwner,
+		},
+	}
+	for _, test := range tests {
+		err := installContent("/kubelet", []byte(test.content), test.mode, test.owner, "")
+		if !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+			t.Errorf("%s: error = %v, expected %v", test.name, err, test.err)
+		}
+
+		// The file is installed, also when the chown is deferred, without temporary file left
+		content, err := os.ReadFile(filepath.Join(rootDir, "kubelet"))
+		if err != nil || string(content) != test.content {
+			t.Errorf("%s: content = %q, %v", test.name, content, err)
+		}
+		info, err := os.Stat(filepath.Join(rootDir, "kubelet"))
+		if err != nil || fmt.Sprintf("%04o", info.Mode().Perm()) != test.mode {
+			t.Errorf("%s: unexpected mode %v, %v", test.name, info.Mode(), err)
+		}
+		entries, err := os.ReadDir(rootDir)
+		if err != nil || len(entries) != 1 {
+			t.Errorf("%s: expected only the file, got %v, %v", test.name, entries, err)
+		}
+	}
+
+	err := writeFileSync("/state.json", []byte("{}"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write state file: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(rootDir, "state.json"))
+	if err != nil || string(content) != "{}" {
+		t.Errorf("state file content = %q, %v", content, err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, "state.json.tmp"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the temporary state file removed, got %v", err)
+	}
+
+	// A symlink destination is written through, eg: a binary linked to a versioned path
+	err = os.MkdirAll(filepath.Join(rootDir, "opt/bin"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("/opt/bin/crictl-1.31", filepath.Join(rootDir, "crictl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = installContent("/crictl", []byte("crictl"), "0755", "", "")
+	if err != nil {
+		t.Fatalf("failed to install through symlink: %v", err)
+	}
+	target, err := os.Readlink(filepath.Join(rootDir, "crictl"))
+	if err != nil || target != "/opt/bin/crictl-1.31" {
+		t.Errorf("expected the symlink kept, got %q, %v", target, err)
+	}
+	content, err = os.ReadFile(filepath.Join(rootDir, "opt/bin/crictl-1.31"))
+	if err != nil || string(content) != "crictl" {
+		t.Errorf("symlink target content = %q, %v", content, err)
+	}
+}
+
+func TestMkdirUnknownOwner(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	// The chown of the directory alone is deferred
+	err := mkdir("/etc/leaf", "0750", "scw-unknown-user", "", false)
+	if !errors.Is(err, errUnknownOwner) {
+		t.Errorf("mkdir without parents error = %v, expected %v", err, errUnknownOwner)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, "etc/leaf"))
+	if err != nil {
+		t.Errorf("expected the directory created, got %v", err)
+	}
+
+	// The chown of the parents cannot be deferred, nothing is created
+	err = mkdir("/var/lib/parent/leaf", "0750", "scw-unknown-user", "", true)
+	if err == nil || errors.Is(err, errUnknownOwner) {
+		t.Errorf("mkdir with parents error = %v, expected a lookup error not deferred", err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, "var"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no parent created, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// holdAnnotationPrefix is the prefix of the annotations holding a component at a version,
+// eg: k8s.scaleway.com/hold-containerd=1.7.22
+var holdAnnotationPrefix = defaultAnnotationPrefix + "hold-"
+
+// The holds are copied from the node annotations to a state file, so they are also
+// respected when the agent installs the components at boot, before reaching the API server
+var holdsFile = filepath.Join(stateDir, "holds.json")
+
+// nodeHolds returns the component holds set in the node annotations
+func nodeHolds(annotations map[string]string) map[string]string {
+	holds := make(map[string]string)
+	for annotation, version := range annotations {
+		if component, ok := strings.CutPrefix(annotation, holdAnnotationPrefix); ok && component != "" && version != "" {
+			holds[component] = version
+		}
+	}
+	return holds
+}
+
+func loadHolds() (map[string]string, error) {
+	holds := make(map[string]string)
+
+	jsonHolds, err := os.ReadFile(hostPath(holdsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return holds, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read holds: %w", err)
+	}
+
+	err = json.Unmarshal(jsonHolds, &holds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal holds: %w", err)
+	}
+
+	return holds, nil
+}
+
+func saveHolds(holds map[string]string) error {
+	if len(holds) == 0 {
+		err := os.Remove(hostPath(holdsFile))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove holds: %w", err)
+		}
+		return nil
+	}
+
+	jsonHolds, err := json.Marshal(holds)
+	if err != nil {
+		return fmt.Errorf("failed to marshal holds: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = os.WriteFile(hostPath(holdsFile), jsonHolds, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write holds: %w", err)
+	}
+
+	return nil
+}
+
+// applyHolds replaces the version of the held components by their held version, the holds of a version
+// the repository no longer has are ignored, the release version is installed instead
+func applyHolds(repoFS fs.FS, components []Component, holds map[string]string) ([]Component, error) {
+	held := make([]Component, 0, len(components))
+	for _, component := range components {
+		if version, ok := holds[component.Name]; ok && version != component.Version {
+			available, err := componentVersions(repoFS, component.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get component %s versions: %w", component.Name, err)
+			}
+			if !slices.Contains(available, trimVersion(version)) {
+				slog.Warn("Held version not in the repository, hold ignored", slog.String("component", component.Name), slog.String("version", version), slog.String("release_version", component.Version))
+				held = append(held, component)
+				continue
+			}
+			slog.Info("Component held", slog.String("component", component.Name), slog.String("version", version), slog.String("release_version", component.Version))
+			component.Version = version
+			component.Source = nil // The source is the one of the release version
+		}
+		held = append(held, component)
+	}
+	return held, nil
+}
+
+// formatHolds returns the holds as a sorted "component=version" list
+func formatHolds(holds map[string]string) string {
+	formatted := make([]string, 0, len(holds))
+	for _, component := range slices.Sorted(maps.Keys(holds)) {
+		formatted = append(formatted, component+"="+holds[component])
+	}
+	return strings.Join(formatted, ", ")
+}
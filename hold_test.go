@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNodeHolds(t *testing.T) {
+	holds := nodeHolds(map[string]string{
+		holdAnnotationPrefix + "containerd": "1.7.22",
+		holdAnnotationPrefix + "kubelet":    "",
+		holdAnnotationPrefix:                "1.0.0",
+		"k8s.example.com/hold-runc":         "1.1.12",
+	})
+	expected := map[string]string{"containerd": "1.7.22"}
+	if !reflect.DeepEqual(holds, expected) {
+		t.Errorf("holds = %v, expected %v", holds, expected)
+	}
+	if formatted := formatHolds(map[string]string{"runc": "1.1.12", "containerd": "1.7.22"}); formatted != "containerd=1.7.22, runc=1.1.12" {
+		t.Errorf("unexpected formatted holds %q", formatted)
+	}
+}
+
+func TestApplyHolds(t *testing.T) {
+	repoFS := fstest.MapFS{
+		"containerd/metadata.yaml": {Data: []byte("versions:\n  1.7.22: {}\n  1.7.23: {}\n")},
+		"runc/metadata.yaml":       {Data: []byte("versions:\n  1.1.14: {}\n")},
+	}
+	components := []Component{
+		{Name: "containerd", Version: "1.7.23", Source: &ComponentSource{URL: "https://hotfixes"}},
+		{Name: "runc", Version: "1.1.14"},
+		{Name: "kubelet", Version: "1.31.2"},
+	}
+
+	// The held version the repository still has is installed, the others keep the release version
+	held, err := applyHolds(repoFS, components, map[string]string{"containerd": "1.7.22~1", "runc": "1.1.12"})
+	if err != nil {
+		t.Fatalf("failed to apply holds: %v", err)
+	}
+	expected := []Component{
+		{Name: "containerd", Version: "1.7.22~1"},
+		{Name: "runc", Version: "1.1.14"},
+		{Name: "kubelet", Version: "1.31.2"},
+	}
+	if !reflect.DeepEqual(held, expected) {
+		t.Errorf("components = %+v, expected %+v", held, expected)
+	}
+}
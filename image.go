@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// JSON File template of the image manifest, listing the components pre-installed into an image with
+// the agent -root flag. The files still matching their digest are not copied again on the node.
+//
+//	{
+//	   "agent_version": "1.4.0",
+//	   "repo_uri": "https://repo.example.com/k8s",
+//	   "built_at": "2024-10-07T10:00:00Z",
+//	   "components": {
+//	      "containerd": {"version": "1.7.22", "files": {"/usr/bin/containerd": "9f86d0..."}}
+//	   }
+//	}
+const imageManifestFile = "/etc/scw-k8s-image.json"
+
+// imageStatePaths are the state files kept in the image: the files managed by the components, the files
+// taken over by them, and the commands recorded during the build. The rest of the state, eg: the
+// status, the audit log or the repository cache, belongs to the build and not to the nodes.
+var imageStatePaths = []string{managedFilesFile, takeoverBackupDir, componentSourcesFile, commandsLog}
+
+type ImageManifest struct {
+	AgentVersion string                    `json:"agent_version"`
+	RepoURI      string                    `json:"repo_uri"`
+	BuiltAt      time.Time                 `json:"built_at"`
+	Components   map[string]ImageComponent `json:"components"`
+}
+
+type ImageComponent struct {
+	Version string            `json:"version"`
+	Files   map[string]string `json:"files"` // SHA256 digest by path
+}
+
+// writeImageManifest writes the manifest of the components installed into the alternate root. The
+// installed versions and the state of the build are not kept in the image: the node installs its
+// components on first boot, with its own metadata, and only skips copying the files baked into the
+// image.
+func writeImageManifest(nodemetadata NodeMetadata) error {
+	versions, err := ListComponentsVersions()
+	if err != nil {
+		return fmt.Errorf("failed to list components versions: %w", err)
+	}
+	digests, err := managedFileDigests(versions)
+	if err != nil {
+		return err
+	}
+
+	manifest := ImageManifest{
+		AgentVersion: Version,
+		RepoURI:      nodemetadata.RepoURI,
+		BuiltAt:      time.Now().UTC(),
+		Components:   make(map[string]ImageComponent),
+	}
+	for name, version := range versions {
+		manifest.Components[name] = ImageComponent{Version: version, Files: digests[name]}
+	}
+
+	jsonManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal image manifest: %w", err)
+	}
+	err = os.WriteFile(hostPath(imageManifestFile), jsonManifest, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write image manifest: %w", err)
+	}
+
+	for _, file := range []string{versionsFile, sbomFile} {
+		err = os.Remove(hostPath(file))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s from the image: %w", file, err)
+		}
+	}
+	err = removeImageState()
+	if err != nil {
+		return err
+	}
+	slog.Info("Image manifest written", slog.String("file", imageManifestFile), slog.Int("components", len(manifest.Components)))
+
+	return nil
+}
+
+// removeImageState removes the state of the build from the image, but the state files of the image
+func removeImageState() error {
+	entries, err := os.ReadDir(hostPath(stateDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(stateDir, entry.Name())
+		if slices.Contains(imageStatePaths, path) {
+			continue
+		}
+		err = os.RemoveAll(hostPath(path))
+		if err != nil {
+			return fmt.Errorf("failed to remove %s from the image: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// bakedFile returns whether the file of the component version was pre-installed into the image, and
+// is unchanged since. The image manifest is loaded once per install, nil if the node image was not
+// built by the agent.
+func bakedFile(manifest *ImageManifest, component, version, path string) bool {
+	if manifest == nil {
+		return false
+	}
+
+	baked, ok := manifest.Components[component]
+	if !ok || baked.Version != version || baked.Files[path] == "" {
+		return false
+	}
+	digest, err := fileDigest(path)
+	return err == nil && digest == baked.Files[path]
+}
+
+// loadImageManifest reads the image manifest, nil if the node image was not built by the agent
+func loadImageManifest() (*ImageManifest, error) {
+	jsonManifest, err := os.ReadFile(hostPath(imageManifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image manifest: %w", err)
+	}
+
+	var manifest ImageManifest
+	err = json.Unmarshal(jsonManifest, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal image manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// checkImageRelease checks the image was built with exactly the release components, from the same
+// repository, and that all their files are unchanged
+func checkImageRelease(manifest *ImageManifest, nodemetadata NodeMetadata, components []Component) error {
+	if manifest.RepoURI != nodemetadata.RepoURI {
+		return fmt.Errorf("image built from repository %s", manifest.RepoURI)
+	}
+	if len(manifest.Components) != len(components) {
+		return fmt.Errorf("image built with %d components, the release has %d", len(manifest.Components), len(components))
+	}
+
+	for _, component := range components {
+		expectedVersion := expandVersion(component.Version, nodemetadata.PoolVersion)
+		baked, ok := manifest.Components[component.Name]
+		if !ok {
+			return fmt.Errorf("component %s not in the image", component.Name)
+		}
+		if baked.Version != expectedVersion {
+			return fmt.Errorf("component %s %s in the image, the release has %s", component.Name, baked.Version, expectedVersion)
+		}
+		for path, expectedDigest := range baked.Files {
+			digest, err := fileDigest(path)
+			if err != nil {
+				return err
+			}
+			if digest != expectedDigest {
+				return fmt.Errorf("file %s of component %s changed since the image build", path, component.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// imageFastPath returns the image manifest if the components baked into the image can be used as is: on
+// first boot, with the ImageFastPath feature gate, when the image matches the release and all its
+// files are unchanged
+func imageFastPath(nodemetadata NodeMetadata, components []Component, upgrade bool) (*ImageManifest, error) {
+	if upgrade || serviceManager == chrootServiceManager || !nodemetadata.featureEnabled(FeatureImageFastPath) {
+		return nil, nil
+	}
+	versions, err := ListComponentsVersions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list components versions: %w", err)
+	}
+	if len(versions) > 0 {
+		return nil, nil
+	}
+
+	manifest := nodemetadata.image
+	if manifest == nil {
+		return nil, nil
+	}
+
+	err = checkImageRelease(manifest, nodemetadata, components)
+	if err != nil {
+		slog.Info("Image does not match the release, installing the components", slog.String("reason", err.Error()))
+		return nil, nil
+	}
+	slog.Info("Image matches the release, install skipped", slog.Int("components", len(components)))
+
+	return manifest, nil
+}
+
+// recordImageComponents records the components of the verified image as installed from the node
+// repository, their files are already managed
+func recordImageComponents(manifest *ImageManifest, nodemetadata NodeMetadata) error {
+	for _, name := range slices.Sorted(maps.Keys(manifest.Components)) {
+		baked := manifest.Components[name]
+		err := SetComponentVersion(name, baked.Version)
+		if err != nil {
+			return err
+		}
+		err = recordComponentRepo(name, nodemetadata.RepoURI)
+		if err != nil {
+			return err
+		}
+		setComponentStatus(name, baked.Version, "installed")
+	}
+
+	return nil
+}
+
+// managedFileDigests returns the SHA256 digest of the files managed by each component, by path. The
+// files removed since their install are skipped.
+func managedFileDigests(versions map[string]string) (map[string]map[string]string, error) {
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make(map[string]map[string]string)
+	for name := range versions {
+		digests[name] = make(map[string]string)
+	}
+	for path, name := range managedFiles {
+		files, ok := digests[name]
+		if !ok {
+			continue
+		}
+		digest, err := fileDigest(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[path] = digest
+	}
+
+	return digests, nil
+}
+
+// fileDigest returns the SHA256 digest of the regular file
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(hostPath(path))
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("failed to hash %s: %w", path, fs.ErrNotExist)
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash file %s: %w", path, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageManifest(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = chrootServiceManager
+
+	// Install the components into the image
+	for _, dir := range []string{"etc", "usr/bin"} {
+		err := os.MkdirAll(filepath.Join(rootDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(rootDir, "usr/bin/containerd"), []byte("containerd binary"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, component := range map[string]string{"/usr/bin/containerd": "containerd", "/usr/bin/missing": "containerd", "/usr/bin/other": "other"} {
+		err = recordManagedFile(path, component)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = SetComponentVersion("containerd", "1.7.22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, statusFile), []byte("{}"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeImageManifest(NodeMetadata{RepoURI: "https://repo.example.com/k8s"})
+	if err != nil {
+		t.Fatalf("failed to write image manifest: %v", err)
+	}
+
+	jsonManifest, err := os.ReadFile(filepath.Join(rootDir, imageManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ImageManifest
+	err = json.Unmarshal(jsonManifest, &manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := manifest.Components["containerd"].Files
+	if len(manifest.Components) != 1 || manifest.Components["containerd"].Version != "1.7.22" || len(files) != 1 || files["/usr/bin/containerd"] == "" {
+		t.Errorf("unexpected image manifest %s", jsonManifest)
+	}
+
+	// The node installs its components on first boot
+	version, err := GetComponentVersion("containerd")
+	if err != nil || version != "" {
+		t.Errorf("expected the versions removed from the image, got %q, %v", version, err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, statusFile))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the build status removed from the image, got %v", err)
+	}
+	managedFiles, err := loadManagedFiles()
+	if err != nil || managedFiles["/usr/bin/containerd"] != "containerd" {
+		t.Errorf("expected the managed files kept in the image, got %v, %v", managedFiles, err)
+	}
+
+	// Only the unchanged files of the same version are skipped
+	serviceManager = systemdServiceManager
+	image, err := loadImageManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		version string
+		path    string
+		content string
+		baked   bool
+	}{
+		{name: "baked", version: "1.7.22", path: "/usr/bin/containerd", baked: true},
+		{name: "other version", version: "1.7.23", path: "/usr/bin/containerd"},
+		{name: "not baked", version: "1.7.22", path: "/usr/bin/ctr"},
+		{name: "changed", version: "1.7.22", path: "/usr/bin/containerd", content: "patched binary"},
+	}
+	for _, test := range tests {
+		if test.content != "" {
+			err = os.WriteFile(filepath.Join(rootDir, test.path), []byte(test.content), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		baked := bakedFile(image, "containerd", test.version, test.path)
+		if baked != test.baked {
+			t.Errorf("%s: baked = %v, expected %v", test.name, baked, test.baked)
+		}
+	}
+}
+
+func TestImageFastPath(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootDir, "usr/bin"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "usr/bin/containerd"), []byte("containerd binary"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := fileDigest("/usr/bin/containerd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &ImageManifest{
+		RepoURI: "https://repo.example.com/k8s",
+		Components: map[string]ImageComponent{
+			"containerd": {Version: "1.7.22", Files: map[string]string{"/usr/bin/containerd": digest}},
+			"kubelet":    {Version: "1.31.2", Files: map[string]string{}},
+		},
+	}
+	nodemetadata := NodeMetadata{RepoURI: "https://repo.example.com/k8s", PoolVersion: "1.31.2"}
+
+	tests := []struct {
+		name       string
+		repoURI    string
+		components []Component
+		wantErr    bool
+	}{
+		{
+			name:       "image matches the release",
+			components: []Component{{Name: "containerd", Version: "1.7.22"}, {Name: "kubelet"}},
+		},
+		{
+			name:       "other repository",
+			repoURI:    "https://other.example.com/k8s",
+			components: []Component{{Name: "containerd", Version: "1.7.22"}, {Name: "kubelet"}},
+			wantErr:    true,
+		},
+		{
+			name:       "other version",
+			components: []Component{{Name: "containerd", Version: "1.7.23"}, {Name: "kubelet"}},
+			wantErr:    true,
+		},
+		{
+			name:       "missing component",
+			components: []Component{{Name: "containerd", Version: "1.7.22"}, {Name: "kubelet"}, {Name: "cni", Version: "1.5.1"}},
+			wantErr:    true,
+		},
+	}
+	for _, test := range tests {
+		metadata := nodemetadata
+		if test.repoURI != "" {
+			metadata.RepoURI = test.repoURI
+		}
+		err = checkImageRelease(manifest, metadata, test.components)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", test.name, err, test.wantErr)
+		}
+	}
+
+	// A changed file is installed again
+	err = os.WriteFile(filepath.Join(rootDir, "usr/bin/containerd"), []byte("patched binary"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkImageRelease(manifest, nodemetadata, []Component{{Name: "containerd", Version: "1.7.22"}, {Name: "kubelet"}})
+	if err == nil {
+		t.Errorf("expected an error for the changed file")
+	}
+
+	// The install of the components of the verified image is skipped, they are only recorded
+	err = os.MkdirAll(filepath.Join(rootDir, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(rootDir, stateDir), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recordImageComponents(manifest, nodemetadata)
+	if err != nil {
+		t.Fatalf("failed to record image components: %v", err)
+	}
+	versions, err := ListComponentsVersions()
+	if err != nil || versions["containerd"] != "1.7.22" || versions["kubelet"] != "1.31.2" {
+		t.Errorf("expected the image components recorded, got %v, %v", versions, err)
+	}
+}
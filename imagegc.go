@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ImageGC remediates the disk pressure of the image filesystem, eg: on small-disk node pools where the
+// kubelet image GC is too late to avoid evictions
+//
+//	"image_gc": {
+//	   "high_threshold": 85,
+//	   "low_threshold": 70,
+//	   "prune_content": true
+//	}
+type ImageGC struct {
+	// Usage percent of the image filesystem triggering the remediation, 85 if not set
+	HighThreshold int `json:"high_threshold,omitempty"`
+
+	// Usage percent of the image filesystem the remediation tries to reach, 70 if not set
+	LowThreshold int `json:"low_threshold,omitempty"`
+
+	// Also prune the content and snapshots not referenced anymore when pruning the images is not enough
+	PruneContent bool `json:"prune_content,omitempty"`
+}
+
+const (
+	defaultImageGCHighThreshold = 85
+	defaultImageGCLowThreshold  = 70
+)
+
+// imageGCInterval is the minimum time between two image filesystem checks, pruning the images takes a
+// while and the kubelet may pull images again in between
+const imageGCInterval = 10 * time.Minute
+
+// defaultContainerdRoot is the containerd data directory, unless set in the containerd settings
+const defaultContainerdRoot = "/var/lib/containerd"
+
+// ImageGCReport is the result of a disk pressure remediation
+type ImageGCReport struct {
+	Threshold   int      // Usage percent triggering the remediation
+	UsageBefore int      // Usage percent of the image filesystem before the remediation
+	UsageAfter  int      // Usage percent of the image filesystem after the remediation
+	Actions     []string // Remediation actions run, none if the usage is under the high threshold
+}
+
+// thresholds returns the high and low thresholds, with their defaults
+func (g ImageGC) thresholds() (int, int, error) {
+	high, low := g.HighThreshold, g.LowThreshold
+	if high == 0 {
+		high = defaultImageGCHighThreshold
+	}
+	if low == 0 {
+		low = min(defaultImageGCLowThreshold, high)
+	}
+	if high < 1 || high > 100 || low < 1 || low > high {
+		return 0, 0, fmt.Errorf("invalid image GC thresholds %d/%d, expected 0 < low <= high <= 100", high, low)
+	}
+	return high, low, nil
+}
+
+// imageFilesystemUsage returns the usage percent of the filesystem of the containerd root
+func imageFilesystemUsage(root string) (int, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(hostPath(root), &stat)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat image filesystem %s: %w", root, err)
+	}
+	if stat.Blocks == 0 {
+		return 0, nil
+	}
+
+	// The blocks reserved to root are not available to containerd
+	used := stat.Blocks - stat.Bfree
+	return int((used*100 + (used + stat.Bavail) - 1) / (used + stat.Bavail)), nil
+}
+
+// remediateImageFilesystem prunes the unused images when the image filesystem usage is above the high
+// threshold, then the unreferenced content if enabled and the usage is still above the low threshold
+func remediateImageFilesystem(imageGC ImageGC, containerd *Containerd) (ImageGCReport, error) {
+	high, low, err := imageGC.thresholds()
+	if err != nil {
+		return ImageGCReport{}, err
+	}
+
+	root := defaultContainerdRoot
+	if containerd != nil && containerd.Root != "" {
+		root = containerd.Root
+	}
+
+	usage, err := imageFilesystemUsage(root)
+	if err != nil {
+		return ImageGCReport{}, err
+	}
+	report := ImageGCReport{Threshold: high, UsageBefore: usage, UsageAfter: usage}
+	if usage < high {
+		return report, nil
+	}
+	slog.Warn("Image filesystem usage above threshold", slog.Int("usage", usage), slog.Int("threshold", high))
+
+	// Remove the images not used by any container
+	cmd := command("/usr/bin/crictl", "rmi", "--prune")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return report, fmt.Errorf("failed to prune unused images: %w: %s", err, output)
+	}
+	report.Actions = append(report.Actions, "pruned unused images")
+
+	report.UsageAfter, err = imageFilesystemUsage(root)
+	if err != nil {
+		return report, err
+	}
+
+	// Remove the content not referenced by any image, the snapshots are then collected by containerd
+	if imageGC.PruneContent && report.UsageAfter > low {
+		cmd = command("/usr/bin/ctr", "--namespace", "k8s.io", "content", "prune", "references")
+		output, err = cmd.CombinedOutput()
+		if err != nil {
+			return report, fmt.Errorf("failed to prune unreferenced content: %w: %s", err, output)
+		}
+		report.Actions = append(report.Actions, "pruned unreferenced content")
+
+		report.UsageAfter, err = imageFilesystemUsage(root)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	slog.Info("Image filesystem remediated", slog.Int("usage_before", report.UsageBefore), slog.Int("usage_after", report.UsageAfter), slog.String("actions", strings.Join(report.Actions, ", ")))
+
+	return report, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestImageGCThresholds(t *testing.T) {
+	tests := []struct {
+		imageGC   ImageGC
+		high, low int
+		valid     bool
+	}{
+		{ImageGC{}, 85, 70, true},
+		{ImageGC{HighThreshold: 60}, 60, 60, true},
+		{ImageGC{HighThreshold: 90, LowThreshold: 50}, 90, 50, true},
+		{ImageGC{HighThreshold: 80, LowThreshold: 90}, 0, 0, false},
+		{ImageGC{HighThreshold: 120}, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		high, low, err := test.imageGC.thresholds()
+		if (err == nil) != test.valid {
+			t.Errorf("%+v: error = %v, valid %v", test.imageGC, err, test.valid)
+			continue
+		}
+		if high != test.high || low != test.low {
+			t.Errorf("%+v: thresholds = %d/%d, expected %d/%d", test.imageGC, high, low, test.high, test.low)
+		}
+	}
+}
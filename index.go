@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"regexp"
+	"runtime"
+	"slices"
+)
+
+// ComponentIndex is the index.yaml of a component in the repository layout v2, it lists the versions
+// available and their artifacts per architecture, so the files are resolved without templating their
+// paths and checked against their digest and size. The metadata.yaml still defines the sections, the
+// versions of the index without sections use the ones of their fallback version if any, and the
+// defaults and the ranges.
+//
+//	versions:
+//	  1.31.2:
+//	    artifacts:
+//	      kubelet:
+//	        amd64: {path: 1.31.2/amd64/kubelet, sha256: 3f2a..., size: 117846528}
+//	        arm64: {path: 1.31.2/arm64/kubelet, sha256: 9c1e..., size: 112132096}
+//	      kubelet.service:
+//	        all: {path: 1.31.2/kubelet.service, sha256: 7d0b..., size: 512}
+type ComponentIndex struct {
+	Versions map[string]IndexVersion `yaml:"versions"`
+}
+
+type IndexVersion struct {
+	Artifacts map[string]map[string]IndexArtifact `yaml:"artifacts,omitempty"` // By name and architecture
+}
+
+type IndexArtifact struct {
+	Path   string `yaml:"path"` // Relative to the component directory
+	SHA256 string `yaml:"sha256"`
+	Size   int64  `yaml:"size"`
+}
+
+// indexArchAll is the architecture of the artifacts which work on all the architectures
+const indexArchAll = "all"
+
+var sha256Regexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// indexedFS is the filesystem of a component with an index, the artifacts are checked against their
+// digest and size when read
+type indexedFS struct {
+	fs.FS
+	index     ComponentIndex
+	artifacts map[string]IndexArtifact // By path
+}
+
+// openIndexedFS returns the component filesystem with its index, or the filesystem itself if the
+// component has no index.yaml
+func openIndexedFS(componentFS fs.FS, name string) (fs.FS, error) {
+	content, err := fs.ReadFile(componentFS, "index.yaml")
+	if errors.Is(err, fs.ErrNotExist) {
+		return componentFS, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read component %s index: %w", name, err)
+	}
+
+	var index ComponentIndex
+	err = unmarshalStrict(content, &index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal component file %s/index.yaml: %w", name, err)
+	}
+	artifacts, err := index.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid component %s index: %w", name, err)
+	}
+
+	return &indexedFS{FS: componentFS, index: index, artifacts: artifacts}, nil
+}
+
+// validate checks the artifacts of the index, it returns them by path
+func (i ComponentIndex) validate() (map[string]IndexArtifact, error) {
+	artifacts := make(map[string]IndexArtifact)
+	for _, version := range slices.Sorted(maps.Keys(i.Versions)) {
+		for name, variants := range i.Versions[version].Artifacts {
+			for arch, artifact := range variants {
+				if !fs.ValidPath(artifact.Path) || artifact.Path == "." {
+					return nil, fmt.Errorf("artifact %s %s %s: invalid path %q", version, name, arch, artifact.Path)
+				}
+				if !sha256Regexp.MatchString(artifact.SHA256) {
+					return nil, fmt.Errorf("artifact %s %s %s: invalid sha256 %q", version, name, arch, artifact.SHA256)
+				}
+				if artifact.Size < 0 {
+					return nil, fmt.Errorf("artifact %s %s %s: invalid size %d", version, name, arch, artifact.Size)
+				}
+				// The artifacts shared by the versions must be the same file
+				if existing, ok := artifacts[artifact.Path]; ok && existing != artifact {
+					return nil, fmt.Errorf("artifact %s %s %s: path %s is listed with a different digest or size", version, name, arch, artifact.Path)
+				}
+				artifacts[artifact.Path] = artifact
+			}
+		}
+	}
+	return artifacts, nil
+}
+
+// artifact returns the artifact of the version for the architecture, or the one for all the
+// architectures
+func (i ComponentIndex) artifact(version, name, arch string) (IndexArtifact, error) {
+	indexVersion, ok := i.Versions[version]
+	if !ok {
+		return IndexArtifact{}, fmt.Errorf("version %s not found in the component index", version)
+	}
+	variants, ok := indexVersion.Artifacts[name]
+	if !ok {
+		return IndexArtifact{}, fmt.Errorf("artifact %s not found for version %s", name, version)
+	}
+	if artifact, ok := variants[arch]; ok {
+		return artifact, nil
+	}
+	if artifact, ok := variants[indexArchAll]; ok {
+		return artifact, nil
+	}
+	return IndexArtifact{}, fmt.Errorf("artifact %s %s not available for %s", name, version, arch)
+}
+
+// componentIndex returns the indexed filesystem of the component, also when it is verified against
+// its provenance
+func componentIndex(componentFS fs.FS) (*indexedFS, bool) {
+	if attested, ok := componentFS.(*attestedFS); ok {
+		componentFS = attested.FS
+	}
+	indexed, ok := componentFS.(*indexedFS)
+	return indexed, ok
+}
+
+// ReadFile reads the file, the artifacts of the index are checked against their size and digest
+func (f *indexedFS) ReadFile(name string) ([]byte, error) {
+	content, err := fs.ReadFile(f.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	artifact, ok := f.artifacts[name]
+	if !ok {
+		return content, nil
+	}
+	if int64(len(content)) != artifact.Size {
+		return nil, fmt.Errorf("artifact %s size mismatch: expected %d, got %d", name, artifact.Size, len(content))
+	}
+	digest := sha256.Sum256(content)
+	if expected, _ := hex.DecodeString(artifact.SHA256); !bytes.Equal(digest[:], expected) {
+		return nil, fmt.Errorf("artifact %s digest mismatch: expected %s, got %x", name, artifact.SHA256, digest)
+	}
+	return content, nil
+}
+
+// sourceName returns the name of the file source, used as base name of the directory destinations
+func (f ComponentFile) sourceName() string {
+	if f.Artifact != "" {
+		return f.Artifact
+	}
+	return f.Src
+}
+
+// componentFileSource returns the path of the file source in the component filesystem: the artifact
+// of the index for the version and the architecture, or the templated src
+func componentFileSource(componentFS fs.FS, file ComponentFile, version string) (string, error) {
+	if file.Artifact == "" {
+		return templateComponentPath(file.Src, version)
+	}
+	if file.Src != "" {
+		return "", fmt.Errorf("file %s: src and artifact are exclusive", file.Src)
+	}
+	indexed, ok := componentIndex(componentFS)
+	if !ok {
+		return "", fmt.Errorf("artifact %s requires the component index.yaml", file.Artifact)
+	}
+	artifact, err := indexed.index.artifact(trimVersion(version), file.Artifact, runtime.GOARCH)
+	if err != nil {
+		return "", err
+	}
+	return artifact.Path, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestComponentIndex(t *testing.T) {
+	kubelet := []byte("kubelet binary")
+	digest := sha256.Sum256(kubelet)
+	index := fmt.Sprintf(`versions:
+  1.31.2:
+    artifacts:
+      kubelet:
+        %[1]s: {path: 1.31.2/%[1]s/kubelet, sha256: %[2]s, size: %[3]d}
+        other: {path: 1.31.2/other/kubelet, sha256: %[2]s, size: %[3]d}
+      kubelet.service:
+        all: {path: kubelet.service, sha256: %[2]s, size: %[3]d}
+  1.32.0:
+    artifacts:
+      kubelet:
+        %[1]s: {path: 1.32.0/%[1]s/kubelet, sha256: %[2]s, size: %[3]d}
+`, runtime.GOARCH, hex.EncodeToString(digest[:]), len(kubelet))
+	repoFS := fstest.MapFS{
+		"kubelet/index.yaml": {Data: []byte(index)},
+		"kubelet/metadata.yaml": {Data: []byte(`defaults:
+  install:
+    - files:
+        - {state: file, artifact: kubelet, dst: /usr/bin/}
+versions:
+  1.30.6: {}
+  1.32.0:
+    template_functions: [indent]
+`)},
+		"kubelet/1.31.2/" + runtime.GOARCH + "/kubelet": {Data: kubelet},
+		"kubelet/1.32.0/" + runtime.GOARCH + "/kubelet": {Data: []byte("tampered binary")},
+		"kubelet/kubelet.service":                       {Data: kubelet},
+	}
+
+	// The versions available are the ones of the index, with the sections of the metadata
+	versions, err := componentVersions(repoFS, "kubelet")
+	if err != nil || !slices.Equal(slices.Sorted(slices.Values(versions)), []string{"1.31.2", "1.32.0"}) {
+		t.Errorf("unexpected versions %v, %v", versions, err)
+	}
+	sections, err := componentMetadata(repoFS, "kubelet", "1.31.2~1")
+	if err != nil || len(sections.Install) != 1 || sections.Install[0].Files[0].Artifact != "kubelet" {
+		t.Errorf("unexpected sections %+v, %v", sections, err)
+	}
+	sections, err = componentMetadata(repoFS, "kubelet", "1.32.0")
+	if err != nil || !slices.Equal(sections.TemplateFunctions, []string{"indent"}) {
+		t.Errorf("unexpected sections %+v, %v", sections, err)
+	}
+
+	// The artifacts are resolved for the architecture, and checked when read
+	componentFS, err := openComponentFS(repoFS, "kubelet")
+	if err != nil {
+		t.Fatalf("failed to open component: %v", err)
+	}
+	tests := []struct {
+		name     string
+		file     ComponentFile
+		version  string
+		expected string
+		err      string
+	}{
+		{name: "architecture", file: ComponentFile{Artifact: "kubelet"}, version: "1.31.2~1", expected: "1.31.2/" + runtime.GOARCH + "/kubelet"},
+		{name: "all architectures", file: ComponentFile{Artifact: "kubelet.service"}, version: "1.31.2", expected: "kubelet.service"},
+		{name: "templated src", file: ComponentFile{Src: "{{ .Version }}/config.yaml"}, version: "1.31.2", expected: "1.31.2/config.yaml"},
+		{name: "digest mismatch", file: ComponentFile{Artifact: "kubelet"}, version: "1.32.0", expected: "1.32.0/" + runtime.GOARCH + "/kubelet", err: "size mismatch"},
+		{name: "unknown artifact", file: ComponentFile{Artifact: "kubectl"}, version: "1.31.2", err: "artifact kubectl not found"},
+		{name: "unknown version", file: ComponentFile{Artifact: "kubelet"}, version: "1.30.6", err: "version 1.30.6 not found"},
+		{name: "src and artifact", file: ComponentFile{Src: "kubelet", Artifact: "kubelet"}, version: "1.31.2", err: "exclusive"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src, err := componentFileSource(componentFS, test.file, test.version)
+			if err == nil && test.file.Artifact != "" {
+				_, err = fs.ReadFile(componentFS, src)
+			}
+			if src != test.expected {
+				t.Errorf("expected source %q, got %q", test.expected, src)
+			}
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// The artifacts require an index
+	_, err = componentFileSource(fstest.MapFS{}, ComponentFile{Artifact: "kubelet"}, "1.31.2")
+	if err == nil || !strings.Contains(err.Error(), "requires the component index.yaml") {
+		t.Errorf("expected an index error, got %v", err)
+	}
+}
+
+func TestComponentIndexFallback(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+	index := fmt.Sprintf(`versions:
+  1.31.2:
+    artifacts:
+      kubelet:
+        all: {path: 1.31.2/kubelet, sha256: %[1]s, size: 10}
+  1.31.4:
+    artifacts:
+      kubelet:
+        all: {path: 1.31.4/kubelet, sha256: %[1]s, size: 10}
+  1.32.0:
+    artifacts:
+      kubelet:
+        all: {path: 1.32.0/kubelet, sha256: %[1]s, size: 10}
+`, digest)
+	repoFS := fstest.MapFS{
+		"kubelet/index.yaml": {Data: []byte(index)},
+		"kubelet/metadata.yaml": {Data: []byte(`fallback: [nearest_lower_patch, default]
+versions:
+  1.31.0:
+    template_functions: [indent]
+  1.31.4:
+    template_functions: [quote]
+  default:
+    template_functions: [trim]
+`)},
+	}
+
+	// The default key is not an available version, and the versions missing from the index are dropped
+	versions, err := componentVersions(repoFS, "kubelet")
+	if err != nil || !slices.Equal(slices.Sorted(slices.Values(versions)), []string{"1.31.2", "1.31.4", "1.32.0"}) {
+		t.Errorf("unexpected versions %v, %v", versions, err)
+	}
+
+	// The versions of the index without sections use the ones of their fallback version
+	tests := []struct {
+		version  string
+		expected []string
+		err      string
+	}{
+		{version: "1.31.2", expected: []string{"indent"}},
+		{version: "1.31.4", expected: []string{"quote"}},
+		{version: "1.32.0", expected: []string{"trim"}},
+		{version: "1.31.3", err: "version 1.31.3 not found in index"},
+	}
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			sections, err := componentMetadata(repoFS, "kubelet", test.version)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(sections.TemplateFunctions, test.expected) {
+				t.Errorf("expected template functions %v, got %+v, %v", test.expected, sections.TemplateFunctions, err)
+			}
+		})
+	}
+}
+
+func TestComponentIndexValidate(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+	tests := []struct {
+		name     string
+		artifact IndexArtifact
+		err      string
+	}{
+		{name: "valid", artifact: IndexArtifact{Path: "1.31.2/kubelet", SHA256: digest, Size: 10}},
+		{name: "invalid path", artifact: IndexArtifact{Path: "../kubectl/kubectl", SHA256: digest}, err: "invalid path"},
+		{name: "absolute path", artifact: IndexArtifact{Path: "/usr/bin/kubelet", SHA256: digest}, err: "invalid path"},
+		{name: "invalid digest", artifact: IndexArtifact{Path: "kubelet", SHA256: "abc"}, err: "invalid sha256"},
+		{name: "invalid size", artifact: IndexArtifact{Path: "kubelet", SHA256: digest, Size: -1}, err: "invalid size"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			index := ComponentIndex{Versions: map[string]IndexVersion{"1.31.2": {Artifacts: map[string]map[string]IndexArtifact{"kubelet": {"amd64": test.artifact}}}}}
+			_, err := index.validate()
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// A path shared by the versions is the same artifact
+	index := ComponentIndex{Versions: map[string]IndexVersion{
+		"1.31.2": {Artifacts: map[string]map[string]IndexArtifact{"kubelet.service": {"all": {Path: "kubelet.service", SHA256: digest}}}},
+		"1.32.0": {Artifacts: map[string]map[string]IndexArtifact{"kubelet.service": {"all": {Path: "kubelet.service", SHA256: strings.Repeat("b", 64)}}}},
+	}}
+	_, err := index.validate()
+	if err == nil || !strings.Contains(err.Error(), "different digest") {
+		t.Errorf("expected a shared path error, got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ComponentKernel declares the kernel command line parameters of a component (or of the node),
+// they are added to the GRUB configuration and take effect on the next boot
+//
+//	kernel:
+//	  state: present
+//	  cmdline: [hugepagesz=1G, hugepages=16, iommu=pt]
+type ComponentKernel struct {
+	State   string   `yaml:"state" json:"state"` // present or absent
+	Cmdline []string `yaml:"cmdline,omitempty" json:"cmdline,omitempty"`
+}
+
+// kernelGrubDir holds the GRUB configuration drop-ins, sourced by update-grub
+const kernelGrubDir = "/etc/default/grub.d"
+
+// rebootRequiredFile signals a reboot is required, as done by the package manager
+const rebootRequiredFile = "/var/run/reboot-required"
+
+// kernelParamRegexp matches the parameters safe to write in the GRUB configuration, which is a shell script
+var kernelParamRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+(=[A-Za-z0-9_.,:/+=-]+)?$`)
+
+// kernelGrubPrefix is the line of the drop-ins appending the parameters to the command line
+const kernelGrubPrefix = `GRUB_CMDLINE_LINUX="$GRUB_CMDLINE_LINUX `
+
+func kernelGrubFile(owner string) string {
+	return filepath.Join(kernelGrubDir, fmt.Sprintf("90-scw-k8s-%s.cfg", owner))
+}
+
+// processKernel applies or reverts the kernel parameters owned by a component (or "node"), a reboot
+// is signaled when the GRUB configuration changes
+func processKernel(logger *slog.Logger, owner string, kernel *ComponentKernel) error {
+	if kernel == nil {
+		return nil
+	}
+
+	var content []byte
+	switch kernel.State {
+	case "", "present":
+		for _, param := range kernel.Cmdline {
+			if !kernelParamRegexp.MatchString(param) {
+				return fmt.Errorf("invalid kernel parameter %q", param)
+			}
+		}
+		content = []byte(fmt.Sprintf("# %s\n%s%s\"\n", managedHeaderText, kernelGrubPrefix, strings.Join(kernel.Cmdline, " ")))
+	case "absent":
+	default:
+		return fmt.Errorf("unknown kernel state: %s", kernel.State)
+	}
+
+	// Only update GRUB when the parameters change, so the reboot is only required once
+	path := kernelGrubFile(owner)
+	current, err := os.ReadFile(hostPath(path))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if bytes.Equal(current, content) || (content == nil && errors.Is(err, fs.ErrNotExist)) {
+		return nil
+	}
+
+	if content == nil {
+		err = os.Remove(hostPath(path))
+	} else {
+		err = os.MkdirAll(hostPath(kernelGrubDir), defaultDirectoryMode)
+		if err == nil {
+			err = os.WriteFile(hostPath(path), content, 0644)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", path, err)
+	}
+
+	cmd := command("/usr/sbin/update-grub")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to update GRUB: %w: %s", err, output)
+	}
+
+	err = os.WriteFile(hostPath(rebootRequiredFile), nil, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to signal reboot required: %w", err)
+	}
+	logger.Warn("Kernel parameters changed, reboot required", slog.String("owner", owner), slog.Any("cmdline", kernel.Cmdline), slog.String("state", kernel.State))
+
+	return nil
+}
+
+// pendingKernelParams returns the parameters of the GRUB drop-ins not in the running kernel command line,
+// and the ones of them not applied by a reboot, the drop-in being changed before the node booted
+func pendingKernelParams() ([]string, []string, error) {
+	dropins, err := filepath.Glob(hostPath(kernelGrubFile("*")))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list kernel parameters: %w", err)
+	}
+	if len(dropins) == 0 {
+		return nil, nil, nil
+	}
+
+	cmdline, err := os.ReadFile(hostPath("/proc/cmdline"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read kernel command line: %w", err)
+	}
+	running := strings.Fields(string(cmdline))
+
+	bootTime, err := nodeBootTime()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pending, notApplied []string
+	for _, dropin := range dropins {
+		info, err := os.Stat(dropin)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to stat %s: %w", nodePath(dropin), err)
+		}
+		rebooted := info.ModTime().Before(bootTime)
+
+		content, err := os.ReadFile(dropin)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", nodePath(dropin), err)
+		}
+		for line := range strings.Lines(string(content)) {
+			params, ok := strings.CutPrefix(strings.TrimSpace(line), kernelGrubPrefix)
+			if !ok {
+				continue
+			}
+			for _, param := range strings.Fields(strings.TrimSuffix(params, `"`)) {
+				if slices.Contains(running, param) {
+					continue
+				}
+				pending = append(pending, param)
+				if rebooted {
+					notApplied = append(notApplied, param)
+				}
+			}
+		}
+	}
+
+	return pending, notApplied, nil
+}
+
+// nodeBootTime returns the boot time of the node, from the btime line of /proc/stat
+func nodeBootTime() (time.Time, error) {
+	stat, err := os.ReadFile(hostPath("/proc/stat"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read kernel statistics: %w", err)
+	}
+	for line := range strings.Lines(string(stat)) {
+		btime, ok := strings.CutPrefix(strings.TrimSpace(line), "btime ")
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.ParseInt(btime, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid boot time %q: %w", btime, err)
+		}
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, errors.New("boot time not found in kernel statistics")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestKernelParameters(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	for _, dir := range []string{"proc", "var/run"} {
+		err := os.MkdirAll(filepath.Join(rootDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(rootDir, "proc/cmdline"), []byte("BOOT_IMAGE=/vmlinuz ro iommu=pt\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = os.WriteFile(filepath.Join(rootDir, "proc/stat"), fmt.Appendf(nil, "cpu  1 2 3\nbtime %d\nprocesses 42\n", bootTime.Unix()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying the same parameters twice only updates GRUB once
+	kernel := &ComponentKernel{Cmdline: []string{"iommu=pt", "hugepagesz=1G", "hugepages=16"}}
+	for range 2 {
+		err = processKernel(slog.Default(), "node", kernel)
+		if err != nil {
+			t.Fatalf("failed to process kernel parameters: %v", err)
+		}
+	}
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(commands), "update-grub") != 1 {
+		t.Errorf("expected a single GRUB update, got commands %q", commands)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, rebootRequiredFile))
+	if err != nil {
+		t.Errorf("reboot required not signaled: %v", err)
+	}
+
+	pending, notApplied, err := pendingKernelParams()
+	if err != nil {
+		t.Fatalf("failed to get pending kernel parameters: %v", err)
+	}
+	if !reflect.DeepEqual(pending, []string{"hugepagesz=1G", "hugepages=16"}) || len(notApplied) != 0 {
+		t.Errorf("pending kernel parameters = %v, not applied %v", pending, notApplied)
+	}
+
+	// The parameters still missing once the node rebooted are not applied
+	err = os.Chtimes(hostPath(kernelGrubFile("node")), time.Time{}, bootTime.Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, notApplied, err = pendingKernelParams()
+	if err != nil || !reflect.DeepEqual(notApplied, []string{"hugepagesz=1G", "hugepages=16"}) {
+		t.Errorf("not applied kernel parameters = %v, %v", notApplied, err)
+	}
+
+	// The parameters are written to a shell script
+	err = processKernel(slog.Default(), "node", &ComponentKernel{Cmdline: []string{`quiet"; rm -rf /`}})
+	if err == nil {
+		t.Error("expected an error for an unsafe kernel parameter")
+	}
+}
+
+func TestUninstallComponentKernelParameters(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	for _, dir := range []string{"/var/run", "/etc"} {
+		err := os.MkdirAll(hostPath(dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := SetComponentVersion("nvidia-driver", "550.127.05")
+	if err == nil {
+		err = processKernel(slog.Default(), "nvidia-driver", &ComponentKernel{Cmdline: []string{"iommu=pt"}})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The drop-in of the component is removed with it, its uninstall does not declare the parameters
+	repoFS := fstest.MapFS{"nvidia-driver/metadata.yaml": {Data: []byte("versions:\n  550.127.05: {}\n")}}
+	err = uninstallComponents(context.Background(), repoFS, []Component{{Name: "nvidia-driver", Version: "570.86.15"}}, NodeMetadata{RepoURI: "https://repo"})
+	if err != nil {
+		t.Fatalf("failed to uninstall components: %v", err)
+	}
+	_, err = os.Stat(hostPath(kernelGrubFile("nvidia-driver")))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the kernel drop-in removed, got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Kubeconfig is a node-scoped kubeconfig rendered by the agent from the node metadata, authenticated
+// with the node token. It is rendered again when the cluster CA or the token change.
+//
+// The kubeconfig holds the node token, so it is always written with mode 0600, in one of the
+// kubeconfigDirs. The kubeconfig of the node metadata is owned by root.
+//
+// In the node metadata, eg: for debugging on the node
+//
+//	"kubeconfig": {
+//	   "path": "/root/.kube/config"
+//	}
+//
+// In a component metadata, instead of rendering the kubeconfig from a template
+//
+//	files:
+//	  - state: kubeconfig
+//	    dst: /etc/kubernetes/node-problem-detector.kubeconfig
+//	    owner: npd
+type Kubeconfig struct {
+	Path  string `json:"path"`
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+const kubeconfigMode = "0600"
+
+// kubeconfigDirs are the directories the kubeconfigs can be written to
+var kubeconfigDirs = []string{"/etc/kubernetes", "/root/.kube"}
+
+// JSON File template to store the kubeconfigs rendered by the agent, they are rendered again on rotation
+//
+//	{
+//	   "/root/.kube/config": {"path": "/root/.kube/config", "mode": "0600"}
+//	}
+var kubeconfigsFile = filepath.Join(stateDir, "kubeconfigs.json")
+
+// renderKubeconfig renders the kubeconfig of the node, the CA bundle is inlined
+func renderKubeconfig(nodeMetadata NodeMetadata) ([]byte, error) {
+	if nodeMetadata.ClusterURL == "" {
+		return nil, fmt.Errorf("no cluster URL in the node metadata")
+	}
+	bundle, err := decodeClusterCA(nodeMetadata.ClusterCA)
+	if err != nil {
+		return nil, err
+	}
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters["cluster"] = &clientcmdapi.Cluster{
+		Server:                   nodeMetadata.ClusterURL,
+		CertificateAuthorityData: bundle,
+	}
+	config.AuthInfos["node"] = &clientcmdapi.AuthInfo{Token: nodeMetadata.Token}
+	config.Contexts["node"] = &clientcmdapi.Context{Cluster: "cluster", AuthInfo: "node"}
+	config.CurrentContext = "node"
+
+	content, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal kubeconfig: %w", err)
+	}
+
+	return content, nil
+}
+
+// writeKubeconfig renders the kubeconfig and records it so it is rendered again on rotation, it
+// returns false if the kubeconfig is unchanged
+func writeKubeconfig(kubeconfig Kubeconfig, nodeMetadata NodeMetadata) (bool, error) {
+	if kubeconfig.Path == "" {
+		return false, fmt.Errorf("no kubeconfig path")
+	}
+	if !slices.ContainsFunc(kubeconfigDirs, func(dir string) bool {
+		return strings.HasPrefix(filepath.Clean(kubeconfig.Path), dir+"/")
+	}) {
+		return false, fmt.Errorf("kubeconfig %s is not in %s", kubeconfig.Path, strings.Join(kubeconfigDirs, ", "))
+	}
+
+	content, err := renderKubeconfig(nodeMetadata)
+	if err != nil {
+		return false, err
+	}
+
+	// Record the kubeconfig before writing it, so a kubeconfig partially written is rendered again
+	kubeconfigs, err := loadKubeconfigs()
+	if err != nil {
+		return false, err
+	}
+	if kubeconfigs[kubeconfig.Path] != kubeconfig {
+		kubeconfigs[kubeconfig.Path] = kubeconfig
+		err = saveKubeconfigs(kubeconfigs)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	current, err := os.ReadFile(hostPath(kubeconfig.Path))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("failed to read kubeconfig %s: %w", kubeconfig.Path, err)
+	}
+	changed := !bytes.Equal(current, content)
+
+	// The mode and ownership are also ensured when the content is unchanged
+	err = os.MkdirAll(hostPath(filepath.Dir(kubeconfig.Path)), defaultDirectoryMode)
+	if err != nil {
+		return false, fmt.Errorf("failed to create kubeconfig directory: %w", err)
+	}
+	err = installContent(kubeconfig.Path, content, kubeconfigMode, kubeconfig.Owner, kubeconfig.Group)
+	if err != nil {
+		return false, fmt.Errorf("failed to write kubeconfig %s: %w", kubeconfig.Path, err)
+	}
+
+	return changed, nil
+}
+
+// syncNodeKubeconfig renders the kubeconfig of the node metadata. The node kubeconfig rendered before at
+// another path, or no longer set, is removed and forgotten since it holds the node token.
+func syncNodeKubeconfig(nodeMetadata NodeMetadata) error {
+	var path string
+	if nodeMetadata.Kubeconfig != nil {
+		path = nodeMetadata.Kubeconfig.Path
+		_, err := writeKubeconfig(Kubeconfig{Path: path}, nodeMetadata)
+		if err != nil {
+			return fmt.Errorf("failed to write node kubeconfig: %w", err)
+		}
+	}
+
+	kubeconfigs, err := loadKubeconfigs()
+	if err != nil {
+		return err
+	}
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		return err
+	}
+	for _, previous := range slices.Sorted(maps.Keys(kubeconfigs)) {
+		// The kubeconfigs of the components are their managed files
+		if _, ok := managedFiles[previous]; ok || previous == path {
+			continue
+		}
+		err = os.Remove(hostPath(previous))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove node kubeconfig %s: %w", previous, err)
+		}
+		err = forgetKubeconfig(previous)
+		if err != nil {
+			return err
+		}
+		slog.Info("Node kubeconfig removed", slog.String("path", previous))
+	}
+
+	return nil
+}
+
+// rotateKubeconfigs renders again the kubeconfigs written by the agent, with the current cluster CA
+// and token. It returns the kubeconfigs changed. The kubeconfigs removed since, eg: by the uninstall
+// of their component, are forgotten instead of written again.
+func rotateKubeconfigs(nodeMetadata NodeMetadata) ([]string, error) {
+	kubeconfigs, err := loadKubeconfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	var rotated []string
+	for _, path := range slices.Sorted(maps.Keys(kubeconfigs)) {
+		_, err = os.Lstat(hostPath(path))
+		if errors.Is(err, fs.ErrNotExist) {
+			err = forgetKubeconfig(path)
+			if err != nil {
+				return rotated, err
+			}
+			continue
+		}
+		if err != nil {
+			return rotated, fmt.Errorf("failed to check kubeconfig %s: %w", path, err)
+		}
+
+		changed, err := writeKubeconfig(kubeconfigs[path], nodeMetadata)
+		if err != nil {
+			return rotated, err
+		}
+		if changed {
+			slog.Info("Kubeconfig rotated", slog.String("path", path))
+			rotated = append(rotated, path)
+		}
+	}
+
+	return rotated, nil
+}
+
+// forgetKubeconfig stops rotating the kubeconfig, eg: once removed by its component
+func forgetKubeconfig(path string) error {
+	kubeconfigs, err := loadKubeconfigs()
+	if err != nil {
+		return err
+	}
+	if _, ok := kubeconfigs[path]; !ok {
+		return nil
+	}
+	delete(kubeconfigs, path)
+
+	return saveKubeconfigs(kubeconfigs)
+}
+
+func loadKubeconfigs() (map[string]Kubeconfig, error) {
+	kubeconfigs := make(map[string]Kubeconfig)
+
+	jsonKubeconfigs, err := os.ReadFile(hostPath(kubeconfigsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return kubeconfigs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfigs: %w", err)
+	}
+
+	err = json.Unmarshal(jsonKubeconfigs, &kubeconfigs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal kubeconfigs: %w", err)
+	}
+
+	return kubeconfigs, nil
+}
+
+func saveKubeconfigs(kubeconfigs map[string]Kubeconfig) error {
+	jsonKubeconfigs, err := json.Marshal(kubeconfigs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal kubeconfigs: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = os.WriteFile(hostPath(kubeconfigsFile), jsonKubeconfigs, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write kubeconfigs: %w", err)
+	}
+
+	return nil
+}
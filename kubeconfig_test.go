@@ -0,0 +1,160 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestWriteKubeconfig(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	nodeMetadata := NodeMetadata{ClusterURL: "https://cluster.example.com:6443", ClusterCA: testCA(t, "kubernetes"), Token: "token"}
+	kubeconfig := Kubeconfig{Path: "/root/.kube/config"}
+
+	// The kubeconfig is only changed once
+	for i, want := range []bool{true, false} {
+		changed, err := writeKubeconfig(kubeconfig, nodeMetadata)
+		if err != nil {
+			t.Fatalf("failed to write kubeconfig: %v", err)
+		}
+		if changed != want {
+			t.Errorf("writeKubeconfig() call %d = %v, want %v", i, changed, want)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(rootDir, kubeconfig.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("kubeconfig mode = %v, want 0600", info.Mode().Perm())
+	}
+	config, err := clientcmd.LoadFromFile(filepath.Join(rootDir, kubeconfig.Path))
+	if err != nil {
+		t.Fatalf("invalid kubeconfig: %v", err)
+	}
+	current := config.Contexts[config.CurrentContext]
+	if current == nil || config.Clusters[current.Cluster].Server != nodeMetadata.ClusterURL || config.AuthInfos[current.AuthInfo].Token != "token" {
+		t.Errorf("unexpected kubeconfig %+v", config)
+	}
+
+	// The kubeconfig follows the token and CA changes
+	nodeMetadata.Token = "rotated"
+	rotated, err := rotateKubeconfigs(nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to rotate kubeconfigs: %v", err)
+	}
+	if !reflect.DeepEqual(rotated, []string{kubeconfig.Path}) {
+		t.Errorf("rotateKubeconfigs() = %v", rotated)
+	}
+
+	// A forgotten kubeconfig is not rotated anymore
+	err = forgetKubeconfig(kubeconfig.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeMetadata.Token = "rotated-again"
+	rotated, err = rotateKubeconfigs(nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to rotate kubeconfigs: %v", err)
+	}
+	if len(rotated) != 0 {
+		t.Errorf("rotateKubeconfigs() = %v, want none", rotated)
+	}
+
+	// The kubeconfig requires the cluster URL and CA
+	_, err = writeKubeconfig(kubeconfig, NodeMetadata{ClusterCA: nodeMetadata.ClusterCA})
+	if err == nil {
+		t.Error("expected an error without cluster URL")
+	}
+
+	// The kubeconfig holding the node token is only written in the kubeconfig directories
+	for _, path := range []string{"/etc/cron.d/kubeconfig", "/etc/kubernetes/../cron.d/kubeconfig", "/etc/kubernetes"} {
+		_, err = writeKubeconfig(Kubeconfig{Path: path}, nodeMetadata)
+		if err == nil {
+			t.Errorf("expected kubeconfig %s refused", path)
+		}
+	}
+}
+
+func TestSyncNodeKubeconfig(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	nodeMetadata := NodeMetadata{ClusterURL: "https://cluster.example.com:6443", ClusterCA: testCA(t, "kubernetes"), Token: "token"}
+	nodeMetadata.Kubeconfig = &Kubeconfig{Path: "/root/.kube/config"}
+	err := syncNodeKubeconfig(nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to sync node kubeconfig: %v", err)
+	}
+
+	// The kubeconfig of a component is kept
+	_, err = writeKubeconfig(Kubeconfig{Path: "/etc/kubernetes/npd.kubeconfig"}, nodeMetadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recordManagedFile("/etc/kubernetes/npd.kubeconfig", "npd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The previous node kubeconfig is removed once moved, and not rotated anymore
+	nodeMetadata.Kubeconfig = &Kubeconfig{Path: "/etc/kubernetes/node.kubeconfig"}
+	err = syncNodeKubeconfig(nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to sync node kubeconfig: %v", err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, "/root/.kube/config"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the previous node kubeconfig removed, got %v", err)
+	}
+	kubeconfigs, err := loadKubeconfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := slices.Sorted(maps.Keys(kubeconfigs)); !slices.Equal(paths, []string{"/etc/kubernetes/node.kubeconfig", "/etc/kubernetes/npd.kubeconfig"}) {
+		t.Errorf("tracked kubeconfigs = %v", paths)
+	}
+
+	// The node kubeconfig is removed once unset
+	nodeMetadata.Kubeconfig = nil
+	err = syncNodeKubeconfig(nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to sync node kubeconfig: %v", err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, "/etc/kubernetes/node.kubeconfig"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the node kubeconfig removed, got %v", err)
+	}
+
+	// A kubeconfig removed since, eg: by its component uninstall, is not written again
+	err = os.Remove(filepath.Join(rootDir, "/etc/kubernetes/npd.kubeconfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := rotateKubeconfigs(nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to rotate kubeconfigs: %v", err)
+	}
+	if len(rotated) != 0 {
+		t.Errorf("rotateKubeconfigs() = %v, want none", rotated)
+	}
+	kubeconfigs, err = loadKubeconfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kubeconfigs) != 0 {
+		t.Errorf("expected no kubeconfig tracked, got %v", kubeconfigs)
+	}
+}
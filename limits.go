@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ResourceLimits are the limits the agent imposes on itself during the installs,
+// so an upgrade on a busy node does not steal resources from the running pods
+//
+//	{
+//	   "memory_limit": "256MiB",
+//	   "nice": 10,
+//	   "io_class": "idle",
+//	   "slice": "scw-k8s-agent.slice"
+//	}
+type ResourceLimits struct {
+	MemoryLimit string `json:"memory_limit,omitempty"` // Soft memory limit of the agent, in the GOMEMLIMIT format
+	Nice        int    `json:"nice,omitempty"`         // Niceness of the agent, its downloads and scripts
+	IOClass     string `json:"io_class,omitempty"`     // I/O scheduling class: best-effort or idle
+	Slice       string `json:"slice,omitempty"`        // systemd slice the component scripts are run in
+}
+
+// I/O priority constants, see ioprio_set(2)
+const (
+	ioprioWhoProcess     = 1
+	ioprioClassShift     = 13
+	ioprioClassBE        = 2
+	ioprioClassIdle      = 3
+	ioprioLowestPriority = 7
+)
+
+// applyResourceLimits sets the memory limit and lowers the CPU and I/O priorities of the agent, the
+// scripts executed by the agent inherit the priorities. The limits apply to the whole process, so the
+// returned function restores the previous ones once the install is done.
+func applyResourceLimits(limits *ResourceLimits) (func(), error) {
+	if limits == nil {
+		return func() {}, nil
+	}
+
+	memoryLimit := int64(-1)
+	if limits.MemoryLimit != "" {
+		var err error
+		memoryLimit, err = parseMemoryLimit(limits.MemoryLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ioprio int
+	switch limits.IOClass {
+	case "":
+	case "best-effort":
+		ioprio = ioprioClassBE<<ioprioClassShift | ioprioLowestPriority
+	case "idle":
+		ioprio = ioprioClassIdle << ioprioClassShift
+	default:
+		return nil, fmt.Errorf("unknown I/O class: %s", limits.IOClass)
+	}
+
+	// Save the current limits, the kernel returns the niceness as 20 - nice
+	previousPriority, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get agent niceness: %w", err)
+	}
+	previousNice := 20 - previousPriority
+	previousIOPrio, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("failed to get agent I/O priority: %w", errno)
+	}
+
+	// A negative limit only reads the current one
+	previousMemoryLimit := debug.SetMemoryLimit(memoryLimit)
+	err = setThreadsPriorities(limits.Nice != 0, limits.Nice, ioprio != 0, ioprio)
+	if err != nil {
+		debug.SetMemoryLimit(previousMemoryLimit)
+		return nil, err
+	}
+
+	slog.Info("Resource limits applied", slog.String("memory_limit", limits.MemoryLimit), slog.Int("nice", limits.Nice), slog.String("io_class", limits.IOClass))
+
+	restore := func() {
+		debug.SetMemoryLimit(previousMemoryLimit)
+		err := setThreadsPriorities(limits.Nice != 0, previousNice, ioprio != 0, int(previousIOPrio))
+		if err != nil {
+			slog.Warn("Failed to restore resource limits", slog.Any("error", err))
+			return
+		}
+		slog.Info("Resource limits restored")
+	}
+	return restore, nil
+}
+
+// setThreadsPriorities sets the niceness and the I/O priority of all the agent threads, the priorities
+// are per thread on Linux and the threads created later inherit them
+func setThreadsPriorities(setNice bool, nice int, setIOPrio bool, ioprio int) error {
+	if !setNice && !setIOPrio {
+		return nil
+	}
+
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("failed to list agent threads: %w", err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if setNice {
+			err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+			if err != nil {
+				slog.Warn("Failed to set agent niceness", slog.Int("tid", tid), slog.Any("error", err))
+			}
+		}
+		if setIOPrio {
+			_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio))
+			if errno != 0 {
+				slog.Warn("Failed to set agent I/O priority", slog.Int("tid", tid), slog.Any("error", errno))
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseMemoryLimit parses a memory limit in the GOMEMLIMIT format, eg: 256MiB
+func parseMemoryLimit(limit string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"TiB", 1 << 40},
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+		{"B", 1},
+	}
+
+	multiplier := int64(1)
+	number := limit
+	for _, unit := range units {
+		if trimmed, ok := strings.CutSuffix(limit, unit.suffix); ok {
+			number, multiplier = trimmed, unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid memory limit %q", limit)
+	}
+
+	return value * multiplier, nil
+}
+
+// scriptCommand returns the command executing the script, in the configured slice if any. The
+// scripts run in the alternate root are not limited, they are not run by systemd.
+func scriptCommand(script string, limits *ResourceLimits) *exec.Cmd {
+	if limits != nil && limits.Slice != "" && serviceManager != chrootServiceManager {
+		return command("/usr/bin/systemd-run", "--scope", "--quiet", "--slice="+limits.Slice, "--", "/bin/bash", "-c", script)
+	}
+	return command("/bin/bash", "-c", script)
+}
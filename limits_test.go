@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"syscall"
+	"testing"
+)
+
+func TestParseMemoryLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    string
+		expected int64
+		wantErr  bool
+	}{
+		{name: "bytes", limit: "1048576", expected: 1 << 20},
+		{name: "bytes suffix", limit: "512B", expected: 512},
+		{name: "mebibytes", limit: "256MiB", expected: 256 << 20},
+		{name: "gibibytes", limit: "2GiB", expected: 2 << 30},
+		{name: "unknown unit", limit: "256MB", wantErr: true},
+		{name: "negative", limit: "-1MiB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseMemoryLimit(tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMemoryLimit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("parseMemoryLimit() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+// limitsChildEnv runs the resource limits test in a child process, the niceness of the test process
+// itself is left untouched
+const limitsChildEnv = "K8S_AGENT_LIMITS_CHILD"
+
+func TestApplyResourceLimitsRestore(t *testing.T) {
+	if os.Getenv(limitsChildEnv) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestApplyResourceLimitsRestore$", "-test.v")
+		cmd.Env = append(os.Environ(), limitsChildEnv+"=1")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("child process failed: %v\n%s", err, output)
+		}
+		return
+	}
+
+	previousMemoryLimit := debug.SetMemoryLimit(-1)
+	previousPriority, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore, err := applyResourceLimits(&ResourceLimits{MemoryLimit: "256MiB", Nice: 10})
+	if err != nil {
+		t.Fatalf("failed to apply resource limits: %v", err)
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != 256<<20 {
+		t.Errorf("memory limit = %d, expected %d", limit, 256<<20)
+	}
+
+	// The limits apply to the whole agent until the install is done
+	restore()
+	if limit := debug.SetMemoryLimit(-1); limit != previousMemoryLimit {
+		t.Errorf("memory limit = %d, expected %d restored", limit, previousMemoryLimit)
+	}
+	// Lowering the niceness requires CAP_SYS_NICE
+	priority, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err == nil && os.Geteuid() == 0 && priority != previousPriority {
+		t.Errorf("priority = %d, expected %d restored", priority, previousPriority)
+	}
+}
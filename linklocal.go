@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// metadataInterfaceFlag is the -metadata-interface flag value, the interface the user-data endpoint
+// is reached through, since the node metadata is not known yet. The default route interface is used
+// if empty.
+var metadataInterfaceFlag string
+
+// resolveMetadataInterface returns the name and the IPv4 address of the interface selected by name
+// (eg: ens5) or by a CIDR its address is in (eg: 172.16.0.0/22), eg: on the Kosmos hybrid nodes
+// where the default route is not the one to the metadata endpoints
+func resolveMetadataInterface(selector string) (string, net.IP, error) {
+	_, network, err := net.ParseCIDR(selector)
+	if err != nil {
+		network = nil
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+	for _, iface := range interfaces {
+		if network == nil && iface.Name != selector {
+			continue
+		}
+		addresses, err := iface.Addrs()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to list interface %s addresses: %w", iface.Name, err)
+		}
+		for _, address := range addresses {
+			ipNet, ok := address.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			if network == nil || network.Contains(ipNet.IP) {
+				return iface.Name, ipNet.IP, nil
+			}
+		}
+		if network == nil {
+			return "", nil, fmt.Errorf("no IPv4 address on metadata interface %s", selector)
+		}
+	}
+
+	if network != nil {
+		return "", nil, fmt.Errorf("no interface with an address in the metadata interface CIDR %s", selector)
+	}
+	return "", nil, fmt.Errorf("metadata interface %s not found", selector)
+}
+
+// bindToDevice returns the dialer control binding the sockets to the interface, so the requests are
+// routed through it whatever the routes, nil if not set
+func bindToDevice(device string) func(network, address string, conn syscall.RawConn) error {
+	if device == "" {
+		return nil
+	}
+	return func(network, address string, conn syscall.RawConn) error {
+		var bindErr error
+		err := conn.Control(func(fd uintptr) {
+			bindErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+		})
+		if err != nil {
+			return err
+		}
+		if bindErr != nil {
+			return fmt.Errorf("failed to bind to interface %s: %w", device, bindErr)
+		}
+		return nil
+	}
+}
+
+// metadataHTTPClient returns the HTTP client of the node metadata endpoint, through the selected
+// interface if set
+func metadataHTTPClient(selector string) (*http.Client, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if selector == "" {
+		return client, nil
+	}
+
+	device, address, err := resolveMetadataInterface(selector)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			LocalAddr: &net.TCPAddr{IP: address},
+			Control:   bindToDevice(device),
+		}).DialContext,
+	}
+
+	return client, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveMetadataInterface(t *testing.T) {
+	tests := []struct {
+		selector string
+		device   string
+		address  net.IP
+		err      string
+	}{
+		{selector: "lo", device: "lo", address: net.IPv4(127, 0, 0, 1)},
+		{selector: "127.0.0.0/8", device: "lo", address: net.IPv4(127, 0, 0, 1)},
+		{selector: "missing0", err: "metadata interface missing0 not found"},
+		{selector: "203.0.113.0/24", err: "no interface with an address in the metadata interface CIDR"},
+	}
+	for _, test := range tests {
+		device, address, err := resolveMetadataInterface(test.selector)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.selector, test.err, err)
+			}
+			continue
+		}
+		if err != nil || device != test.device || !address.Equal(test.address) {
+			t.Errorf("%s: got %s %v, %v, expected %s %v", test.selector, device, address, err, test.device, test.address)
+		}
+	}
+}
+
+func TestFetchNodeMetadataInterface(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Auth-Token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id": "node"}`))
+	}))
+	defer server.Close()
+
+	// The loopback server is only reachable through the loopback interface
+	metadata, err := fetchNodeMetadata(server.URL, "token", "lo")
+	if err != nil || string(metadata) != `{"id": "node"}` {
+		t.Errorf("unexpected node metadata %s, %v", metadata, err)
+	}
+
+	_, err = fetchNodeMetadata(server.URL, "token", "missing0")
+	if err == nil {
+		t.Errorf("expected an error with a missing interface")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LocalDisks declares how the instance local disks (eg: scratch NVMe) are provisioned
+//
+//	{
+//	   "devices": ["/dev/nvme*n1"],
+//	   "filesystem": "xfs",
+//	   "mountpoint": "/var/lib/containerd",
+//	   "raid_level": 0
+//	}
+type LocalDisks struct {
+	Devices    []string `json:"devices"` // Glob patterns of the devices
+	Filesystem string   `json:"filesystem,omitempty"`
+	Mountpoint string   `json:"mountpoint"`
+	Options    string   `json:"options,omitempty"`
+	RaidLevel  int      `json:"raid_level,omitempty"` // RAID level used when several devices match
+}
+
+// localDisksRaidDevice is the RAID device assembled from the local disks
+const localDisksRaidDevice = "/dev/md/scw-k8s-local"
+
+// provisionLocalDisks formats and mounts the local disks, already formatted disks are left untouched.
+// The root disk is never provisioned, and the disks in use (partitioned, LVM or foreign RAID members,
+// mounted) are refused.
+func provisionLocalDisks(localDisks LocalDisks) error {
+	filesystem := localDisks.Filesystem
+	if filesystem == "" {
+		filesystem = "ext4"
+	}
+
+	// Resolve the devices
+	var devices []string
+	for _, pattern := range localDisks.Devices {
+		matches, err := filepath.Glob(hostPath(pattern))
+		if err != nil {
+			return fmt.Errorf("invalid device pattern %q: %w", pattern, err)
+		}
+		for _, match := range matches {
+			devices = append(devices, nodePath(match))
+		}
+	}
+	slices.Sort(devices)
+	devices = slices.Compact(devices)
+	if len(devices) == 0 {
+		slog.Info("No local disk found, skipping provisioning", slog.Any("devices", localDisks.Devices))
+		return nil
+	}
+
+	// Check the devices are not in use, and find the array they are already assembled in
+	disks, err := listBlockDevices(devices)
+	if err != nil {
+		return err
+	}
+	target, err := selectLocalDisks(disks, localDisks.Mountpoint)
+	if err != nil {
+		return err
+	}
+	if target.Path == "" {
+		slog.Info("No local disk left once the root disk excluded, skipping provisioning", slog.Any("devices", devices))
+		return nil
+	}
+
+	// Assemble the devices in a RAID array if several devices match
+	device := target.Path
+	if len(target.Members) > 0 {
+		args := []string{"--create", device, "--run", "--level=" + strconv.Itoa(localDisks.RaidLevel), "--raid-devices=" + strconv.Itoa(len(target.Members))}
+		cmd := command("/usr/sbin/mdadm", append(args, target.Members...)...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to create RAID array: %w: %s", err, output)
+		}
+		slog.Info("Local disks RAID array created", slog.String("device", device), slog.Any("devices", target.Members), slog.Int("level", localDisks.RaidLevel))
+	}
+
+	// Format the device if it does not have a filesystem yet
+	uuid, err := filesystemUUID(device)
+	if err != nil {
+		return err
+	}
+	if uuid == "" && !target.Blank {
+		return fmt.Errorf("local disk %s has no filesystem UUID but is not blank, refusing to format it", device)
+	}
+	if uuid == "" {
+		cmd := command("/usr/sbin/mkfs."+filesystem, device)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to format %s: %w: %s", device, err, output)
+		}
+		slog.Info("Local disk formatted", slog.String("device", device), slog.String("filesystem", filesystem))
+
+		uuid, err = filesystemUUID(device)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Mount the device by UUID since the device names may change across reboots
+	return processMounts(slog.Default(), []ComponentMount{{
+		State:   "mounted",
+		What:    "/dev/disk/by-uuid/" + uuid,
+		Where:   localDisks.Mountpoint,
+		Type:    filesystem,
+		Options: localDisks.Options,
+	}})
+}
+
+// blockDevice is a device of the lsblk JSON output, with its partitions and holders as children
+type blockDevice struct {
+	Path        string        `json:"path"`
+	Type        string        `json:"type"` // disk, part, lvm, crypt, raid0, raid1, ...
+	FSType      string        `json:"fstype"`
+	PTType      string        `json:"pttype"`
+	Mountpoints []string      `json:"mountpoints"`
+	Children    []blockDevice `json:"children"`
+}
+
+// listBlockDevices returns the devices with their children
+func listBlockDevices(devices []string) ([]blockDevice, error) {
+	args := []string{"--json", "--paths", "--output", "PATH,TYPE,FSTYPE,PTTYPE,MOUNTPOINTS"}
+	cmd := command("/usr/bin/lsblk", append(args, devices...)...)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local disks: %w", err)
+	}
+
+	var list struct {
+		BlockDevices []blockDevice `json:"blockdevices"`
+	}
+	err = json.Unmarshal(output, &list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal local disks: %w", err)
+	}
+
+	return list.BlockDevices, nil
+}
+
+// mountpoints returns the mountpoints of the device and of its children
+func (d blockDevice) mountpoints() []string {
+	var mountpoints []string
+	for _, mountpoint := range d.Mountpoints {
+		if mountpoint != "" {
+			mountpoints = append(mountpoints, mountpoint)
+		}
+	}
+	for _, child := range d.Children {
+		mountpoints = append(mountpoints, child.mountpoints()...)
+	}
+	return mountpoints
+}
+
+// blank returns true if the device has no partition table, no signature and no children
+func (d blockDevice) blank() bool {
+	return d.FSType == "" && d.PTType == "" && len(d.Children) == 0
+}
+
+// localDisksTarget is the device the local disks are provisioned on
+type localDisksTarget struct {
+	Path    string   // Device to format and mount, empty if no disk is left
+	Blank   bool     // Whether the device has no filesystem nor any other signature
+	Members []string // Disks to assemble in a new RAID array at the path, if not assembled yet
+}
+
+// selectLocalDisks returns the device to format and mount from the local disks. The root disk is
+// excluded, the disks which are partitioned, LVM physical volumes, members of another RAID array or
+// mounted elsewhere are refused. The array the disks are already assembled in is found whatever its
+// name, eg: /dev/md127 once assembled without the agent name after a reboot.
+func selectLocalDisks(disks []blockDevice, mountpoint string) (localDisksTarget, error) {
+	var candidates []blockDevice
+	for _, disk := range disks {
+		mountpoints := disk.mountpoints()
+		if slices.Contains(mountpoints, "/") {
+			slog.Warn("Root disk matched by the local disks devices, skipped", slog.String("device", disk.Path))
+			continue
+		}
+		for _, mounted := range mountpoints {
+			if mounted != mountpoint {
+				return localDisksTarget{}, fmt.Errorf("local disk %s is in use, mounted on %s", disk.Path, mounted)
+			}
+		}
+		if disk.Type != "disk" {
+			return localDisksTarget{}, fmt.Errorf("local disk %s is a %s, expected a disk", disk.Path, disk.Type)
+		}
+		if disk.PTType != "" {
+			return localDisksTarget{}, fmt.Errorf("local disk %s has a %s partition table", disk.Path, disk.PTType)
+		}
+		for _, child := range disk.Children {
+			if !strings.HasPrefix(child.Type, "raid") {
+				return localDisksTarget{}, fmt.Errorf("local disk %s is in use by %s (%s)", disk.Path, child.Path, child.Type)
+			}
+		}
+		candidates = append(candidates, disk)
+	}
+	if len(candidates) == 0 {
+		return localDisksTarget{}, nil
+	}
+
+	// A single disk is formatted, or mounted if it has a filesystem
+	if len(candidates) == 1 {
+		disk := candidates[0]
+		if disk.FSType == "linux_raid_member" || disk.FSType == "LVM2_member" || len(disk.Children) > 0 {
+			return localDisksTarget{}, fmt.Errorf("local disk %s is in use as %s", disk.Path, disk.FSType)
+		}
+		return localDisksTarget{Path: disk.Path, Blank: disk.blank()}, nil
+	}
+
+	// Several disks are either all blank, or all the members of the same array
+	if !slices.ContainsFunc(candidates, func(disk blockDevice) bool { return !disk.blank() }) {
+		members := make([]string, 0, len(candidates))
+		for _, disk := range candidates {
+			members = append(members, disk.Path)
+		}
+		return localDisksTarget{Path: localDisksRaidDevice, Blank: true, Members: members}, nil
+	}
+	var array *blockDevice
+	for _, disk := range candidates {
+		if disk.FSType != "linux_raid_member" || len(disk.Children) != 1 || (array != nil && disk.Children[0].Path != array.Path) {
+			return localDisksTarget{}, fmt.Errorf("local disk %s is not blank nor a member of the local disks array", disk.Path)
+		}
+		array = &disk.Children[0]
+	}
+	return localDisksTarget{Path: array.Path, Blank: array.FSType == "" && array.PTType == "" && len(array.Children) == 0}, nil
+}
+
+// filesystemUUID returns the UUID of the device filesystem, empty if the device has no filesystem
+func filesystemUUID(device string) (string, error) {
+	cmd := command("/usr/sbin/blkid", "-s", "UUID", "-o", "value", device)
+	output, err := cmd.Output()
+	if err != nil {
+		// 2 is the exit code for blkid when no filesystem is found
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get %s filesystem: %w", device, err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelectLocalDisks(t *testing.T) {
+	blank := func(path string) blockDevice { return blockDevice{Path: path, Type: "disk"} }
+	rootDisk := blockDevice{Path: "/dev/nvme0n1", Type: "disk", PTType: "gpt", Children: []blockDevice{
+		{Path: "/dev/nvme0n1p1", Type: "part", FSType: "vfat", Mountpoints: []string{"/boot/efi"}},
+		{Path: "/dev/nvme0n1p2", Type: "part", FSType: "ext4", Mountpoints: []string{"/"}},
+	}}
+	member := func(path, array string) blockDevice {
+		return blockDevice{Path: path, Type: "disk", FSType: "linux_raid_member", Children: []blockDevice{
+			{Path: array, Type: "raid0", FSType: "ext4", Mountpoints: []string{"/var/lib/containerd"}},
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		disks    []blockDevice
+		expected localDisksTarget
+		err      string
+	}{
+		{
+			name:     "blank disk",
+			disks:    []blockDevice{blank("/dev/nvme1n1")},
+			expected: localDisksTarget{Path: "/dev/nvme1n1", Blank: true},
+		},
+		{
+			name:     "formatted disk",
+			disks:    []blockDevice{{Path: "/dev/nvme1n1", Type: "disk", FSType: "ext4", Mountpoints: []string{"/var/lib/containerd"}}},
+			expected: localDisksTarget{Path: "/dev/nvme1n1"},
+		},
+		{
+			name:     "root disk excluded",
+			disks:    []blockDevice{rootDisk, blank("/dev/nvme1n1")},
+			expected: localDisksTarget{Path: "/dev/nvme1n1", Blank: true},
+		},
+		{
+			name:  "only the root disk",
+			disks: []blockDevice{rootDisk},
+		},
+		{
+			name:  "partitioned disk",
+			disks: []blockDevice{{Path: "/dev/nvme1n1", Type: "disk", PTType: "gpt"}},
+			err:   "has a gpt partition table",
+		},
+		{
+			name:  "LVM physical volume",
+			disks: []blockDevice{{Path: "/dev/nvme1n1", Type: "disk", FSType: "LVM2_member", Children: []blockDevice{{Path: "/dev/mapper/vg-data", Type: "lvm"}}}},
+			err:   "is in use by /dev/mapper/vg-data (lvm)",
+		},
+		{
+			name:  "disk mounted elsewhere",
+			disks: []blockDevice{{Path: "/dev/nvme1n1", Type: "disk", FSType: "ext4", Mountpoints: []string{"/data"}}},
+			err:   "mounted on /data",
+		},
+		{
+			name:     "new array",
+			disks:    []blockDevice{blank("/dev/nvme1n1"), blank("/dev/nvme2n1")},
+			expected: localDisksTarget{Path: localDisksRaidDevice, Blank: true, Members: []string{"/dev/nvme1n1", "/dev/nvme2n1"}},
+		},
+		{
+			name:     "array assembled as md127",
+			disks:    []blockDevice{member("/dev/nvme1n1", "/dev/md127"), member("/dev/nvme2n1", "/dev/md127")},
+			expected: localDisksTarget{Path: "/dev/md127"},
+		},
+		{
+			name:  "member of another array",
+			disks: []blockDevice{member("/dev/nvme1n1", "/dev/md127"), member("/dev/nvme2n1", "/dev/md126")},
+			err:   "not blank nor a member of the local disks array",
+		},
+		{
+			name:  "single RAID member",
+			disks: []blockDevice{member("/dev/nvme1n1", "/dev/md127")},
+			err:   "is in use as linux_raid_member",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := selectLocalDisks(test.disks, "/var/lib/containerd")
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(target, test.expected) {
+				t.Errorf("target = %+v, expected %+v", target, test.expected)
+			}
+		})
+	}
+}
+
+func TestBlockDevicesUnmarshal(t *testing.T) {
+	output := `{"blockdevices": [{"path": "/dev/md127", "type": "raid0", "fstype": null, "pttype": null, "mountpoints": [null]}]}`
+
+	var list struct {
+		BlockDevices []blockDevice `json:"blockdevices"`
+	}
+	err := json.Unmarshal([]byte(output), &list)
+	if err != nil {
+		t.Fatalf("failed to unmarshal lsblk output: %v", err)
+	}
+	if len(list.BlockDevices) != 1 || !list.BlockDevices[0].blank() || len(list.BlockDevices[0].mountpoints()) != 0 {
+		t.Errorf("unexpected devices %+v", list.BlockDevices)
+	}
+}
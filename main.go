@@ -7,7 +7,12 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
+
+	"github.com/scaleway/k8s-agent/repo"
 )
 
 var (
@@ -15,9 +20,36 @@ var (
 )
 
 func main() {
+	// Save and report the panics of the installation
+	defer handlePanic(nil)
+
 	// Flags
 	flagVersion := flag.Bool("version", false, "Print the version")
+	flagDumpMetadata := flag.Bool("dump-metadata", false, "Print the effective node metadata merged from all the sources and exit")
 	flagKosmos := flag.Bool("kosmos", false, "Enable Kosmos mode (multicloud): POOL_ID, POOL_REGION and SCW_SECRET_KEY env vars must be set")
+	flagControllerUser := flag.String("controller-user", "", "Run the controller as this user after the installation, the privileged operations being delegated to the root agent process")
+	flagInstallUnit := flag.Bool("install-unit", false, "Install and enable the agent systemd unit, running the agent with the other flags, and exit")
+	flagControllerChild := flag.Bool("controller-child", false, "Internal: run the unprivileged controller started by the agent")
+	flagDebug := flag.Bool("debug", false, "Log the debug messages, eg: the output of the component scripts")
+	flagBootstrapTimeout := flag.Duration("bootstrap-timeout", 0, "Maximum duration of the initial install, the agent exits with status 8 once exceeded, eg: 30m (no timeout if 0)")
+	flagWaitFor := flag.String("wait-for", "", "Conditions the initial install waits for, eg: cloud-init,file:/run/disks-ready,unit:setup-network.service")
+	flagWaitForTimeout := flag.Duration("wait-for-timeout", defaultBootWaitTimeout, "Maximum duration to wait for the -wait-for conditions, the node is installed anyway once exceeded")
+	flagRoot := flag.String("root", "", "Install the components into this alternate root, eg: a mounted image filesystem, and exit without starting the controller")
+	flag.StringVar(&rootDir, "root-dir", "", "Root the node filesystem under this directory, for the integration tests")
+	flag.StringVar(&serviceManager, "service-manager", systemdServiceManager, "Service manager running the commands: systemd, fake to record them in the commands.log state file instead, or chroot to run them in the root directory")
+	flagPrivilegedPorts := flag.String("privileged-ports", "", "Privileged source ports of the user-data requests, the first free one is used, eg: 1001,1010-1020 (all if empty), or none to use an ephemeral port (default in Kosmos mode)")
+	flagPrivilegedExcludedPorts := flag.String("privileged-excluded-ports", "", "Privileged source ports never used for the user-data requests, in addition to 179, eg: 111,636-989")
+	flagPrivilegedSourceCIDR := flag.String("privileged-source-cidr", "", "Network of the local address the user-data requests are sent from, the address routing to the endpoint if empty, eg: 10.0.0.0/8")
+	flag.StringVar(&metadataInterfaceFlag, "metadata-interface", "", "Interface the user-data and node metadata endpoints are reached through, by name or CIDR of its address, eg: ens5 or 172.16.0.0/22 (default route if empty)")
+	flag.StringVar(&debugSocketFlag, "debug-socket", "", "Serve the Go profiles on /debug/pprof on this unix socket, eg: "+defaultDebugSocket+", by the controller process with -controller-user (disabled if empty)")
+	flag.StringVar(&adminSocketFlag, "admin-socket", "", "Serve the local admin API (status, verify, upgrade, logs) on this unix socket, eg: "+defaultAdminSocket+", by the controller process with -controller-user (disabled if empty)")
+	flag.StringVar(&remoteAPIAddressFlag, "remote-api-address", "", "Serve the admin API status and operations over TLS at this address for the Scaleway CLI, authenticated with the node token, eg: :10260 for the node internal address (disabled if empty)")
+	flag.StringVar(&remoteAPICertFlag, "remote-api-cert", "", "Certificate file of the remote API")
+	flag.StringVar(&remoteAPIKeyFlag, "remote-api-key", "", "Private key file of the remote API")
+	flag.DurationVar(&stallTimeoutFlag, "stall-timeout", 0, "Duration without progress after which a reconcile, a drain or an install is reported stalled, with its goroutines dumped and a node event, eg: 1h (disabled if 0)")
+	flag.BoolVar(&releaseFallbackFlag, "release-fallback", false, "Install the highest lower release of the same minor version when the repository has no release for the node pool version, eg: 1.31.4 for 1.31.5")
+	flag.BoolVar(&stallRestartFlag, "stall-restart", false, "Exit with status 11 once a reconcile, a drain or an install is stalled, so the agent is restarted by systemd, requires -stall-timeout")
+	flag.StringVar(&featureGatesFlag, "feature-gates", "", "Feature gates enabled or disabled over their defaults, the node metadata ones prevail, eg: DrainBeforeUpgrade=true,DriftHeal=false")
 	flag.Parse()
 
 	// Flag to print the version
@@ -26,10 +58,143 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *flagDebug {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	// The alternate root installs are run with the chroot service manager
+	if *flagRoot != "" {
+		root, err := filepath.Abs(*flagRoot)
+		if err != nil {
+			slog.Error("Invalid flag", slog.Any("error", err))
+			exit(exitFailure)
+		}
+		rootDir, serviceManager = root, chrootServiceManager
+	}
+
+	// The only command is reset, the agent installs the node without command
+	if flag.NArg() > 1 || (flag.NArg() == 1 && flag.Arg(0) != "reset") {
+		slog.Error("Invalid arguments, expected no command or reset", slog.Any("args", flag.Args()))
+		exit(exitFailure)
+	}
+
+	err := validateServiceManager(serviceManager)
+	if err != nil {
+		slog.Error("Invalid flag", slog.Any("error", err))
+		exit(exitFailure)
+	}
+	flagFeatureGates, err = parseFeatureGates(featureGatesFlag)
+	if err != nil {
+		slog.Error("Invalid flag", slog.Any("error", err))
+		exit(exitFailure)
+	}
+	err = validateRemoteAPIFlags(remoteAPIAddressFlag, remoteAPICertFlag, remoteAPIKeyFlag)
+	if err != nil {
+		slog.Error("Invalid flag", slog.Any("error", err))
+		exit(exitFailure)
+	}
+	err = validateStallFlags(stallTimeoutFlag, stallRestartFlag)
+	if err != nil {
+		slog.Error("Invalid flag", slog.Any("error", err))
+		exit(exitFailure)
+	}
+	bootConditions, err := parseBootConditions(*flagWaitFor)
+	if err != nil {
+		slog.Error("Invalid flag", slog.Any("error", err))
+		exit(exitFailure)
+	}
+	privilegedPortConfig, err = parsePrivilegedPortConfig(*flagPrivilegedPorts, *flagPrivilegedExcludedPorts, *flagPrivilegedSourceCIDR, *flagKosmos)
+	if err != nil {
+		slog.Error("Invalid flag", slog.Any("error", err))
+		exit(exitFailure)
+	}
+
+	// // Register chan to receive system signals
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	ctx, sigCancel := context.WithCancel(context.Background())
+	go func() {
+		sig := <-sigs
+		slog.Info("Received signal, shutting down", slog.String("signal", sig.String()))
+		sigCancel()
+	}()
+
+	// Serve the profiles of the long-running process, the controller one with -controller-user
+	if debugSocketFlag != "" && (*flagControllerChild || *flagControllerUser == "") {
+		err = serveDebug(ctx, debugSocketFlag)
+		if err != nil {
+			slog.Warn("Failed to serve profiles", slog.Any("error", err))
+		}
+	}
+
+	// Serve the admin API of the long-running process, the controller one with -controller-user
+	if adminSocketFlag != "" && (*flagControllerChild || *flagControllerUser == "") {
+		err = serveAdmin(ctx, adminSocketFlag)
+		if err != nil {
+			slog.Warn("Failed to serve admin API", slog.Any("error", err))
+		}
+	}
+
+	// Detect the reconciles and installs wedged on a script or a download, in each agent process
+	if stallTimeoutFlag > 0 {
+		repo.OnProgress = stalls.progress
+		go stalls.run(ctx, stallTimeoutFlag, stallRestartFlag)
+	}
+
+	// Run the unprivileged controller started by the agent
+	if *flagControllerChild {
+		err := runControllerChild(ctx)
+		if err != nil {
+			slog.Error("Failed to run node controller", slog.Any("error", err))
+			exit(exitCode(err, exitController))
+		}
+		return
+	}
+
 	// The agent must be executed as root
 	if os.Getuid() != 0 {
 		slog.Error("Agent must be run as root")
-		os.Exit(1)
+		exit(exitFailure)
+	}
+
+	// Flag to install the agent unit
+	if *flagInstallUnit {
+		args := slices.DeleteFunc(slices.Clone(os.Args[1:]), func(arg string) bool {
+			return strings.HasPrefix(strings.TrimLeft(arg, "-"), "install-unit")
+		})
+		err := installAgentUnit(args, *flagBootstrapTimeout)
+		if err != nil {
+			slog.Error("Failed to install agent unit", slog.Any("error", err))
+			exit(exitFailure)
+		}
+		slog.Info("Agent unit installed", slog.String("unit", agentUnitName))
+		os.Exit(0)
+	}
+
+	// Command to reset the node to its state before the install, eg: to reuse the machine
+	if flag.Arg(0) == "reset" {
+		nodeMetadata, err := resetNodeMetadata(ctx, *flagKosmos)
+		if err != nil {
+			slog.Warn("Failed to get node metadata, the components uninstall sections are not run", slog.Any("error", err))
+		}
+		err = resetNode(ctx, nodeMetadata)
+		if err != nil {
+			slog.Error("Failed to reset node", slog.Any("error", err))
+			exit(exitFailure)
+		}
+		os.Exit(0)
+	}
+
+	// A decommissioned node is not installed again until the marker is removed
+	decommissioned, err := fileExists(decommissionedFile)
+	if err != nil {
+		slog.Error("Failed to check node decommission", slog.Any("error", err))
+		exit(exitFailure)
+	}
+	if decommissioned {
+		slog.Info("Node decommissioned, exiting", slog.String("marker", decommissionedFile))
+		_ = sdNotify("READY=1\nSTATUS=Node decommissioned")
+		return
 	}
 
 	// Get node token and url to fetch the node metadata
@@ -39,7 +204,7 @@ func main() {
 		kosmosUserData, err := getKosmosUserData()
 		if err != nil {
 			slog.Error("Failed to get Kosmos node credentials", slog.Any("error", err))
-			os.Exit(1)
+			exit(exitCredentials)
 		}
 		userData = kosmosUserData
 	} else {
@@ -47,52 +212,84 @@ func main() {
 		nodeUserData, err := getNodeUserData()
 		if err != nil {
 			slog.Error("Failed to get Kapsule node credentials", slog.Any("error", err))
-			os.Exit(1)
+			exit(exitCredentials)
 		}
 		userData = nodeUserData
 	}
 
-	// Get the node metadata, from the PN node metadata endpoint or the external kapsule endpoint
-	nodeMetadata, err := getNodeMetadata(userData.MetadataURL, userData.NodeSecretKey)
+	// Get the node metadata, merged from all the metadata sources
+	nodeMetadata, err := loadNodeMetadata(ctx, userData)
 	if err != nil {
 		slog.Error("Failed to get node metadata", slog.Any("error", err))
-		os.Exit(1)
+		exit(exitMetadata)
 	}
 
-	// // Register chan to receive system signals
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	ctx, sigCancel := context.WithCancel(context.Background())
-	go func() {
-		sig := <-sigs
-		slog.Info("Received signal, shutting down", slog.String("signal", sig.String()))
-		sigCancel()
-	}()
+	// Flag to dump the effective node metadata
+	if *flagDumpMetadata {
+		dump, err := dumpNodeMetadata(nodeMetadata)
+		if err != nil {
+			slog.Error("Failed to dump node metadata", slog.Any("error", err))
+			exit(exitFailure)
+		}
+		fmt.Println(dump)
+		os.Exit(0)
+	}
+
+	logFeatureGates(nodeMetadata)
+
+	// Wait for the boot configuration the components need, eg: cloud-init, not in an alternate root
+	if serviceManager != chrootServiceManager {
+		err = waitForBoot(ctx, bootConditions, *flagWaitForTimeout)
+		if err != nil {
+			slog.Error("Failed to wait for boot conditions", slog.Any("error", err))
+			exit(exitInstall)
+		}
+	}
 
 	// Install the components: binaries, configuration files, and services
-	err = processComponents(ctx, nodeMetadata)
+	err = bootstrapNode(ctx, nodeMetadata, *flagBootstrapTimeout)
+	if serviceManager != chrootServiceManager {
+		reportBootstrapRelease(ctx, nodeMetadata, err)
+	}
 	if err != nil {
 		slog.Error("Failed to process components", slog.Any("error", err))
-		os.Exit(1)
+		exit(exitCode(err, exitInstall))
 	}
 
 	slog.Info("System and components processed successfully")
 
-	// If Kosmos mode, exit after installation
-	if *flagKosmos {
+	// Exit after the installation into an alternate root, it is not the running node
+	if serviceManager == chrootServiceManager {
+		err = writeImageManifest(nodeMetadata)
+		if err != nil {
+			slog.Error("Failed to write image manifest", slog.Any("error", err))
+			exit(exitInstall)
+		}
+		slog.Info("Components installed into alternate root", slog.String("root", rootDir))
+		return
+	}
+
+	// If Kosmos mode, exit after installation, unless the tunnel must be monitored
+	if *flagKosmos && nodeMetadata.Tunnel == nil {
 		slog.Info("Kosmos mode: exiting after installation")
+		_ = sdNotify("READY=1\nSTATUS=Node installed")
 		return
 	}
 
-	// Start the node controller
-	nodeController, err := NewController(ctx, nodeMetadata)
-	if err != nil {
-		slog.Error("Failed to create node controller", slog.Any("error", err))
-		os.Exit(1)
+	// Run the controller without privileges, the agent only serves its privileged operations
+	if *flagControllerUser != "" {
+		err = runUnprivilegedController(ctx, *flagControllerUser, nodeMetadata)
+		if err != nil {
+			slog.Error("Failed to run unprivileged node controller", slog.Any("error", err))
+			exit(exitCode(err, exitController))
+		}
+		return
 	}
-	err = nodeController.Run(ctx)
+
+	// Start the node controller, or the controllers of the nodes managed by a shared agent
+	err = runNodeControllers(ctx, nodeMetadata, localPrivileged{})
 	if err != nil {
 		slog.Error("Failed to run node controller", slog.Any("error", err))
-		os.Exit(1)
+		exit(exitCode(err, exitController))
 	}
 }
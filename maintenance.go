@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaintenanceWindow represents a recurring window during which disruptive upgrades are allowed,
+// opening at a start time on some days
+//
+//	{
+//	   "start": "02:00",
+//	   "duration": "4h",
+//	   "days": ["sat", "sun"],
+//	   "timezone": "Europe/Paris"
+//	}
+//
+// or at the times of a cron schedule (minute, hour, day of month, month and day of week)
+//
+//	{
+//	   "schedule": "0 2 * * sun",
+//	   "duration": "4h"
+//	}
+type MaintenanceWindow struct {
+	Start    string   `json:"start,omitempty"`
+	Schedule string   `json:"schedule,omitempty"`
+	Duration string   `json:"duration"`
+	Days     []string `json:"days,omitempty"`
+	Timezone string   `json:"timezone,omitempty"`
+}
+
+// parsedMaintenanceWindow is the validated form of a MaintenanceWindow
+type parsedMaintenanceWindow struct {
+	hour     int
+	minute   int
+	schedule *cronSchedule
+	duration time.Duration
+	days     []time.Weekday
+	location *time.Location
+}
+
+// cronSchedule is a parsed cron expression, each field is the set of its allowed values
+type cronSchedule struct {
+	minutes     []bool
+	hours       []bool
+	daysOfMonth []bool
+	months      []bool
+	daysOfWeek  []bool
+	// With both days restricted, a day matches either of them, like cron does
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (w MaintenanceWindow) parse() (parsedMaintenanceWindow, error) {
+	var parsed parsedMaintenanceWindow
+	var err error
+
+	// Parse the cron schedule of the window, or its start time (HH:MM)
+	if w.Schedule != "" {
+		if w.Start != "" || len(w.Days) > 0 {
+			return parsedMaintenanceWindow{}, fmt.Errorf("schedule %q can't be set with a start or days", w.Schedule)
+		}
+		parsed.schedule, err = parseCronSchedule(w.Schedule)
+		if err != nil {
+			return parsedMaintenanceWindow{}, fmt.Errorf("failed to parse schedule %q: %w", w.Schedule, err)
+		}
+	} else {
+		start, err := time.Parse("15:04", w.Start)
+		if err != nil {
+			return parsedMaintenanceWindow{}, fmt.Errorf("failed to parse start %q: %w", w.Start, err)
+		}
+		parsed.hour, parsed.minute = start.Hour(), start.Minute()
+	}
+
+	// Parse the duration of the window, it can't exceed a day
+	parsed.duration, err = time.ParseDuration(w.Duration)
+	if err != nil {
+		return parsedMaintenanceWindow{}, fmt.Errorf("failed to parse duration %q: %w", w.Duration, err)
+	}
+	if parsed.duration <= 0 || parsed.duration > 24*time.Hour {
+		return parsedMaintenanceWindow{}, fmt.Errorf("duration %q must be between 0 and 24h", w.Duration)
+	}
+
+	// Parse the days the window opens, no days means every day
+	for _, day := range w.Days {
+		weekday, ok := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+		if !ok {
+			return parsedMaintenanceWindow{}, fmt.Errorf("unknown day %q", day)
+		}
+		parsed.days = append(parsed.days, weekday)
+	}
+
+	// Load the timezone of the window, UTC by default
+	parsed.location = time.UTC
+	if w.Timezone != "" {
+		parsed.location, err = time.LoadLocation(w.Timezone)
+		if err != nil {
+			return parsedMaintenanceWindow{}, fmt.Errorf("failed to load timezone %q: %w", w.Timezone, err)
+		}
+	}
+
+	return parsed, nil
+}
+
+// Validate checks the maintenance window definition
+func (w MaintenanceWindow) Validate() error {
+	_, err := w.parse()
+	return err
+}
+
+// NextOpening returns zero if the window is open at the given time,
+// otherwise the duration to wait until the window opens
+func (w MaintenanceWindow) NextOpening(now time.Time) (time.Duration, error) {
+	parsed, err := w.parse()
+	if err != nil {
+		return 0, err
+	}
+
+	now = now.In(parsed.location)
+	if parsed.schedule != nil {
+		return parsed.schedule.nextOpening(now, parsed.duration)
+	}
+
+	// Check the window that started yesterday (it may overlap midnight), then the next 7 days
+	for offset := -1; offset <= 7; offset++ {
+		day := now.AddDate(0, 0, offset)
+		if len(parsed.days) > 0 && !slices.Contains(parsed.days, day.Weekday()) {
+			continue
+		}
+
+		start := time.Date(day.Year(), day.Month(), day.Day(), parsed.hour, parsed.minute, 0, 0, parsed.location)
+		end := start.Add(parsed.duration)
+		if !now.Before(start) && now.Before(end) {
+			return 0, nil
+		}
+		if start.After(now) {
+			return start.Sub(now), nil
+		}
+	}
+
+	return 0, fmt.Errorf("no opening found for maintenance window")
+}
+
+// cronFieldNames are the names allowed in the month and day of week fields
+var cronFieldNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+func parseCronSchedule(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+
+	dayNames := map[string]int{}
+	for name, weekday := range weekdays {
+		dayNames[name] = int(weekday)
+	}
+
+	var schedule cronSchedule
+	var err error
+	for i, field := range []struct {
+		name      string
+		values    *[]bool
+		low, high int
+		names     map[string]int
+	}{
+		{name: "minute", values: &schedule.minutes, low: 0, high: 59},
+		{name: "hour", values: &schedule.hours, low: 0, high: 23},
+		{name: "day of month", values: &schedule.daysOfMonth, low: 1, high: 31},
+		{name: "month", values: &schedule.months, low: 1, high: 12, names: cronFieldNames},
+		{name: "day of week", values: &schedule.daysOfWeek, low: 0, high: 7, names: dayNames},
+	} {
+		*field.values, err = parseCronField(fields[i], field.low, field.high, field.names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", field.name, fields[i], err)
+		}
+	}
+
+	// 7 is also Sunday
+	if schedule.daysOfWeek[7] {
+		schedule.daysOfWeek[0] = true
+	}
+	schedule.anyDayOfMonth = strings.HasPrefix(fields[2], "*")
+	schedule.anyDayOfWeek = strings.HasPrefix(fields[4], "*")
+
+	return &schedule, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges (a-b) and steps (*/n, a-b/n)
+func parseCronField(field string, low, high int, names map[string]int) ([]bool, error) {
+	parseValue := func(value string) (int, error) {
+		if number, ok := names[strings.ToLower(value)]; ok {
+			return number, nil
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q", value)
+		}
+		if number < low || number > high {
+			return 0, fmt.Errorf("value %d out of range %d-%d", number, low, high)
+		}
+		return number, nil
+	}
+
+	values := make([]bool, high+1)
+	for part := range strings.SplitSeq(field, ",") {
+		valueRange, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepText)
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+
+		first, last := low, high
+		if valueRange != "*" {
+			firstText, lastText, isRange := strings.Cut(valueRange, "-")
+			var err error
+			first, err = parseValue(firstText)
+			if err != nil {
+				return nil, err
+			}
+			last = first
+			if isRange {
+				last, err = parseValue(lastText)
+				if err != nil {
+					return nil, err
+				}
+			} else if hasStep {
+				last = high
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid range %q", valueRange)
+			}
+		}
+
+		for value := first; value <= last; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+// matchesDay checks if the window can open on the day
+func (s *cronSchedule) matchesDay(day time.Time) bool {
+	if !s.months[day.Month()] {
+		return false
+	}
+	dayOfMonth, dayOfWeek := s.daysOfMonth[day.Day()], s.daysOfWeek[day.Weekday()]
+	switch {
+	case s.anyDayOfMonth:
+		return dayOfWeek
+	case s.anyDayOfWeek:
+		return dayOfMonth
+	default:
+		return dayOfMonth || dayOfWeek
+	}
+}
+
+// nextOpening returns zero if a window of the schedule is open at the given time,
+// otherwise the duration to wait until the next one opens
+func (s *cronSchedule) nextOpening(now time.Time, duration time.Duration) (time.Duration, error) {
+	// Check the windows that started yesterday (they may overlap midnight), then the next 4 years
+	// for the schedules on leap days
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for offset := -1; offset <= 4*366; offset++ {
+		day := today.AddDate(0, 0, offset)
+		if !s.matchesDay(day) {
+			continue
+		}
+
+		for hour := range s.hours {
+			for minute := range s.minutes {
+				if !s.hours[hour] || !s.minutes[minute] {
+					continue
+				}
+				start := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, now.Location())
+				if !now.Before(start) && now.Before(start.Add(duration)) {
+					return 0, nil
+				}
+				if start.After(now) {
+					return start.Sub(now), nil
+				}
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("no opening found for maintenance window")
+}
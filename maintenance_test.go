@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaintenanceWindowNextOpening(t *testing.T) {
+	// 2024-01-03 is a Wednesday
+	tests := []struct {
+		name     string
+		window   MaintenanceWindow
+		now      string
+		expected time.Duration
+	}{
+		{
+			name:     "inside daily window",
+			window:   MaintenanceWindow{Start: "02:00", Duration: "4h"},
+			now:      "2024-01-03T03:00:00Z",
+			expected: 0,
+		},
+		{
+			name:     "before daily window",
+			window:   MaintenanceWindow{Start: "02:00", Duration: "4h"},
+			now:      "2024-01-03T01:00:00Z",
+			expected: time.Hour,
+		},
+		{
+			name:     "after daily window",
+			window:   MaintenanceWindow{Start: "02:00", Duration: "4h"},
+			now:      "2024-01-03T07:00:00Z",
+			expected: 19 * time.Hour,
+		},
+		{
+			name:     "window overlapping midnight",
+			window:   MaintenanceWindow{Start: "23:00", Duration: "2h"},
+			now:      "2024-01-03T00:30:00Z",
+			expected: 0,
+		},
+		{
+			name:     "weekly window",
+			window:   MaintenanceWindow{Start: "02:00", Duration: "1h", Days: []string{"sat"}},
+			now:      "2024-01-03T02:00:00Z",
+			expected: 72 * time.Hour,
+		},
+		{
+			name:     "window with timezone",
+			window:   MaintenanceWindow{Start: "02:00", Duration: "1h", Timezone: "Europe/Paris"},
+			now:      "2024-01-03T01:30:00Z",
+			expected: 0,
+		},
+		{
+			name:     "inside scheduled window",
+			window:   MaintenanceWindow{Schedule: "30 */6 * * *", Duration: "1h"},
+			now:      "2024-01-03T12:45:00Z",
+			expected: 0,
+		},
+		{
+			name:     "before scheduled window",
+			window:   MaintenanceWindow{Schedule: "30 */6 * * *", Duration: "1h"},
+			now:      "2024-01-03T13:30:00Z",
+			expected: 5 * time.Hour,
+		},
+		{
+			name:     "weekly scheduled window",
+			window:   MaintenanceWindow{Schedule: "0 2 * * sun", Duration: "4h"},
+			now:      "2024-01-03T02:00:00Z",
+			expected: 96 * time.Hour,
+		},
+		{
+			name:     "scheduled window on days of month or week",
+			window:   MaintenanceWindow{Schedule: "0 2 10 * sun", Duration: "4h"},
+			now:      "2024-01-08T02:00:00Z",
+			expected: 48 * time.Hour,
+		},
+		{
+			name:     "scheduled window overlapping midnight",
+			window:   MaintenanceWindow{Schedule: "0 22 * * wed", Duration: "4h"},
+			now:      "2024-01-04T01:00:00Z",
+			expected: 0,
+		},
+		{
+			name:     "scheduled window in a month",
+			window:   MaintenanceWindow{Schedule: "0 3 15 mar *", Duration: "1h", Timezone: "Europe/Paris"},
+			now:      "2024-01-03T00:00:00Z",
+			expected: 72*24*time.Hour + 2*time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.Parse(time.RFC3339, tt.now)
+			if err != nil {
+				t.Fatalf("failed to parse time: %v", err)
+			}
+			result, err := tt.window.NextOpening(now)
+			if err != nil {
+				t.Fatalf("NextOpening() returned an error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("NextOpening(%s) = %s, expected %s", tt.now, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMaintenanceWindowValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+	}{
+		{
+			name:   "invalid start",
+			window: MaintenanceWindow{Start: "25:00", Duration: "1h"},
+		},
+		{
+			name:   "invalid duration",
+			window: MaintenanceWindow{Start: "02:00", Duration: "48h"},
+		},
+		{
+			name:   "invalid day",
+			window: MaintenanceWindow{Start: "02:00", Duration: "1h", Days: []string{"someday"}},
+		},
+		{
+			name:   "schedule with a start",
+			window: MaintenanceWindow{Start: "02:00", Schedule: "0 2 * * *", Duration: "1h"},
+		},
+		{
+			name:   "schedule with missing fields",
+			window: MaintenanceWindow{Schedule: "0 2 *", Duration: "1h"},
+		},
+		{
+			name:   "schedule out of range",
+			window: MaintenanceWindow{Schedule: "0 24 * * *", Duration: "1h"},
+		},
+		{
+			name:   "schedule with an invalid step",
+			window: MaintenanceWindow{Schedule: "*/0 * * * *", Duration: "1h"},
+		},
+		{
+			name:   "schedule with an invalid range",
+			window: MaintenanceWindow{Schedule: "0 2 * * fri-mon", Duration: "1h"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.window.Validate(); err == nil {
+				t.Errorf("Validate() expected an error for %+v", tt.window)
+			}
+		})
+	}
+}
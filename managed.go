@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// JSON File template to store the files managed by the agent and their component
+//
+//	{
+//	   "/etc/kubernetes/kubelet.conf": "kubelet",
+//	   "/usr/bin/containerd": "containerd"
+//	}
+
+var managedFilesFile = filepath.Join(stateDir, "managed-files.json")
+
+// takeoverBackupDir holds the files taken over with force as they were before the install, under their
+// path, eg: /etc/crictl.yaml is backed up to /var/lib/scw-k8s-agent/takeover-backup/etc/crictl.yaml
+var takeoverBackupDir = filepath.Join(stateDir, "takeover-backup")
+
+// managedFilesMu serializes the updates of the managed files, the files of a component are written
+// concurrently
+var managedFilesMu sync.Mutex
+
+// managedHeaderText is the text of the header prepended to managed files
+const managedHeaderText = "Managed by scw-k8s-agent, do not edit"
+
+// managedHeaderComments are the comment syntaxes by file extension
+var managedHeaderComments = map[string]string{
+	".conf":    "#",
+	".cfg":     "#",
+	".env":     "#",
+	".ini":     "#",
+	".service": "#",
+	".socket":  "#",
+	".timer":   "#",
+	".mount":   "#",
+	".sh":      "#",
+	".toml":    "#",
+	".yaml":    "#",
+	".yml":     "#",
+	".lua":     "--",
+}
+
+func loadManagedFiles() (map[string]string, error) {
+	managedFiles := make(map[string]string)
+
+	jsonManagedFiles, err := os.ReadFile(hostPath(managedFilesFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return managedFiles, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read managed files: %w", err)
+	}
+
+	err = json.Unmarshal(jsonManagedFiles, &managedFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal managed files: %w", err)
+	}
+
+	return managedFiles, nil
+}
+
+func saveManagedFiles(managedFiles map[string]string) error {
+	jsonManagedFiles, err := json.Marshal(managedFiles)
+	if err != nil {
+		return fmt.Errorf("failed to marshal managed files: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(filepath.Dir(managedFilesFile)), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = writeFileSync(managedFilesFile, jsonManagedFiles, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write managed files: %w", err)
+	}
+
+	return nil
+}
+
+// recordManagedFile records the file as managed by the component
+func recordManagedFile(path, component string) error {
+	managedFilesMu.Lock()
+	defer managedFilesMu.Unlock()
+
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		return err
+	}
+
+	if managedFiles[path] == component {
+		return nil
+	}
+	managedFiles[path] = component
+
+	return saveManagedFiles(managedFiles)
+}
+
+// forgetManagedFile removes the file, or the files under the directory, from the managed files
+func forgetManagedFile(path string) error {
+	managedFilesMu.Lock()
+	defer managedFilesMu.Unlock()
+
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for managedPath := range managedFiles {
+		if managedPath == path || strings.HasPrefix(managedPath, strings.TrimSuffix(path, "/")+"/") {
+			delete(managedFiles, managedPath)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return saveManagedFiles(managedFiles)
+}
+
+// checkTakeover returns an error if an existing file, not managed by the agent, is about to be overwritten.
+// Files of a legacy install, a component installed without managed files recorded, are considered managed,
+// as they were installed before the record existed. The files taken over with force are backed up, so the
+// reset restores them, and the files backed up are considered taken over.
+func checkTakeover(logger *slog.Logger, path, component string, legacyInstall, force bool) error {
+	if legacyInstall {
+		return nil
+	}
+
+	_, err := os.Lstat(hostPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	managedFilesMu.Lock()
+	managedFiles, err := loadManagedFiles()
+	managedFilesMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, ok := managedFiles[path]; ok {
+		return nil
+	}
+	if force {
+		return backupTakenOverFile(logger, path)
+	}
+
+	// The files backed up were already taken over, eg: the files of an adopted component
+	_, err = os.Lstat(hostPath(filepath.Join(takeoverBackupDir, path)))
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("file %s exists and is not managed by the agent, set force to take it over", path)
+}
+
+// backupTakenOverFile copies the file taken over to the backup directory, with its mode and owner.
+// The first backup is kept, it is the file before the install.
+func backupTakenOverFile(logger *slog.Logger, path string) error {
+	backup := filepath.Join(takeoverBackupDir, path)
+	_, err := os.Lstat(hostPath(backup))
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to stat backup of %s: %w", path, err)
+	}
+
+	err = os.MkdirAll(hostPath(filepath.Dir(backup)), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	err = copyFileAs(path, backup)
+	if err != nil {
+		return fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	logger.Info("File taken over backed up", slog.String("file", path))
+
+	return nil
+}
+
+// restoreTakenOverFiles restores the files taken over from the backup directory
+func restoreTakenOverFiles() error {
+	return fs.WalkDir(os.DirFS(hostPath(takeoverBackupDir)), ".", func(name string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && name == "." {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read backup directory: %w", err)
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		path := "/" + name
+		err = os.MkdirAll(hostPath(filepath.Dir(path)), defaultDirectoryMode)
+		if err != nil {
+			return fmt.Errorf("failed to create directory of %s: %w", path, err)
+		}
+		err = copyFileAs(filepath.Join(takeoverBackupDir, name), path)
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+		slog.Info("File taken over restored", slog.String("file", path))
+
+		return nil
+	})
+}
+
+// copyFileAs copies the regular file or the symlink, with the mode and the owner of the source
+func copyFileAs(src, dst string) error {
+	info, err := os.Lstat(hostPath(src))
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unsupported file info %T", info.Sys())
+	}
+
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(hostPath(src))
+		if err != nil {
+			return err
+		}
+		err = os.Remove(hostPath(dst))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		err = os.Symlink(target, hostPath(dst))
+		if err != nil {
+			return err
+		}
+		return os.Lchown(hostPath(dst), int(stat.Uid), int(stat.Gid))
+	case info.Mode().IsRegular():
+		content, err := os.ReadFile(hostPath(src))
+		if err != nil {
+			return err
+		}
+		mode := fmt.Sprintf("%04o", info.Mode().Perm())
+		return installContent(dst, content, mode, strconv.Itoa(int(stat.Uid)), strconv.Itoa(int(stat.Gid)))
+	default:
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+}
+
+// addManagedHeader prepends the managed header to the content, using the comment syntax of the file extension
+func addManagedHeader(path string, content []byte) ([]byte, error) {
+	comment, ok := managedHeaderComments[filepath.Ext(path)]
+	if !ok {
+		return nil, fmt.Errorf("no comment syntax known for %s", path)
+	}
+	header := []byte(comment + " " + managedHeaderText + "\n")
+
+	// Keep the shebang on the first line
+	if bytes.HasPrefix(content, []byte("#!")) {
+		shebang, rest, _ := bytes.Cut(content, []byte("\n"))
+		return slices.Concat(shebang, []byte("\n"), header, rest), nil
+	}
+
+	return slices.Concat(header, content), nil
+}
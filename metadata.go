@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"slices"
 	"time"
 )
 
@@ -17,37 +17,160 @@ import (
 type UserData struct {
 	MetadataURL   string `json:"metadata_url"`
 	NodeSecretKey string `json:"node_secret_key"`
+
+	// Optional partial node metadata, overridden by all the other metadata sources
+	Metadata json.RawMessage `json:"metadata,omitempty"`
 }
 
 // NodeMetadata represents the metadata returned by the node metadata endpoint
 type NodeMetadata struct {
-	ID            string            `json:"id"`
-	Name          string            `json:"name"`
-	ClusterURL    string            `json:"cluster_url"`
-	ClusterCA     string            `json:"cluster_ca"`
-	PoolVersion   string            `json:"pool_version"`
-	KubeletConfig string            `json:"kubelet_config"`
-	NodeLabels    map[string]string `json:"node_labels"`
-	NodeTaints    []struct {
-		Key    string `json:"key"`
-		Value  string `json:"value"`
-		Effect string `json:"effect"`
-	} `json:"node_taints"`
+	ID             string            `json:"id"`
+	Name           string            `json:"name"`
+	ClusterURL     string            `json:"cluster_url"`
+	ClusterCA      string            `json:"cluster_ca"`
+	PoolVersion    string            `json:"pool_version"`
+	KubeletConfig  string            `json:"kubelet_config"`
+	NodeLabels     map[string]string `json:"node_labels"`
+	NodeTaints     []NodeTaint       `json:"node_taints"`
 	ProviderID     string            `json:"provider_id"`
 	ResolvconfPath string            `json:"resolvconf_path"`
 	TemplateArgs   map[string]string `json:"template_args"`
 
 	RepoURI string `json:"repo_uri"`
-	Token   string // Token is not part of the metadata, it is get from the instance user-data
+	Token   string `json:"-"` // Token is not part of the metadata, it is get from the instance user-data
+
+	// Repositories the cluster may switch the node to (repo-uri annotation, ConfigMap), besides the
+	// metadata repository, only applied from the node metadata endpoint
+	AllowedRepoURIs []string `json:"allowed_repo_uris"`
+
+	// Node metadata endpoint, the node status is posted to it with the token unless a status URL is
+	// set, only applied from the node metadata endpoint
+	MetadataURL string `json:"-"`
+	StatusURL   string `json:"status_url"`
+
+	// Control plane endpoint the controller heartbeat is posted to with the token, no heartbeat if not
+	// set, only applied from the node metadata endpoint
+	Heartbeat *HeartbeatEndpoint `json:"heartbeat"`
+
+	// Resync periods and rate limits of the controller, the defaults if not set
+	ControllerTuning *ControllerTuning `json:"controller_tuning"`
 
 	// Kapsule-specific fields
 	HasGPU bool `json:"has_gpu"`
+	GPU    *GPU `json:"gpu"` // NVIDIA driver branch and MIG profile, the release driver without MIG if not set
 
 	// Kosmos-specific fields
-	ExternalIP string `json:"external_ip"`
+	ExternalIP string  `json:"external_ip"`
+	Tunnel     *Tunnel `json:"tunnel"` // WireGuard tunnel to the cluster, managed by the agent if set
+
+	// Release channel of the pool version (stable if empty), eg: beta
+	Channel string `json:"channel"`
 
 	// Installer tags
 	InstallerTags []string `json:"installer_tags"`
+
+	// Per component overrides merged over the release components, eg: a hotfix version
+	ComponentOverrides map[string]ComponentOverride `json:"component_overrides"`
+
+	// Upgrade maintenance window, upgrades are applied immediately if not set
+	MaintenanceWindow *MaintenanceWindow `json:"maintenance_window"`
+
+	// Apply the component changes which do not restart the node services (containerd, kubelet) outside
+	// the maintenance window, only the disruptive ones wait for it
+	SplitDisruptiveUpgrades bool `json:"split_disruptive_upgrades"`
+
+	// Wait for the control plane to approve the upgrade plan before upgrading
+	RequireUpgradeApproval bool `json:"require_upgrade_approval"`
+
+	// Limit of the nodes of the pool upgrading at once, not limited if not set
+	UpgradeConcurrency *UpgradeConcurrency `json:"upgrade_concurrency"`
+
+	// Smoke test of the node after the initial install, not run if not set
+	SmokeTest *SmokeTest `json:"smoke_test"`
+
+	// Nodes managed by the controller of a shared agent, eg: the lightweight nodes of a hypervisor,
+	// only the node of the name if not set, only applied from the node metadata endpoint
+	ManagedNodes []string `json:"managed_nodes"`
+
+	// Kubernetes token of a shared agent allowed to write the managed nodes, the Node authorizer only
+	// allows the node token to write the node of the host, only applied from the node metadata endpoint
+	ManagedNodesToken string `json:"managed_nodes_token"`
+
+	// Prefix of the annotations and labels of the agent and of the NodeOperation API group, eg:
+	// "k8s.example.com", k8s.scaleway.com if not set, only applied from the node metadata endpoint
+	AnnotationPrefix string `json:"annotation_prefix"`
+
+	// SHA256 digests of the component scripts allowed to run, the digests of the metadata.yaml are only
+	// trusted once it is attested by the provenance policy, only applied from the node metadata endpoint
+	ScriptDigests []string `json:"script_digests"`
+
+	// DaemonSets (namespace/name) which pods must be ready on the node after an upgrade
+	CriticalDaemonSets []string `json:"critical_daemonsets"`
+
+	// ConfigMap (namespace/name) holding a partial node metadata in its "metadata.json" key
+	MetadataConfigMap string `json:"metadata_configmap"`
+
+	// Node mounts, processed before the components
+	Mounts []ComponentMount `json:"mounts"`
+
+	// Local disks provisioning, the local disks are left untouched if not set
+	LocalDisks *LocalDisks `json:"local_disks"`
+
+	// Node network prerequisites, checked for drift by the controller
+	Network *ComponentNetwork `json:"network"`
+
+	// Node firewall openings, checked for drift by the controller
+	Firewall *ComponentFirewall `json:"firewall"`
+
+	// Node kernel command line parameters, applied on the next boot
+	Kernel *ComponentKernel `json:"kernel"`
+
+	// Containerd storage settings, rendered in a containerd configuration drop-in
+	Containerd *Containerd `json:"containerd"`
+
+	// deferContainerd keeps the containerd storage settings for the maintenance window, set in the
+	// root agent process when the install request defers containerd
+	deferContainerd bool
+
+	// image is the manifest of the components pre-installed into the node image, loaded once per
+	// install, nil if the node image was not built by the agent
+	image *ImageManifest
+
+	// Image filesystem disk pressure remediation, checked by the controller, disabled if not set
+	ImageGC *ImageGC `json:"image_gc"`
+
+	// Feature gates enabled or disabled for the pool, over the agent defaults
+	FeatureGates map[string]bool `json:"feature_gates"`
+
+	// CNI of the cluster (eg: cilium), the configuration of the other CNIs is quarantined
+	CNI string `json:"cni"`
+
+	// Resources limits of the agent during the installs, not limited if not set
+	ResourceLimits *ResourceLimits `json:"resource_limits"`
+
+	// Node-scoped kubeconfig rendered by the agent, eg: for debugging on the node, none if not set, only
+	// applied from the node metadata endpoint
+	Kubeconfig *Kubeconfig `json:"kubeconfig"`
+
+	// Remote operations of the agent annotation allowed on the node (reinstall, restart, verify), none if not set
+	RemoteOperations []string `json:"remote_operations"`
+
+	// Decommission the node once its Node object is deleted, the decommission must also be allowed by the
+	// remote operations
+	DecommissionOnDelete bool `json:"decommission_on_delete"`
+
+	// Writable paths the component files under read-only filesystems are written to, by read-only path
+	WritablePaths map[string]string `json:"writable_paths"`
+
+	// Write the component files under /usr and /opt to systemd-sysext extensions, for immutable images
+	SystemExtensions bool `json:"system_extensions"`
+
+	// Interface the node metadata endpoint is reached through, by name or CIDR of its address, only
+	// applied from the user-data metadata, the -metadata-interface flag or the default route if not set
+	MetadataInterface string `json:"metadata_interface"`
+
+	// SLSA provenance policy of the component files, not verified if not set
+	Provenance *ProvenancePolicy `json:"provenance"`
 }
 
 func getNodeUserData() (UserData, error) {
@@ -58,7 +181,7 @@ func getNodeUserData() (UserData, error) {
 	}
 
 	// Get credentials from instance user-data
-	resp, err := client.Get("http://169.254.42.42/user_data/k8s")
+	resp, err := client.Get("http://" + userDataAddress + "/user_data/k8s")
 	if err != nil {
 		return UserData{}, fmt.Errorf("failed to get instance user-data: %w", err)
 	}
@@ -118,13 +241,16 @@ func getKosmosUserData() (UserData, error) {
 	return userData, nil
 }
 
+// kosmosUserDataCacheFile caches the user data of the registered Kosmos node
+const kosmosUserDataCacheFile = "/etc/scw-k8s-userdata"
+
 // registerKosmosNode registers a new Kosmos node in the pool and retrieve its generated token
 func registerKosmosNode(apiURL, poolID, poolRegion, secretKey string) (UserData, error) {
-	userdataCachePath := "/etc/scw-k8s-userdata"
+	userdataCachePath := kosmosUserDataCacheFile
 
 	// If userdata cache file is present it means the node is already registered, so use it
 	// If the userdata cache file is not found, it means the node is not registered, so ignore the error and continue with registration
-	userdataCache, err := os.ReadFile(userdataCachePath)
+	userdataCache, err := os.ReadFile(hostPath(userdataCachePath))
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return UserData{}, fmt.Errorf("failed to read userdata cache: %w", err)
 	} else if err == nil {
@@ -176,7 +302,7 @@ func registerKosmosNode(apiURL, poolID, poolRegion, secretKey string) (UserData,
 	}
 
 	// Write the registration response to the userdata cache, so the registration can be skipped next time
-	err = os.WriteFile(userdataCachePath, body, 0600)
+	err = os.WriteFile(hostPath(userdataCachePath), body, 0600)
 	if err != nil {
 		return UserData{}, fmt.Errorf("failed to write Kosmos node userdata cache: %w", err)
 	}
@@ -184,69 +310,69 @@ func registerKosmosNode(apiURL, poolID, poolRegion, secretKey string) (UserData,
 	return userData, nil
 }
 
-func getNodeMetadata(url, token string) (NodeMetadata, error) {
+// fetchNodeMetadata returns the raw JSON metadata returned by the node metadata endpoint, reached
+// through the selected interface if set
+func fetchNodeMetadata(url, token, metadataInterface string) ([]byte, error) {
 	// Create a new HTTP client to get the node metadata
-	client := &http.Client{Timeout: 10 * time.Second}
+	client, err := metadataHTTPClient(metadataInterface)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create a new request with the header X-Auth-Token set to the node token
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return NodeMetadata{}, fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("X-Auth-Token", token)
 
 	// Send the request
 	resp, err := client.Do(req)
 	if err != nil {
-		return NodeMetadata{}, fmt.Errorf("failed to get node metadata: %w", err)
+		return nil, fmt.Errorf("failed to get node metadata: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return NodeMetadata{}, fmt.Errorf("failed to get node metadata: %v", resp.Status)
+		return nil, fmt.Errorf("failed to get node metadata: %v", resp.Status)
 	}
 
 	// Read and close the body of the response
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return NodeMetadata{}, fmt.Errorf("failed to read node metadata: %w", err)
+		return nil, fmt.Errorf("failed to read node metadata: %w", err)
 	}
 
 	err = resp.Body.Close()
 	if err != nil {
-		return NodeMetadata{}, fmt.Errorf("failed to close response body: %w", err)
-	}
-
-	// Unmarshal the json metadata
-	var metadata NodeMetadata
-	err = json.Unmarshal(body, &metadata)
-	if err != nil {
-		return NodeMetadata{}, fmt.Errorf("failed to unmarshal node metadata: %w", err)
+		return nil, fmt.Errorf("failed to close response body: %w", err)
 	}
 
-	metadata.Token = token
-
-	return metadata, nil
+	return body, nil
 }
 
 func createPrivilegedHTTPClient() (*http.Client, error) {
-	// Exclude some ports from that can cause conflicts with other services running or to be run on the node
-	excludedPorts := []int{
-		179, // Used by calico-bird BGP.
+	// Bind to the selected interface, otherwise to the address of the interface routing to the endpoint,
+	// or in the configured network
+	var device string
+	var address net.IP
+	var err error
+	if metadataInterfaceFlag != "" {
+		device, address, err = resolveMetadataInterface(metadataInterfaceFlag)
+	} else {
+		address, err = privilegedSourceAddress(privilegedPortConfig.SourceCIDR)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Find a free priviledged port to use for the HTTP client
+	// Find a free priviledged port to use for the HTTP client, among the allowed ports
 	var clientPrivilegedPort int
-	for i := 1; i < 1024; i++ {
-		// Skip the excluded ports
-		if slices.Contains(excludedPorts, i) {
-			continue
-		}
-
+	for _, port := range privilegedPortConfig.Ports {
 		// Try to bind to the port
-		laddr := &net.TCPAddr{Port: i}
+		laddr := &net.TCPAddr{IP: address, Port: port}
 		conn, err := net.ListenTCP("tcp", laddr)
 		if err == nil {
-			clientPrivilegedPort = i
+			clientPrivilegedPort = port
 			err = conn.Close()
 			if err != nil {
 				return nil, fmt.Errorf("failed to close connection: %w", err)
@@ -254,11 +380,12 @@ func createPrivilegedHTTPClient() (*http.Client, error) {
 			break
 		}
 	}
-	if clientPrivilegedPort == 0 {
+	if clientPrivilegedPort == 0 && len(privilegedPortConfig.Ports) > 0 {
 		return nil, fmt.Errorf("failed to get a priviledged port")
 	}
+	slog.Debug("Privileged source port selected", slog.String("interface", device), slog.Any("address", address), slog.Int("port", clientPrivilegedPort))
 
-	// Create a new HTTP client using the priviledged port
+	// Create a new HTTP client using the priviledged port, an ephemeral port if disabled
 	return &http.Client{
 		Timeout: 30 * time.Second,
 		Transport: &http.Transport{
@@ -266,7 +393,8 @@ func createPrivilegedHTTPClient() (*http.Client, error) {
 			DialContext: (&net.Dialer{
 				Timeout:   10 * time.Second,
 				KeepAlive: -1,
-				LocalAddr: &net.TCPAddr{Port: clientPrivilegedPort},
+				LocalAddr: &net.TCPAddr{IP: address, Port: clientPrivilegedPort},
+				Control:   bindToDevice(device),
 			}).DialContext,
 		},
 	}, nil
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// Default modes when the mode is omitted
+const (
+	defaultFileMode       = 0644
+	defaultExecutableMode = 0755
+	defaultDirectoryMode  = 0755
+)
+
+// defaultModeForContent returns the default mode of a file, executables (ELF binaries and scripts) are executable
+func defaultModeForContent(content []byte) uint32 {
+	if bytes.HasPrefix(content, []byte("\x7fELF")) || bytes.HasPrefix(content, []byte("#!")) {
+		return defaultExecutableMode
+	}
+	return defaultFileMode
+}
+
+// parseMode parses an octal mode (eg: "0755", "4755") or a symbolic mode (eg: "u=rwX,go=rX").
+// Symbolic modes are applied on top of the default mode, and an empty mode returns the default mode.
+func parseMode(mode string, defaultMode uint32, isDir bool) (fs.FileMode, error) {
+	if mode == "" {
+		return toFileMode(defaultMode), nil
+	}
+
+	// Octal mode
+	if mode[0] >= '0' && mode[0] <= '7' {
+		parsedMode, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse mode %q: %w", mode, err)
+		}
+		if parsedMode > 07777 {
+			return 0, fmt.Errorf("invalid mode %q", mode)
+		}
+		return toFileMode(uint32(parsedMode)), nil
+	}
+
+	// Symbolic mode
+	parsedMode := defaultMode
+	for clause := range strings.SplitSeq(mode, ",") {
+		var err error
+		parsedMode, err = applySymbolicClause(parsedMode, clause, isDir)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse mode %q: %w", mode, err)
+		}
+	}
+
+	return toFileMode(parsedMode), nil
+}
+
+// applySymbolicClause applies a single symbolic clause (eg: "go-w") to the unix mode
+func applySymbolicClause(mode uint32, clause string, isDir bool) (uint32, error) {
+	// Parse the who part, no who means all
+	var who uint32
+	i := 0
+	for ; i < len(clause) && strings.ContainsRune("ugoa", rune(clause[i])); i++ {
+		switch clause[i] {
+		case 'u':
+			who |= 04700
+		case 'g':
+			who |= 02070
+		case 'o':
+			who |= 01007
+		case 'a':
+			who |= 07777
+		}
+	}
+	if who == 0 {
+		who = 07777
+	}
+
+	if i >= len(clause) || !strings.ContainsRune("+-=", rune(clause[i])) {
+		return 0, fmt.Errorf("invalid clause %q", clause)
+	}
+	op := clause[i]
+
+	// Parse the permissions part
+	var perms uint32
+	for _, p := range clause[i+1:] {
+		switch p {
+		case 'r':
+			perms |= 0444
+		case 'w':
+			perms |= 0222
+		case 'x':
+			perms |= 0111
+		case 'X':
+			// Execute only for directories or if any execute bit is already set
+			if isDir || mode&0111 != 0 {
+				perms |= 0111
+			}
+		case 's':
+			perms |= 06000
+		case 't':
+			perms |= 01000
+		default:
+			return 0, fmt.Errorf("invalid permission %q in clause %q", p, clause)
+		}
+	}
+	perms &= who
+
+	switch op {
+	case '+':
+		mode |= perms
+	case '-':
+		mode &^= perms
+	case '=':
+		// The assignment clears the special bits of the who too, except the setuid and setgid bits of
+		// the directories, as chmod does
+		cleared := who
+		if isDir {
+			cleared &^= 06000
+		}
+		mode = mode&^cleared | perms
+	}
+
+	return mode, nil
+}
+
+// toFileMode converts a unix mode to a fs.FileMode, including the setuid, setgid and sticky bits
+func toFileMode(mode uint32) fs.FileMode {
+	fileMode := fs.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		fileMode |= fs.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fileMode |= fs.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fileMode |= fs.ModeSticky
+	}
+	return fileMode
+}
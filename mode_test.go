@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/fs"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		defaultMode uint32
+		isDir       bool
+		expected    fs.FileMode
+	}{
+		{
+			name:        "empty mode",
+			mode:        "",
+			defaultMode: defaultFileMode,
+			expected:    0644,
+		},
+		{
+			name:        "octal mode",
+			mode:        "0600",
+			defaultMode: defaultFileMode,
+			expected:    0600,
+		},
+		{
+			name:        "octal mode with setuid",
+			mode:        "4755",
+			defaultMode: defaultFileMode,
+			expected:    0755 | fs.ModeSetuid,
+		},
+		{
+			name:        "octal mode with sticky",
+			mode:        "1777",
+			defaultMode: defaultDirectoryMode,
+			isDir:       true,
+			expected:    0777 | fs.ModeSticky,
+		},
+		{
+			name:        "symbolic mode on file",
+			mode:        "u=rwX,go=rX",
+			defaultMode: defaultFileMode,
+			expected:    0644,
+		},
+		{
+			name:        "symbolic mode on executable",
+			mode:        "u=rwX,go=rX",
+			defaultMode: defaultExecutableMode,
+			expected:    0755,
+		},
+		{
+			name:        "symbolic mode on directory",
+			mode:        "u=rwX,go=",
+			defaultMode: defaultFileMode,
+			isDir:       true,
+			expected:    0700,
+		},
+		{
+			name:        "symbolic relative mode",
+			mode:        "go-r,u+x",
+			defaultMode: defaultFileMode,
+			expected:    0700,
+		},
+		{
+			name:        "symbolic setgid",
+			mode:        "g+s",
+			defaultMode: defaultDirectoryMode,
+			isDir:       true,
+			expected:    0755 | fs.ModeSetgid,
+		},
+		{
+			name:        "symbolic assignment clears setuid",
+			mode:        "u=rwx",
+			defaultMode: 04755,
+			expected:    0755,
+		},
+		{
+			name:        "symbolic assignment keeps directory setgid",
+			mode:        "g=rx",
+			defaultMode: 02755,
+			isDir:       true,
+			expected:    0755 | fs.ModeSetgid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseMode(tt.mode, tt.defaultMode, tt.isDir)
+			if err != nil {
+				t.Fatalf("parseMode(%q) returned an error: %v", tt.mode, err)
+			}
+			if result != tt.expected {
+				t.Errorf("parseMode(%q) = %v, expected %v", tt.mode, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseModeInvalid(t *testing.T) {
+	for _, mode := range []string{"0999", "77777", "u~rw", "u=rwz"} {
+		if _, err := parseMode(mode, defaultFileMode, false); err == nil {
+			t.Errorf("parseMode(%q) expected an error", mode)
+		}
+	}
+}
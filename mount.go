@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ComponentMount declares a mount, persisted either as a systemd mount unit or as a fstab entry
+//
+//	mounts:
+//	  - state: mounted
+//	    what: /dev/vdb
+//	    where: /var/lib/containerd
+//	    type: ext4
+//	    options: defaults,noatime
+//	    persistence: systemd
+type ComponentMount struct {
+	State       string `yaml:"state" json:"state"`
+	What        string `yaml:"what" json:"what"`
+	Where       string `yaml:"where" json:"where"`
+	Type        string `yaml:"type" json:"type"`
+	Options     string `yaml:"options,omitempty" json:"options,omitempty"`
+	Persistence string `yaml:"persistence,omitempty" json:"persistence,omitempty"` // systemd (default) or fstab
+}
+
+const (
+	fstabPath   = "/etc/fstab"
+	fstabMarker = "# managed by scw-k8s-agent"
+)
+
+const systemdUnitsDir = "/etc/systemd/system"
+
+func processMounts(logger *slog.Logger, mounts []ComponentMount) error {
+	for _, mount := range mounts {
+		if !filepath.IsAbs(mount.Where) {
+			return fmt.Errorf("mount point %q must be an absolute path", mount.Where)
+		}
+		where := filepath.Clean(mount.Where)
+
+		switch mount.State {
+		case "mounted":
+			err := mountPersisted(mount, where)
+			if err != nil {
+				return fmt.Errorf("failed to mount %s: %w", where, err)
+			}
+			logger.Info("Mount configured", slog.String("where", where), slog.String("what", mount.What))
+		case "absent":
+			err := unmountPersisted(mount, where)
+			if err != nil {
+				return fmt.Errorf("failed to unmount %s: %w", where, err)
+			}
+			logger.Info("Mount removed", slog.String("where", where))
+		default:
+			return fmt.Errorf("unknown mount state: %s", mount.State)
+		}
+	}
+
+	return nil
+}
+
+func mountPersisted(mount ComponentMount, where string) error {
+	err := os.MkdirAll(hostPath(where), defaultDirectoryMode)
+	if err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+
+	switch mount.Persistence {
+	case "", "systemd":
+		// Write the mount unit and start it
+		unitName := mountUnitName(where)
+		err = os.WriteFile(hostPath(filepath.Join(systemdUnitsDir, unitName)), []byte(mountUnit(mount, where)), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to write mount unit: %w", err)
+		}
+
+		cmd := command("/usr/bin/systemctl", "daemon-reload")
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to daemon-reload: %w", err)
+		}
+
+		cmd = command("/usr/bin/systemctl", "enable", "--now", unitName)
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to enable mount unit %s: %w", unitName, err)
+		}
+	case "fstab":
+		// Write the fstab entry and mount it if not already mounted
+		options := mount.Options
+		if options == "" {
+			options = "defaults"
+		}
+		entry := fmt.Sprintf("%s %s %s %s 0 0 %s", mount.What, where, mount.Type, options, fstabMarker)
+		err = setFstabEntry(where, entry)
+		if err != nil {
+			return err
+		}
+
+		mounted, err := isMounted(where)
+		if err != nil {
+			return err
+		}
+		if !mounted {
+			cmd := command("/usr/bin/mount", where)
+			err = cmd.Run()
+			if err != nil {
+				return fmt.Errorf("failed to mount: %w", err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown mount persistence: %s", mount.Persistence)
+	}
+
+	return nil
+}
+
+func unmountPersisted(mount ComponentMount, where string) error {
+	switch mount.Persistence {
+	case "", "systemd":
+		unitName := mountUnitName(where)
+		unitPath := filepath.Join(systemdUnitsDir, unitName)
+		if _, err := os.Stat(hostPath(unitPath)); os.IsNotExist(err) {
+			return nil
+		}
+
+		cmd := command("/usr/bin/systemctl", "disable", "--now", unitName)
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to disable mount unit %s: %w", unitName, err)
+		}
+
+		err = os.Remove(hostPath(unitPath))
+		if err != nil {
+			return fmt.Errorf("failed to remove mount unit: %w", err)
+		}
+
+		cmd = command("/usr/bin/systemctl", "daemon-reload")
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to daemon-reload: %w", err)
+		}
+	case "fstab":
+		mounted, err := isMounted(where)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			cmd := command("/usr/bin/umount", where)
+			err = cmd.Run()
+			if err != nil {
+				return fmt.Errorf("failed to unmount: %w", err)
+			}
+		}
+
+		err = setFstabEntry(where, "")
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown mount persistence: %s", mount.Persistence)
+	}
+
+	return nil
+}
+
+// mountUnit renders the systemd mount unit
+func mountUnit(mount ComponentMount, where string) string {
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "# %s\n", managedHeaderText)
+	fmt.Fprintf(&unit, "[Unit]\nDescription=Mount %s\n\n", where)
+	fmt.Fprintf(&unit, "[Mount]\nWhat=%s\nWhere=%s\nType=%s\n", mount.What, where, mount.Type)
+	if mount.Options != "" {
+		fmt.Fprintf(&unit, "Options=%s\n", mount.Options)
+	}
+	fmt.Fprintf(&unit, "\n[Install]\nWantedBy=local-fs.target\n")
+	return unit.String()
+}
+
+// mountUnitName returns the systemd mount unit name of the mount point, as systemd-escape --path does
+func mountUnitName(where string) string {
+	path := strings.Trim(where, "/")
+	if path == "" {
+		return "-.mount"
+	}
+
+	var name strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			name.WriteByte('-')
+		case c == '.' && i == 0:
+			fmt.Fprintf(&name, "\\x%02x", c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.':
+			name.WriteByte(c)
+		default:
+			fmt.Fprintf(&name, "\\x%02x", c)
+		}
+	}
+
+	return name.String() + ".mount"
+}
+
+// setFstabEntry replaces the agent managed fstab entry of the mount point, an empty entry removes it
+func setFstabEntry(where, entry string) error {
+	fstab, err := os.ReadFile(hostPath(fstabPath))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read fstab: %w", err)
+	}
+
+	var lines []string
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(fstab))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if strings.HasSuffix(line, fstabMarker) && len(fields) > 1 && fields[1] == where {
+			found = true
+			if entry != "" {
+				lines = append(lines, entry)
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse fstab: %w", err)
+	}
+	if !found && entry != "" {
+		lines = append(lines, entry)
+	}
+
+	err = os.WriteFile(hostPath(fstabPath), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write fstab: %w", err)
+	}
+
+	return nil
+}
+
+// isMounted checks if the path is a mount point
+func isMounted(where string) (bool, error) {
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("failed to read mountinfo: %w", err)
+	}
+
+	for line := range strings.Lines(string(mountinfo)) {
+		fields := strings.Fields(line)
+		if len(fields) > 4 && fields[4] == where {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
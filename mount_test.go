@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMountUnitName(t *testing.T) {
+	tests := []struct {
+		where    string
+		expected string
+	}{
+		{where: "/", expected: "-.mount"},
+		{where: "/var/lib/containerd", expected: "var-lib-containerd.mount"},
+		{where: "/mnt/my-disk/", expected: `mnt-my\x2ddisk.mount`},
+		{where: "/srv/.cache", expected: "srv-.cache.mount"},
+		{where: "/.hidden", expected: `\x2ehidden.mount`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			result := mountUnitName(tt.where)
+			if result != tt.expected {
+				t.Errorf("mountUnitName(%q) = %q, expected %q", tt.where, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSetFstabEntry(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	// The entries not managed by the agent are kept, even on the same mount point
+	err := os.MkdirAll(hostPath("/etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := "UUID=root / ext4 defaults 0 1\n/dev/vdc /var/lib/containerd xfs defaults 0 0\n"
+	err = os.WriteFile(hostPath(fstabPath), []byte(original), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		entry    string
+		expected string
+	}{
+		{name: "insert", entry: "/dev/vdb /var/lib/containerd ext4 defaults 0 0 " + fstabMarker, expected: original + "/dev/vdb /var/lib/containerd ext4 defaults 0 0 " + fstabMarker + "\n"},
+		{name: "update", entry: "/dev/vdb /var/lib/containerd ext4 defaults,noatime 0 0 " + fstabMarker, expected: original + "/dev/vdb /var/lib/containerd ext4 defaults,noatime 0 0 " + fstabMarker + "\n"},
+		{name: "remove", entry: "", expected: original},
+		{name: "remove absent", entry: "", expected: original},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := setFstabEntry("/var/lib/containerd", test.entry)
+			if err != nil {
+				t.Fatalf("failed to set fstab entry: %v", err)
+			}
+			fstab, err := os.ReadFile(hostPath(fstabPath))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(fstab) != test.expected {
+				t.Errorf("expected fstab %q, got %q", test.expected, fstab)
+			}
+		})
+	}
+}
+
+func TestProcessMounts(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	err := os.MkdirAll(hostPath(systemdUnitsDir), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unitPath := hostPath(filepath.Join(systemdUnitsDir, "mnt-data.mount"))
+	mount := ComponentMount{State: "mounted", What: "/dev/vdb", Where: "/mnt/data", Type: "ext4", Options: "noatime"}
+	err = processMounts(slog.Default(), []ComponentMount{mount})
+	if err != nil {
+		t.Fatalf("failed to process mounts: %v", err)
+	}
+	expected, err := os.ReadFile(unitPath)
+	if err != nil || !strings.Contains(string(expected), "What=/dev/vdb\nWhere=/mnt/data\nType=ext4\nOptions=noatime\n") {
+		t.Fatalf("expected the mount unit written, got %q, %v", expected, err)
+	}
+	_, err = os.Stat(hostPath("/mnt/data"))
+	if err != nil {
+		t.Errorf("expected the mount point created, got %v", err)
+	}
+
+	// A mount unit modified or removed on the node is written again
+	for _, drift := range []func() error{
+		func() error { return os.WriteFile(unitPath, []byte("[Mount]\nWhat=/dev/vdc\n"), 0644) },
+		func() error { return os.Remove(unitPath) },
+	} {
+		err = drift()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = processMounts(slog.Default(), []ComponentMount{mount})
+		if err != nil {
+			t.Fatalf("failed to process mounts: %v", err)
+		}
+		unit, err := os.ReadFile(unitPath)
+		if err != nil || string(unit) != string(expected) {
+			t.Errorf("expected the mount unit restored, got %q, %v", unit, err)
+		}
+	}
+
+	// An absent mount removes its unit
+	mount.State = "absent"
+	err = processMounts(slog.Default(), []ComponentMount{mount})
+	if err != nil {
+		t.Fatalf("failed to process mounts: %v", err)
+	}
+	_, err = os.Stat(unitPath)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the mount unit removed, got %v", err)
+	}
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(commands), "enable --now mnt-data.mount") != 3 || strings.Count(string(commands), "disable --now mnt-data.mount") != 1 {
+		t.Errorf("expected the mount unit enabled three times and disabled once, got commands %q", commands)
+	}
+
+	// A fstab entry edited on the node is written again, then removed
+	mount = ComponentMount{State: "mounted", What: "/dev/vdb", Where: "/mnt/data", Type: "ext4", Persistence: "fstab"}
+	entry := "/dev/vdb /mnt/data ext4 defaults 0 0 " + fstabMarker + "\n"
+	err = processMounts(slog.Default(), []ComponentMount{mount})
+	if err != nil {
+		t.Fatalf("failed to process mounts: %v", err)
+	}
+	err = os.WriteFile(hostPath(fstabPath), []byte("/dev/vdc /mnt/data xfs defaults 0 0 "+fstabMarker+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = processMounts(slog.Default(), []ComponentMount{mount})
+	if err != nil {
+		t.Fatalf("failed to process mounts: %v", err)
+	}
+	fstab, err := os.ReadFile(hostPath(fstabPath))
+	if err != nil || string(fstab) != entry {
+		t.Errorf("expected fstab %q, got %q, %v", entry, fstab, err)
+	}
+	mount.State = "absent"
+	err = processMounts(slog.Default(), []ComponentMount{mount})
+	if err != nil {
+		t.Fatalf("failed to process mounts: %v", err)
+	}
+	fstab, err = os.ReadFile(hostPath(fstabPath))
+	if err != nil || strings.Contains(string(fstab), fstabMarker) {
+		t.Errorf("expected the fstab entry removed, got %q, %v", fstab, err)
+	}
+
+	// Invalid mounts are refused
+	for _, invalid := range []ComponentMount{
+		{State: "mounted", Where: "mnt/data"},
+		{State: "unmounted", Where: "/mnt/data"},
+		{State: "mounted", Where: "/mnt/data", Persistence: "automount"},
+	} {
+		err = processMounts(slog.Default(), []ComponentMount{invalid})
+		if err == nil {
+			t.Errorf("expected an error for mount %+v", invalid)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ComponentNetwork declares the networking prerequisites of a component (or of the node)
+//
+//	network:
+//	  state: present
+//	  modules: [br_netfilter, overlay]
+//	  sysctls:
+//	    net.ipv4.ip_forward: "1"
+//	    net.bridge.bridge-nf-call-iptables: "1"
+//	  interfaces:
+//	    - name: ens5
+//	      mtu: 1500
+//	      addresses: [192.168.1.10/24]
+type ComponentNetwork struct {
+	State      string             `yaml:"state" json:"state"` // present or absent
+	Modules    []string           `yaml:"modules,omitempty" json:"modules,omitempty"`
+	Sysctls    map[string]string  `yaml:"sysctls,omitempty" json:"sysctls,omitempty"`
+	Interfaces []NetworkInterface `yaml:"interfaces,omitempty" json:"interfaces,omitempty"`
+}
+
+type NetworkInterface struct {
+	Name      string   `yaml:"name" json:"name"`
+	MTU       int      `yaml:"mtu,omitempty" json:"mtu,omitempty"`
+	Addresses []string `yaml:"addresses,omitempty" json:"addresses,omitempty"`
+}
+
+// networkOriginalState is the state before the network configuration was applied, restored on removal
+type networkOriginalState struct {
+	Sysctls   map[string]string   `json:"sysctls"`
+	MTUs      map[string]int      `json:"mtus"`
+	Addresses map[string][]string `json:"addresses"`
+}
+
+func networkModulesFile(owner string) string {
+	return fmt.Sprintf("/etc/modules-load.d/scw-k8s-%s.conf", owner)
+}
+
+func networkSysctlsFile(owner string) string {
+	return fmt.Sprintf("/etc/sysctl.d/90-scw-k8s-%s.conf", owner)
+}
+
+func networkStateFile(owner string) string {
+	return filepath.Join(stateDir, fmt.Sprintf("network-%s.json", owner))
+}
+
+// processNetwork applies or reverts the network configuration owned by a component (or "node")
+func processNetwork(logger *slog.Logger, owner string, network *ComponentNetwork) error {
+	if network == nil {
+		return nil
+	}
+
+	switch network.State {
+	case "", "present":
+		err := applyNetwork(owner, *network)
+		if err != nil {
+			return fmt.Errorf("failed to apply network configuration: %w", err)
+		}
+		logger.Info("Network configuration applied", slog.String("owner", owner))
+	case "absent":
+		err := revertNetwork(owner)
+		if err != nil {
+			return fmt.Errorf("failed to revert network configuration: %w", err)
+		}
+		logger.Info("Network configuration reverted", slog.String("owner", owner))
+	default:
+		return fmt.Errorf("unknown network state: %s", network.State)
+	}
+
+	return nil
+}
+
+func applyNetwork(owner string, network ComponentNetwork) error {
+	// Record the original state the first time, so it can be reverted
+	_, err := os.Stat(hostPath(networkStateFile(owner)))
+	if errors.Is(err, fs.ErrNotExist) {
+		original, err := currentNetworkState(network)
+		if err != nil {
+			return err
+		}
+		jsonOriginal, err := json.Marshal(original)
+		if err != nil {
+			return fmt.Errorf("failed to marshal network state: %w", err)
+		}
+		err = os.MkdirAll(hostPath(stateDir), 0700)
+		if err != nil {
+			return fmt.Errorf("failed to create state directory: %w", err)
+		}
+		err = os.WriteFile(hostPath(networkStateFile(owner)), jsonOriginal, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to write network state: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to stat network state: %w", err)
+	}
+
+	// Load and persist the kernel modules
+	for _, module := range network.Modules {
+		cmd := command("/usr/sbin/modprobe", module)
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to load module %s: %w", module, err)
+		}
+	}
+	if len(network.Modules) > 0 {
+		err = os.WriteFile(hostPath(networkModulesFile(owner)), []byte(strings.Join(network.Modules, "\n")+"\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to persist modules: %w", err)
+		}
+	}
+
+	// Set and persist the sysctls
+	keys := make([]string, 0, len(network.Sysctls))
+	for key := range network.Sysctls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sysctls strings.Builder
+	for _, key := range keys {
+		err = writeSysctl(key, network.Sysctls[key])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sysctls, "%s = %s\n", key, network.Sysctls[key])
+	}
+	if len(keys) > 0 {
+		err = os.WriteFile(hostPath(networkSysctlsFile(owner)), []byte(sysctls.String()), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to persist sysctls: %w", err)
+		}
+	}
+
+	// Configure the interfaces
+	for _, iface := range network.Interfaces {
+		err = configureInterface(iface)
+		if err != nil {
+			return fmt.Errorf("failed to configure interface %s: %w", iface.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func revertNetwork(owner string) error {
+	jsonOriginal, err := os.ReadFile(hostPath(networkStateFile(owner)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read network state: %w", err)
+	}
+
+	var original networkOriginalState
+	err = json.Unmarshal(jsonOriginal, &original)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal network state: %w", err)
+	}
+
+	// Remove the persisted configuration, the kernel modules are not unloaded since they may be in use
+	for _, path := range []string{networkModulesFile(owner), networkSysctlsFile(owner)} {
+		err = os.Remove(hostPath(path))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	// Restore the original sysctls
+	for key, value := range original.Sysctls {
+		err = writeSysctl(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Restore the original interfaces MTU and addresses
+	for name, mtu := range original.MTUs {
+		err = configureInterface(NetworkInterface{Name: name, MTU: mtu})
+		if err != nil {
+			return fmt.Errorf("failed to restore interface %s: %w", name, err)
+		}
+	}
+	for name, addresses := range original.Addresses {
+		current, err := interfaceAddresses(name)
+		if err != nil {
+			return err
+		}
+		for _, address := range current {
+			if slices.Contains(addresses, address) {
+				continue
+			}
+			cmd := command("/usr/sbin/ip", "address", "del", address, "dev", name)
+			err = cmd.Run()
+			if err != nil {
+				return fmt.Errorf("failed to remove address %s from %s: %w", address, name, err)
+			}
+		}
+	}
+
+	err = os.Remove(hostPath(networkStateFile(owner)))
+	if err != nil {
+		return fmt.Errorf("failed to remove network state: %w", err)
+	}
+
+	return nil
+}
+
+// currentNetworkState returns the current values of the sysctls and interfaces declared in the configuration
+func currentNetworkState(network ComponentNetwork) (networkOriginalState, error) {
+	state := networkOriginalState{
+		Sysctls:   map[string]string{},
+		MTUs:      map[string]int{},
+		Addresses: map[string][]string{},
+	}
+
+	for key := range network.Sysctls {
+		value, err := readSysctl(key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The sysctl may only exist once its module is loaded
+			continue
+		}
+		if err != nil {
+			return networkOriginalState{}, err
+		}
+		state.Sysctls[key] = value
+	}
+
+	for _, iface := range network.Interfaces {
+		netIface, err := net.InterfaceByName(iface.Name)
+		if err != nil {
+			return networkOriginalState{}, fmt.Errorf("failed to get interface %s: %w", iface.Name, err)
+		}
+		state.MTUs[iface.Name] = netIface.MTU
+
+		addresses, err := interfaceAddresses(iface.Name)
+		if err != nil {
+			return networkOriginalState{}, err
+		}
+		state.Addresses[iface.Name] = addresses
+	}
+
+	return state, nil
+}
+
+// networkDrift returns the differences between the network configuration and the current state
+func networkDrift(network ComponentNetwork) ([]string, error) {
+	if network.State == "absent" {
+		return nil, nil
+	}
+
+	var drifts []string
+
+	for _, module := range network.Modules {
+		loaded, err := moduleLoaded(module)
+		if err != nil {
+			return nil, err
+		}
+		if !loaded {
+			drifts = append(drifts, fmt.Sprintf("module %s is not loaded", module))
+		}
+	}
+
+	current, err := currentNetworkState(network)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range network.Sysctls {
+		// The multi-value sysctls are read with tabs, eg: net.ipv4.ip_local_port_range
+		if normalizeSysctl(current.Sysctls[key]) != normalizeSysctl(value) {
+			drifts = append(drifts, fmt.Sprintf("sysctl %s is %q instead of %q", key, current.Sysctls[key], value))
+		}
+	}
+	for _, iface := range network.Interfaces {
+		if iface.MTU != 0 && current.MTUs[iface.Name] != iface.MTU {
+			drifts = append(drifts, fmt.Sprintf("interface %s MTU is %d instead of %d", iface.Name, current.MTUs[iface.Name], iface.MTU))
+		}
+		for _, address := range iface.Addresses {
+			if !slices.Contains(current.Addresses[iface.Name], address) {
+				drifts = append(drifts, fmt.Sprintf("interface %s is missing address %s", iface.Name, address))
+			}
+		}
+	}
+	sort.Strings(drifts)
+
+	return drifts, nil
+}
+
+func configureInterface(iface NetworkInterface) error {
+	if iface.MTU != 0 {
+		cmd := command("/usr/sbin/ip", "link", "set", "dev", iface.Name, "mtu", strconv.Itoa(iface.MTU))
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to set MTU: %w", err)
+		}
+	}
+
+	current, err := interfaceAddresses(iface.Name)
+	if err != nil {
+		return err
+	}
+	for _, address := range iface.Addresses {
+		if slices.Contains(current, address) {
+			continue
+		}
+		cmd := command("/usr/sbin/ip", "address", "add", address, "dev", iface.Name)
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to add address %s: %w", address, err)
+		}
+	}
+
+	if len(iface.Addresses) > 0 {
+		cmd := command("/usr/sbin/ip", "link", "set", "dev", iface.Name, "up")
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to set interface up: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// interfaceAddresses returns the addresses of the interface in CIDR notation
+func interfaceAddresses(name string) ([]string, error) {
+	netIface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %s: %w", name, err)
+	}
+
+	addrs, err := netIface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get interface %s addresses: %w", name, err)
+	}
+
+	addresses := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addresses = append(addresses, addr.String())
+	}
+
+	return addresses, nil
+}
+
+// moduleLoaded returns true if the kernel module is loaded or built into the kernel. The built-in
+// modules are not listed in /proc/modules, only those with parameters have a /sys/module directory.
+func moduleLoaded(module string) (bool, error) {
+	// The module names are listed with underscores, the dashes are accepted by modprobe
+	name := strings.ReplaceAll(module, "-", "_")
+
+	_, err := os.Stat(hostPath(filepath.Join("/sys/module", name)))
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("failed to stat module %s: %w", module, err)
+	}
+
+	modules, err := os.ReadFile(hostPath("/proc/modules"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read modules: %w", err)
+	}
+	for _, line := range strings.Split(string(modules), "\n") {
+		if loaded, _, _ := strings.Cut(line, " "); loaded == name {
+			return true, nil
+		}
+	}
+
+	release, err := os.ReadFile(hostPath("/proc/sys/kernel/osrelease"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read kernel release: %w", err)
+	}
+	builtin, err := os.ReadFile(hostPath(filepath.Join("/lib/modules", strings.TrimSpace(string(release)), "modules.builtin")))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read built-in modules: %w", err)
+	}
+	for _, line := range strings.Split(string(builtin), "\n") {
+		if strings.ReplaceAll(strings.TrimSuffix(filepath.Base(line), ".ko"), "-", "_") == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// normalizeSysctl returns the sysctl value with its fields separated by a single space
+func normalizeSysctl(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func sysctlPath(key string) string {
+	return filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+}
+
+// readSysctl reads the sysctl of the running kernel, an alternate root has none
+func readSysctl(key string) (string, error) {
+	if serviceManager == chrootServiceManager {
+		return "", fmt.Errorf("sysctl %s of the alternate root: %w", key, fs.ErrNotExist)
+	}
+	value, err := os.ReadFile(hostPath(sysctlPath(key)))
+	if err != nil {
+		return "", fmt.Errorf("failed to read sysctl %s: %w", key, err)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// writeSysctl sets the sysctl of the running kernel, the sysctls of an alternate root are only persisted
+// and applied on its boot
+func writeSysctl(key, value string) error {
+	if serviceManager == chrootServiceManager {
+		return nil
+	}
+	err := os.WriteFile(hostPath(sysctlPath(key)), []byte(value), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write sysctl %s: %w", key, err)
+	}
+	return nil
+}
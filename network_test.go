@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNetworkDrift(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	files := map[string]string{
+		"/proc/modules":                                 "br_netfilter 32768 0 - Live 0x0000000000000000\noverlay 151552 1 - Live 0x0000000000000000\n",
+		"/proc/sys/kernel/osrelease":                    "6.8.0-45-generic\n",
+		"/lib/modules/6.8.0-45-generic/modules.builtin": "kernel/net/ipv4/ip_tunnel.ko\nkernel/net/netfilter/nf-conntrack.ko\n",
+		"/sys/module/ip_vs/parameters/conn_tab_bits":    "12\n",
+		"/proc/sys/net/ipv4/ip_forward":                 "1\n",
+		"/proc/sys/net/ipv4/ip_local_port_range":        "32768\t60999\n",
+		"/proc/sys/net/core/somaxconn":                  "4096\n",
+	}
+	for path, content := range files {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(rootDir, path)), 0755)
+		if err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		err = os.WriteFile(filepath.Join(rootDir, path), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	network := ComponentNetwork{
+		Modules: []string{"br_netfilter", "overlay", "ip_tunnel", "nf_conntrack", "ip_vs", "br", "wireguard"},
+		Sysctls: map[string]string{
+			"net.ipv4.ip_forward":          "1",
+			"net.ipv4.ip_local_port_range": "32768 60999",
+			"net.core.somaxconn":           "65535",
+		},
+	}
+	drifts, err := networkDrift(network)
+	if err != nil {
+		t.Fatalf("failed to detect network drift: %v", err)
+	}
+
+	// Only the missing modules and the differing values are reported, not the built-in modules nor
+	// the whitespace differences
+	expected := []string{
+		"module br is not loaded",
+		"module wireguard is not loaded",
+		`sysctl net.core.somaxconn is "4096" instead of "65535"`,
+	}
+	if !reflect.DeepEqual(drifts, expected) {
+		t.Errorf("drifts = %q, expected %q", drifts, expected)
+	}
+}
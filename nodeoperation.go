@@ -0,0 +1,267 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NodeOperation is a namespaced custom resource triggering an agent operation on a node, an alternative
+// to the agent annotation with parameters and a status updated by the agent
+//
+//	apiVersion: k8s.scaleway.com/v1alpha1
+//	kind: NodeOperation
+//	metadata:
+//	  name: upgrade-1-31-3
+//	  namespace: kube-system
+//	  labels:
+//	    k8s.scaleway.com/node: scw-pool-1234
+//	spec:
+//	  operation: upgrade # upgrade, restore, plan, reinstall, restart, verify or decommission
+//	  parameters:
+//	    repo_uri: https://repo.example.com/k8s # upgrade and plan, component for reinstall, service for restart
+//	status:
+//	  phase: Succeeded # Pending, Running, Succeeded or Failed
+//	  message: Node upgraded
+//	  result: ""
+//	  startTime: "2024-10-07T10:00:00Z"
+//	  completionTime: "2024-10-07T10:03:12Z"
+var nodeOperationResource = schema.GroupVersionResource{Group: "k8s.scaleway.com", Version: "v1alpha1", Resource: "nodeoperations"}
+
+// nodeOperationsNamespace is the namespace of the NodeOperations
+const nodeOperationsNamespace = "kube-system"
+
+// nodeOperationNodeLabel selects the node of a NodeOperation
+var nodeOperationNodeLabel = defaultAnnotationPrefix + "node"
+
+// NodeOperation phases
+const (
+	nodeOperationPending   = "Pending"
+	nodeOperationRunning   = "Running"
+	nodeOperationSucceeded = "Succeeded"
+	nodeOperationFailed    = "Failed"
+)
+
+// setupNodeOperations watches the NodeOperations of the node, they are reconciled with the node
+func (c *Controller) setupNodeOperations(nodemetadata NodeMetadata) error {
+	config, err := kubernetesConfig(nodemetadata)
+	if err != nil {
+		return err
+	}
+	c.dynamicClient, err = dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create Kubernetes dynamic client: %w", err)
+	}
+
+	settings := nodemetadata.ControllerTuning.settingsOrDefaults()
+
+	labelSelector := fmt.Sprintf("%s=%s", nodeOperationNodeLabel, nodemetadata.Name)
+	c.operationsInformerFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.dynamicClient, settings.InformerResync, nodeOperationsNamespace, func(options *metav1.ListOptions) {
+		options.LabelSelector = labelSelector
+	})
+	informer := c.operationsInformerFactory.ForResource(nodeOperationResource)
+	c.operationsLister = informer.Lister()
+	c.operationsSynced = informer.Informer().HasSynced
+
+	// Reconcile the node when an operation is created or changed
+	nodeName := cache.ObjectName{Name: nodemetadata.Name}
+	_, err = informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.queue.Add(nodeName) },
+		UpdateFunc: func(oldObj, newObj interface{}) { c.queue.Add(nodeName) },
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up event handler for node operations informer: %w", err)
+	}
+
+	return nil
+}
+
+// syncNodeOperations runs the oldest NodeOperation not completed, one operation per reconcile
+func (c *Controller) syncNodeOperations(ctx context.Context) error {
+	if c.operationsLister == nil {
+		return nil
+	}
+
+	objects, err := c.operationsLister.ByNamespace(nodeOperationsNamespace).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("failed to list node operations: %w", err)
+	}
+	pending := nextNodeOperation(objects)
+	if pending == nil {
+		return nil
+	}
+	operation := pending.DeepCopy()
+
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	// Mark the operation running the first time it is processed
+	operationType, _, _ := unstructured.NestedString(operation.Object, "spec", "operation")
+	parameters, _, _ := unstructured.NestedStringMap(operation.Object, "spec", "parameters")
+	phase, _, _ := unstructured.NestedString(operation.Object, "status", "phase")
+	if phase == "" {
+		c.logger.Info("Node operation started", slog.String("operation", operation.GetName()), slog.String("type", operationType))
+		operation, err = c.updateNodeOperationStatus(ctx, operation, map[string]any{
+			"phase":     nodeOperationRunning,
+			"message":   fmt.Sprintf("Operation %s started", operationType),
+			"startTime": time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Run the operation, the failures are reported in the operation status
+	status := map[string]any{"phase": nodeOperationSucceeded}
+	opErr := c.checkHostOperation(node, operationType)
+	switch {
+	case opErr != nil:
+		// The operations acting on the host are not run for a managed node
+	case operationType == "upgrade":
+		var done bool
+		done, opErr = c.upgrade(ctx, node, parameters["repo_uri"])
+		status["message"] = "Node upgraded"
+		if opErr == nil && !done {
+			// The node is reconciled again once the upgrade can go on
+			status = map[string]any{"phase": nodeOperationPending, "message": c.upgradeDeferredMessage(ctx)}
+		}
+	case operationType == "restore":
+		var snapshotPath string
+		snapshotPath, opErr = c.restore(ctx, node)
+		status["message"] = "Node restored"
+		status["result"] = snapshotPath
+	case operationType == "plan":
+		var plan UpgradePlan
+		plan, opErr = c.plan(ctx, node, parameters["repo_uri"])
+		if opErr == nil {
+			jsonPlan, err := json.Marshal(plan)
+			if err != nil {
+				return fmt.Errorf("failed to marshal upgrade plan: %w", err)
+			}
+			status["message"] = "Upgrade plan computed"
+			status["result"] = string(jsonPlan)
+		}
+	case slices.Contains(remoteOperations, operationType):
+		remote := AgentOperation{Name: operationType, Arg: parameters["component"]}
+		if operationType == "restart" {
+			remote.Arg = parameters["service"]
+		}
+		_, opErr = parseAgentOperation(remote.String())
+		if opErr == nil {
+			actor, requestedAt := fieldManager(operation.GetManagedFields(), "spec")
+			source := fmt.Sprintf("NodeOperation %s/%s", operation.GetNamespace(), operation.GetName())
+			status["message"], opErr = c.runRemoteOperation(ctx, node, remote, AuditEntry{Source: source, Actor: actor, RequestedAt: requestedAt})
+			if errors.Is(opErr, errOperationNotStarted) {
+				return opErr
+			}
+			if errors.Is(opErr, errOperationDeferred) {
+				status = map[string]any{"phase": nodeOperationPending, "message": opErr.Error()}
+				opErr = nil
+			}
+		}
+	default:
+		opErr = fmt.Errorf("unknown operation %q, expected upgrade, restore, plan, reinstall, restart, verify or decommission", operationType)
+	}
+	if opErr != nil {
+		status = map[string]any{"phase": nodeOperationFailed, "message": opErr.Error()}
+	}
+	if status["phase"] != nodeOperationPending {
+		status["completionTime"] = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	_, err = c.updateNodeOperationStatus(ctx, operation, status)
+	if err != nil {
+		return err
+	}
+	c.logger.Info("Node operation processed", slog.String("operation", operation.GetName()), slog.String("type", operationType), slog.Any("phase", status["phase"]))
+
+	return nil
+}
+
+// upgradeDeferredMessage returns why the upgrade is deferred, from the upgrade deferred condition set by
+// the upgrade, eg: the maintenance window, the approval or the upgrade slots
+func (c *Controller) upgradeDeferredMessage(ctx context.Context) string {
+	node, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err == nil {
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == upgradeDeferredCondition && condition.Status == corev1.ConditionTrue {
+				return condition.Message
+			}
+		}
+	}
+	return "Upgrade deferred, it is retried on a next reconcile"
+}
+
+// nextNodeOperation returns the oldest operation not completed, nil if none
+func nextNodeOperation(objects []runtime.Object) *unstructured.Unstructured {
+	var operations []*unstructured.Unstructured
+	for _, object := range objects {
+		operation, ok := object.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		phase, _, _ := unstructured.NestedString(operation.Object, "status", "phase")
+		if phase != nodeOperationSucceeded && phase != nodeOperationFailed {
+			operations = append(operations, operation)
+		}
+	}
+	if len(operations) == 0 {
+		return nil
+	}
+
+	return slices.MinFunc(operations, func(a, b *unstructured.Unstructured) int {
+		return cmp.Or(
+			a.GetCreationTimestamp().Compare(b.GetCreationTimestamp().Time),
+			strings.Compare(a.GetName(), b.GetName()),
+		)
+	})
+}
+
+// updateNodeOperationStatus merges the fields in the operation status, the status is only updated
+// if it changed
+func (c *Controller) updateNodeOperationStatus(ctx context.Context, operation *unstructured.Unstructured, fields map[string]any) (*unstructured.Unstructured, error) {
+	status, _, _ := unstructured.NestedMap(operation.Object, "status")
+	if status == nil {
+		status = make(map[string]any)
+	}
+	changed := false
+	for field, value := range fields {
+		if status[field] != value {
+			status[field] = value
+			changed = true
+		}
+	}
+	if !changed {
+		return operation, nil
+	}
+
+	err := unstructured.SetNestedMap(operation.Object, status, "status")
+	if err != nil {
+		return nil, fmt.Errorf("failed to set node operation status: %w", err)
+	}
+	updated, err := c.dynamicClient.Resource(nodeOperationResource).Namespace(operation.GetNamespace()).UpdateStatus(ctx, operation, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update node operation %s status: %w", operation.GetName(), err)
+	}
+
+	return updated, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testNodeOperation(name string, created time.Time, phase string) *unstructured.Unstructured {
+	operation := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "k8s.scaleway.com/v1alpha1",
+		"kind":       "NodeOperation",
+		"spec":       map[string]any{"operation": "upgrade"},
+	}}
+	operation.SetName(name)
+	operation.SetNamespace(nodeOperationsNamespace)
+	operation.SetCreationTimestamp(metav1.NewTime(created))
+	if phase != "" {
+		_ = unstructured.SetNestedField(operation.Object, phase, "status", "phase")
+	}
+	return operation
+}
+
+func TestNextNodeOperation(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name       string
+		operations []runtime.Object
+		want       string
+	}{
+		{
+			name: "none",
+			want: "",
+		},
+		{
+			name: "all completed",
+			operations: []runtime.Object{
+				testNodeOperation("a", now, nodeOperationSucceeded),
+				testNodeOperation("b", now, nodeOperationFailed),
+			},
+			want: "",
+		},
+		{
+			name: "oldest first",
+			operations: []runtime.Object{
+				testNodeOperation("new", now, ""),
+				testNodeOperation("old", now.Add(-time.Minute), ""),
+			},
+			want: "old",
+		},
+		{
+			name: "completed skipped",
+			operations: []runtime.Object{
+				testNodeOperation("done", now.Add(-time.Hour), nodeOperationSucceeded),
+				testNodeOperation("deferred", now.Add(-time.Minute), nodeOperationPending),
+				testNodeOperation("new", now, ""),
+			},
+			want: "deferred",
+		},
+		{
+			name: "same creation time by name",
+			operations: []runtime.Object{
+				testNodeOperation("b", now, nodeOperationRunning),
+				testNodeOperation("a", now, ""),
+			},
+			want: "a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if operation := nextNodeOperation(tt.operations); operation != nil {
+				got = operation.GetName()
+			}
+			if got != tt.want {
+				t.Errorf("nextNodeOperation() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// operationPrivileged returns the node metadata of the test and records the planned repositories
+type operationPrivileged struct {
+	localPrivileged
+	metadata NodeMetadata
+	planned  *[]string
+}
+
+func (p operationPrivileged) LoadNodeMetadata(ctx context.Context) (NodeMetadata, error) {
+	return p.metadata, nil
+}
+
+func (p operationPrivileged) PlanComponents(ctx context.Context, request InstallRequest) (UpgradePlan, error) {
+	*p.planned = append(*p.planned, request.RepoURI)
+	return UpgradePlan{PoolVersion: "1.31.3"}, nil
+}
+
+func TestSyncNodeOperationsDispatch(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	tests := []struct {
+		name       string
+		operation  string
+		parameters map[string]any
+		managed    bool
+		phase      string
+		message    string
+		planned    []string
+	}{
+		{
+			name:       "plan of an allowed repository",
+			operation:  "plan",
+			parameters: map[string]any{"repo_uri": "https://new"},
+			phase:      nodeOperationSucceeded,
+			message:    "Upgrade plan computed",
+			planned:    []string{"https://new"},
+		},
+		{
+			name:       "plan of a repository not allowed",
+			operation:  "plan",
+			parameters: map[string]any{"repo_uri": "https://attacker.example.com"},
+			phase:      nodeOperationFailed,
+			message:    errRepositoryNotAllowed.Error(),
+		},
+		{
+			name:       "upgrade of a repository not allowed",
+			operation:  "upgrade",
+			parameters: map[string]any{"repo_uri": "https://attacker.example.com"},
+			phase:      nodeOperationFailed,
+			message:    errRepositoryNotAllowed.Error(),
+		},
+		{
+			name:       "restart not allowed",
+			operation:  "restart",
+			parameters: map[string]any{"service": "kubelet"},
+			phase:      nodeOperationFailed,
+			message:    "operation restart is not allowed",
+		},
+		{
+			name:       "upgrade of a managed node",
+			operation:  "upgrade",
+			parameters: map[string]any{"repo_uri": "https://new"},
+			managed:    true,
+			phase:      nodeOperationFailed,
+			message:    "operation upgrade acts on the host of the shared agent, it is not run for the managed node node",
+		},
+		{
+			name:      "decommission of a managed node",
+			operation: "decommission",
+			managed:   true,
+			phase:     nodeOperationFailed,
+			message:   "operation decommission acts on the host of the shared agent",
+		},
+		{
+			name:       "plan of a managed node",
+			operation:  "plan",
+			parameters: map[string]any{"repo_uri": "https://new"},
+			managed:    true,
+			phase:      nodeOperationSucceeded,
+			message:    "Upgrade plan computed",
+			planned:    []string{"https://new"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+			client := fake.NewClientset(node)
+			nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			err := nodeIndexer.Add(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			operation := testNodeOperation("operation", time.Now(), "")
+			operation.Object["spec"] = map[string]any{"operation": test.operation, "parameters": test.parameters}
+			operation.SetLabels(map[string]string{nodeOperationNodeLabel: "node"})
+			dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{nodeOperationResource: "NodeOperationList"}, operation)
+			operationIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			err = operationIndexer.Add(operation)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var planned []string
+			c := &Controller{
+				nodeName:         "node",
+				client:           client,
+				dynamicClient:    dynamicClient,
+				nodesLister:      corelisters.NewNodeLister(nodeIndexer),
+				operationsLister: cache.NewGenericLister(operationIndexer, nodeOperationResource.GroupResource()),
+				privileged: operationPrivileged{
+					metadata: NodeMetadata{RepoURI: "https://repo", AllowedRepoURIs: []string{"https://new"}},
+					planned:  &planned,
+				},
+				recorder:    newEventRecorder(ctx, client, "node"),
+				logger:      slog.Default(),
+				managedNode: test.managed,
+			}
+
+			// The operation is dispatched and its result reported in the status
+			err = c.syncNodeOperations(ctx)
+			if err != nil {
+				t.Fatalf("failed to sync node operations: %v", err)
+			}
+			updated, err := dynamicClient.Resource(nodeOperationResource).Namespace(nodeOperationsNamespace).Get(ctx, "operation", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			phase, _, _ := unstructured.NestedString(updated.Object, "status", "phase")
+			message, _, _ := unstructured.NestedString(updated.Object, "status", "message")
+			if phase != test.phase || !strings.Contains(message, test.message) {
+				t.Errorf("status = %s %q, expected %s %q", phase, message, test.phase, test.message)
+			}
+			if !slices.Equal(planned, test.planned) {
+				t.Errorf("planned repositories = %q, expected %q", planned, test.planned)
+			}
+		})
+	}
+}
+
+func TestUpgradeDeferredMessage(t *testing.T) {
+	ctx := context.Background()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+	client := fake.NewClientset(node)
+	c := &Controller{nodeName: "node", client: client}
+
+	// Without the deferred condition, eg: the drain is retried later
+	if message := c.upgradeDeferredMessage(ctx); message != "Upgrade deferred, it is retried on a next reconcile" {
+		t.Errorf("unexpected message %q", message)
+	}
+
+	node.Status.Conditions = []corev1.NodeCondition{{Type: "AgentUpgradeDeferred", Status: corev1.ConditionTrue, Reason: "UpgradeConcurrencyLimit", Message: "Upgrade deferred until less than 1 nodes of pool are upgrading"}}
+	_, err := client.CoreV1().Nodes().UpdateStatus(ctx, node, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message := c.upgradeDeferredMessage(ctx); message != "Upgrade deferred until less than 1 nodes of pool are upgrading" {
+		t.Errorf("unexpected message %q", message)
+	}
+}
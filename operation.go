@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The agent annotation accepts remediation operations in addition to the upgrade, restore and plan,
+// with their argument after "=", eg: "reinstall=containerd", "restart=kubelet", "verify" or "decommission". They must
+// be allowed by the node metadata and are audited. The result is published in the result annotation
+// and the agent annotation is removed.
+//
+//	k8s.scaleway.com/agent-result: {"operation":"restart=kubelet","status":"succeeded","message":"Service kubelet restarted","time":"2024-10-07T10:00:00Z"}
+var agentResultAnnotation = defaultAnnotationPrefix + "agent-result"
+
+// restartableServices are the services which can be restarted by the restart operation
+var restartableServices = []string{"containerd", "kubelet"}
+
+// AgentOperation is an operation requested by the agent annotation
+type AgentOperation struct {
+	Name string // upgrade, restore, plan, reinstall, restart, verify or decommission
+	Arg  string // Component to reinstall or service to restart
+}
+
+func (o AgentOperation) String() string {
+	if o.Arg == "" {
+		return o.Name
+	}
+	return o.Name + "=" + o.Arg
+}
+
+// OperationResult is the result of an agent operation, published in the result annotation
+type OperationResult struct {
+	Operation string    `json:"operation"`
+	Status    string    `json:"status"` // succeeded or failed, or requested for an upgrade of the admin socket
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// parseAgentOperation parses the agent annotation value
+func parseAgentOperation(value string) (AgentOperation, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(value), "=")
+	operation := AgentOperation{Name: name, Arg: arg}
+
+	switch name {
+	case "upgrade", "restore", "plan", "verify", "decommission":
+		if arg != "" {
+			return AgentOperation{}, fmt.Errorf("operation %s does not take an argument", name)
+		}
+	case "reinstall":
+		if arg == "" {
+			return AgentOperation{}, fmt.Errorf("operation reinstall requires a component, eg: reinstall=containerd")
+		}
+	case "restart":
+		if !slices.Contains(restartableServices, arg) {
+			return AgentOperation{}, fmt.Errorf("operation restart requires a service, expected one of %s", strings.Join(restartableServices, ", "))
+		}
+	default:
+		return AgentOperation{}, fmt.Errorf("unknown operation %q, expected upgrade, restore, plan, reinstall, restart, verify or decommission", value)
+	}
+
+	return operation, nil
+}
+
+// operateNode runs the remediation operation of the agent annotation, the upgrade, restore and plan
+// operations are run by their own sync
+func (c *Controller) operateNode(ctx context.Context) error {
+	// Get the node from the lister
+	node, err := c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+
+	// Exit if the annotation is not set
+	value, exists := node.Annotations[agentAnnotation]
+	if !exists {
+		return nil
+	}
+
+	// Run the operation, the failures are reported in the result annotation
+	var message string
+	operation, opErr := parseAgentOperation(value)
+	if opErr != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Invalid operation: %s", opErr)
+	} else {
+		opErr = c.checkHostOperation(node, operation.Name)
+	}
+	if opErr == nil {
+		if operation.Name == "upgrade" || operation.Name == "restore" || operation.Name == "plan" {
+			return nil
+		}
+		actor, requestedAt := annotationManager(node, agentAnnotation)
+		message, opErr = c.runRemoteOperation(ctx, node, operation, AuditEntry{Source: "annotation", Actor: actor, RequestedAt: requestedAt})
+		if errors.Is(opErr, errOperationNotStarted) {
+			return opErr
+		}
+		if errors.Is(opErr, errOperationDeferred) {
+			return nil
+		}
+	}
+
+	result := OperationResult{Operation: value, Status: "succeeded", Message: message, Time: time.Now().UTC()}
+	if opErr != nil {
+		result.Status = "failed"
+		result.Message = opErr.Error()
+	}
+	c.logger.Info("Operation done", slog.String("operation", value), slog.String("status", result.Status), slog.String("message", result.Message))
+
+	// Publish the result and remove the annotation
+	jsonResult, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal operation result: %w", err)
+	}
+	node, err = c.nodesLister.Get(c.nodeName)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+	nodeCopy := node.DeepCopy()
+	delete(nodeCopy.Annotations, agentAnnotation)
+	delete(nodeCopy.Annotations, upgradePlanAnnotation)
+	delete(nodeCopy.Annotations, upgradeApprovedAnnotation)
+	nodeCopy.Annotations[agentResultAnnotation] = string(jsonResult)
+	_, err = c.client.CoreV1().Nodes().Update(ctx, nodeCopy, metav1.UpdateOptions{})
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to publish operation result: %s", err)
+		return fmt.Errorf("failed to publish operation result on node %s: %w", c.nodeName, err)
+	}
+
+	return nil
+}
+
+// hostOperations are the operations acting on the host, they are refused for the managed nodes of a
+// shared agent: the privileged operations use the node metadata of the host, eg: an upgrade of a
+// virtual machine node would upgrade the kubelet of the hypervisor
+var hostOperations = []string{"upgrade", "restore", "reinstall", "restart", "decommission"}
+
+// checkHostOperation refuses the operations acting on the host for a managed node of a shared agent
+func (c *Controller) checkHostOperation(node *corev1.Node, name string) error {
+	if !c.managedNode || !slices.Contains(hostOperations, name) {
+		return nil
+	}
+	c.logger.Warn("Host operation refused for the managed node", slog.String("operation", name))
+	c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Operation %s refused: it acts on the host of the shared agent, not on the managed node", name)
+	return fmt.Errorf("operation %s acts on the host of the shared agent, it is not run for the managed node %s", name, c.nodeName)
+}
+
+// errOperationNotStarted is returned when the remote operation could not be checked or audited, it is
+// retried on the next reconcile
+var errOperationNotStarted = errors.New("remote operation not started")
+
+// errOperationDeferred is returned when the remote operation waits for the maintenance window, its
+// approval or the drain of the node, the node is reconciled again once it can run
+var errOperationDeferred = errors.New("remote operation deferred")
+
+// runRemoteOperation runs the remote operation if allowed by the node metadata, the operation is
+// recorded in the audit log before and after running it, and not run if it cannot be recorded. The
+// privileged operations are recorded by the root agent process, which checks the policy again.
+func (c *Controller) runRemoteOperation(ctx context.Context, node *corev1.Node, operation AgentOperation, audit AuditEntry) (string, error) {
+	// Get the node metadata, the policy is always the current one
+	nodeMetadata, err := c.privileged.LoadNodeMetadata(ctx)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to get node metadata: %s", err)
+		return "", fmt.Errorf("%w: failed to get node metadata: %w", errOperationNotStarted, err)
+	}
+	audit.Operation = operation.String()
+
+	// Deny the operations not allowed by the node metadata
+	if !nodeMetadata.remoteOperationAllowed(operation.Name) {
+		err = fmt.Errorf("operation %s is not allowed by the node metadata remote operations policy", operation.Name)
+		c.logger.Warn("Remote operation denied", slog.String("operation", audit.Operation), slog.String("actor", audit.Actor))
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Operation %s denied: not allowed by the node metadata", operation)
+		c.recordAudit(ctx, audit, "denied", err.Error())
+		return "", err
+	}
+
+	// The reinstall restarts the services of the component, it waits for the maintenance window and
+	// the approval as an upgrade
+	if operation.Name == "reinstall" {
+		err = c.checkReinstallGates(ctx, node, nodeMetadata, operation)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Record the operation before running it
+	privileged := slices.Contains(privilegedRemoteOperations, operation.Name)
+	if !privileged {
+		audit.Time = time.Now().UTC()
+		audit.Status = "started"
+		err = c.privileged.RecordAudit(ctx, audit)
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to audit operation %s: %s", operation, err)
+			return "", fmt.Errorf("%w: failed to record operation in the audit log: %w", errOperationNotStarted, err)
+		}
+	}
+
+	var message string
+	request := RemoteOperationRequest{Arg: operation.Arg, Source: audit.Source, Actor: audit.Actor, RequestedAt: audit.RequestedAt}
+	switch operation.Name {
+	case "reinstall":
+		message, err = c.reinstall(ctx, node, nodeMetadata, request)
+	case "restart":
+		message, err = c.restart(ctx, node, request)
+	case "verify":
+		message, err = c.verify(ctx, node, nodeMetadata)
+	case "decommission":
+		message, err = c.decommission(ctx, node, request)
+	default:
+		err = fmt.Errorf("unknown remote operation %q", operation.Name)
+	}
+	if errors.Is(err, errOperationDeferred) {
+		c.recordAudit(ctx, audit, "deferred", err.Error())
+		return "", err
+	}
+	if errors.Is(err, errOperationNotStarted) {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to audit operation %s: %s", operation, err)
+		return "", err
+	}
+	if err != nil {
+		if !privileged {
+			c.recordAudit(ctx, audit, "failed", err.Error())
+		}
+		return "", err
+	}
+	if !privileged {
+		c.recordAudit(ctx, audit, "succeeded", message)
+	}
+
+	return message, nil
+}
+
+// recordAudit records the result of the remote operation in the audit log, the failures are only
+// logged since the operation is already recorded as started
+func (c *Controller) recordAudit(ctx context.Context, audit AuditEntry, status, message string) {
+	audit.Time = time.Now().UTC()
+	audit.Status = status
+	audit.Message = message
+	err := c.privileged.RecordAudit(ctx, audit)
+	if err != nil {
+		c.logger.Warn("Failed to record operation in the audit log", slog.String("operation", audit.Operation), slog.Any("error", err))
+	}
+}
+
+// checkReinstallGates returns errOperationDeferred while the maintenance window is closed or the
+// reinstall is not approved, the node is requeued when the window opens or updated once approved
+func (c *Controller) checkReinstallGates(ctx context.Context, node *corev1.Node, nodeMetadata NodeMetadata, operation AgentOperation) error {
+	if nodeMetadata.MaintenanceWindow != nil {
+		delay, err := nodeMetadata.MaintenanceWindow.NextOpening(time.Now())
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Invalid maintenance window: %s", err)
+			return fmt.Errorf("invalid maintenance window: %w", err)
+		}
+		if delay > 0 {
+			c.logger.Info("Operation deferred until the maintenance window opens", slog.String("operation", operation.String()), slog.Duration("delay", delay))
+			c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeOperation", "Operation %s deferred until the maintenance window opens in %s", operation, delay.Round(time.Second))
+			c.queue.AddAfter(cache.ObjectName{Namespace: node.Namespace, Name: node.Name}, delay)
+			return fmt.Errorf("%w until the maintenance window opens in %s", errOperationDeferred, delay.Round(time.Second))
+		}
+	}
+
+	// The hash of the operation is approved as an upgrade plan hash
+	if nodeMetadata.RequireUpgradeApproval {
+		sum := sha256.Sum256([]byte(operation.String()))
+		approved, err := c.checkApproval(ctx, fmt.Sprintf("Operation %s", operation), hex.EncodeToString(sum[:]))
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to check operation approval: %s", err)
+			return fmt.Errorf("%w: failed to check operation approval: %w", errOperationNotStarted, err)
+		}
+		if !approved {
+			return fmt.Errorf("%w until it is approved", errOperationDeferred)
+		}
+	}
+
+	return nil
+}
+
+// reinstall reinstalls the installed version of the component, eg: to repair its files. The node is
+// drained first as for an upgrade, and uncordoned once the component is reinstalled.
+func (c *Controller) reinstall(ctx context.Context, node *corev1.Node, nodeMetadata NodeMetadata, request RemoteOperationRequest) (string, error) {
+	component := request.Arg
+	var cordoned bool
+	if nodeMetadata.featureEnabled(FeatureDrainBeforeUpgrade) {
+		var err error
+		cordoned, err = c.drainNode(ctx)
+		if errors.Is(err, errDrainTimeout) {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to drain node, retrying in %s: %s", drainRetryInterval, err)
+			c.queue.AddAfter(cache.ObjectName{Namespace: node.Namespace, Name: node.Name}, drainRetryInterval)
+			return "", fmt.Errorf("%w until the node is drained: %w", errOperationDeferred, err)
+		}
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to drain node: %s", err)
+			return "", fmt.Errorf("failed to drain node: %w", err)
+		}
+	}
+
+	c.logger.Info("Reinstalling component", slog.String("component", component))
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeOperation", "Reinstalling component %s", component)
+
+	version, err := c.privileged.ReinstallComponent(ctx, request)
+	if isCRIUnavailable(err) {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "ContainerRuntimeUnavailable", "Kubelet not started, the container runtime is not ready: %s", err)
+	}
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to reinstall component %s: %s", component, err)
+		return "", fmt.Errorf("failed to reinstall component %s: %w", component, err)
+	}
+
+	// The node drained by the agent is schedulable again once the component is reinstalled
+	if cordoned {
+		err = c.cordonNode(ctx, false)
+		if err != nil {
+			c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to uncordon node: %s", err)
+		}
+	}
+
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeOperation", "Component %s %s reinstalled", component, version)
+	return fmt.Sprintf("Component %s %s reinstalled", component, version), nil
+}
+
+// restart restarts the service, eg: to recover a stuck kubelet
+func (c *Controller) restart(ctx context.Context, node *corev1.Node, request RemoteOperationRequest) (string, error) {
+	service := request.Arg
+	c.logger.Info("Restarting service", slog.String("service", service))
+
+	err := c.privileged.RestartService(ctx, request)
+	if isCRIUnavailable(err) {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "ContainerRuntimeUnavailable", "Kubelet not started, the container runtime is not ready: %s", err)
+	}
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Failed to restart service %s: %s", service, err)
+		return "", fmt.Errorf("failed to restart service %s: %w", service, err)
+	}
+
+	c.recorder.Eventf(node, corev1.EventTypeNormal, "NodeOperation", "Service %s restarted", service)
+	return fmt.Sprintf("Service %s restarted", service), nil
+}
+
+// verify checks the node health once, as after an upgrade
+func (c *Controller) verify(ctx context.Context, node *corev1.Node, nodeMetadata NodeMetadata) (string, error) {
+	err := c.checkNodeHealth(ctx, nodeMetadata.CriticalDaemonSets)
+	if err != nil {
+		c.recorder.Eventf(node, corev1.EventTypeWarning, "NodeOperation", "Node unhealthy: %s", err)
+		return "", fmt.Errorf("node unhealthy: %w", err)
+	}
+
+	c.recorder.Event(node, corev1.EventTypeNormal, "NodeOperation", "Node healthy")
+	return "Node healthy", nil
+}
+
+// reinstallComponent forgets the installed version of the component and installs the node again, the
+// components are kept at their installed version so the reinstall is not an upgrade. The installed
+// version is recorded again if the reinstall fails. It returns the version reinstalled.
+func reinstallComponent(ctx context.Context, nodeMetadata NodeMetadata, component string) (version string, err error) {
+	version, err = GetComponentVersion(component)
+	if err != nil {
+		return "", fmt.Errorf("failed to get component version: %w", err)
+	}
+	if version == "" {
+		return "", fmt.Errorf("component %s is not installed", component)
+	}
+
+	// Keep the components changed by the release at their installed version, including the reinstalled
+	// one, the new components and the containerd settings are not installed
+	plan, err := planComponents(nodeMetadata)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute upgrade plan: %w", err)
+	}
+	nodeMetadata = deferComponents(nodeMetadata, plan.Components)
+	nodeMetadata.deferContainerd = true
+
+	err = DeleteComponentVersion(component)
+	if err != nil {
+		return "", fmt.Errorf("failed to reset component %s version: %w", component, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		restoreErr := SetComponentVersion(component, version)
+		if restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to restore component %s version: %w", component, restoreErr))
+		}
+	}()
+
+	err = processComponents(ctx, nodeMetadata, false)
+	if err != nil {
+		return "", err
+	}
+
+	return GetComponentVersion(component)
+}
+
+// restartService restarts one of the restartable services
+func restartService(ctx context.Context, service string) error {
+	if !slices.Contains(restartableServices, service) {
+		return fmt.Errorf("service %s cannot be restarted, expected one of %s", service, strings.Join(restartableServices, ", "))
+	}
+	if slices.Contains(criGatedServices, service) {
+		err := waitForCRI(ctx, slog.Default())
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd := command("/usr/bin/systemctl", "restart", service)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to restart service %s: %w: %s", service, err, output)
+	}
+	slog.Info("Service restarted", slog.String("service", service))
+
+	return nil
+}
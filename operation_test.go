@@ -0,0 +1,272 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestParseAgentOperation(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    AgentOperation
+		wantErr bool
+	}{
+		{value: "upgrade", want: AgentOperation{Name: "upgrade"}},
+		{value: "verify", want: AgentOperation{Name: "verify"}},
+		{value: "decommission", want: AgentOperation{Name: "decommission"}},
+		{value: "decommission=now", wantErr: true},
+		{value: "reinstall=containerd", want: AgentOperation{Name: "reinstall", Arg: "containerd"}},
+		{value: " restart=kubelet ", want: AgentOperation{Name: "restart", Arg: "kubelet"}},
+		{value: "upgrade=now", wantErr: true},
+		{value: "reinstall", wantErr: true},
+		{value: "reinstall=", wantErr: true},
+		{value: "restart=sshd", wantErr: true},
+		{value: "restart", wantErr: true},
+		{value: "reboot", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseAgentOperation(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAgentOperation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseAgentOperation() = %+v, want %+v", got, tt.want)
+			}
+			if err == nil && got.String() != strings.TrimSpace(tt.value) {
+				t.Errorf("String() = %q, want %q", got.String(), strings.TrimSpace(tt.value))
+			}
+		})
+	}
+}
+
+func TestRestartService(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+	serveFakeCRI(t)
+
+	err := restartService(context.Background(), "kubelet")
+	if err != nil {
+		t.Fatalf("failed to restart service: %v", err)
+	}
+	err = restartService(context.Background(), "sshd")
+	if err == nil {
+		t.Error("expected an error for a service which cannot be restarted")
+	}
+
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(commands), "systemctl restart kubelet") || strings.Contains(string(commands), "sshd") {
+		t.Errorf("unexpected commands %q", commands)
+	}
+}
+
+// reinstallPrivileged returns the node metadata of the test and records the reinstalled components
+type reinstallPrivileged struct {
+	localPrivileged
+	metadata    NodeMetadata
+	reinstalled *[]string
+}
+
+func (p reinstallPrivileged) LoadNodeMetadata(ctx context.Context) (NodeMetadata, error) {
+	return p.metadata, nil
+}
+
+func (p reinstallPrivileged) ReinstallComponent(ctx context.Context, request RemoteOperationRequest) (string, error) {
+	*p.reinstalled = append(*p.reinstalled, request.Arg)
+	return "1.7.23", nil
+}
+
+func TestRunRemoteOperationReinstallGates(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	operation := AgentOperation{Name: "reinstall", Arg: "containerd"}
+	sum := sha256.Sum256([]byte(operation.String()))
+	operationHash := hex.EncodeToString(sum[:])
+	closed := &MaintenanceWindow{Start: time.Now().UTC().Add(2 * time.Hour).Format("15:04"), Duration: "1m"}
+
+	tests := []struct {
+		name        string
+		metadata    NodeMetadata
+		annotations map[string]string
+		deferred    bool
+		published   string
+	}{
+		{
+			name:     "no gate",
+			metadata: NodeMetadata{},
+		},
+		{
+			name:     "maintenance window closed",
+			metadata: NodeMetadata{MaintenanceWindow: closed},
+			deferred: true,
+		},
+		{
+			name:      "waiting for approval",
+			metadata:  NodeMetadata{RequireUpgradeApproval: true},
+			deferred:  true,
+			published: operationHash,
+		},
+		{
+			name:        "approved",
+			metadata:    NodeMetadata{RequireUpgradeApproval: true},
+			annotations: map[string]string{upgradeApprovedAnnotation: operationHash},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node", Annotations: test.annotations}}
+			client := fake.NewClientset(node)
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			err := indexer.Add(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[cache.ObjectName]())
+			defer queue.ShutDown()
+
+			test.metadata.RemoteOperations = []string{"reinstall"}
+			var reinstalled []string
+			c := &Controller{
+				nodeName:    "node",
+				client:      client,
+				nodesLister: corelisters.NewNodeLister(indexer),
+				queue:       queue,
+				privileged:  reinstallPrivileged{metadata: test.metadata, reinstalled: &reinstalled},
+				recorder:    newEventRecorder(ctx, client, "node"),
+				logger:      slog.Default(),
+			}
+
+			// The deferred reinstall does not run, the reinstall runs once the gates pass
+			_, err = c.runRemoteOperation(ctx, node, operation, AuditEntry{Source: "annotation"})
+			if test.deferred != errors.Is(err, errOperationDeferred) || (!test.deferred && err != nil) {
+				t.Fatalf("expected deferred %t, got %v", test.deferred, err)
+			}
+			if test.deferred == slices.Equal(reinstalled, []string{"containerd"}) {
+				t.Errorf("expected deferred %t, got reinstalled %q", test.deferred, reinstalled)
+			}
+			var published string
+			for _, action := range client.Actions() {
+				if update, ok := action.(k8stesting.UpdateAction); ok && update.GetSubresource() == "" {
+					published = update.GetObject().(*corev1.Node).Annotations[upgradePlanAnnotation]
+				}
+			}
+			if published != test.published {
+				t.Errorf("published hash = %q, expected %q", published, test.published)
+			}
+		})
+	}
+}
+
+// writeTestRepository writes the repository files in a zip repository, it returns the repository URI
+func writeTestRepository(t *testing.T, files map[string]string) string {
+	path := filepath.Join(t.TempDir(), "repo.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		w, err := writer.Create(name)
+		if err == nil {
+			_, err = w.Write([]byte(files[name]))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "zip://" + path
+}
+
+func TestReinstallComponent(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	for _, dir := range []string{"/var/run", "/etc/containerd"} {
+		err := os.MkdirAll(hostPath(dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	repoURI := writeTestRepository(t, map[string]string{
+		"releases.yaml": "versions:\n  1.31.2:\n    - name: containerd\n      version: 1.7.23\n",
+		"containerd/metadata.yaml": `versions:
+  1.7.22:
+    install:
+      - files:
+          - {state: file, src: 1.7.22/config.toml, dst: /etc/containerd/}
+  1.7.23:
+    install:
+      - files:
+          - {state: file, src: 1.7.23/config.toml, dst: /etc/containerd/}
+`,
+		"containerd/1.7.22/config.toml": "1.7.22",
+		"containerd/1.7.23/config.toml": "1.7.23",
+	})
+	err := SetComponentVersion("containerd", "1.7.22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeMetadata := NodeMetadata{RepoURI: repoURI, PoolVersion: "1.31.2"}
+
+	// The installed version is reinstalled, not the release one
+	version, err := reinstallComponent(context.Background(), nodeMetadata, "containerd")
+	if err != nil || version != "1.7.22" {
+		t.Fatalf("reinstalled version = %s, %v, expected 1.7.22", version, err)
+	}
+	content, err := os.ReadFile(hostPath("/etc/containerd/config.toml"))
+	if err != nil || string(content) != "1.7.22" {
+		t.Errorf("config.toml = %q, %v, expected the installed version one", content, err)
+	}
+
+	// The installed version is kept when the reinstall fails
+	nodeMetadata.NodeLabels = map[string]string{"invalid label": "value"}
+	_, err = reinstallComponent(context.Background(), nodeMetadata, "containerd")
+	if err == nil {
+		t.Fatal("expected the reinstall to fail")
+	}
+	version, err = GetComponentVersion("containerd")
+	if err != nil || version != "1.7.22" {
+		t.Errorf("version = %s, %v, expected 1.7.22 kept", version, err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/validate/content"
+)
+
+// errForeignNode is returned when the agent would edit a node other than its own, eg: after a node
+// metadata mix-up between two instances
+var errForeignNode = errors.New("refusing to edit a node other than the own node")
+
+// nodesPath is the path of the nodes resource of the Kubernetes API
+const nodesPath = "/api/v1/nodes"
+
+// ownNodeTransport rejects the requests writing to other nodes than the own node, whatever the
+// permissions of the node credentials
+type ownNodeTransport struct {
+	next     http.RoundTripper
+	nodeName string
+}
+
+func (t *ownNodeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		name, ok := nodeRequestName(req.URL.Path)
+		if ok && name != t.nodeName {
+			return nil, fmt.Errorf("%w: %s %s", errForeignNode, req.Method, req.URL.Path)
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// nodeRequestName returns the node name of a nodes resource path, empty for the collection
+func nodeRequestName(path string) (string, bool) {
+	_, rest, found := strings.Cut(path, nodesPath)
+	if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return "", false
+	}
+	name, _, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	return name, true
+}
+
+// validateNodeName checks the node name of the node metadata, and warns if the kubelet registers the
+// node with another name. The hostname is not checked for the managed nodes of a shared agent, which run
+// their own kubelet.
+func validateNodeName(name string, checkHostname bool) error {
+	if errs := content.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid node name %q: %s", name, strings.Join(errs, ", "))
+	}
+	if !checkHostname {
+		return nil
+	}
+
+	hostname, err := kubeletHostname()
+	if err != nil {
+		slog.Warn("Failed to get kubelet hostname", slog.Any("error", err))
+		return nil
+	}
+	if override := kubeletHostnameOverride(); override != "" {
+		hostname = override
+	}
+	if hostname != name {
+		slog.Warn("Node name differs from the kubelet hostname", slog.String("node", name), slog.String("hostname", hostname))
+	}
+	return nil
+}
+
+// kubeletHostnameOverride returns the lowercase --hostname-override of the running kubelet, empty if the
+// kubelet is not running or does not override the hostname
+func kubeletHostnameOverride() string {
+	processes, err := os.ReadDir(hostPath("/proc"))
+	if err != nil {
+		return ""
+	}
+	for _, process := range processes {
+		cmdline, err := os.ReadFile(hostPath(filepath.Join("/proc", process.Name(), "cmdline")))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+		if filepath.Base(args[0]) != "kubelet" {
+			continue
+		}
+		for i, arg := range args[1:] {
+			if value, ok := strings.CutPrefix(arg, "--hostname-override="); ok {
+				return strings.ToLower(strings.TrimSpace(value))
+			}
+			if arg == "--hostname-override" && i+2 < len(args) {
+				return strings.ToLower(strings.TrimSpace(args[i+2]))
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// kubeletHostname returns the name the kubelet registers the node with if not overridden, the
+// lowercase hostname
+func kubeletHostname() (string, error) {
+	data, err := os.ReadFile(hostPath("/etc/hostname"))
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		return strings.ToLower(strings.TrimSpace(string(data))), nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	return strings.ToLower(hostname), nil
+}
+
+// localAddresses returns the addresses of the interfaces of the node with their networks
+var localAddresses = func() ([]*net.IPNet, error) {
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+	}
+	var ipNets []*net.IPNet
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok {
+			ipNets = append(ipNets, ipNet)
+		}
+	}
+	return ipNets, nil
+}
+
+// checkNodeOwnership checks that the node is this instance: one of its internal addresses must be
+// local. A managed node of a shared agent runs on the host, one of its internal addresses must be on a
+// network of the host, eg: the bridge of the virtual machines, without being an address of the host. The
+// node is not checked until its addresses are reported.
+func checkNodeOwnership(node *corev1.Node, managed bool) error {
+	var internal []string
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP {
+			internal = append(internal, address.Address)
+		}
+	}
+	if len(internal) == 0 {
+		return nil
+	}
+
+	ipNets, err := localAddresses()
+	if err != nil {
+		return err
+	}
+	for _, address := range internal {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		if !managed && slices.ContainsFunc(ipNets, func(local *net.IPNet) bool { return local.IP.Equal(ip) }) {
+			return nil
+		}
+		if managed && !ip.IsLoopback() && slices.ContainsFunc(ipNets, func(local *net.IPNet) bool { return local.Contains(ip) }) &&
+			!slices.ContainsFunc(ipNets, func(local *net.IPNet) bool { return local.IP.Equal(ip) }) {
+			return nil
+		}
+	}
+	if managed {
+		return fmt.Errorf("%w: managed node %s internal addresses %s are not on a network of the host", errForeignNode, node.Name, strings.Join(internal, ", "))
+	}
+	return fmt.Errorf("%w: node %s internal addresses %s are not local", errForeignNode, node.Name, strings.Join(internal, ", "))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestOwnNodeTransport(t *testing.T) {
+	tests := []struct {
+		method  string
+		path    string
+		allowed bool
+	}{
+		{method: http.MethodPatch, path: "/api/v1/nodes/node", allowed: true},
+		{method: http.MethodPut, path: "/api/v1/nodes/node/status", allowed: true},
+		{method: http.MethodGet, path: "/api/v1/nodes/other", allowed: true},
+		{method: http.MethodGet, path: "/api/v1/nodes", allowed: true},
+		{method: http.MethodPost, path: "/api/v1/namespaces/default/events", allowed: true},
+		{method: http.MethodPost, path: "/api/v1/namespaces/kube-system/pods/pod/eviction", allowed: true},
+		{method: http.MethodPatch, path: "/k8s/api/v1/nodes/node", allowed: true},
+		{method: http.MethodPatch, path: "/api/v1/nodesets/other", allowed: true},
+		{method: http.MethodPatch, path: "/api/v1/nodes/other"},
+		{method: http.MethodPut, path: "/api/v1/nodes/other/status"},
+		{method: http.MethodDelete, path: "/api/v1/nodes/other"},
+		{method: http.MethodPost, path: "/api/v1/nodes"},
+		{method: http.MethodDelete, path: "/api/v1/nodes"},
+		{method: http.MethodPatch, path: "/k8s/api/v1/nodes/other"},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.path, func(t *testing.T) {
+			sent := false
+			transport := &ownNodeTransport{nodeName: "node", next: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				sent = true
+				return &http.Response{StatusCode: http.StatusOK}, nil
+			})}
+			req, _ := http.NewRequest(test.method, "https://cluster.example"+test.path, nil)
+			_, err := transport.RoundTrip(req)
+			if test.allowed && (err != nil || !sent) {
+				t.Errorf("expected the request to be sent, got %v", err)
+			}
+			if !test.allowed && (!errors.Is(err, errForeignNode) || sent) {
+				t.Errorf("expected the request to be refused, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckNodeOwnership(t *testing.T) {
+	defer func(original func() ([]*net.IPNet, error)) { localAddresses = original }(localAddresses)
+	localAddresses = func() ([]*net.IPNet, error) {
+		var ipNets []*net.IPNet
+		for _, cidr := range []string{"127.0.0.1/8", "172.16.0.5/24", "fd00::5/64", "10.0.0.1/24"} {
+			ip, ipNet, _ := net.ParseCIDR(cidr)
+			ipNet.IP = ip
+			ipNets = append(ipNets, ipNet)
+		}
+		return ipNets, nil
+	}
+
+	tests := []struct {
+		name      string
+		addresses []corev1.NodeAddress
+		managed   bool
+		err       string
+	}{
+		{name: "no addresses"},
+		{name: "local", addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "172.16.0.5"}}},
+		{name: "local IPv6", addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "172.16.0.6"}, {Type: corev1.NodeInternalIP, Address: "fd00::5"}}},
+		{name: "external only", addresses: []corev1.NodeAddress{{Type: corev1.NodeExternalIP, Address: "51.15.0.1"}}},
+		{name: "foreign", addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "172.16.0.6"}, {Type: corev1.NodeExternalIP, Address: "172.16.0.5"}}, err: "172.16.0.6 are not local"},
+		{name: "managed on the host network", addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.2"}}, managed: true},
+		{name: "managed no addresses", managed: true},
+		{name: "managed with a host address", addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.1"}}, managed: true, err: "are not on a network of the host"},
+		{name: "managed loopback", addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "127.0.0.2"}}, managed: true, err: "are not on a network of the host"},
+		{name: "managed foreign", addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "192.168.0.2"}}, managed: true, err: "192.168.0.2 are not on a network of the host"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}, Status: corev1.NodeStatus{Addresses: test.addresses}}
+			err := checkNodeOwnership(node, test.managed)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, errForeignNode) || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateNodeName(t *testing.T) {
+	defer func(original string) { rootDir = original }(rootDir)
+	rootDir = t.TempDir()
+
+	for _, name := range []string{"scw-cluster-pool-0123", "node.example.com"} {
+		if err := validateNodeName(name, true); err != nil {
+			t.Errorf("unexpected error for %q: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Node", "node_1", "-node"} {
+		if err := validateNodeName(name, true); err == nil || !strings.Contains(err.Error(), "invalid node name") {
+			t.Errorf("expected invalid node name for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestKubeletHostnameOverride(t *testing.T) {
+	defer func(original string) { rootDir = original }(rootDir)
+	rootDir = t.TempDir()
+
+	if override := kubeletHostnameOverride(); override != "" {
+		t.Errorf("expected no override without a kubelet, got %q", override)
+	}
+
+	writeCmdline := func(pid string, args ...string) {
+		t.Helper()
+		dir := filepath.Join(rootDir, "proc", pid)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cmdline"), []byte(strings.Join(args, "\x00")+"\x00"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCmdline("1", "/sbin/init", "--hostname-override=init")
+	writeCmdline("42", "/usr/bin/kubelet", "--config=/var/lib/kubelet/config.yaml")
+	if override := kubeletHostnameOverride(); override != "" {
+		t.Errorf("expected no override, got %q", override)
+	}
+
+	writeCmdline("42", "/usr/bin/kubelet", "--config=/var/lib/kubelet/config.yaml", "--hostname-override=Node-1")
+	if override := kubeletHostnameOverride(); override != "node-1" {
+		t.Errorf("expected the node-1 override, got %q", override)
+	}
+	writeCmdline("42", "/usr/bin/kubelet", "--hostname-override", "node-2")
+	if override := kubeletHostnameOverride(); override != "node-2" {
+		t.Errorf("expected the node-2 override, got %q", override)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+// panicsDir is where the stacks of the agent panics are saved
+var panicsDir = filepath.Join(stateDir, "panics")
+
+// panicSave saves the panics, by the root agent process for the unprivileged controller which cannot
+// write the state directory
+var panicSave = savePanic
+
+// handlePanic must be deferred at the top of the goroutines, it saves the stack of a panic, reports it
+// and exits, so a panic can be distinguished from an OOM kill
+func handlePanic(report func(message string)) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	stack := debug.Stack()
+
+	slog.Error("Agent panicked", slog.Any("panic", recovered), slog.String("stack", string(stack)))
+	message := fmt.Sprintf("Agent panicked: %v", recovered)
+	panicPath, err := panicSave(fmt.Sprint(recovered), stack)
+	if err != nil {
+		slog.Error("Failed to save panic", slog.Any("error", err))
+	} else {
+		message = fmt.Sprintf("%s (stack saved in %s)", message, panicPath)
+	}
+
+	if report != nil {
+		report(message)
+	}
+
+	exit(exitPanic)
+}
+
+// savePanic writes the panic and its stack in the state directory
+func savePanic(recovered string, stack []byte) (string, error) {
+	err := os.MkdirAll(hostPath(panicsDir), 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create panics directory: %w", err)
+	}
+
+	now := time.Now()
+	panicPath := filepath.Join(panicsDir, fmt.Sprintf("panic-%s.log", now.UTC().Format("20060102T150405Z")))
+	content := fmt.Sprintf("time: %s\nversion: %s\npanic: %s\n\n%s", now.Format(time.RFC3339), Version, recovered, stack)
+	err = os.WriteFile(hostPath(panicPath), []byte(content), 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write panic: %w", err)
+	}
+
+	return panicPath, nil
+}
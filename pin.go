@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+// repoPin is the repository snapshot used at the last successful install, persisted so that an agent
+// restart reinstalls the same components even if the repository was updated in the meantime. The
+// releases file and the component metadata and index files are pinned, the component files, templates
+// and scripts they reference are still read from the repository.
+//
+//	{
+//	   "repo_uri": "https://repo.example.com/k8s",
+//	   "pool_version": "1.31.2",
+//	   "channel": "beta",
+//	   "digest": "5f2b...",
+//	   "releases": "dmVyc2lvbnM6...",
+//	   "components": {"kubelet/metadata.yaml": "dmVyc2lvbnM6..."}
+//	}
+type repoPin struct {
+	RepoURI     string            `json:"repo_uri"`
+	PoolVersion string            `json:"pool_version"`
+	Channel     string            `json:"channel,omitempty"`
+	Digest      string            `json:"digest"`
+	Releases    []byte            `json:"releases"`
+	Components  map[string][]byte `json:"components,omitempty"` // Component metadata files by path
+}
+
+var repoPinFile = filepath.Join(stateDir, "repo-pin.json")
+
+// pinnedComponentFiles are the files of the component directories pinned with the releases file
+var pinnedComponentFiles = []string{"metadata.yaml", "index.yaml"}
+
+// pinnedFS serves the pinned releases file and component metadata files, the other files are read from
+// the repository. It records the component metadata files read, they are pinned once the install succeeds.
+type pinnedFS struct {
+	repo.RepoFS
+	releases   []byte
+	components map[string][]byte // Pinned component metadata files by path
+
+	mu   sync.Mutex
+	read map[string][]byte // Component metadata files read by path
+}
+
+func (p *pinnedFS) ReadFile(name string) ([]byte, error) {
+	if name == "releases.yaml" {
+		return p.releases, nil
+	}
+	if !isComponentMetadataFile(name) {
+		return fs.ReadFile(p.RepoFS, name)
+	}
+
+	content, ok := p.components[name]
+	if !ok {
+		var err error
+		content, err = fs.ReadFile(p.RepoFS, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.read[name] = content
+
+	return content, nil
+}
+
+// isComponentMetadataFile returns true for the metadata files of a component directory, eg: kubelet/metadata.yaml
+func isComponentMetadataFile(name string) bool {
+	dir, file := path.Split(name)
+	return dir != "" && !strings.Contains(strings.TrimSuffix(dir, "/"), "/") && slices.Contains(pinnedComponentFiles, file)
+}
+
+func releasesDigest(releases []byte) string {
+	sum := sha256.Sum256(releases)
+	return hex.EncodeToString(sum[:])
+}
+
+// pinRepository returns the repository to install from, serving its releases file. Unless an upgrade
+// was triggered, the snapshot pinned at the last successful install is used when the node version and channel are unchanged.
+func pinRepository(repoFS repo.RepoFS, nodemetadata NodeMetadata, upgrade bool) (*pinnedFS, error) {
+	releases, err := fs.ReadFile(repoFS, "releases.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read releases file: %w", err)
+	}
+	pinned := &pinnedFS{RepoFS: repoFS, releases: releases, read: make(map[string][]byte)}
+	if upgrade {
+		return pinned, nil
+	}
+
+	pin, err := loadRepoPin()
+	if err != nil {
+		return nil, err
+	}
+	if pin == nil || pin.RepoURI != nodemetadata.RepoURI || pin.PoolVersion != nodemetadata.PoolVersion || pin.Channel != nodemetadata.Channel {
+		return pinned, nil
+	}
+
+	if digest := releasesDigest(releases); digest != pin.Digest {
+		slog.Warn("Repository changed since the last install, using the pinned snapshot",
+			slog.String("pinned", pin.Digest), slog.String("current", digest))
+	}
+	pinned.releases, pinned.components = pin.Releases, pin.Components
+
+	return pinned, nil
+}
+
+func loadRepoPin() (*repoPin, error) {
+	jsonPin, err := os.ReadFile(hostPath(repoPinFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository pin: %w", err)
+	}
+
+	var pin repoPin
+	err = json.Unmarshal(jsonPin, &pin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal repository pin: %w", err)
+	}
+
+	return &pin, nil
+}
+
+// saveRepoPin pins the repository snapshot after a successful install, with the component metadata
+// files read by the install
+func saveRepoPin(nodemetadata NodeMetadata, pinned *pinnedFS) error {
+	pinned.mu.Lock()
+	components := maps.Clone(pinned.read)
+	pinned.mu.Unlock()
+
+	jsonPin, err := json.Marshal(repoPin{
+		RepoURI:     nodemetadata.RepoURI,
+		PoolVersion: nodemetadata.PoolVersion,
+		Channel:     nodemetadata.Channel,
+		Digest:      releasesDigest(pinned.releases),
+		Releases:    pinned.releases,
+		Components:  components,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal repository pin: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = writeFileSync(repoPinFile, jsonPin, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write repository pin: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+// mapRepoFS is an in-memory repository
+type mapRepoFS struct {
+	fstest.MapFS
+}
+
+func (mapRepoFS) Cleanup() error { return nil }
+
+func (mapRepoFS) FetchStats() repo.FetchStats { return repo.FetchStats{} }
+
+func TestPinRepository(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	nodemetadata := NodeMetadata{RepoURI: "https://repo", PoolVersion: "1.31.4"}
+	repoFS := mapRepoFS{fstest.MapFS{
+		"releases.yaml":         {Data: []byte("v1 releases")},
+		"kubelet/metadata.yaml": {Data: []byte("v1 metadata")},
+		"kubelet/index.yaml":    {Data: []byte("v1 index")},
+		"kubelet/1.31.4/config": {Data: []byte("v1 config")},
+	}}
+
+	// Nothing is pinned before the first install
+	pinned, err := pinRepository(repoFS, nodemetadata, false)
+	if err != nil {
+		t.Fatalf("failed to pin repository: %v", err)
+	}
+	for _, name := range []string{"kubelet/metadata.yaml", "kubelet/index.yaml", "kubelet/1.31.4/config"} {
+		_, err = fs.ReadFile(pinned, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = saveRepoPin(nodemetadata, pinned)
+	if err != nil {
+		t.Fatalf("failed to save repository pin: %v", err)
+	}
+	pin, err := loadRepoPin()
+	if err != nil || pin == nil || string(pin.Releases) != "v1 releases" || pin.Digest != releasesDigest([]byte("v1 releases")) {
+		t.Fatalf("expected the releases pinned, got %+v, %v", pin, err)
+	}
+	if len(pin.Components) != 2 || string(pin.Components["kubelet/metadata.yaml"]) != "v1 metadata" || string(pin.Components["kubelet/index.yaml"]) != "v1 index" {
+		t.Errorf("expected the component metadata files pinned, got %v", pin.Components)
+	}
+
+	// The repository is updated
+	repoFS.MapFS["releases.yaml"].Data = []byte("v2 releases")
+	repoFS.MapFS["kubelet/metadata.yaml"].Data = []byte("v2 metadata")
+	repoFS.MapFS["kubelet/1.31.4/config"].Data = []byte("v2 config")
+
+	// A restart uses the pinned releases and component metadata, the other files are not pinned
+	tests := []struct {
+		name         string
+		nodemetadata NodeMetadata
+		upgrade      bool
+		expected     map[string]string
+	}{
+		{name: "restart", nodemetadata: nodemetadata, expected: map[string]string{"releases.yaml": "v1 releases", "kubelet/metadata.yaml": "v1 metadata", "kubelet/1.31.4/config": "v2 config"}},
+		{name: "upgrade", nodemetadata: nodemetadata, upgrade: true, expected: map[string]string{"releases.yaml": "v2 releases", "kubelet/metadata.yaml": "v2 metadata"}},
+		{name: "pool version changed", nodemetadata: NodeMetadata{RepoURI: "https://repo", PoolVersion: "1.32.0"}, expected: map[string]string{"releases.yaml": "v2 releases", "kubelet/metadata.yaml": "v2 metadata"}},
+		{name: "repository changed", nodemetadata: NodeMetadata{RepoURI: "https://other", PoolVersion: "1.31.4"}, expected: map[string]string{"releases.yaml": "v2 releases", "kubelet/metadata.yaml": "v2 metadata"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pinned, err := pinRepository(repoFS, test.nodemetadata, test.upgrade)
+			if err != nil {
+				t.Fatalf("failed to pin repository: %v", err)
+			}
+			for name, expected := range test.expected {
+				content, err := fs.ReadFile(pinned, name)
+				if err != nil || string(content) != expected {
+					t.Errorf("expected %s %q, got %q, %v", name, expected, content, err)
+				}
+			}
+		})
+	}
+}
+
+func TestIsComponentMetadataFile(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"kubelet/metadata.yaml":        true,
+		"kubelet/index.yaml":           true,
+		"metadata.yaml":                false,
+		"kubelet/1.31.4/metadata.yaml": false,
+		"kubelet/config.yaml":          false,
+	} {
+		if isComponentMetadataFile(name) != expected {
+			t.Errorf("isComponentMetadataFile(%q) = %v, expected %v", name, !expected, expected)
+		}
+	}
+}
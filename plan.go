@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+// UpgradePlan represents the components changes an upgrade would apply, FallbackRelease is the release
+// installed when the repository has no release for the pool version. ContainerdRestart is set when the
+// containerd storage settings changed, the installed containerd is restarted to apply them.
+type UpgradePlan struct {
+	PoolVersion       string             `json:"pool_version"`
+	FallbackRelease   string             `json:"fallback_release,omitempty"`
+	Disruption        string             `json:"disruption"`
+	Components        []PlannedComponent `json:"components"`
+	ContainerdRestart bool               `json:"containerd_restart,omitempty"`
+}
+
+// PlannedComponent represents a component change, an empty From means the component is not installed yet
+type PlannedComponent struct {
+	Name       string `json:"name"`
+	From       string `json:"from,omitempty"`
+	To         string `json:"to"`
+	Disruption string `json:"disruption"`
+}
+
+// Disruption levels of a component change, from the least to the most disruptive
+const (
+	// disruptionNone means no service is started or stopped
+	disruptionNone = "none"
+	// disruptionService means services are started or stopped, the workloads are not affected
+	disruptionService = "service"
+	// disruptionNode means the node services (containerd, kubelet) are started or stopped
+	disruptionNode = "node"
+)
+
+var disruptionLevels = []string{disruptionNone, disruptionService, disruptionNode}
+
+// componentDisruption returns the disruption level of the component install
+func componentDisruption(sections ComponentSections) string {
+	disruption := disruptionNone
+	for _, resources := range sections.Install {
+		for _, service := range resources.Services {
+			if slices.Contains(verifiedServices, service.Name) {
+				return disruptionNode
+			}
+			disruption = disruptionService
+		}
+	}
+	return disruption
+}
+
+// split returns the component changes which do not restart the node services, applied outside the
+// maintenance window with split_disruptive_upgrades, and the disruptive ones deferred to the window
+func (p UpgradePlan) split() (immediate []PlannedComponent, deferred []PlannedComponent) {
+	for _, component := range p.Components {
+		if component.Disruption == disruptionNode {
+			deferred = append(deferred, component)
+		} else {
+			immediate = append(immediate, component)
+		}
+	}
+	return immediate, deferred
+}
+
+// immediatePhase returns the plan of the changes applied outside the maintenance window with
+// split_disruptive_upgrades, it is approved apart from the disruptive changes applied in the window
+func (p UpgradePlan) immediatePhase() UpgradePlan {
+	immediate, _ := p.split()
+	p.Components = immediate
+	p.ContainerdRestart = false
+	p.Disruption = disruptionNone
+	for _, component := range immediate {
+		if slices.Index(disruptionLevels, component.Disruption) > slices.Index(disruptionLevels, p.Disruption) {
+			p.Disruption = component.Disruption
+		}
+	}
+	return p
+}
+
+// deferComponents returns the node metadata keeping the deferred components at their installed
+// version, the deferred new components are not installed
+func deferComponents(nodemetadata NodeMetadata, deferred []PlannedComponent) NodeMetadata {
+	overrides := maps.Clone(nodemetadata.ComponentOverrides)
+	if overrides == nil {
+		overrides = make(map[string]ComponentOverride)
+	}
+	for _, component := range deferred {
+		override := overrides[component.Name]
+		if component.From == "" {
+			override.Disabled = true
+		} else {
+			override.Version = component.From
+			override.Source = nil
+		}
+		overrides[component.Name] = override
+	}
+	nodemetadata.ComponentOverrides = overrides
+	return nodemetadata
+}
+
+// formatPlannedComponents returns the component changes as a "component from->to" list
+func formatPlannedComponents(components []PlannedComponent) string {
+	changes := make([]string, 0, len(components))
+	for _, component := range components {
+		changes = append(changes, fmt.Sprintf("%s %s->%s", component.Name, component.From, component.To))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// Hash returns a stable hash of the plan, used by the control plane to approve a given plan
+func (p UpgradePlan) Hash() (string, error) {
+	jsonPlan, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal plan: %w", err)
+	}
+
+	sum := sha256.Sum256(jsonPlan)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// planComponents computes the upgrade plan for the node without applying anything
+func planComponents(nodemetadata NodeMetadata) (UpgradePlan, error) {
+	// Open repository FS (local zip or remote http(s))
+	slog.Info("Opening repositories", slog.String("uri", nodemetadata.RepoURI))
+	repoFS, err := repo.NewRepoFS(nodemetadata.RepoURI, hostPath(repoCacheDir))
+	if err != nil {
+		return UpgradePlan{}, err
+	}
+
+	plan, err := upgradePlan(repoFS, nodemetadata)
+	if err != nil {
+		return UpgradePlan{}, err
+	}
+
+	// Only close the repository, the zip file must be kept for the upgrade itself
+	if closer, ok := repoFS.(interface{ Close() error }); ok {
+		err = closer.Close()
+		if err != nil {
+			return UpgradePlan{}, fmt.Errorf("failed to close repository: %w", err)
+		}
+	}
+
+	return plan, nil
+}
+
+// upgradePlan compares the release components with the installed versions
+func upgradePlan(repoFS fs.FS, nodemetadata NodeMetadata) (UpgradePlan, error) {
+	// Get the release components for the node version
+	releaseComponents, fallback, err := releaseComponents(repoFS, nodemetadata)
+	if err != nil {
+		return UpgradePlan{}, fmt.Errorf("failed to get release components: %w", err)
+	}
+
+	// Resolve the wildcard versions to the versions an upgrade would install
+	releaseComponents, err = resolveComponentVersions(repoFS, releaseComponents, false)
+	if err != nil {
+		return UpgradePlan{}, fmt.Errorf("failed to resolve release components versions: %w", err)
+	}
+
+	// The plan of a release which components do not work together fails
+	err = checkComponentRequirements(repoFS, releaseComponents, nodemetadata.PoolVersion)
+	if err != nil {
+		return UpgradePlan{}, err
+	}
+
+	plan := UpgradePlan{
+		PoolVersion:     nodemetadata.PoolVersion,
+		FallbackRelease: fallback,
+		Disruption:      disruptionNone,
+		Components:      []PlannedComponent{},
+	}
+	for _, component := range releaseComponents {
+		installedVersion, err := GetComponentVersion(component.Name)
+		if err != nil {
+			return UpgradePlan{}, fmt.Errorf("failed to get component version: %w", err)
+		}
+
+		// Only keep the components which version changes
+		expectedVersion := expandVersion(component.Version, nodemetadata.PoolVersion)
+		if installedVersion == expectedVersion {
+			continue
+		}
+
+		// Get the disruption level from the component metadata of the new version, or from its source
+		var disruption string
+		if component.Source != nil {
+			disruption = sourceDisruption(*component.Source)
+		} else {
+			componentSections, err := componentMetadata(repoFS, component.Name, expectedVersion)
+			if err != nil {
+				return UpgradePlan{}, fmt.Errorf("failed to read component metadata: %w", err)
+			}
+			disruption = componentDisruption(componentSections)
+		}
+		if slices.Index(disruptionLevels, disruption) > slices.Index(disruptionLevels, plan.Disruption) {
+			plan.Disruption = disruption
+		}
+
+		plan.Components = append(plan.Components, PlannedComponent{
+			Name:       component.Name,
+			From:       installedVersion,
+			To:         expectedVersion,
+			Disruption: disruption,
+		})
+	}
+
+	// The containerd storage settings are applied by restarting containerd, like a containerd upgrade
+	containerdVersion, err := containerdVersion(releaseComponents, nodemetadata.PoolVersion)
+	if err != nil {
+		return UpgradePlan{}, err
+	}
+	plan.ContainerdRestart, err = containerdRestartRequired(nodemetadata.Containerd, containerdVersion)
+	if err != nil {
+		return UpgradePlan{}, err
+	}
+	if plan.ContainerdRestart {
+		plan.Disruption = disruptionNode
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComponentDisruption(t *testing.T) {
+	tests := []struct {
+		name     string
+		sections ComponentSections
+		expected string
+	}{
+		{
+			name:     "files only",
+			sections: ComponentSections{Install: []ComponentResources{{Files: []ComponentFile{{State: "file", Src: "a", Dst: "/a"}}}}},
+			expected: disruptionNone,
+		},
+		{
+			name:     "service",
+			sections: ComponentSections{Install: []ComponentResources{{Services: []ComponentService{{State: "started", Name: "chronyd"}}}}},
+			expected: disruptionService,
+		},
+		{
+			name: "node service",
+			sections: ComponentSections{Install: []ComponentResources{
+				{Services: []ComponentService{{State: "started", Name: "chronyd"}}},
+				{Services: []ComponentService{{State: "started", Name: "kubelet"}}},
+			}},
+			expected: disruptionNode,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := componentDisruption(tt.sections)
+			if result != tt.expected {
+				t.Errorf("componentDisruption() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSplitUpgradePlan(t *testing.T) {
+	plan := UpgradePlan{Components: []PlannedComponent{
+		{Name: "containerd", From: "1.7.22", To: "1.7.24", Disruption: disruptionNode},
+		{Name: "chrony", From: "4.3", To: "4.5", Disruption: disruptionService},
+		{Name: "crictl", From: "1.30.0", To: "1.31.1", Disruption: disruptionNone},
+		{Name: "nvidia-toolkit", To: "1.16.2", Disruption: disruptionNode},
+	}}
+	immediate, deferred := plan.split()
+	if formatPlannedComponents(immediate) != "chrony 4.3->4.5, crictl 1.30.0->1.31.1" {
+		t.Errorf("unexpected immediate components %s", formatPlannedComponents(immediate))
+	}
+	if formatPlannedComponents(deferred) != "containerd 1.7.22->1.7.24, nvidia-toolkit ->1.16.2" {
+		t.Errorf("unexpected deferred components %s", formatPlannedComponents(deferred))
+	}
+
+	// The deferred components are kept at their installed version, the new ones are not installed
+	nodemetadata := NodeMetadata{ComponentOverrides: map[string]ComponentOverride{
+		"containerd": {Version: "1.7.24", Source: &ComponentSource{}, Tags: []string{"gpu"}},
+		"crictl":     {Version: "1.31.1"},
+	}}
+	deferredMetadata := deferComponents(nodemetadata, deferred)
+	expected := map[string]ComponentOverride{
+		"containerd":     {Version: "1.7.22", Tags: []string{"gpu"}},
+		"crictl":         {Version: "1.31.1"},
+		"nvidia-toolkit": {Disabled: true},
+	}
+	if !reflect.DeepEqual(deferredMetadata.ComponentOverrides, expected) {
+		t.Errorf("unexpected overrides %+v", deferredMetadata.ComponentOverrides)
+	}
+	if nodemetadata.ComponentOverrides["containerd"].Version != "1.7.24" {
+		t.Error("expected the node metadata overrides to be left unchanged")
+	}
+}
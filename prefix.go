@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/validate/content"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// defaultAnnotationPrefix is the prefix of the annotations and labels of the agent, replaced by the
+// annotation_prefix of the node metadata, eg: for the partner deployments
+const defaultAnnotationPrefix = "k8s.scaleway.com/"
+
+// annotationPrefix is the prefix of the annotations and labels of the agent
+var annotationPrefix = defaultAnnotationPrefix
+
+// migratedManagersAnnotation records the field managers of the annotations moved to the prefix, so the
+// operations requested with the default prefix are not audited as requested by the agent
+var migratedManagersAnnotation = defaultAnnotationPrefix + "agent-migrated-managers"
+
+// prefixMigratedAnnotation is set by the agent with the default prefix once the annotations and the
+// conditions of the node are moved to the prefix, they are moved once
+var prefixMigratedAnnotation = defaultAnnotationPrefix + "agent-prefix-migrated"
+
+// annotationMigrationManager is the field manager of the annotations moved to the prefix
+const annotationMigrationManager = "k8s-agent-annotation-migration"
+
+// migratedManager is the field manager of an annotation before it was moved to the prefix
+type migratedManager struct {
+	Manager string     `json:"manager"`
+	Time    *time.Time `json:"time,omitempty"`
+}
+
+// annotationKeys are the annotations of the agent, renamed with the prefix
+var annotationKeys = []*string{
+	&agentAnnotation,
+	&upgradePlanAnnotation,
+	&upgradeApprovedAnnotation,
+	&planPreviewAnnotation,
+	&agentPanicAnnotation,
+	&repoFetchAnnotation,
+	&managedAnnotationsAnnotation,
+	&repoURIAnnotation,
+	&agentResultAnnotation,
+	&sbomAnnotation,
+	&tunnelPublicKeyAnnotation,
+	&drainCordonAnnotation,
+	&migratedManagersAnnotation,
+	&prefixMigratedAnnotation,
+}
+
+// annotationKeyPrefixes are the prefixes of the annotations of the agent, eg: the holds
+var annotationKeyPrefixes = []*string{&holdAnnotationPrefix, &componentAnnotationPrefix}
+
+// labelKeys are the labels of the agent, renamed with the prefix
+var labelKeys = []*string{&nodeOperationNodeLabel}
+
+// conditionTypes are the conditions of the agent, prefixed with a prefix other than the default one
+var conditionTypes = []*corev1.NodeConditionType{&upgradeDeferredCondition, &tunnelUnavailableCondition, &kernelRebootCondition}
+
+// setAnnotationPrefix renames the annotations and labels of the agent, and the NodeOperation API group,
+// with the prefix, eg: "k8s.example.com" for k8s.example.com/agent. The conditions are prefixed unless
+// the prefix is the default one, eg: k8s.example.com/AgentUpgradeDeferred. The default prefix is kept if
+// empty.
+func setAnnotationPrefix(prefix string) error {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		prefix = strings.TrimSuffix(defaultAnnotationPrefix, "/")
+	}
+	if errs := content.IsDNS1123Subdomain(prefix); len(errs) > 0 {
+		return fmt.Errorf("invalid annotation prefix %q: %s", prefix, strings.Join(errs, ", "))
+	}
+	prefix += "/"
+
+	for _, key := range slices.Concat(annotationKeys, annotationKeyPrefixes, labelKeys) {
+		*key = prefix + strings.TrimPrefix(*key, annotationPrefix)
+	}
+	for _, conditionType := range conditionTypes {
+		name := strings.TrimPrefix(string(*conditionType), annotationPrefix)
+		if prefix != defaultAnnotationPrefix {
+			name = prefix + name
+		}
+		*conditionType = corev1.NodeConditionType(name)
+	}
+	annotationPrefix = prefix
+	nodeOperationResource.Group = strings.TrimSuffix(prefix, "/")
+	return nil
+}
+
+// isAgentAnnotation returns true if the annotation is one of the agent with the current prefix
+func isAgentAnnotation(annotation string) bool {
+	for _, key := range annotationKeys {
+		if annotation == *key {
+			return true
+		}
+	}
+	for _, key := range annotationKeyPrefixes {
+		if strings.HasPrefix(annotation, *key) {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateAnnotationsPatch returns the merge patch moving the agent annotations set with the default
+// prefix to the current prefix, eg: set before the prefix was configured, and recording the migration so
+// the annotations set later with the default prefix are ignored. The annotations already set with the
+// current prefix are kept, with the default prefix annotation. The field managers of the moved
+// annotations are recorded, the agent becomes their field manager.
+func migrateAnnotationsPatch(annotations map[string]string, managedFields []metav1.ManagedFieldsEntry) map[string]*string {
+	patch := make(map[string]*string)
+	if !prefixMigrationPending(annotations) {
+		return patch
+	}
+	from := defaultAnnotationPrefix
+	patch[prefixMigratedAnnotation] = &from
+
+	managers := make(map[string]migratedManager)
+	if value, exists := annotations[migratedManagersAnnotation]; exists {
+		err := json.Unmarshal([]byte(value), &managers)
+		if err != nil {
+			slog.Warn("Invalid migrated annotations managers", slog.Any("error", err))
+		}
+	}
+	var recorded bool
+	for annotation, value := range annotations {
+		name, found := strings.CutPrefix(annotation, defaultAnnotationPrefix)
+		if !found || !isAgentAnnotation(annotationPrefix+name) {
+			continue
+		}
+		migrated := annotationPrefix + name
+		if migrated == migratedManagersAnnotation || migrated == prefixMigratedAnnotation {
+			patch[annotation] = nil
+			continue
+		}
+		if _, exists := annotations[migrated]; exists {
+			slog.Warn("Annotation with the default prefix not migrated, already set with the prefix", slog.String("annotation", annotation))
+			continue
+		}
+		patch[annotation] = nil
+		// The managed annotations are renamed too, so they are still removed once not desired
+		if migrated == managedAnnotationsAnnotation {
+			managed := strings.Split(value, ",")
+			for i, managedAnnotation := range managed {
+				if name, found := strings.CutPrefix(managedAnnotation, defaultAnnotationPrefix); found && isAgentAnnotation(annotationPrefix+name) {
+					managed[i] = annotationPrefix + name
+				}
+			}
+			value = strings.Join(managed, ",")
+		}
+		patch[migrated] = &value
+
+		manager, managedAt := fieldManager(managedFields, "metadata", "annotations", annotation)
+		if manager != "" {
+			managers[migrated] = migratedManager{Manager: manager, Time: managedAt}
+			recorded = true
+		}
+	}
+	if recorded {
+		value, err := json.Marshal(managers)
+		if err == nil {
+			valueString := string(value)
+			patch[migratedManagersAnnotation] = &valueString
+		}
+	}
+
+	return patch
+}
+
+// prefixMigrationPending returns whether the agent annotations and conditions of the node have not been
+// moved to the prefix yet
+func prefixMigrationPending(annotations map[string]string) bool {
+	_, migrated := annotations[prefixMigratedAnnotation]
+	return annotationPrefix != defaultAnnotationPrefix && !migrated
+}
+
+// annotationManager returns the field manager which set the agent annotation and when, the manager
+// before it was moved to the prefix if moved by the agent
+func annotationManager(node *corev1.Node, annotation string) (string, *time.Time) {
+	manager, managedAt := fieldManager(node.ManagedFields, "metadata", "annotations", annotation)
+	if manager != annotationMigrationManager {
+		return manager, managedAt
+	}
+	var managers map[string]migratedManager
+	err := json.Unmarshal([]byte(node.Annotations[migratedManagersAnnotation]), &managers)
+	if err != nil {
+		return manager, managedAt
+	}
+	if migrated, exists := managers[annotation]; exists {
+		return migrated.Manager, migrated.Time
+	}
+	return manager, managedAt
+}
+
+// migrateAnnotations moves the agent annotations of the node set with the default prefix to the
+// current prefix, once, and removes the conditions set without the prefix, which are set again with it
+// once still true. It returns true if the node was updated.
+func (c *Controller) migrateAnnotations(ctx context.Context, node *corev1.Node) (bool, error) {
+	if !prefixMigrationPending(node.Annotations) {
+		return false, nil
+	}
+
+	// Remove the conditions first, the annotations patch is conditional to the node version
+	conditions := slices.DeleteFunc(slices.Clone(node.Status.Conditions), func(condition corev1.NodeCondition) bool {
+		return slices.ContainsFunc(conditionTypes, func(conditionType *corev1.NodeConditionType) bool {
+			return string(condition.Type) == strings.TrimPrefix(string(*conditionType), annotationPrefix)
+		})
+	})
+	if len(conditions) != len(node.Status.Conditions) {
+		nodeCopy := node.DeepCopy()
+		nodeCopy.Status.Conditions = conditions
+		_, err := c.client.CoreV1().Nodes().UpdateStatus(ctx, nodeCopy, metav1.UpdateOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to remove node %s conditions without prefix: %w", c.nodeName, err)
+		}
+		c.logger.Info("Removed conditions without prefix", slog.String("prefix", annotationPrefix), slog.Int("conditions", len(node.Status.Conditions)-len(conditions)))
+		return true, nil
+	}
+
+	// Conditionally to the node version, so a trigger set meanwhile is not lost
+	patch := migrateAnnotationsPatch(node.Annotations, node.ManagedFields)
+	jsonPatch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{"annotations": patch, "resourceVersion": node.ResourceVersion},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal annotations patch: %w", err)
+	}
+	_, err = c.client.CoreV1().Nodes().Patch(ctx, c.nodeName, types.MergePatchType, jsonPatch, metav1.PatchOptions{FieldManager: annotationMigrationManager})
+	if err != nil {
+		return false, fmt.Errorf("failed to migrate node annotations %s: %w", c.nodeName, err)
+	}
+	var migrated int
+	for _, value := range patch {
+		if value == nil {
+			migrated++
+		}
+	}
+	c.logger.Info("Migrated annotations to prefix", slog.String("prefix", annotationPrefix), slog.Int("annotations", migrated))
+
+	return true, nil
+}
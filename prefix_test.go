@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetAnnotationPrefix(t *testing.T) {
+	defer func() { _ = setAnnotationPrefix("") }()
+
+	err := setAnnotationPrefix("k8s.example.com/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for key, expected := range map[string]string{
+		agentAnnotation:                  "k8s.example.com/agent",
+		managedAnnotationsAnnotation:     "k8s.example.com/agent-managed-annotations",
+		holdAnnotationPrefix:             "k8s.example.com/hold-",
+		componentAnnotationPrefix:        "k8s.example.com/component-",
+		nodeOperationNodeLabel:           "k8s.example.com/node",
+		nodeOperationResource.Group:      "k8s.example.com",
+		string(upgradeDeferredCondition): "k8s.example.com/AgentUpgradeDeferred",
+	} {
+		if key != expected {
+			t.Errorf("expected %s, got %s", expected, key)
+		}
+	}
+
+	// The keys are renamed from the current prefix
+	err = setAnnotationPrefix("partner.example")
+	if err != nil || agentAnnotation != "partner.example/agent" {
+		t.Errorf("unexpected agent annotation %s, %v", agentAnnotation, err)
+	}
+	err = setAnnotationPrefix("Invalid_Prefix")
+	if err == nil || !strings.Contains(err.Error(), "invalid annotation prefix") {
+		t.Errorf("expected an invalid prefix error, got %v", err)
+	}
+	err = setAnnotationPrefix("")
+	if err != nil || agentAnnotation != "k8s.scaleway.com/agent" {
+		t.Errorf("expected the default prefix, got %s, %v", agentAnnotation, err)
+	}
+
+	// The conditions are not prefixed with the default prefix
+	if upgradeDeferredCondition != "AgentUpgradeDeferred" {
+		t.Errorf("expected the condition without prefix, got %s", upgradeDeferredCondition)
+	}
+}
+
+func TestMigrateAnnotationsPatch(t *testing.T) {
+	defer func() { _ = setAnnotationPrefix("") }()
+
+	annotations := map[string]string{
+		"k8s.scaleway.com/agent":                     "upgrade",
+		"k8s.scaleway.com/hold-containerd":           "1.7.22",
+		"k8s.scaleway.com/component-kubelet":         "1.31.2",
+		"k8s.scaleway.com/agent-managed-annotations": "k8s.scaleway.com/component-kubelet,other",
+		"k8s.scaleway.com/upgrade-approved":          "old",
+		"k8s.example.com/upgrade-approved":           "new",
+		"k8s.scaleway.com/pool-name":                 "default",
+		"other":                                      "value",
+	}
+
+	// Nothing is migrated with the default prefix
+	requestedAt := metav1.NewTime(time.Date(2024, 10, 7, 10, 0, 0, 0, time.UTC))
+	managedFields := []metav1.ManagedFieldsEntry{
+		{Manager: "support-tool", Time: &requestedAt, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:k8s.scaleway.com/agent":{}}}}`)}},
+	}
+	if patch := migrateAnnotationsPatch(annotations, managedFields); len(patch) != 0 {
+		t.Errorf("unexpected patch %v", patch)
+	}
+
+	err := setAnnotationPrefix("k8s.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	patch := migrateAnnotationsPatch(annotations, managedFields)
+	migrated := make(map[string]string)
+	var removed []string
+	for annotation, value := range patch {
+		if value == nil {
+			removed = append(removed, annotation)
+			continue
+		}
+		migrated[annotation] = *value
+	}
+	expected := map[string]string{
+		"k8s.example.com/agent":                     "upgrade",
+		"k8s.example.com/hold-containerd":           "1.7.22",
+		"k8s.example.com/component-kubelet":         "1.31.2",
+		"k8s.example.com/agent-managed-annotations": "k8s.example.com/component-kubelet,other",
+		"k8s.example.com/agent-migrated-managers":   `{"k8s.example.com/agent":{"manager":"support-tool","time":"2024-10-07T10:00:00Z"}}`,
+		"k8s.example.com/agent-prefix-migrated":     "k8s.scaleway.com/",
+	}
+	if !maps.Equal(migrated, expected) {
+		t.Errorf("expected migrated annotations %v, got %v", expected, migrated)
+	}
+	// The annotations already set with the prefix are kept with the default prefix one, the others are
+	// not agent annotations
+	if len(removed) != 4 {
+		t.Errorf("unexpected removed annotations %v", removed)
+	}
+	for _, annotation := range []string{"k8s.scaleway.com/upgrade-approved", "k8s.example.com/upgrade-approved", "k8s.scaleway.com/pool-name", "other"} {
+		if _, exists := patch[annotation]; exists {
+			t.Errorf("unexpected patch of annotation %s", annotation)
+		}
+	}
+
+	// The annotations are migrated once
+	annotations[prefixMigratedAnnotation] = defaultAnnotationPrefix
+	if patch := migrateAnnotationsPatch(annotations, managedFields); len(patch) != 0 {
+		t.Errorf("unexpected patch once migrated %v", patch)
+	}
+}
+
+func TestMigrateAnnotations(t *testing.T) {
+	defer func() { _ = setAnnotationPrefix("") }()
+	err := setAnnotationPrefix("k8s.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx := context.Background()
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node", Annotations: map[string]string{"k8s.scaleway.com/agent": "upgrade"}},
+		Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{
+			{Type: corev1.NodeReady, Status: corev1.ConditionTrue},
+			{Type: "AgentUpgradeDeferred", Status: corev1.ConditionTrue, Reason: "WaitingForApproval"},
+		}},
+	}
+	client := fake.NewClientset(node)
+	c := &Controller{nodeName: "node", client: client, logger: slog.Default()}
+	get := func() *corev1.Node {
+		t.Helper()
+		node, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+
+	// The conditions without prefix are removed, then the annotations moved
+	migrated, err := c.migrateAnnotations(ctx, node)
+	if err != nil || !migrated {
+		t.Fatalf("expected the conditions removed, got %v, %v", migrated, err)
+	}
+	node = get()
+	if len(node.Status.Conditions) != 1 || node.Status.Conditions[0].Type != corev1.NodeReady {
+		t.Errorf("expected the agent conditions removed, got %v", node.Status.Conditions)
+	}
+	migrated, err = c.migrateAnnotations(ctx, node)
+	if err != nil || !migrated {
+		t.Fatalf("expected the annotations migrated, got %v, %v", migrated, err)
+	}
+	node = get()
+	if node.Annotations[agentAnnotation] != "upgrade" || node.Annotations[prefixMigratedAnnotation] != defaultAnnotationPrefix {
+		t.Errorf("expected the annotations migrated, got %v", node.Annotations)
+	}
+	if _, exists := node.Annotations["k8s.scaleway.com/agent"]; exists {
+		t.Errorf("expected the default prefix annotation moved, got %v", node.Annotations)
+	}
+
+	// The annotations set with the default prefix once migrated are ignored
+	node.Annotations["k8s.scaleway.com/agent"] = "restart=kubelet"
+	migrated, err = c.migrateAnnotations(ctx, node)
+	if err != nil || migrated {
+		t.Errorf("expected the node migrated once, got %v, %v", migrated, err)
+	}
+}
+
+func TestAnnotationManager(t *testing.T) {
+	defer func() { _ = setAnnotationPrefix("") }()
+	err := setAnnotationPrefix("k8s.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The operation requested with the default prefix is attributed to its requester once moved
+	movedAt := metav1.NewTime(time.Date(2024, 10, 7, 10, 1, 0, 0, time.UTC))
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{
+			agentAnnotation:            "reinstall=containerd",
+			migratedManagersAnnotation: `{"k8s.example.com/agent":{"manager":"support-tool","time":"2024-10-07T10:00:00Z"}}`,
+		},
+		ManagedFields: []metav1.ManagedFieldsEntry{
+			{Manager: annotationMigrationManager, Time: &movedAt, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:k8s.example.com/agent":{}}}}`)}},
+		},
+	}}
+	manager, requestedAt := annotationManager(node, agentAnnotation)
+	if manager != "support-tool" || requestedAt == nil || !requestedAt.Equal(time.Date(2024, 10, 7, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the manager before the migration, got %q, %v", manager, requestedAt)
+	}
+
+	// The operation requested again with the prefix is attributed to its manager
+	node.ManagedFields = append(node.ManagedFields, metav1.ManagedFieldsEntry{Manager: "kubectl-annotate", Time: &metav1.Time{Time: movedAt.Add(time.Minute)}, FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{"f:k8s.example.com/agent":{}}}}`)}})
+	manager, _ = annotationManager(node, agentAnnotation)
+	if manager != "kubectl-annotate" {
+		t.Errorf("expected the manager of the annotation, got %q", manager)
+	}
+}
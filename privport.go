@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// userDataAddress is the address of the instance user-data endpoint, it only answers the requests
+// sent from a privileged source port
+const userDataAddress = "169.254.42.42"
+
+// defaultExcludedPorts are never used as source port, they can conflict with services running or to
+// be run on the node
+var defaultExcludedPorts = []int{
+	179, // Used by calico-bird BGP.
+}
+
+// PrivilegedPortConfig is the source of the requests of the instance user-data endpoint client
+type PrivilegedPortConfig struct {
+	Ports      []int      // Privileged source ports tried in order, the first free one is used, an ephemeral port if empty
+	SourceCIDR *net.IPNet // Network of the local address the client binds to, the address routing to the endpoint if not set
+}
+
+// privilegedPortConfig is set by the -privileged-ports, -privileged-excluded-ports and
+// -privileged-source-cidr flags
+var privilegedPortConfig = PrivilegedPortConfig{Ports: privilegedPortRange(defaultExcludedPorts)}
+
+// privilegedPortRange returns all the privileged ports but the excluded ones
+func privilegedPortRange(excluded []int) []int {
+	var ports []int
+	for port := 1; port < 1024; port++ {
+		if !slices.Contains(excluded, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// parsePrivilegedPortConfig parses the privileged port flags. The ports are a list of ports and port
+// ranges (eg: 1001,1010-1020), all the privileged ports if empty, or "none" to use an ephemeral port,
+// the default in Kosmos mode where the user-data endpoint is not used.
+func parsePrivilegedPortConfig(ports, excludedPorts, sourceCIDR string, kosmos bool) (PrivilegedPortConfig, error) {
+	var config PrivilegedPortConfig
+
+	excluded := slices.Clone(defaultExcludedPorts)
+	if excludedPorts != "" {
+		list, err := parsePortList(excludedPorts)
+		if err != nil {
+			return PrivilegedPortConfig{}, fmt.Errorf("invalid excluded privileged ports: %w", err)
+		}
+		excluded = append(excluded, list...)
+	}
+
+	switch {
+	case ports == "none" || (ports == "" && kosmos):
+	case ports == "":
+		config.Ports = privilegedPortRange(excluded)
+	default:
+		list, err := parsePortList(ports)
+		if err != nil {
+			return PrivilegedPortConfig{}, fmt.Errorf("invalid privileged ports: %w", err)
+		}
+		config.Ports = slices.DeleteFunc(list, func(port int) bool { return slices.Contains(excluded, port) })
+		if len(config.Ports) == 0 {
+			return PrivilegedPortConfig{}, fmt.Errorf("invalid privileged ports: all the ports are excluded")
+		}
+	}
+
+	if sourceCIDR != "" {
+		_, network, err := net.ParseCIDR(sourceCIDR)
+		if err != nil {
+			return PrivilegedPortConfig{}, fmt.Errorf("invalid privileged source CIDR: %w", err)
+		}
+		config.SourceCIDR = network
+	}
+
+	return config, nil
+}
+
+// parsePortList parses a list of privileged ports and port ranges, eg: 1001,1010-1020
+func parsePortList(value string) ([]int, error) {
+	var ports []int
+	for item := range strings.SplitSeq(value, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		if !isRange {
+			last = first
+		}
+		from, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		to, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		if from < 1 || to > 1023 || from > to {
+			return nil, fmt.Errorf("invalid port %q, expected privileged ports between 1 and 1023", item)
+		}
+		for port := from; port <= to; port++ {
+			if !slices.Contains(ports, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	return ports, nil
+}
+
+// privilegedSourceAddress returns the local address the client binds to: the address in the source
+// CIDR if set, otherwise the address of the interface routing to the user-data endpoint, so the right
+// interface is used when the node has several private networks. It is nil if there is no route.
+func privilegedSourceAddress(sourceCIDR *net.IPNet) (net.IP, error) {
+	if sourceCIDR != nil {
+		addresses, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+		}
+		for _, address := range addresses {
+			if network, ok := address.(*net.IPNet); ok && sourceCIDR.Contains(network.IP) {
+				return network.IP, nil
+			}
+		}
+		return nil, fmt.Errorf("no local address in the privileged source CIDR %s", sourceCIDR)
+	}
+
+	// Resolve the route to the endpoint, no packet is sent
+	conn, err := net.Dial("udp4", net.JoinHostPort(userDataAddress, "80"))
+	if err != nil {
+		return nil, nil
+	}
+	address := conn.LocalAddr().(*net.UDPAddr).IP
+	_ = conn.Close()
+
+	return address, nil
+}
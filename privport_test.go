@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePrivilegedPortConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		ports      string
+		excluded   string
+		sourceCIDR string
+		kosmos     bool
+		expected   []int
+		count      int
+		err        string
+	}{
+		{name: "default", count: 1022},
+		{name: "default excluded", excluded: "111,600-699", count: 921},
+		{name: "allow-list", ports: "1001, 1010-1012,179", expected: []int{1001, 1010, 1011, 1012}},
+		{name: "allow-list excluded", ports: "1001-1003", excluded: "1002", expected: []int{1001, 1003}},
+		{name: "single port", ports: "1001", expected: []int{1001}},
+		{name: "disabled", ports: "none"},
+		{name: "Kosmos", kosmos: true},
+		{name: "Kosmos allow-list", ports: "1001", kosmos: true, expected: []int{1001}},
+		{name: "source CIDR", ports: "1001", sourceCIDR: "10.0.0.0/8", expected: []int{1001}},
+		{name: "unprivileged port", ports: "1024", err: "expected privileged ports"},
+		{name: "invalid range", ports: "1010-1001", err: "invalid port"},
+		{name: "invalid port", ports: "http", err: "invalid port"},
+		{name: "all excluded", ports: "179", err: "all the ports are excluded"},
+		{name: "invalid excluded port", excluded: "0", err: "invalid excluded privileged ports"},
+		{name: "invalid source CIDR", sourceCIDR: "10.0.0.1", err: "invalid privileged source CIDR"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := parsePrivilegedPortConfig(test.ports, test.excluded, test.sourceCIDR, test.kosmos)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.count > 0 {
+				if len(config.Ports) != test.count || slices.Contains(config.Ports, 179) {
+					t.Errorf("expected %d ports without 179, got %d", test.count, len(config.Ports))
+				}
+			} else if !slices.Equal(config.Ports, test.expected) {
+				t.Errorf("ports = %v, expected %v", config.Ports, test.expected)
+			}
+			if (config.SourceCIDR != nil) != (test.sourceCIDR != "") {
+				t.Errorf("unexpected source CIDR %v", config.SourceCIDR)
+			}
+		})
+	}
+}
+
+func TestPrivilegedSourceAddress(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	address, err := privilegedSourceAddress(loopback)
+	if err != nil || !address.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("expected the loopback address, got %v, %v", address, err)
+	}
+
+	_, documentation, _ := net.ParseCIDR("203.0.113.0/24")
+	_, err = privilegedSourceAddress(documentation)
+	if err == nil || !strings.Contains(err.Error(), "no local address") {
+		t.Errorf("expected no local address, got %v", err)
+	}
+}
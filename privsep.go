@@ -0,0 +1,975 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+// privileged are the controller operations which require root. When the controller runs as an
+// unprivileged user, they are delegated to the root agent process through RPC calls.
+type privileged interface {
+	LoadNodeMetadata(ctx context.Context) (NodeMetadata, error)
+	CreateSnapshot(ctx context.Context) (string, error)
+	ProcessComponents(ctx context.Context, request InstallRequest) error
+	RestoreLatestSnapshot(ctx context.Context) (string, error)
+	PlanComponents(ctx context.Context, request InstallRequest) (UpgradePlan, error)
+	SyncHolds(ctx context.Context, holds map[string]string) (bool, error)
+	SetupTunnel(ctx context.Context) error
+	CheckTunnel(ctx context.Context) error
+	TunnelPublicKey(ctx context.Context) (string, error)
+	ProcessNetwork(ctx context.Context) error
+	FirewallDrift(ctx context.Context) ([]string, error)
+	ApplyFirewallRules(ctx context.Context) error
+	FetchStats(ctx context.Context) (repo.FetchStats, error)
+	SBOMDigest(ctx context.Context) (string, error)
+	SwitchRepository(ctx context.Context, to string) error
+	ReconcileCNI(ctx context.Context) ([]string, error)
+	RemediateImageFilesystem(ctx context.Context) (ImageGCReport, error)
+	ReinstallComponent(ctx context.Context, request RemoteOperationRequest) (string, error)
+	RestartService(ctx context.Context, request RemoteOperationRequest) error
+	DecommissionNode(ctx context.Context, request RemoteOperationRequest) error
+	RecordAudit(ctx context.Context, entry AuditEntry) error
+	AuthenticateRemoteRequest(ctx context.Context, request RemoteAPIRequest) error
+	RotateClusterCA(ctx context.Context) (ClusterCARotation, error)
+}
+
+// InstallRequest are the parameters of an install or a plan requested by the controller. The node
+// metadata is loaded by the root agent process, so the controller can only choose an allowed repository
+// and the components kept at their installed version.
+type InstallRequest struct {
+	RepoURI  string   // Repository switched to, the metadata repository if empty
+	Deferred []string // Components kept at their installed version, containerd also keeps its settings
+}
+
+// RemoteOperationRequest is a privileged remote operation requested by the controller, the root agent
+// process checks the remote operations policy and records the operation in the audit log itself
+type RemoteOperationRequest struct {
+	Arg         string // Component reinstalled or service restarted
+	Source      string
+	Actor       string
+	RequestedAt *time.Time
+}
+
+// privilegedNodeMetadata loads the node metadata in the root agent process, the controller never
+// sends the node metadata of the privileged operations
+var privilegedNodeMetadata = func(ctx context.Context) (NodeMetadata, error) {
+	// Get node token to fetch the node metadata
+	nodeUserData, err := getNodeUserData()
+	if err != nil {
+		return NodeMetadata{}, fmt.Errorf("failed to get credentials: %w", err)
+	}
+
+	// Get the node metadata, merged from all the metadata sources
+	return loadNodeMetadata(ctx, nodeUserData)
+}
+
+// requestMetadata returns the node metadata of the install request
+func requestMetadata(ctx context.Context, request InstallRequest) (NodeMetadata, error) {
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		return NodeMetadata{}, fmt.Errorf("failed to get node metadata: %w", err)
+	}
+
+	// The repository must be allowed by the node metadata endpoint
+	if request.RepoURI != "" && request.RepoURI != nodeMetadata.RepoURI {
+		err = nodeMetadata.checkRepoURI(request.RepoURI)
+		if err != nil {
+			return NodeMetadata{}, err
+		}
+		nodeMetadata.RepoURI = request.RepoURI
+	}
+	if len(request.Deferred) == 0 {
+		return nodeMetadata, nil
+	}
+
+	// Defer the planned changes of the requested components
+	plan, err := planComponents(nodeMetadata)
+	if err != nil {
+		return NodeMetadata{}, fmt.Errorf("failed to compute upgrade plan: %w", err)
+	}
+	var deferred []PlannedComponent
+	for _, component := range plan.Components {
+		if slices.Contains(request.Deferred, component.Name) {
+			deferred = append(deferred, component)
+		}
+	}
+	nodeMetadata = deferComponents(nodeMetadata, deferred)
+	nodeMetadata.deferContainerd = slices.Contains(request.Deferred, "containerd")
+	return nodeMetadata, nil
+}
+
+// localPrivileged runs the privileged operations in the current process
+type localPrivileged struct{}
+
+func (localPrivileged) LoadNodeMetadata(ctx context.Context) (NodeMetadata, error) {
+	return privilegedNodeMetadata(ctx)
+}
+
+func (localPrivileged) CreateSnapshot(ctx context.Context) (string, error) {
+	return createSnapshot()
+}
+
+func (localPrivileged) ProcessComponents(ctx context.Context, request InstallRequest) error {
+	nodeMetadata, err := requestMetadata(ctx, request)
+	if err != nil {
+		return err
+	}
+	return processComponents(ctx, nodeMetadata, true)
+}
+
+func (localPrivileged) RestoreLatestSnapshot(ctx context.Context) (string, error) {
+	return restoreLatestSnapshot()
+}
+
+func (localPrivileged) PlanComponents(ctx context.Context, request InstallRequest) (UpgradePlan, error) {
+	nodeMetadata, err := requestMetadata(ctx, request)
+	if err != nil {
+		return UpgradePlan{}, err
+	}
+	return planComponents(nodeMetadata)
+}
+
+// SyncHolds saves the holds, it returns true if they changed
+func (localPrivileged) SyncHolds(ctx context.Context, holds map[string]string) (bool, error) {
+	savedHolds, err := loadHolds()
+	if err != nil {
+		return false, err
+	}
+	if maps.Equal(holds, savedHolds) {
+		return false, nil
+	}
+
+	err = saveHolds(holds)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// privilegedTunnel returns the tunnel of the node metadata loaded by the root agent process
+func privilegedTunnel(ctx context.Context) (Tunnel, error) {
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		return Tunnel{}, fmt.Errorf("failed to get node metadata: %w", err)
+	}
+	if nodeMetadata.Tunnel == nil {
+		return Tunnel{}, errors.New("no tunnel in the node metadata")
+	}
+	return *nodeMetadata.Tunnel, nil
+}
+
+func (localPrivileged) SetupTunnel(ctx context.Context) error {
+	tunnel, err := privilegedTunnel(ctx)
+	if err != nil {
+		return err
+	}
+	return setupTunnel(tunnel)
+}
+
+func (localPrivileged) CheckTunnel(ctx context.Context) error {
+	tunnel, err := privilegedTunnel(ctx)
+	if err != nil {
+		return err
+	}
+	return checkTunnel(tunnel, time.Now())
+}
+
+func (localPrivileged) TunnelPublicKey(ctx context.Context) (string, error) {
+	tunnel, err := privilegedTunnel(ctx)
+	if err != nil {
+		return "", err
+	}
+	return tunnelPublicKey(tunnel)
+}
+
+// ProcessNetwork applies the node network prerequisites of the node metadata again
+func (localPrivileged) ProcessNetwork(ctx context.Context) error {
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get node metadata: %w", err)
+	}
+	return processNetwork(slog.Default(), "node", nodeMetadata.Network)
+}
+
+func (localPrivileged) FirewallDrift(ctx context.Context) ([]string, error) {
+	return firewallDrift()
+}
+
+// ApplyFirewallRules applies the rules saved by the root process, never rules sent by the controller
+func (localPrivileged) ApplyFirewallRules(ctx context.Context) error {
+	rules, err := loadFirewallRules()
+	if err != nil {
+		return err
+	}
+	return applyFirewallRules(rules)
+}
+
+func (localPrivileged) FetchStats(ctx context.Context) (repo.FetchStats, error) {
+	return loadFetchStats()
+}
+
+func (localPrivileged) SBOMDigest(ctx context.Context) (string, error) {
+	return loadSBOMDigest()
+}
+
+func (localPrivileged) SwitchRepository(ctx context.Context, to string) error {
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get node metadata: %w", err)
+	}
+	err = nodeMetadata.checkRepoURI(to)
+	if err != nil {
+		return err
+	}
+	return saveRepoSwitch(nodeMetadata.RepoURI, to)
+}
+
+func (localPrivileged) ReconcileCNI(ctx context.Context) ([]string, error) {
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node metadata: %w", err)
+	}
+	return reconcileCNI(nodeMetadata.CNI)
+}
+
+func (localPrivileged) RemediateImageFilesystem(ctx context.Context) (ImageGCReport, error) {
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		return ImageGCReport{}, fmt.Errorf("failed to get node metadata: %w", err)
+	}
+	if nodeMetadata.ImageGC == nil {
+		return ImageGCReport{}, nil
+	}
+	return remediateImageFilesystem(*nodeMetadata.ImageGC, nodeMetadata.Containerd)
+}
+
+func (localPrivileged) ReinstallComponent(ctx context.Context, request RemoteOperationRequest) (string, error) {
+	var version string
+	err := auditRemoteOperation(ctx, AgentOperation{Name: "reinstall", Arg: request.Arg}, request, func(nodeMetadata NodeMetadata) (string, error) {
+		var err error
+		version, err = reinstallComponent(ctx, nodeMetadata, request.Arg)
+		return fmt.Sprintf("Component %s %s reinstalled", request.Arg, version), err
+	})
+	return version, err
+}
+
+func (localPrivileged) RestartService(ctx context.Context, request RemoteOperationRequest) error {
+	return auditRemoteOperation(ctx, AgentOperation{Name: "restart", Arg: request.Arg}, request, func(NodeMetadata) (string, error) {
+		return fmt.Sprintf("Service %s restarted", request.Arg), restartService(ctx, request.Arg)
+	})
+}
+
+func (localPrivileged) DecommissionNode(ctx context.Context, request RemoteOperationRequest) error {
+	return auditRemoteOperation(ctx, AgentOperation{Name: "decommission"}, request, func(nodeMetadata NodeMetadata) (string, error) {
+		return "Node decommissioned", decommissionNode(ctx, nodeMetadata)
+	})
+}
+
+func (localPrivileged) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	return recordReportedAudit(entry)
+}
+
+func (localPrivileged) AuthenticateRemoteRequest(ctx context.Context, request RemoteAPIRequest) error {
+	return remoteAuth.authenticate(ctx, request)
+}
+
+// ClusterCARotation is the result of a cluster CA rotation, with the cluster CA of the node metadata it applied
+type ClusterCARotation struct {
+	ClusterCA string
+	Rotated   bool
+}
+
+func (localPrivileged) RotateClusterCA(ctx context.Context) (ClusterCARotation, error) {
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		return ClusterCARotation{}, fmt.Errorf("failed to get node metadata: %w", err)
+	}
+	if nodeMetadata.ClusterCA == "" {
+		return ClusterCARotation{}, nil
+	}
+
+	rotation := ClusterCARotation{ClusterCA: nodeMetadata.ClusterCA}
+	rotation.Rotated, err = rotateClusterCA(nodeMetadata.ClusterCA)
+	if err != nil {
+		return rotation, err
+	}
+
+	// The kubeconfigs also follow the token changes
+	_, err = rotateKubeconfigs(nodeMetadata)
+	return rotation, err
+}
+
+// StallProgress is the progress of the root agent process and its stall to report, if any
+type StallProgress struct {
+	LastProgress int64 // Unix time in nanoseconds
+	Stall        string
+}
+
+// StallDump is a stall of the unprivileged controller saved by the root agent process
+type StallDump struct {
+	Message    string
+	Goroutines []byte
+}
+
+// stallProgressInterval is the interval at which the controller fetches the progress of the root agent
+// process, so a long install is not reported as a stalled reconcile
+const stallProgressInterval = 10 * time.Second
+
+// stallDumpMaxSize is the maximum size of the goroutines of the controller saved by the root agent process
+const stallDumpMaxSize = 16 << 20
+
+// PrivilegedHelper is the RPC server of the root agent process running the privileged operations
+type PrivilegedHelper struct {
+	ctx          context.Context
+	nodeMetadata NodeMetadata
+	local        localPrivileged
+	stallReports chan string // Stalls of the root agent process, reported by the controller
+}
+
+// Metadata returns the node metadata loaded by the root agent process at startup
+func (h *PrivilegedHelper) Metadata(_ bool, reply *NodeMetadata) error {
+	*reply = controllerMetadata(h.nodeMetadata)
+	return nil
+}
+
+func (h *PrivilegedHelper) LoadNodeMetadata(_ bool, reply *NodeMetadata) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	nodeMetadata, err := h.local.LoadNodeMetadata(h.ctx)
+	*reply = controllerMetadata(nodeMetadata)
+	return err
+}
+
+// controllerMetadata returns the node metadata sent to the controller, without the secrets only the root
+// agent process uses. The node token and the managed nodes token are kept, they are the credentials of the
+// Kubernetes API clients of the controller.
+func controllerMetadata(nodeMetadata NodeMetadata) NodeMetadata {
+	if nodeMetadata.Tunnel != nil {
+		tunnel := *nodeMetadata.Tunnel
+		tunnel.PrivateKey = ""
+		nodeMetadata.Tunnel = &tunnel
+	}
+	return nodeMetadata
+}
+
+func (h *PrivilegedHelper) CreateSnapshot(_ bool, reply *string) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	snapshotPath, err := h.local.CreateSnapshot(h.ctx)
+	*reply = snapshotPath
+	return err
+}
+
+func (h *PrivilegedHelper) ProcessComponents(request InstallRequest, _ *bool) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	return h.local.ProcessComponents(h.ctx, request)
+}
+
+func (h *PrivilegedHelper) RestoreLatestSnapshot(_ bool, reply *string) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	snapshotPath, err := h.local.RestoreLatestSnapshot(h.ctx)
+	*reply = snapshotPath
+	return err
+}
+
+// PlanReply is the reply of the PlanComponents call. net/rpc only carries the message of the errors,
+// so the release not found error is returned in the reply to keep its type.
+type PlanReply struct {
+	Plan            UpgradePlan
+	ReleaseNotFound string
+}
+
+func (h *PrivilegedHelper) PlanComponents(request InstallRequest, reply *PlanReply) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	plan, err := h.local.PlanComponents(h.ctx, request)
+	if errors.Is(err, errReleaseNotFound) {
+		reply.ReleaseNotFound = err.Error()
+		return nil
+	}
+	reply.Plan = plan
+	return err
+}
+
+func (h *PrivilegedHelper) SyncHolds(holds map[string]string, reply *bool) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	changed, err := h.local.SyncHolds(h.ctx, holds)
+	*reply = changed
+	return err
+}
+
+func (h *PrivilegedHelper) SetupTunnel(_ bool, _ *bool) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	return h.local.SetupTunnel(h.ctx)
+}
+
+func (h *PrivilegedHelper) CheckTunnel(_ bool, _ *bool) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	return h.local.CheckTunnel(h.ctx)
+}
+
+func (h *PrivilegedHelper) TunnelPublicKey(_ bool, reply *string) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	publicKey, err := h.local.TunnelPublicKey(h.ctx)
+	*reply = publicKey
+	return err
+}
+
+func (h *PrivilegedHelper) ProcessNetwork(_ bool, _ *bool) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	return h.local.ProcessNetwork(h.ctx)
+}
+
+func (h *PrivilegedHelper) FirewallDrift(_ bool, reply *[]string) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	drifts, err := h.local.FirewallDrift(h.ctx)
+	*reply = drifts
+	return err
+}
+
+func (h *PrivilegedHelper) ApplyFirewallRules(_ bool, _ *bool) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	return h.local.ApplyFirewallRules(h.ctx)
+}
+
+func (h *PrivilegedHelper) FetchStats(_ bool, reply *repo.FetchStats) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	stats, err := h.local.FetchStats(h.ctx)
+	*reply = stats
+	return err
+}
+
+func (h *PrivilegedHelper) SBOMDigest(_ bool, reply *string) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	digest, err := h.local.SBOMDigest(h.ctx)
+	*reply = digest
+	return err
+}
+
+func (h *PrivilegedHelper) SwitchRepository(to string, _ *bool) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	return h.local.SwitchRepository(h.ctx, to)
+}
+
+func (h *PrivilegedHelper) ReconcileCNI(_ bool, reply *[]string) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	quarantined, err := h.local.ReconcileCNI(h.ctx)
+	*reply = quarantined
+	return err
+}
+
+func (h *PrivilegedHelper) RemediateImageFilesystem(_ bool, reply *ImageGCReport) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	report, err := h.local.RemediateImageFilesystem(h.ctx)
+	*reply = report
+	return err
+}
+
+// RemoteOperationReply is the reply of the privileged remote operation calls. net/rpc only carries the
+// message of the errors, so the operation not started error is returned in the reply to keep its type.
+type RemoteOperationReply struct {
+	Version    string // Version of the component reinstalled
+	NotStarted string
+}
+
+func (h *PrivilegedHelper) ReinstallComponent(request RemoteOperationRequest, reply *RemoteOperationReply) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	version, err := h.local.ReinstallComponent(h.ctx, request)
+	if errors.Is(err, errOperationNotStarted) {
+		reply.NotStarted = err.Error()
+		return nil
+	}
+	reply.Version = version
+	return err
+}
+
+func (h *PrivilegedHelper) RestartService(request RemoteOperationRequest, reply *RemoteOperationReply) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	err := h.local.RestartService(h.ctx, request)
+	if errors.Is(err, errOperationNotStarted) {
+		reply.NotStarted = err.Error()
+		return nil
+	}
+	return err
+}
+
+func (h *PrivilegedHelper) DecommissionNode(request RemoteOperationRequest, reply *RemoteOperationReply) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	err := h.local.DecommissionNode(h.ctx, request)
+	if errors.Is(err, errOperationNotStarted) {
+		reply.NotStarted = err.Error()
+		return nil
+	}
+	return err
+}
+
+func (h *PrivilegedHelper) RecordAudit(entry AuditEntry, _ *bool) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	return h.local.RecordAudit(h.ctx, entry)
+}
+
+func (h *PrivilegedHelper) AuthenticateRemoteRequest(request RemoteAPIRequest, reply *RemoteAPIReply) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	err := h.local.AuthenticateRemoteRequest(h.ctx, request)
+	if errors.Is(err, errRemoteAPIDenied) {
+		reply.Denied = err.Error()
+		return nil
+	}
+	return err
+}
+
+func (h *PrivilegedHelper) RotateClusterCA(_ bool, reply *ClusterCARotation) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	rotation, err := h.local.RotateClusterCA(h.ctx)
+	*reply = rotation
+	return err
+}
+
+// StallProgress returns the last progress of the root agent process, and its stall to report if any
+func (h *PrivilegedHelper) StallProgress(_ bool, reply *StallProgress) error {
+	reply.LastProgress = stalls.lastProgress.Load()
+	select {
+	case reply.Stall = <-h.stallReports:
+	default:
+	}
+	return nil
+}
+
+// SaveStall saves the stall of the controller, which cannot write the state directory
+func (h *PrivilegedHelper) SaveStall(dump StallDump, reply *string) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	message := dump.Message
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	goroutines := dump.Goroutines
+	if len(goroutines) > stallDumpMaxSize {
+		goroutines = goroutines[:stallDumpMaxSize]
+	}
+	stallPath, err := saveStall(controllerStallsDir, "controller: "+message, goroutines)
+	*reply = stallPath
+	return err
+}
+
+// PanicDump is a panic of the unprivileged controller saved by the root agent process
+type PanicDump struct {
+	Panic string
+	Stack []byte
+}
+
+// SavePanic saves the panic of the controller, which cannot write the state directory
+func (h *PrivilegedHelper) SavePanic(dump PanicDump, reply *string) error {
+	// The RPC calls run in their own goroutine
+	defer handlePanic(nil)
+
+	message := dump.Panic
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	stack := dump.Stack
+	if len(stack) > stallDumpMaxSize {
+		stack = stack[:stallDumpMaxSize]
+	}
+	panicPath, err := savePanic("controller: "+message, stack)
+	*reply = panicPath
+	return err
+}
+
+// reportStall hands the stall of the root agent process to the controller, which reports it on the node
+func (h *PrivilegedHelper) reportStall(message string) {
+	select {
+	case h.stallReports <- message:
+	case <-time.After(2 * stallProgressInterval):
+		slog.Warn("Stall not reported, the controller did not fetch it")
+	}
+}
+
+// privilegedClient delegates the privileged operations to the root agent process
+type privilegedClient struct {
+	client *rpc.Client
+}
+
+// privilegedError is an error returned by the root agent process, it keeps the message of the error
+// and matches its sentinel error with errors.Is
+type privilegedError struct {
+	message string
+	err     error
+}
+
+func (e privilegedError) Error() string { return e.message }
+
+func (e privilegedError) Unwrap() error { return e.err }
+
+// call calls the privileged helper method, the call is abandoned if the context is cancelled
+func (p *privilegedClient) call(ctx context.Context, method string, args any, reply any) error {
+	call := p.client.Go("PrivilegedHelper."+method, args, reply, nil)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.Done:
+		return call.Error
+	}
+}
+
+func (p *privilegedClient) Metadata(ctx context.Context) (NodeMetadata, error) {
+	var nodeMetadata NodeMetadata
+	err := p.call(ctx, "Metadata", true, &nodeMetadata)
+	return nodeMetadata, err
+}
+
+func (p *privilegedClient) LoadNodeMetadata(ctx context.Context) (NodeMetadata, error) {
+	var nodeMetadata NodeMetadata
+	err := p.call(ctx, "LoadNodeMetadata", true, &nodeMetadata)
+	return nodeMetadata, err
+}
+
+func (p *privilegedClient) CreateSnapshot(ctx context.Context) (string, error) {
+	var snapshotPath string
+	err := p.call(ctx, "CreateSnapshot", true, &snapshotPath)
+	return snapshotPath, err
+}
+
+func (p *privilegedClient) ProcessComponents(ctx context.Context, request InstallRequest) error {
+	return p.call(ctx, "ProcessComponents", request, new(bool))
+}
+
+func (p *privilegedClient) RestoreLatestSnapshot(ctx context.Context) (string, error) {
+	var snapshotPath string
+	err := p.call(ctx, "RestoreLatestSnapshot", true, &snapshotPath)
+	return snapshotPath, err
+}
+
+func (p *privilegedClient) PlanComponents(ctx context.Context, request InstallRequest) (UpgradePlan, error) {
+	var reply PlanReply
+	err := p.call(ctx, "PlanComponents", request, &reply)
+	if err == nil && reply.ReleaseNotFound != "" {
+		return UpgradePlan{}, privilegedError{message: reply.ReleaseNotFound, err: errReleaseNotFound}
+	}
+
+	// Empty slices are decoded as nil, keep the plan identical to a local one so its hash is the same
+	plan := reply.Plan
+	if plan.Components == nil {
+		plan.Components = []PlannedComponent{}
+	}
+
+	return plan, err
+}
+
+func (p *privilegedClient) SyncHolds(ctx context.Context, holds map[string]string) (bool, error) {
+	var changed bool
+	err := p.call(ctx, "SyncHolds", holds, &changed)
+	return changed, err
+}
+
+func (p *privilegedClient) SetupTunnel(ctx context.Context) error {
+	return p.call(ctx, "SetupTunnel", true, new(bool))
+}
+
+func (p *privilegedClient) CheckTunnel(ctx context.Context) error {
+	return p.call(ctx, "CheckTunnel", true, new(bool))
+}
+
+func (p *privilegedClient) TunnelPublicKey(ctx context.Context) (string, error) {
+	var publicKey string
+	err := p.call(ctx, "TunnelPublicKey", true, &publicKey)
+	return publicKey, err
+}
+
+func (p *privilegedClient) ProcessNetwork(ctx context.Context) error {
+	return p.call(ctx, "ProcessNetwork", true, new(bool))
+}
+
+func (p *privilegedClient) FirewallDrift(ctx context.Context) ([]string, error) {
+	var reply []string
+	err := p.call(ctx, "FirewallDrift", true, &reply)
+	return reply, err
+}
+
+func (p *privilegedClient) ApplyFirewallRules(ctx context.Context) error {
+	return p.call(ctx, "ApplyFirewallRules", true, new(bool))
+}
+
+func (p *privilegedClient) FetchStats(ctx context.Context) (repo.FetchStats, error) {
+	var stats repo.FetchStats
+	err := p.call(ctx, "FetchStats", true, &stats)
+	return stats, err
+}
+
+func (p *privilegedClient) SBOMDigest(ctx context.Context) (string, error) {
+	var digest string
+	err := p.call(ctx, "SBOMDigest", true, &digest)
+	return digest, err
+}
+
+func (p *privilegedClient) SwitchRepository(ctx context.Context, to string) error {
+	return p.call(ctx, "SwitchRepository", to, new(bool))
+}
+
+func (p *privilegedClient) ReconcileCNI(ctx context.Context) ([]string, error) {
+	var quarantined []string
+	err := p.call(ctx, "ReconcileCNI", true, &quarantined)
+	return quarantined, err
+}
+
+func (p *privilegedClient) RemediateImageFilesystem(ctx context.Context) (ImageGCReport, error) {
+	var report ImageGCReport
+	err := p.call(ctx, "RemediateImageFilesystem", true, &report)
+	return report, err
+}
+
+func (p *privilegedClient) ReinstallComponent(ctx context.Context, request RemoteOperationRequest) (string, error) {
+	var reply RemoteOperationReply
+	err := p.call(ctx, "ReinstallComponent", request, &reply)
+	if err == nil && reply.NotStarted != "" {
+		return "", privilegedError{message: reply.NotStarted, err: errOperationNotStarted}
+	}
+	return reply.Version, err
+}
+
+func (p *privilegedClient) RestartService(ctx context.Context, request RemoteOperationRequest) error {
+	var reply RemoteOperationReply
+	err := p.call(ctx, "RestartService", request, &reply)
+	if err == nil && reply.NotStarted != "" {
+		return privilegedError{message: reply.NotStarted, err: errOperationNotStarted}
+	}
+	return err
+}
+
+func (p *privilegedClient) DecommissionNode(ctx context.Context, request RemoteOperationRequest) error {
+	var reply RemoteOperationReply
+	err := p.call(ctx, "DecommissionNode", request, &reply)
+	if err == nil && reply.NotStarted != "" {
+		return privilegedError{message: reply.NotStarted, err: errOperationNotStarted}
+	}
+	return err
+}
+
+func (p *privilegedClient) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	return p.call(ctx, "RecordAudit", entry, new(bool))
+}
+
+func (p *privilegedClient) AuthenticateRemoteRequest(ctx context.Context, request RemoteAPIRequest) error {
+	var reply RemoteAPIReply
+	err := p.call(ctx, "AuthenticateRemoteRequest", request, &reply)
+	if err == nil && reply.Denied != "" {
+		return privilegedError{message: reply.Denied, err: errRemoteAPIDenied}
+	}
+	return err
+}
+
+func (p *privilegedClient) RotateClusterCA(ctx context.Context) (ClusterCARotation, error) {
+	var rotation ClusterCARotation
+	err := p.call(ctx, "RotateClusterCA", true, &rotation)
+	return rotation, err
+}
+
+// SaveStall saves the stall of the controller in the state directory of the root agent process
+func (p *privilegedClient) SaveStall(message string, goroutines []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var stallPath string
+	err := p.call(ctx, "SaveStall", StallDump{Message: message, Goroutines: goroutines}, &stallPath)
+	return stallPath, err
+}
+
+// SavePanic saves the panic of the controller in the state directory of the root agent process
+func (p *privilegedClient) SavePanic(recovered string, stack []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var panicPath string
+	err := p.call(ctx, "SavePanic", PanicDump{Panic: recovered, Stack: stack}, &panicPath)
+	return panicPath, err
+}
+
+// forwardStallProgress fetches the progress of the root agent process until the context is done, so
+// its installs are progress of the controller reconcile waiting for them, and reports its stalls
+func (p *privilegedClient) forwardStallProgress(ctx context.Context) {
+	ticker := time.NewTicker(stallProgressInterval)
+	defer ticker.Stop()
+
+	var lastProgress int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var progress StallProgress
+		err := p.call(ctx, "StallProgress", true, &progress)
+		if err != nil {
+			slog.Debug("Failed to get root agent progress", slog.Any("error", err))
+			continue
+		}
+		if progress.LastProgress > lastProgress {
+			if lastProgress != 0 {
+				stalls.progress()
+			}
+			lastProgress = progress.LastProgress
+		}
+		if progress.Stall != "" {
+			stalls.reportStall(progress.Stall)
+		}
+	}
+}
+
+// helperFD is the file descriptor of the privileged helper connection in the controller process
+const helperFD = 3
+
+// runUnprivilegedController runs the controller as the given user in a child process, and serves
+// its privileged operations until it exits
+func runUnprivilegedController(ctx context.Context, username string, nodeMetadata NodeMetadata) error {
+	controllerUser, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("failed to lookup user %s: %w", username, err)
+	}
+	uid, err := strconv.ParseUint(controllerUser.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid user %s uid: %w", username, err)
+	}
+	gid, err := strconv.ParseUint(controllerUser.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid user %s gid: %w", username, err)
+	}
+
+	// Connect the helper and the controller with a socket pair
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create socket pair: %w", err)
+	}
+	helperFile := os.NewFile(uintptr(fds[0]), "helper")
+	controllerFile := os.NewFile(uintptr(fds[1]), "controller")
+	helperConn, err := net.FileConn(helperFile)
+	_ = helperFile.Close()
+	if err != nil {
+		_ = controllerFile.Close()
+		return fmt.Errorf("failed to open helper connection: %w", err)
+	}
+
+	// Start the controller without any privilege, it is killed if the agent dies
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get agent executable: %w", err)
+	}
+	cmd := exec.Command(executable, "-controller-child", "-root-dir="+rootDir, "-service-manager="+serviceManager, "-feature-gates="+featureGatesFlag, "-debug-socket="+debugSocketFlag, "-admin-socket="+adminSocketFlag, "-remote-api-address="+remoteAPIAddressFlag, "-remote-api-cert="+remoteAPICertFlag, "-remote-api-key="+remoteAPIKeyFlag, "-stall-timeout="+stallTimeoutFlag.String(), "-stall-restart="+strconv.FormatBool(stallRestartFlag))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{controllerFile}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		Pdeathsig:  syscall.SIGTERM,
+	}
+	err = cmd.Start()
+	_ = controllerFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start controller: %w", err)
+	}
+	slog.Info("Controller started", slog.String("user", username), slog.Int("pid", cmd.Process.Pid))
+
+	// Serve the privileged operations
+	helper := &PrivilegedHelper{ctx: ctx, nodeMetadata: nodeMetadata, stallReports: make(chan string)}
+	server := rpc.NewServer()
+	err = server.Register(helper)
+	if err != nil {
+		return fmt.Errorf("failed to register privileged helper: %w", err)
+	}
+	go server.ServeConn(helperConn)
+
+	// The stalls of the installs run by the root agent process are reported by the controller
+	stalls.setReport(helper.reportStall)
+	defer stalls.setReport(nil)
+
+	err = cmd.Wait()
+	if err != nil {
+		return controllerExitError{code: cmd.ProcessState.ExitCode(), err: err}
+	}
+
+	return nil
+}
+
+// runControllerChild runs the controller in the unprivileged child process
+func runControllerChild(ctx context.Context) error {
+	conn, err := net.FileConn(os.NewFile(helperFD, "helper"))
+	if err != nil {
+		return fmt.Errorf("failed to open helper connection: %w", err)
+	}
+	helper := &privilegedClient{client: rpc.NewClient(conn)}
+
+	nodeMetadata, err := helper.Metadata(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get node metadata: %w", err)
+	}
+
+	// The panics are saved by the root agent process
+	panicSave = helper.SavePanic
+
+	// The stalls are saved by the root agent process, and its installs are progress of the controller
+	if stallTimeoutFlag > 0 {
+		stalls.setSave(helper.SaveStall)
+		go helper.forwardStallProgress(ctx)
+	}
+
+	return runNodeControllers(ctx, nodeMetadata, helper)
+}
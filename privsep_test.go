@@ -0,0 +1,357 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrivilegedHelperForgedRequests(t *testing.T) {
+	defer func(previousRoot, previousManager string, previousMetadata func(context.Context) (NodeMetadata, error)) {
+		rootDir, serviceManager, privilegedNodeMetadata = previousRoot, previousManager, previousMetadata
+	}(rootDir, serviceManager, privilegedNodeMetadata)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	// The root agent process loads the node metadata itself
+	privilegedNodeMetadata = func(ctx context.Context) (NodeMetadata, error) {
+		return NodeMetadata{RepoURI: "https://repo", AllowedRepoURIs: []string{"https://new"}}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := rpc.NewServer()
+	err := server.Register(&PrivilegedHelper{ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperConn, controllerConn := net.Pipe()
+	go server.ServeConn(helperConn)
+	client := rpc.NewClient(controllerConn)
+	defer client.Close()
+	helper := &privilegedClient{client: client}
+
+	// A repository not allowed by the endpoint is refused, even if the controller skipped the check
+	_, err = helper.PlanComponents(ctx, InstallRequest{RepoURI: "https://attacker.example.com"})
+	if err == nil || !strings.Contains(err.Error(), errRepositoryNotAllowed.Error()) {
+		t.Errorf("expected the plan repository refused, got %v", err)
+	}
+	err = helper.ProcessComponents(ctx, InstallRequest{RepoURI: "https://attacker.example.com"})
+	if err == nil || !strings.Contains(err.Error(), errRepositoryNotAllowed.Error()) {
+		t.Errorf("expected the install repository refused, got %v", err)
+	}
+	err = helper.SwitchRepository(ctx, "https://attacker.example.com")
+	if err == nil || !strings.Contains(err.Error(), errRepositoryNotAllowed.Error()) {
+		t.Errorf("expected the repository switch refused, got %v", err)
+	}
+	_, err = os.Stat(hostPath(repoSwitchFile))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no repository switch saved, got %v", err)
+	}
+
+	// The remote operations policy is enforced by the root agent process
+	_, err = helper.ReinstallComponent(ctx, RemoteOperationRequest{Arg: "kubelet", Source: "annotation", Actor: "kubectl-annotate"})
+	if err == nil || !strings.Contains(err.Error(), "operation reinstall is not allowed") {
+		t.Errorf("expected the reinstall refused, got %v", err)
+	}
+	err = helper.RestartService(ctx, RemoteOperationRequest{Arg: "kubelet", Source: "annotation", Actor: "kubectl-annotate"})
+	if err == nil || !strings.Contains(err.Error(), "operation restart is not allowed") {
+		t.Errorf("expected the restart refused, got %v", err)
+	}
+	err = helper.DecommissionNode(ctx, RemoteOperationRequest{Source: "deletion"})
+	if err == nil || !strings.Contains(err.Error(), "operation decommission is not allowed") {
+		t.Errorf("expected the decommission refused, got %v", err)
+	}
+
+	// The refused operations are recorded by the root agent process, the controller cannot record the
+	// start or the result of a privileged operation
+	for _, entry := range []AuditEntry{
+		{Source: "annotation", Operation: "restart=kubelet", Status: "succeeded"},
+		{Source: "annotation", Operation: "decommission", Status: "started"},
+		{Source: "kubelet 1.31.1", Operation: "script install", Status: "succeeded", Digest: "forged"},
+		{Source: "annotation", Operation: "verify", Status: "unknown"},
+	} {
+		err = helper.RecordAudit(ctx, entry)
+		if err == nil {
+			t.Errorf("expected the audit entry %+v refused", entry)
+		}
+	}
+	err = helper.RecordAudit(ctx, AuditEntry{Time: time.Unix(0, 0), Source: "annotation", Operation: "verify", Status: "started"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(hostPath(auditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []AuditEntry
+	var statuses []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var entry AuditEntry
+		err = json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("invalid audit entry %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+		statuses = append(statuses, entry.Operation+" "+entry.Status+" "+entry.Reporter)
+	}
+	expected := []string{"reinstall=kubelet denied ", "restart=kubelet denied ", "decommission denied ", "verify started controller"}
+	if !slices.Equal(statuses, expected) {
+		t.Errorf("unexpected audit log %q, expected %q", statuses, expected)
+	}
+	if entries[len(entries)-1].Time.Before(time.Now().Add(-time.Minute)) {
+		t.Errorf("expected the time of the reported entry set by the root agent process, got %s", entries[len(entries)-1].Time)
+	}
+
+	// The firewall rules applied are the ones saved by the root agent process, the controller sends none
+	saved := map[string][]FirewallRule{"kubelet": {{Protocol: "tcp", Ports: "10250"}}}
+	err = saveFirewallRules(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = helper.ApplyFirewallRules(ctx)
+	if err != nil {
+		t.Errorf("expected the saved rules applied, got %v", err)
+	}
+	rules, err := loadFirewallRules()
+	if err != nil || len(rules) != 1 || rules["kubelet"][0].Ports != "10250" {
+		t.Errorf("expected the saved rules kept, got %v, %v", rules, err)
+	}
+
+	// The tunnel, network, CNI and image GC settings are the ones of the root agent metadata, the
+	// controller sends none
+	err = os.MkdirAll(hostPath(cniConfDir), 0755)
+	if err == nil {
+		err = os.WriteFile(hostPath(filepath.Join(cniConfDir, "10-calico.conflist")), []byte("{}"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantined, err := helper.ReconcileCNI(ctx)
+	if err != nil || len(quarantined) != 0 {
+		t.Errorf("expected no CNI configuration quarantined without metadata CNI, got %v, %v", quarantined, err)
+	}
+	err = helper.ProcessNetwork(ctx)
+	if err != nil {
+		t.Errorf("expected the metadata without network processed, got %v", err)
+	}
+	_, err = os.Stat(hostPath(networkStateFile("node")))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no network state saved, got %v", err)
+	}
+	err = helper.SetupTunnel(ctx)
+	if err == nil || !strings.Contains(err.Error(), "no tunnel in the node metadata") {
+		t.Errorf("expected the tunnel setup refused without metadata tunnel, got %v", err)
+	}
+}
+
+func TestPrivilegedHelperReleaseNotFound(t *testing.T) {
+	defer func(previousRoot string, previousMetadata func(context.Context) (NodeMetadata, error)) {
+		rootDir, privilegedNodeMetadata = previousRoot, previousMetadata
+	}(rootDir, privilegedNodeMetadata)
+	rootDir = t.TempDir()
+
+	// A repository without release for the pool version
+	repoPath := filepath.Join(t.TempDir(), "repo.zip")
+	file, err := os.Create(repoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	writer, err := archive.Create("releases.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write([]byte("versions:\n  1.31.4:\n  - name: kubelet\n    version: 1.31.4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privilegedNodeMetadata = func(ctx context.Context) (NodeMetadata, error) {
+		return NodeMetadata{RepoURI: "zip://" + repoPath, PoolVersion: "1.31.5"}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := rpc.NewServer()
+	err = server.Register(&PrivilegedHelper{ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperConn, controllerConn := net.Pipe()
+	go server.ServeConn(helperConn)
+	client := rpc.NewClient(controllerConn)
+	defer client.Close()
+	helper := &privilegedClient{client: client}
+
+	// The release not found error keeps its type and its message across the RPC
+	_, err = helper.PlanComponents(ctx, InstallRequest{RepoURI: "zip://" + repoPath})
+	if !errors.Is(err, errReleaseNotFound) || !strings.Contains(err.Error(), "1.31.5 is newer than the latest release 1.31.4") {
+		t.Errorf("expected the release not found error, got %v", err)
+	}
+
+	// The other errors are only carried as messages
+	_, err = helper.PlanComponents(ctx, InstallRequest{RepoURI: "https://attacker.example.com"})
+	if err == nil || errors.Is(err, errReleaseNotFound) {
+		t.Errorf("expected the plan repository refused, got %v", err)
+	}
+}
+
+func TestPrivilegedHelperStalls(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	helper := &PrivilegedHelper{ctx: context.Background(), stallReports: make(chan string, 1)}
+	server := rpc.NewServer()
+	err := server.Register(helper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperConn, controllerConn := net.Pipe()
+	go server.ServeConn(helperConn)
+	client := rpc.NewClient(controllerConn)
+	defer client.Close()
+
+	// The stall of the root agent process is handed to the controller once, with its progress
+	stalls.progress()
+	helper.reportStall("Agent stalled: no install progress for 1h0m0s")
+	var progress StallProgress
+	err = client.Call("PrivilegedHelper.StallProgress", true, &progress)
+	if err != nil || progress.LastProgress == 0 || progress.Stall != "Agent stalled: no install progress for 1h0m0s" {
+		t.Errorf("expected the progress and the stall, got %+v, %v", progress, err)
+	}
+	progress = StallProgress{}
+	err = client.Call("PrivilegedHelper.StallProgress", true, &progress)
+	if err != nil || progress.Stall != "" {
+		t.Errorf("expected the stall reported once, got %+v, %v", progress, err)
+	}
+
+	// The controller stall is saved by the root agent process, bounded
+	var stallPath string
+	err = client.Call("PrivilegedHelper.SaveStall", StallDump{Message: "Agent stalled: no reconcile progress for 1h0m0s", Goroutines: make([]byte, stallDumpMaxSize+1)}, &stallPath)
+	if err != nil {
+		t.Fatalf("failed to save stall: %v", err)
+	}
+	info, err := os.Stat(hostPath(stallPath))
+	if err != nil || info.Size() > stallDumpMaxSize+1024 || filepath.Dir(stallPath) != controllerStallsDir {
+		t.Errorf("expected the bounded stall saved in %s, got %s %v, %v", controllerStallsDir, stallPath, info, err)
+	}
+}
+
+func TestPrivilegedHelperMetadataSecrets(t *testing.T) {
+	defer func(previousMetadata func(context.Context) (NodeMetadata, error)) {
+		privilegedNodeMetadata = previousMetadata
+	}(privilegedNodeMetadata)
+	nodeMetadata := NodeMetadata{ID: "node", Token: "node-token", Tunnel: &Tunnel{PrivateKey: "tunnel-private-key"}}
+	privilegedNodeMetadata = func(ctx context.Context) (NodeMetadata, error) {
+		return nodeMetadata, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	helper := &PrivilegedHelper{ctx: ctx, nodeMetadata: nodeMetadata}
+	server := rpc.NewServer()
+	err := server.Register(helper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperConn, controllerConn := net.Pipe()
+	go server.ServeConn(helperConn)
+	client := &privilegedClient{client: rpc.NewClient(controllerConn)}
+	defer client.client.Close()
+
+	// The tunnel private key never leaves the root agent process, the controller uses the node token
+	for name, load := range map[string]func(context.Context) (NodeMetadata, error){"Metadata": client.Metadata, "LoadNodeMetadata": client.LoadNodeMetadata} {
+		metadata, err := load(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if metadata.Tunnel == nil || metadata.Tunnel.PrivateKey != "" {
+			t.Errorf("%s: expected the tunnel without private key, got %+v", name, metadata.Tunnel)
+		}
+		if metadata.ID != "node" || metadata.Token != "node-token" {
+			t.Errorf("%s: expected the node ID and token, got %q and %q", name, metadata.ID, metadata.Token)
+		}
+	}
+	if helper.nodeMetadata.Tunnel.PrivateKey != "tunnel-private-key" {
+		t.Errorf("expected the root agent metadata unchanged, got %+v", helper.nodeMetadata.Tunnel)
+	}
+}
+
+func TestPrivilegedHelperSavePanic(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := rpc.NewServer()
+	err := server.Register(&PrivilegedHelper{ctx: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	helperConn, controllerConn := net.Pipe()
+	go server.ServeConn(helperConn)
+	client := &privilegedClient{client: rpc.NewClient(controllerConn)}
+	defer client.client.Close()
+
+	// The controller panics are saved in the state directory of the root agent process
+	panicPath, err := client.SavePanic("runtime error: index out of range", []byte("goroutine 1 [running]:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(hostPath(panicPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "panic: controller: runtime error: index out of range\n\ngoroutine 1 [running]:") {
+		t.Errorf("unexpected panic file:\n%s", content)
+	}
+}
+
+func TestPrivilegedHelperArguments(t *testing.T) {
+	// The arguments the controller can send to the root agent process, checked by the calls. The other
+	// calls take no argument, the root agent process uses its own node metadata and saved state.
+	checked := map[string]reflect.Type{
+		"ProcessComponents":         reflect.TypeFor[InstallRequest](),
+		"PlanComponents":            reflect.TypeFor[InstallRequest](),
+		"SyncHolds":                 reflect.TypeFor[map[string]string](),
+		"SwitchRepository":          reflect.TypeFor[string](),
+		"ReinstallComponent":        reflect.TypeFor[RemoteOperationRequest](),
+		"RestartService":            reflect.TypeFor[RemoteOperationRequest](),
+		"DecommissionNode":          reflect.TypeFor[RemoteOperationRequest](),
+		"RecordAudit":               reflect.TypeFor[AuditEntry](),
+		"AuthenticateRemoteRequest": reflect.TypeFor[RemoteAPIRequest](),
+		"SaveStall":                 reflect.TypeFor[StallDump](),
+		"SavePanic":                 reflect.TypeFor[PanicDump](),
+	}
+
+	helperType := reflect.TypeFor[*PrivilegedHelper]()
+	for i := range helperType.NumMethod() {
+		method := helperType.Method(i)
+		argument := method.Type.In(1)
+		expected, ok := checked[method.Name]
+		if !ok {
+			expected = reflect.TypeFor[bool]()
+		}
+		if argument != expected {
+			t.Errorf("%s takes a %s argument, expected %s", method.Name, argument, expected)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+// runScriptWithProgress runs the script command, logging it is still running every progress interval
+// so a long script is not mistaken for a hung install
+func runScriptWithProgress(logger *slog.Logger, cmd *exec.Cmd, script string) error {
+	start := time.Now()
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(repo.ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				logger.Info("Script still running", slog.String("script", script), slog.Duration("elapsed", time.Since(start).Round(time.Second)))
+			}
+		}
+	})
+
+	err = cmd.Wait()
+	close(done)
+	wg.Wait()
+
+	return err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+func TestRunScriptWithProgress(t *testing.T) {
+	defer func(previous time.Duration) { repo.ProgressInterval = previous }(repo.ProgressInterval)
+	repo.ProgressInterval = 10 * time.Millisecond
+
+	var output bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&output, nil))
+
+	err := runScriptWithProgress(logger, exec.Command("/bin/sleep", "0.1"), "sleep 0.1")
+	if err != nil {
+		t.Fatalf("failed to run script: %v", err)
+	}
+	if !strings.Contains(output.String(), `"msg":"Script still running","script":"sleep 0.1"`) {
+		t.Errorf("expected the script progress logs, got %q", output.String())
+	}
+
+	// The script failure is returned
+	err = runScriptWithProgress(logger, exec.Command("/bin/false"), "false")
+	if err == nil {
+		t.Errorf("expected the script failure")
+	}
+}
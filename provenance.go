@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+// ProvenancePolicy is the SLSA provenance policy the component files are verified against before
+// their install, disabled if not set. It is not changed by the metadata ConfigMap since it can be
+// changed from the cluster.
+//
+//	"provenance": {
+//	   "keys": ["-----BEGIN PUBLIC KEY-----\n..."],
+//	   "builders": ["https://github.com/slsa-framework/slsa-github-generator/.github/workflows/generator_generic_slsa3.yml@refs/tags/v2.0.0"],
+//	   "source_repositories": ["git+https://github.com/scaleway/k8s-components"],
+//	   "components": ["containerd", "kubelet"]
+//	}
+type ProvenancePolicy struct {
+	Keys               []string `json:"keys"`                          // PEM public keys (ECDSA or Ed25519) the attestations are signed with
+	Builders           []string `json:"builders"`                      // Builder IDs allowed
+	SourceRepositories []string `json:"source_repositories,omitempty"` // Prefixes of the source URIs allowed, any if not set
+	Components         []string `json:"components,omitempty"`          // Components verified, all if not set
+}
+
+// provenancePath is the path of the attestations of a component version in the component directory,
+// a DSSE envelope of an in-toto statement per line
+const provenancePath = "provenance/{{.Version}}.intoto.jsonl"
+
+const (
+	inTotoPayloadType  = "application/vnd.in-toto+json"
+	slsaProvenanceType = "https://slsa.dev/provenance/v1"
+)
+
+// dsseEnvelope is a signed attestation
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// inTotoStatement is the attestation payload, with the SLSA v1 provenance fields checked by the policy
+type inTotoStatement struct {
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string `json:"predicateType"`
+	Predicate     struct {
+		BuildDefinition struct {
+			ResolvedDependencies []slsaDependency `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+		RunDetails struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+		} `json:"runDetails"`
+	} `json:"predicate"`
+}
+
+type slsaDependency struct {
+	URI string `json:"uri"`
+}
+
+// enforced returns whether the policy applies to the component
+func (p *ProvenancePolicy) enforced(component string) bool {
+	return p != nil && (len(p.Components) == 0 || slices.Contains(p.Components, component))
+}
+
+// attestedFS is the filesystem of a component verified against its provenance, the files are
+// checked against the digest attested for their name when read, so the bytes installed are the bytes
+// verified
+type attestedFS struct {
+	fs.FS
+	attested map[string]string // SHA256 digest by file name
+}
+
+// ReadFile reads the file, it is refused if not attested
+func (f *attestedFS) ReadFile(name string) ([]byte, error) {
+	content, err := fs.ReadFile(f.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(content)
+	if attested, ok := f.attested[name]; !ok || attested != hex.EncodeToString(digest[:]) {
+		return nil, fmt.Errorf("file %s is not attested by the component provenance", name)
+	}
+	return content, nil
+}
+
+// verifyComponentProvenance verifies the SLSA provenance attestations of the component version are
+// signed with a policy key, built by an allowed builder from an allowed source. It returns the
+// component filesystem only reading the attested files: the metadata, the files, the templates and
+// their includes.
+func verifyComponentProvenance(componentFS fs.FS, name, version string, policy *ProvenancePolicy) (fs.FS, error) {
+	if !policy.enforced(name) {
+		return componentFS, nil
+	}
+
+	attestationsPath, err := templateComponentPath(provenancePath, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to template provenance path: %w", err)
+	}
+	attestations, err := fs.ReadFile(componentFS, attestationsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provenance attestations: %w", err)
+	}
+
+	// Collect the digests attested by the valid attestations for the files of the component version
+	attested, err := verifyAttestations(attestations, policy, name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attestedFS{FS: componentFS, attested: attested}, nil
+}
+
+// checkAttestedSources checks the sources of the component files are attested before changing
+// anything, the component filesystem still checks them when they are installed
+func checkAttestedSources(componentFS fs.FS, version string, resources []ComponentResources) error {
+	if _, ok := componentFS.(*attestedFS); !ok {
+		return nil
+	}
+
+	for _, resource := range resources {
+		for _, file := range resource.Files {
+			if !slices.Contains(concurrentFileStates, file.State) {
+				continue
+			}
+			src, err := componentFileSource(componentFS, file, version)
+			if err != nil {
+				return fmt.Errorf("failed to resolve source path: %w", err)
+			}
+			_, err = fs.ReadFile(componentFS, src)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// attestationSubject returns the subject name of a file of the component version, eg:
+// containerd@1.7.22/config.toml, so an attested file is not accepted for another file, component or version
+func attestationSubject(component, version, name string) string {
+	return component + "@" + version + "/" + name
+}
+
+// verifyAttestations verifies the attestations against the policy, and returns the SHA256 digests of
+// their subjects by file name of the component version, the other subjects are ignored. All the
+// attestations must be valid.
+func verifyAttestations(attestations []byte, policy *ProvenancePolicy, component, version string) (map[string]string, error) {
+	keys, err := parseProvenanceKeys(policy.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := attestationSubject(component, version, "")
+	attested := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(attestations))
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		statement, err := verifyAttestation(scanner.Bytes(), keys, policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provenance attestation on line %d: %w", line, err)
+		}
+		for _, subject := range statement.Subject {
+			name, found := strings.CutPrefix(subject.Name, prefix)
+			digest := strings.ToLower(subject.Digest["sha256"])
+			if !found || digest == "" {
+				continue
+			}
+			if previous, ok := attested[name]; ok && previous != digest {
+				return nil, fmt.Errorf("conflicting provenance digests for subject %s", subject.Name)
+			}
+			attested[name] = digest
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provenance attestations: %w", err)
+	}
+	if len(attested) == 0 {
+		return nil, fmt.Errorf("no provenance attestation of %s %s", component, version)
+	}
+
+	return attested, nil
+}
+
+// verifyAttestation verifies the signature of the DSSE envelope and the provenance of its statement
+func verifyAttestation(jsonEnvelope []byte, keys []any, policy *ProvenancePolicy) (inTotoStatement, error) {
+	var envelope dsseEnvelope
+	err := json.Unmarshal(jsonEnvelope, &envelope)
+	if err != nil {
+		return inTotoStatement{}, fmt.Errorf("failed to unmarshal envelope: %w", err)
+	}
+	if envelope.PayloadType != inTotoPayloadType {
+		return inTotoStatement{}, fmt.Errorf("unexpected payload type %q", envelope.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return inTotoStatement{}, fmt.Errorf("failed to decode payload: %w", err)
+	}
+
+	// The envelope must be signed by one of the policy keys
+	signed := false
+	message := dssePAE(envelope.PayloadType, payload)
+	for _, signature := range envelope.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err != nil {
+			continue
+		}
+		if slices.ContainsFunc(keys, func(key any) bool { return verifySignature(key, message, sig) }) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return inTotoStatement{}, fmt.Errorf("no signature from a policy key")
+	}
+
+	var statement inTotoStatement
+	err = json.Unmarshal(payload, &statement)
+	if err != nil {
+		return inTotoStatement{}, fmt.Errorf("failed to unmarshal statement: %w", err)
+	}
+	if statement.PredicateType != slsaProvenanceType {
+		return inTotoStatement{}, fmt.Errorf("unexpected predicate type %q, expected %s", statement.PredicateType, slsaProvenanceType)
+	}
+
+	// The artifacts must be built by an allowed builder, from an allowed source
+	builder := statement.Predicate.RunDetails.Builder.ID
+	if !slices.Contains(policy.Builders, builder) {
+		return inTotoStatement{}, fmt.Errorf("builder %q not allowed", builder)
+	}
+	if len(policy.SourceRepositories) > 0 {
+		allowed := slices.ContainsFunc(statement.Predicate.BuildDefinition.ResolvedDependencies, func(dependency slsaDependency) bool {
+			return slices.ContainsFunc(policy.SourceRepositories, func(repository string) bool {
+				return sourceRepositoryMatch(dependency.URI, repository)
+			})
+		})
+		if !allowed {
+			return inTotoStatement{}, fmt.Errorf("no source from an allowed repository")
+		}
+	}
+
+	return statement, nil
+}
+
+// sourceRepositoryMatch returns whether the source URI is in the repository, with an optional ref
+// or sub-path, eg: git+https://github.com/org/repo@refs/tags/v1 in git+https://github.com/org/repo
+func sourceRepositoryMatch(uri, repository string) bool {
+	repository = strings.TrimSuffix(repository, "/")
+	rest, found := strings.CutPrefix(uri, repository)
+	return found && (rest == "" || rest[0] == '@' || rest[0] == '/')
+}
+
+// dssePAE returns the DSSE pre-authentication encoding of the payload, the message actually signed
+func dssePAE(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+// parseProvenanceKeys parses the PEM public keys of the policy
+func parseProvenanceKeys(pemKeys []string) ([]any, error) {
+	var keys []any
+	for _, pemKey := range pemKeys {
+		block, _ := pem.Decode([]byte(pemKey))
+		if block == nil {
+			return nil, fmt.Errorf("invalid provenance key: no PEM block")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provenance key: %w", err)
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("invalid provenance key: unsupported %T key", key)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no provenance key in the policy")
+	}
+
+	return keys, nil
+}
+
+func verifySignature(key any, message, sig []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, sig)
+	}
+	return false
+}
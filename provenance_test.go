@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+const (
+	testBuilder = "https://github.com/slsa-framework/slsa-github-generator/.github/workflows/generator_generic_slsa3.yml@refs/tags/v2.0.0"
+	testSource  = "git+https://github.com/scaleway/k8s-components"
+)
+
+// signedAttestation returns a DSSE envelope of the SLSA provenance of the contents by subject name
+func signedAttestation(t *testing.T, key ed25519.PrivateKey, builder, source string, contents map[string]string) string {
+	t.Helper()
+
+	statement := map[string]any{
+		"_type":         "https://in-toto.io/Statement/v1",
+		"predicateType": slsaProvenanceType,
+		"predicate": map[string]any{
+			"buildDefinition": map[string]any{"resolvedDependencies": []map[string]any{{"uri": source + "@refs/tags/v1.0.0"}}},
+			"runDetails":      map[string]any{"builder": map[string]any{"id": builder}},
+		},
+	}
+	var subjects []map[string]any
+	for name, content := range contents {
+		digest := sha256.Sum256([]byte(content))
+		subjects = append(subjects, map[string]any{"name": name, "digest": map[string]string{"sha256": hex.EncodeToString(digest[:])}})
+	}
+	statement["subject"] = subjects
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := json.Marshal(map[string]any{
+		"payloadType": inTotoPayloadType,
+		"payload":     base64.StdEncoding.EncodeToString(payload),
+		"signatures":  []map[string]string{{"sig": base64.StdEncoding.EncodeToString(ed25519.Sign(key, dssePAE(inTotoPayloadType, payload)))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(envelope) + "\n"
+}
+
+func TestVerifyComponentProvenance(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &ProvenancePolicy{
+		Keys:               []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+		Builders:           []string{testBuilder},
+		SourceRepositories: []string{testSource},
+	}
+	binary := attestationSubject("containerd", "1.7.22", "1.7.22/containerd")
+	ctr := attestationSubject("containerd", "1.7.22", "1.7.22/ctr")
+	config := attestationSubject("containerd", "1.7.22", "config.toml")
+	resources := []ComponentResources{{Files: []ComponentFile{
+		{State: "file", Src: "{{ .Version }}/containerd", Dst: "/usr/bin/"},
+		{State: "template", Src: "config.toml", Dst: "/etc/containerd/"},
+	}}}
+
+	tests := []struct {
+		name         string
+		policy       *ProvenancePolicy
+		attestations string
+		err          string
+	}{
+		{name: "no policy", attestations: ""},
+		{name: "component not verified", policy: &ProvenancePolicy{Components: []string{"kubelet"}}},
+		{name: "attested", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "containerd binary", ctr: "ctr binary", config: "version = 2"})},
+		{name: "several attestations", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{ctr: "ctr binary", config: "version = 2"}) + "\n" + signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "containerd binary"})},
+		{name: "missing attestations", policy: policy, err: "failed to read provenance attestations"},
+		{name: "other key", policy: policy, attestations: signedAttestation(t, otherKey, testBuilder, testSource, map[string]string{binary: "containerd binary"}), err: "no signature from a policy key"},
+		{name: "other builder", policy: policy, attestations: signedAttestation(t, privateKey, "https://example.com/builder", testSource, map[string]string{binary: "containerd binary"}), err: `builder "https://example.com/builder" not allowed`},
+		{name: "other source", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, "git+https://github.com/example/k8s-components", map[string]string{binary: "containerd binary"}), err: "no source from an allowed repository"},
+		{name: "file not attested", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "patched binary", config: "version = 2"}), err: "file 1.7.22/containerd is not attested"},
+		{name: "template not attested", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "containerd binary"}), err: "file config.toml is not attested"},
+		{name: "one invalid attestation", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "containerd binary"}) + signedAttestation(t, otherKey, testBuilder, testSource, map[string]string{ctr: "ctr binary"}), err: "invalid provenance attestation on line 2"},
+		{name: "attested for another file", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "containerd binary", "containerd@1.7.22/1.7.22/config.toml": "version = 2"}), err: "file config.toml is not attested"},
+		{name: "attested for another version", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{"containerd@1.7.21/1.7.22/containerd": "containerd binary", "containerd@1.7.21/config.toml": "version = 2"}), err: "no provenance attestation of containerd 1.7.22"},
+		{name: "attested for another component", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "containerd binary", "runc@1.7.22/config.toml": "version = 2"}), err: "file config.toml is not attested"},
+		{name: "conflicting digests", policy: policy, attestations: signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "containerd binary"}) + signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{binary: "patched binary"}), err: "conflicting provenance digests for subject containerd@1.7.22/1.7.22/containerd"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			componentFS := fstest.MapFS{
+				"1.7.22/containerd": {Data: []byte("containerd binary")},
+				"config.toml":       {Data: []byte("version = 2")},
+			}
+			if test.attestations != "" {
+				componentFS["provenance/1.7.22.intoto.jsonl"] = &fstest.MapFile{Data: []byte(test.attestations)}
+			}
+
+			verifiedFS, err := verifyComponentProvenance(componentFS, "containerd", "1.7.22", test.policy)
+			if err == nil {
+				err = checkAttestedSources(verifiedFS, "1.7.22", resources)
+			}
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestAttestedFS(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &ProvenancePolicy{
+		Keys:     []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+		Builders: []string{testBuilder},
+	}
+	componentFS := fstest.MapFS{
+		"metadata.yaml":                  {Data: []byte("versions: {}\n")},
+		"1.7.22/containerd":              {Data: []byte("containerd binary")},
+		"provenance/1.7.22.intoto.jsonl": {Data: []byte(signedAttestation(t, privateKey, testBuilder, testSource, map[string]string{attestationSubject("containerd", "1.7.22", "1.7.22/containerd"): "containerd binary"}))},
+	}
+
+	verifiedFS, err := verifyComponentProvenance(componentFS, "containerd", "1.7.22", policy)
+	if err != nil {
+		t.Fatalf("failed to verify provenance: %v", err)
+	}
+
+	// The metadata is not attested
+	_, err = parseComponentFSMetadata(verifiedFS, "containerd")
+	if err == nil || !strings.Contains(err.Error(), "file metadata.yaml is not attested") {
+		t.Errorf("expected the metadata refused, got %v", err)
+	}
+
+	// The file replaced after the verification is refused when installed
+	componentFS["1.7.22/containerd"] = &fstest.MapFile{Data: []byte("patched binary")}
+	_, err = fs.ReadFile(verifiedFS, "1.7.22/containerd")
+	if err == nil || !strings.Contains(err.Error(), "file 1.7.22/containerd is not attested") {
+		t.Errorf("expected the replaced file refused, got %v", err)
+	}
+}
+
+func TestSourceRepositoryMatch(t *testing.T) {
+	tests := []struct {
+		uri        string
+		repository string
+		match      bool
+	}{
+		{uri: testSource, repository: testSource, match: true},
+		{uri: testSource + "@refs/tags/v1.0.0", repository: testSource, match: true},
+		{uri: testSource + "/components/containerd", repository: testSource + "/", match: true},
+		{uri: testSource + "-fork@refs/heads/main", repository: testSource},
+		{uri: "git+https://github.com/example/k8s-components", repository: testSource},
+	}
+	for _, test := range tests {
+		if match := sourceRepositoryMatch(test.uri, test.repository); match != test.match {
+			t.Errorf("sourceRepositoryMatch(%q, %q) = %v, expected %v", test.uri, test.repository, match, test.match)
+		}
+	}
+}
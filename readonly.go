@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// stReadOnly is the statfs flag of the read-only filesystems
+const stReadOnly = 0x1
+
+// statfs returns the filesystem statistics of the path, replaced in tests
+var statfs = syscall.Statfs
+
+// writablePath returns the path redirected to the writable path declared in the node metadata for
+// its read-only parent, eg: on ostree-based images, the path itself if none
+//
+//	"writable_paths": {
+//	   "/usr/bin": "/usr/local/bin",
+//	   "/usr/lib/systemd/system": "/etc/systemd/system"
+//	}
+func (m NodeMetadata) writablePath(path string) string {
+	var prefix string
+	for readOnly := range m.WritablePaths {
+		readOnly = strings.TrimSuffix(readOnly, "/")
+		if (path == readOnly || strings.HasPrefix(path, readOnly+"/")) && len(readOnly) > len(prefix) {
+			prefix = readOnly
+		}
+	}
+	if prefix == "" {
+		return path
+	}
+
+	writable := m.WritablePaths[prefix]
+	if writable == "" {
+		writable = m.WritablePaths[prefix+"/"]
+	}
+	return strings.TrimSuffix(writable, "/") + path[len(prefix):]
+}
+
+// readOnlyFilesystem returns whether the path, or its nearest existing parent, is on a read-only
+// filesystem
+func readOnlyFilesystem(path string) (bool, error) {
+	for {
+		var stat syscall.Statfs_t
+		err := statfs(hostPath(path), &stat)
+		if err == nil {
+			return stat.Flags&stReadOnly != 0, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) || path == "/" {
+			return false, fmt.Errorf("failed to stat filesystem of %s: %w", path, err)
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// checkWritableDestinations checks the destinations of the component files are not on a read-only
+// filesystem before changing anything, the destinations under the component mounts are not checked
+func checkWritableDestinations(name, version string, resources []ComponentResources, nodeMetadata NodeMetadata) error {
+	var (
+		mounts []string
+		errs   []error
+	)
+	for _, resource := range resources {
+		for _, mount := range resource.Mounts {
+			mounts = append(mounts, mount.Where)
+		}
+	}
+
+	for _, resource := range resources {
+	files:
+		for _, file := range resource.Files {
+			dst, err := templateComponentPath(file.Dst, version)
+			if err != nil {
+				return fmt.Errorf("failed to template destination path: %w", err)
+			}
+			dst = nodeMetadata.componentPath(name, destinationPath(file.sourceName(), dst))
+			for _, mount := range mounts {
+				if dst == mount || strings.HasPrefix(dst, strings.TrimSuffix(mount, "/")+"/") {
+					continue files
+				}
+			}
+
+			readOnly, err := readOnlyFilesystem(dst)
+			if err != nil {
+				return err
+			}
+			if readOnly {
+				errs = append(errs, fmt.Errorf("destination %s is on a read-only filesystem, declare a writable path for it in the writable_paths of the node metadata", dst))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWritablePath(t *testing.T) {
+	nodeMetadata := NodeMetadata{WritablePaths: map[string]string{
+		"/usr":                    "/var/usr",
+		"/usr/bin/":               "/usr/local/bin",
+		"/usr/lib/systemd/system": "/etc/systemd/system",
+	}}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/usr/bin/kubelet", "/usr/local/bin/kubelet"},
+		{"/usr/bin/", "/usr/local/bin/"},
+		{"/usr/lib/systemd/system/kubelet.service", "/etc/systemd/system/kubelet.service"},
+		{"/usr/share/doc/kubelet", "/var/usr/share/doc/kubelet"},
+		{"/usr-local/bin/kubelet", "/usr-local/bin/kubelet"},
+		{"/etc/kubernetes/kubelet.conf", "/etc/kubernetes/kubelet.conf"},
+	}
+	for _, test := range tests {
+		path := nodeMetadata.writablePath(test.path)
+		if path != test.expected {
+			t.Errorf("writablePath(%q) = %q, expected %q", test.path, path, test.expected)
+		}
+	}
+}
+
+func TestCheckWritableDestinations(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	// The missing destinations are checked on their nearest existing parent
+	readOnly, err := readOnlyFilesystem("/usr/local/bin/kubelet")
+	if err != nil || readOnly {
+		t.Errorf("readOnlyFilesystem = %v, %v, expected a writable filesystem", readOnly, err)
+	}
+
+	resources := []ComponentResources{{
+		Files: []ComponentFile{
+			{State: "file", Src: "kubelet", Dst: "/usr/bin/"},
+			{State: "directory", Dst: "/var/lib/kubelet"},
+		},
+	}}
+	err = checkWritableDestinations("kubelet", "1.31.2", resources, NodeMetadata{})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckReadOnlyDestinations(t *testing.T) {
+	defer func(previousRoot string, previousStatfs func(string, *syscall.Statfs_t) error) {
+		rootDir, statfs = previousRoot, previousStatfs
+	}(rootDir, statfs)
+	rootDir = t.TempDir()
+
+	// The /usr filesystem is read-only, eg: on an ostree-based image
+	statfs = func(path string, stat *syscall.Statfs_t) error {
+		*stat = syscall.Statfs_t{}
+		if path == filepath.Join(rootDir, "usr") || strings.HasPrefix(path, filepath.Join(rootDir, "usr")+"/") {
+			stat.Flags = stReadOnly
+		}
+		return nil
+	}
+	resources := []ComponentResources{{
+		Files: []ComponentFile{
+			{State: "file", Src: "kubelet", Dst: "/usr/bin/"},
+			{State: "file", Src: "kubelet.service", Dst: "/usr/lib/systemd/system/"},
+			{State: "directory", Dst: "/var/lib/kubelet"},
+			{State: "directory", Dst: "/mnt/kubelet/pods"},
+		},
+		Mounts: []ComponentMount{{What: "/dev/vdb", Where: "/mnt/kubelet"}},
+	}}
+
+	// The read-only destinations are all reported before any change, but the ones under the mounts
+	err := checkWritableDestinations("kubelet", "1.31.2", resources, NodeMetadata{})
+	if err == nil || !strings.Contains(err.Error(), "/usr/bin/kubelet is on a read-only filesystem") || !strings.Contains(err.Error(), "/usr/lib/systemd/system/kubelet.service is on a read-only filesystem") || strings.Contains(err.Error(), "/mnt/kubelet") {
+		t.Errorf("expected the read-only destinations rejected, got %v", err)
+	}
+
+	// The destinations redirected to the writable paths are accepted
+	nodeMetadata := NodeMetadata{WritablePaths: map[string]string{"/usr/bin": "/var/usr/bin", "/usr/lib/systemd/system": "/etc/systemd/system"}}
+	err = checkWritableDestinations("kubelet", "1.31.2", resources, nodeMetadata)
+	if err != nil {
+		t.Errorf("unexpected error with the writable paths: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/validate/content"
+)
+
+// NodeTaint is a taint the kubelet registers the node with
+type NodeTaint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Effect string `json:"effect"`
+}
+
+// kubeletAllowedLabels are the labels of the kubernetes.io and k8s.io namespaces the kubelet is allowed to set
+var kubeletAllowedLabels = []string{
+	"kubernetes.io/hostname",
+	"kubernetes.io/arch",
+	"kubernetes.io/os",
+	"beta.kubernetes.io/arch",
+	"beta.kubernetes.io/os",
+	"beta.kubernetes.io/instance-type",
+	"node.kubernetes.io/instance-type",
+	"failure-domain.beta.kubernetes.io/region",
+	"failure-domain.beta.kubernetes.io/zone",
+	"topology.kubernetes.io/region",
+	"topology.kubernetes.io/zone",
+}
+
+// kubeletAllowedLabelPrefixes are the label namespaces reserved to the kubelet
+var kubeletAllowedLabelPrefixes = []string{"kubelet.kubernetes.io/", "node.kubernetes.io/"}
+
+// Validate checks the taint as the API server would
+func (t NodeTaint) Validate() error {
+	if errs := content.IsLabelKey(t.Key); len(errs) > 0 {
+		return fmt.Errorf("invalid taint key %q: %s", t.Key, strings.Join(errs, ", "))
+	}
+	if errs := content.IsLabelValue(t.Value); len(errs) > 0 {
+		return fmt.Errorf("invalid taint %s value %q: %s", t.Key, t.Value, strings.Join(errs, ", "))
+	}
+	switch corev1.TaintEffect(t.Effect) {
+	case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		return fmt.Errorf("invalid taint %s effect %q: must be NoSchedule, PreferNoSchedule or NoExecute", t.Key, t.Effect)
+	}
+	return nil
+}
+
+// String returns the taint in the kubelet format: key=value:effect
+func (t NodeTaint) String() string {
+	if t.Value == "" {
+		return t.Key + ":" + t.Effect
+	}
+	return t.Key + "=" + t.Value + ":" + t.Effect
+}
+
+// validateNodeLabel checks the label as the API server and the kubelet would
+func validateNodeLabel(key, value string) error {
+	if errs := content.IsLabelKey(key); len(errs) > 0 {
+		return fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, ", "))
+	}
+	if errs := content.IsLabelValue(value); len(errs) > 0 {
+		return fmt.Errorf("invalid label %s value %q: %s", key, value, strings.Join(errs, ", "))
+	}
+
+	// The kubelet refuses to start with the labels of the kubernetes namespaces it is not allowed to set
+	namespace, _, found := strings.Cut(key, "/")
+	if !found || slices.Contains(kubeletAllowedLabels, key) {
+		return nil
+	}
+	if slices.ContainsFunc(kubeletAllowedLabelPrefixes, func(prefix string) bool { return strings.HasPrefix(key, prefix) }) {
+		return nil
+	}
+	if namespace == "kubernetes.io" || namespace == "k8s.io" || strings.HasSuffix(namespace, ".kubernetes.io") || strings.HasSuffix(namespace, ".k8s.io") {
+		return fmt.Errorf("label %s cannot be set by the kubelet", key)
+	}
+
+	return nil
+}
+
+// ValidateRegistration checks the node labels and taints before the kubelet is configured with them
+func (m NodeMetadata) ValidateRegistration() error {
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(m.NodeLabels)) {
+		errs = append(errs, validateNodeLabel(key, m.NodeLabels[key]))
+	}
+	for _, taint := range m.NodeTaints {
+		errs = append(errs, taint.Validate())
+	}
+	return errors.Join(errs...)
+}
+
+// KubeletRegistrationArgs returns the kubelet --node-labels and --register-with-taints arguments,
+// available in templates as {{ .KubeletRegistrationArgs }}
+func (m NodeMetadata) KubeletRegistrationArgs() (string, error) {
+	err := m.ValidateRegistration()
+	if err != nil {
+		return "", err
+	}
+
+	var args []string
+	if len(m.NodeLabels) > 0 {
+		labels := make([]string, 0, len(m.NodeLabels))
+		for _, key := range slices.Sorted(maps.Keys(m.NodeLabels)) {
+			labels = append(labels, key+"="+m.NodeLabels[key])
+		}
+		args = append(args, "--node-labels="+strings.Join(labels, ","))
+	}
+	if len(m.NodeTaints) > 0 {
+		taints := make([]string, 0, len(m.NodeTaints))
+		for _, taint := range m.NodeTaints {
+			taints = append(taints, taint.String())
+		}
+		args = append(args, "--register-with-taints="+strings.Join(taints, ","))
+	}
+
+	return strings.Join(args, " "), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKubeletRegistrationArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata NodeMetadata
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "empty",
+			metadata: NodeMetadata{},
+			expected: "",
+		},
+		{
+			name: "labels and taints",
+			metadata: NodeMetadata{
+				NodeLabels: map[string]string{"k8s.scaleway.com/pool-name": "default", "env": "prod", "node.kubernetes.io/exclude-from-external-load-balancers": ""},
+				NodeTaints: []NodeTaint{{Key: "gpu", Value: "true", Effect: "NoSchedule"}, {Key: "k8s.scaleway.com/dedicated", Effect: "NoExecute"}},
+			},
+			expected: "--node-labels=env=prod,k8s.scaleway.com/pool-name=default,node.kubernetes.io/exclude-from-external-load-balancers= --register-with-taints=gpu=true:NoSchedule,k8s.scaleway.com/dedicated:NoExecute",
+		},
+		{
+			name:     "invalid effect",
+			metadata: NodeMetadata{NodeTaints: []NodeTaint{{Key: "gpu", Effect: "NoScheduling"}}},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid label value",
+			metadata: NodeMetadata{NodeLabels: map[string]string{"env": "prod env"}},
+			wantErr:  true,
+		},
+		{
+			name:     "label reserved to the control plane",
+			metadata: NodeMetadata{NodeLabels: map[string]string{"node-role.kubernetes.io/worker": ""}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.metadata.KubeletRegistrationArgs()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("KubeletRegistrationArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("KubeletRegistrationArgs() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
@@ -1,41 +1,95 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
+	"maps"
 	"slices"
+	"strings"
 
-	"gopkg.in/yaml.v3"
+	"github.com/Masterminds/semver/v3"
 )
 
-// Structs to unmarshal releases.yaml
+// Structs to unmarshal releases.yaml, the versions are the stable channel releases and the other
+// channels define their own releases, eg: release candidates. A channel only defines the versions it
+// overrides, the other versions are resolved from the stable releases.
+//
+//	versions:
+//	  1.31.2: [...]
+//	channels:
+//	  beta:
+//	    1.32.0: [...]
 type Releases struct {
 	Versions map[string][]Component
+	Channels map[string]map[string][]Component
 }
 
+// defaultChannel is the channel of the releases versions
+const defaultChannel = "stable"
+
+// errReleaseNotFound is returned when the repository has no release for the node pool version
+var errReleaseNotFound = errors.New("release not found")
+
+// releaseFallbackFlag is the -release-fallback flag value, the highest lower release of the same minor
+// version is installed when the repository has no release for the node pool version
+var releaseFallbackFlag bool
+
+// maxListedReleases is the number of latest releases listed in the release not found errors
+const maxListedReleases = 10
+
 type Component struct {
 	Name    string
 	Version string
-	Tags    []string
+	Tags    Tags
+	Source  *ComponentSource // Installed from a single file instead of the repository
+}
+
+// ComponentOverride overrides a release component from the node metadata
+//
+//	"component_overrides": {
+//	   "containerd": {"version": "1.7.23"},
+//	   "nvidia-toolkit": {"disabled": true}
+//	}
+type ComponentOverride struct {
+	Version  string           `json:"version,omitempty"`
+	Tags     []string         `json:"tags,omitempty"`
+	Disabled bool             `json:"disabled,omitempty"` // The component is neither installed nor upgraded
+	Source   *ComponentSource `json:"source,omitempty"`   // Install the version from a single file, eg: a hotfix
 }
 
-// releaseComponents reads the releases.yaml file and returns the components for the given node version
-func releaseComponents(repoFS fs.FS, nodemetadata NodeMetadata) ([]Component, error) {
+// releaseComponents reads the releases.yaml file and returns the components for the given node version,
+// with the fallback release installed instead of the node version if any
+func releaseComponents(repoFS fs.FS, nodemetadata NodeMetadata) ([]Component, string, error) {
 	// Read and unmarshal "releases.yaml" file at the root of the repository
 	var releases Releases
 	releasesFile, err := fs.ReadFile(repoFS, "releases.yaml")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read releases file: %w", err)
+		return nil, "", fmt.Errorf("failed to read releases file: %w", err)
 	}
-	err = yaml.Unmarshal(releasesFile, &releases)
+	err = unmarshalStrict(releasesFile, &releases)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal releases file: %w", err)
+		return nil, "", fmt.Errorf("failed to unmarshal releases file: %w", err)
+	}
+	err = validateReleases(releasesFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid releases file: %w", err)
 	}
 
-	// Get the release components for the node version
-	releaseComponents, ok := releases.Versions[nodemetadata.PoolVersion]
-	if !ok {
-		return nil, fmt.Errorf("release %s not found", nodemetadata.PoolVersion)
+	// Get the release components for the node version in the node channel
+	releaseComponents, fallback, err := releases.channelComponents(nodemetadata.Channel, nodemetadata.PoolVersion)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Merge the node component overrides
+	releaseComponents = applyComponentOverrides(releaseComponents, nodemetadata.ComponentOverrides)
+
+	// Select the NVIDIA driver branch of the node
+	releaseComponents, err = applyGPUDriverBranch(releaseComponents, nodemetadata)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid GPU configuration: %w", err)
 	}
 
 	filteredComponents := []Component{}
@@ -44,16 +98,265 @@ func releaseComponents(repoFS fs.FS, nodemetadata NodeMetadata) ([]Component, er
 	if len(nodemetadata.InstallerTags) == 0 {
 		filteredComponents = append(filteredComponents, releaseComponents...)
 	} else {
-		// Otherwise, include only components that match at least one of the installer tags
+		// Otherwise, include only components which tag expressions match the installer tags
 		for _, component := range releaseComponents {
-			for _, tag := range nodemetadata.InstallerTags {
-				if slices.Contains(component.Tags, tag) {
-					filteredComponents = append(filteredComponents, component)
-					break
-				}
+			match, err := component.Tags.Match(nodemetadata.InstallerTags)
+			if err != nil {
+				return nil, "", fmt.Errorf("component %s: %w", component.Name, err)
+			}
+			if match {
+				filteredComponents = append(filteredComponents, component)
 			}
 		}
 	}
 
-	return filteredComponents, nil
+	// Keep the held components at their held version
+	holds, err := loadHolds()
+	if err != nil {
+		return nil, "", err
+	}
+
+	heldComponents, err := applyHolds(repoFS, filteredComponents, holds)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return heldComponents, fallback, nil
+}
+
+// channelComponents resolves the node version within the channel (stable if empty), the stable release
+// is used if the channel does not define the version and an unknown channel fails. The closest release
+// fallback only applies to the stable releases, it also returns the fallback release installed instead
+// of the version, if any.
+func (r Releases) channelComponents(channel, version string) ([]Component, string, error) {
+	if channel != "" && channel != defaultChannel {
+		versions, ok := r.Channels[channel]
+		if !ok {
+			return nil, "", fmt.Errorf("channel %s not found", channel)
+		}
+		if components, ok := versions[version]; ok {
+			slog.Info("Using channel release", slog.String("channel", channel), slog.String("version", version))
+			return components, "", nil
+		}
+		slog.Info("Release not found in channel, using the stable release", slog.String("channel", channel), slog.String("version", version))
+	}
+
+	components, ok := r.Versions[version]
+	if !ok {
+		available := slices.Collect(maps.Keys(r.Versions))
+		closest := closestRelease(version, available)
+		if releaseFallbackFlag && closest != "" {
+			slog.Warn("Release not found, using the closest release", slog.String("version", version), slog.String("release", closest))
+			return r.Versions[closest], closest, nil
+		}
+		return nil, "", releaseNotFoundError(version, available, closest)
+	}
+
+	return components, "", nil
+}
+
+// releaseNotFoundError returns the error of a missing release, telling whether the repository is
+// outdated or the node pool version is wrong, with the closest and the available releases
+func releaseNotFoundError(version string, available []string, closest string) error {
+	sorted := sortReleases(available)
+
+	// The repository is outdated if the version is newer than all the releases
+	cause := "is not in the repository, check the node metadata pool version"
+	parsedVersion, err := semver.NewVersion(version)
+	if err != nil {
+		cause = "is not a valid version, check the node metadata pool version"
+	} else if len(sorted) > 0 {
+		latest, err := semver.NewVersion(sorted[len(sorted)-1])
+		if err == nil && parsedVersion.GreaterThan(latest) {
+			cause = fmt.Sprintf("is newer than the latest release %s, the repository is outdated", sorted[len(sorted)-1])
+		}
+	}
+
+	var details []string
+	if closest != "" {
+		details = append(details, "closest release "+closest)
+	}
+	switch {
+	case len(sorted) == 0:
+		details = append(details, "no release available")
+	case len(sorted) > maxListedReleases:
+		details = append(details, fmt.Sprintf("available releases: %s and %d older", strings.Join(sorted[len(sorted)-maxListedReleases:], ", "), len(sorted)-maxListedReleases))
+	default:
+		details = append(details, "available releases: "+strings.Join(sorted, ", "))
+	}
+
+	return fmt.Errorf("%w: %s %s (%s)", errReleaseNotFound, version, cause, strings.Join(details, ", "))
+}
+
+// sortReleases returns the releases sorted by version, the invalid versions first
+func sortReleases(releases []string) []string {
+	return slices.SortedFunc(slices.Values(releases), func(a, b string) int {
+		parsedA, errA := semver.NewVersion(a)
+		parsedB, errB := semver.NewVersion(b)
+		switch {
+		case errA != nil && errB != nil:
+			return strings.Compare(a, b)
+		case errA != nil:
+			return -1
+		case errB != nil:
+			return 1
+		}
+		return parsedA.Compare(parsedB)
+	})
+}
+
+// closestRelease returns the highest release of the same minor version lower than the version, eg:
+// the previous patch release. A higher release is never returned, the node would run components newer
+// than its pool version. It returns an empty string if there is none.
+func closestRelease(version string, available []string) string {
+	parsedVersion, err := semver.NewVersion(version)
+	if err != nil {
+		return ""
+	}
+
+	var lower *semver.Version
+	var lowerRelease string
+	for _, release := range available {
+		parsed, err := semver.NewVersion(release)
+		if err != nil || parsed.Major() != parsedVersion.Major() || parsed.Minor() != parsedVersion.Minor() {
+			continue
+		}
+		if parsed.LessThan(parsedVersion) && (lower == nil || parsed.GreaterThan(lower)) {
+			lower, lowerRelease = parsed, release
+		}
+	}
+	return lowerRelease
+}
+
+// latestVersion is the release version resolved to the latest version available for the component
+const latestVersion = "latest"
+
+// resolveComponentVersions resolves the wildcard versions (eg: "1.30.x") and "latest" against the
+// versions available in the component metadata. If keepInstalled is set, the installed version is kept
+// as long as it matches, so the components are only upgraded on an upgrade.
+func resolveComponentVersions(repoFS fs.FS, components []Component, keepInstalled bool) ([]Component, error) {
+	resolved := make([]Component, 0, len(components))
+	for _, component := range components {
+		if !isVersionPattern(component.Version) || component.Source != nil {
+			resolved = append(resolved, component)
+			continue
+		}
+
+		if keepInstalled {
+			installedVersion, err := GetComponentVersion(component.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get component version: %w", err)
+			}
+
+			// The installed version is kept verbatim, with its own subversion suffix
+			base, _, _ := strings.Cut(component.Version, "~")
+			_, err = resolveVersion(base, []string{installedVersion})
+			if err == nil {
+				slog.Info("Component version kept", slog.String("component", component.Name), slog.String("pattern", component.Version), slog.String("version", installedVersion))
+				component.Version = installedVersion
+				resolved = append(resolved, component)
+				continue
+			}
+		}
+
+		// Not installed or the installed version does not match anymore, resolve against the component metadata
+		available, err := componentVersions(repoFS, component.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get component %s versions: %w", component.Name, err)
+		}
+		version, err := resolveVersion(component.Version, available)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve component %s version: %w", component.Name, err)
+		}
+
+		slog.Info("Component version resolved", slog.String("component", component.Name), slog.String("pattern", component.Version), slog.String("version", version))
+		component.Version = version
+		resolved = append(resolved, component)
+	}
+
+	return resolved, nil
+}
+
+// isVersionPattern returns true if the version must be resolved
+func isVersionPattern(version string) bool {
+	version = trimVersion(version)
+	return version == latestVersion || strings.HasSuffix(version, ".x") || strings.HasSuffix(version, ".*")
+}
+
+// resolveVersion returns the highest available version matching the pattern, prereleases are never
+// matched. The subversion suffix of the pattern (eg: "1.30.x~2") is kept.
+func resolveVersion(pattern string, available []string) (string, error) {
+	base, suffix, _ := strings.Cut(pattern, "~")
+
+	var constraint *semver.Constraints
+	if base != latestVersion {
+		var err error
+		constraint, err = semver.NewConstraint(base)
+		if err != nil {
+			return "", fmt.Errorf("invalid version pattern %q: %w", pattern, err)
+		}
+	}
+
+	var best *semver.Version
+	bestVersion := ""
+	for _, version := range available {
+		parsed, err := semver.NewVersion(trimVersion(version))
+		if err != nil {
+			// Not a semantic version, it cannot match a pattern
+			continue
+		}
+		if parsed.Prerelease() != "" || (constraint != nil && !constraint.Check(parsed)) {
+			continue
+		}
+		if best == nil || parsed.GreaterThan(best) {
+			best = parsed
+			bestVersion = trimVersion(version)
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no version matching %q", pattern)
+	}
+
+	if suffix != "" {
+		return bestVersion + "~" + suffix, nil
+	}
+	return bestVersion, nil
+}
+
+// applyComponentOverrides merges the overrides over the release components, the overridden components
+// which are not part of the release are added at the end
+func applyComponentOverrides(components []Component, overrides map[string]ComponentOverride) []Component {
+	overridden := make([]Component, 0, len(components))
+	for _, component := range components {
+		override, ok := overrides[component.Name]
+		if !ok {
+			overridden = append(overridden, component)
+			continue
+		}
+		if override.Disabled {
+			slog.Info("Component disabled by override", slog.String("component", component.Name))
+			continue
+		}
+		if override.Version != "" {
+			slog.Info("Component version overridden", slog.String("component", component.Name), slog.String("version", override.Version), slog.String("release_version", component.Version))
+			component.Version = override.Version
+			component.Source = override.Source
+		}
+		if override.Tags != nil {
+			component.Tags = override.Tags
+		}
+		overridden = append(overridden, component)
+	}
+
+	// Add the components which are not part of the release
+	for _, name := range slices.Sorted(maps.Keys(overrides)) {
+		override := overrides[name]
+		if override.Disabled || override.Version == "" || slices.ContainsFunc(components, func(c Component) bool { return c.Name == name }) {
+			continue
+		}
+		slog.Info("Component added by override", slog.String("component", name), slog.String("version", override.Version))
+		overridden = append(overridden, Component{Name: name, Version: override.Version, Tags: override.Tags, Source: override.Source})
+	}
+
+	return overridden
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestApplyComponentOverrides(t *testing.T) {
+	components := []Component{
+		{Name: "containerd", Version: "1.7.22", Tags: []string{"runtime"}},
+		{Name: "kubelet", Version: ""},
+		{Name: "nvidia-toolkit", Version: "1.16.0", Tags: []string{"gpu"}},
+	}
+
+	tests := []struct {
+		name      string
+		overrides map[string]ComponentOverride
+		expected  []Component
+	}{
+		{
+			name:      "no override",
+			overrides: nil,
+			expected:  components,
+		},
+		{
+			name: "version and tags",
+			overrides: map[string]ComponentOverride{
+				"containerd": {Version: "1.7.23"},
+				"kubelet":    {Tags: []string{"node"}},
+			},
+			expected: []Component{
+				{Name: "containerd", Version: "1.7.23", Tags: []string{"runtime"}},
+				{Name: "kubelet", Version: "", Tags: []string{"node"}},
+				{Name: "nvidia-toolkit", Version: "1.16.0", Tags: []string{"gpu"}},
+			},
+		},
+		{
+			name: "disabled and added",
+			overrides: map[string]ComponentOverride{
+				"nvidia-toolkit": {Disabled: true},
+				"crun":           {Version: "1.17"},
+				"missing":        {Tags: []string{"ignored"}},
+			},
+			expected: []Component{
+				{Name: "containerd", Version: "1.7.22", Tags: []string{"runtime"}},
+				{Name: "kubelet", Version: ""},
+				{Name: "crun", Version: "1.17"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := applyComponentOverrides(components, tt.overrides)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("applyComponentOverrides() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+	available := []string{"1.29.9", "1.30.2", "1.30.10", "1.31.0-rc.1", "1.30.4~1", "custom"}
+
+	tests := []struct {
+		name     string
+		pattern  string
+		expected string
+		wantErr  bool
+	}{
+		{name: "patch wildcard", pattern: "1.30.x", expected: "1.30.10"},
+		{name: "minor wildcard", pattern: "1.*", expected: "1.30.10"},
+		{name: "latest skips prereleases", pattern: "latest", expected: "1.30.10"},
+		{name: "subversion suffix kept", pattern: "1.29.x~3", expected: "1.29.9~3"},
+		{name: "no match", pattern: "1.32.x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := resolveVersion(tt.pattern, available)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("resolveVersion() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestChannelComponentsReleaseNotFound(t *testing.T) {
+	defer func(original bool) { releaseFallbackFlag = original }(releaseFallbackFlag)
+	releases := Releases{Versions: map[string][]Component{
+		"1.30.6": {{Name: "kubelet", Version: "1.30.6"}},
+		"1.31.2": {{Name: "kubelet", Version: "1.31.2"}},
+		"1.31.4": {{Name: "kubelet", Version: "1.31.4"}},
+	}}
+
+	tests := []struct {
+		name     string
+		version  string
+		fallback bool
+		expected string
+		err      string
+	}{
+		{name: "found", version: "1.31.2", expected: "1.31.2"},
+		{name: "repository outdated", version: "1.31.5", err: "release not found: 1.31.5 is newer than the latest release 1.31.4, the repository is outdated (closest release 1.31.4, available releases: 1.30.6, 1.31.2, 1.31.4)"},
+		{name: "pool version wrong", version: "1.31.3", err: "1.31.3 is not in the repository, check the node metadata pool version (closest release 1.31.2,"},
+		{name: "no closest release", version: "1.29.1", err: "1.29.1 is not in the repository, check the node metadata pool version (available releases: 1.30.6"},
+		{name: "invalid version", version: "next", err: "next is not a valid version"},
+		{name: "fallback", version: "1.31.5", fallback: true, expected: "1.31.4"},
+		{name: "no lower fallback", version: "1.30.1", fallback: true, err: "1.30.1 is not in the repository, check the node metadata pool version (available releases"},
+		{name: "no compatible fallback", version: "1.32.0", fallback: true, err: "repository is outdated (available releases"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			releaseFallbackFlag = test.fallback
+			components, fallback, err := releases.channelComponents("", test.version)
+			if test.err == "" && (err != nil || len(components) != 1 || components[0].Version != test.expected) {
+				t.Errorf("expected release %s, got %v, %v", test.expected, components, err)
+			}
+			if test.err == "" && test.fallback != (fallback != "") {
+				t.Errorf("expected the fallback %v, got %q", test.fallback, fallback)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err) || !errors.Is(err, errReleaseNotFound)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// The latest releases only are listed
+	for patch := range 15 {
+		releases.Versions[fmt.Sprintf("1.29.%d", patch)] = nil
+	}
+	_, _, err := releases.channelComponents("", "1.32.0")
+	if err == nil || !strings.Contains(err.Error(), "available releases: 1.29.8, 1.29.9, 1.29.10, 1.29.11, 1.29.12, 1.29.13, 1.29.14, 1.30.6, 1.31.2, 1.31.4 and 8 older") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestResolveComponentVersionsKeepInstalled(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+	err := os.MkdirAll(filepath.Join(rootDir, "etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for component, version := range map[string]string{"kubelet": "1.30.2~3", "containerd": "1.6.9"} {
+		err = SetComponentVersion(component, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	repoFS := fstest.MapFS{
+		"kubelet/metadata.yaml":    {Data: []byte("versions:\n  1.30.2: {}\n  1.30.4: {}\n")},
+		"containerd/metadata.yaml": {Data: []byte("versions:\n  1.6.9: {}\n  1.7.22: {}\n")},
+	}
+	components := []Component{{Name: "kubelet", Version: "1.30.x~2"}, {Name: "containerd", Version: "1.7.x"}}
+
+	tests := []struct {
+		name          string
+		keepInstalled bool
+		expected      []string
+	}{
+		// The installed version is kept with its own subversion suffix
+		{name: "keep installed", keepInstalled: true, expected: []string{"1.30.2~3", "1.7.22"}},
+		{name: "upgrade", expected: []string{"1.30.4~2", "1.7.22"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := resolveComponentVersions(repoFS, components, test.keepInstalled)
+			if err != nil {
+				t.Fatalf("failed to resolve versions: %v", err)
+			}
+			var versions []string
+			for _, component := range resolved {
+				versions = append(versions, component.Version)
+			}
+			if !slices.Equal(versions, test.expected) {
+				t.Errorf("versions = %v, expected %v", versions, test.expected)
+			}
+		})
+	}
+}
+
+func TestChannelComponents(t *testing.T) {
+	releases := Releases{
+		Versions: map[string][]Component{
+			"1.31.2": {{Name: "kubelet", Version: "1.31.2"}},
+		},
+		Channels: map[string]map[string][]Component{
+			"beta": {"1.32.0": {{Name: "kubelet", Version: "1.32.0-rc.1"}}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		channel  string
+		version  string
+		expected string
+		err      string
+	}{
+		{name: "stable", version: "1.31.2", expected: "1.31.2"},
+		{name: "explicit stable", channel: "stable", version: "1.31.2", expected: "1.31.2"},
+		{name: "channel release", channel: "beta", version: "1.32.0", expected: "1.32.0-rc.1"},
+		{name: "stable release of channel", channel: "beta", version: "1.31.2", expected: "1.31.2"},
+		{name: "not in stable", version: "1.32.0", err: "release not found"},
+		{name: "not in channel nor stable", channel: "beta", version: "1.31.3", err: "release not found"},
+		{name: "unknown channel", channel: "edge", version: "1.31.2", err: "channel edge not found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			components, fallback, err := releases.channelComponents(test.channel, test.version)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil || len(components) != 1 || components[0].Version != test.expected || fallback != "" {
+				t.Errorf("expected release %s, got %v, %q, %v", test.expected, components, fallback, err)
+			}
+		})
+	}
+}
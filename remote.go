@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Flags of the remote API, the admin API served over TLS to the Scaleway CLI, eg: for
+// `scw k8s node debug`. Disabled if the address is empty.
+var (
+	remoteAPIAddressFlag string
+	remoteAPICertFlag    string
+	remoteAPIKeyFlag     string
+)
+
+// remoteAPITokenHeader is the header of the node token authenticating the remote API requests, as
+// the Scaleway API
+const remoteAPITokenHeader = "X-Auth-Token"
+
+// remoteAPISource is the audit source of the remote API requests
+const remoteAPISource = "remote-api"
+
+// validateRemoteAPIFlags checks the remote API is served over TLS
+func validateRemoteAPIFlags(address, cert, key string) error {
+	if address == "" {
+		return nil
+	}
+	_, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid remote API address %q: %w", address, err)
+	}
+	if cert == "" || key == "" {
+		return fmt.Errorf("the remote API requires -remote-api-cert and -remote-api-key")
+	}
+	return nil
+}
+
+// Limits of the remote API: the failed authentications are throttled per client, eg: the token guesses,
+// so a client cannot lock the others out, and the denied requests recorded in the audit log are bounded,
+// the others are only logged
+const (
+	remoteAPIFailureBurst = 10
+	remoteAPIClients      = 1024
+	remoteAPIDeniedAudit  = 10
+)
+
+// remoteAPIFailureRate is the rate at which a client recovers from its failed authentications
+var remoteAPIFailureRate = rate.Every(time.Second)
+
+// remoteAPITokenRefresh is the interval at which the node token is reloaded, so a rotated token is
+// accepted and the previous one refused
+const remoteAPITokenRefresh = time.Minute
+
+// remoteAPIAddressWait is the interval at which the node internal address to bind is checked
+const remoteAPIAddressWait = 10 * time.Second
+
+// errRemoteAPIDenied is returned by the root agent process for a remote API request without the current
+// node token
+var errRemoteAPIDenied = errors.New("invalid node token")
+
+// RemoteAPIRequest is a remote API request authenticated by the root agent process, which records it in
+// the audit log itself
+type RemoteAPIRequest struct {
+	Operation string
+	Actor     string // Client address
+	Token     string
+	UserAgent string
+}
+
+// RemoteAPIReply is the result of the authentication of a remote API request
+type RemoteAPIReply struct {
+	Denied string
+}
+
+// remoteAPI throttles the failed authentications of the remote API requests per client
+type remoteAPI struct {
+	controller *Controller
+
+	failuresMu sync.Mutex
+	failures   map[string]*rate.Limiter
+}
+
+func newRemoteAPI(c *Controller) *remoteAPI {
+	return &remoteAPI{controller: c, failures: make(map[string]*rate.Limiter)}
+}
+
+// serveRemoteAPI serves the status and the operations of the admin API over TLS until the context is
+// done. The requests are authenticated with the node token and recorded in the audit log. A port-only
+// address binds to the internal address of the node, once reported, instead of all the interfaces.
+func (c *Controller) serveRemoteAPI(ctx context.Context, address, cert, key string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid remote API address %q: %w", address, err)
+	}
+	if host == "" {
+		host, err = c.waitInternalAddress(ctx)
+		if err != nil {
+			return err
+		}
+		address = net.JoinHostPort(host, port)
+	}
+	certificate := &certificateReloader{certFile: cert, keyFile: key, logger: c.logger}
+	_, err = certificate.GetCertificate(nil)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on remote API address: %w", err)
+	}
+
+	api := newRemoteAPI(c)
+	mux := http.NewServeMux()
+	mux.Handle("GET /v1/status", api.authenticate("status", http.HandlerFunc(handleAdminStatus)))
+	mux.Handle("GET /v1/sbom", api.authenticate("sbom", http.HandlerFunc(handleAdminSBOM)))
+	mux.Handle("POST /v1/verify", api.authenticate("verify", http.HandlerFunc(handleAdminVerify)))
+	mux.Handle("POST /v1/upgrade", api.authenticate("upgrade", http.HandlerFunc(handleAdminUpgrade)))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second, TLSConfig: &tls.Config{GetCertificate: certificate.GetCertificate, MinVersion: tls.VersionTLS12}}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		err := server.ServeTLS(listener, "", "")
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.logger.Warn("Remote API server stopped", slog.Any("error", err))
+		}
+	}()
+	c.logger.Info("Serving remote API", slog.String("address", listener.Addr().String()))
+
+	return nil
+}
+
+// waitInternalAddress returns the first internal address of the node, waiting for the kubelet to
+// report it
+func (c *Controller) waitInternalAddress(ctx context.Context) (string, error) {
+	var address string
+	err := wait.PollUntilContextCancel(ctx, remoteAPIAddressWait, true, func(ctx context.Context) (bool, error) {
+		node, err := c.nodesLister.Get(c.nodeName)
+		if err != nil {
+			return false, nil
+		}
+		for _, nodeAddress := range node.Status.Addresses {
+			if nodeAddress.Type == corev1.NodeInternalIP {
+				address = nodeAddress.Address
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to wait for node internal address: %w", err)
+	}
+	return address, nil
+}
+
+// authenticate refuses the requests without the current node token, the token is checked and the request
+// recorded in the audit log by the root agent process. The clients failing to authenticate are throttled.
+func (a *remoteAPI) authenticate(operation string, next http.Handler) http.Handler {
+	c := a.controller
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if !a.clientAllowed(actor) {
+			writeAdminError(w, http.StatusTooManyRequests, fmt.Errorf("too many failed requests"))
+			return
+		}
+
+		request := RemoteAPIRequest{Operation: operation, Actor: actor, Token: r.Header.Get(remoteAPITokenHeader), UserAgent: strings.TrimSpace(r.UserAgent())}
+		err := c.privileged.AuthenticateRemoteRequest(r.Context(), request)
+		if errors.Is(err, errRemoteAPIDenied) {
+			a.recordFailure(actor)
+			c.logger.Warn("Remote API request denied", slog.String("operation", operation), slog.String("actor", actor))
+			writeAdminError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			c.logger.Warn("Failed to authenticate remote API request", slog.String("operation", operation), slog.Any("error", err))
+			writeAdminError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withAuditSource(r.Context(), remoteAPISource)))
+	})
+}
+
+// clientAllowed returns whether the client has not exceeded its failed authentications
+func (a *remoteAPI) clientAllowed(client string) bool {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+	limiter, exists := a.failures[client]
+	return !exists || limiter.Tokens() >= 1
+}
+
+// recordFailure counts a failed authentication of the client, the clients recovered from their failures
+// are forgotten once too many clients are tracked
+func (a *remoteAPI) recordFailure(client string) {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+	limiter, exists := a.failures[client]
+	if !exists {
+		if len(a.failures) >= remoteAPIClients {
+			for address, failures := range a.failures {
+				if failures.Tokens() >= remoteAPIFailureBurst {
+					delete(a.failures, address)
+				}
+			}
+		}
+		limiter = rate.NewLimiter(remoteAPIFailureRate, remoteAPIFailureBurst)
+		a.failures[client] = limiter
+	}
+	limiter.Allow()
+}
+
+// remoteAPIAuth authenticates the remote API requests in the root agent process, so the controller cannot
+// record a remote API request in the audit log without the node token
+type remoteAPIAuth struct {
+	mu           sync.Mutex
+	token        string
+	loadedAt     time.Time
+	deniedAudits *rate.Limiter
+}
+
+var remoteAuth = newRemoteAPIAuth()
+
+func newRemoteAPIAuth() *remoteAPIAuth {
+	return &remoteAPIAuth{deniedAudits: rate.NewLimiter(rate.Every(time.Minute), remoteAPIDeniedAudit)}
+}
+
+// authenticate checks the request has the current node token and records it in the audit log before it
+// is served, the request is refused if it cannot be recorded. The verify is recorded as the remote
+// operation it runs.
+func (a *remoteAPIAuth) authenticate(ctx context.Context, request RemoteAPIRequest) error {
+	nodeToken, err := a.currentToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	audit := AuditEntry{Time: time.Now().UTC(), Source: remoteAPISource, Operation: request.Operation, Actor: request.Actor}
+	if request.Token == "" || subtle.ConstantTimeCompare([]byte(request.Token), []byte(nodeToken)) != 1 {
+		if a.deniedAudits.Allow() {
+			recordAudit(audit, "denied", errRemoteAPIDenied.Error())
+		}
+		return errRemoteAPIDenied
+	}
+	if request.Operation == "verify" {
+		return nil
+	}
+
+	audit.Status = "started"
+	audit.Message = fmt.Sprintf("user agent %s", request.UserAgent)
+	err = appendAudit(audit)
+	if err != nil {
+		return fmt.Errorf("failed to record request in the audit log: %w", err)
+	}
+	return nil
+}
+
+// currentToken returns the node token, reloaded from the node metadata once stale. The previous token
+// is kept if the node metadata cannot be loaded.
+func (a *remoteAPIAuth) currentToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.loadedAt) < remoteAPITokenRefresh {
+		return a.token, nil
+	}
+
+	nodeMetadata, err := privilegedNodeMetadata(ctx)
+	if err != nil {
+		if a.token == "" {
+			return "", fmt.Errorf("failed to load node metadata: %w", err)
+		}
+		slog.Warn("Failed to reload node token", slog.Any("error", err))
+		return a.token, nil
+	}
+	a.token, a.loadedAt = nodeMetadata.Token, time.Now()
+	return a.token, nil
+}
+
+// certificateReloader loads the certificate of the remote API again once its files change, eg: renewed.
+// The previous certificate is kept while the new one cannot be loaded, eg: the key is not written yet.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+}
+
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var modTime time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			if r.certificate == nil {
+				return nil, fmt.Errorf("failed to load remote API certificate: %w", err)
+			}
+			return r.certificate, nil
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.certificate != nil && modTime.Equal(r.modTime) {
+		return r.certificate, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.certificate == nil {
+			return nil, fmt.Errorf("failed to load remote API certificate: %w", err)
+		}
+		r.logger.Warn("Failed to reload remote API certificate", slog.Any("error", err))
+		return r.certificate, nil
+	}
+	if r.certificate != nil {
+		r.logger.Info("Reloaded remote API certificate")
+	}
+	r.certificate, r.modTime = &certificate, modTime
+	return r.certificate, nil
+}
+
+type auditSourceKey struct{}
+
+// withAuditSource sets the audit source of the operations run by the request, admin if not set
+func withAuditSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, auditSourceKey{}, source)
+}
+
+func auditSource(ctx context.Context) string {
+	if source, ok := ctx.Value(auditSourceKey{}).(string); ok {
+		return source
+	}
+	return "admin"
+}
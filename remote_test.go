@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestValidateRemoteAPIFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		cert    string
+		key     string
+		err     string
+	}{
+		{name: "disabled"},
+		{name: "tls", address: ":10260", cert: "cert.pem", key: "key.pem"},
+		{name: "no tls", address: ":10260", err: "requires -remote-api-cert and -remote-api-key"},
+		{name: "invalid address", address: "10260", cert: "cert.pem", key: "key.pem", err: "invalid remote API address"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateRemoteAPIFlags(test.address, test.cert, test.key)
+			if test.err == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// stubRemoteAuth authenticates the remote API requests with the token in the tests
+func stubRemoteAuth(t *testing.T, token *string) {
+	t.Helper()
+	previousRoot, previousMetadata, previousAuth := rootDir, privilegedNodeMetadata, remoteAuth
+	t.Cleanup(func() {
+		rootDir, privilegedNodeMetadata, remoteAuth = previousRoot, previousMetadata, previousAuth
+	})
+	rootDir = t.TempDir()
+	privilegedNodeMetadata = func(ctx context.Context) (NodeMetadata, error) {
+		return NodeMetadata{Token: *token}, nil
+	}
+	remoteAuth = newRemoteAPIAuth()
+}
+
+// readAuditLog returns the entries of the audit log
+func readAuditLog(t *testing.T) []string {
+	t.Helper()
+	file, err := os.Open(hostPath(auditLog))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestAuthenticateRemote(t *testing.T) {
+	token := "secret"
+	stubRemoteAuth(t, &token)
+
+	c := &Controller{nodeName: "node", privileged: localPrivileged{}, logger: slog.Default()}
+	var source string
+	var served int
+	handler := newRemoteAPI(c).authenticate("status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source = auditSource(r.Context())
+		served++
+	}))
+
+	tests := []struct {
+		name   string
+		token  string
+		code   int
+		status string
+	}{
+		{name: "no token", code: http.StatusUnauthorized, status: "denied"},
+		{name: "invalid token", token: "secre", code: http.StatusUnauthorized, status: "denied"},
+		{name: "node token", token: "secret", code: http.StatusOK, status: "started"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/v1/status", nil)
+		req.RemoteAddr = "10.0.0.1:43210"
+		if test.token != "" {
+			req.Header.Set(remoteAPITokenHeader, test.token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.code {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.code, recorder.Code)
+		}
+	}
+	if served != 1 || source != remoteAPISource {
+		t.Errorf("expected the authenticated request served with the %s audit source, got %d requests with %q", remoteAPISource, served, source)
+	}
+
+	// Each request is audited by the root agent process, not reported by the controller
+	lines := readAuditLog(t)
+	if len(lines) != len(tests) {
+		t.Fatalf("expected %d audit entries, got %d", len(tests), len(lines))
+	}
+	for i, test := range tests {
+		for _, expected := range []string{`"source":"remote-api"`, `"operation":"status"`, `"actor":"10.0.0.1"`, `"status":"` + test.status + `"`} {
+			if !strings.Contains(lines[i], expected) {
+				t.Errorf("%s: expected %s in audit entry %s", test.name, expected, lines[i])
+			}
+		}
+		if strings.Contains(lines[i], `"reporter"`) {
+			t.Errorf("%s: expected the entry recorded by the root agent process, got %s", test.name, lines[i])
+		}
+	}
+
+	// The controller cannot report a remote API request
+	err := c.privileged.RecordAudit(context.Background(), AuditEntry{Source: remoteAPISource, Operation: "status", Actor: "10.0.0.2", Status: "started"})
+	if err == nil {
+		t.Error("expected the remote API request reported by the controller refused")
+	}
+
+	// The verify is only audited as the remote operation it runs
+	err = c.privileged.AuthenticateRemoteRequest(context.Background(), RemoteAPIRequest{Operation: "verify", Actor: "10.0.0.1", Token: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lines := readAuditLog(t); len(lines) != len(tests) {
+		t.Errorf("expected the verify request not audited, got %d audit entries", len(lines))
+	}
+}
+
+func TestRemoteAPILimits(t *testing.T) {
+	token := "secret"
+	stubRemoteAuth(t, &token)
+
+	c := &Controller{nodeName: "node", privileged: localPrivileged{}, logger: slog.Default()}
+	handler := newRemoteAPI(c).authenticate("status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(client, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/status", nil)
+		req.RemoteAddr = client + ":43210"
+		req.Header.Set(remoteAPITokenHeader, token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// The rotated token is accepted once reloaded, and the previous one refused
+	if code := request("10.0.0.1", "secret"); code != http.StatusOK {
+		t.Errorf("expected the node token accepted, got %d", code)
+	}
+	token = "rotated"
+	if code := request("10.0.0.1", "secret"); code != http.StatusOK {
+		t.Errorf("expected the cached token accepted, got %d", code)
+	}
+	remoteAuth.loadedAt = time.Now().Add(-remoteAPITokenRefresh)
+	if code := request("10.0.0.1", "secret"); code != http.StatusUnauthorized {
+		t.Errorf("expected the previous token refused, got %d", code)
+	}
+	if code := request("10.0.0.1", "rotated"); code != http.StatusOK {
+		t.Errorf("expected the rotated token accepted, got %d", code)
+	}
+
+	// The token guesses are throttled per client, and only the first denied requests are audited
+	var throttled bool
+	for range 2 * remoteAPIFailureBurst {
+		if request("10.0.0.2", "guess") == http.StatusTooManyRequests {
+			throttled = true
+		}
+	}
+	if !throttled {
+		t.Error("expected the failing client throttled")
+	}
+	if code := request("10.0.0.2", "rotated"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the throttled client refused, got %d", code)
+	}
+	if code := request("10.0.0.1", "rotated"); code != http.StatusOK {
+		t.Errorf("expected the other clients not throttled, got %d", code)
+	}
+	var denied int
+	for _, line := range readAuditLog(t) {
+		if strings.Contains(line, `"status":"denied"`) {
+			denied++
+		}
+	}
+	if denied != remoteAPIDeniedAudit {
+		t.Errorf("expected %d denied requests audited, got %d", remoteAPIDeniedAudit, denied)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate of the host and its key
+func writeTestCertificate(t *testing.T, certFile, keyFile, host string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteAPICertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile, logger: slog.Default()}
+	commonName := func() string {
+		t.Helper()
+		certificate, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Subject.CommonName
+	}
+
+	// The missing certificate is refused on start
+	_, err := reloader.GetCertificate(nil)
+	if err == nil {
+		t.Fatal("expected the missing certificate refused")
+	}
+
+	writeTestCertificate(t, certFile, keyFile, "agent")
+	if name := commonName(); name != "agent" {
+		t.Errorf("expected the agent certificate, got %s", name)
+	}
+
+	// The renewed certificate is served without restarting
+	writeTestCertificate(t, certFile, keyFile, "renewed")
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{certFile, keyFile} {
+		err = os.Chtimes(name, later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name := commonName(); name != "renewed" {
+		t.Errorf("expected the renewed certificate, got %s", name)
+	}
+
+	// The previous certificate is kept while the new one is invalid
+	err = os.WriteFile(keyFile, []byte("partial"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(); name != "renewed" {
+		t.Errorf("expected the previous certificate kept, got %s", name)
+	}
+}
+
+func TestRemoteAPIInternalAddress(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}, Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+		{Type: corev1.NodeExternalIP, Address: "51.15.0.1"},
+		{Type: corev1.NodeInternalIP, Address: "10.0.0.5"},
+	}}}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err := indexer.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Controller{nodeName: "node", nodesLister: corelisters.NewNodeLister(indexer)}
+
+	// A port-only address binds to the internal address, not to all the interfaces
+	address, err := c.waitInternalAddress(context.Background())
+	if err != nil || address != "10.0.0.5" {
+		t.Errorf("expected the internal address, got %q, %v", address, err)
+	}
+}
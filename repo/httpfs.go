@@ -1,48 +1,136 @@
 package repo
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
-// HTTPFS is a fs.FS implementation that reads files from an HTTP server
-// Only the ReadFile method is implemented
+// HTTPFS is a fs.FS implementation that reads files from an HTTP server. HTTP servers do not list
+// directories, so the directories are listed from the optional index file at the root of the repository.
 type httpFS struct {
-	baseURL string
-	client  *http.Client
+	baseURL  string
+	client   *http.Client
+	cacheDir string
+
+	// Context of the requests and of the retries waits, canceled by Cleanup
+	ctx        context.Context
+	cancel     context.CancelFunc
+	retryDelay time.Duration
+
+	indexOnce sync.Once
+	index     map[string][]string // Directories children names, sorted
+	indexErr  error
+
+	// Optional component indexes not found, not requested again
+	missing sync.Map
+
+	statsMu sync.Mutex
+	stats   FetchStats
 }
 
-func NewHTTPFS(baseURL string) *httpFS {
+// indexFile lists the repository files, one path per line, eg: generated with "find . -type f"
+const indexFile = "index.txt"
+
+// componentIndexFile is the optional index of a component, its absence is cached
+const componentIndexFile = "index.yaml"
+
+// NewHTTPFS creates an HTTP repository, manifest files are cached in cacheDir
+// and revalidated with conditional requests (no cache if cacheDir is empty)
+func NewHTTPFS(baseURL string, cacheDir string) *httpFS {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &httpFS{
 		baseURL: strings.TrimSuffix(baseURL, "/"),
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		cacheDir:   cacheDir,
+		ctx:        ctx,
+		cancel:     cancel,
+		retryDelay: downloadRetryDelay,
 	}
 }
 
 func (h *httpFS) Open(name string) (fs.File, error) {
-	return &httpFile{}, nil
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	// Directories are only known from the index
+	if h.isDir(name) {
+		return &httpDir{fs: h, name: name}, nil
+	}
+
+	data, err := h.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpFile{info: httpFileInfo{name: path.Base(name), size: int64(len(data))}, Reader: bytes.NewReader(data)}, nil
 }
 
 func (h *httpFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	if h.isDir(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+
+	return h.download(name)
+}
+
+// download gets the file from the HTTP server, or from the cache if not modified
+func (h *httpFS) download(name string) ([]byte, error) {
 	url := fmt.Sprintf("%s/%s", h.baseURL, name)
+	if _, missing := h.missing.Load(name); missing {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+
+	// Revalidate the cached manifest file if any
+	cached, cacheable := h.readCache(url, name)
 
-	resp, err := h.client.Get(url)
+	start := time.Now()
+	resp, retries, err := h.get(url, cached)
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		err = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		h.recordFetch(url, FileFetch{Name: name, Duration: time.Since(start), Retries: retries, NotModified: true})
+		return cached.Data, nil
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fs.ErrNotExist
+		_ = resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound && path.Base(name) == componentIndexFile {
+			h.missing.Store(name, struct{}{})
+		}
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	data, err := ReadAllWithProgress(resp.Body, name, resp.ContentLength)
 	if err != nil {
+		_ = resp.Body.Close()
 		return nil, err
 	}
 
@@ -50,41 +138,295 @@ func (h *httpFS) ReadFile(name string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	h.recordFetch(url, FileFetch{Name: name, Bytes: int64(len(data)), Duration: time.Since(start), Retries: retries})
+
+	if cacheable {
+		h.writeCache(url, &cachedFile{
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Data:         data,
+		})
+	}
 
 	return data, nil
 }
 
+// downloadAttempts is the number of attempts of a request failing with a network or server error
+const downloadAttempts = 3
+
+// downloadRetryDelay is the delay before the first retry of a request, increased for each retry
+const downloadRetryDelay = time.Second
+
+// get sends the GET request, conditional if the file is cached, and retries the transient errors.
+// It returns the response and the number of retries.
+func (h *httpFS) get(url string, cached *cachedFile) (*http.Response, int, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(h.ctx, "GET", url, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if cached != nil {
+			if cached.ETag != "" {
+				req.Header.Set("If-None-Match", cached.ETag)
+			}
+			if cached.LastModified != "" {
+				req.Header.Set("If-Modified-Since", cached.LastModified)
+			}
+		}
+
+		resp, err := h.client.Do(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, attempt - 1, nil
+		}
+		if err == nil {
+			_ = resp.Body.Close()
+			err = fmt.Errorf("server error: %s", resp.Status)
+		}
+		if attempt == downloadAttempts {
+			return nil, attempt - 1, err
+		}
+
+		slog.Warn("Repository download failed, retrying", slog.String("url", url), slog.Int("attempt", attempt), slog.Any("error", err))
+		select {
+		case <-h.ctx.Done():
+			return nil, attempt - 1, h.ctx.Err()
+		case <-time.After(time.Duration(attempt) * h.retryDelay):
+		}
+	}
+}
+
+// recordFetch adds the download to the statistics, and warns about the slow downloads
+func (h *httpFS) recordFetch(url string, fetch FileFetch) {
+	if fetch.Duration > slowDownloadThreshold {
+		slog.Warn("Slow repository download", slog.String("url", url), slog.Int64("bytes", fetch.Bytes), slog.Duration("duration", fetch.Duration), slog.String("throughput", Throughput(fetch.Bytes, fetch.Duration)), slog.Int("retries", fetch.Retries))
+	}
+
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+	h.stats.add(fetch)
+}
+
+// FetchStats returns the statistics of the files downloaded
+func (h *httpFS) FetchStats() FetchStats {
+	h.statsMu.Lock()
+	defer h.statsMu.Unlock()
+
+	stats := h.stats
+	stats.Mirror = h.baseURL
+	return stats
+}
+
+// cachedFile is a manifest file cached with its validators
+type cachedFile struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Data         []byte `json:"data"`
+}
+
+// cacheableExtensions are the extensions of the small manifest files cached
+var cacheableExtensions = []string{".yaml", ".yml", ".json"}
+
+func (h *httpFS) cachePath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(h.cacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// readCache returns the cached file if any, and if the file can be cached
+func (h *httpFS) readCache(url, name string) (*cachedFile, bool) {
+	if h.cacheDir == "" || !slices.Contains(cacheableExtensions, path.Ext(name)) {
+		return nil, false
+	}
+
+	jsonCached, err := os.ReadFile(h.cachePath(url))
+	if err != nil {
+		return nil, true
+	}
+
+	var cached cachedFile
+	err = json.Unmarshal(jsonCached, &cached)
+	if err != nil {
+		slog.Warn("Ignoring invalid repository cache", slog.String("url", url), slog.Any("error", err))
+		return nil, true
+	}
+
+	return &cached, true
+}
+
+// writeCache caches the file, failing to cache is not an error since the file is downloaded anyway
+func (h *httpFS) writeCache(url string, cached *cachedFile) {
+	if cached.ETag == "" && cached.LastModified == "" {
+		return
+	}
+
+	jsonCached, err := json.Marshal(cached)
+	if err == nil {
+		err = os.MkdirAll(h.cacheDir, 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(h.cachePath(url), jsonCached, 0600)
+	}
+	if err != nil {
+		slog.Warn("Failed to write repository cache", slog.String("url", url), slog.Any("error", err))
+	}
+}
+
 func (h *httpFS) Cleanup() error {
-	// No cleanup needed for HTTPFS
+	// Abort the downloads and their retries
+	h.cancel()
 	return nil
 }
 
-type httpFile struct{}
+// loadIndex reads the index file once, the index is a tree of the directories children
+func (h *httpFS) loadIndex() (map[string][]string, error) {
+	h.indexOnce.Do(func() {
+		data, err := h.download(indexFile)
+		if err != nil {
+			h.indexErr = fmt.Errorf("failed to read repository index: %w", err)
+			return
+		}
 
-func (f *httpFile) Stat() (fs.FileInfo, error) {
-	return &httpFileInfo{}, nil
+		index := map[string][]string{".": nil}
+		for line := range strings.Lines(string(data)) {
+			name := strings.TrimPrefix(strings.TrimSpace(line), "./")
+			if name == "" || !fs.ValidPath(name) {
+				continue
+			}
+
+			// Add the file and its missing parents, the parents of a known entry are known
+			for name != "." && !slices.Contains(index[path.Dir(name)], path.Base(name)) {
+				index[path.Dir(name)] = append(index[path.Dir(name)], path.Base(name))
+				name = path.Dir(name)
+			}
+		}
+		for dir := range index {
+			slices.Sort(index[dir])
+		}
+		h.index = index
+	})
+
+	return h.index, h.indexErr
 }
 
-func (f *httpFile) Read(b []byte) (int, error) {
-	return 0, io.EOF
+// isDir returns true if the index lists the name as a directory, the root is always a directory
+func (h *httpFS) isDir(name string) bool {
+	if name == "." {
+		return true
+	}
+	index, err := h.loadIndex()
+	if err != nil {
+		return false
+	}
+	_, ok := index[name]
+	return ok
+}
+
+// errIsDir is returned when reading a directory
+var errIsDir = errors.New("is a directory")
+
+// httpFile is a file downloaded in memory
+type httpFile struct {
+	*bytes.Reader
+	info httpFileInfo
+}
+
+func (f *httpFile) Stat() (fs.FileInfo, error) {
+	return &f.info, nil
 }
 
 func (f *httpFile) Close() error {
 	return nil
 }
 
-type httpFileInfo struct{}
+// httpDir is a directory listed from the repository index
+type httpDir struct {
+	fs      *httpFS
+	name    string
+	entries []fs.DirEntry
+	offset  int
+	listed  bool
+}
+
+func (d *httpDir) Stat() (fs.FileInfo, error) {
+	return &httpFileInfo{name: path.Base(d.name), dir: true}, nil
+}
+
+func (d *httpDir) Read(b []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errIsDir}
+}
+
+func (d *httpDir) Close() error {
+	return nil
+}
+
+// ReadDir lists the directory from the index, the files size is only known once downloaded
+func (d *httpDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		index, err := d.fs.loadIndex()
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		for _, child := range index[d.name] {
+			d.entries = append(d.entries, &httpDirEntry{fs: d.fs, name: path.Join(d.name, child)})
+		}
+		d.listed = true
+	}
+
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(remaining))
+	d.offset += n
+	return remaining[:n], nil
+}
+
+type httpDirEntry struct {
+	fs   *httpFS
+	name string
+}
+
+func (e *httpDirEntry) Name() string {
+	return path.Base(e.name)
+}
+
+func (e *httpDirEntry) IsDir() bool {
+	return e.fs.isDir(e.name)
+}
+
+func (e *httpDirEntry) Type() fs.FileMode {
+	if e.IsDir() {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+func (e *httpDirEntry) Info() (fs.FileInfo, error) {
+	return fs.Stat(e.fs, e.name)
+}
+
+type httpFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
 
 func (fi *httpFileInfo) Name() string {
-	return ""
+	return fi.name
 }
 
 func (fi *httpFileInfo) Size() int64 {
-	return 0
+	return fi.size
 }
 
 func (fi *httpFileInfo) Mode() fs.FileMode {
-	return 0
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
 }
 
 func (fi *httpFileInfo) ModTime() time.Time {
@@ -92,9 +434,13 @@ func (fi *httpFileInfo) ModTime() time.Time {
 }
 
 func (fi *httpFileInfo) IsDir() bool {
-	return false
+	return fi.dir
 }
 
 func (fi *httpFileInfo) Sys() interface{} {
 	return nil
 }
+
+func (fi *httpFileInfo) String() string {
+	return fs.FormatFileInfo(fi)
+}
@@ -0,0 +1,72 @@
+package repo
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProgressInterval is the interval between two progress logs of a long download, the downloads
+// shorter than the interval are not logged
+var ProgressInterval = 5 * time.Second
+
+// OnProgress is called on each read of a download making progress, eg: so a slow download is not
+// mistaken for a stalled install
+var OnProgress = func() {}
+
+// progressReader counts the bytes of a download while it is read
+type progressReader struct {
+	reader io.Reader
+	read   atomic.Int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		p.read.Add(int64(n))
+		OnProgress()
+	}
+	return n, err
+}
+
+// ReadAllWithProgress reads the download until EOF and logs its progress every ProgressInterval, also
+// while nothing is received so a stalled download is logged. total is the expected size (eg: the
+// Content-Length), unknown if negative.
+func ReadAllWithProgress(reader io.Reader, name string, total int64) ([]byte, error) {
+	progress := &progressReader{reader: reader}
+	start := time.Now()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				read := progress.read.Load()
+				elapsed := time.Since(start)
+				attrs := []any{
+					slog.String("file", name),
+					slog.Int64("bytes", read),
+					slog.String("throughput", Throughput(read, elapsed)),
+					slog.Duration("elapsed", elapsed.Round(time.Second)),
+				}
+				if total > 0 {
+					attrs = append(attrs, slog.Int64("total_bytes", total), slog.Int64("percent", read*100/total))
+				}
+				slog.Info("Download in progress", attrs...)
+			}
+		}
+	})
+
+	data, err := io.ReadAll(progress)
+	close(done)
+	wg.Wait()
+
+	return data, err
+}
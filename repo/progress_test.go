@@ -0,0 +1,72 @@
+package repo
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReader(t *testing.T) {
+	defer func(previous time.Duration) { ProgressInterval = previous }(ProgressInterval)
+	defer slog.SetDefault(slog.Default())
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		total    int64
+		logs     []string
+	}{
+		{
+			name:     "short download",
+			interval: time.Hour,
+			total:    8,
+		},
+		{
+			name:     "known size",
+			interval: time.Millisecond,
+			total:    8,
+			logs:     []string{"Download in progress", `"total_bytes":8`, `"percent":`},
+		},
+		{
+			name:     "unknown size",
+			interval: time.Millisecond,
+			total:    -1,
+			logs:     []string{"Download in progress", `"bytes":`},
+		},
+	}
+	for _, test := range tests {
+		ProgressInterval = test.interval
+		var output bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewJSONHandler(&output, nil)))
+
+		// The content is passed through unchanged, the progress is logged while the download stalls
+		reader, writer := io.Pipe()
+		go func() {
+			_, _ = writer.Write([]byte("1234"))
+			time.Sleep(20 * time.Millisecond)
+			_, _ = writer.Write([]byte("5678"))
+			_ = writer.Close()
+		}()
+		content, err := ReadAllWithProgress(reader, "file", test.total)
+		if err != nil || string(content) != "12345678" {
+			t.Errorf("%s: content = %q, %v", test.name, content, err)
+		}
+		if len(test.logs) == 0 && output.Len() != 0 {
+			t.Errorf("%s: unexpected progress logs %q", test.name, output.String())
+		}
+		for _, log := range test.logs {
+			if !strings.Contains(output.String(), log) {
+				t.Errorf("%s: expected %s in the progress logs %q", test.name, log, output.String())
+			}
+		}
+		if len(test.logs) > 0 && !strings.Contains(output.String(), `"bytes":4`) {
+			t.Errorf("%s: expected the stalled download logged in %q", test.name, output.String())
+		}
+		if test.total < 0 && strings.Contains(output.String(), "total_bytes") {
+			t.Errorf("%s: unexpected total in the progress logs %q", test.name, output.String())
+		}
+	}
+}
@@ -11,10 +11,13 @@ import (
 type RepoFS interface {
 	fs.FS
 	Cleanup() error
+
+	// FetchStats returns the statistics of the files downloaded from the repository
+	FetchStats() FetchStats
 }
 
-// NewRepoFS opens a repository based on the URI scheme
-func NewRepoFS(uri string) (RepoFS, error) {
+// NewRepoFS opens a repository based on the URI scheme, cacheDir is used to cache the HTTP repositories manifest files
+func NewRepoFS(uri string, cacheDir string) (RepoFS, error) {
 	// Split repositories (support for multiple URIs is not yet implemented)
 	repos := strings.Split(uri, ",")
 	if len(repos) == 0 {
@@ -25,7 +28,7 @@ func NewRepoFS(uri string) (RepoFS, error) {
 		switch {
 		case strings.HasPrefix(repo, "http://"), strings.HasPrefix(repo, "https://"):
 			slog.Info("Using repository", slog.String("repo", repo))
-			return NewHTTPFS(repo), nil
+			return NewHTTPFS(repo, cacheDir), nil
 		case strings.HasPrefix(repo, "zip://"):
 			// zip package already implement fs.FS interface
 			path := strings.TrimPrefix(repo, "zip://")
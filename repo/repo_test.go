@@ -0,0 +1,250 @@
+package repo
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// testFiles is a minimal repository
+var testFiles = map[string]string{
+	"releases.yaml":                  "versions: {}\n",
+	"containerd/metadata.yaml":       "versions: {}\n",
+	"containerd/1.7.23/config.toml":  "version = 2\n",
+	"kubelet/metadata.yaml":          "versions: {}\n",
+	"kubelet/1.31.2/kubelet.service": "[Service]\n",
+}
+
+func TestZipFS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repo.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := zip.NewWriter(file)
+	for name, content := range testFiles {
+		w, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repoFS, err := NewRepoFS("zip://"+path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = repoFS.Cleanup() }()
+
+	err = fstest.TestFS(repoFS, "releases.yaml", "containerd/1.7.23/config.toml", "kubelet/metadata.yaml")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHTTPFS(t *testing.T) {
+	files := map[string]string{indexFile: ""}
+	for name, content := range testFiles {
+		files[name] = content
+		files[indexFile] += "./" + name + "\n"
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path[1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	repoFS, err := NewRepoFS(server.URL, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fstest.TestFS(repoFS, "releases.yaml", "containerd/1.7.23/config.toml", "kubelet/metadata.yaml")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHTTPFSFetchStats(t *testing.T) {
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/releases.yaml" && failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		content, ok := testFiles[r.URL.Path[1:]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	repoFS := NewHTTPFS(server.URL, "")
+	repoFS.retryDelay = 100 * time.Millisecond
+	for _, name := range []string{"releases.yaml", "containerd/1.7.23/config.toml"} {
+		_, err := repoFS.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := repoFS.FetchStats()
+	wantBytes := int64(len(testFiles["releases.yaml"]) + len(testFiles["containerd/1.7.23/config.toml"]))
+	if stats.Mirror != server.URL || stats.Files != 2 || stats.Bytes != wantBytes || stats.Retries != 1 {
+		t.Errorf("unexpected fetch stats: %s", stats)
+	}
+	if stats.Slowest == nil || stats.Slowest.Name != "releases.yaml" {
+		t.Errorf("slowest fetch = %+v, want releases.yaml", stats.Slowest)
+	}
+}
+
+func TestHTTPFSCleanupRetries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// The cleanup of the repository aborts the retries waits
+	repoFS := NewHTTPFS(server.URL, "")
+	repoFS.retryDelay = time.Hour
+	time.AfterFunc(100*time.Millisecond, func() { _ = repoFS.Cleanup() })
+	_, err := repoFS.ReadFile("releases.yaml")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the retries canceled, got %v", err)
+	}
+}
+
+func TestHTTPFSCache(t *testing.T) {
+	type servedFile struct {
+		content      string
+		etag         string
+		lastModified string
+	}
+	files := map[string]*servedFile{
+		"releases.yaml":          {content: "versions: {}\n", etag: `"v1"`},
+		"kubelet/metadata.yaml":  {content: "versions: {}\n", lastModified: "Mon, 12 Oct 2026 10:00:00 GMT"},
+		"kubelet/1.31.2/kubelet": {content: "kubelet binary", etag: `"bin"`},
+	}
+	conditional := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[1:]
+		file, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		conditional[name] = r.Header.Get("If-None-Match") + r.Header.Get("If-Modified-Since")
+		if file.etag != "" {
+			w.Header().Set("ETag", file.etag)
+		}
+		if file.lastModified != "" {
+			w.Header().Set("Last-Modified", file.lastModified)
+		}
+		if (file.etag != "" && r.Header.Get("If-None-Match") == file.etag) || (file.lastModified != "" && r.Header.Get("If-Modified-Since") == file.lastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte(file.content))
+	}))
+	defer server.Close()
+	cacheDir := t.TempDir()
+
+	// readAll reads the files with a new repository, as after an agent restart
+	readAll := func() {
+		t.Helper()
+		clear(conditional)
+		repoFS := NewHTTPFS(server.URL, cacheDir)
+		for name, file := range files {
+			content, err := repoFS.ReadFile(name)
+			if err != nil || string(content) != file.content {
+				t.Fatalf("expected %s %q, got %q, %v", name, file.content, content, err)
+			}
+		}
+	}
+
+	// Cache miss: the manifest files are downloaded and cached
+	readAll()
+	if conditional["releases.yaml"] != "" || conditional["kubelet/metadata.yaml"] != "" {
+		t.Errorf("expected unconditional requests, got %v", conditional)
+	}
+
+	// The cached manifest files are revalidated and reused, the other files are not cached
+	readAll()
+	if conditional["releases.yaml"] != `"v1"` || conditional["kubelet/metadata.yaml"] != "Mon, 12 Oct 2026 10:00:00 GMT" {
+		t.Errorf("expected the manifest files revalidated, got %v", conditional)
+	}
+	if conditional["kubelet/1.31.2/kubelet"] != "" {
+		t.Errorf("expected the binary not cached, got %q", conditional["kubelet/1.31.2/kubelet"])
+	}
+
+	// A modified file is downloaded again and its cache updated
+	files["releases.yaml"].content, files["releases.yaml"].etag = "versions:\n  1.31.2: []\n", `"v2"`
+	readAll()
+	if conditional["releases.yaml"] != `"v1"` {
+		t.Errorf("expected the modified file downloaded, got %v", conditional)
+	}
+	readAll()
+	if conditional["releases.yaml"] != `"v2"` {
+		t.Errorf("expected the modified file cached, got %v", conditional)
+	}
+
+	// An invalid cache is ignored
+	repoFS := NewHTTPFS(server.URL, cacheDir)
+	err := os.WriteFile(repoFS.cachePath(server.URL+"/releases.yaml"), []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAll()
+	if conditional["releases.yaml"] != "" {
+		t.Errorf("expected the invalid cache ignored, got %v", conditional)
+	}
+}
+
+func TestHTTPFSMissingFile(t *testing.T) {
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	// The missing component indexes are requested once, the other files each time, eg: published later
+	repoFS := NewHTTPFS(server.URL, "")
+	for range 3 {
+		for _, name := range []string{"kubelet/index.yaml", "kubelet/1.31.2/metadata.yaml"} {
+			_, err := repoFS.ReadFile(name)
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("expected a not exist error, got %v", err)
+			}
+		}
+	}
+	if requests["/kubelet/index.yaml"] != 1 || requests["/kubelet/1.31.2/metadata.yaml"] != 3 {
+		t.Errorf("unexpected requests %v", requests)
+	}
+}
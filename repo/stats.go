@@ -0,0 +1,59 @@
+package repo
+
+import (
+	"fmt"
+	"time"
+)
+
+// slowDownloadThreshold is the download duration after which a warning is logged
+const slowDownloadThreshold = 5 * time.Second
+
+// FileFetch is the download of a single repository file
+type FileFetch struct {
+	Name        string        `json:"name"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration"`
+	Retries     int           `json:"retries,omitempty"`
+	NotModified bool          `json:"not_modified,omitempty"` // Served from the cache after revalidation
+}
+
+// FetchStats summarizes the repository files downloads, to diagnose the slow installs
+type FetchStats struct {
+	Mirror   string        `json:"mirror"` // Repository the files were downloaded from
+	Files    int           `json:"files"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+	Retries  int           `json:"retries"`
+	Cached   int           `json:"cached"`
+	Slowest  *FileFetch    `json:"slowest,omitempty"`
+}
+
+func (s *FetchStats) add(fetch FileFetch) {
+	s.Files++
+	s.Bytes += fetch.Bytes
+	s.Duration += fetch.Duration
+	s.Retries += fetch.Retries
+	if fetch.NotModified {
+		s.Cached++
+	}
+	if s.Slowest == nil || fetch.Duration > s.Slowest.Duration {
+		s.Slowest = &fetch
+	}
+}
+
+// String returns a compact summary, eg: for a node annotation
+func (s FetchStats) String() string {
+	summary := fmt.Sprintf("mirror=%s files=%d bytes=%d duration=%s retries=%d cached=%d", s.Mirror, s.Files, s.Bytes, s.Duration.Round(time.Millisecond), s.Retries, s.Cached)
+	if s.Slowest != nil {
+		summary += fmt.Sprintf(" slowest=%s (%s, %s)", s.Slowest.Name, s.Slowest.Duration.Round(time.Millisecond), Throughput(s.Slowest.Bytes, s.Slowest.Duration))
+	}
+	return summary
+}
+
+// Throughput formats the download throughput in KiB/s
+func Throughput(bytes int64, duration time.Duration) string {
+	if duration <= 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.1fKiB/s", float64(bytes)/1024/duration.Seconds())
+}
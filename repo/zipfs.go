@@ -6,6 +6,7 @@ import (
 	"os"
 )
 
+// ZipFS is a repository in a zip archive, the archive/zip reader implements the fs.FS directories
 type ZipFS struct {
 	*zip.ReadCloser
 	path string
@@ -36,3 +37,8 @@ func (z *ZipFS) Cleanup() error {
 
 	return nil
 }
+
+// FetchStats returns empty statistics, the files are read from the local archive
+func (z *ZipFS) FetchStats() FetchStats {
+	return FetchStats{Mirror: "zip://" + z.path}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+// repoURIAnnotation is set by the control plane with the repository to switch to on the next upgrade,
+// eg: to migrate the nodes from the legacy HTTP repository
+var repoURIAnnotation = defaultAnnotationPrefix + "repo-uri"
+
+// The repository switched to is saved once the upgrade succeeded, so it is also used when the agent
+// installs the components at boot. It replaces the metadata repository until the metadata changes.
+//
+//	{
+//	   "from": "https://legacy-repo.example.com",
+//	   "to": "https://new-repo.example.com"
+//	}
+type repoSwitch struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+var repoSwitchFile = filepath.Join(stateDir, "repo-switch.json")
+
+// componentReposFile records the repository each component was installed from, since the installed
+// version of a component may not be in the repository switched to
+var componentReposFile = filepath.Join(stateDir, "component-repos.json")
+
+// errRepositoryNotAllowed is returned for a repository the node metadata endpoint does not allow
+var errRepositoryNotAllowed = errors.New("repository not allowed")
+
+// checkRepoURI returns an error unless the repository is the metadata repository or one of the
+// repositories allowed by the node metadata endpoint, since the cluster must not make the agent
+// install components from any repository
+func (m NodeMetadata) checkRepoURI(uri string) error {
+	if uri == m.RepoURI || slices.Contains(m.AllowedRepoURIs, uri) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not in the allowed repositories of the node metadata", errRepositoryNotAllowed, uri)
+}
+
+func loadRepoSwitch() (*repoSwitch, error) {
+	jsonSwitch, err := os.ReadFile(hostPath(repoSwitchFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository switch: %w", err)
+	}
+
+	var repoSwitch repoSwitch
+	err = json.Unmarshal(jsonSwitch, &repoSwitch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal repository switch: %w", err)
+	}
+
+	return &repoSwitch, nil
+}
+
+// applyRepoSwitch replaces the metadata repository by the repository switched to, the switch is
+// ignored once the metadata repository changed
+func applyRepoSwitch(metadata *NodeMetadata) error {
+	repoSwitch, err := loadRepoSwitch()
+	if err != nil {
+		return err
+	}
+	if repoSwitch == nil || repoSwitch.From != metadata.RepoURI {
+		return nil
+	}
+
+	// The repository may not be allowed anymore by the node metadata endpoint
+	err = metadata.checkRepoURI(repoSwitch.To)
+	if err != nil {
+		slog.Warn("Repository switch ignored", slog.Any("error", err))
+		return nil
+	}
+
+	metadata.RepoURI = repoSwitch.To
+	slog.Debug("Node metadata source applied", slog.String("source", repoSwitchFile))
+	return nil
+}
+
+// saveRepoSwitch saves the switch from the current repository, which may already be a switched one
+func saveRepoSwitch(current, to string) error {
+	from := current
+	previous, err := loadRepoSwitch()
+	if err != nil {
+		return err
+	}
+	if previous != nil && previous.To == current {
+		from = previous.From
+	}
+
+	jsonSwitch, err := json.Marshal(repoSwitch{From: from, To: to})
+	if err != nil {
+		return fmt.Errorf("failed to marshal repository switch: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = os.WriteFile(hostPath(repoSwitchFile), jsonSwitch, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write repository switch: %w", err)
+	}
+
+	return nil
+}
+
+func loadComponentRepos() (map[string]string, error) {
+	componentRepos := make(map[string]string)
+
+	jsonRepos, err := os.ReadFile(hostPath(componentReposFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return componentRepos, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read component repositories: %w", err)
+	}
+
+	err = json.Unmarshal(jsonRepos, &componentRepos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal component repositories: %w", err)
+	}
+
+	return componentRepos, nil
+}
+
+// componentReposMu serializes the updates of the component repositories, the components may be
+// installed concurrently
+var componentReposMu sync.Mutex
+
+// recordComponentRepo records the repository the component was installed from
+func recordComponentRepo(name, repoURI string) error {
+	componentReposMu.Lock()
+	defer componentReposMu.Unlock()
+
+	componentRepos, err := loadComponentRepos()
+	if err != nil {
+		return err
+	}
+	if componentRepos[name] == repoURI {
+		return nil
+	}
+	componentRepos[name] = repoURI
+
+	jsonRepos, err := json.Marshal(componentRepos)
+	if err != nil {
+		return fmt.Errorf("failed to marshal component repositories: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = os.WriteFile(hostPath(componentReposFile), jsonRepos, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write component repositories: %w", err)
+	}
+
+	return nil
+}
+
+// installedComponentMetadata returns the metadata of the installed version of the component, and the
+// filesystem of the component directory. The component is read from the repository it was installed
+// from, or from the current repository if it is not available anymore. Its uninstall runs as root, so
+// its provenance is verified with the policy of the node metadata, from either repository.
+func installedComponentMetadata(repoFS fs.FS, nodemetadata NodeMetadata, name, version string) (ComponentSections, fs.FS, error) {
+	componentRepos, err := loadComponentRepos()
+	if err != nil {
+		return ComponentSections{}, nil, err
+	}
+
+	// The source file of a component installed from a source is replaced by the next install
+	if strings.HasPrefix(componentRepos[name], sourceRepoPrefix) {
+		return ComponentSections{}, nil, nil
+	}
+
+	if installedURI := componentRepos[name]; installedURI != "" && installedURI != nodemetadata.RepoURI {
+		sections, componentFS, err := openInstalledComponent(installedURI, name, version, nodemetadata.Provenance)
+		if err == nil {
+			return sections, componentFS, nil
+		}
+		slog.Warn("Failed to read the component from the repository it was installed from, using the current repository",
+			slog.String("component", name), slog.String("repo", installedURI), slog.Any("error", err))
+	}
+
+	return openVerifiedComponent(repoFS, name, version, nodemetadata.Provenance)
+}
+
+// openInstalledComponent reads the component from a previous repository, the repository is not cleaned up
+// since a local archive is removed on cleanup
+func openInstalledComponent(repoURI, name, version string, provenance *ProvenancePolicy) (ComponentSections, fs.FS, error) {
+	installedFS, err := repo.NewRepoFS(repoURI, hostPath(repoCacheDir))
+	if err != nil {
+		return ComponentSections{}, nil, err
+	}
+
+	return openVerifiedComponent(installedFS, name, version, provenance)
+}
+
+// openVerifiedComponent returns the metadata of the component version and the filesystem of the
+// component directory, once its provenance is verified
+func openVerifiedComponent(repoFS fs.FS, name, version string, provenance *ProvenancePolicy) (ComponentSections, fs.FS, error) {
+	componentFS, err := openComponentFS(repoFS, name)
+	if err != nil {
+		return ComponentSections{}, nil, err
+	}
+	componentFS, err = verifyComponentProvenance(componentFS, name, version, provenance)
+	if err != nil {
+		return ComponentSections{}, nil, fmt.Errorf("failed to verify component %s provenance: %w", name, err)
+	}
+	sections, err := componentFSMetadata(componentFS, name, version)
+	if err != nil {
+		return ComponentSections{}, nil, fmt.Errorf("failed to read component metadata: %w", err)
+	}
+
+	return sections, componentFS, nil
+}
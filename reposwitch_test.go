@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRepoSwitch(t *testing.T) {
+	defer func(previous string) { rootDir = previous }(rootDir)
+	rootDir = t.TempDir()
+
+	steps := []struct {
+		current     string // Repository of the loaded metadata, switched or not
+		to          string // Repository switched to, none if empty
+		metadataURI string // Repository of the metadata sources
+		wantURI     string
+	}{
+		{metadataURI: "https://legacy", wantURI: "https://legacy"},
+		{current: "https://legacy", to: "https://new", metadataURI: "https://legacy", wantURI: "https://new"},
+		{current: "https://new", to: "https://newer", metadataURI: "https://legacy", wantURI: "https://newer"},
+		{metadataURI: "https://metadata", wantURI: "https://metadata"},
+	}
+
+	for i, step := range steps {
+		if step.to != "" {
+			err := saveRepoSwitch(step.current, step.to)
+			if err != nil {
+				t.Fatalf("step %d: failed to save repository switch: %v", i, err)
+			}
+		}
+
+		metadata := NodeMetadata{RepoURI: step.metadataURI, AllowedRepoURIs: []string{"https://new", "https://newer"}}
+		err := applyRepoSwitch(&metadata)
+		if err != nil {
+			t.Fatalf("step %d: failed to apply repository switch: %v", i, err)
+		}
+		if metadata.RepoURI != step.wantURI {
+			t.Errorf("step %d: repository = %s, want %s", i, metadata.RepoURI, step.wantURI)
+		}
+	}
+}
+
+func TestRepoSwitchNotAllowed(t *testing.T) {
+	defer func(previous string) { rootDir = previous }(rootDir)
+	rootDir = t.TempDir()
+
+	metadata := NodeMetadata{RepoURI: "https://legacy", AllowedRepoURIs: []string{"https://new"}}
+	tests := []struct {
+		uri     string
+		allowed bool
+	}{
+		{uri: "https://legacy", allowed: true},
+		{uri: "https://new", allowed: true},
+		{uri: "https://attacker.example.com"},
+		{uri: "https://new/"},
+	}
+	for _, test := range tests {
+		err := metadata.checkRepoURI(test.uri)
+		if test.allowed && err != nil {
+			t.Errorf("expected %s allowed, got %v", test.uri, err)
+		}
+		if !test.allowed && !errors.Is(err, errRepositoryNotAllowed) {
+			t.Errorf("expected %s not allowed, got %v", test.uri, err)
+		}
+	}
+
+	// The repository switched to is ignored once the endpoint does not allow it anymore
+	err := saveRepoSwitch("https://legacy", "https://new")
+	if err != nil {
+		t.Fatalf("failed to save repository switch: %v", err)
+	}
+	metadata = NodeMetadata{RepoURI: "https://legacy"}
+	err = applyRepoSwitch(&metadata)
+	if err != nil || metadata.RepoURI != "https://legacy" {
+		t.Errorf("expected the repository switch ignored, got %s, %v", metadata.RepoURI, err)
+	}
+}
+
+func TestEndpointOnlyFields(t *testing.T) {
+	endpoint := NodeMetadata{
+		RepoURI:              "https://repo",
+		RemoteOperations:     []string{"restart"},
+		DecommissionOnDelete: true,
+		Provenance:           &ProvenancePolicy{Keys: []string{"key"}},
+		AllowedRepoURIs:      []string{"https://new"},
+		StatusURL:            "https://status",
+		Heartbeat:            &HeartbeatEndpoint{URL: "https://heartbeat"},
+		ClusterURL:           "https://cluster",
+		ClusterCA:            "Y2E=",
+		Kubeconfig:           &Kubeconfig{Path: "/root/.kube/config"},
+		ManagedNodes:         []string{"vm-1"},
+		ManagedNodesToken:    "managed-token",
+		AnnotationPrefix:     "k8s.example.com",
+		WritablePaths:        map[string]string{"/usr/bin": "/usr/local/bin"},
+		SystemExtensions:     true,
+		ControllerTuning:     &ControllerTuning{QPS: 2},
+		TemplateArgs:         map[string]string{"containerd": "{}"},
+		ScriptDigests:        []string{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"},
+		ComponentOverrides: map[string]ComponentOverride{
+			"containerd": {Version: "1.7.23-hotfix1", Source: &ComponentSource{URL: "https://hotfixes", Dst: "/usr/local/bin/containerd"}},
+		},
+	}
+
+	// The ConfigMap layer cannot set nor update in place the endpoint-only fields
+	metadata := endpoint
+	metadata.clearEndpointOnly()
+	err := json.Unmarshal([]byte(`{"remote_operations": ["reinstall"], "decommission_on_delete": false, "allowed_repo_uris": ["https://attacker"], "provenance": {"keys": ["attacker"]}, "status_url": "https://attacker", "heartbeat": {"url": "https://attacker"}, "cluster_url": "https://attacker", "cluster_ca": "YXR0YWNrZXI=", "kubeconfig": {"path": "/etc/cron.d/attacker"}, "managed_nodes": ["other-node"], "managed_nodes_token": "attacker", "annotation_prefix": "attacker.example.com", "writable_paths": {"/usr/bin": "/etc/cron.d"}, "system_extensions": false, "script_digests": ["attacker"], "controller_tuning": {"queue_max_delay": "invalid"}, "template_args": {"containerd": "{\"plugins\": {\"io.containerd.grpc.v1.cri\": {\"containerd\": {\"runtimes\": {\"runc\": {\"options\": {\"BinaryName\": \"/tmp/attacker\"}}}}}}}"}, "component_overrides": {"containerd": {"version": "1.0.0", "source": {"url": "https://attacker", "dst": "/etc/cron.d/attacker"}}}}`), &metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.restoreEndpointOnly(endpoint)
+	if !reflect.DeepEqual(metadata, endpoint) || endpoint.Provenance.Keys[0] != "key" || endpoint.Heartbeat.URL != "https://heartbeat" || endpoint.ComponentOverrides["containerd"].Source.URL != "https://hotfixes" {
+		t.Errorf("metadata = %+v, expected %+v", metadata, endpoint)
+	}
+
+	// The ConfigMap can override the component versions, but not install a source file
+	metadata = endpoint
+	metadata.clearEndpointOnly()
+	err = json.Unmarshal([]byte(`{"component_overrides": {"kubelet": {"version": "1.31.5", "source": {"url": "https://attacker", "dst": "/etc/cron.d/attacker"}}}}`), &metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.restoreEndpointOnly(endpoint)
+	expected := map[string]ComponentOverride{"containerd": endpoint.ComponentOverrides["containerd"], "kubelet": {Version: "1.31.5"}}
+	if !reflect.DeepEqual(metadata.ComponentOverrides, expected) || len(endpoint.ComponentOverrides) != 1 {
+		t.Errorf("component overrides = %+v, expected %+v", metadata.ComponentOverrides, expected)
+	}
+}
+
+func TestInstalledComponentProvenance(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	repoFS := fstest.MapFS{
+		"containerd/metadata.yaml": {Data: []byte("versions:\n  1.7.22:\n    uninstall:\n      - scripts:\n          - cmd: rm -rf /var/lib/containerd\n")},
+	}
+
+	// The uninstall runs as root, it is refused without the provenance of the installed version
+	_, _, err := installedComponentMetadata(repoFS, NodeMetadata{Provenance: &ProvenancePolicy{Keys: []string{"key"}}}, "containerd", "1.7.22")
+	if err == nil || !strings.Contains(err.Error(), "failed to verify component containerd provenance") {
+		t.Errorf("expected the provenance verified, got %v", err)
+	}
+
+	sections, _, err := installedComponentMetadata(repoFS, NodeMetadata{}, "containerd", "1.7.22")
+	if err != nil || len(sections.Uninstall) != 1 {
+		t.Errorf("unexpected uninstall sections %+v, %v", sections, err)
+	}
+}
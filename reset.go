@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// resetKeptDirs are the system directories never removed by the reset, even when empty once the
+// managed files are removed
+var resetKeptDirs = []string{
+	"/", "/etc", "/etc/default", "/etc/sysctl.d", "/etc/modules-load.d", "/etc/systemd", systemdUnitsDir,
+	"/opt", "/usr", "/usr/bin", "/usr/sbin", "/usr/lib", "/usr/local", "/usr/local/bin", "/usr/local/sbin",
+	"/usr/local/lib", "/var", "/var/lib", "/var/log", "/run",
+}
+
+// resetNode resets the node to its state before the install, eg: to reuse a bare-metal or Kosmos
+// machine without reimaging it. The uninstall sections of the components are not run without the
+// node metadata, the files written by the agent are removed anyway.
+func resetNode(ctx context.Context, nodemetadata *NodeMetadata) error {
+	// Stop the agent first so it does not install the node again
+	agentUnitPath := filepath.Join(systemdUnitsDir, agentUnitName)
+	agentInstalled, err := fileExists(agentUnitPath)
+	if err != nil {
+		return err
+	}
+	if agentInstalled {
+		output, err := command("/usr/bin/systemctl", "disable", "--now", agentUnitName).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to stop agent unit: %w: %s", err, output)
+		}
+		slog.Info("Agent unit stopped", slog.String("unit", agentUnitName))
+	}
+
+	// Stop the services, they may not be installed. The pods are removed through the CRI once the
+	// kubelet is stopped, so their mounts and networks do not outlive containerd.
+	for _, service := range decommissionServices {
+		if service == "containerd" {
+			err = removeCRIPods(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		output, err := command("/usr/bin/systemctl", "stop", service).CombinedOutput()
+		if err != nil {
+			slog.Warn("Failed to stop service", slog.String("service", service), slog.Any("error", err), slog.String("output", string(output)))
+			continue
+		}
+		slog.Info("Service stopped", slog.String("service", service))
+	}
+
+	// Uninstall the installed components
+	if nodemetadata != nil {
+		err = uninstallNode(ctx, *nodemetadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Remove the files written by the agent and left by the components, and the directories created for
+	// them. The list is kept by the decommission for the reset.
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		return err
+	}
+	for _, path := range slices.Backward(slices.Sorted(maps.Keys(managedFiles))) {
+		err = os.RemoveAll(hostPath(path))
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		err = removeEmptyParents(path)
+		if err != nil {
+			return err
+		}
+	}
+	if len(managedFiles) > 0 {
+		slog.Info("Managed files removed", slog.Int("count", len(managedFiles)))
+	}
+
+	// Restore the files taken over by the install, as they were before
+	err = restoreTakenOverFiles()
+	if err != nil {
+		return err
+	}
+
+	// Remove the credentials and the state directory except the audit logs, the node is installed again
+	// from scratch
+	err = wipeNodeState()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(hostPath(stateDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read state directory: %w", err)
+	}
+	for _, entry := range entries {
+		if isAuditLog(entry.Name()) {
+			continue
+		}
+		err = os.RemoveAll(hostPath(filepath.Join(stateDir, entry.Name())))
+		if err != nil {
+			return fmt.Errorf("failed to remove state %s: %w", entry.Name(), err)
+		}
+	}
+
+	// Remove the agent unit last, it is installed again with -install-unit
+	if agentInstalled {
+		err = os.Remove(hostPath(agentUnitPath))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove agent unit: %w", err)
+		}
+	}
+	output, err := command("/usr/bin/systemctl", "daemon-reload").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to daemon-reload: %w: %s", err, output)
+	}
+	slog.Info("Node reset")
+
+	return nil
+}
+
+// removeEmptyParents removes the parent directories of the path while they are empty, up to the
+// system directories
+func removeEmptyParents(path string) error {
+	for dir := filepath.Dir(path); !slices.Contains(resetKeptDirs, dir); dir = filepath.Dir(dir) {
+		entries, err := os.ReadDir(hostPath(dir))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read directory %s: %w", dir, err)
+		}
+		if len(entries) > 0 {
+			return nil
+		}
+		err = os.Remove(hostPath(dir))
+		if err != nil {
+			return fmt.Errorf("failed to remove directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// resetNodeMetadata returns the node metadata of the uninstall sections, nil if the node was never
+// registered. A Kosmos node is not registered by the reset.
+func resetNodeMetadata(ctx context.Context, kosmos bool) (*NodeMetadata, error) {
+	var userData UserData
+	if kosmos {
+		data, err := os.ReadFile(hostPath(kosmosUserDataCacheFile))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read userdata cache: %w", err)
+		}
+		err = json.Unmarshal(data, &userData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal Kosmos node userdata cache: %w", err)
+		}
+	} else {
+		nodeUserData, err := getNodeUserData()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get credentials: %w", err)
+		}
+		userData = nodeUserData
+	}
+
+	nodeMetadata, err := loadNodeMetadata(ctx, userData)
+	if err != nil {
+		return nil, err
+	}
+	return &nodeMetadata, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResetNode(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	// Files written by the agent, and files it does not manage
+	managed := []string{"/opt/cni/bin/bridge", "/opt/cni/bin/loopback", "/usr/local/bin/kubelet", "/etc/kubernetes/kubelet/config.yaml"}
+	unmanaged := []string{"/opt/other/tool", "/usr/local/bin/helm", "/etc/kubernetes/admin.conf"}
+	for _, path := range append(append(managed, unmanaged...), filepath.Join(systemdUnitsDir, agentUnitName), versionsFile, auditLog) {
+		err := os.MkdirAll(filepath.Dir(hostPath(path)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(hostPath(path), []byte("data"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range managed {
+		err := recordManagedFile(path, "component")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A file taken over with force, then the node decommissioned
+	err := os.WriteFile(hostPath("/etc/crictl.yaml"), []byte("original"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkTakeover(slog.Default(), "/etc/crictl.yaml", "component", false, true)
+	if err != nil {
+		t.Fatalf("failed to take over file: %v", err)
+	}
+	err = installContent("/etc/crictl.yaml", []byte("installed"), "0644", "", "")
+	if err == nil {
+		err = recordManagedFile("/etc/crictl.yaml", "component")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wipeNodeState()
+	if err != nil {
+		t.Fatalf("failed to wipe node state: %v", err)
+	}
+
+	err = resetNode(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("failed to reset node: %v", err)
+	}
+
+	removed := append(managed, "/opt/cni", "/etc/kubernetes/kubelet", filepath.Join(systemdUnitsDir, agentUnitName), versionsFile)
+	for _, path := range removed {
+		if _, err := os.Stat(hostPath(path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+	for _, path := range append(unmanaged, "/usr/local/bin", "/opt") {
+		if _, err := os.Stat(hostPath(path)); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+
+	// The file taken over is restored as it was
+	content, err := os.ReadFile(hostPath("/etc/crictl.yaml"))
+	if err != nil || string(content) != "original" {
+		t.Errorf("expected the file taken over restored, got %q, %v", content, err)
+	}
+	info, err := os.Stat(hostPath("/etc/crictl.yaml"))
+	if err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("expected the file taken over mode restored, got %v, %v", info, err)
+	}
+
+	// The state directory only holds the audit log and the commands run after it is wiped
+	commands, err := os.ReadFile(hostPath(commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(commands)) == "" || !strings.Contains(string(commands), "systemctl daemon-reload") {
+		t.Errorf("unexpected commands %q", commands)
+	}
+	entries, err := os.ReadDir(hostPath(stateDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := entryNames(entries); !slices.Equal(names, []string{filepath.Base(auditLog), filepath.Base(commandsLog)}) {
+		t.Errorf("unexpected state files %v", names)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Service managers, the fake one records the commands instead of executing them, the chroot one
+// installs the components into the alternate root, eg: an image filesystem
+const (
+	systemdServiceManager = "systemd"
+	fakeServiceManager    = "fake"
+	chrootServiceManager  = "chroot"
+)
+
+// chrootCommands only change the files of the root, they are run in the alternate root, the other
+// commands act on the running system and are recorded instead
+var chrootCommands = []string{"/bin/bash", "/usr/sbin/update-grub", "/usr/bin/systemd-analyze"}
+
+// chrootSystemctlCommands only change the unit files, they are run with the alternate root
+var chrootSystemctlCommands = []string{"enable", "disable", "mask", "unmask"}
+
+var (
+	// rootDir is the directory the node filesystem is rooted under, the actual root if empty.
+	// It is meant for the integration tests alongside the fake service manager, and for the image
+	// builds alongside the chroot service manager.
+	rootDir string
+
+	// serviceManager executes the commands run by the agent (systemctl, scripts, ...)
+	serviceManager = systemdServiceManager
+)
+
+// commandsLog is the file the commands are recorded to by the fake service manager
+var commandsLog = filepath.Join(stateDir, "commands.log")
+
+// commandsLogMu serializes the writes to the commands log
+var commandsLogMu sync.Mutex
+
+// hostPath returns the path of the node file under the root directory. The agent process own
+// files (/proc/self) are never rooted.
+func hostPath(path string) string {
+	if rootDir == "" || strings.HasPrefix(path, "/proc/self/") {
+		return path
+	}
+	return filepath.Join(rootDir, path)
+}
+
+// command returns the command to run, or a no-op command recording it with the fake service manager
+// and with the chroot one for the commands acting on the running system
+func command(name string, args ...string) *exec.Cmd {
+	return commandContext(context.Background(), name, args...)
+}
+
+// commandContext is command with a context killing the command when done
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	switch {
+	case serviceManager == systemdServiceManager:
+		return exec.CommandContext(ctx, name, args...)
+	case serviceManager == chrootServiceManager && name == "/usr/bin/systemctl" && len(args) > 0 && slices.Contains(chrootSystemctlCommands, args[0]):
+		return exec.CommandContext(ctx, name, slices.Concat([]string{"--root=" + rootDir}, args)...)
+	case serviceManager == chrootServiceManager && slices.Contains(chrootCommands, name):
+		return exec.CommandContext(ctx, "/usr/sbin/chroot", slices.Concat([]string{rootDir, name}, args)...)
+	}
+
+	err := recordCommand(name, args)
+	if err != nil {
+		slog.Warn("Failed to record command", slog.String("command", name), slog.Any("error", err))
+	}
+	return exec.CommandContext(ctx, "/bin/true")
+}
+
+// recordCommand appends the command line to the commands log
+func recordCommand(name string, args []string) error {
+	commandsLogMu.Lock()
+	defer commandsLogMu.Unlock()
+
+	path := hostPath(commandsLog)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create commands log dir: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open commands log: %w", err)
+	}
+
+	_, err = fmt.Fprintln(file, strings.Join(append([]string{name}, args...), " "))
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to write commands log: %w", err)
+	}
+
+	return file.Close()
+}
+
+// validateServiceManager checks the service manager flag value
+func validateServiceManager(manager string) error {
+	switch manager {
+	case systemdServiceManager, fakeServiceManager:
+		return nil
+	case chrootServiceManager:
+		if rootDir == "" {
+			return fmt.Errorf("service manager %s requires a root directory", manager)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown service manager %q, expected %s, %s or %s", manager, systemdServiceManager, fakeServiceManager, chrootServiceManager)
+	}
+}
+
+// nodePath is the reverse of hostPath, it returns the path of the node file rooted under the root directory
+func nodePath(path string) string {
+	if rootDir == "" {
+		return path
+	}
+	rel, err := filepath.Rel(rootDir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
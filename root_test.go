@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestHostPath(t *testing.T) {
+	defer func(previous string) { rootDir = previous }(rootDir)
+	rootDir = "/tmp/root"
+
+	tests := []struct {
+		path     string
+		hostPath string
+	}{
+		{"/etc/kubernetes/kubelet.conf", "/tmp/root/etc/kubernetes/kubelet.conf"},
+		{"/", "/tmp/root"},
+		{"/proc/sys/net/ipv4/ip_forward", "/tmp/root/proc/sys/net/ipv4/ip_forward"},
+		{"/proc/self/mountinfo", "/proc/self/mountinfo"},
+	}
+
+	for _, test := range tests {
+		got := hostPath(test.path)
+		if got != test.hostPath {
+			t.Errorf("hostPath(%q) = %q, want %q", test.path, got, test.hostPath)
+		}
+		if test.path != "/proc/self/mountinfo" && nodePath(got) != test.path {
+			t.Errorf("nodePath(%q) = %q, want %q", got, nodePath(got), test.path)
+		}
+	}
+}
+
+func TestFakeServiceManager(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	err := command("/usr/bin/systemctl", "enable", "kubelet").Run()
+	if err != nil {
+		t.Fatalf("failed to run command: %v", err)
+	}
+	err = scriptCommand("echo hello", nil).Run()
+	if err != nil {
+		t.Fatalf("failed to run script: %v", err)
+	}
+
+	recorded, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatalf("failed to read commands log: %v", err)
+	}
+	want := "/usr/bin/systemctl enable kubelet\n/bin/bash -c echo hello\n"
+	if string(recorded) != want {
+		t.Errorf("recorded commands = %q, want %q", recorded, want)
+	}
+}
+
+func TestChrootServiceManager(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = chrootServiceManager
+
+	tests := []struct {
+		name string
+		cmd  *exec.Cmd
+		args []string // Recorded instead if nil
+	}{
+		{
+			name: "unit enabled in the root",
+			cmd:  command("/usr/bin/systemctl", "enable", "kubelet"),
+			args: []string{"/usr/bin/systemctl", "--root=" + rootDir, "enable", "kubelet"},
+		},
+		{
+			name: "service not started",
+			cmd:  command("/usr/bin/systemctl", "start", "kubelet"),
+		},
+		{
+			name: "script run in the root without limits",
+			cmd:  scriptCommand("echo hello", &ResourceLimits{Slice: "scw-k8s-agent.slice"}),
+			args: []string{"/usr/sbin/chroot", rootDir, "/bin/bash", "-c", "echo hello"},
+		},
+		{
+			name: "unit verified in the root",
+			cmd:  command("/usr/bin/systemd-analyze", "verify", "--man=no", "--recursive-errors=no", "/etc/systemd/system/kubelet.service"),
+			args: []string{"/usr/sbin/chroot", rootDir, "/usr/bin/systemd-analyze", "verify", "--man=no", "--recursive-errors=no", "/etc/systemd/system/kubelet.service"},
+		},
+		{
+			name: "network not configured",
+			cmd:  command("/usr/sbin/ip", "link", "set", "eth1", "up"),
+		},
+	}
+	for _, test := range tests {
+		if test.args == nil {
+			test.args = []string{"/bin/true"}
+		}
+		if !slices.Equal(test.cmd.Args, test.args) {
+			t.Errorf("%s: command = %v, want %v", test.name, test.cmd.Args, test.args)
+		}
+	}
+
+	recorded, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatalf("failed to read commands log: %v", err)
+	}
+	want := "/usr/bin/systemctl start kubelet\n/usr/sbin/ip link set eth1 up\n"
+	if string(recorded) != want {
+		t.Errorf("recorded commands = %q, want %q", recorded, want)
+	}
+
+	err = validateServiceManager(chrootServiceManager)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	rootDir = ""
+	err = validateServiceManager(chrootServiceManager)
+	if err == nil {
+		t.Errorf("expected an error without root directory")
+	}
+}
+
+func TestChrootOwnersAndSysctls(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = chrootServiceManager
+
+	// The owners are the users and groups of the image, not of the host
+	err := os.MkdirAll(hostPath("/etc/sysctl.d"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(hostPath("/etc/passwd"), []byte("root:x:0:0:root:/root:/bin/bash\nnobody:x:4242:4243::/:/sbin/nologin\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(hostPath("/etc/group"), []byte("root:x:0:\nnogroup:x:4243:\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, err := lookupUserID("nobody")
+	if err != nil || uid != 4242 {
+		t.Errorf("lookupUserID() = %d, %v, want the image uid 4242", uid, err)
+	}
+	gid, err := lookupGroupID("nogroup")
+	if err != nil || gid != 4243 {
+		t.Errorf("lookupGroupID() = %d, %v, want the image gid 4243", gid, err)
+	}
+	_, err = lookupUserID("daemon")
+	if !errors.Is(err, errUnknownOwner) {
+		t.Errorf("expected the user not in the image unknown, got %v", err)
+	}
+
+	// The sysctls are only persisted in the image, not written to its /proc/sys
+	err = applyNetwork("kubelet", ComponentNetwork{Sysctls: map[string]string{"net.ipv4.ip_forward": "1"}})
+	if err != nil {
+		t.Fatalf("failed to apply network: %v", err)
+	}
+	_, err = os.Stat(hostPath("/proc/sys/net/ipv4/ip_forward"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no sysctl written in the image, got %v", err)
+	}
+	persisted, err := os.ReadFile(hostPath(networkSysctlsFile("kubelet")))
+	if err != nil || string(persisted) != "net.ipv4.ip_forward = 1\n" {
+		t.Errorf("persisted sysctls = %q, %v", persisted, err)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// CycloneDX JSON SBOM of the components installed on the node, with their version, the repository
+// they were installed from and the SHA256 digest of their files. It is written after each successful
+// install, only when the inventory changed, readable by all the users like the versions file. It is
+// served by the admin API, and its digest is published in the sbom annotation and the node status.
+//
+//	{
+//	   "bomFormat": "CycloneDX",
+//	   "specVersion": "1.5",
+//	   "version": 1,
+//	   "metadata": {
+//	      "timestamp": "2024-10-07T10:00:00Z",
+//	      "tools": {"components": [{"type": "application", "name": "scw-k8s-agent", "version": "1.4.0"}]},
+//	      "component": {"type": "platform", "name": "scw-pool-1234", "version": "1.31.3"}
+//	   },
+//	   "components": [{
+//	      "type": "application",
+//	      "name": "containerd",
+//	      "version": "1.7.22",
+//	      "externalReferences": [{"type": "distribution", "url": "https://repo.example.com/k8s"}],
+//	      "components": [{"type": "file", "name": "/usr/bin/containerd", "hashes": [{"alg": "SHA-256", "content": "9f86d0..."}]}]
+//	   }]
+//	}
+const sbomFile = "/etc/scw-k8s-sbom.cdx.json"
+
+// sbomAnnotation is set by the agent with the SHA256 digest of the node SBOM
+var sbomAnnotation = defaultAnnotationPrefix + "sbom-digest"
+
+const sbomSpecVersion = "1.5"
+
+type SBOM struct {
+	BOMFormat   string          `json:"bomFormat"`
+	SpecVersion string          `json:"specVersion"`
+	Version     int             `json:"version"`
+	Metadata    SBOMMetadata    `json:"metadata"`
+	Components  []SBOMComponent `json:"components"`
+}
+
+type SBOMMetadata struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Tools     SBOMTools     `json:"tools"`
+	Component SBOMComponent `json:"component"`
+}
+
+type SBOMTools struct {
+	Components []SBOMComponent `json:"components"`
+}
+
+type SBOMComponent struct {
+	Type               string          `json:"type"` // application, platform or file
+	Name               string          `json:"name"`
+	Version            string          `json:"version,omitempty"`
+	Hashes             []SBOMHash      `json:"hashes,omitempty"`
+	ExternalReferences []SBOMReference `json:"externalReferences,omitempty"`
+	Components         []SBOMComponent `json:"components,omitempty"`
+}
+
+type SBOMHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type SBOMReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// buildSBOM returns the SBOM of the components installed, sorted by name
+func buildSBOM(nodemetadata NodeMetadata) (SBOM, error) {
+	versions, err := ListComponentsVersions()
+	if err != nil {
+		return SBOM{}, fmt.Errorf("failed to list components versions: %w", err)
+	}
+	// The uninstalled components are not part of the inventory
+	maps.DeleteFunc(versions, func(_, version string) bool {
+		return version == "" || version == "uninstalled"
+	})
+	componentRepos, err := loadComponentRepos()
+	if err != nil {
+		return SBOM{}, err
+	}
+	digests, err := managedFileDigests(versions)
+	if err != nil {
+		return SBOM{}, err
+	}
+
+	sbom := SBOM{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: sbomSpecVersion,
+		Version:     1,
+		Metadata: SBOMMetadata{
+			Timestamp: time.Now().UTC(),
+			Tools:     SBOMTools{Components: []SBOMComponent{{Type: "application", Name: "scw-k8s-agent", Version: Version}}},
+			Component: SBOMComponent{Type: "platform", Name: nodemetadata.Name, Version: nodemetadata.PoolVersion},
+		},
+		Components: []SBOMComponent{},
+	}
+	for _, name := range slices.Sorted(maps.Keys(versions)) {
+		component := SBOMComponent{Type: "application", Name: name, Version: versions[name]}
+
+		// The components installed before their repository was recorded come from the node repository
+		repoURI := componentRepos[name]
+		if repoURI == "" {
+			repoURI = nodemetadata.RepoURI
+		}
+		if repoURI != "" {
+			component.ExternalReferences = []SBOMReference{{Type: "distribution", URL: repoURI}}
+		}
+
+		for _, path := range slices.Sorted(maps.Keys(digests[name])) {
+			component.Components = append(component.Components, SBOMComponent{
+				Type:   "file",
+				Name:   path,
+				Hashes: []SBOMHash{{Alg: "SHA-256", Content: digests[name][path]}},
+			})
+		}
+		sbom.Components = append(sbom.Components, component)
+	}
+
+	return sbom, nil
+}
+
+// writeSBOM writes the SBOM of the components installed if the inventory changed, and returns the
+// digest of the SBOM
+func writeSBOM(nodemetadata NodeMetadata) (string, error) {
+	sbom, err := buildSBOM(nodemetadata)
+	if err != nil {
+		return "", err
+	}
+
+	// Keep the current SBOM if the inventory is unchanged, so its digest only changes with the components
+	current, err := loadSBOM()
+	if err != nil {
+		return "", err
+	}
+	if current != nil && current.Metadata.Component.Name == sbom.Metadata.Component.Name && current.Metadata.Component.Version == sbom.Metadata.Component.Version {
+		jsonCurrent, err := json.Marshal(current.Components)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal SBOM components: %w", err)
+		}
+		jsonComponents, err := json.Marshal(sbom.Components)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal SBOM components: %w", err)
+		}
+		if bytes.Equal(jsonCurrent, jsonComponents) {
+			return loadSBOMDigest()
+		}
+	}
+
+	jsonSBOM, err := json.MarshalIndent(sbom, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal SBOM: %w", err)
+	}
+
+	err = writeFileSync(sbomFile, jsonSBOM, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to write SBOM: %w", err)
+	}
+	slog.Info("SBOM written", slog.String("file", sbomFile), slog.Int("components", len(sbom.Components)))
+
+	return sbomDigest(jsonSBOM), nil
+}
+
+// loadSBOM returns the SBOM of the node, nil if not written yet
+func loadSBOM() (*SBOM, error) {
+	jsonSBOM, err := os.ReadFile(hostPath(sbomFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SBOM: %w", err)
+	}
+
+	var sbom SBOM
+	err = json.Unmarshal(jsonSBOM, &sbom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal SBOM: %w", err)
+	}
+
+	return &sbom, nil
+}
+
+// loadSBOMDigest returns the digest of the SBOM of the node, empty if not written yet
+func loadSBOMDigest() (string, error) {
+	jsonSBOM, err := os.ReadFile(hostPath(sbomFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read SBOM: %w", err)
+	}
+
+	return sbomDigest(jsonSBOM), nil
+}
+
+func sbomDigest(jsonSBOM []byte) string {
+	digest := sha256.Sum256(jsonSBOM)
+	return "sha256:" + hex.EncodeToString(digest[:])
+}
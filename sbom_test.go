@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteSBOM(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	// Install the components
+	for _, dir := range []string{"etc", "usr/bin"} {
+		err := os.MkdirAll(filepath.Join(rootDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(rootDir, "usr/bin/containerd"), []byte("containerd binary"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, component := range map[string]string{"/usr/bin/containerd": "containerd", "/usr/bin/missing": "containerd"} {
+		err = recordManagedFile(path, component)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for component, version := range map[string]string{"containerd": "1.7.22", "kubelet": "1.31.3", "cilium": "uninstalled", "flannel": ""} {
+		err = SetComponentVersion(component, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = recordComponentRepo("kubelet", "https://other.example.com/k8s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodemetadata := NodeMetadata{Name: "scw-pool-1234", PoolVersion: "1.31.3", RepoURI: "https://repo.example.com/k8s"}
+
+	digest, err := writeSBOM(nodemetadata)
+	if err != nil {
+		t.Fatalf("failed to write SBOM: %v", err)
+	}
+	sbom, err := loadSBOM()
+	if err != nil || sbom == nil {
+		t.Fatalf("failed to load SBOM: %v", err)
+	}
+	if sbom.BOMFormat != "CycloneDX" || sbom.Metadata.Component.Name != "scw-pool-1234" || len(sbom.Components) != 2 {
+		t.Fatalf("unexpected SBOM %+v", sbom)
+	}
+
+	// The components are sorted, without the uninstalled ones, with their repository and the digest of their existing files
+	containerd, kubelet := sbom.Components[0], sbom.Components[1]
+	if containerd.Name != "containerd" || containerd.Version != "1.7.22" || containerd.ExternalReferences[0].URL != "https://repo.example.com/k8s" {
+		t.Errorf("unexpected containerd component %+v", containerd)
+	}
+	if len(containerd.Components) != 1 || containerd.Components[0].Name != "/usr/bin/containerd" || containerd.Components[0].Hashes[0].Alg != "SHA-256" {
+		t.Errorf("unexpected containerd files %+v", containerd.Components)
+	}
+	if kubelet.Name != "kubelet" || kubelet.ExternalReferences[0].URL != "https://other.example.com/k8s" || len(kubelet.Components) != 0 {
+		t.Errorf("unexpected kubelet component %+v", kubelet)
+	}
+
+	// The SBOM is readable by all the users and served by the admin API
+	info, err := os.Stat(filepath.Join(rootDir, sbomFile))
+	if err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("unexpected SBOM file %v, %v", info, err)
+	}
+	jsonSBOM, err := os.ReadFile(filepath.Join(rootDir, sbomFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handleAdminSBOM(recorder, httptest.NewRequest(http.MethodGet, "/v1/sbom", nil))
+	if recorder.Code != http.StatusOK || !bytes.Equal(recorder.Body.Bytes(), jsonSBOM) || sbomDigest(recorder.Body.Bytes()) != digest {
+		t.Errorf("unexpected SBOM response %d %s", recorder.Code, recorder.Body)
+	}
+
+	// The SBOM is kept while the inventory is unchanged
+	unchanged, err := writeSBOM(nodemetadata)
+	if err != nil || unchanged != digest {
+		t.Errorf("expected the SBOM digest %s unchanged, got %s, %v", digest, unchanged, err)
+	}
+	current, err := loadSBOMDigest()
+	if err != nil || current != digest {
+		t.Errorf("expected the SBOM digest %s, got %s, %v", digest, current, err)
+	}
+
+	// The SBOM is written again once a file changes
+	err = os.WriteFile(filepath.Join(rootDir, "usr/bin/containerd"), []byte("patched binary"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := writeSBOM(nodemetadata)
+	if err != nil || changed == digest {
+		t.Errorf("expected the SBOM digest changed, got %s, %v", changed, err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// templateArgsSchemaFile is the optional JSON schema of the template args, in the component directory
+const templateArgsSchemaFile = "template_args.schema.json"
+
+// TemplateArgsSchema is the subset of JSON schema supported to validate the template args.
+// Since template args are strings, the type of a property is checked by parsing its value.
+//
+//	{
+//	   "required": ["max_pods"],
+//	   "additionalProperties": false,
+//	   "properties": {
+//	      "max_pods": {"type": "integer"},
+//	      "cgroup_driver": {"type": "string", "enum": ["systemd", "cgroupfs"]},
+//	      "registry_mirror": {"type": "string", "pattern": "^https://"}
+//	   }
+//	}
+type TemplateArgsSchema struct {
+	Required             []string                              `json:"required"`
+	AdditionalProperties *bool                                 `json:"additionalProperties"`
+	Properties           map[string]TemplateArgsPropertySchema `json:"properties"`
+}
+
+type TemplateArgsPropertySchema struct {
+	Type    string   `json:"type"`
+	Enum    []string `json:"enum"`
+	Pattern string   `json:"pattern"`
+}
+
+// validateComponentTemplateArgs validates the template args against the component schema, if any
+func validateComponentTemplateArgs(componentFS fs.FS, templateArgs map[string]string) error {
+	schemaFile, err := fs.ReadFile(componentFS, templateArgsSchemaFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read template args schema: %w", err)
+	}
+
+	var schema TemplateArgsSchema
+	err = json.Unmarshal(schemaFile, &schema)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal template args schema: %w", err)
+	}
+
+	return schema.Validate(templateArgs)
+}
+
+// Validate returns all the validation errors of the template args
+func (s TemplateArgsSchema) Validate(templateArgs map[string]string) error {
+	var errs []error
+
+	// Check required args
+	for _, required := range s.Required {
+		if _, ok := templateArgs[required]; !ok {
+			errs = append(errs, fmt.Errorf("template arg %q is required", required))
+		}
+	}
+
+	// Check args in a stable order
+	names := make([]string, 0, len(templateArgs))
+	for name := range templateArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := templateArgs[name]
+
+		property, ok := s.Properties[name]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, fmt.Errorf("template arg %q is unknown", name))
+			}
+			continue
+		}
+
+		err := property.validate(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("template arg %q: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p TemplateArgsPropertySchema) validate(value string) error {
+	var err error
+	switch p.Type {
+	case "", "string":
+	case "integer":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "number":
+		_, err = strconv.ParseFloat(value, 64)
+	case "boolean":
+		_, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("unsupported type %q in schema", p.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("value %q is not of type %s", value, p.Type)
+	}
+
+	if len(p.Enum) > 0 && !slices.Contains(p.Enum, value) {
+		return fmt.Errorf("value %q must be one of %v", value, p.Enum)
+	}
+
+	if p.Pattern != "" {
+		pattern, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q in schema: %w", p.Pattern, err)
+		}
+		if !pattern.MatchString(value) {
+			return fmt.Errorf("value %q does not match pattern %q", value, p.Pattern)
+		}
+	}
+
+	return nil
+}
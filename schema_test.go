@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTemplateArgsSchemaValidate(t *testing.T) {
+	noAdditional := false
+	schema := TemplateArgsSchema{
+		Required:             []string{"max_pods"},
+		AdditionalProperties: &noAdditional,
+		Properties: map[string]TemplateArgsPropertySchema{
+			"max_pods":        {Type: "integer"},
+			"cgroup_driver":   {Type: "string", Enum: []string{"systemd", "cgroupfs"}},
+			"registry_mirror": {Pattern: "^https://"},
+			"gpu":             {Type: "boolean"},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		templateArgs map[string]string
+		valid        bool
+	}{
+		{
+			name:         "valid args",
+			templateArgs: map[string]string{"max_pods": "110", "cgroup_driver": "systemd", "registry_mirror": "https://mirror", "gpu": "true"},
+			valid:        true,
+		},
+		{
+			name:         "missing required arg",
+			templateArgs: map[string]string{"cgroup_driver": "systemd"},
+		},
+		{
+			name:         "invalid integer",
+			templateArgs: map[string]string{"max_pods": "a lot"},
+		},
+		{
+			name:         "value not in enum",
+			templateArgs: map[string]string{"max_pods": "110", "cgroup_driver": "sytsemd"},
+		},
+		{
+			name:         "value not matching pattern",
+			templateArgs: map[string]string{"max_pods": "110", "registry_mirror": "http://mirror"},
+		},
+		{
+			name:         "unknown arg",
+			templateArgs: map[string]string{"max_pods": "110", "maxpods": "110"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := schema.Validate(tt.templateArgs)
+			if tt.valid && err != nil {
+				t.Errorf("Validate(%v) returned an error: %v", tt.templateArgs, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("Validate(%v) expected an error", tt.templateArgs)
+			}
+		})
+	}
+}
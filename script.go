@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scriptTailLines is the number of last output lines of a failed script included in its error
+const scriptTailLines = 50
+
+// scriptOutputWaitDelay is the time to read the output of a script once exited
+var scriptOutputWaitDelay = 5 * time.Second
+
+// scriptBaseEnv is the environment of the scripts, the agent environment may contain proxies or
+// credentials and is not inherited
+var scriptBaseEnv = map[string]string{
+	"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME": "/root",
+	"LANG": "C.UTF-8",
+}
+
+// scriptEnv returns the environment of the script: the base environment, the agent variables it
+// inherits if set, then its declared variables
+func scriptEnv(script ComponentScript) []string {
+	env := maps.Clone(scriptBaseEnv)
+	for _, name := range script.InheritEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+	maps.Copy(env, script.Env)
+
+	variables := make([]string, 0, len(env))
+	for _, name := range slices.Sorted(maps.Keys(env)) {
+		variables = append(variables, name+"="+env[name])
+	}
+	return variables
+}
+
+// scriptOutput streams the output lines of a script to the debug logs while it runs, and keeps the
+// last lines for the error if it fails
+type scriptOutput struct {
+	logger *slog.Logger
+	script string
+
+	mu   sync.Mutex
+	tail []string
+}
+
+func newScriptOutput(logger *slog.Logger, script string) *scriptOutput {
+	return &scriptOutput{logger: logger, script: script}
+}
+
+// stream returns the writer of the script stream, eg: stdout
+func (o *scriptOutput) stream(name string) *scriptStream {
+	return &scriptStream{output: o, name: name}
+}
+
+// line logs the output line and keeps it in the tail
+func (o *scriptOutput) line(stream, line string) {
+	o.logger.Debug("Script output", slog.String("script", o.script), slog.String("stream", stream), slog.String("line", line))
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.tail = append(o.tail, line)
+	if len(o.tail) > scriptTailLines {
+		o.tail = o.tail[len(o.tail)-scriptTailLines:]
+	}
+}
+
+// Tail returns the last output lines of the script, stdout and stderr interleaved
+func (o *scriptOutput) Tail() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.tail, "\n")
+}
+
+// scriptStream splits a script stream in lines
+type scriptStream struct {
+	output  *scriptOutput
+	name    string
+	partial []byte
+}
+
+func (s *scriptStream) Write(b []byte) (int, error) {
+	s.partial = append(s.partial, b...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.output.line(s.name, string(bytes.TrimSuffix(s.partial[:i], []byte("\r"))))
+		s.partial = s.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+// flush logs the last line not terminated by a newline, once the script exited
+func (s *scriptStream) flush() {
+	if len(s.partial) > 0 {
+		s.output.line(s.name, string(s.partial))
+		s.partial = nil
+	}
+}
+
+// scriptsDir holds the copies of the pinned script files while they run, only accessible by root
+var scriptsDir = filepath.Join(stateDir, "scripts")
+
+// scriptDigest returns the SHA256 digest of the script command, as declared in the component metadata.
+// The environment of the script is hashed with the command, one line per declared variable then per
+// inherited variable, sorted by name:
+//
+//	<cmd>
+//	env <name>=<value>
+//	inherit_env <name>
+func scriptDigest(script ComponentScript) string {
+	content := script.Cmd
+	for _, name := range slices.Sorted(maps.Keys(script.Env)) {
+		content += "\nenv " + name + "=" + script.Env[name]
+	}
+	for _, name := range slices.Sorted(slices.Values(script.InheritEnv)) {
+		content += "\ninherit_env " + name
+	}
+
+	digest := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(digest[:])
+}
+
+// checkScriptDigests checks the script command with its environment and the script files it runs
+// match their digest, so a command or a script file changed after the component was released, eg: by
+// a template, is never run. It returns the command to run: the pinned script files are run from a
+// private copy of the bytes checked, removed by the cleanup, so a file changed meanwhile is not run.
+// The scripts without digest, or with a digest not attested, are refused if required.
+func checkScriptDigests(script ComponentScript, required, attested bool) (string, func(), error) {
+	cleanup := func() {}
+	if script.SHA256 == "" {
+		if required {
+			return "", cleanup, fmt.Errorf("no sha256 digest, required by the %s feature gate", FeatureScriptDigests)
+		}
+		if len(script.Files) > 0 {
+			return "", cleanup, fmt.Errorf("script files pinned without the command sha256 digest")
+		}
+		return script.Cmd, cleanup, nil
+	}
+	if required && !attested {
+		return "", cleanup, fmt.Errorf("sha256 digest %s neither attested by the component provenance nor pinned by the node metadata, required by the %s feature gate", script.SHA256, FeatureScriptDigests)
+	}
+
+	digest := scriptDigest(script)
+	if !strings.EqualFold(digest, script.SHA256) {
+		return "", cleanup, fmt.Errorf("command digest %s does not match %s", digest, script.SHA256)
+	}
+
+	run := script.Cmd
+	var copies []string
+	cleanup = func() {
+		for _, path := range copies {
+			_ = os.Remove(hostPath(path))
+		}
+	}
+	for _, path := range slices.Sorted(maps.Keys(script.Files)) {
+		if !strings.Contains(script.Cmd, path) {
+			cleanup()
+			return "", func() {}, fmt.Errorf("script file %s is not run by the command", path)
+		}
+		content, mode, err := readScriptFile(path)
+		if err != nil {
+			cleanup()
+			return "", func() {}, err
+		}
+		sum := sha256.Sum256(content)
+		digest := hex.EncodeToString(sum[:])
+		if !strings.EqualFold(digest, script.Files[path]) {
+			cleanup()
+			return "", func() {}, fmt.Errorf("script file %s digest %s does not match %s", path, digest, script.Files[path])
+		}
+
+		verified := filepath.Join(scriptsDir, digest+filepath.Ext(path))
+		err = os.MkdirAll(hostPath(scriptsDir), 0700)
+		if err == nil {
+			err = installContent(verified, content, fmt.Sprintf("%04o", mode.Perm()), "", "")
+		}
+		if err != nil {
+			cleanup()
+			return "", func() {}, fmt.Errorf("failed to copy script file %s: %w", path, err)
+		}
+		copies = append(copies, verified)
+		run = strings.ReplaceAll(run, path, verified)
+	}
+
+	return run, cleanup, nil
+}
+
+// readScriptFile returns the content and the mode of the regular script file, read from the same file
+func readScriptFile(path string) ([]byte, fs.FileMode, error) {
+	file, err := os.Open(hostPath(path))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to stat file %s: %w", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, 0, fmt.Errorf("script file %s is not a regular file", path)
+	}
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read file %s: %w", path, err)
+	}
+
+	return content, info.Mode(), nil
+}
+
+// scriptAuditEntry returns the audit log entry of the pinned script
+func scriptAuditEntry(name, version string, script ComponentScript, status, message string) AuditEntry {
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Source:    fmt.Sprintf("component %s %s", name, version),
+		Operation: "script",
+		Status:    status,
+		Message:   message,
+	}
+	if script.SHA256 != "" {
+		entry.Digest = "sha256:" + strings.ToLower(script.SHA256)
+	}
+	return entry
+}
+
+// recordScriptAudit records the result of the script in the audit log, the failures are only logged
+// since the script already ran or was refused
+func recordScriptAudit(logger *slog.Logger, name, version string, script ComponentScript, status, message string) {
+	err := appendAudit(scriptAuditEntry(name, version, script, status, message))
+	if err != nil {
+		logger.Warn("Failed to record script in the audit log", slog.String("script", script.Cmd), slog.Any("error", err))
+	}
+}
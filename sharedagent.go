@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/validate/content"
+)
+
+// errManagedNodesToken is returned when a shared agent has no token allowed to write its managed nodes
+var errManagedNodesToken = errors.New("managed_nodes requires a managed_nodes_token")
+
+// managedNodeNames returns the names of the nodes managed by the controller: the managed_nodes of a
+// shared agent, eg: the lightweight nodes of a hypervisor, or the node of the metadata
+func managedNodeNames(nodemetadata NodeMetadata) ([]string, error) {
+	if len(nodemetadata.ManagedNodes) == 0 {
+		return []string{nodemetadata.Name}, nil
+	}
+
+	var names []string
+	for _, name := range nodemetadata.ManagedNodes {
+		if errs := content.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid managed node name %q: %s", name, strings.Join(errs, ", "))
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// runNodeControllers runs the controller of each managed node until the first one stops. The nodes of
+// a shared agent have their own informer, queue and reconcile state, use the managed nodes token for
+// the Kubernetes API, and share the node metadata of the host for the privileged operations.
+func runNodeControllers(ctx context.Context, nodemetadata NodeMetadata, privileged privileged) error {
+	names, err := managedNodeNames(nodemetadata)
+	if err != nil {
+		return err
+	}
+	err = setAnnotationPrefix(nodemetadata.AnnotationPrefix)
+	if err != nil {
+		return err
+	}
+	if len(nodemetadata.ManagedNodes) == 0 {
+		nodeController, err := NewController(ctx, nodemetadata, privileged)
+		if err != nil {
+			return fmt.Errorf("failed to create node controller: %w", err)
+		}
+		return nodeController.Run(ctx)
+	}
+
+	// The Node authorizer denies the node token the writes to the managed nodes
+	if nodemetadata.ManagedNodesToken == "" {
+		return errManagedNodesToken
+	}
+
+	slog.Info("Starting shared agent", slog.Any("nodes", names))
+	sharedSync := &sync.Mutex{}
+	controllers := make([]*Controller, 0, len(names))
+	for i, name := range names {
+		managedNode := nodemetadata
+		managedNode.Name = name
+		managedNode.Token = nodemetadata.ManagedNodesToken
+		nodeController, err := NewController(ctx, managedNode, privileged)
+		if err != nil {
+			return fmt.Errorf("failed to create node controller %s: %w", name, err)
+		}
+		nodeController.nodeMetadata = nodemetadata
+		nodeController.logger = slog.Default().With(slog.String("node", name))
+		nodeController.sharedSync = sharedSync
+		nodeController.secondary = i > 0
+		nodeController.managedNode = name != nodemetadata.Name
+		controllers = append(controllers, nodeController)
+	}
+
+	// The agent stops with the first controller, eg: for a restart, once the others are stopped
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(controllers))
+	for _, nodeController := range controllers {
+		go func() {
+			errs <- nodeController.Run(ctx)
+		}()
+	}
+	err = <-errs
+	cancel()
+	for range len(controllers) - 1 {
+		otherErr := <-errs
+		if err == nil {
+			err = otherErr
+		}
+	}
+
+	return err
+}
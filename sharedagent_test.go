@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestManagedNodeNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata NodeMetadata
+		expected []string
+		err      bool
+	}{
+		{name: "single node", metadata: NodeMetadata{Name: "node-1"}, expected: []string{"node-1"}},
+		{name: "shared agent", metadata: NodeMetadata{Name: "hypervisor", ManagedNodes: []string{"vm-1", "vm-2", "vm-1"}}, expected: []string{"vm-1", "vm-2"}},
+		{name: "invalid name", metadata: NodeMetadata{Name: "hypervisor", ManagedNodes: []string{"vm-1", "VM_2"}}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names, err := managedNodeNames(test.metadata)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("names = %v, expected %v", names, test.expected)
+			}
+		})
+	}
+}
+
+func TestSharedNodeDeletion(t *testing.T) {
+	// The deletion of a node of a shared agent does not decommission the host
+	c := &Controller{
+		nodeName:   "vm-1",
+		client:     fake.NewClientset(),
+		logger:     slog.Default(),
+		lastNode:   &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vm-1"}},
+		sharedSync: &sync.Mutex{},
+	}
+	err := c.syncNodeDeletion(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.lastNode != nil || c.decommissioned {
+		t.Errorf("expected the node to be forgotten without decommission, got %v, %v", c.lastNode, c.decommissioned)
+	}
+}
+
+func TestSharedAgentManagedNodesToken(t *testing.T) {
+	// The node token is not allowed to write the managed nodes
+	metadata := NodeMetadata{Name: "hypervisor", ManagedNodes: []string{"vm-1"}}
+	err := runNodeControllers(context.Background(), metadata, localPrivileged{})
+	if !errors.Is(err, errManagedNodesToken) {
+		t.Errorf("expected the managed nodes token error, got %v", err)
+	}
+}
+
+func TestManagedNodesTokenRedacted(t *testing.T) {
+	dump, err := dumpNodeMetadata(NodeMetadata{ManagedNodes: []string{"vm-1"}, ManagedNodesToken: "managed-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dump, "managed-token") || !strings.Contains(dump, `"managed_nodes_token": "redacted"`) {
+		t.Errorf("expected the managed nodes token redacted, got %s", dump)
+	}
+}
+
+func TestSharedNodeOwnership(t *testing.T) {
+	defer func(previousRoot, previousManager string, original func() ([]*net.IPNet, error)) {
+		rootDir, serviceManager, localAddresses = previousRoot, previousManager, original
+	}(rootDir, serviceManager, localAddresses)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+	hostNetworks := []*net.IPNet{{IP: net.ParseIP("172.16.0.5"), Mask: net.CIDRMask(24, 32)}}
+	localAddresses = func() ([]*net.IPNet, error) { return hostNetworks, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vm-1"}, Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "10.0.0.2"}}}}
+	client := fake.NewClientset(node)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err := indexer.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Controller{
+		nodeName:    "vm-1",
+		client:      client,
+		nodesLister: corelisters.NewNodeLister(indexer),
+		privileged:  localPrivileged{},
+		recorder:    newEventRecorder(ctx, client, "vm-1"),
+		logger:      slog.Default(),
+		lastCACheck: time.Now(),
+	}
+
+	// The managed node addresses are not local to the host, they must be on a network of the host
+	err = c.syncHandler(ctx)
+	if !errors.Is(err, errForeignNode) {
+		t.Errorf("expected the foreign node refused, got %v", err)
+	}
+	c.sharedSync = &sync.Mutex{}
+	c.managedNode = true
+	err = c.syncHandler(ctx)
+	if !errors.Is(err, errForeignNode) || c.lastNode != nil {
+		t.Errorf("expected the managed node off the host networks refused, got %v", err)
+	}
+	hostNetworks = append(hostNetworks, &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)})
+	err = c.syncHandler(ctx)
+	if errors.Is(err, errForeignNode) || c.lastNode == nil {
+		t.Errorf("expected the managed node reconciled, got %v", err)
+	}
+}
+
+func TestManagedNodeHostOperations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The operations acting on the host are refused for a managed node, with a failed result
+	for _, operation := range []string{"upgrade", "restore", "reinstall=containerd", "restart=kubelet", "decommission"} {
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "vm-1", Annotations: map[string]string{agentAnnotation: operation}}}
+		client := fake.NewClientset(node)
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		err := indexer.Add(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Controller{
+			nodeName:    "vm-1",
+			client:      client,
+			nodesLister: corelisters.NewNodeLister(indexer),
+			recorder:    newEventRecorder(ctx, client, "vm-1"),
+			logger:      slog.Default(),
+			sharedSync:  &sync.Mutex{},
+			managedNode: true,
+		}
+		err = c.upgradeNode(ctx)
+		if err == nil {
+			err = c.restoreNode(ctx)
+		}
+		if err == nil {
+			err = c.operateNode(ctx)
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", operation, err)
+		}
+		updated, err := client.CoreV1().Nodes().Get(ctx, "vm-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := updated.Annotations[agentAnnotation]; ok || !strings.Contains(updated.Annotations[agentResultAnnotation], `"status":"failed"`) || !strings.Contains(updated.Annotations[agentResultAnnotation], "acts on the host of the shared agent") {
+			t.Errorf("%s: expected the operation refused, got %v", operation, updated.Annotations)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/unix"
+	grpcstatus "google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// SmokeTest configures the node smoke test run after the initial install, the install is only
+// reported successful once the kubelet is healthy, a pod sandbox is created and the DNS resolves
+//
+//	"smoke_test": {"dns_name": "api.example.com", "timeout_seconds": 120}
+type SmokeTest struct {
+	DNSName        string `json:"dns_name,omitempty"`        // Resolved from the pod sandbox, the cluster URL host if not set
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"` // Maximum time for the kubelet and the pod network to be ready, 120 if not set
+}
+
+const defaultSmokeTestTimeout = 2 * time.Minute
+
+// kubeletHealthzURL is the healthz endpoint of the kubelet
+var kubeletHealthzURL = "http://127.0.0.1:10248/healthz"
+
+// smokeTestSandboxName is the name of the pod sandbox created by the smoke test
+const smokeTestSandboxName = "scw-k8s-agent-smoke-test"
+
+// smokeTestSandboxRetryInterval is the delay between the pod sandbox creations, eg: while the CNI
+// DaemonSet of a fresh node has not written its configuration yet
+var smokeTestSandboxRetryInterval = 5 * time.Second
+
+// defaultResolvConf is the resolv.conf of the pods with the Default DNS policy if the node metadata has none
+const defaultResolvConf = "/etc/resolv.conf"
+
+// dnsQueryTimeout is the timeout of each DNS query of the smoke test
+const dnsQueryTimeout = 5 * time.Second
+
+// dnsPort is the port of the nameservers
+var dnsPort = "53"
+
+// errSmokeTest is returned when the node smoke test fails after the install
+var errSmokeTest = errors.New("node smoke test failed")
+
+func (s SmokeTest) timeout() time.Duration {
+	if s.TimeoutSeconds <= 0 {
+		return defaultSmokeTestTimeout
+	}
+	return time.Duration(s.TimeoutSeconds) * time.Second
+}
+
+// dnsName returns the name resolved by the smoke test
+func (s SmokeTest) dnsName(clusterURL string) (string, error) {
+	if s.DNSName != "" {
+		return s.DNSName, nil
+	}
+	parsedURL, err := url.Parse(clusterURL)
+	if err != nil || parsedURL.Hostname() == "" || net.ParseIP(parsedURL.Hostname()) != nil {
+		return "", fmt.Errorf("no DNS name to resolve in the cluster URL, set dns_name")
+	}
+	return parsedURL.Hostname(), nil
+}
+
+// runSmokeTest checks the installed node works: the kubelet is healthy, a pod sandbox is created and
+// destroyed through the CRI, and the DNS resolves from the network namespace of the sandbox with the
+// resolver of the pods
+func runSmokeTest(ctx context.Context, smokeTest SmokeTest, clusterURL, resolvConfPath string) error {
+	// Fail early if there is nothing to resolve
+	dnsName, err := smokeTest.dnsName(clusterURL)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSmokeTest, err)
+	}
+	dnsConfig, err := podDNSConfig(resolvConfPath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSmokeTest, err)
+	}
+
+	// The kubelet and the pod network must be ready within the timeout, eg: the CNI DaemonSet
+	slog.Info("Running node smoke test")
+	ctx, cancel := context.WithTimeout(ctx, smokeTest.timeout())
+	defer cancel()
+	err = waitForKubeletHealthz(ctx, smokeTest.timeout())
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSmokeTest, err)
+	}
+
+	// Create the pod sandbox, removed whatever the result
+	client, conn, err := newCRIClient()
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSmokeTest, err)
+	}
+	defer func() { _ = conn.Close() }()
+	sandboxID, err := runSmokeTestSandbox(ctx, client, dnsConfig)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSmokeTest, err)
+	}
+	defer removeSmokeTestSandbox(client, sandboxID)
+
+	netns, err := sandboxNetworkNamespace(ctx, client, sandboxID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSmokeTest, err)
+	}
+	addresses, err := resolveFromNetworkNamespace(ctx, netns, dnsConfig.Servers, dnsName)
+	if err != nil {
+		return fmt.Errorf("%w: failed to resolve %s from the pod network: %w", errSmokeTest, dnsName, err)
+	}
+
+	slog.Info("Node smoke test passed", slog.String("dns_name", dnsName), slog.Any("addresses", addresses))
+	return nil
+}
+
+// waitForKubeletHealthz waits for the kubelet healthz endpoint to answer ok
+func waitForKubeletHealthz(ctx context.Context, timeout time.Duration) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	var lastErr error
+	err := wait.PollUntilContextTimeout(ctx, 2*time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		lastErr = checkKubeletHealthz(ctx, client)
+		return lastErr == nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("kubelet not healthy after %s: %w", timeout, lastErr)
+	}
+	return nil
+}
+
+func checkKubeletHealthz(ctx context.Context, client *http.Client) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, kubeletHealthzURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get kubelet healthz: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubelet healthz returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// runSmokeTestSandbox creates the pod sandbox of the smoke test, it returns its ID. The creation is retried
+// until the context is done, the pod network is not ready until the CNI configuration is written.
+func runSmokeTestSandbox(ctx context.Context, client runtimeapi.RuntimeServiceClient, dnsConfig *runtimeapi.DNSConfig) (string, error) {
+	config := &runtimeapi.PodSandboxConfig{
+		Metadata: &runtimeapi.PodSandboxMetadata{
+			Name:      smokeTestSandboxName,
+			Namespace: "kube-system",
+			Uid:       fmt.Sprintf("%s-%d", smokeTestSandboxName, time.Now().UnixNano()),
+		},
+		DnsConfig: dnsConfig,
+		Linux:     &runtimeapi.LinuxPodSandboxConfig{},
+	}
+
+	var sandboxID string
+	var lastErr error
+	err := wait.PollUntilContextCancel(ctx, smokeTestSandboxRetryInterval, true, func(ctx context.Context) (bool, error) {
+		response, err := client.RunPodSandbox(ctx, &runtimeapi.RunPodSandboxRequest{Config: config})
+		if err != nil {
+			lastErr = err
+			config.Metadata.Attempt++
+			slog.Info("Waiting for pod network", slog.Duration("retry_in", smokeTestSandboxRetryInterval), slog.String("reason", grpcstatus.Convert(err).Message()))
+			return false, nil
+		}
+		sandboxID = response.PodSandboxId
+		return true, nil
+	})
+	if err != nil && lastErr != nil {
+		return "", fmt.Errorf("failed to create pod sandbox: %w", lastErr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create pod sandbox: %w", err)
+	}
+	return sandboxID, nil
+}
+
+// sandboxNetworkNamespace returns the network namespace path of the pod sandbox
+func sandboxNetworkNamespace(ctx context.Context, client runtimeapi.RuntimeServiceClient, sandboxID string) (string, error) {
+	response, err := client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{PodSandboxId: sandboxID, Verbose: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect pod sandbox: %w", err)
+	}
+	return parseSandboxNetworkNamespace([]byte(response.Info["info"]))
+}
+
+// parseSandboxNetworkNamespace returns the network namespace path of the verbose pod sandbox info
+func parseSandboxNetworkNamespace(info []byte) (string, error) {
+	var inspect struct {
+		RuntimeSpec struct {
+			Linux struct {
+				Namespaces []struct {
+					Type string `json:"type"`
+					Path string `json:"path"`
+				} `json:"namespaces"`
+			} `json:"linux"`
+		} `json:"runtimeSpec"`
+	}
+	err := json.Unmarshal(info, &inspect)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal pod sandbox: %w", err)
+	}
+	for _, namespace := range inspect.RuntimeSpec.Linux.Namespaces {
+		if namespace.Type == "network" && namespace.Path != "" {
+			return namespace.Path, nil
+		}
+	}
+	return "", fmt.Errorf("pod sandbox has no network namespace")
+}
+
+// removeSmokeTestSandbox stops and removes the pod sandbox, a sandbox left behind is only logged
+func removeSmokeTestSandbox(client runtimeapi.RuntimeServiceClient, sandboxID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), criRemoveTimeout)
+	defer cancel()
+
+	_, err := client.StopPodSandbox(ctx, &runtimeapi.StopPodSandboxRequest{PodSandboxId: sandboxID})
+	if err == nil {
+		_, err = client.RemovePodSandbox(ctx, &runtimeapi.RemovePodSandboxRequest{PodSandboxId: sandboxID})
+	}
+	if err != nil {
+		slog.Warn("Failed to remove smoke test pod sandbox", slog.String("sandbox", sandboxID), slog.Any("error", err))
+	}
+}
+
+// podDNSConfig returns the DNS configuration of the pods with the Default DNS policy, from the resolv.conf
+// of the kubelet
+func podDNSConfig(resolvConfPath string) (*runtimeapi.DNSConfig, error) {
+	if resolvConfPath == "" {
+		resolvConfPath = defaultResolvConf
+	}
+	data, err := os.ReadFile(hostPath(resolvConfPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pod resolv.conf: %w", err)
+	}
+
+	config := &runtimeapi.DNSConfig{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			config.Servers = append(config.Servers, fields[1])
+		case "search":
+			config.Searches = fields[1:]
+		case "options":
+			config.Options = append(config.Options, fields[1:]...)
+		}
+	}
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("no nameserver in %s", resolvConfPath)
+	}
+	return config, nil
+}
+
+// resolveFromNetworkNamespace resolves the name with the first nameserver answering, queried from the
+// network namespace. The hosts file of the agent is not used.
+func resolveFromNetworkNamespace(ctx context.Context, netns string, servers []string, name string) ([]string, error) {
+	var errs []error
+	for _, server := range servers {
+		addresses, err := queryNameserver(ctx, netns, server, name)
+		if err == nil {
+			return addresses, nil
+		}
+		errs = append(errs, fmt.Errorf("nameserver %s: %w", server, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// queryNameserver queries the A and AAAA records of the name to the nameserver, from the network namespace
+func queryNameserver(ctx context.Context, netns, server, name string) ([]string, error) {
+	fqdn, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS name %s: %w", name, err)
+	}
+
+	var addresses []string
+	for _, queryType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		query := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: fqdn, Type: queryType, Class: dnsmessage.ClassINET}},
+		}
+		packed, err := query.Pack()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pack DNS query: %w", err)
+		}
+		conn, err := dialFromNetworkNamespace(ctx, netns, "udp", net.JoinHostPort(server, dnsPort))
+		if err != nil {
+			return nil, err
+		}
+		response, err := exchangeDNS(conn, packed)
+		_ = conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		if response.ID != query.ID || response.RCode != dnsmessage.RCodeSuccess {
+			return nil, fmt.Errorf("%s query failed: %s", queryType, response.RCode)
+		}
+		for _, answer := range response.Answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addresses = append(addresses, netip.AddrFrom4(body.A).String())
+			case *dnsmessage.AAAAResource:
+				addresses = append(addresses, netip.AddrFrom16(body.AAAA).String())
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no address for %s", name)
+	}
+	return addresses, nil
+}
+
+// exchangeDNS sends the DNS query and returns the response
+func exchangeDNS(conn net.Conn, query []byte) (dnsmessage.Message, error) {
+	err := conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("failed to set DNS query deadline: %w", err)
+	}
+	_, err = conn.Write(query)
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("failed to send DNS query: %w", err)
+	}
+	buffer := make([]byte, 1232)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("failed to read DNS response: %w", err)
+	}
+	var response dnsmessage.Message
+	err = response.Unpack(buffer[:n])
+	if err != nil {
+		return dnsmessage.Message{}, fmt.Errorf("failed to parse DNS response: %w", err)
+	}
+	return response, nil
+}
+
+// dialFromNetworkNamespace dials the address from the network namespace: a socket belongs to the network
+// namespace of the thread creating it, so it is created by a thread entering the namespace
+func dialFromNetworkNamespace(ctx context.Context, netns, network, address string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		// A thread left in the pod network namespace exits with the goroutine
+		runtime.LockOSThread()
+		conn, err := dialInNetworkNamespace(ctx, netns, network, address)
+		result <- dialResult{conn: conn, err: err}
+	}()
+	dialed := <-result
+	return dialed.conn, dialed.err
+}
+
+// dialInNetworkNamespace dials the address with the locked thread in the network namespace, and unlocks
+// the thread unless it could not be restored to the agent network namespace
+func dialInNetworkNamespace(ctx context.Context, netns, network, address string) (net.Conn, error) {
+	restored := true
+	defer func() {
+		if restored {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	origin, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open agent network namespace: %w", err)
+	}
+	defer func() { _ = origin.Close() }()
+	target, err := os.Open(netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pod network namespace: %w", err)
+	}
+	defer func() { _ = target.Close() }()
+
+	err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enter pod network namespace: %w", err)
+	}
+	var dialer net.Dialer
+	conn, dialErr := dialer.DialContext(ctx, network, address)
+	restored = unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET) == nil
+	if dialErr != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, dialErr)
+	}
+	return conn, nil
+}
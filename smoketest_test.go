@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestSmokeTestDNSName(t *testing.T) {
+	tests := []struct {
+		name       string
+		smokeTest  SmokeTest
+		clusterURL string
+		expected   string
+		err        bool
+	}{
+		{name: "dns name", smokeTest: SmokeTest{DNSName: "scaleway.com"}, clusterURL: "https://10.0.0.1:6443", expected: "scaleway.com"},
+		{name: "cluster URL host", clusterURL: "https://0123.api.k8s.fr-par.scw.cloud:6443", expected: "0123.api.k8s.fr-par.scw.cloud"},
+		{name: "cluster URL address", clusterURL: "https://10.0.0.1:6443", err: true},
+		{name: "no cluster URL", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, err := test.smokeTest.dnsName(test.clusterURL)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name != test.expected {
+				t.Errorf("dns name = %q, expected %q", name, test.expected)
+			}
+		})
+	}
+}
+
+func TestWaitForKubeletHealthz(t *testing.T) {
+	defer func(original string) { kubeletHealthzURL = original }(kubeletHealthzURL)
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 2 {
+			http.Error(w, "[-]syncloop failed", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	kubeletHealthzURL = server.URL
+
+	err := waitForKubeletHealthz(context.Background(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The last failure is reported once the timeout is exceeded
+	calls = -100
+	err = waitForKubeletHealthz(context.Background(), time.Second)
+	if err == nil || !strings.Contains(err.Error(), "syncloop failed") {
+		t.Errorf("expected the healthz failure, got %v", err)
+	}
+}
+
+func TestRunSmokeTestWithoutDNSName(t *testing.T) {
+	err := runSmokeTest(context.Background(), SmokeTest{}, "https://10.0.0.1:6443", "")
+	if !errors.Is(err, errSmokeTest) {
+		t.Errorf("expected a smoke test error, got %v", err)
+	}
+}
+
+func TestParseSandboxNetworkNamespace(t *testing.T) {
+	info := `{"pid": 1234, "runtimeSpec": {"linux": {"namespaces": [
+  {"type": "pid"},
+  {"type": "network", "path": "/var/run/netns/cni-1234"}
+]}}}`
+	netns, err := parseSandboxNetworkNamespace([]byte(info))
+	if err != nil || netns != "/var/run/netns/cni-1234" {
+		t.Errorf("unexpected network namespace %q, %v", netns, err)
+	}
+
+	_, err = parseSandboxNetworkNamespace([]byte(`{"runtimeSpec": {"linux": {"namespaces": [{"type": "network"}]}}}`))
+	if err == nil {
+		t.Error("expected an error without network namespace path")
+	}
+}
+
+func TestRunSmokeTestSandbox(t *testing.T) {
+	defer func(previousRoot string, previousInterval time.Duration) {
+		rootDir, smokeTestSandboxRetryInterval = previousRoot, previousInterval
+	}(rootDir, smokeTestSandboxRetryInterval)
+	rootDir = t.TempDir()
+	smokeTestSandboxRetryInterval = 10 * time.Millisecond
+	serveFakeCRI(t)
+	client, conn, err := newCRIClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// The sandbox creation is retried until the pod network is ready
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	sandboxID, err := runSmokeTestSandbox(ctx, client, &runtimeapi.DNSConfig{Servers: []string{"10.0.0.2"}})
+	if err != nil || sandboxID != "sandbox" {
+		t.Fatalf("expected the sandbox created, got %q, %v", sandboxID, err)
+	}
+	netns, err := sandboxNetworkNamespace(ctx, client, sandboxID)
+	if err != nil || netns != "/var/run/netns/cni-sandbox" {
+		t.Errorf("unexpected network namespace %q, %v", netns, err)
+	}
+	removeSmokeTestSandbox(client, sandboxID)
+
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "cri RunPodSandbox scw-k8s-agent-smoke-test\ncri RunPodSandbox scw-k8s-agent-smoke-test\ncri StopPodSandbox sandbox\ncri RemovePodSandbox sandbox\n"
+	if string(commands) != expected {
+		t.Errorf("commands = %q, expected %q", commands, expected)
+	}
+}
+
+func TestPodDNSConfig(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+
+	err := os.MkdirAll(filepath.Join(rootDir, "/run/systemd/resolve"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(rootDir, "/run/systemd/resolve/resolv.conf"), []byte("# Uplink DNS\nnameserver 10.194.3.3\nnameserver fd00::3\nsearch fr-par-1.internal\noptions edns0 trust-ad\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := podDNSConfig("/run/systemd/resolve/resolv.conf")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &runtimeapi.DNSConfig{Servers: []string{"10.194.3.3", "fd00::3"}, Searches: []string{"fr-par-1.internal"}, Options: []string{"edns0", "trust-ad"}}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("config = %+v, expected %+v", config, expected)
+	}
+
+	_, err = podDNSConfig("")
+	if err == nil {
+		t.Error("expected an error without resolv.conf")
+	}
+}
+
+func TestResolveFromNetworkNamespace(t *testing.T) {
+	defer func(original string) { dnsPort = original }(dnsPort)
+
+	// The nameserver answers the A query, there is no AAAA record
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = server.Close() }()
+	_, dnsPort, _ = net.SplitHostPort(server.LocalAddr().String())
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buffer[:n]) != nil {
+				continue
+			}
+			response := dnsmessage.Message{Header: dnsmessage.Header{ID: query.ID, Response: true}, Questions: query.Questions}
+			if query.Questions[0].Type == dnsmessage.TypeA {
+				response.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{51, 15, 0, 1}},
+				}}
+			}
+			packed, _ := response.Pack()
+			_, _ = server.WriteTo(packed, addr)
+		}
+	}()
+
+	// Entering the network namespace of the test, which needs CAP_SYS_ADMIN
+	addresses, err := resolveFromNetworkNamespace(context.Background(), "/proc/self/ns/net", []string{"127.0.0.2", "127.0.0.1"}, "api.example.com")
+	if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skip("entering a network namespace is not permitted")
+	}
+	if err != nil || !reflect.DeepEqual(addresses, []string{"51.15.0.1"}) {
+		t.Errorf("expected the address from the second nameserver, got %q, %v", addresses, err)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// snapshotsDir is where the configuration snapshots are stored, one tar.gz archive per snapshot
+var snapshotsDir = filepath.Join(stateDir, "snapshots")
+
+// snapshotsToKeep is the number of snapshots kept, older ones are removed
+const snapshotsToKeep = 3
+
+// snapshotPaths are the critical configuration paths archived before an upgrade, with the files managed
+// by the components, so a restore brings back the installed versions with their files
+var snapshotPaths = []string{
+	versionsFile,
+	managedFilesFile,
+	componentSourcesFile,
+	componentReposFile,
+	"/etc/kubernetes",
+	"/var/lib/kubelet/config.yaml",
+	"/etc/containerd",
+	"/etc/cni/net.d",
+	"/etc/systemd/system",
+}
+
+// snapshotRestartServices are the services restarted after a snapshot is restored, in order
+var snapshotRestartServices = []string{"containerd", "kubelet"}
+
+// createSnapshot archives the critical configuration paths into a timestamped snapshot
+func createSnapshot() (string, error) {
+	err := os.MkdirAll(hostPath(snapshotsDir), 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshots directory: %w", err)
+	}
+
+	snapshotPath := filepath.Join(snapshotsDir, time.Now().UTC().Format("20060102T150405Z")+".tar.gz")
+	snapshotFile, err := os.OpenFile(hostPath(snapshotPath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+
+	err = writeSnapshot(snapshotFile)
+	closeErr := snapshotFile.Close()
+	if err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close snapshot file: %w", closeErr)
+	}
+	if err != nil {
+		// Never leave a truncated snapshot, it would be restored
+		_ = os.Remove(hostPath(snapshotPath))
+		return "", err
+	}
+
+	// Remove the oldest snapshots
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return "", err
+	}
+	for len(snapshots) > snapshotsToKeep {
+		err = os.Remove(hostPath(snapshots[0]))
+		if err != nil {
+			return "", fmt.Errorf("failed to remove old snapshot: %w", err)
+		}
+		snapshots = snapshots[1:]
+	}
+
+	return snapshotPath, nil
+}
+
+// writeSnapshot archives the critical configuration paths and the managed files into the snapshot file
+func writeSnapshot(snapshotFile io.Writer) error {
+	paths, err := snapshotManagedPaths()
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(snapshotFile)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	// Archive every path, missing paths are ignored since not all nodes have all components
+	for _, path := range paths {
+		err = filepath.WalkDir(hostPath(path), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return addToSnapshot(tarWriter, nodePath(path))
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to archive %s: %w", path, err)
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close snapshot archive: %w", err)
+	}
+	err = gzipWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close snapshot compression: %w", err)
+	}
+
+	return nil
+}
+
+// snapshotManagedPaths returns the snapshot paths and the managed files out of them, eg: the binaries
+func snapshotManagedPaths() ([]string, error) {
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := slices.Clone(snapshotPaths)
+	for _, path := range slices.Sorted(maps.Keys(managedFiles)) {
+		if !slices.ContainsFunc(snapshotPaths, func(snapshotPath string) bool { return isUnder(path, snapshotPath) }) {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, nil
+}
+
+// isUnder returns true if the path is the directory or under it
+func isUnder(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// addToSnapshot adds a single file, directory or symlink to the snapshot archive
+func addToSnapshot(tarWriter *tar.Writer, path string) error {
+	info, err := os.Lstat(hostPath(path))
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err = os.Readlink(hostPath(path))
+		if err != nil {
+			return fmt.Errorf("failed to read link %s: %w", path, err)
+		}
+	}
+
+	// Skip sockets, devices and other special files
+	if !info.Mode().IsRegular() && !info.IsDir() && link == "" {
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fmt.Errorf("failed to create header for %s: %w", path, err)
+	}
+	header.Name = strings.TrimPrefix(path, "/")
+
+	err = tarWriter.WriteHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to write header for %s: %w", path, err)
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(hostPath(path))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	_, err = io.Copy(tarWriter, file)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to archive %s: %w", path, err)
+	}
+
+	return file.Close()
+}
+
+// listSnapshots returns the snapshots paths, from the oldest to the most recent
+func listSnapshots() ([]string, error) {
+	snapshots, err := filepath.Glob(hostPath(filepath.Join(snapshotsDir, "*.tar.gz")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for i, snapshot := range snapshots {
+		snapshots[i] = nodePath(snapshot)
+	}
+	slices.Sort(snapshots)
+
+	return snapshots, nil
+}
+
+// restoreLatestSnapshot extracts the most recent snapshot and restarts the affected services
+func restoreLatestSnapshot() (string, error) {
+	snapshots, err := listSnapshots()
+	if err != nil {
+		return "", err
+	}
+	if len(snapshots) == 0 {
+		return "", fmt.Errorf("no snapshot found in %s", snapshotsDir)
+	}
+	snapshotPath := snapshots[len(snapshots)-1]
+
+	// The files managed since the snapshot, eg: added by the upgrade, are removed once it is restored
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		return "", err
+	}
+
+	err = extractSnapshot(snapshotPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract snapshot %s: %w", snapshotPath, err)
+	}
+
+	err = removeFilesManagedSince(managedFiles)
+	if err != nil {
+		return "", err
+	}
+
+	// Daemon-reload to pick up the restored service files
+	cmd := command("/usr/bin/systemctl", "daemon-reload")
+	err = cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("failed to daemon-reload: %w", err)
+	}
+
+	for _, service := range snapshotRestartServices {
+		cmd = command("/usr/bin/systemctl", "try-restart", service)
+		err = cmd.Run()
+		if err != nil {
+			return "", fmt.Errorf("failed to restart service %s: %w", service, err)
+		}
+		slog.Info("Service restarted", slog.String("service", service))
+	}
+
+	return snapshotPath, nil
+}
+
+// removeFilesManagedSince removes the files of the previous managed files which are not managed by the
+// restored snapshot
+func removeFilesManagedSince(previousManagedFiles map[string]string) error {
+	managedFiles, err := loadManagedFiles()
+	if err != nil {
+		return err
+	}
+
+	for path := range previousManagedFiles {
+		if _, ok := managedFiles[path]; ok {
+			continue
+		}
+		err = os.Remove(hostPath(path))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		slog.Info("File removed", slog.String("path", path))
+	}
+
+	return nil
+}
+
+// extractSnapshot extracts a snapshot archive at the root of the filesystem
+func extractSnapshot(snapshotPath string) error {
+	snapshotFile, err := os.Open(hostPath(snapshotPath))
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer func() { _ = snapshotFile.Close() }()
+
+	gzipReader, err := gzip.NewReader(snapshotFile)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot compression: %w", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot archive: %w", err)
+		}
+
+		// Refuse paths escaping the root
+		if !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("invalid path in snapshot: %s", header.Name)
+		}
+		path := filepath.Join("/", header.Name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(hostPath(path), header.FileInfo().Mode().Perm())
+		case tar.TypeSymlink:
+			err = os.Remove(hostPath(path))
+			if err == nil || errors.Is(err, fs.ErrNotExist) {
+				err = os.Symlink(header.Linkname, hostPath(path))
+			}
+		case tar.TypeReg:
+			err = extractSnapshotFile(tarReader, path, header.FileInfo().Mode().Perm())
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+
+		err = os.Lchown(hostPath(path), header.Uid, header.Gid)
+		if err != nil {
+			return fmt.Errorf("failed to chown %s: %w", path, err)
+		}
+		slog.Info("File restored", slog.String("path", path))
+	}
+
+	return nil
+}
+
+// extractSnapshotFile writes the file next to its path and renames it, so the running binaries are
+// replaced instead of written in place
+func extractSnapshotFile(reader io.Reader, path string, mode fs.FileMode) error {
+	tmp := path + ".snapshot-tmp"
+	file, err := os.OpenFile(hostPath(tmp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, reader)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(hostPath(tmp))
+		return err
+	}
+
+	err = file.Close()
+	if err == nil {
+		// The mode is only set at creation, ensure it for an existing temporary file
+		err = os.Chmod(hostPath(tmp), mode)
+	}
+	if err == nil {
+		err = os.Rename(hostPath(tmp), hostPath(path))
+	}
+	if err != nil {
+		_ = os.Remove(hostPath(tmp))
+		return err
+	}
+
+	return nil
+}
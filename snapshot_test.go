@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	writeFiles := func(files map[string]string) {
+		t.Helper()
+		for path, content := range files {
+			err := os.MkdirAll(hostPath(filepath.Dir(path)), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(hostPath(path), []byte(content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Installed node
+	writeFiles(map[string]string{
+		versionsFile:                   `{"kubelet":"1.31.4"}`,
+		"/etc/kubernetes/kubelet.conf": "v1.31.4 config",
+		"/usr/bin/kubelet":             "v1.31.4 binary",
+	})
+	err := saveManagedFiles(map[string]string{"/etc/kubernetes/kubelet.conf": "kubelet", "/usr/bin/kubelet": "kubelet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotPath, err := createSnapshot()
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+
+	// Upgraded node, with a file added by the new version
+	writeFiles(map[string]string{
+		versionsFile:                   `{"kubelet":"1.32.0"}`,
+		"/etc/kubernetes/kubelet.conf": "v1.32.0 config",
+		"/usr/bin/kubelet":             "v1.32.0 binary",
+		"/usr/bin/kubelet-helper":      "v1.32.0 helper",
+	})
+	err = recordManagedFile("/usr/bin/kubelet-helper", "kubelet")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The restore brings back the versions with their files, and removes the added file
+	restoredPath, err := restoreLatestSnapshot()
+	if err != nil || restoredPath != snapshotPath {
+		t.Fatalf("expected snapshot %s restored, got %s, %v", snapshotPath, restoredPath, err)
+	}
+	for path, expected := range map[string]string{
+		versionsFile:                   `{"kubelet":"1.31.4"}`,
+		"/etc/kubernetes/kubelet.conf": "v1.31.4 config",
+		"/usr/bin/kubelet":             "v1.31.4 binary",
+	} {
+		content, err := os.ReadFile(hostPath(path))
+		if err != nil || string(content) != expected {
+			t.Errorf("expected %s restored to %q, got %q, %v", path, expected, content, err)
+		}
+	}
+	_, err = os.Stat(hostPath("/usr/bin/kubelet-helper"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the added file removed, got %v", err)
+	}
+	managedFiles, err := loadManagedFiles()
+	if err != nil || len(managedFiles) != 2 {
+		t.Errorf("expected the managed files restored, got %v, %v", managedFiles, err)
+	}
+}
+
+func TestSnapshotFailureRemoved(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	// A snapshot which cannot be completed is not left behind
+	err := os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(hostPath(managedFilesFile), []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = createSnapshot()
+	if err == nil {
+		t.Fatal("expected the snapshot to fail")
+	}
+	snapshots, err := listSnapshots()
+	if err != nil || len(snapshots) != 0 {
+		t.Errorf("expected no snapshot left, got %v, %v", snapshots, err)
+	}
+}
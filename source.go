@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/scaleway/k8s-agent/repo"
+)
+
+// ComponentSource installs the component from a single file downloaded from a direct URL, bypassing
+// the repository, eg: to distribute an emergency hotfix without cutting a repository release
+//
+//	versions:
+//	  1.31.2:
+//	    - name: containerd
+//	      version: 1.7.23-hotfix1
+//	      source:
+//	        url: https://hotfixes.example.com/containerd
+//	        sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//	        dst: /usr/local/bin/containerd
+//	        mode: "0755"
+//	        restart: [containerd]
+type ComponentSource struct {
+	URL     string   `json:"url" yaml:"url"`
+	SHA256  string   `json:"sha256" yaml:"sha256"`
+	Dst     string   `json:"dst" yaml:"dst"`
+	Mode    string   `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Owner   string   `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group   string   `json:"group,omitempty" yaml:"group,omitempty"`
+	Restart []string `json:"restart,omitempty" yaml:"restart,omitempty"` // Services restarted after the install
+}
+
+// installedSource is the source a component was installed from, with the version installed from the
+// repository it replaced in place, uninstalled once the component is installed from the repository again
+type installedSource struct {
+	ComponentSource
+	ReplacedVersion string `json:"replaced_version,omitempty"`
+	ReplacedRepo    string `json:"replaced_repo,omitempty"`
+}
+
+// sourceRepoPrefix prefixes the source URL recorded as the repository of the components installed from a source
+const sourceRepoPrefix = "source+"
+
+// componentSourcesFile records the source each component was installed from, so the source file is
+// removed once the component is installed from the repository again or uninstalled
+var componentSourcesFile = filepath.Join(stateDir, "component-sources.json")
+
+// sourceDownloadTimeout is the timeout of the source file download, the file may be a large binary
+const sourceDownloadTimeout = 10 * time.Minute
+
+// Validate checks the source is complete, the file is always verified against its digest
+func (s ComponentSource) Validate() error {
+	parsedURL, err := url.Parse(s.URL)
+	if err != nil || (parsedURL.Scheme != "https" && parsedURL.Scheme != "http") || parsedURL.Host == "" {
+		return fmt.Errorf("invalid source url %q", s.URL)
+	}
+
+	sum, err := hex.DecodeString(s.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("invalid source sha256 %q", s.SHA256)
+	}
+
+	if !filepath.IsAbs(s.Dst) || filepath.Clean(s.Dst) != s.Dst {
+		return fmt.Errorf("invalid source dst %q, expected a clean absolute path", s.Dst)
+	}
+
+	return nil
+}
+
+// installComponentSource downloads and verifies the source file, installs it and restarts the services
+func installComponentSource(ctx context.Context, logger *slog.Logger, name, version string, source ComponentSource) error {
+	err := source.Validate()
+	if err != nil {
+		return err
+	}
+
+	content, err := downloadSource(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	installed, err := replacedInstall(name, source)
+	if err != nil {
+		return err
+	}
+
+	// The file is taken over from the component previous install, if any
+	err = installContent(source.Dst, content, source.Mode, source.Owner, source.Group)
+	if err != nil {
+		return fmt.Errorf("failed to write file %s: %w", source.Dst, err)
+	}
+	err = recordManagedFile(source.Dst, name)
+	if err != nil {
+		return fmt.Errorf("failed to record managed file %s: %w", source.Dst, err)
+	}
+	logger.Info("Source file installed", slog.String("file", source.Dst), slog.String("url", source.URL))
+
+	// Daemon-reload in case the source file is a unit
+	cmd := command("/usr/bin/systemctl", "daemon-reload")
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to daemon-reload: %w", err)
+	}
+
+	for _, service := range source.Restart {
+		cmd = command("/usr/bin/systemctl", "restart", service)
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("failed to restart service %s: %w", service, err)
+		}
+		logger.Info("Service restarted", slog.String("service", service))
+	}
+
+	// Store the component version and its source in place of the repository
+	err = SetComponentVersion(name, version)
+	if err != nil {
+		return fmt.Errorf("failed to store component version: %w", err)
+	}
+	err = recordComponentSource(name, &installed)
+	if err != nil {
+		return err
+	}
+
+	return recordComponentRepo(name, sourceRepoPrefix+source.URL)
+}
+
+// replacedInstall returns the source install recording the version installed from the repository it
+// replaces, or the one replaced by the previous source
+func replacedInstall(name string, source ComponentSource) (installedSource, error) {
+	installed := installedSource{ComponentSource: source}
+
+	componentSources, err := loadComponentSources()
+	if err != nil {
+		return installedSource{}, err
+	}
+	if previous, ok := componentSources[name]; ok {
+		installed.ReplacedVersion, installed.ReplacedRepo = previous.ReplacedVersion, previous.ReplacedRepo
+		return installed, nil
+	}
+
+	version, err := GetComponentVersion(name)
+	if err != nil {
+		return installedSource{}, fmt.Errorf("failed to get component version: %w", err)
+	}
+	if version == "" || version == "uninstalled" {
+		return installed, nil
+	}
+	componentRepos, err := loadComponentRepos()
+	if err != nil {
+		return installedSource{}, err
+	}
+	installed.ReplacedVersion, installed.ReplacedRepo = version, componentRepos[name]
+
+	return installed, nil
+}
+
+func loadComponentSources() (map[string]installedSource, error) {
+	componentSources := make(map[string]installedSource)
+
+	jsonSources, err := os.ReadFile(hostPath(componentSourcesFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return componentSources, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read component sources: %w", err)
+	}
+
+	err = json.Unmarshal(jsonSources, &componentSources)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal component sources: %w", err)
+	}
+
+	return componentSources, nil
+}
+
+// recordComponentSource records the source the component was installed from, or forgets it if nil
+func recordComponentSource(name string, source *installedSource) error {
+	componentSources, err := loadComponentSources()
+	if err != nil {
+		return err
+	}
+	if source == nil {
+		delete(componentSources, name)
+	} else {
+		componentSources[name] = *source
+	}
+
+	jsonSources, err := json.Marshal(componentSources)
+	if err != nil {
+		return fmt.Errorf("failed to marshal component sources: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	err = writeFileSync(componentSourcesFile, jsonSources, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write component sources: %w", err)
+	}
+
+	return nil
+}
+
+// uninstallComponentSource removes the file of the source the component was installed from, unless it
+// is the destination of the next source which replaces it in place. Once the component is installed
+// from the repository again, the version the source replaced is recorded back and returned, so it is
+// uninstalled from the repository it was installed from.
+func uninstallComponentSource(logger *slog.Logger, name string, next *ComponentSource) (string, error) {
+	componentSources, err := loadComponentSources()
+	if err != nil {
+		return "", err
+	}
+	source, ok := componentSources[name]
+	if !ok {
+		return "", nil
+	}
+
+	if next == nil || next.Dst != source.Dst {
+		err = os.Remove(hostPath(source.Dst))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("failed to remove source file %s: %w", source.Dst, err)
+		}
+		err = forgetManagedFile(source.Dst)
+		if err != nil {
+			return "", fmt.Errorf("failed to forget managed file %s: %w", source.Dst, err)
+		}
+		logger.Info("Source file removed", slog.String("file", source.Dst))
+	}
+
+	// The next source keeps the replaced version
+	if next != nil {
+		return "", nil
+	}
+
+	if source.ReplacedVersion != "" {
+		err = SetComponentVersion(name, source.ReplacedVersion)
+		if err != nil {
+			return "", fmt.Errorf("failed to store component version: %w", err)
+		}
+		err = recordComponentRepo(name, source.ReplacedRepo)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return source.ReplacedVersion, recordComponentSource(name, nil)
+}
+
+// downloadSource downloads the source file and verifies its digest
+func downloadSource(ctx context.Context, source ComponentSource) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, sourceDownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", source.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download source %s: %w", source.URL, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("failed to download source %s: %v", source.URL, resp.Status)
+	}
+
+	content, err := repo.ReadAllWithProgress(resp.Body, source.URL, resp.ContentLength)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("failed to read source %s: %w", source.URL, err)
+	}
+
+	err = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close response body: %w", err)
+	}
+
+	sum := sha256.Sum256(content)
+	if digest := hex.EncodeToString(sum[:]); !strings.EqualFold(digest, source.SHA256) {
+		return nil, fmt.Errorf("source digest mismatch: expected %s, got %s", source.SHA256, digest)
+	}
+
+	return content, nil
+}
+
+// sourceDisruption returns the disruption level of the source install
+func sourceDisruption(source ComponentSource) string {
+	disruption := disruptionNone
+	for _, service := range source.Restart {
+		if slices.Contains(verifiedServices, service) {
+			return disruptionNode
+		}
+		disruption = disruptionService
+	}
+	return disruption
+}
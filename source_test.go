@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestUninstallComponentSource(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	for _, path := range []string{"/etc/containerd/config.toml", "/usr/bin/containerd", "/usr/local/bin/containerd"} {
+		err := os.MkdirAll(filepath.Dir(hostPath(path)), 0755)
+		if err == nil {
+			err = os.WriteFile(hostPath(path), []byte("content"), 0644)
+		}
+		if err == nil {
+			err = recordManagedFile(path, "containerd")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	repoFS := fstest.MapFS{
+		"containerd/metadata.yaml": {Data: []byte(`versions:
+  1.7.22:
+    uninstall:
+      - files:
+          - state: absent
+            dst: /etc/containerd/config.toml
+`)},
+	}
+	nodeMetadata := NodeMetadata{RepoURI: "https://repo"}
+	exists := func(path string) bool {
+		_, err := os.Stat(hostPath(path))
+		return err == nil
+	}
+
+	// The source replaces the binary in place, the repository version is not uninstalled
+	err := SetComponentVersion("containerd", "1.7.22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ComponentSource{URL: "https://hotfixes.example.com/containerd", Dst: "/usr/bin/containerd"}
+	err = uninstallComponents(context.Background(), repoFS, []Component{{Name: "containerd", Version: "1.7.23-hotfix1", Source: source}}, nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to uninstall components: %v", err)
+	}
+	if !exists("/etc/containerd/config.toml") || !exists("/usr/bin/containerd") {
+		t.Error("expected the repository version files kept")
+	}
+
+	// The next source with another destination removes the previous source file
+	err = SetComponentVersion("containerd", "1.7.23-hotfix1")
+	if err == nil {
+		err = recordComponentSource("containerd", &installedSource{ComponentSource: ComponentSource{URL: source.URL, Dst: "/usr/local/bin/containerd"}, ReplacedVersion: "1.7.22", ReplacedRepo: "https://repo"})
+	}
+	if err == nil {
+		err = recordComponentRepo("containerd", sourceRepoPrefix+source.URL)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uninstallComponents(context.Background(), repoFS, []Component{{Name: "containerd", Version: "1.7.23-hotfix2", Source: source}}, nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to uninstall components: %v", err)
+	}
+	if exists("/usr/local/bin/containerd") || !exists("/usr/bin/containerd") {
+		t.Error("expected the previous source file removed and the new destination kept")
+	}
+	managedFiles, err := loadManagedFiles()
+	if err != nil || managedFiles["/usr/local/bin/containerd"] != "" {
+		t.Errorf("expected the previous source file forgotten, got %v, %v", managedFiles, err)
+	}
+
+	// The next source keeps the version it replaces
+	sources, err := loadComponentSources()
+	if err != nil || sources["containerd"].ReplacedVersion != "1.7.22" {
+		t.Errorf("expected the replaced version kept, got %v, %v", sources, err)
+	}
+
+	// Back to the repository, the source file is removed and the version it replaced is uninstalled
+	err = recordComponentSource("containerd", &installedSource{ComponentSource: *source, ReplacedVersion: "1.7.22", ReplacedRepo: "https://repo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = uninstallComponents(context.Background(), repoFS, []Component{{Name: "containerd", Version: "1.7.23"}}, nodeMetadata)
+	if err != nil {
+		t.Fatalf("failed to uninstall components: %v", err)
+	}
+	sources, err = loadComponentSources()
+	if err != nil || exists("/usr/bin/containerd") || len(sources) != 0 {
+		t.Errorf("expected the source file removed, got %v, %v", sources, err)
+	}
+	if exists("/etc/containerd/config.toml") {
+		t.Error("expected the replaced version uninstalled")
+	}
+	componentRepos, err := loadComponentRepos()
+	if err != nil || componentRepos["containerd"] != "https://repo" {
+		t.Errorf("expected the replaced version repository recorded, got %v, %v", componentRepos, err)
+	}
+}
+
+func TestReplacedInstall(t *testing.T) {
+	defer func(previousRoot string) { rootDir = previousRoot }(rootDir)
+	rootDir = t.TempDir()
+	err := os.MkdirAll(hostPath("/etc"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := ComponentSource{URL: "https://hotfixes.example.com/containerd", Dst: "/usr/bin/containerd"}
+
+	// A fresh source install replaces no version
+	installed, err := replacedInstall("containerd", source)
+	if err != nil || installed.ReplacedVersion != "" {
+		t.Errorf("expected no replaced version, got %+v, %v", installed, err)
+	}
+
+	// The source replaces the version installed from the repository
+	err = SetComponentVersion("containerd", "1.7.22")
+	if err == nil {
+		err = recordComponentRepo("containerd", "https://repo")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	installed, err = replacedInstall("containerd", source)
+	if err != nil || installed.ReplacedVersion != "1.7.22" || installed.ReplacedRepo != "https://repo" || installed.URL != source.URL {
+		t.Errorf("expected the repository version replaced, got %+v, %v", installed, err)
+	}
+
+	// The next source replaces the same repository version
+	err = SetComponentVersion("containerd", "1.7.23-hotfix1")
+	if err == nil {
+		err = recordComponentSource("containerd", &installed)
+	}
+	if err == nil {
+		err = recordComponentRepo("containerd", sourceRepoPrefix+source.URL)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	installed, err = replacedInstall("containerd", ComponentSource{URL: "https://hotfixes.example.com/containerd2", Dst: "/usr/bin/containerd"})
+	if err != nil || installed.ReplacedVersion != "1.7.22" || installed.ReplacedRepo != "https://repo" {
+		t.Errorf("expected the repository version still replaced, got %+v, %v", installed, err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The node metadata is assembled from layered sources, each source overriding the previous ones:
+//
+//  1. the optional "metadata" object embedded in the instance user-data (or Kosmos registration)
+//  2. the node metadata endpoint (PN node metadata endpoint or external kapsule endpoint)
+//  3. the optional ConfigMap referenced by "metadata_configmap", in its "metadata.json" key
+//  4. the optional local override file /etc/scw-k8s-metadata-override.json
+//  5. the repository switched to with the node annotation, until the metadata repository changes
+//
+// Each source is a partial JSON node metadata: objects are merged, other values (including arrays) are replaced.
+
+// metadataOverrideFile is the local file overriding the node metadata, mostly for testing purposes
+const metadataOverrideFile = "/etc/scw-k8s-metadata-override.json"
+
+// metadataConfigMapKey is the ConfigMap key holding the partial node metadata
+const metadataConfigMapKey = "metadata.json"
+
+// loadNodeMetadata returns the node metadata merged from all the metadata sources
+func loadNodeMetadata(ctx context.Context, userData UserData) (NodeMetadata, error) {
+	var metadata NodeMetadata
+
+	// Metadata embedded in the user-data
+	if len(userData.Metadata) > 0 {
+		err := json.Unmarshal(userData.Metadata, &metadata)
+		if err != nil {
+			return NodeMetadata{}, fmt.Errorf("failed to unmarshal user-data metadata: %w", err)
+		}
+		slog.Debug("Node metadata source applied", slog.String("source", "user-data"))
+	}
+
+	// Metadata returned by the node metadata endpoint
+	endpointMetadata, err := fetchNodeMetadata(userData.MetadataURL, userData.NodeSecretKey, cmp.Or(metadata.MetadataInterface, metadataInterfaceFlag))
+	if err != nil {
+		return NodeMetadata{}, err
+	}
+	err = json.Unmarshal(endpointMetadata, &metadata)
+	if err != nil {
+		return NodeMetadata{}, fmt.Errorf("failed to unmarshal node metadata: %w", err)
+	}
+	slog.Debug("Node metadata source applied", slog.String("source", "endpoint"))
+
+	metadata.Token = userData.NodeSecretKey
+	metadata.MetadataURL = userData.MetadataURL
+
+	// Metadata stored in a ConfigMap, it cannot change the fields only the endpoint can set since it can
+	// be changed from the cluster. They are unset while it is applied, so it cannot update them in place.
+	endpoint := metadata
+	metadata.clearEndpointOnly()
+	if metadata.MetadataConfigMap != "" {
+		configMapMetadata, err := fetchConfigMapMetadata(ctx, endpoint)
+		if err != nil {
+			return NodeMetadata{}, fmt.Errorf("failed to get ConfigMap %s metadata: %w", metadata.MetadataConfigMap, err)
+		}
+		if len(configMapMetadata) > 0 {
+			err = json.Unmarshal(configMapMetadata, &metadata)
+			if err != nil {
+				return NodeMetadata{}, fmt.Errorf("failed to unmarshal ConfigMap %s metadata: %w", metadata.MetadataConfigMap, err)
+			}
+			slog.Debug("Node metadata source applied", slog.String("source", "configmap"))
+		}
+	}
+	metadata.restoreEndpointOnly(endpoint)
+
+	// Metadata from the local override file
+	overrideMetadata, err := os.ReadFile(hostPath(metadataOverrideFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return NodeMetadata{}, fmt.Errorf("failed to read metadata override file: %w", err)
+	} else if err == nil {
+		err = json.Unmarshal(overrideMetadata, &metadata)
+		if err != nil {
+			return NodeMetadata{}, fmt.Errorf("failed to unmarshal metadata override file: %w", err)
+		}
+		slog.Debug("Node metadata source applied", slog.String("source", metadataOverrideFile))
+	}
+
+	// Repository switched to
+	err = applyRepoSwitch(&metadata)
+	if err != nil {
+		return NodeMetadata{}, err
+	}
+
+	// The tunnel interface name is a path of its configuration, written by root
+	if metadata.Tunnel != nil {
+		err = metadata.Tunnel.Validate()
+		if err != nil {
+			return NodeMetadata{}, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// clearEndpointOnly unsets the fields only the node metadata endpoint (or the user-data) can set
+func (m *NodeMetadata) clearEndpointOnly() {
+	m.RemoteOperations = nil
+	m.DecommissionOnDelete = false
+	m.Provenance = nil
+	m.AllowedRepoURIs = nil
+	m.StatusURL = ""
+	m.Heartbeat = nil
+	m.ClusterURL, m.ClusterCA = "", ""
+	m.Kubeconfig = nil
+	m.ManagedNodes, m.ManagedNodesToken = nil, ""
+	m.AnnotationPrefix = ""
+	m.WritablePaths = nil
+	m.SystemExtensions = false
+	m.ScriptDigests = nil
+	m.ControllerTuning = nil
+	m.TemplateArgs = nil
+
+	// The component overrides can be set by the ConfigMap, but not their source files installed by root
+	overrides := maps.Clone(m.ComponentOverrides)
+	for name, override := range overrides {
+		override.Source = nil
+		overrides[name] = override
+	}
+	m.ComponentOverrides = overrides
+}
+
+// restoreEndpointOnly restores the fields only the node metadata endpoint (or the user-data) can set
+func (m *NodeMetadata) restoreEndpointOnly(endpoint NodeMetadata) {
+	m.RemoteOperations = endpoint.RemoteOperations
+	m.DecommissionOnDelete = endpoint.DecommissionOnDelete
+	m.Provenance = endpoint.Provenance
+	m.AllowedRepoURIs = endpoint.AllowedRepoURIs
+	m.StatusURL = endpoint.StatusURL
+	m.Heartbeat = endpoint.Heartbeat
+	m.ClusterURL, m.ClusterCA = endpoint.ClusterURL, endpoint.ClusterCA
+	m.Kubeconfig = endpoint.Kubeconfig
+	m.ManagedNodes, m.ManagedNodesToken = endpoint.ManagedNodes, endpoint.ManagedNodesToken
+	m.AnnotationPrefix = endpoint.AnnotationPrefix
+	m.WritablePaths = endpoint.WritablePaths
+	m.SystemExtensions = endpoint.SystemExtensions
+	m.ScriptDigests = endpoint.ScriptDigests
+	m.ControllerTuning = endpoint.ControllerTuning
+	m.TemplateArgs = endpoint.TemplateArgs
+
+	// The source overrides of the endpoint are restored with their version
+	for name, override := range m.ComponentOverrides {
+		override.Source = nil
+		if endpointOverride := endpoint.ComponentOverrides[name]; endpointOverride.Source != nil {
+			override.Version, override.Source = endpointOverride.Version, endpointOverride.Source
+		}
+		m.ComponentOverrides[name] = override
+	}
+	for name, endpointOverride := range endpoint.ComponentOverrides {
+		if _, ok := m.ComponentOverrides[name]; !ok && endpointOverride.Source != nil {
+			if m.ComponentOverrides == nil {
+				m.ComponentOverrides = make(map[string]ComponentOverride)
+			}
+			m.ComponentOverrides[name] = endpointOverride
+		}
+	}
+}
+
+// fetchConfigMapMetadata returns the raw JSON metadata stored in the ConfigMap referenced by the metadata
+func fetchConfigMapMetadata(ctx context.Context, metadata NodeMetadata) ([]byte, error) {
+	namespace, name, found := strings.Cut(metadata.MetadataConfigMap, "/")
+	if !found {
+		return nil, fmt.Errorf("invalid ConfigMap %q, expected namespace/name", metadata.MetadataConfigMap)
+	}
+
+	client, err := newKubernetesClient(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ConfigMap: %w", err)
+	}
+
+	return []byte(configMap.Data[metadataConfigMapKey]), nil
+}
+
+// redactedSecret replaces the secrets of the dumped node metadata
+const redactedSecret = "redacted"
+
+// secrets returns the secret values of the node metadata, redacted wherever they appear, eg: in the
+// template diffs
+func (m NodeMetadata) secrets() []string {
+	secrets := []string{m.Token, m.ManagedNodesToken}
+	if m.Tunnel != nil {
+		secrets = append(secrets, m.Tunnel.PrivateKey)
+	}
+	return secrets
+}
+
+// dumpNodeMetadata returns the indented JSON node metadata without its secrets, for debug purposes
+func dumpNodeMetadata(metadata NodeMetadata) (string, error) {
+	if metadata.Tunnel != nil && metadata.Tunnel.PrivateKey != "" {
+		tunnel := *metadata.Tunnel
+		tunnel.PrivateKey = redactedSecret
+		metadata.Tunnel = &tunnel
+	}
+	if metadata.ManagedNodesToken != "" {
+		metadata.ManagedNodesToken = redactedSecret
+	}
+
+	dump, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal node metadata: %w", err)
+	}
+
+	return string(dump), nil
+}
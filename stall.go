@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flag values of the stall detection, passed to the unprivileged controller
+var (
+	// stallTimeoutFlag is the -stall-timeout flag value, the duration without progress after which a
+	// reconcile, a drain or an install is reported stalled, disabled if 0
+	stallTimeoutFlag time.Duration
+	// stallRestartFlag is the -stall-restart flag value, the agent exits once stalled so it is restarted
+	// by systemd
+	stallRestartFlag bool
+)
+
+// validateStallFlags checks the stall timeout is disabled or long enough for the install steps, eg: 1h
+// is longer than the slowest known component scripts, and set for the restart
+func validateStallFlags(timeout time.Duration, restart bool) error {
+	if timeout != 0 && timeout < time.Minute {
+		return fmt.Errorf("invalid stall timeout %s, expected 0 to disable it or at least 1m", timeout)
+	}
+	if restart && timeout == 0 {
+		return fmt.Errorf("-stall-restart requires a -stall-timeout")
+	}
+	return nil
+}
+
+// stallsDir is where the goroutines of the stalled agent are dumped
+var stallsDir = filepath.Join(stateDir, "stalls")
+
+// controllerStallsDir is where the root agent process saves the stalls of the unprivileged controller,
+// which cannot rotate the dumps of the root agent process
+var controllerStallsDir = filepath.Join(stallsDir, "controller")
+
+// stallsKept is the number of stall dumps kept, the older ones are removed
+const stallsKept = 10
+
+// stallDetector tracks the progress of the running activities, a reconcile, a drain or an install, to
+// detect the ones wedged on an unkillable script or a hung download
+type stallDetector struct {
+	mu         sync.Mutex
+	activities []*stallActivity // Running activities, the innermost last
+	reported   bool             // The current stall is reported
+	report     func(message string)
+	save       func(message string, goroutines []byte) (string, error) // saveStall of stallsDir if not set
+
+	// Last progress of any activity, forwarded by the root agent process to the controller
+	lastProgress atomic.Int64
+}
+
+// stallActivity is a running activity, only its own progress is tracked, eg: the reconcile is not
+// stalled while it drains the node or waits for an install progressing
+type stallActivity struct {
+	name         string
+	lastProgress time.Time
+}
+
+// stalls is the stall detector of the agent process
+var stalls = &stallDetector{}
+
+// start records the start of an activity, it returns the function recording its end
+func (s *stallDetector) start(activity string) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := &stallActivity{name: activity, lastProgress: time.Now()}
+	s.activities = append(s.activities, running)
+	s.lastProgress.Store(time.Now().UnixNano())
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// The activities of other goroutines may have started since
+		s.activities = slices.DeleteFunc(s.activities, func(other *stallActivity) bool { return other == running })
+		s.progressLocked()
+	}
+}
+
+// progress records a progress of the innermost running activity, eg: a component installed, bytes
+// downloaded or a drain poll
+func (s *stallDetector) progress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.progressLocked()
+}
+
+func (s *stallDetector) progressLocked() {
+	now := time.Now()
+	s.lastProgress.Store(now.UnixNano())
+	if len(s.activities) > 0 {
+		s.activities[len(s.activities)-1].lastProgress = now
+	}
+}
+
+// setReport sets the function reporting the stalls, eg: with a node event
+func (s *stallDetector) setReport(report func(message string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.report = report
+}
+
+// setSave sets the function saving the stalls, eg: by the root agent process for the unprivileged
+// controller
+func (s *stallDetector) setSave(save func(message string, goroutines []byte) (string, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.save = save
+}
+
+// reportStall reports the stall, if a report function is set
+func (s *stallDetector) reportStall(message string) {
+	s.mu.Lock()
+	report := s.report
+	s.mu.Unlock()
+	if report != nil {
+		report(message)
+	}
+}
+
+// check returns the innermost activity if stalled and the time since its last progress, empty if not
+// stalled or already reported
+func (s *stallDetector) check(timeout time.Duration) (string, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.activities) == 0 {
+		s.reported = false
+		return "", 0
+	}
+	activity := s.activities[len(s.activities)-1]
+	since := time.Since(activity.lastProgress)
+	if since <= timeout {
+		s.reported = false
+		return "", 0
+	}
+	if s.reported {
+		return "", 0
+	}
+	s.reported = true
+
+	return activity.name, since
+}
+
+// run checks the stalls until the context is done. A stall is reported once, with the goroutines
+// dumped in the state directory, and the agent exits with restart.
+func (s *stallDetector) run(ctx context.Context, timeout time.Duration, restart bool) {
+	ticker := time.NewTicker(min(timeout/4, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			activity, since := s.check(timeout)
+			if activity == "" {
+				continue
+			}
+
+			message := fmt.Sprintf("Agent stalled: no %s progress for %s", activity, since.Round(time.Second))
+			goroutines := dumpGoroutines()
+			s.mu.Lock()
+			save := s.save
+			s.mu.Unlock()
+			if save == nil {
+				save = func(message string, goroutines []byte) (string, error) {
+					return saveStall(stallsDir, message, goroutines)
+				}
+			}
+			stallPath, err := save(message, goroutines)
+			if err != nil {
+				slog.Error("Failed to save stall", slog.Any("error", err))
+				slog.Error("Agent stalled", slog.String("activity", activity), slog.Duration("since", since), slog.String("goroutines", string(goroutines)))
+			} else {
+				slog.Error("Agent stalled", slog.String("activity", activity), slog.Duration("since", since), slog.String("goroutines_path", stallPath))
+				message = fmt.Sprintf("%s (goroutines saved in %s)", message, stallPath)
+			}
+
+			s.reportStall(message)
+
+			if restart {
+				slog.Error("Exiting to be restarted", slog.String("activity", activity))
+				exit(exitStalled)
+			}
+		}
+	}
+}
+
+// dumpGoroutines returns the stacks of all the goroutines
+func dumpGoroutines() []byte {
+	var buf bytes.Buffer
+	_ = pprof.Lookup("goroutine").WriteTo(&buf, 2)
+	return buf.Bytes()
+}
+
+// saveStall writes the stall and the goroutines in the stalls directory, only the last stalls of the
+// directory are kept
+func saveStall(dir, message string, goroutines []byte) (string, error) {
+	err := os.MkdirAll(hostPath(dir), 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create stalls directory: %w", err)
+	}
+
+	now := time.Now()
+	stallPath := filepath.Join(dir, fmt.Sprintf("stall-%s.log", now.UTC().Format("20060102T150405Z")))
+	content := fmt.Sprintf("time: %s\nversion: %s\nstall: %s\n\n%s", now.Format(time.RFC3339), Version, message, goroutines)
+	err = os.WriteFile(hostPath(stallPath), []byte(content), 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write stall: %w", err)
+	}
+
+	// Remove the oldest stalls, the names are sorted by time
+	entries, err := os.ReadDir(hostPath(dir))
+	if err != nil {
+		return "", fmt.Errorf("failed to read stalls directory: %w", err)
+	}
+	entries = slices.DeleteFunc(entries, func(entry os.DirEntry) bool { return entry.IsDir() })
+	for i := 0; i < len(entries)-stallsKept; i++ {
+		err = os.Remove(hostPath(filepath.Join(dir, entries[i].Name())))
+		if err != nil {
+			return "", fmt.Errorf("failed to remove stall %s: %w", entries[i].Name(), err)
+		}
+	}
+
+	return stallPath, nil
+}
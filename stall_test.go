@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStallDetector(t *testing.T) {
+	detector := &stallDetector{}
+	stall := func() {
+		for _, activity := range detector.activities {
+			activity.lastProgress = time.Now().Add(-2 * time.Hour)
+		}
+	}
+
+	// Idle
+	stall()
+	if activity, _ := detector.check(time.Hour); activity != "" {
+		t.Errorf("expected no stall while idle, got %q", activity)
+	}
+
+	// Stalled install within a reconcile, reported once
+	endReconcile := detector.start("reconcile")
+	endInstall := detector.start("install")
+	if activity, _ := detector.check(time.Hour); activity != "" {
+		t.Errorf("expected no stall on start, got %q", activity)
+	}
+	stall()
+	activity, since := detector.check(time.Hour)
+	if activity != "install" || since < 2*time.Hour {
+		t.Errorf("expected install stalled for 2h, got %q for %s", activity, since)
+	}
+	if activity, _ := detector.check(time.Hour); activity != "" {
+		t.Errorf("expected the stall to be reported once, got %q", activity)
+	}
+
+	// A progress ends the stall, the next one is reported
+	detector.progress()
+	if activity, _ := detector.check(time.Hour); activity != "" {
+		t.Errorf("expected no stall after progress, got %q", activity)
+	}
+	endInstall()
+	stall()
+	if activity, _ := detector.check(time.Hour); activity != "reconcile" {
+		t.Errorf("expected reconcile stalled, got %q", activity)
+	}
+
+	// A drain progressing is not a stall of the reconcile, nor once done
+	stall()
+	endDrain := detector.start("drain")
+	detector.progress()
+	if activity, _ := detector.check(time.Hour); activity != "" {
+		t.Errorf("expected no stall while draining, got %q", activity)
+	}
+	endDrain()
+	if activity, _ := detector.check(time.Hour); activity != "" {
+		t.Errorf("expected no stall once drained, got %q", activity)
+	}
+
+	endReconcile()
+	stall()
+	if activity, _ := detector.check(time.Hour); activity != "" {
+		t.Errorf("expected no stall once done, got %q", activity)
+	}
+}
+
+func TestSaveStall(t *testing.T) {
+	defer func(original string) { rootDir = original }(rootDir)
+	rootDir = t.TempDir()
+
+	stallPath, err := saveStall(stallsDir, "Agent stalled: no install progress for 1h0m0s", dumpGoroutines())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(hostPath(stallPath))
+	if err != nil {
+		t.Fatalf("failed to read stall: %v", err)
+	}
+	if !strings.Contains(string(content), "stall: Agent stalled") || !strings.Contains(string(content), "TestSaveStall") {
+		t.Errorf("expected the stall message and the goroutines, got %s", content)
+	}
+
+	// Only the last stalls are kept
+	for i := range stallsKept + 5 {
+		err = os.WriteFile(hostPath(filepath.Join(stallsDir, fmt.Sprintf("stall-20200101T0000%02dZ.log", i))), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stallPath, err = saveStall(stallsDir, "Agent stalled: no install progress for 1h0m0s", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(hostPath(stallsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != stallsKept || entries[len(entries)-1].Name() != filepath.Base(stallPath) {
+		t.Errorf("expected the %d last stalls kept, got %v", stallsKept, entries)
+	}
+
+	// The stalls of the controller do not rotate the dumps of the root agent process
+	for range stallsKept + 1 {
+		_, err = saveStall(controllerStallsDir, "controller: Agent stalled: no reconcile progress for 1h0m0s", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	entries, err = os.ReadDir(hostPath(stallsDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != stallsKept+1 || !slices.ContainsFunc(entries, func(entry os.DirEntry) bool { return entry.Name() == filepath.Base(stallPath) }) {
+		t.Errorf("expected the root stalls kept with the controller stalls directory, got %v", entries)
+	}
+}
+
+func TestValidateStallFlags(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute, time.Hour} {
+		if err := validateStallFlags(timeout, false); err != nil {
+			t.Errorf("unexpected error for %s: %v", timeout, err)
+		}
+	}
+	for _, timeout := range []time.Duration{-time.Minute, 30 * time.Second} {
+		if err := validateStallFlags(timeout, false); err == nil {
+			t.Errorf("expected an error for %s", timeout)
+		}
+	}
+
+	// The restart is only enabled with the stall detection
+	if err := validateStallFlags(time.Hour, true); err != nil {
+		t.Errorf("unexpected error for the restart: %v", err)
+	}
+	if err := validateStallFlags(0, true); err == nil {
+		t.Error("expected an error for the restart without stall timeout")
+	}
+}
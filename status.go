@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// NodeStatus is the provisioning status of the node, saved in the status file and posted to the
+// control plane, so it does not need to read the node annotations to know the provisioning progress
+//
+//	{
+//	   "phase": "installing",
+//	   "agent_version": "1.4.0",
+//	   "pool_version": "1.31.2",
+//	   "repo_uri": "https://repo.example.com/k8s",
+//	   "repo_digest": "5f2b...",
+//	   "components": [
+//	      {"name": "containerd", "version": "1.7.22", "status": "installed", "updated_at": "2024-10-07T10:00:05Z"},
+//	      {"name": "kubelet", "version": "1.31.2", "status": "installing", "updated_at": "2024-10-07T10:00:06Z"}
+//	   ],
+//	   "started_at": "2024-10-07T10:00:00Z",
+//	   "updated_at": "2024-10-07T10:00:06Z"
+//	}
+type NodeStatus struct {
+	Phase           string            `json:"phase"` // installing, upgrading, installed, upgraded or failed
+	AgentVersion    string            `json:"agent_version"`
+	PoolVersion     string            `json:"pool_version"`
+	RepoURI         string            `json:"repo_uri"`
+	RepoDigest      string            `json:"repo_digest,omitempty"`      // Digest of the releases file installed from
+	FallbackRelease string            `json:"fallback_release,omitempty"` // Closest release installed instead of the pool version, see -release-fallback
+	SBOMDigest      string            `json:"sbom_digest,omitempty"`      // Digest of the SBOM of the components installed
+	Components      []ComponentStatus `json:"components"`
+	Error           string            `json:"error,omitempty"`
+	StartedAt       time.Time         `json:"started_at"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+}
+
+type ComponentStatus struct {
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Status    string    `json:"status"` // installing, installed or failed
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var statusFile = filepath.Join(stateDir, "status.json")
+
+// statusReportRetryDelay is the delay before posting the status again after a failure, the final
+// status of an install is always posted
+const statusReportRetryDelay = 30 * time.Second
+
+// The status of the install in progress, updated by the installer
+var (
+	statusMu       sync.Mutex
+	status         NodeStatus
+	statusURL      string
+	statusToken    string
+	statusFailedAt time.Time
+)
+
+// statusReport is a status document to post, done is closed once it is posted or replaced
+type statusReport struct {
+	url      string
+	token    string
+	document []byte
+	final    bool
+	done     chan struct{}
+}
+
+// statusReports holds the status document waiting to be posted, only the latest one is kept since
+// it replaces the previous ones
+var (
+	statusReports       = make(chan statusReport, 1)
+	statusReporterStart sync.Once
+)
+
+// startStatus starts the status of an install, it is posted to the status URL of the metadata, or
+// to the node metadata endpoint if not set
+func startStatus(nodemetadata NodeMetadata, upgrade bool) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	phase := "installing"
+	if upgrade {
+		phase = "upgrading"
+	}
+	now := time.Now().UTC()
+	status = NodeStatus{
+		Phase:        phase,
+		AgentVersion: Version,
+		PoolVersion:  nodemetadata.PoolVersion,
+		RepoURI:      nodemetadata.RepoURI,
+		Components:   []ComponentStatus{},
+		StartedAt:    now,
+		UpdatedAt:    now,
+	}
+	statusURL = nodemetadata.StatusURL
+	if statusURL == "" {
+		statusURL = nodemetadata.MetadataURL
+	}
+	// The install into an alternate root is not the node install
+	if serviceManager == chrootServiceManager {
+		statusURL = ""
+	}
+	statusToken = nodemetadata.Token
+	statusFailedAt = time.Time{}
+
+	updateStatus(false)
+}
+
+// setStatusRepoDigest records the digest of the releases file the components are installed from
+func setStatusRepoDigest(digest string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	status.RepoDigest = digest
+	updateStatus(false)
+}
+
+// setStatusFallbackRelease records the closest release installed instead of the pool version, if any
+func setStatusFallbackRelease(release string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	status.FallbackRelease = release
+	updateStatus(false)
+}
+
+// statusFallbackRelease returns the closest release installed by the install, if any
+func statusFallbackRelease() string {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	return status.FallbackRelease
+}
+
+// setStatusSBOMDigest records the digest of the SBOM of the components installed
+func setStatusSBOMDigest(digest string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	status.SBOMDigest = digest
+	updateStatus(false)
+}
+
+// setComponentStatus records the status of a component install
+func setComponentStatus(name, version, componentStatus string) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	stalls.progress()
+	updated := ComponentStatus{Name: name, Version: version, Status: componentStatus, UpdatedAt: time.Now().UTC()}
+	i := slices.IndexFunc(status.Components, func(component ComponentStatus) bool { return component.Name == name })
+	if i < 0 {
+		status.Components = append(status.Components, updated)
+	} else {
+		status.Components[i] = updated
+	}
+	updateStatus(false)
+}
+
+// finishStatus records the result of the install, the component being installed failed with the error
+func finishStatus(err error) {
+	statusMu.Lock()
+
+	switch {
+	case err != nil:
+		status.Phase = "failed"
+		status.Error = err.Error()
+		for i, component := range status.Components {
+			if component.Status == "installing" {
+				status.Components[i].Status = "failed"
+				status.Components[i].Error = err.Error()
+				status.Components[i].UpdatedAt = time.Now().UTC()
+			}
+		}
+	case status.Phase == "upgrading":
+		status.Phase = "upgraded"
+	default:
+		status.Phase = "installed"
+	}
+	reported := updateStatus(true)
+	statusMu.Unlock()
+
+	// The final status is posted before the install returns, the agent may exit right after
+	<-reported
+}
+
+// statusComponents returns the components of the install with the status, eg: installed
+func statusComponents(componentStatus string) []string {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+
+	var names []string
+	for _, component := range status.Components {
+		if component.Status == componentStatus {
+			names = append(names, component.Name)
+		}
+	}
+	return names
+}
+
+// updateStatus saves the status and queues it to be posted, the failures are only logged since the
+// status must not fail the install. The status lock must be held. The returned channel is closed once
+// the status is posted.
+func updateStatus(final bool) <-chan struct{} {
+	done := make(chan struct{})
+	status.UpdatedAt = time.Now().UTC()
+
+	jsonStatus, err := json.Marshal(status)
+	if err != nil {
+		slog.Warn("Failed to marshal node status", slog.Any("error", err))
+		close(done)
+		return done
+	}
+
+	err = os.MkdirAll(hostPath(stateDir), 0700)
+	if err == nil {
+		err = os.WriteFile(hostPath(statusFile), jsonStatus, 0600)
+	}
+	if err != nil {
+		slog.Warn("Failed to write node status", slog.Any("error", err))
+	}
+
+	if statusURL == "" {
+		close(done)
+		return done
+	}
+
+	// Post the status in the background, replacing the status not posted yet, so the install is not
+	// slowed down by the control plane
+	statusReporterStart.Do(func() { go reportStatus() })
+	select {
+	case replaced := <-statusReports:
+		close(replaced.done)
+	default:
+	}
+	statusReports <- statusReport{url: statusURL, token: statusToken, document: jsonStatus, final: final, done: done}
+
+	return done
+}
+
+// reportStatus posts the queued status documents to the control plane
+func reportStatus() {
+	for report := range statusReports {
+		// Do not post again until the retry delay when the control plane is unreachable
+		statusMu.Lock()
+		skip := !report.final && time.Since(statusFailedAt) < statusReportRetryDelay
+		statusMu.Unlock()
+		if skip {
+			close(report.done)
+			continue
+		}
+
+		err := postJSON(report.url, report.token, report.document)
+		statusMu.Lock()
+		if err != nil {
+			statusFailedAt = time.Now()
+		} else {
+			statusFailedAt = time.Time{}
+		}
+		statusMu.Unlock()
+		if err != nil {
+			slog.Warn("Failed to report node status", slog.Bool("final", report.final), slog.Any("error", err))
+		}
+		close(report.done)
+	}
+}
+
+// postJSON posts the JSON document to the control plane, authenticated with the node token
+func postJSON(url, token string, document []byte) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(document))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post to %s: %w", url, err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to post to %s: %v", url, resp.Status)
+	}
+
+	return nil
+}
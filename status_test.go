@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestNodeStatus(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	var (
+		mu       sync.Mutex
+		reported []NodeStatus
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("X-Auth-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var status NodeStatus
+		_ = json.Unmarshal(body, &status)
+		mu.Lock()
+		reported = append(reported, status)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	startStatus(NodeMetadata{PoolVersion: "1.31.2", MetadataURL: server.URL, Token: "token"}, true)
+	setComponentStatus("containerd", "1.7.22", "installing")
+	setComponentStatus("containerd", "1.7.22", "installed")
+	setComponentStatus("kubelet", "1.31.2", "installing")
+	finishStatus(errors.New("failed to install component kubelet"))
+
+	// The statuses not posted yet are replaced by the latest one, the final one is always posted
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reported) == 0 || len(reported) > 5 {
+		t.Fatalf("expected up to 5 status reports, got %d", len(reported))
+	}
+	if reported[len(reported)-1].Phase != "failed" {
+		t.Errorf("last phase = %s, expected failed", reported[len(reported)-1].Phase)
+	}
+
+	// The saved status is the last reported one
+	jsonStatus, err := os.ReadFile(filepath.Join(rootDir, statusFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved NodeStatus
+	err = json.Unmarshal(jsonStatus, &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Phase != "failed" || saved.Error == "" {
+		t.Errorf("saved phase = %s, error %q, expected failed", saved.Phase, saved.Error)
+	}
+	expected := map[string]string{"containerd": "installed", "kubelet": "failed"}
+	if len(saved.Components) != len(expected) {
+		t.Fatalf("components = %+v", saved.Components)
+	}
+	for _, component := range saved.Components {
+		if component.Status != expected[component.Name] {
+			t.Errorf("component %s status = %s, expected %s", component.Name, component.Status, expected[component.Name])
+		}
+	}
+}
+
+func TestNodeStatusAsync(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	// The control plane answers once the install is done
+	release := make(chan struct{})
+	var (
+		mu    sync.Mutex
+		final NodeStatus
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var status NodeStatus
+		_ = json.Unmarshal(body, &status)
+		if status.Phase == "installed" {
+			mu.Lock()
+			final = status
+			mu.Unlock()
+			return
+		}
+		<-release
+	}))
+	defer server.Close()
+
+	// The status updates do not wait for the slow control plane
+	startStatus(NodeMetadata{PoolVersion: "1.31.2", MetadataURL: server.URL, Token: "token"}, false)
+	for range 10 {
+		setComponentStatus("containerd", "1.7.22", "installed")
+	}
+	close(release)
+	finishStatus(nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if final.Phase != "installed" {
+		t.Errorf("expected the final status posted, got %+v", final)
+	}
+}
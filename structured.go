@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// structuredTemplateFunctions are the template functions merging structured configurations, eg: a
+// base configuration of the repository with an overlay of the template args
+//
+//	{{ mergeConfig (loadConfig "config.yaml") (fromYaml (.TemplateArgs.containerd | default "{}")) | toToml }}
+var structuredTemplateFunctions = map[string]any{
+	"fromYaml":    fromYAML,
+	"toYaml":      toYAML,
+	"toToml":      toTOML,
+	"mergeConfig": mergeConfig,
+}
+
+// loadConfig returns the YAML or JSON configuration file of the component directory
+func loadConfig(componentFS fs.FS, name string) (map[string]any, error) {
+	if !fs.ValidPath(name) {
+		return nil, fmt.Errorf("invalid configuration path %q, expected a path in the component directory", name)
+	}
+	data, err := fs.ReadFile(componentFS, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration: %w", err)
+	}
+	config, err := fromYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration %s: %w", name, err)
+	}
+	return config, nil
+}
+
+// fromYAML parses a YAML or JSON object, empty if the document is empty
+func fromYAML(data string) (map[string]any, error) {
+	config := make(map[string]any)
+	err := yaml.Unmarshal([]byte(data), &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if config == nil {
+		config = make(map[string]any)
+	}
+	return config, nil
+}
+
+// toYAML returns the YAML document of the value, without the final newline
+func toYAML(value any) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal YAML: %w", err)
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// mergeConfig deep-merges the overlays over the base configuration, like the node metadata sources:
+// the objects are merged, the other values are replaced, and a null value removes the key
+func mergeConfig(base map[string]any, overlays ...map[string]any) map[string]any {
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = make(map[string]any)
+	}
+	for _, overlay := range overlays {
+		for key, value := range overlay {
+			baseObject, baseIsObject := merged[key].(map[string]any)
+			object, isObject := value.(map[string]any)
+			switch {
+			case value == nil:
+				delete(merged, key)
+			case baseIsObject && isObject:
+				merged[key] = mergeConfig(baseObject, object)
+			default:
+				merged[key] = value
+			}
+		}
+	}
+	return merged
+}
+
+// toTOML returns the TOML document of the configuration, the objects of objects are written as tables
+// and the lists of objects as arrays of tables
+func toTOML(config map[string]any) (string, error) {
+	// TOML has no null, the encoder would silently drop the key
+	for _, key := range slices.Sorted(maps.Keys(config)) {
+		err := checkTOMLValue(key, config[key])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var document strings.Builder
+	encoder := toml.NewEncoder(&document)
+	encoder.Indent = ""
+	err := encoder.Encode(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal TOML: %w", err)
+	}
+	return strings.TrimSuffix(document.String(), "\n"), nil
+}
+
+// checkTOMLValue returns an error if the value holds a null
+func checkTOMLValue(path string, value any) error {
+	switch value := value.(type) {
+	case nil:
+		return fmt.Errorf("invalid value of %s: null is not supported in TOML", path)
+	case map[string]any:
+		for _, key := range slices.Sorted(maps.Keys(value)) {
+			err := checkTOMLValue(path+"."+key, value[key])
+			if err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, element := range value {
+			err := checkTOMLValue(fmt.Sprintf("%s[%d]", path, i), element)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestMergeConfig(t *testing.T) {
+	base := map[string]any{
+		"version": 2,
+		"plugins": map[string]any{
+			"cri": map[string]any{"sandbox_image": "pause:3.9", "max_concurrent_downloads": 3},
+		},
+		"debug": map[string]any{"level": "info"},
+	}
+	overlay := map[string]any{
+		"plugins": map[string]any{"cri": map[string]any{"max_concurrent_downloads": 10}},
+		"debug":   nil,
+		"metrics": map[string]any{"address": "127.0.0.1:1338"},
+	}
+	expected := map[string]any{
+		"version": 2,
+		"plugins": map[string]any{
+			"cri": map[string]any{"sandbox_image": "pause:3.9", "max_concurrent_downloads": 10},
+		},
+		"metrics": map[string]any{"address": "127.0.0.1:1338"},
+	}
+
+	merged := mergeConfig(base, overlay)
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("merged %+v, expected %+v", merged, expected)
+	}
+	if base["debug"] == nil || base["plugins"].(map[string]any)["cri"].(map[string]any)["max_concurrent_downloads"] != 3 {
+		t.Errorf("expected the base to be left unchanged, got %+v", base)
+	}
+}
+
+func TestToTOML(t *testing.T) {
+	config, err := fromYAML(`
+version: 2
+root: /var/lib/containerd
+plugins:
+  io.containerd.grpc.v1.cri:
+    sandbox_image: "registry.k8s.io/pause:3.9"
+    enable_cdi: true
+    containerd:
+      runtimes:
+        runc:
+          runtime_type: io.containerd.runc.v2
+          options: {SystemdCgroup: true}
+  empty: {}
+mirrors:
+  - endpoint: "https://mirror.example"
+    ratio: 0.5
+  - endpoint: "https://other.example"
+    ratio: 1.0
+labels: ["a", 1, {inline: "quoted \"value\"\n"}]
+`)
+	if err != nil {
+		t.Fatalf("failed to parse YAML: %v", err)
+	}
+	expected := `labels = ["a", 1, {inline = "quoted \"value\"\n"}]
+root = "/var/lib/containerd"
+version = 2
+
+[[mirrors]]
+endpoint = "https://mirror.example"
+ratio = 0.5
+
+[[mirrors]]
+endpoint = "https://other.example"
+ratio = 1.0
+
+[plugins]
+[plugins.empty]
+[plugins."io.containerd.grpc.v1.cri"]
+enable_cdi = true
+sandbox_image = "registry.k8s.io/pause:3.9"
+[plugins."io.containerd.grpc.v1.cri".containerd]
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes]
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc]
+runtime_type = "io.containerd.runc.v2"
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc.options]
+SystemdCgroup = true`
+
+	document, err := toTOML(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if document != expected {
+		t.Errorf("unexpected TOML document:\n%s", document)
+	}
+	var decoded map[string]any
+	_, err = toml.Decode(document, &decoded)
+	if err != nil || decoded["plugins"].(map[string]any)["io.containerd.grpc.v1.cri"].(map[string]any)["enable_cdi"] != true {
+		t.Errorf("expected a valid TOML document, got %v, %v", decoded, err)
+	}
+
+	_, err = toTOML(map[string]any{"key": nil})
+	if err == nil || !strings.Contains(err.Error(), "invalid value of key: null is not supported") {
+		t.Errorf("expected a null error, got %v", err)
+	}
+}
+
+func TestStructuredTemplate(t *testing.T) {
+	componentFS := fstest.MapFS{
+		"config.yaml": {Data: []byte("version: 2\nplugins:\n  cri:\n    max_concurrent_downloads: 3\n")},
+	}
+	funcs, err := templateFuncMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := template.New("tmpl").Funcs(withComponentFuncs(componentFS, funcs)).Parse(
+		`{{ mergeConfig (loadConfig "config.yaml") (fromYaml (.TemplateArgs.containerd | default "{}")) | toToml }}`)
+	if err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		args     map[string]string
+		expected string
+	}{
+		{name: "base", expected: "version = 2\n\n[plugins]\n[plugins.cri]\nmax_concurrent_downloads = 3"},
+		{name: "overlay", args: map[string]string{"containerd": `{"plugins": {"cri": {"max_concurrent_downloads": 10}}}`}, expected: "version = 2\n\n[plugins]\n[plugins.cri]\nmax_concurrent_downloads = 10"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rendered strings.Builder
+			err := tmpl.Execute(&rendered, NodeMetadata{TemplateArgs: test.args})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rendered.String() != test.expected {
+				t.Errorf("rendered %q, expected %q", rendered.String(), test.expected)
+			}
+		})
+	}
+
+	// The result is also valid YAML
+	yamlDocument, err := toYAML(mergeConfig(map[string]any{"a": map[string]any{"b": 1}}, map[string]any{"a": map[string]any{"c": "d"}}))
+	if err != nil || yamlDocument != "a:\n    b: 1\n    c: d" {
+		t.Errorf("unexpected YAML document %q, %v", yamlDocument, err)
+	}
+}
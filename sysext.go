@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With the system extensions integration, the component files under /usr and /opt are written to a
+// systemd-sysext extension per component instead, merged over the read-only /usr of immutable
+// images, eg: /usr/bin/kubelet is written to /var/lib/extensions/scw-k8s-kubelet/usr/bin/kubelet
+const sysextDir = "/var/lib/extensions"
+
+// sysextRoots are the hierarchies merged by systemd-sysext
+var sysextRoots = []string{"/usr", "/opt"}
+
+// sysextName returns the name of the system extension of the component
+func sysextName(component string) string {
+	return "scw-k8s-" + component
+}
+
+// sysextStagedDir returns the directory the merged extension of the component is moved to while the
+// extension is written, hidden from systemd-sysext
+func sysextStagedDir(component string) string {
+	return filepath.Join(sysextDir, "."+sysextName(component)+".merged")
+}
+
+// componentPath returns the path the component file is written to: in the component system
+// extension if enabled, or redirected to its writable path
+func (m NodeMetadata) componentPath(component, path string) string {
+	if m.SystemExtensions {
+		for _, root := range sysextRoots {
+			if path == root || strings.HasPrefix(path, root+"/") {
+				return filepath.Join(sysextDir, sysextName(component)) + path
+			}
+		}
+	}
+
+	return m.writablePath(path)
+}
+
+// installSysext writes the release file of the component system extension and merges the extensions,
+// they are merged again on boot by the systemd-sysext service
+func installSysext(logger *slog.Logger, component, version string) error {
+	name := sysextName(component)
+	releaseFile := filepath.Join(sysextDir, name, "usr/lib/extension-release.d", "extension-release."+name)
+	err := os.MkdirAll(hostPath(filepath.Dir(releaseFile)), defaultDirectoryMode)
+	if err != nil {
+		return fmt.Errorf("failed to create system extension %s: %w", name, err)
+	}
+	content := fmt.Sprintf("# %s %s\nID=_any\n", component, version)
+	err = installContent(releaseFile, []byte(content), "0644", "", "")
+	if err != nil {
+		return fmt.Errorf("failed to write system extension %s release: %w", name, err)
+	}
+
+	cmd := command("/usr/bin/systemctl", "enable", "systemd-sysext.service")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to enable systemd-sysext: %w: %s", err, output)
+	}
+	err = refreshStagedSysext(component)
+	if err != nil {
+		return err
+	}
+	logger.Info("System extension merged", slog.String("extension", name))
+
+	return nil
+}
+
+// removeSysext removes the component system extension and merges the remaining extensions. The
+// extension is moved aside and only removed once it is no longer merged.
+func removeSysext(logger *slog.Logger, component string) error {
+	name := sysextName(component)
+	err := os.Rename(hostPath(filepath.Join(sysextDir, name)), hostPath(sysextStagedDir(component)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove system extension %s: %w", name, err)
+	}
+	err = refreshStagedSysext(component)
+	if err != nil {
+		return err
+	}
+	logger.Info("System extension removed", slog.String("extension", name))
+
+	return nil
+}
+
+// stageSysext stages the component system extension before its files are written: the merged
+// hierarchies are overlays of the extension directories which must not be changed while they are
+// merged, so the merged extension is moved aside and copied back to the extension directory. The files
+// are written to the copy, not merged until the extensions are refreshed, while the other extensions
+// stay merged.
+func stageSysext(component string) error {
+	name := sysextName(component)
+	dir := filepath.Join(sysextDir, name)
+	staged := sysextStagedDir(component)
+
+	// A copy staged by an interrupted install may still be merged
+	_, err := os.Lstat(hostPath(staged))
+	if err == nil {
+		err = refreshStagedSysext(component)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	err = os.Rename(hostPath(dir), hostPath(staged))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stage system extension %s: %w", name, err)
+	}
+
+	return fs.WalkDir(os.DirFS(hostPath(staged)), ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read system extension %s: %w", name, err)
+		}
+		if entry.IsDir() {
+			info, err := entry.Info()
+			if err != nil {
+				return fmt.Errorf("failed to stat %s: %w", path, err)
+			}
+			err = os.MkdirAll(hostPath(filepath.Join(dir, path)), info.Mode().Perm())
+			if err != nil {
+				return fmt.Errorf("failed to create system extension directory: %w", err)
+			}
+			return nil
+		}
+		err = copyFileAs(filepath.Join(staged, path), filepath.Join(dir, path))
+		if err != nil {
+			return fmt.Errorf("failed to copy %s to system extension %s: %w", path, name, err)
+		}
+		return nil
+	})
+}
+
+// refreshStagedSysext merges the system extensions again, and removes the extension of the component
+// moved aside once it is no longer merged
+func refreshStagedSysext(component string) error {
+	err := refreshSysext()
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(hostPath(sysextStagedDir(component)))
+	if err != nil {
+		return fmt.Errorf("failed to remove staged system extension %s: %w", sysextName(component), err)
+	}
+
+	return nil
+}
+
+// refreshSysext merges the system extensions again
+func refreshSysext() error {
+	cmd := command("/usr/bin/systemd-sysext", "refresh")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to merge system extensions: %w: %s", err, output)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestComponentPath(t *testing.T) {
+	tests := []struct {
+		name         string
+		nodeMetadata NodeMetadata
+		path         string
+		expected     string
+	}{
+		{
+			name:     "default",
+			path:     "/usr/bin/kubelet",
+			expected: "/usr/bin/kubelet",
+		},
+		{
+			name:         "system extension",
+			nodeMetadata: NodeMetadata{SystemExtensions: true},
+			path:         "/usr/bin/kubelet",
+			expected:     "/var/lib/extensions/scw-k8s-kubelet/usr/bin/kubelet",
+		},
+		{
+			name:         "system extension directory",
+			nodeMetadata: NodeMetadata{SystemExtensions: true},
+			path:         "/opt/cni/bin/",
+			expected:     "/var/lib/extensions/scw-k8s-kubelet/opt/cni/bin/",
+		},
+		{
+			name:         "outside of the system extension",
+			nodeMetadata: NodeMetadata{SystemExtensions: true, WritablePaths: map[string]string{"/etc/kubernetes": "/var/kubernetes"}},
+			path:         "/etc/kubernetes/kubelet.conf",
+			expected:     "/var/kubernetes/kubelet.conf",
+		},
+	}
+	for _, test := range tests {
+		path := test.nodeMetadata.componentPath("kubelet", test.path)
+		if path != test.expected {
+			t.Errorf("%s: componentPath(%q) = %q, expected %q", test.name, test.path, path, test.expected)
+		}
+	}
+}
+
+func TestSystemExtensionInstall(t *testing.T) {
+	defer func(previousRoot, previousManager string) {
+		rootDir, serviceManager = previousRoot, previousManager
+	}(rootDir, serviceManager)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+	serveFakeCRI(t)
+
+	err := os.MkdirAll(filepath.Join(rootDir, "etc/kubernetes"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	componentFS := fstest.MapFS{
+		"kubelet":         &fstest.MapFile{Data: []byte("kubelet binary")},
+		"kubelet.service": &fstest.MapFile{Data: []byte("[Service]\n")},
+		"kubelet.conf":    &fstest.MapFile{Data: []byte("kind: KubeletConfiguration\n")},
+	}
+	resources := []ComponentResources{{
+		Files: []ComponentFile{
+			{State: "file", Src: "kubelet", Dst: "/usr/bin/", Mode: "0755"},
+			{State: "file", Src: "kubelet.service", Dst: "/usr/lib/systemd/system/"},
+			{State: "file", Src: "kubelet.conf", Dst: "/etc/kubernetes/"},
+		},
+		Services: []ComponentService{{Name: "kubelet", Enabled: true, State: "started"}},
+	}}
+
+	err = processComponentMetadata(context.Background(), slog.Default(), componentFS, "kubelet", "1.31.2", resources, nil, NodeMetadata{SystemExtensions: true})
+	if err != nil {
+		t.Fatalf("failed to install component: %v", err)
+	}
+
+	// The files under /usr are written to the extension, the other ones in place
+	for _, path := range []string{
+		"var/lib/extensions/scw-k8s-kubelet/usr/bin/kubelet",
+		"var/lib/extensions/scw-k8s-kubelet/usr/lib/systemd/system/kubelet.service",
+		"var/lib/extensions/scw-k8s-kubelet/usr/lib/extension-release.d/extension-release.scw-k8s-kubelet",
+		"etc/kubernetes/kubelet.conf",
+	} {
+		_, err = os.Stat(filepath.Join(rootDir, path))
+		if err != nil {
+			t.Errorf("expected %s: %v", path, err)
+		}
+	}
+
+	// The extensions are merged before the services are enabled
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := strings.Index(string(commands), "/usr/bin/systemd-sysext refresh")
+	enable := strings.Index(string(commands), "/usr/bin/systemctl enable kubelet")
+	if refresh < 0 || enable < refresh {
+		t.Errorf("expected the extensions merged before the service enabled, got %q", commands)
+	}
+
+	// The other extensions stay merged while the extension files are written
+	if strings.Contains(string(commands), "/usr/bin/systemd-sysext unmerge") {
+		t.Errorf("expected the extensions not unmerged, got %q", commands)
+	}
+
+	// On upgrade, the files are written to a copy of the merged extension, removed once merged again
+	err = os.WriteFile(filepath.Join(rootDir, "var/lib/extensions/scw-k8s-kubelet/usr/bin/kubelet-plugin"), []byte("plugin"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrade := []ComponentResources{{Files: []ComponentFile{{State: "file", Src: "kubelet", Dst: "/usr/bin/", Mode: "0755"}}}}
+	err = processComponentMetadata(context.Background(), slog.Default(), componentFS, "kubelet", "1.31.3", upgrade, nil, NodeMetadata{SystemExtensions: true})
+	if err != nil {
+		t.Fatalf("failed to upgrade component: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(rootDir, "var/lib/extensions/scw-k8s-kubelet/usr/bin/kubelet-plugin"))
+	if err != nil || string(content) != "plugin" {
+		t.Errorf("expected the extension files kept, got %q, %v", content, err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, sysextStagedDir("kubelet")))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the staged extension removed, got %v", err)
+	}
+
+	// The extension of the uninstalled component is removed and the extensions merged again
+	err = os.Remove(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uninstall := []ComponentResources{{Files: []ComponentFile{{State: "absent", Dst: "/usr/bin/kubelet"}}}}
+	err = processComponentMetadata(context.Background(), slog.Default(), componentFS, "kubelet", "uninstalled", uninstall, nil, NodeMetadata{SystemExtensions: true})
+	if err != nil {
+		t.Fatalf("failed to uninstall component: %v", err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, "var/lib/extensions/scw-k8s-kubelet"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the system extension removed, got %v", err)
+	}
+	commands, err = os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(commands), "/usr/bin/systemd-sysext refresh\n") {
+		t.Errorf("expected the extensions merged again, got %q", commands)
+	}
+}
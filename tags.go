@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Tags are the tag expressions of a component, the component matches the node installer tags if any
+// of its expressions is true. An expression is a tag, or a boolean expression of tags using !, &&, ||
+// and parentheses. A single expression can be written as a string.
+//
+//	tags: [gpu, kosmos]
+//	tags: gpu && !kosmos
+type Tags []string
+
+func (t *Tags) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = Tags{value.Value}
+		return nil
+	}
+
+	var tags []string
+	err := value.Decode(&tags)
+	if err != nil {
+		return err
+	}
+	*t = tags
+	return nil
+}
+
+// Match returns true if any of the tag expressions is true for the node tags
+func (t Tags) Match(nodeTags []string) (bool, error) {
+	for _, expression := range t {
+		match, err := evalTagExpression(expression, nodeTags)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// evalTagExpression evaluates the tag expression, a tag is true if the node has it
+func evalTagExpression(expression string, nodeTags []string) (bool, error) {
+	tokens, err := tagTokens(expression)
+	if err != nil {
+		return false, err
+	}
+
+	parser := tagParser{tokens: tokens, nodeTags: nodeTags}
+	result, err := parser.or()
+	if err != nil {
+		return false, fmt.Errorf("invalid tag expression %q: %w", expression, err)
+	}
+	if parser.pos < len(parser.tokens) {
+		return false, fmt.Errorf("invalid tag expression %q: unexpected %q", expression, parser.tokens[parser.pos])
+	}
+
+	return result, nil
+}
+
+// tagTokens splits the expression in operators, parentheses and tags
+func tagTokens(expression string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expression); {
+		switch c := expression[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.HasPrefix(expression[i:], "&&"), strings.HasPrefix(expression[i:], "||"):
+			tokens = append(tokens, expression[i:i+2])
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			end := i
+			for end < len(expression) && !strings.ContainsRune(" \t&|!()", rune(expression[end])) {
+				end++
+			}
+			tag := expression[i:end]
+			if !tagRegexp.MatchString(tag) {
+				return nil, fmt.Errorf("invalid tag %q in expression %q", tag, expression)
+			}
+			tokens = append(tokens, tag)
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+// tagParser is a recursive descent parser evaluating the expression:
+//
+//	or    = and { "||" and }
+//	and   = unary { "&&" unary }
+//	unary = "!" unary | "(" or ")" | tag
+type tagParser struct {
+	tokens   []string
+	pos      int
+	nodeTags []string
+}
+
+func (p *tagParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *tagParser) or() (bool, error) {
+	result, err := p.and()
+	if err != nil {
+		return false, err
+	}
+	for p.next() == "||" {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return false, err
+		}
+		result = result || right
+	}
+	return result, nil
+}
+
+func (p *tagParser) and() (bool, error) {
+	result, err := p.unary()
+	if err != nil {
+		return false, err
+	}
+	for p.next() == "&&" {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return false, err
+		}
+		result = result && right
+	}
+	return result, nil
+}
+
+func (p *tagParser) unary() (bool, error) {
+	token := p.next()
+	p.pos++
+	switch token {
+	case "":
+		return false, fmt.Errorf("unexpected end")
+	case "!":
+		result, err := p.unary()
+		return !result, err
+	case "(":
+		result, err := p.or()
+		if err != nil {
+			return false, err
+		}
+		if p.next() != ")" {
+			return false, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return result, nil
+	case "&&", "||", ")":
+		return false, fmt.Errorf("unexpected %q", token)
+	default:
+		return slices.Contains(p.nodeTags, token), nil
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEvalTagExpression(t *testing.T) {
+	nodeTags := []string{"gpu", "fr-par"}
+
+	tests := []struct {
+		name       string
+		expression string
+		expected   bool
+		wantErr    bool
+	}{
+		{name: "tag", expression: "gpu", expected: true},
+		{name: "missing tag", expression: "kosmos", expected: false},
+		{name: "and not", expression: "gpu && !kosmos", expected: true},
+		{name: "or", expression: "kosmos || fr-par", expected: true},
+		{name: "precedence", expression: "kosmos && gpu || !fr-par", expected: false},
+		{name: "parentheses", expression: "!(kosmos || gpu)", expected: false},
+		{name: "missing parenthesis", expression: "(gpu || kosmos", wantErr: true},
+		{name: "dangling operator", expression: "gpu &&", wantErr: true},
+		{name: "invalid tag", expression: "gpu & kosmos", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := evalTagExpression(tt.expression, nodeTags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("evalTagExpression() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("evalTagExpression() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// templateDiffsDir is where the diff of the last change of each rendered template is saved, eg: to see
+// what an upgrade changed in the kubelet or containerd configuration
+var templateDiffsDir = filepath.Join(stateDir, "diffs")
+
+// redactedValue replaces the secrets in the template diffs
+const redactedValue = "<redacted>"
+
+// secretLineRegexp matches the keys of the configuration lines holding a secret, their value is redacted,
+// eg: the base64 credentials of the containerd registry auth
+var secretLineRegexp = regexp.MustCompile(`(?i)^.*?(token|password|passwd|secret|private[_-]?key|key-data|certificate-data|\bauth)["']?\s*[:=]\s*`)
+
+// recordTemplateDiff saves the redacted unified diff of a template render changing an existing file,
+// and logs it at debug level. The secrets are the values redacted wherever they appear.
+func recordTemplateDiff(dst string, content []byte, secrets ...string) error {
+	previous, err := os.ReadFile(hostPath(dst))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", dst, err)
+	}
+	if bytes.Equal(previous, content) {
+		return nil
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        redactLines(string(previous), secrets),
+		B:        redactLines(string(content), secrets),
+		FromFile: dst,
+		ToFile:   dst,
+		Context:  3,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to diff %s: %w", dst, err)
+	}
+	slog.Debug("Template changed", slog.String("template", dst), slog.String("diff", diff))
+
+	err = os.MkdirAll(hostPath(templateDiffsDir), 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create diffs directory: %w", err)
+	}
+	header := fmt.Sprintf("# %s\n", time.Now().UTC().Format(time.RFC3339))
+	err = writeFileSync(templateDiffPath(dst), []byte(header+diff), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write diff of %s: %w", dst, err)
+	}
+
+	return nil
+}
+
+// templateDiffEscaper escapes the destination paths into distinct file names: the escape character and the
+// underscores are percent-encoded, so they never collide with the path separators
+var templateDiffEscaper = strings.NewReplacer("%", "%25", "_", "%5F", "/", "_")
+
+// templateDiffPath returns the path of the diff of the template destination, eg:
+// /var/lib/scw-k8s-agent/diffs/etc_containerd_config.toml.diff
+func templateDiffPath(dst string) string {
+	return filepath.Join(templateDiffsDir, templateDiffEscaper.Replace(strings.TrimPrefix(filepath.Clean(dst), "/"))+".diff")
+}
+
+// redactLines splits the content in lines, with the secret values, the values of the secret keys and
+// the private keys redacted
+func redactLines(content string, secrets []string) []string {
+	lines := difflib.SplitLines(content)
+	privateKey := false
+	for i, line := range lines {
+		for _, secret := range secrets {
+			if secret != "" {
+				line = strings.ReplaceAll(line, secret, redactedValue)
+			}
+		}
+
+		switch {
+		case strings.Contains(line, "-----BEGIN") && strings.Contains(line, "PRIVATE KEY-----"):
+			privateKey = true
+		case strings.Contains(line, "-----END") && strings.Contains(line, "PRIVATE KEY-----"):
+			privateKey = false
+		case privateKey:
+			line = redactedValue + "\n"
+		default:
+			if match := secretLineRegexp.FindString(line); match != "" {
+				line = match + redactedValue + "\n"
+			}
+		}
+		lines[i] = line
+	}
+	return lines
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ControllerTuning tunes the Kubernetes API footprint of the controller of each node, eg: on very large
+// clusters. The defaults are used for the fields not set.
+//
+//	"controller_tuning": {
+//	   "informer_resync": "24h",
+//	   "handler_resync": "1m",
+//	   "qps": 5,
+//	   "burst": 10,
+//	   "queue_base_delay": "5ms",
+//	   "queue_max_delay": "1000s",
+//	   "queue_qps": 50,
+//	   "queue_burst": 300
+//	}
+type ControllerTuning struct {
+	InformerResync string  `json:"informer_resync,omitempty"`  // Full resync of the informers cache
+	HandlerResync  string  `json:"handler_resync,omitempty"`   // Resync of the node event handler, the reconcile loop period
+	QPS            float32 `json:"qps,omitempty"`              // Kubernetes client requests per second
+	Burst          int     `json:"burst,omitempty"`            // Kubernetes client requests burst
+	QueueBaseDelay string  `json:"queue_base_delay,omitempty"` // First retry delay of a failed reconcile, doubled on each failure
+	QueueMaxDelay  string  `json:"queue_max_delay,omitempty"`  // Maximum retry delay of a failed reconcile
+	QueueQPS       float64 `json:"queue_qps,omitempty"`        // Overall reconciles per second
+	QueueBurst     int     `json:"queue_burst,omitempty"`      // Overall reconciles burst
+}
+
+// controllerSettings are the controller tuning values, with their defaults
+type controllerSettings struct {
+	InformerResync time.Duration
+	HandlerResync  time.Duration
+	QPS            float32
+	Burst          int
+	QueueBaseDelay time.Duration
+	QueueMaxDelay  time.Duration
+	QueueQPS       float64
+	QueueBurst     int
+}
+
+var defaultControllerSettings = controllerSettings{
+	InformerResync: 24 * time.Hour,
+	HandlerResync:  time.Minute,
+	QPS:            5,
+	Burst:          10,
+	QueueBaseDelay: 5 * time.Millisecond,
+	QueueMaxDelay:  1000 * time.Second,
+	QueueQPS:       50,
+	QueueBurst:     300,
+}
+
+// settingsOrDefaults returns the controller settings, the defaults with a warning if the tuning is
+// invalid, so an invalid tuning does not prevent the controller from running
+func (t *ControllerTuning) settingsOrDefaults() controllerSettings {
+	settings, err := t.settings()
+	if err != nil {
+		slog.Warn("Invalid controller tuning, using the defaults", slog.Any("error", err))
+		return defaultControllerSettings
+	}
+	return settings
+}
+
+// settings returns the controller settings, the defaults if the tuning is not set
+func (t *ControllerTuning) settings() (controllerSettings, error) {
+	settings := defaultControllerSettings
+	if t == nil {
+		return settings, nil
+	}
+
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{name: "informer_resync", value: t.InformerResync, field: &settings.InformerResync},
+		{name: "handler_resync", value: t.HandlerResync, field: &settings.HandlerResync},
+		{name: "queue_base_delay", value: t.QueueBaseDelay, field: &settings.QueueBaseDelay},
+		{name: "queue_max_delay", value: t.QueueMaxDelay, field: &settings.QueueMaxDelay},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(duration.value)
+		if err != nil || value <= 0 {
+			return controllerSettings{}, fmt.Errorf("invalid controller tuning %s %q", duration.name, duration.value)
+		}
+		*duration.field = value
+	}
+	if settings.QueueBaseDelay > settings.QueueMaxDelay {
+		return controllerSettings{}, fmt.Errorf("invalid controller tuning: queue_base_delay %s exceeds queue_max_delay %s", settings.QueueBaseDelay, settings.QueueMaxDelay)
+	}
+
+	if t.QPS < 0 || t.Burst < 0 || t.QueueQPS < 0 || t.QueueBurst < 0 {
+		return controllerSettings{}, fmt.Errorf("invalid controller tuning: negative rate limit")
+	}
+	if t.QPS > 0 {
+		settings.QPS = t.QPS
+	}
+	if t.Burst > 0 {
+		settings.Burst = t.Burst
+	}
+	if t.QueueQPS > 0 {
+		settings.QueueQPS = t.QueueQPS
+	}
+	if t.QueueBurst > 0 {
+		settings.QueueBurst = t.QueueBurst
+	}
+
+	return settings, nil
+}
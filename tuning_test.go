@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControllerTuningSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		tuning   *ControllerTuning
+		expected controllerSettings
+		err      string
+	}{
+		{name: "not set", expected: defaultControllerSettings},
+		{name: "empty", tuning: &ControllerTuning{}, expected: defaultControllerSettings},
+		{
+			name:   "large cluster",
+			tuning: &ControllerTuning{InformerResync: "48h", HandlerResync: "5m", QPS: 1, Burst: 2, QueueBaseDelay: "1s", QueueMaxDelay: "1h", QueueQPS: 1, QueueBurst: 5},
+			expected: controllerSettings{
+				InformerResync: 48 * time.Hour,
+				HandlerResync:  5 * time.Minute,
+				QPS:            1,
+				Burst:          2,
+				QueueBaseDelay: time.Second,
+				QueueMaxDelay:  time.Hour,
+				QueueQPS:       1,
+				QueueBurst:     5,
+			},
+		},
+		{
+			name:   "partial",
+			tuning: &ControllerTuning{HandlerResync: "10m", QPS: 2},
+			expected: func() controllerSettings {
+				settings := defaultControllerSettings
+				settings.HandlerResync, settings.QPS = 10*time.Minute, 2
+				return settings
+			}(),
+		},
+		{name: "invalid duration", tuning: &ControllerTuning{InformerResync: "daily"}, err: `invalid controller tuning informer_resync "daily"`},
+		{name: "zero duration", tuning: &ControllerTuning{HandlerResync: "0s"}, err: "invalid controller tuning handler_resync"},
+		{name: "base delay over max delay", tuning: &ControllerTuning{QueueBaseDelay: "1h", QueueMaxDelay: "1m"}, err: "exceeds queue_max_delay"},
+		{name: "negative rate limit", tuning: &ControllerTuning{Burst: -1}, err: "negative rate limit"},
+	}
+	for _, test := range tests {
+		settings, err := test.tuning.settings()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil || settings != test.expected {
+			t.Errorf("%s: got %+v, %v, expected %+v", test.name, settings, err, test.expected)
+		}
+	}
+}
+
+func TestControllerTuningDefaults(t *testing.T) {
+	// An invalid tuning falls back to the defaults instead of preventing the controller from running
+	tuning := &ControllerTuning{QueueBaseDelay: "1h", QueueMaxDelay: "1m", QPS: 2}
+	settings := tuning.settingsOrDefaults()
+	if settings != defaultControllerSettings {
+		t.Errorf("expected the default settings, got %+v", settings)
+	}
+
+	tuning = &ControllerTuning{QPS: 2}
+	settings = tuning.settingsOrDefaults()
+	if settings.QPS != 2 {
+		t.Errorf("expected the tuning applied, got %+v", settings)
+	}
+}
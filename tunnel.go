@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tunnel is the WireGuard tunnel connecting a Kosmos external node to the cluster
+//
+//	{
+//	   "interface": "wg-kosmos",
+//	   "address": "100.64.0.10/32",
+//	   "listen_port": 51820,
+//	   "mtu": 1420,
+//	   "peers": [{
+//	      "public_key": "...",
+//	      "endpoint": "51.15.0.1:51820",
+//	      "allowed_ips": ["100.64.0.0/16", "10.32.0.0/12"],
+//	      "persistent_keepalive": 25
+//	   }],
+//	   "routes": ["10.32.0.0/12"]
+//	}
+type Tunnel struct {
+	Interface  string       `json:"interface,omitempty"`
+	PrivateKey string       `json:"private_key,omitempty"` // Generated and kept on the node if empty
+	Address    string       `json:"address"`
+	ListenPort int          `json:"listen_port,omitempty"`
+	MTU        int          `json:"mtu,omitempty"`
+	Peers      []TunnelPeer `json:"peers"`
+	Routes     []string     `json:"routes,omitempty"`
+}
+
+type TunnelPeer struct {
+	PublicKey           string   `json:"public_key"`
+	Endpoint            string   `json:"endpoint,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+}
+
+// tunnelHandshakeTimeout is the maximum age of the last handshake of a healthy peer,
+// WireGuard handshakes every 2 minutes when the tunnel is used or kept alive
+const tunnelHandshakeTimeout = 3 * time.Minute
+
+const tunnelKeysDir = "/etc/wireguard"
+
+// tunnelPublicKeyAnnotation publishes the public key of the tunnel on the node, the control plane adds
+// it as a peer of the cluster side of the tunnel
+var tunnelPublicKeyAnnotation = defaultAnnotationPrefix + "tunnel-public-key"
+
+// tunnelInterfacePattern matches the valid interface names, the name is also the name of the tunnel
+// configuration and key files
+var tunnelInterfacePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// Validate checks the tunnel interface name
+func (t Tunnel) Validate() error {
+	if t.Interface != "" && (!tunnelInterfacePattern.MatchString(t.Interface) || t.Interface == "." || t.Interface == "..") {
+		return fmt.Errorf("invalid tunnel interface %q, expected at most 15 letters, digits, '_', '.' or '-'", t.Interface)
+	}
+	return nil
+}
+
+func (t Tunnel) interfaceName() string {
+	if t.Interface == "" {
+		return "wg-kosmos"
+	}
+	return t.Interface
+}
+
+// setupTunnel creates and configures the WireGuard interface and its routes
+func setupTunnel(tunnel Tunnel) error {
+	err := tunnel.Validate()
+	if err != nil {
+		return err
+	}
+	iface := tunnel.interfaceName()
+
+	// Create the interface if it does not exist
+	if _, err := net.InterfaceByName(iface); err != nil {
+		cmd := command("/usr/sbin/ip", "link", "add", "dev", iface, "type", "wireguard")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to create interface %s: %w: %s", iface, err, output)
+		}
+	}
+
+	// Write the WireGuard configuration and apply it
+	privateKey, err := tunnelPrivateKey(tunnel)
+	if err != nil {
+		return err
+	}
+	configPath := filepath.Join(tunnelKeysDir, iface+".conf")
+	err = os.WriteFile(hostPath(configPath), []byte(tunnelConfig(tunnel, privateKey)), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write tunnel configuration: %w", err)
+	}
+	cmd := command("/usr/bin/wg", "setconf", iface, configPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to configure interface %s: %w: %s", iface, err, output)
+	}
+
+	// Configure the address, MTU and bring the interface up
+	err = configureInterface(NetworkInterface{Name: iface, MTU: tunnel.MTU, Addresses: []string{tunnel.Address}})
+	if err != nil {
+		return fmt.Errorf("failed to configure interface %s: %w", iface, err)
+	}
+
+	// Route the cluster networks through the tunnel
+	for _, route := range tunnel.Routes {
+		cmd = command("/usr/sbin/ip", "route", "replace", route, "dev", iface)
+		output, err = cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to add route %s: %w: %s", route, err, output)
+		}
+	}
+
+	slog.Info("Tunnel configured", slog.String("interface", iface), slog.Int("peers", len(tunnel.Peers)))
+
+	return nil
+}
+
+// tunnelPrivateKey returns the private key from the metadata, or the one generated and kept on the node
+func tunnelPrivateKey(tunnel Tunnel) (string, error) {
+	err := tunnel.Validate()
+	if err != nil {
+		return "", err
+	}
+	if tunnel.PrivateKey != "" {
+		return tunnel.PrivateKey, nil
+	}
+
+	keyPath := filepath.Join(tunnelKeysDir, tunnel.interfaceName()+".key")
+	key, err := os.ReadFile(hostPath(keyPath))
+	if err == nil {
+		return strings.TrimSpace(string(key)), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("failed to read tunnel private key: %w", err)
+	}
+
+	cmd := command("/usr/bin/wg", "genkey")
+	key, err = cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate tunnel private key: %w", err)
+	}
+
+	err = os.MkdirAll(hostPath(tunnelKeysDir), 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", tunnelKeysDir, err)
+	}
+	err = os.WriteFile(hostPath(keyPath), key, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to write tunnel private key: %w", err)
+	}
+
+	return strings.TrimSpace(string(key)), nil
+}
+
+// tunnelPublicKey returns the public key of the tunnel private key, in the wg pubkey format
+func tunnelPublicKey(tunnel Tunnel) (string, error) {
+	privateKey, err := tunnelPrivateKey(tunnel)
+	if err != nil {
+		return "", err
+	}
+	key, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid tunnel private key: %w", err)
+	}
+	ecdhKey, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid tunnel private key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(ecdhKey.PublicKey().Bytes()), nil
+}
+
+// tunnelConfig renders the configuration in the wg setconf format
+func tunnelConfig(tunnel Tunnel, privateKey string) string {
+	var config strings.Builder
+	fmt.Fprintf(&config, "# %s\n[Interface]\nPrivateKey = %s\n", managedHeaderText, privateKey)
+	if tunnel.ListenPort != 0 {
+		fmt.Fprintf(&config, "ListenPort = %d\n", tunnel.ListenPort)
+	}
+	for _, peer := range tunnel.Peers {
+		fmt.Fprintf(&config, "\n[Peer]\nPublicKey = %s\nAllowedIPs = %s\n", peer.PublicKey, strings.Join(peer.AllowedIPs, ", "))
+		if peer.Endpoint != "" {
+			fmt.Fprintf(&config, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&config, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return config.String()
+}
+
+// checkTunnel returns an error describing why the tunnel is not healthy
+func checkTunnel(tunnel Tunnel, now time.Time) error {
+	iface := tunnel.interfaceName()
+
+	cmd := command("/usr/bin/wg", "show", iface, "latest-handshakes")
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to get interface %s handshakes: %w", iface, err)
+	}
+
+	handshakes := make(map[string]time.Time)
+	for line := range strings.Lines(string(output)) {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse handshake %q: %w", line, err)
+		}
+		handshakes[fields[0]] = time.Unix(timestamp, 0)
+	}
+
+	for _, peer := range tunnel.Peers {
+		handshake, ok := handshakes[peer.PublicKey]
+		if !ok || handshake.Unix() == 0 {
+			return fmt.Errorf("no handshake with peer %s", peer.Endpoint)
+		}
+		if age := now.Sub(handshake); age > tunnelHandshakeTimeout {
+			return fmt.Errorf("last handshake with peer %s was %s ago", peer.Endpoint, age.Round(time.Second))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestTunnelPublicKey(t *testing.T) {
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+
+	// RFC 7748 X25519 test vector
+	publicKey, err := tunnelPublicKey(Tunnel{PrivateKey: "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="})
+	if err != nil {
+		t.Fatalf("failed to get public key: %v", err)
+	}
+	if publicKey != "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo=" {
+		t.Errorf("public key = %s", publicKey)
+	}
+
+	_, err = tunnelPublicKey(Tunnel{PrivateKey: "invalid"})
+	if err == nil {
+		t.Error("expected an invalid private key error")
+	}
+}
+
+func TestTunnelConfig(t *testing.T) {
+	config := tunnelConfig(Tunnel{
+		ListenPort: 51820,
+		Peers: []TunnelPeer{{
+			PublicKey:           "peer-key",
+			Endpoint:            "51.15.0.1:51820",
+			AllowedIPs:          []string{"100.64.0.0/16", "10.32.0.0/12"},
+			PersistentKeepalive: 25,
+		}},
+	}, "private-key")
+
+	expected := "[Interface]\nPrivateKey = private-key\nListenPort = 51820\n\n[Peer]\nPublicKey = peer-key\nAllowedIPs = 100.64.0.0/16, 10.32.0.0/12\nEndpoint = 51.15.0.1:51820\nPersistentKeepalive = 25\n"
+	if !strings.HasSuffix(config, expected) {
+		t.Errorf("config = %q, expected suffix %q", config, expected)
+	}
+}
+
+func TestTunnelValidate(t *testing.T) {
+	for _, iface := range []string{"", "wg-kosmos", "wg0", "wg_kosmos.1"} {
+		err := Tunnel{Interface: iface}.Validate()
+		if err != nil {
+			t.Errorf("expected interface %q valid, got %v", iface, err)
+		}
+	}
+	for _, iface := range []string{"../../etc/modprobe.d/x", "wg/kosmos", "..", "wg kosmos", "wg-kosmos-cluster"} {
+		err := Tunnel{Interface: iface}.Validate()
+		if err == nil {
+			t.Errorf("expected interface %q invalid", iface)
+		}
+	}
+
+	// The tunnel configuration is never written outside of the WireGuard directory
+	defer func(previousRoot string) {
+		rootDir = previousRoot
+	}(rootDir)
+	rootDir = t.TempDir()
+	err := setupTunnel(Tunnel{Interface: "../../etc/modprobe.d/x", PrivateKey: "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="})
+	if err == nil || !strings.Contains(err.Error(), "invalid tunnel interface") {
+		t.Errorf("expected the tunnel interface refused, got %v", err)
+	}
+}
+
+func TestDumpNodeMetadataRedacted(t *testing.T) {
+	metadata := NodeMetadata{Tunnel: &Tunnel{PrivateKey: "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo="}}
+	dump, err := dumpNodeMetadata(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(dump, metadata.Tunnel.PrivateKey) || !strings.Contains(dump, `"private_key": "redacted"`) {
+		t.Errorf("expected the tunnel private key redacted, got %s", dump)
+	}
+}
+
+func TestSyncTunnel(t *testing.T) {
+	defer func(previousRoot, previousManager string, previousMetadata func(context.Context) (NodeMetadata, error)) {
+		rootDir, serviceManager, privilegedNodeMetadata = previousRoot, previousManager, previousMetadata
+	}(rootDir, serviceManager, privilegedNodeMetadata)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+	tunnel := &Tunnel{Interface: "lo", PrivateKey: "dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo=", Peers: []TunnelPeer{{PublicKey: "peer-key", Endpoint: "51.15.0.1:51820"}}}
+	privilegedNodeMetadata = func(ctx context.Context) (NodeMetadata, error) {
+		return NodeMetadata{Tunnel: tunnel}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+	client := fake.NewClientset(node)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err := indexer.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Controller{
+		nodeName:     "node",
+		nodeMetadata: NodeMetadata{Tunnel: tunnel},
+		client:       client,
+		nodesLister:  corelisters.NewNodeLister(indexer),
+		privileged:   localPrivileged{},
+		recorder:     newEventRecorder(ctx, client, "node"),
+		logger:       slog.Default(),
+	}
+
+	// The public key is published and the tunnel without handshake is reported unavailable
+	err = c.syncTunnel(ctx)
+	if err != nil {
+		t.Fatalf("failed to sync tunnel: %v", err)
+	}
+	var patched bool
+	for _, action := range client.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			patched = strings.Contains(string(patch.GetPatch()), `"`+tunnelPublicKeyAnnotation+`":"hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="`)
+		}
+	}
+	if !patched {
+		t.Errorf("expected the public key annotation patched, got %v", client.Actions())
+	}
+	updated, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Status.Conditions) != 1 || updated.Status.Conditions[0].Type != "AgentTunnelUnavailable" || updated.Status.Conditions[0].Status != corev1.ConditionTrue {
+		t.Errorf("expected the tunnel unavailable condition, got %v", updated.Status.Conditions)
+	}
+}
+
+func TestSetNodeConditionFalseNotCreated(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	err := indexer.Add(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Controller{nodeName: "node", client: fake.NewClientset(node), nodesLister: corelisters.NewNodeLister(indexer)}
+
+	// The absence of the condition means false, it is not created
+	changed, err := c.setNodeCondition(context.Background(), "AgentTunnelUnavailable", corev1.ConditionFalse, "TunnelHealthy", "All the tunnel peers handshaked recently")
+	if err != nil || changed {
+		t.Errorf("expected the false condition not created, got %v, %v", changed, err)
+	}
+	changed, err = c.setNodeCondition(context.Background(), "AgentTunnelUnavailable", corev1.ConditionTrue, "TunnelUnhealthy", "No handshake from peer peer-key")
+	if err != nil || !changed {
+		t.Errorf("expected the true condition created, got %v, %v", changed, err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const agentUnitName = "scw-k8s-agent.service"
+
+// agentUnitStartMargin is the time left to the agent after the bootstrap timeout to report it and exit
+// with its status, before systemd stops the start of the unit
+const agentUnitStartMargin = 5 * time.Minute
+
+// agentUnit renders the hardened systemd unit of the agent. The file system is read-only except the
+// directories the components are installed in (eg: /usr/bin, /boot) and the kubeconfigs of root, the
+// agent enters the pods network namespaces so the namespaces are not protected, and the capabilities
+// are bounded to the ones the installation requires. The start of the unit, the initial install, is only
+// bounded by the bootstrap timeout.
+func agentUnit(args []string, bootstrapTimeout time.Duration) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, systemdQuote(arg))
+	}
+
+	startTimeout := "infinity"
+	if bootstrapTimeout > 0 {
+		startTimeout = fmt.Sprintf("%ds", int64((bootstrapTimeout + agentUnitStartMargin).Seconds()))
+	}
+
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "# %s\n", managedHeaderText)
+	fmt.Fprintf(&unit, "[Unit]\nDescription=Scaleway Kubernetes node agent\nWants=network-online.target\nAfter=network-online.target\n\n")
+	fmt.Fprintf(&unit, "[Service]\nType=notify\nNotifyAccess=all\nExecStart=%s\n", strings.Join(quoted, " "))
+	fmt.Fprintf(&unit, "Restart=on-failure\nRestartSec=10s\nWatchdogSec=5min\nTimeoutStartSec=%s\n", startTimeout)
+	fmt.Fprintf(&unit, "RestartPreventExitStatus=%d\n\n", exitBootstrap)
+	fmt.Fprintf(&unit, "# Hardening\n")
+	fmt.Fprintf(&unit, "ProtectSystem=strict\nProtectHome=read-only\n")
+	fmt.Fprintf(&unit, "ReadWritePaths=/etc /usr -/lib /boot /opt /var /run /root\n")
+	fmt.Fprintf(&unit, "PrivateTmp=yes\nProtectClock=yes\nProtectHostname=yes\n")
+	fmt.Fprintf(&unit, "ProtectKernelLogs=yes\nLockPersonality=yes\nRestrictRealtime=yes\n")
+	fmt.Fprintf(&unit, "RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK\n")
+	fmt.Fprintf(&unit, "CapabilityBoundingSet=CAP_CHOWN CAP_DAC_OVERRIDE CAP_FOWNER CAP_FSETID CAP_SETUID CAP_SETGID ")
+	fmt.Fprintf(&unit, "CAP_KILL CAP_MKNOD CAP_NET_ADMIN CAP_NET_BIND_SERVICE CAP_SYS_ADMIN CAP_SYS_MODULE CAP_SYS_NICE\n\n")
+	fmt.Fprintf(&unit, "[Install]\nWantedBy=multi-user.target\n")
+	return unit.String()
+}
+
+// installAgentUnit writes the agent unit running the agent with the given arguments and enables it
+func installAgentUnit(args []string, bootstrapTimeout time.Duration) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get agent executable: %w", err)
+	}
+
+	err = writeFileSync(filepath.Join(systemdUnitsDir, agentUnitName), []byte(agentUnit(slices.Concat([]string{executable}, args), bootstrapTimeout)), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write agent unit: %w", err)
+	}
+
+	cmd := command("/usr/bin/systemctl", "daemon-reload")
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to daemon-reload: %w", err)
+	}
+
+	cmd = command("/usr/bin/systemctl", "enable", agentUnitName)
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("failed to enable agent unit: %w", err)
+	}
+
+	return nil
+}
+
+// systemdQuote quotes an ExecStart argument, the specifiers and the variables are escaped so the
+// argument is passed verbatim
+func systemdQuote(arg string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + replacer.Replace(arg) + `"`
+}
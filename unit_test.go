@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentUnit(t *testing.T) {
+	unit := agentUnit([]string{"/usr/local/bin/scw-k8s-agent", "-controller-user", "scw agent", `-label=a"b`, "-format=%s$HOME"}, 0)
+
+	// The arguments are passed verbatim, with their spaces, quotes, specifiers and variables
+	expected := `ExecStart="/usr/local/bin/scw-k8s-agent" "-controller-user" "scw agent" "-label=a\"b" "-format=%%s$$HOME"` + "\n"
+	if !strings.Contains(unit, expected) {
+		t.Errorf("expected %q in unit:\n%s", expected, unit)
+	}
+
+	// The file system is read-only except the installation directories, eg: /usr and /boot
+	if !strings.Contains(unit, "ProtectSystem=strict\n") || !strings.Contains(unit, "ReadWritePaths=/etc /usr -/lib /boot /opt /var /run /root\n") {
+		t.Errorf("expected the file system protected in unit:\n%s", unit)
+	}
+	if strings.Contains(unit, "RestrictNamespaces=") {
+		t.Errorf("unexpected RestrictNamespaces= in unit:\n%s", unit)
+	}
+	// The start is not bounded without bootstrap timeout, the agent reports the timeout before systemd otherwise
+	if !strings.Contains(unit, "TimeoutStartSec=infinity\n") {
+		t.Errorf("expected an unbounded start in unit:\n%s", unit)
+	}
+	unit = agentUnit([]string{"/usr/local/bin/scw-k8s-agent", "-bootstrap-timeout", "1h"}, time.Hour)
+	if !strings.Contains(unit, "TimeoutStartSec=3900s\n") {
+		t.Errorf("expected the start bounded after the bootstrap timeout in unit:\n%s", unit)
+	}
+	if !strings.Contains(unit, "Type=notify\n") || !strings.HasSuffix(unit, "[Install]\nWantedBy=multi-user.target\n") {
+		t.Errorf("unexpected unit:\n%s", unit)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// systemdUnitSuffixes are the suffixes of the unit files verified once installed, the drop-ins of the
+// units are not verified as they are not complete units
+var systemdUnitSuffixes = []string{".service", ".socket", ".mount", ".automount", ".swap", ".timer", ".path", ".target", ".slice"}
+
+// isSystemdUnit returns whether the destination is a unit file of the systemd units directory
+func isSystemdUnit(dst string) bool {
+	return filepath.Dir(filepath.Clean(dst)) == systemdUnitsDir && slices.Contains(systemdUnitSuffixes, filepath.Ext(dst))
+}
+
+// unitExecutableErrorRegexp matches the verification errors of the unit commands not executable, they
+// are not refused since the binary may be installed later, eg: by the component scripts
+var unitExecutableErrorRegexp = regexp.MustCompile(`: Command .* is not executable`)
+
+// analyzeUnits runs systemd-analyze verify on the unit files, the errors of the units they depend on
+// are not reported
+var analyzeUnits = func(paths []string) ([]byte, error) {
+	return command("/usr/bin/systemd-analyze", slices.Concat([]string{"verify", "--man=no", "--recursive-errors=no"}, paths)...).CombinedOutput()
+}
+
+// verifyComponentUnits verifies the unit files managed by the component once all its files are written,
+// so an invalid unit fails the component instead of leaving the service unstartable after the
+// daemon-reload. The units are verified in the alternate root during the image builds.
+func verifyComponentUnits(name string) error {
+	managedFilesMu.Lock()
+	managedFiles, err := loadManagedFiles()
+	managedFilesMu.Unlock()
+	if err != nil {
+		return err
+	}
+	var units []string
+	for path, component := range managedFiles {
+		if component == name && isSystemdUnit(path) {
+			units = append(units, path)
+		}
+	}
+	if len(units) == 0 {
+		return nil
+	}
+	slices.Sort(units)
+
+	output, err := analyzeUnits(units)
+	if err == nil {
+		return nil
+	}
+	var errs []string
+	for line := range strings.Lines(string(output)) {
+		line = strings.TrimSpace(line)
+		if line != "" && !unitExecutableErrorRegexp.MatchString(line) {
+			errs = append(errs, line)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid systemd units of component %s: %w: %s", name, err, strings.Join(errs, "; "))
+}
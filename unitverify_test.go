@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsSystemdUnit(t *testing.T) {
+	tests := []struct {
+		dst      string
+		expected bool
+	}{
+		{dst: "/etc/systemd/system/kubelet.service", expected: true},
+		{dst: "/etc/systemd/system/var-lib-containerd.mount", expected: true},
+		{dst: "/etc/systemd/system/kubelet.service.d/10-agent.conf", expected: false},
+		{dst: "/usr/lib/systemd/system/kubelet.service", expected: false},
+		{dst: "/etc/systemd/system/README", expected: false},
+	}
+	for _, test := range tests {
+		if isSystemdUnit(test.dst) != test.expected {
+			t.Errorf("isSystemdUnit(%q) = %v, expected %v", test.dst, !test.expected, test.expected)
+		}
+	}
+}
+
+func TestVerifyComponentUnits(t *testing.T) {
+	defer func(previousRoot, previousManager string, previousAnalyze func([]string) ([]byte, error)) {
+		rootDir, serviceManager, analyzeUnits = previousRoot, previousManager, previousAnalyze
+	}(rootDir, serviceManager, analyzeUnits)
+	rootDir = t.TempDir()
+	serviceManager = fakeServiceManager
+
+	// No verification without unit
+	err := recordManagedFile("/etc/kubernetes/kubelet.yaml", "kubelet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyComponentUnits("kubelet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = os.Stat(filepath.Join(rootDir, commandsLog))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no command, got %v", err)
+	}
+
+	// Only the installed units of the component are verified, without the units they depend on
+	for path, component := range map[string]string{
+		"/etc/systemd/system/kubelet.service":           "kubelet",
+		"/etc/systemd/system/kubelet.service.d/10.conf": "kubelet",
+		"/etc/systemd/system/containerd.service":        "containerd",
+		"/etc/systemd/system/kubelet-gc.timer":          "kubelet",
+	} {
+		err = recordManagedFile(path, component)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = verifyComponentUnits("kubelet")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	commands, err := os.ReadFile(filepath.Join(rootDir, commandsLog))
+	if err != nil {
+		t.Fatalf("failed to read commands log: %v", err)
+	}
+	expected := "/usr/bin/systemd-analyze verify --man=no --recursive-errors=no /etc/systemd/system/kubelet-gc.timer /etc/systemd/system/kubelet.service\n"
+	if string(commands) != expected {
+		t.Errorf("commands = %q, expected %q", commands, expected)
+	}
+
+	// The commands not executable yet are not refused, the other errors fail the component
+	output := "kubelet.service: Command /usr/bin/kubelet is not executable: No such file or directory\n"
+	analyzeUnits = func(paths []string) ([]byte, error) {
+		return []byte(output), errors.New("exit status 1")
+	}
+	err = verifyComponentUnits("kubelet")
+	if err != nil {
+		t.Errorf("expected the missing executable ignored, got %v", err)
+	}
+	output += "kubelet-gc.timer: Unknown key name 'OnCalender' in section 'Timer', ignoring.\nkubelet-gc.timer: Timer unit lacks value setting. Refusing.\n"
+	err = verifyComponentUnits("kubelet")
+	if err == nil || !strings.Contains(err.Error(), "invalid systemd units of component kubelet: exit status 1: kubelet-gc.timer: Unknown key name") || strings.Contains(err.Error(), "not executable") {
+		t.Errorf("expected the invalid timer refused, got %v", err)
+	}
+}
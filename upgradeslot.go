@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UpgradeConcurrency limits the nodes of a group upgrading at once with Lease slots in the cluster, eg:
+// so a mass upgrade of the pool does not take down all the nodes running a critical DaemonSet
+//
+//	{
+//	   "group": "pool-0123",
+//	   "max_upgrading": 2,
+//	   "namespace": "scw-k8s-agent",
+//	   "lease_duration_seconds": 300
+//	}
+type UpgradeConcurrency struct {
+	Group                string `json:"group"`                            // Nodes sharing the slots, eg: the pool ID
+	MaxUpgrading         int    `json:"max_upgrading"`                    // Nodes of the group upgrading at once
+	Namespace            string `json:"namespace,omitempty"`              // Namespace of the leases, scw-k8s-agent if empty
+	LeaseDurationSeconds int32  `json:"lease_duration_seconds,omitempty"` // Slot expiry if not renewed, eg: the agent crashed
+}
+
+// Defaults of the upgrade slots, the namespace is dedicated to them so the nodes are only granted its
+// leases (deploy/upgradeslots.yaml)
+const (
+	defaultUpgradeSlotNamespace     = "scw-k8s-agent"
+	defaultUpgradeSlotLeaseDuration = 5 * time.Minute
+)
+
+// upgradeSlotFailedAnnotation is set on the slot kept by a node whose upgrade failed, with the time of
+// the failure. The slot is not taken over by the other nodes even once expired, so a bad release does not
+// spread across the group, until the node upgrades or the lease is deleted.
+const upgradeSlotFailedAnnotation = "k8s.scaleway.com/upgrade-failed"
+
+// upgradeSlotRetryInterval is the delay before trying again to acquire a slot once all are held
+var upgradeSlotRetryInterval = 30 * time.Second
+
+var upgradeGroupRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// validate checks the group can name the leases and the limit allows an upgrade
+func (u UpgradeConcurrency) validate() error {
+	if !upgradeGroupRegexp.MatchString(u.Group) {
+		return fmt.Errorf("invalid upgrade concurrency group %q, expected a DNS label", u.Group)
+	}
+	if u.MaxUpgrading < 1 {
+		return fmt.Errorf("invalid upgrade concurrency max_upgrading %d, expected at least 1", u.MaxUpgrading)
+	}
+	if u.LeaseDurationSeconds < 0 {
+		return fmt.Errorf("invalid upgrade concurrency lease_duration_seconds %d", u.LeaseDurationSeconds)
+	}
+	return nil
+}
+
+func (u UpgradeConcurrency) namespace() string {
+	if u.Namespace == "" {
+		return defaultUpgradeSlotNamespace
+	}
+	return u.Namespace
+}
+
+func (u UpgradeConcurrency) leaseDuration() time.Duration {
+	if u.LeaseDurationSeconds == 0 {
+		return defaultUpgradeSlotLeaseDuration
+	}
+	return time.Duration(u.LeaseDurationSeconds) * time.Second
+}
+
+// slotName returns the lease name of the slot
+func (u UpgradeConcurrency) slotName(slot int) string {
+	return fmt.Sprintf("scw-k8s-agent-upgrade-%s-%d", u.Group, slot)
+}
+
+// acquireUpgradeSlot acquires a free or expired slot of the group, or the one the node already holds.
+// It returns an empty lease name if all the slots are held by other nodes.
+func (c *Controller) acquireUpgradeSlot(ctx context.Context, concurrency UpgradeConcurrency) (string, error) {
+	// Renew the slot the node already holds first, eg: after a restart, so it never holds two slots
+	leases := c.client.CoordinationV1().Leases(concurrency.namespace())
+	for slot := range concurrency.MaxUpgrading {
+		name := concurrency.slotName(slot)
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get upgrade slot %s: %w", name, err)
+		}
+		if leaseHolder(lease) != c.nodeName {
+			continue
+		}
+		claimed, err := c.claimUpgradeSlot(ctx, concurrency, name)
+		if err != nil {
+			return "", err
+		}
+		if claimed {
+			return name, nil
+		}
+	}
+
+	for slot := range concurrency.MaxUpgrading {
+		name := concurrency.slotName(slot)
+		claimed, err := c.claimUpgradeSlot(ctx, concurrency, name)
+		if err != nil {
+			return "", err
+		}
+		if claimed {
+			return name, nil
+		}
+	}
+
+	return "", nil
+}
+
+// claimUpgradeSlot creates the slot lease, takes it over if expired, or renews it if held by the node.
+// It returns false if the slot is held by another node.
+func (c *Controller) claimUpgradeSlot(ctx context.Context, concurrency UpgradeConcurrency, name string) (bool, error) {
+	leases := c.client.CoordinationV1().Leases(concurrency.namespace())
+	now := metav1.NewMicroTime(time.Now())
+	durationSeconds := int32(concurrency.leaseDuration().Seconds())
+	holderIdentity := c.nodeName
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = leases.Create(ctx, &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: concurrency.namespace()},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holderIdentity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to create upgrade slot %s: %w", name, err)
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get upgrade slot %s: %w", name, err)
+	}
+
+	// Take the slot over if it is held by this node or expired, unless kept by a failed upgrade
+	holder := leaseHolder(lease)
+	if holder != c.nodeName && holder != "" && (!leaseExpired(lease, now.Time) || lease.Annotations[upgradeSlotFailedAnnotation] != "") {
+		return false, nil
+	}
+	lease = lease.DeepCopy()
+	if holder != c.nodeName {
+		lease.Spec.HolderIdentity = &holderIdentity
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update upgrade slot %s: %w", name, err)
+	}
+
+	return true, nil
+}
+
+// leaseExpired returns true if the lease was not renewed within its duration
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// leaseHolder returns the holder of the lease, empty if released
+func leaseHolder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// holdUpgradeSlot renews the slot during the upgrade, it returns the function releasing it once the node
+// is upgraded, or keeping it for the node if the upgrade failed or was interrupted, eg: by a drain timeout
+func (c *Controller) holdUpgradeSlot(ctx context.Context, concurrency UpgradeConcurrency, name string) func(upgraded bool) {
+	leases := c.client.CoordinationV1().Leases(concurrency.namespace())
+	renewCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(concurrency.leaseDuration() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				claimed, err := c.claimUpgradeSlot(renewCtx, concurrency, name)
+				if renewCtx.Err() != nil {
+					return
+				}
+				if err != nil {
+					c.logger.Warn("Failed to renew upgrade slot", slog.String("slot", name), slog.Any("error", err))
+				} else if !claimed {
+					c.logger.Warn("Upgrade slot taken over by another node", slog.String("slot", name))
+				}
+			}
+		}
+	}()
+
+	return func(upgraded bool) {
+		cancel()
+		<-done
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		if err == nil && leaseHolder(lease) != c.nodeName {
+			return
+		}
+
+		// Keep the slot after a failure, it is acquired again by the node to retry its upgrade
+		if err == nil && !upgraded {
+			lease = lease.DeepCopy()
+			if lease.Annotations == nil {
+				lease.Annotations = map[string]string{}
+			}
+			lease.Annotations[upgradeSlotFailedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+			_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+			if err != nil {
+				c.logger.Warn("Failed to keep upgrade slot", slog.String("slot", name), slog.Any("error", err))
+				return
+			}
+			c.logger.Warn("Upgrade slot kept until the node is upgraded", slog.String("slot", name))
+			return
+		}
+
+		// Free the slot for the other nodes once upgraded
+		if err == nil {
+			err = leases.Delete(ctx, name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion}})
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			c.logger.Warn("Failed to release upgrade slot", slog.String("slot", name), slog.Any("error", err))
+			return
+		}
+		c.logger.Info("Upgrade slot released", slog.String("slot", name))
+	}
+}
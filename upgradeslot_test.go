@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAcquireUpgradeSlot(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewClientset()
+	controller := func(name string) *Controller {
+		return &Controller{nodeName: name, client: client, logger: slog.Default()}
+	}
+	concurrency := UpgradeConcurrency{Group: "pool", MaxUpgrading: 2}
+
+	// The slots are acquired by the first nodes, then held
+	expected := map[string]string{
+		"node-a": "scw-k8s-agent-upgrade-pool-0",
+		"node-b": "scw-k8s-agent-upgrade-pool-1",
+		"node-c": "",
+	}
+	for _, name := range []string{"node-a", "node-b", "node-c", "node-a"} {
+		slot, err := controller(name).acquireUpgradeSlot(ctx, concurrency)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", name, err)
+		}
+		if slot != expected[name] {
+			t.Errorf("slot of %s = %q, expected %q", name, slot, expected[name])
+		}
+	}
+
+	// A released slot is acquired by the waiting node
+	release := controller("node-a").holdUpgradeSlot(ctx, concurrency, "scw-k8s-agent-upgrade-pool-0")
+	release(true)
+	_, err := client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Get(ctx, "scw-k8s-agent-upgrade-pool-0", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the released slot to be deleted, got %v", err)
+	}
+	slot, err := controller("node-c").acquireUpgradeSlot(ctx, concurrency)
+	if err != nil || slot != "scw-k8s-agent-upgrade-pool-0" {
+		t.Errorf("expected node-c to acquire the released slot, got %q, %v", slot, err)
+	}
+
+	// An expired slot is taken over
+	lease, err := client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Get(ctx, "scw-k8s-agent-upgrade-pool-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get slot: %v", err)
+	}
+	expired := metav1.NewMicroTime(time.Now().Add(-time.Hour))
+	lease.Spec.RenewTime = &expired
+	_, err = client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Update(ctx, lease, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("failed to update slot: %v", err)
+	}
+	slot, err = controller("node-d").acquireUpgradeSlot(ctx, concurrency)
+	if err != nil || slot != "scw-k8s-agent-upgrade-pool-1" {
+		t.Errorf("expected node-d to take the expired slot over, got %q, %v", slot, err)
+	}
+	lease, _ = client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Get(ctx, "scw-k8s-agent-upgrade-pool-1", metav1.GetOptions{})
+	if leaseHolder(lease) != "node-d" || leaseExpired(lease, time.Now()) {
+		t.Errorf("expected the slot renewed for node-d, got %+v", lease.Spec)
+	}
+
+	// The slot already held is renewed, even if a lower slot is free, eg: after a restart
+	err = client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Delete(ctx, "scw-k8s-agent-upgrade-pool-0", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("failed to delete slot: %v", err)
+	}
+	slot, err = controller("node-d").acquireUpgradeSlot(ctx, concurrency)
+	if err != nil || slot != "scw-k8s-agent-upgrade-pool-1" {
+		t.Errorf("expected node-d to keep its slot, got %q, %v", slot, err)
+	}
+	_, err = client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Get(ctx, "scw-k8s-agent-upgrade-pool-0", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected node-d not to hold a second slot, got %v", err)
+	}
+
+	// The slot of a failed upgrade is kept, even once expired, until the node upgrades
+	release = controller("node-d").holdUpgradeSlot(ctx, concurrency, "scw-k8s-agent-upgrade-pool-1")
+	release(false)
+	lease, err = client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Get(ctx, "scw-k8s-agent-upgrade-pool-1", metav1.GetOptions{})
+	if err != nil || leaseHolder(lease) != "node-d" || lease.Annotations[upgradeSlotFailedAnnotation] == "" {
+		t.Fatalf("expected the failed slot kept by node-d, got %+v, %v", lease, err)
+	}
+	lease.Spec.RenewTime = &expired
+	_, err = client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Update(ctx, lease, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("failed to update slot: %v", err)
+	}
+	claimed, err := controller("node-e").claimUpgradeSlot(ctx, concurrency, "scw-k8s-agent-upgrade-pool-1")
+	if err != nil || claimed {
+		t.Errorf("expected the failed slot not taken over, got %t, %v", claimed, err)
+	}
+	slot, err = controller("node-d").acquireUpgradeSlot(ctx, concurrency)
+	if err != nil || slot != "scw-k8s-agent-upgrade-pool-1" {
+		t.Errorf("expected node-d to acquire its failed slot again, got %q, %v", slot, err)
+	}
+	release = controller("node-d").holdUpgradeSlot(ctx, concurrency, slot)
+	release(true)
+	_, err = client.CoordinationV1().Leases(defaultUpgradeSlotNamespace).Get(ctx, "scw-k8s-agent-upgrade-pool-1", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the slot released once upgraded, got %v", err)
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	now := time.Now()
+	renewed := metav1.NewMicroTime(now.Add(-time.Minute))
+	duration := int32(300)
+	short := int32(30)
+
+	tests := []struct {
+		name     string
+		spec     coordinationv1.LeaseSpec
+		expected bool
+	}{
+		{name: "never renewed", expected: true},
+		{name: "renewed", spec: coordinationv1.LeaseSpec{RenewTime: &renewed, LeaseDurationSeconds: &duration}},
+		{name: "expired", spec: coordinationv1.LeaseSpec{RenewTime: &renewed, LeaseDurationSeconds: &short}, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if expired := leaseExpired(&coordinationv1.Lease{Spec: test.spec}, now); expired != test.expected {
+				t.Errorf("expired = %t, expected %t", expired, test.expected)
+			}
+		})
+	}
+}
+
+func TestUpgradeConcurrencyValidate(t *testing.T) {
+	valid := []UpgradeConcurrency{
+		{Group: "pool-0123", MaxUpgrading: 1},
+		{Group: "b4d6e5f0-8e7a-4c1d-9f2b-3a5c7e9d1f0a", MaxUpgrading: 3, LeaseDurationSeconds: 60},
+	}
+	for _, concurrency := range valid {
+		if err := concurrency.validate(); err != nil {
+			t.Errorf("unexpected error for %+v: %v", concurrency, err)
+		}
+	}
+	invalid := []UpgradeConcurrency{
+		{Group: "", MaxUpgrading: 1},
+		{Group: "Pool", MaxUpgrading: 1},
+		{Group: "pool", MaxUpgrading: 0},
+		{Group: "pool", MaxUpgrading: 1, LeaseDurationSeconds: -1},
+	}
+	for _, concurrency := range invalid {
+		if err := concurrency.validate(); err == nil {
+			t.Errorf("expected an error for %+v", concurrency)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tagRegexp is the format of the component tags
+var tagRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9_.-]*[a-z0-9])?$`)
+
+// unmarshalStrict unmarshals the YAML document, unknown fields are errors reported with their line
+func unmarshalStrict(data []byte, out any) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(out)
+	if errors.Is(err, io.EOF) {
+		// Empty document
+		return nil
+	}
+
+	return err
+}
+
+// validateReleases checks the components of all the releases, the errors are reported with their position
+func validateReleases(data []byte) error {
+	var document yaml.Node
+	err := yaml.Unmarshal(data, &document)
+	if err != nil {
+		return err
+	}
+	if len(document.Content) == 0 {
+		return nil
+	}
+	root := document.Content[0]
+
+	var errs []error
+	for _, versions := range mappingValues(root, "versions") {
+		errs = append(errs, validateVersions(versions)...)
+	}
+	for _, channels := range mappingValues(root, "channels") {
+		for i := 1; i < len(channels.Content); i += 2 {
+			// The stable channel releases are the versions, a stable channel would never be used
+			if channels.Content[i-1].Value == defaultChannel {
+				errs = append(errs, nodeError(channels.Content[i-1], "channel %s is the versions releases", defaultChannel))
+				continue
+			}
+			errs = append(errs, validateVersions(channels.Content[i])...)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateVersions checks the components of the releases mapping (version -> components)
+func validateVersions(versions *yaml.Node) []error {
+	var errs []error
+	for i := 1; i < len(versions.Content); i += 2 {
+		version := versions.Content[i-1].Value
+		names := make(map[string]int)
+		for _, node := range versions.Content[i].Content {
+			var component Component
+			err := node.Decode(&component)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			if component.Name == "" {
+				errs = append(errs, nodeError(node, "release %s: component name is missing", version))
+				continue
+			}
+			if line, ok := names[component.Name]; ok {
+				errs = append(errs, nodeError(node, "release %s: duplicate component %s (first defined line %d)", version, component.Name, line))
+			}
+			names[component.Name] = node.Line
+
+			if component.Source != nil {
+				err = component.Source.Validate()
+				if err == nil && isVersionPattern(component.Version) {
+					err = fmt.Errorf("version pattern %s cannot be installed from a source", component.Version)
+				}
+				if err != nil {
+					errs = append(errs, nodeError(node, "release %s: component %s: %s", version, component.Name, err))
+				}
+			}
+
+			for _, expression := range component.Tags {
+				_, err = evalTagExpression(expression, nil)
+				if err != nil {
+					errs = append(errs, nodeError(node, "release %s: component %s: %s", version, component.Name, err))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// mappingValues returns the values of the key in the mapping node
+func mappingValues(mapping *yaml.Node, key string) []*yaml.Node {
+	var values []*yaml.Node
+	for i := 1; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i-1].Value == key {
+			values = append(values, mapping.Content[i])
+		}
+	}
+	return values
+}
+
+func nodeError(node *yaml.Node, format string, args ...any) error {
+	return fmt.Errorf("line %d, column %d: %s", node.Line, node.Column, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReleasesValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases string
+		expected string
+	}{
+		{
+			name: "valid",
+			releases: `versions:
+  1.31.2:
+    - name: containerd
+      version: 1.7.22
+      tags: [runtime, gpu]
+    - name: kubelet
+`,
+		},
+		{
+			name: "unknown field",
+			releases: `versions:
+  1.31.2:
+    - name: containerd
+      verison: 1.7.22
+`,
+			expected: "line 4: field verison not found",
+		},
+		{
+			name: "missing name",
+			releases: `versions:
+  1.31.2:
+    - version: 1.7.22
+`,
+			expected: "line 3, column 7: release 1.31.2: component name is missing",
+		},
+		{
+			name: "duplicate component",
+			releases: `channels:
+  beta:
+    1.32.0:
+      - name: kubelet
+      - name: kubelet
+`,
+			expected: "line 5, column 9: release 1.32.0: duplicate component kubelet (first defined line 4)",
+		},
+		{
+			name: "invalid tag",
+			releases: `versions:
+  1.31.2:
+    - name: containerd
+      tags: ["GPU !"]
+`,
+			expected: `component containerd: invalid tag "GPU" in expression "GPU !"`,
+		},
+		{
+			name: "valid source",
+			releases: `versions:
+  1.31.2:
+    - name: containerd
+      version: 1.7.23-hotfix1
+      source:
+        url: https://hotfixes.example.com/containerd
+        sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+        dst: /usr/local/bin/containerd
+        restart: [containerd]
+`,
+		},
+		{
+			name: "source without digest",
+			releases: `versions:
+  1.31.2:
+    - name: containerd
+      version: 1.7.23-hotfix1
+      source:
+        url: https://hotfixes.example.com/containerd
+        dst: /usr/local/bin/containerd
+`,
+			expected: `component containerd: invalid source sha256 ""`,
+		},
+		{
+			name: "source with version pattern",
+			releases: `versions:
+  1.31.2:
+    - name: containerd
+      version: 1.7.x
+      source:
+        url: https://hotfixes.example.com/containerd
+        sha256: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+        dst: /usr/local/bin/containerd
+`,
+			expected: "version pattern 1.7.x cannot be installed from a source",
+		},
+		{
+			name: "stable channel",
+			releases: `versions:
+  1.31.2:
+    - name: kubelet
+      version: 1.31.2
+channels:
+  stable:
+    1.31.2:
+      - name: kubelet
+        version: 1.31.3
+`,
+			expected: "line 6, column 3: channel stable is the versions releases",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var releases Releases
+			err := unmarshalStrict([]byte(tt.releases), &releases)
+			if err == nil {
+				err = validateReleases([]byte(tt.releases))
+			}
+			if tt.expected == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("error = %v, want %q", err, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// upgradeVerificationTimeout is the maximum time to wait for the node to be healthy after an upgrade
+const upgradeVerificationTimeout = 5 * time.Minute
+
+// verifiedServices are the services which must be active after an upgrade
+var verifiedServices = []string{"containerd", "kubelet"}
+
+// verifyNodeHealth waits for the node to be healthy after an upgrade: services active,
+// node Ready and critical DaemonSets pods (namespace/name) running on the node
+func (c *Controller) verifyNodeHealth(ctx context.Context, criticalDaemonSets []string) error {
+	var lastErr error
+	err := wait.PollUntilContextTimeout(ctx, 5*time.Second, upgradeVerificationTimeout, true, func(ctx context.Context) (bool, error) {
+		lastErr = c.checkNodeHealth(ctx, criticalDaemonSets)
+		if lastErr != nil {
+			c.logger.Info("Waiting for node to be healthy", slog.Any("reason", lastErr))
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("node not healthy after %s: %w", upgradeVerificationTimeout, lastErr)
+	}
+
+	return nil
+}
+
+func (c *Controller) checkNodeHealth(ctx context.Context, criticalDaemonSets []string) error {
+	// Check the services are active
+	for _, service := range verifiedServices {
+		cmd := commandContext(ctx, "/usr/bin/systemctl", "is-active", "--quiet", service)
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("service %s is not active", service)
+		}
+	}
+
+	// Check the node is Ready
+	node, err := c.client.CoreV1().Nodes().Get(ctx, c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", c.nodeName, err)
+	}
+	ready := slices.ContainsFunc(node.Status.Conditions, func(condition corev1.NodeCondition) bool {
+		return condition.Type == corev1.NodeReady && condition.Status == corev1.ConditionTrue
+	})
+	if !ready {
+		return fmt.Errorf("node %s is not ready", c.nodeName)
+	}
+
+	if len(criticalDaemonSets) == 0 {
+		return nil
+	}
+
+	// Check the critical DaemonSets pods running on the node are ready
+	pods, err := c.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("spec.nodeName=%s", c.nodeName),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list pods on node %s: %w", c.nodeName, err)
+	}
+
+	for _, daemonSet := range criticalDaemonSets {
+		namespace, name, found := strings.Cut(daemonSet, "/")
+		if !found {
+			return fmt.Errorf("invalid critical DaemonSet %q, expected namespace/name", daemonSet)
+		}
+
+		podReady := slices.ContainsFunc(pods.Items, func(pod corev1.Pod) bool {
+			owner := metav1.GetControllerOf(&pod)
+			if pod.Namespace != namespace || owner == nil || owner.Kind != "DaemonSet" || owner.Name != name {
+				return false
+			}
+			return slices.ContainsFunc(pod.Status.Conditions, func(condition corev1.PodCondition) bool {
+				return condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue
+			})
+		})
+		if !podReady {
+			return fmt.Errorf("DaemonSet %s pod is not ready", daemonSet)
+		}
+	}
+
+	return nil
+}
@@ -3,8 +3,15 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"math"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // JSON File template to store installed components versions
@@ -17,28 +24,108 @@ import (
 
 const versionsFile = "/etc/scw-k8s-versions.json"
 
+// stateDir is where the agent stores its local state (snapshots, ...)
+const stateDir = "/var/lib/scw-k8s-agent"
+
+// repoCacheDir is where the HTTP repositories manifest files are cached
+var repoCacheDir = filepath.Join(stateDir, "repo-cache")
+
+// versionsStore reads and writes the installed components versions file. The versions are cached
+// in memory until the file changes. The updates are serialized by a lock file between the concurrent
+// agent processes (installer and controller) and the file is replaced atomically, so it is never read
+// partially written.
+type versionsStore struct {
+	path string
+
+	mu       sync.Mutex
+	versions map[string]string
+	modTime  time.Time
+	size     int64
+}
+
+// installedVersions is the store shared by the installer and the controller
+var installedVersions = &versionsStore{path: versionsFile}
+
 func SetComponentVersion(component string, version string) error {
-	versions := make(map[string]string)
+	return installedVersions.Set(component, version)
+}
 
-	// Check if versions file exists
-	if info, err := os.Stat(versionsFile); err == nil && !info.IsDir() {
-		// File exists: read and unmarshal its content
-		jsonVersions, err := os.ReadFile(versionsFile)
-		if err != nil {
-			return fmt.Errorf("failed to read versions file: %w", err)
-		}
+// DeleteComponentVersion forgets the installed version of a component
+func DeleteComponentVersion(component string) error {
+	return installedVersions.Delete(component)
+}
+
+func GetComponentVersion(component string) (string, error) {
+	versions, err := installedVersions.List()
+	if err != nil {
+		return "", err
+	}
+
+	// Get component version, empty if not installed
+	return versions[component], nil
+}
+
+func ListComponentsVersions() (map[string]string, error) {
+	return installedVersions.List()
+}
+
+// List returns a copy of the installed components versions
+func (s *versionsStore) List() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	return maps.Clone(s.versions), nil
+}
+
+// Set sets the installed version of a component
+func (s *versionsStore) Set(component string, version string) error {
+	return s.update(func(versions map[string]string) {
+		versions[component] = version
+	})
+}
+
+// Delete removes the installed version of a component
+func (s *versionsStore) Delete(component string) error {
+	return s.update(func(versions map[string]string) {
+		delete(versions, component)
+	})
+}
+
+// update changes the installed versions and writes them
+func (s *versionsStore) update(change func(versions map[string]string)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Lock a separate file for the whole read-modify-write, the versions file itself is replaced
+	lock, err := os.OpenFile(hostPath(s.path+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open versions lock file: %w", err)
+	}
+	defer func() { _ = lock.Close() }()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("failed to lock versions file: %w", err)
+	}
 
-		err = json.Unmarshal(jsonVersions, &versions)
+	versions := make(map[string]string)
+	file, err := os.Open(hostPath(s.path))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open versions file: %w", err)
+	}
+	if err == nil {
+		versions, err = readVersions(file)
+		_ = file.Close()
 		if err != nil {
-			return fmt.Errorf("failed to unmarshal versions file: %w", err)
+			return err
 		}
-	} else if err != nil && !os.IsNotExist(err) {
-		// An error occurred while checking the file (other than it not existing)
-		return fmt.Errorf("failed to stat versions file: %w", err)
 	}
 
-	// Set component version
-	versions[component] = version
+	change(versions)
 
 	// Marshal the updated map to JSON
 	jsonVersions, err := json.Marshal(versions)
@@ -46,62 +133,81 @@ func SetComponentVersion(component string, version string) error {
 		return fmt.Errorf("failed to marshal versions: %w", err)
 	}
 
-	// Write the JSON back to the file
-	err = os.WriteFile(versionsFile, jsonVersions, 0644)
+	// Write a synced temporary file renamed over the versions file, so a crash never leaves it
+	// truncated
+	err = installContent(s.path, jsonVersions, "0644", "", "")
 	if err != nil {
 		return fmt.Errorf("failed to write versions file: %w", err)
 	}
+	err = syncDir(filepath.Dir(s.path))
+	if err != nil {
+		return fmt.Errorf("failed to sync versions directory: %w", err)
+	}
+
+	// Update the cache with the written versions
+	info, err := os.Stat(hostPath(s.path))
+	if err != nil {
+		return fmt.Errorf("failed to stat versions file: %w", err)
+	}
+	s.versions, s.modTime, s.size = versions, info.ModTime(), info.Size()
 
 	return nil
 }
 
-func GetComponentVersion(component string) (string, error) {
-	versions := make(map[string]string)
+// refresh reads the versions file again if it changed since it was cached, the file is always
+// replaced by a rename so it is never read partially written
+func (s *versionsStore) refresh() error {
+	info, err := os.Stat(hostPath(s.path))
+	if os.IsNotExist(err) {
+		s.versions, s.modTime, s.size = make(map[string]string), time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat versions file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("versions file %s is a directory", s.path)
+	}
+	if s.versions != nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil
+	}
 
-	// Check if versions file exists
-	if info, err := os.Stat(versionsFile); err == nil && !info.IsDir() {
-		// File exists: read and unmarshal its content
-		jsonVersions, err := os.ReadFile(versionsFile)
-		if err != nil {
-			return "", fmt.Errorf("failed to read versions file: %w", err)
-		}
+	file, err := os.Open(hostPath(s.path))
+	if err != nil {
+		return fmt.Errorf("failed to open versions file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
 
-		err = json.Unmarshal(jsonVersions, &versions)
-		if err != nil {
-			return "", fmt.Errorf("failed to unmarshal versions file: %w", err)
-		}
-	} else if err != nil && !os.IsNotExist(err) {
-		// An error occurred while checking the file (other than it not existing)
-		return "", fmt.Errorf("failed to stat versions file: %w", err)
+	versions, err := readVersions(file)
+	if err != nil {
+		return err
 	}
 
-	// Get component version
-	version, ok := versions[component]
-	if !ok {
-		return "", nil
+	// Stat the opened file, it may have been replaced since the first stat
+	info, err = file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat versions file: %w", err)
 	}
+	s.versions, s.modTime, s.size = versions, info.ModTime(), info.Size()
 
-	return version, nil
+	return nil
 }
 
-func ListComponentsVersions() (map[string]string, error) {
+// readVersions reads and unmarshals the versions from the file, an empty file has no versions
+func readVersions(file *os.File) (map[string]string, error) {
 	versions := make(map[string]string)
 
-	// Check if versions file exists
-	if info, err := os.Stat(versionsFile); err == nil && !info.IsDir() {
-		// File exists: read and unmarshal its content
-		jsonVersions, err := os.ReadFile(versionsFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read versions file: %w", err)
-		}
+	jsonVersions, err := io.ReadAll(io.NewSectionReader(file, 0, math.MaxInt64))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read versions file: %w", err)
+	}
+	if len(jsonVersions) == 0 {
+		return versions, nil
+	}
 
-		err = json.Unmarshal(jsonVersions, &versions)
-		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal versions file: %w", err)
-		}
-	} else if err != nil && !os.IsNotExist(err) {
-		// An error occurred while checking the file (other than it not existing)
-		return nil, fmt.Errorf("failed to stat versions file: %w", err)
+	err = json.Unmarshal(jsonVersions, &versions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal versions file: %w", err)
 	}
 
 	return versions, nil
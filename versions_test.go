@@ -1,6 +1,9 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -76,3 +79,72 @@ func TestTrimVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestVersionsStore(t *testing.T) {
+	store := &versionsStore{path: filepath.Join(t.TempDir(), "versions.json")}
+
+	// No file yet
+	versions, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("List() = %v, want empty", versions)
+	}
+
+	// Versions set by the store
+	for component, version := range map[string]string{"containerd": "1.7.22", "kubelet": "1.31.2"} {
+		err = store.Set(component, version)
+		if err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	versions, err = store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	expected := map[string]string{"containerd": "1.7.22", "kubelet": "1.31.2"}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Errorf("List() = %v, want %v", versions, expected)
+	}
+
+	// Versions written by another process
+	err = os.WriteFile(store.path, []byte(`{"containerd":"1.7.23"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err = store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	expected = map[string]string{"containerd": "1.7.23"}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Errorf("List() = %v, want %v", versions, expected)
+	}
+
+	// Version deleted, the component is not listed anymore
+	err = store.Delete("containerd")
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	versions, err = store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if _, found := versions["containerd"]; found {
+		t.Errorf("List() = %v, want containerd deleted", versions)
+	}
+
+	// The file is replaced by a rename, no temporary file is left
+	entries, err := os.ReadDir(filepath.Dir(store.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"versions.json", "versions.json.lock"}) {
+		t.Errorf("files = %v, want the versions and lock files only", names)
+	}
+}